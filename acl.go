@@ -0,0 +1,98 @@
+package gochinadns
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Actions on queries of clients denied by the client ACL, see WithAllowedClients.
+const (
+	ACLRefused = "refused" //answer REFUSED, so that clients know they are not served
+	ACLDrop    = "drop"    //answer nothing, as if nothing listens
+)
+
+// clientACL allows queries of clients by their addresses. All methods are no-op on a nil *clientACL.
+type clientACL struct {
+	allowed *cidrSet //nil to allow all clients which are not denied
+	denied  *cidrSet
+}
+
+// newClientACL returns an ACL allowing clients in allowed, or all of them if it's empty, except those in denied.
+// It returns nil if both are empty.
+func newClientACL(allowed, denied []string) (*clientACL, error) {
+	allowedSet, err := parseClientCIDRs(allowed, "allowed")
+	if err != nil {
+		return nil, err
+	}
+	deniedSet, err := parseClientCIDRs(denied, "denied")
+	if err != nil {
+		return nil, err
+	}
+	a := new(clientACL)
+	if allowedSet.Len() > 0 {
+		a.allowed = allowedSet
+	}
+	if deniedSet.Len() > 0 {
+		a.denied = deniedSet
+	}
+	if a.allowed == nil && a.denied == nil {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// trimCIDRs returns cidrs without spaces and empty ones, such as of an empty flag.
+func trimCIDRs(cidrs []string) []string {
+	var trimmed []string
+	for _, cidr := range cidrs {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			trimmed = append(trimmed, cidr)
+		}
+	}
+	return trimmed
+}
+
+// allow reports whether the client at ip is allowed. Denied clients are denied even if they are allowed as well,
+// and clients of unknown addresses are denied if only some clients are allowed.
+func (a *clientACL) allow(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil {
+		return a.allowed == nil
+	}
+	if denied, _ := a.denied.Contains(ip); denied {
+		return false
+	}
+	if a.allowed == nil {
+		return true
+	}
+	allowed, _ := a.allowed.Contains(ip)
+	return allowed
+}
+
+// denied answers req by the ACL action if its client is denied by the client ACL, and reports whether it is.
+func (s *Server) denied(w dns.ResponseWriter, req *dns.Msg) bool {
+	if s.acl == nil {
+		return false
+	}
+	ip, _ := addrIPPort(w.RemoteAddr())
+	if s.acl.allow(ip) {
+		return false
+	}
+	start := time.Now()
+	o := s.options()
+	s.stats.denied.Add(1)
+	s.metrics.observeDenied(o.ACLAction)
+	if o.ACLAction == ACLDrop || len(req.Question) != 1 {
+		return true
+	}
+	reply := new(dns.Msg)
+	reply.SetRcode(req, dns.RcodeRefused)
+	s.respond(w, reply, nil)
+	s.finishQuery(w, req, reply, &queryResult{path: pathDenied, reason: reasonDenied}, start)
+	return true
+}
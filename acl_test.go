@@ -0,0 +1,73 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientACL(t *testing.T) {
+	acl, err := newClientACL([]string{"192.168.1.0/24", "::1"}, []string{"192.168.1.13"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"192.168.1.10": true,
+		"::1":          true,
+		"192.168.1.13": false,
+		"10.0.0.1":     false,
+		"2001:db8::1":  false,
+	} {
+		if got := acl.allow(net.ParseIP(ip)); got != want {
+			t.Errorf("allow(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if acl.allow(nil) {
+		t.Error("clients of unknown addresses should be denied if only some clients are allowed")
+	}
+
+	deny, err := newClientACL(nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deny.allow(net.ParseIP("10.1.2.3")) || !deny.allow(net.ParseIP("192.168.1.1")) || !deny.allow(nil) {
+		t.Error("clients which are not denied should be allowed without an allow list")
+	}
+
+	if acl, err := newClientACL(trimCIDRs([]string{""}), nil); err != nil || acl != nil {
+		t.Errorf("newClientACL() of no CIDRs = %v, %v, want nil", acl, err)
+	}
+	if _, err := newClientACL([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("newClientACL should fail with an invalid CIDR")
+	}
+}
+
+func TestDenied(t *testing.T) {
+	for _, action := range []string{ACLRefused, ACLDrop} {
+		// explainWriter is a client at 127.0.0.1.
+		s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true),
+			WithAllowedClients("127.0.0.0/8"), WithDeniedClients("127.0.0.1"), WithACLAction(action))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("version.bind.", dns.TypeTXT)
+		req.Question[0].Qclass = dns.ClassCHAOS
+		w := new(explainWriter)
+		s.Serve(w, req)
+		switch {
+		case action == ACLDrop && w.reply != nil:
+			t.Errorf("denied query is answered %v, want no reply", w.reply)
+		case action == ACLRefused && (w.reply == nil || w.reply.Rcode != dns.RcodeRefused):
+			t.Errorf("denied query is answered %v, want REFUSED", w.reply)
+		}
+		if n := s.Stats().Denied; n != 1 {
+			t.Errorf("Stats().Denied = %d, want 1", n)
+		}
+	}
+
+	if _, err := NewServer(WithACLAction("ignore")); err == nil {
+		t.Error("NewServer should fail with an unknown ACL action")
+	}
+}
@@ -0,0 +1,340 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// newAdminHandler serves the admin HTTP API:
+//
+//	GET  /healthz                    ok if the process is alive
+//	GET  /version                    version, commit and build date of the server
+//	GET  /readyz                     ok if listening, lists are loaded and an upstream is responsive
+//	GET  /stats                      runtime statistics
+//	GET  /config                     effective configuration
+//	GET  /explain?name=X&type=T      answer a query of X and type T (A by default), and explain every step
+//	GET  /startup                    per resolver and protocol results of the last test of resolvers
+//	GET  /top?n=N                    top N domains, blocked domains and clients in the last hour
+//	GET  /queries?n=N                N latest queries, with WithRecentQueries
+//	GET  /pollution?n=N              pollution per heuristic and the top N polluted domains
+//	GET  /pollution/learned          polluted domains seen so far, as a domain list
+//	POST /sync                       merge the state of a peer, and reply the state of the server, see WithPeers
+//	POST /reload                     reload lists and config files, see Reload
+//	POST /profile?name=X             switch to profile X, or back to the configured one if X is empty
+//	POST /resolvers/disable?addr=X   stop querying resolver X
+//	POST /resolvers/enable?addr=X    resume querying resolver X
+//	POST /resolvers/add?schema=X     query resolver X, in the format of -s. Add trusted=true for a trusted resolver.
+//	POST /resolvers/remove?addr=X    stop querying resolver X and forget it
+func (s *Server) newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, GetBuildInfo())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.Stats())
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.Config())
+	})
+	mux.HandleFunc("/explain", func(w http.ResponseWriter, r *http.Request) {
+		qtype := dns.TypeA
+		if t := r.FormValue("type"); t != "" {
+			var ok bool
+			if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+				http.Error(w, fmt.Sprintf("unknown query type [%s]", t), http.StatusBadRequest)
+				return
+			}
+		}
+		ex, err := s.Explain(r.FormValue("name"), qtype)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.writeJSON(w, ex)
+	})
+	mux.HandleFunc("/startup", func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, s.StartupReport())
+	})
+	mux.HandleFunc("/top", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.FormValue("n"))
+		if err != nil || n <= 0 {
+			n = 10
+		}
+		s.writeJSON(w, s.TopStats(n))
+	})
+	mux.HandleFunc("/queries", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.FormValue("n"))
+		if err != nil || n <= 0 {
+			n = 100
+		}
+		s.writeJSON(w, s.RecentQueries(n))
+	})
+	mux.HandleFunc("/pollution", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.FormValue("n"))
+		if err != nil || n <= 0 {
+			n = 100
+		}
+		s.writeJSON(w, s.PollutionStats(n))
+	})
+	mux.HandleFunc("/pollution/learned", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, domain := range s.LearnedPolluted() {
+			fmt.Fprintln(w, domain)
+		}
+	})
+	mux.HandleFunc("/sync", s.serveSync)
+	mux.HandleFunc("/reload", adminPost(s.log, func(w http.ResponseWriter, r *http.Request) error {
+		return s.Reload()
+	}))
+	mux.HandleFunc("/profile", adminPost(s.log, func(w http.ResponseWriter, r *http.Request) error {
+		return s.SwitchProfile(r.FormValue("name"))
+	}))
+	mux.HandleFunc("/resolvers/disable", adminPost(s.log, func(w http.ResponseWriter, r *http.Request) error {
+		return s.DisableResolver(r.FormValue("addr"))
+	}))
+	mux.HandleFunc("/resolvers/enable", adminPost(s.log, func(w http.ResponseWriter, r *http.Request) error {
+		return s.EnableResolver(r.FormValue("addr"))
+	}))
+	mux.HandleFunc("/resolvers/add", adminPost(s.log, func(w http.ResponseWriter, r *http.Request) error {
+		trusted, _ := strconv.ParseBool(r.FormValue("trusted"))
+		return s.AddResolver(r.FormValue("schema"), trusted)
+	}))
+	mux.HandleFunc("/resolvers/remove", adminPost(s.log, func(w http.ResponseWriter, r *http.Request) error {
+		return s.RemoveResolver(r.FormValue("addr"))
+	}))
+	return mux
+}
+
+// adminPost allows POST requests only, and replies `ok` or the error of h.
+func adminPost(log Logger, h func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := h(w, r); err != nil {
+			log.WithError(err).Warn("Admin request failed: ", r.URL)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		s.log.WithError(err).Error("Fail to write admin response.")
+	}
+}
+
+// Ready returns nil if the server is started, the China route list is loaded and the latest lookup to any enabled resolver succeeded,
+// or an error telling why the server is not ready. With WithSkipStartupTest, resolvers not queried yet count as responsive,
+// since no lookup is made before the first query of a client.
+func (s *Server) Ready() error {
+	s.listenMu.Lock()
+	started := s.running != nil
+	s.listenMu.Unlock()
+	if !started {
+		return errors.New("server is not started")
+	}
+	o := s.options()
+	if o.ChinaCIDR.Len() == 0 {
+		return errors.New("China route list is not loaded")
+	}
+	for _, servers := range []resolverArray{o.TrustedServers, o.UntrustedServers} {
+		for _, server := range servers {
+			if s.isDisabled(server.GetAddr()) {
+				continue
+			}
+			health := s.stats.upstream(server.GetAddr())
+			if health.healthy() {
+				return nil
+			}
+			if _, ok := health.averageRTT(); ok && o.SkipStartupTest {
+				return nil
+			}
+		}
+	}
+	return errors.New("no upstream resolver is responsive")
+}
+
+// ReloadLists reloads the China route list, the IP blacklist and domain lists from their files,
+// and swaps them in atomically. Queries in flight keep using the old lists.
+func (s *Server) ReloadLists() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	fresh, err := s.buildOptions(s.optFuncs)
+	if err != nil {
+		return errors.Wrap(err, "fail to reload lists")
+	}
+
+	o := *s.options()
+	o.ChinaCIDR = fresh.ChinaCIDR
+	o.IPBlacklist = fresh.IPBlacklist
+	o.DomainBlacklist = fresh.DomainBlacklist
+	o.DomainPolluted = fresh.DomainPolluted
+	o.DomainBidiExempt = fresh.DomainBidiExempt
+	o.DomainRoutes, o.BogusNXDomain = fresh.DomainRoutes, fresh.BogusNXDomain
+	o.LocalZones = fresh.LocalZones
+	o.DHCPLeases, o.DHCPDomain = fresh.DHCPLeases, fresh.DHCPDomain
+	o.Files = fresh.Files
+	s.opts.Store(&o)
+	s.cache.Purge()
+	s.options().logger(logLists).Info("Lists reloaded.")
+	return nil
+}
+
+// DisableResolver stops querying the resolver at addr, until it's enabled again.
+func (s *Server) DisableResolver(addr string) error {
+	return s.setResolverDisabled(addr, true)
+}
+
+// EnableResolver resumes querying the resolver at addr.
+func (s *Server) EnableResolver(addr string) error {
+	return s.setResolverDisabled(addr, false)
+}
+
+// AddResolver starts querying the resolver of schema, in the format of -s, as a trusted or untrusted resolver.
+// Resolvers added or removed at runtime are reset by Reload without options.
+func (s *Server) AddResolver(schema string, trusted bool) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	o := *s.options()
+	r, err := schemaToResolver(schema, o.TCPOnly)
+	if err != nil {
+		return errors.Wrap(err, "Schema error")
+	}
+	if _, ok := s.findResolver(r.GetAddr()); ok {
+		return errors.Errorf("resolver [%s] already exists", r.GetAddr())
+	}
+
+	if trusted {
+		r.reason = "added as trusted by the admin API"
+		o.TrustedServers = append(resolverArray{}, o.TrustedServers...)
+		o.TrustedServers = append(o.TrustedServers, r)
+	} else {
+		r.reason = "added as untrusted by the admin API"
+		o.UntrustedServers = append(resolverArray{}, o.UntrustedServers...)
+		o.UntrustedServers = append(o.UntrustedServers, r)
+	}
+	o.normalizeMutation()
+	s.opts.Store(&o)
+	s.log.WithField("server", r.GetAddr()).WithField("trusted", trusted).Info("Resolver added.")
+	return nil
+}
+
+// RemoveResolver stops querying the resolver at addr, and forgets it.
+func (s *Server) RemoveResolver(addr string) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	addr = resolverAddr(addr)
+	if _, ok := s.findResolver(addr); !ok {
+		return errors.Errorf("unknown resolver [%s]", addr)
+	}
+
+	o := *s.options()
+	o.TrustedServers = removeResolver(o.TrustedServers, addr)
+	o.UntrustedServers = removeResolver(o.UntrustedServers, addr)
+	s.opts.Store(&o)
+	s.disabledMu.Lock()
+	delete(s.disabled, addr)
+	s.disabledMu.Unlock()
+	s.log.WithField("server", addr).Info("Resolver removed.")
+	return nil
+}
+
+// resolverAddr returns addr of a resolver with port 53 if it has no port. URLs of json resolvers are left as they are.
+func resolverAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil && !strings.Contains(addr, "://") {
+		return net.JoinHostPort(addr, "53")
+	}
+	return addr
+}
+
+// removeResolver returns a copy of servers without the resolver at addr.
+func removeResolver(servers resolverArray, addr string) resolverArray {
+	kept := make(resolverArray, 0, len(servers))
+	for _, server := range servers {
+		if server.GetAddr() != addr {
+			kept = append(kept, server)
+		}
+	}
+	return kept
+}
+
+func (s *Server) setResolverDisabled(addr string, disabled bool) error {
+	addr = resolverAddr(addr)
+	if _, ok := s.findResolver(addr); !ok {
+		return errors.Errorf("unknown resolver [%s]", addr)
+	}
+
+	s.disabledMu.Lock()
+	state := UpstreamEnabled
+	if disabled {
+		s.disabled[addr] = struct{}{}
+		s.log.WithField("server", addr).Warn("Resolver disabled.")
+		state = UpstreamDisabled
+	} else {
+		delete(s.disabled, addr)
+		s.log.WithField("server", addr).Info("Resolver enabled.")
+	}
+	s.disabledMu.Unlock()
+	s.events.upstreamState(addr, state, "", "")
+	return nil
+}
+
+func (s *Server) findResolver(addr string) (Resolver, bool) {
+	o := s.options()
+	for _, servers := range []resolverArray{o.TrustedServers, o.UntrustedServers} {
+		for _, server := range servers {
+			if server.GetAddr() == addr {
+				return server, true
+			}
+		}
+	}
+	return Resolver{}, false
+}
+
+func (s *Server) isDisabled(addr string) bool {
+	s.disabledMu.RLock()
+	defer s.disabledMu.RUnlock()
+	_, ok := s.disabled[addr]
+	return ok
+}
+
+// available returns servers which are neither disabled nor hijacked.
+func (s *Server) available(servers resolverArray) resolverArray {
+	s.disabledMu.RLock()
+	if len(s.disabled) > 0 {
+		enabled := make(resolverArray, 0, len(servers))
+		for _, server := range servers {
+			if _, ok := s.disabled[server.GetAddr()]; !ok {
+				enabled = append(enabled, server)
+			}
+		}
+		servers = enabled
+	}
+	s.disabledMu.RUnlock()
+	return s.health.filter(s.breaker.filter(s.canary.filter(servers)))
+}
@@ -0,0 +1,105 @@
+package gochinadns
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// adminAuth requires requests of h to carry the bearer token of WithAdminToken, except liveness probes of /healthz.
+// The token is read per request, so that it changes on reload. Client certificates are verified by TLS before.
+func (s *Server) adminAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := s.options().AdminToken
+		if token == "" || r.URL.Path == "/healthz" || isBearer(r, token) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		s.log.Debugf("Reject unauthorized admin request from %s: %s.", r.RemoteAddr, r.URL)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chinadns"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// isBearer reports whether r is authorized with the bearer token, which is compared in constant time.
+func isBearer(r *http.Request, token string) bool {
+	const scheme = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[len(scheme):])), []byte(token)) == 1
+}
+
+// newAdminTLS returns the TLS config of the admin HTTP API of WithAdminTLS, or nil if it's served in plain HTTP.
+func newAdminTLS(o *serverOptions, logger Logger) (*tls.Config, error) {
+	if o.AdminCert == "" {
+		if o.AdminClientCA != "" {
+			return nil, errors.New("client certificates of the admin API require its TLS certificate")
+		}
+		return nil, nil
+	}
+	cert := &adminCert{certFile: o.AdminCert, keyFile: o.AdminKey, log: logger}
+	if err := cert.load(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{GetCertificate: cert.get, MinVersion: tls.VersionTLS12}
+	if o.AdminClientCA != "" {
+		pem, err := ioutil.ReadFile(o.AdminClientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "fail to read client CA of the admin API")
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate in client CA of the admin API [%s]", o.AdminClientCA)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// adminCert is the certificate of the admin HTTP API, which is loaded again once its file changes,
+// so that renewed certificates apply without a restart.
+type adminCert struct {
+	certFile, keyFile string
+	log               Logger
+
+	mu      sync.Mutex
+	modTime time.Time
+	cert    *tls.Certificate
+}
+
+func (c *adminCert) load() error {
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		return errors.Wrap(err, "fail to stat certificate of the admin API")
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "fail to load certificate of the admin API")
+	}
+	c.modTime, c.cert = info.ModTime(), &cert
+	return nil
+}
+
+func (c *adminCert) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info, err := os.Stat(c.certFile); err == nil && !info.ModTime().Equal(c.modTime) {
+		// the old certificate is kept if the new one is half written or broken.
+		if err := c.load(); err != nil {
+			c.log.WithError(err).Warn("Keep the old certificate of the admin API.")
+		} else {
+			c.log.Info("Certificate of the admin API reloaded.")
+		}
+	}
+	return c.cert, nil
+}
@@ -0,0 +1,176 @@
+package gochinadns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a certificate of ip signed by parent, or a self-signed CA if parent is nil, in PEM.
+func newTestCert(t *testing.T, parent *tls.Certificate, ip string) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: ip},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP(ip)},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPEM, keyPEM
+}
+
+func TestAdminAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caPEM, _ := newTestCert(t, nil, "127.0.0.1")
+	_, serverPEM, serverKey := newTestCert(t, &ca, "127.0.0.1")
+	client, _, _ := newTestCert(t, &ca, "127.0.0.1")
+	stranger, _, _ := newTestCert(t, nil, "127.0.0.1")
+	files := map[string][]byte{"ca.pem": caPEM, "cert.pem": serverPEM, "key.pem": serverKey}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTestDomains(), WithAdminListen(addr), WithAdminToken("secret"),
+		WithAdminTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	get := func(cert *tls.Certificate, path, token string) (int, error) {
+		tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+		defer tr.CloseIdleConnections()
+		if cert != nil {
+			tr.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		req, _ := http.NewRequest(http.MethodGet, "https://"+addr+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := (&http.Client{Transport: tr, Timeout: time.Second}).Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	for _, tt := range []struct {
+		cert  *tls.Certificate
+		path  string
+		token string
+		code  int
+	}{
+		{&client, "/config", "secret", http.StatusOK},
+		{&client, "/config", "", http.StatusUnauthorized},
+		{&client, "/config", "wrong", http.StatusUnauthorized},
+		{&client, "/healthz", "", http.StatusOK},
+	} {
+		code, err := get(tt.cert, tt.path, tt.token)
+		if err != nil || code != tt.code {
+			t.Errorf("GET %s with token %q = %d, %v, want %d", tt.path, tt.token, code, err, tt.code)
+		}
+	}
+	for name, cert := range map[string]*tls.Certificate{"no client certificate": nil, "an unknown CA": &stranger} {
+		if _, err := get(cert, "/healthz", "secret"); err == nil {
+			t.Errorf("GET with %s should fail", name)
+		}
+	}
+	if auth := s.Config().AdminAuth; len(auth) != 3 {
+		t.Errorf("Config().AdminAuth = %v, want bearer-token, tls and client-cert", auth)
+	}
+
+	if err := WithAdminTLS(filepath.Join(dir, "cert.pem"), "", "")(new(serverOptions)); err == nil {
+		t.Error("Admin TLS without a private key should fail")
+	}
+	if _, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTestDomains(), WithAdminListen(addr),
+		WithAdminTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "ca.pem"), "")); err == nil {
+		t.Error("Admin TLS with a mismatched private key should fail")
+	}
+}
+
+func TestAdminTokenReload(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithAdminToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.adminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(token string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/config", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := get("secret"); code != http.StatusOK {
+		t.Fatalf("GET with the token = %d, want %d", code, http.StatusOK)
+	}
+
+	// a rotated token takes effect on reload, and the old one is rejected.
+	if err := s.Reload(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithAdminToken("rotated")); err != nil {
+		t.Fatal(err)
+	}
+	if code := get("secret"); code != http.StatusUnauthorized {
+		t.Errorf("GET with the old token after reload = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := get("rotated"); code != http.StatusOK {
+		t.Errorf("GET with the rotated token after reload = %d, want %d", code, http.StatusOK)
+	}
+}
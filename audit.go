@@ -0,0 +1,67 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Events of the audit log.
+const (
+	auditBlocked  = "blocked"  //query of a domain in the domain blacklist
+	auditPolluted = "polluted" //answer rejected as polluted
+)
+
+// AuditEntry is a line of the audit log.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Client   string    `json:"client,omitempty"`
+	Domain   string    `json:"domain"`
+	QType    string    `json:"qtype"`
+	Rule     string    `json:"rule"` //the blacklisted domain matched, or the pollution heuristic fired
+	Resolver string    `json:"resolver,omitempty"`
+	IPs      []string  `json:"ips,omitempty"`
+}
+
+// auditLogger appends one JSON object per blocked query or rejected answer to a file.
+// All methods are no-op on a nil *auditLogger.
+type auditLogger struct {
+	log Logger
+
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newAuditLogger(path string, log Logger) (*auditLogger, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to open audit log")
+	}
+	return &auditLogger{log: log, file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (l *auditLogger) Log(entry *AuditEntry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(entry); err != nil {
+		l.log.WithError(err).Error("Fail to write audit log.")
+	}
+}
+
+// Close closes the audit log. It does nothing if l is nil.
+func (l *auditLogger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,27 @@
+package gochinadns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// udpSession is the address of a client which sends a UDP packet, with the local address the packet is sent to,
+// so that the reply is sent from the same address on hosts with more than one.
+type udpSession struct {
+	*net.UDPAddr
+	local net.IP
+}
+
+// listenAndServe binds srv and serves on it, reading and writing UDP packets in batches of at most batch packets.
+func listenAndServe(srv *dns.Server, batch int) error {
+	if srv.Net != "udp" || batch <= 1 {
+		return srv.ListenAndServe()
+	}
+	pc, err := listenBatchUDP(srv.Addr, srv.ReusePort, batch)
+	if err != nil {
+		return err
+	}
+	srv.PacketConn = pc
+	return srv.ActivateAndServe()
+}
@@ -0,0 +1,221 @@
+//go:build linux
+// +build linux
+
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// supportsUDPBatch is whether UDP packets can be read and written in batches on this platform.
+const supportsUDPBatch = true
+
+// _batchPacketSize is the size of buffers to read packets into. Longer queries are truncated, as they are by dns.Server.
+const _batchPacketSize = dns.DefaultMsgSize
+
+// _oobSize is the size of buffers to read the destination address of packets into, which fit both IPv4 and IPv6 ones.
+var _oobSize = func() int {
+	oob4 := ipv4.NewControlMessage(ipv4.FlagDst | ipv4.FlagInterface)
+	oob6 := ipv6.NewControlMessage(ipv6.FlagDst | ipv6.FlagInterface)
+	if len(oob4) > len(oob6) {
+		return len(oob4)
+	}
+	return len(oob6)
+}()
+
+var errBatchConnClosed = errors.New("use of closed batch connection")
+
+// listenBatchUDP binds addr with SO_REUSEPORT if reusePort is set, and returns a connection reading and writing
+// packets in batches of at most batch packets.
+func listenBatchUDP(addr string, reusePort bool, batch int) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = func(network, address string, rc syscall.RawConn) error {
+			var err error
+			if e := rc.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); e != nil {
+				return e
+			}
+			return err
+		}
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newBatchConn(pc.(*net.UDPConn), batch)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// batchConn is a net.PacketConn which reads UDP packets in batches with recvmmsg, and writes them in batches
+// with sendmmsg. Reads are buffered, so ReadFrom must be called by one goroutine, as dns.Server does.
+// Writes of concurrent goroutines are sent together.
+type batchConn struct {
+	*net.UDPConn
+	pc *ipv4.PacketConn
+
+	reads []ipv4.Message //packets of the last batch read
+	n     int            //number of packets in reads
+	next  int            //index of the next packet in reads to return
+
+	writes    chan *batchWrite
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// batchWrite is a packet to write, with the result of writing it.
+type batchWrite struct {
+	msg  ipv4.Message
+	done chan error
+}
+
+var batchWrites = sync.Pool{
+	New: func() interface{} {
+		return &batchWrite{msg: ipv4.Message{Buffers: make([][]byte, 1)}, done: make(chan error, 1)}
+	},
+}
+
+func newBatchConn(conn *net.UDPConn, batch int) (*batchConn, error) {
+	// destination addresses of packets are read for replies to be sent from, as dns.Server does.
+	err6 := ipv6.NewPacketConn(conn).SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true)
+	err4 := ipv4.NewPacketConn(conn).SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true)
+	if err6 != nil && err4 != nil {
+		return nil, errors.Wrap(err4, "fail to read destination addresses")
+	}
+	c := &batchConn{
+		UDPConn: conn,
+		pc:      ipv4.NewPacketConn(conn),
+		reads:   make([]ipv4.Message, batch),
+		writes:  make(chan *batchWrite),
+		closed:  make(chan struct{}),
+	}
+	for i := range c.reads {
+		c.reads[i].Buffers = [][]byte{make([]byte, _batchPacketSize)}
+		c.reads[i].OOB = make([]byte, _oobSize)
+	}
+	go c.writeLoop(batch)
+	return c, nil
+}
+
+// ReadFrom returns the next packet of the last batch read, and reads another batch once all of them are returned.
+// The address returned is a *udpSession.
+func (c *batchConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.next == c.n {
+		n, err := c.pc.ReadBatch(c.reads, 0)
+		if err != nil {
+			c.n, c.next = 0, 0
+			return 0, nil, err
+		}
+		c.n, c.next = n, 0
+	}
+	m := &c.reads[c.next]
+	c.next++
+	addr, _ := m.Addr.(*net.UDPAddr)
+	return copy(b, m.Buffers[0][:m.N]), &udpSession{UDPAddr: addr, local: parseDst(m.OOB[:m.NN])}, nil
+}
+
+// WriteTo queues b to be written in the next batch, and waits until it's written.
+func (c *batchConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	w := batchWrites.Get().(*batchWrite)
+	defer batchWrites.Put(w)
+	w.msg.Buffers[0], w.msg.Addr, w.msg.OOB = b, addr, nil
+	if s, ok := addr.(*udpSession); ok {
+		w.msg.Addr, w.msg.OOB = s.UDPAddr, sourceOOB(s.local)
+	}
+	select {
+	case c.writes <- w:
+	case <-c.closed:
+		return 0, errBatchConnClosed
+	}
+	if err := <-w.done; err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeLoop writes packets queued by WriteTo, in batches of those queued meanwhile, until the connection is closed.
+func (c *batchConn) writeLoop(batch int) {
+	writes := make([]*batchWrite, 0, batch)
+	msgs := make([]ipv4.Message, batch)
+	for {
+		select {
+		case w := <-c.writes:
+			writes = append(writes[:0], w)
+		case <-c.closed:
+			return
+		}
+	QUEUED:
+		for len(writes) < batch {
+			select {
+			case w := <-c.writes:
+				writes = append(writes, w)
+			default:
+				break QUEUED
+			}
+		}
+
+		for i, w := range writes {
+			msgs[i] = w.msg
+		}
+		for sent := 0; sent < len(writes); {
+			n, err := c.pc.WriteBatch(msgs[sent:len(writes)], 0)
+			for _, w := range writes[sent : sent+n] {
+				w.done <- nil
+			}
+			sent += n
+			// sendmmsg fails only with the first packet it can't send, which is skipped.
+			if err != nil || n == 0 {
+				if err == nil {
+					err = syscall.EIO
+				}
+				writes[sent].done <- err
+				sent++
+			}
+		}
+	}
+}
+
+// Close closes the connection, and fails writes queued.
+func (c *batchConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.UDPConn.Close()
+}
+
+// parseDst returns the destination address of a packet in its control message, or nil if there is none.
+func parseDst(oob []byte) net.IP {
+	cm6 := new(ipv6.ControlMessage)
+	if cm6.Parse(oob) == nil && cm6.Dst != nil {
+		return cm6.Dst
+	}
+	cm4 := new(ipv4.ControlMessage)
+	if cm4.Parse(oob) == nil && cm4.Dst != nil {
+		return cm4.Dst
+	}
+	return nil
+}
+
+// sourceOOB returns the control message to send a packet from src, or nil to send it from any address.
+func sourceOOB(src net.IP) []byte {
+	if src == nil {
+		return nil
+	}
+	// the control message of IPv6 ignores IPv4 addresses, even on IPv6 sockets.
+	if src.To4() == nil {
+		return (&ipv6.ControlMessage{Src: src}).Marshal()
+	}
+	return (&ipv4.ControlMessage{Src: src}).Marshal()
+}
@@ -0,0 +1,150 @@
+package gochinadns
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestBatchConn(t *testing.T) {
+	pc, err := listenBatchUDP("127.0.0.1:0", true, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	const packets = 10
+	for i := 0; i < packets; i++ {
+		if _, err := client.WriteTo([]byte{byte(i)}, pc.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// packets are read in order across batches, and echoed concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < packets; i++ {
+		b := make([]byte, 16)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 || b[0] != byte(i) {
+			t.Fatalf("packet %d is %v", i, b[:n])
+		}
+		s, ok := addr.(*udpSession)
+		if !ok || s.String() != client.LocalAddr().String() || !s.local.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatalf("packet %d is from %v", i, addr)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pc.WriteTo(b[:n], addr); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	received := make(map[byte]bool)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < packets; i++ {
+		b := make([]byte, 16)
+		n, _, err := client.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received[b[0]] = n == 1
+	}
+	if len(received) != packets {
+		t.Errorf("received %d distinct packets, want %d", len(received), packets)
+	}
+
+	pc.Close()
+	if _, err := pc.WriteTo([]byte{0}, client.LocalAddr()); err == nil {
+		t.Error("WriteTo after Close should fail")
+	}
+}
+
+func TestUDPBatch(t *testing.T) {
+	addr := startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithUDPBatch(8),
+		WithTrustedResolvers("udp@"+addr), WithDelay(time.Second), WithTestDomains())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if _, ok := s.UDPServer.PacketConn.(*batchConn); !ok {
+		t.Fatalf("UDP server listens with %T, want *batchConn", s.UDPServer.PacketConn)
+	}
+
+	listen := s.UDPServer.PacketConn.LocalAddr().String()
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			reply, err := dns.Exchange(req, listen)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(reply.Answer) != 1 {
+				t.Errorf("got %d answers, want 1", len(reply.Answer))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestUDPBatchResponseRateLimit(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithUDPBatch(8), WithResponseRateLimit(1, 2),
+		WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if _, ok := s.UDPServer.PacketConn.(*batchConn); !ok {
+		t.Fatalf("UDP server listens with %T, want *batchConn", s.UDPServer.PacketConn)
+	}
+
+	// clients of batched sockets are limited like others.
+	cli := &dns.Client{Timeout: 300 * time.Millisecond}
+	listen := s.UDPServer.PacketConn.LocalAddr().String()
+	var replies []*dns.Msg
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("version.bind.", dns.TypeTXT)
+		req.Question[0].Qclass = dns.ClassCHAOS
+		reply, _, err := cli.Exchange(req, listen)
+		if err != nil && !isTimeout(err) {
+			t.Fatal(err)
+		}
+		replies = append(replies, reply)
+	}
+	if replies[0] == nil || len(replies[0].Answer) == 0 {
+		t.Errorf("first reply = %v, want an answer", replies[0])
+	}
+	if replies[1] != nil {
+		t.Errorf("second reply = %v, want it dropped", replies[1])
+	}
+	if replies[2] == nil || !replies[2].Truncated || len(replies[2].Answer) != 0 {
+		t.Errorf("third reply = %v, want it truncated", replies[2])
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package gochinadns
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// supportsUDPBatch is whether UDP packets can be read and written in batches on this platform.
+// Only Linux has recvmmsg and sendmmsg.
+const supportsUDPBatch = false
+
+func listenBatchUDP(addr string, reusePort bool, batch int) (net.PacketConn, error) {
+	return nil, errors.New("batches of UDP packets are not supported on this platform")
+}
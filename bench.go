@@ -0,0 +1,113 @@
+package gochinadns
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// BenchDomains are sample domains to benchmark resolvers with, both in and out of China, some of which are polluted.
+var BenchDomains = []string{
+	"qq.com", "baidu.com", "taobao.com", "163.com", "bilibili.com",
+	"google.com", "youtube.com", "facebook.com", "twitter.com", "wikipedia.org", "github.com",
+}
+
+// BenchResult is the benchmark of a resolver. See Benchmark.
+type BenchResult struct {
+	Addr          string  `json:"addr"`
+	Schema        string  `json:"schema"` //the resolver in the format of WithResolvers
+	Trusted       bool    `json:"trusted"`
+	Queries       int     `json:"queries"`
+	LossRate      float64 `json:"loss_rate"`      //ratio of queries without a reply
+	PollutionRate float64 `json:"pollution_rate"` //ratio of replies with answers in the IP blacklist
+	LatencyP50    float64 `json:"latency_p50_ms"`
+	LatencyP90    float64 `json:"latency_p90_ms"`
+}
+
+// Benchmark queries A records of domains rounds times to every resolver, and ranks resolvers by pollution rate,
+// loss rate and then median latency. Resolvers are benchmarked in parallel, with a query at a time each.
+// Answers are polluted if they hit the IP blacklist, so set one by WithIPBlacklist to measure pollution.
+func (s *Server) Benchmark(domains []string, rounds int) []BenchResult {
+	o := s.options()
+	servers := append(append(resolverArray{}, o.TrustedServers...), o.UntrustedServers...)
+	results := make([]BenchResult, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server Resolver) {
+			defer wg.Done()
+			results[i] = s.benchmark(o, server, domains, rounds)
+			results[i].Trusted = i < len(o.TrustedServers)
+		}(i, server)
+	}
+	wg.Wait()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.PollutionRate != b.PollutionRate {
+			return a.PollutionRate < b.PollutionRate
+		}
+		if a.LossRate != b.LossRate {
+			return a.LossRate < b.LossRate
+		}
+		return a.LatencyP50 < b.LatencyP50
+	})
+	return results
+}
+
+func (s *Server) benchmark(o *serverOptions, server Resolver, domains []string, rounds int) BenchResult {
+	r := BenchResult{Addr: server.GetAddr(), Schema: server.schema()}
+	var (
+		rtts           []time.Duration
+		lost, polluted int
+		req            = new(dns.Msg)
+	)
+	for i := 0; i < rounds; i++ {
+		for _, name := range domains {
+			req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+			r.Queries++
+			reply, rtt, err := s.LookupMutated(s.ctx, req, server)
+			if err != nil {
+				lost++
+				continue
+			}
+			rtts = append(rtts, rtt)
+			for _, ip := range answerIPs(reply) {
+				if hit, _ := o.IPBlacklist.Contains(ip); hit {
+					polluted++
+					break
+				}
+			}
+		}
+	}
+	if r.Queries > 0 {
+		r.LossRate = float64(lost) / float64(r.Queries)
+	}
+	if len(rtts) > 0 {
+		r.PollutionRate = float64(polluted) / float64(len(rtts))
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		r.LatencyP50 = percentileMillis(rtts, 0.5)
+		r.LatencyP90 = percentileMillis(rtts, 0.9)
+	} else {
+		r.LossRate = 1
+	}
+	return r
+}
+
+// SuggestResolvers suggests trusted and untrusted resolvers from ranked results of Benchmark, in the format of
+// WithTrustedResolvers and WithResolvers: resolvers without pollution which answer at least half of the queries.
+func SuggestResolvers(results []BenchResult) (trusted, untrusted []string) {
+	for _, r := range results {
+		if r.PollutionRate > 0 || r.LossRate > 0.5 {
+			continue
+		}
+		if r.Trusted {
+			trusted = append(trusted, r.Schema)
+		} else {
+			untrusted = append(untrusted, r.Schema)
+		}
+	}
+	return
+}
@@ -0,0 +1,46 @@
+package gochinadns
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBenchmark(t *testing.T) {
+	f, err := ioutil.TempFile("", "iplist-*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("1.2.3.4\n")
+	f.Close()
+
+	clean, polluted := startTestUpstream(t, "5.6.7.8"), startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(
+		WithListenAddr("127.0.0.1:0"),
+		WithTimeout(200*time.Millisecond),
+		WithIPBlacklist(f.Name()),
+		WithTrustedResolvers("udp@"+polluted, "udp@"+clean, "tcp@"+clean+"?mutation=case"),
+		WithSkipStartupTest(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := s.Benchmark([]string{"example.com", "example.org"}, 2)
+	if len(results) != 2 {
+		t.Fatalf("Benchmark() = %+v, want 2 resolvers", results)
+	}
+	if r := results[0]; r.Addr != clean || r.Queries != 4 || r.LossRate != 0 || r.PollutionRate != 0 || !r.Trusted {
+		t.Errorf("first result = %+v, want the clean resolver", r)
+	}
+	if r := results[1]; r.Addr != polluted || r.PollutionRate != 1 {
+		t.Errorf("second result = %+v, want the polluted resolver", r)
+	}
+
+	trusted, untrusted := SuggestResolvers(results)
+	if want := []string{"udp@" + clean}; !reflect.DeepEqual(trusted, want) || len(untrusted) != 0 {
+		t.Errorf("SuggestResolvers() = %v, %v, want %v and none", trusted, untrusted, want)
+	}
+}
@@ -0,0 +1,192 @@
+package gochinadns
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// _breakerCheckInterval is how often resolvers with open circuits are checked for the end of their cooldown.
+const _breakerCheckInterval = time.Second
+
+// _defaultBreakerCooldown is the cooldown of circuit breakers whose threshold is set alone in a config file.
+const _defaultBreakerCooldown = 30 * time.Second
+
+// breaker stops sending queries to resolvers which fail too many lookups in a row, for a cooldown,
+// so that queries don't keep paying the timeout of a dead resolver. Once the cooldown is over,
+// the resolver is probed in the background, and used again if it answers.
+type breaker struct {
+	log       Logger
+	events    *eventHooks
+	threshold int           //consecutive failures to open a circuit
+	cooldown  time.Duration //how long an open circuit gets no queries before it's probed
+
+	mu       sync.RWMutex
+	circuits map[string]*circuit //by address of resolver
+	open     int                 //number of open circuits
+}
+
+// circuit is the state of a resolver for the breaker.
+type circuit struct {
+	failures int       //consecutive failures
+	open     bool      //whether the resolver gets no queries
+	until    time.Time //end of the cooldown of an open circuit
+	probing  bool      //whether a probe of an open circuit is in flight
+}
+
+func newBreaker(o *serverOptions, log Logger, events *eventHooks) *breaker {
+	return &breaker{
+		log:       log,
+		events:    events,
+		threshold: o.BreakerThreshold,
+		cooldown:  o.BreakerCooldown,
+		circuits:  make(map[string]*circuit),
+	}
+}
+
+// observe counts the result of a lookup, opening the circuit of the server at the threshold, or closing it on success.
+func (b *breaker) observe(server Resolver, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	c := b.circuits[server.GetAddr()]
+	if c == nil {
+		c = new(circuit)
+		b.circuits[server.GetAddr()] = c
+	}
+	logger := b.log.WithField("server", server)
+	var state string
+	switch {
+	case err == nil && c.open:
+		logger.Info("Resolver answers again. Close its circuit breaker.")
+		*c = circuit{}
+		b.open--
+		state = UpstreamCircuitClosed
+	case err == nil:
+		c.failures = 0
+	case c.open:
+		c.until = time.Now().Add(b.cooldown)
+	default:
+		if c.failures++; c.failures >= b.threshold {
+			logger.WithError(err).Warnf("Resolver fails %d lookups in a row. Stop querying it for %s.", c.failures, b.cooldown)
+			c.open, c.until = true, time.Now().Add(b.cooldown)
+			b.open++
+			state = UpstreamCircuitOpen
+		}
+	}
+	b.mu.Unlock()
+	switch state {
+	case UpstreamCircuitOpen:
+		b.events.upstreamState(server.GetAddr(), state, "", err.Error())
+	case UpstreamCircuitClosed:
+		b.events.upstreamState(server.GetAddr(), state, "", "")
+	}
+}
+
+// filter returns servers whose circuits are not open. All servers are returned if every circuit is open.
+func (b *breaker) filter(servers resolverArray) resolverArray {
+	if b == nil {
+		return servers
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.open == 0 {
+		return servers
+	}
+	available := make(resolverArray, 0, len(servers))
+	for _, server := range servers {
+		if c := b.circuits[server.GetAddr()]; c == nil || !c.open {
+			available = append(available, server)
+		}
+	}
+	if len(available) == 0 || len(available) == len(servers) {
+		return servers
+	}
+	return available
+}
+
+// isOpen reports whether the circuit of the resolver at addr is open.
+func (b *breaker) isOpen(addr string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	c := b.circuits[addr]
+	return c != nil && c.open
+}
+
+// due returns addresses of open circuits whose cooldown is over and which are not probed yet, marking them probed.
+func (b *breaker) due(now time.Time) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var addrs []string
+	for addr, c := range b.circuits {
+		if c.open && !c.probing && now.After(c.until) {
+			c.probing = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// probed marks the probe of the resolver at addr done.
+func (b *breaker) probed(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c := b.circuits[addr]; c != nil {
+		c.probing = false
+	}
+}
+
+func (s *Server) runBreaker(ctx context.Context) {
+	ticker := time.NewTicker(_breakerCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.probeBreaker(time.Now())
+	}
+}
+
+// probeBreaker probes resolvers with open circuits whose cooldown is over, with the first test domain,
+// or the root zone if there is none. Lookups close the circuits of resolvers answering, see breaker.observe.
+func (s *Server) probeBreaker(now time.Time) {
+	o := s.options()
+	addrs := s.breaker.due(now)
+	if len(addrs) == 0 {
+		return
+	}
+	name := "."
+	if len(o.TestDomains) > 0 {
+		name = dns.Fqdn(o.TestDomains[0])
+	}
+	servers := make(map[string]Resolver)
+	for _, server := range append(append(resolverArray(nil), o.TrustedServers...), o.UntrustedServers...) {
+		servers[server.GetAddr()] = server
+	}
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		server, ok := servers[addr]
+		if !ok {
+			// the resolver is removed by a reload.
+			s.breaker.probed(addr)
+			continue
+		}
+		wg.Add(1)
+		go func(server Resolver) {
+			defer wg.Done()
+			defer s.breaker.probed(server.GetAddr())
+			req := new(dns.Msg)
+			req.SetQuestion(name, o.TestQType)
+			s.LookupMutated(s.ctx, req, server)
+		}(server)
+	}
+	wg.Wait()
+}
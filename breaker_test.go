@@ -0,0 +1,78 @@
+package gochinadns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestBreaker(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithCircuitBreaker(3, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := s.breaker
+	dead, alive := Resolver{addr: "192.0.2.1:53"}, Resolver{addr: "192.0.2.2:53"}
+	servers := resolverArray{dead, alive}
+
+	refused := errors.New("refused")
+	b.observe(dead, refused)
+	b.observe(dead, refused)
+	b.observe(dead, nil)
+	b.observe(dead, refused)
+	b.observe(dead, refused)
+	if b.isOpen(dead.GetAddr()) {
+		t.Fatal("circuit is open after a success resets failures")
+	}
+	b.observe(dead, refused)
+	if !b.isOpen(dead.GetAddr()) {
+		t.Fatal("circuit is not open after 3 failures in a row")
+	}
+	if got := b.filter(servers); len(got) != 1 || got[0].GetAddr() != alive.GetAddr() {
+		t.Errorf("available servers are %v, want %s", got, alive)
+	}
+	if got := b.filter(servers[:1]); len(got) != 1 {
+		t.Errorf("available servers are %v, want all of them when every circuit is open", got)
+	}
+
+	if addrs := b.due(time.Now()); len(addrs) != 0 {
+		t.Errorf("%v are probed during the cooldown", addrs)
+	}
+	addrs := b.due(time.Now().Add(2 * time.Minute))
+	if len(addrs) != 1 || addrs[0] != dead.GetAddr() {
+		t.Fatalf("%v are probed after the cooldown, want %s", addrs, dead)
+	}
+	if addrs := b.due(time.Now().Add(2 * time.Minute)); len(addrs) != 0 {
+		t.Errorf("%v are probed again while probing", addrs)
+	}
+	b.probed(dead.GetAddr())
+	b.observe(dead, nil)
+	if b.isOpen(dead.GetAddr()) || len(b.filter(servers)) != 2 {
+		t.Error("circuit is still open after a success")
+	}
+
+	if _, err := NewServer(WithCircuitBreaker(3, 0)); err == nil {
+		t.Error("circuit breaker without cooldown should fail")
+	}
+}
+
+func TestBreakerProbe(t *testing.T) {
+	addr := startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr), WithTimeout(time.Second),
+		WithTestDomains("example.com"), WithSkipStartupTest(true), WithCircuitBreaker(1, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := s.options().TrustedServers[0]
+	s.observeUpstream(server, time.Second, errors.New("timeout"))
+	if st := s.Stats().Upstreams[0]; !st.Tripped {
+		t.Fatalf("upstream status is %+v, want tripped", st)
+	}
+
+	// the probe is answered, and closes the circuit.
+	s.probeBreaker(time.Now().Add(time.Second))
+	if s.breaker.isOpen(addr) {
+		t.Error("circuit is still open after a probe is answered")
+	}
+}
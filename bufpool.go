@@ -0,0 +1,111 @@
+package gochinadns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// _packetBufferSize is the size of pooled buffers, which fit any DNS message.
+const _packetBufferSize = dns.MaxMsgSize
+
+// packetBuffers are buffers to pack and read DNS messages, reused across queries to spare garbage collection.
+// Pointers to slices are pooled, since putting a slice into a sync.Pool allocates.
+var packetBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, _packetBufferSize)
+		return &b
+	},
+}
+
+func getPacketBuffer() *[]byte { return packetBuffers.Get().(*[]byte) }
+
+func putPacketBuffer(b *[]byte) { packetBuffers.Put(b) }
+
+// writeMsg packs m into a pooled buffer and writes it, where w.WriteMsg allocates the packed message.
+func writeMsg(w dns.ResponseWriter, m *dns.Msg) error {
+	b := getPacketBuffer()
+	defer putPacketBuffer(b)
+	packed, err := m.PackBuffer(*b)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(packed)
+	return err
+}
+
+// exchangeWithConn does the same as cli.ExchangeWithConn, with pooled buffers to pack the request and read the reply.
+func exchangeWithConn(cli *dns.Client, req *dns.Msg, conn *dns.Conn) (reply *dns.Msg, rtt time.Duration, err error) {
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	} else if opt == nil && cli.UDPSize >= dns.MinMsgSize {
+		conn.UDPSize = cli.UDPSize
+	}
+	b := getPacketBuffer()
+	defer putPacketBuffer(b)
+
+	t := time.Now()
+	conn.SetWriteDeadline(t.Add(cli.Timeout))
+	packed, err := req.PackBuffer(*b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err = conn.Write(packed); err != nil {
+		return nil, 0, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(cli.Timeout))
+	for {
+		reply, err = readMsg(conn, *b)
+		// replies with mismatched IDs over UDP may be ones of earlier queries which timed out.
+		if _, ok := conn.Conn.(net.PacketConn); err != nil || reply.Id == req.Id || !ok {
+			break
+		}
+	}
+	if err == nil && reply.Id != req.Id {
+		err = dns.ErrId
+	}
+	return reply, time.Since(t), err
+}
+
+// readMsg does the same as conn.ReadMsg, reading the message into buf.
+func readMsg(conn *dns.Conn, buf []byte) (*dns.Msg, error) {
+	packet, err := readPacket(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	// some EDNS0 options, such as padding, keep slices of the packet they are unpacked from, so the reply is unpacked
+	// from a copy, since buf is put back to the pool while the reply is in use.
+	m := new(dns.Msg)
+	if err := m.Unpack(append([]byte(nil), packet...)); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// readPacket reads a message from conn into buf, and returns it packed.
+func readPacket(conn *dns.Conn, buf []byte) ([]byte, error) {
+	var n int
+	var err error
+	if _, ok := conn.Conn.(net.PacketConn); ok {
+		size := int(conn.UDPSize)
+		if size < dns.MinMsgSize {
+			size = dns.MinMsgSize
+		}
+		n, err = conn.Read(buf[:size])
+	} else {
+		var length uint16
+		if err = binary.Read(conn.Conn, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		n, err = io.ReadFull(conn.Conn, buf[:length])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,110 @@
+package gochinadns
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// discardWriter is a dns.ResponseWriter which packs replies like the one of a dns.Server, and discards them.
+type discardWriter struct {
+	explainWriter
+}
+
+func (w *discardWriter) WriteMsg(m *dns.Msg) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func benchmarkReply() *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	for _, ip := range []string{"1.2.3.4", "5.6.7.8", "9.10.11.12", "13.14.15.16"} {
+		rr, _ := dns.NewRR("www.example.com. 60 IN A " + ip)
+		reply.Answer = append(reply.Answer, rr)
+	}
+	return reply
+}
+
+func BenchmarkRespond(b *testing.B) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true))
+	if err != nil {
+		b.Fatal(err)
+	}
+	reply := benchmarkReply()
+	w := new(discardWriter)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.respond(w, reply, nil)
+	}
+}
+
+func BenchmarkExchange(b *testing.B) {
+	addr := startTestUpstream(b, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTimeout(time.Second), WithSkipStartupTest(true))
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := s.exchange(context.Background(), s.UDPCli, req, addr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReadMsgPadding(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	conn, err := dns.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reply := benchmarkReply()
+	reply.SetEdns0(dns.DefaultMsgSize, false)
+	padding := bytes.Repeat([]byte{0xab}, 16)
+	opt := reply.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: padding})
+	packet, err := reply.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.WriteTo(packet, conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	b := getPacketBuffer()
+	m, err := readMsg(conn, *b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the buffer is reused by another packet once it's put back.
+	for i := range *b {
+		(*b)[i] = 'a'
+	}
+	putPacketBuffer(b)
+	got := m.IsEdns0().Option[0].(*dns.EDNS0_PADDING).Padding
+	if !bytes.Equal(got, padding) {
+		t.Errorf("Padding of the reply = %x after its buffer is reused, want %x", got, padding)
+	}
+}
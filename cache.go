@@ -1,8 +1,369 @@
 package gochinadns
 
-var (
-// flagDisableCache    = flag.Bool("disable-cache", false, "Disable built-in DNS cache.")
-// flagMaxCacheEntries = flag.Int("cache-entries", 5000, "Max DNS cache entries.")
-// flagCacheTTL        = flag.Duration("cache-ttl", 0, "Cache TTL. Set to 0 to use TTL in DNS answers.")
-// flagLazyExpire      = flag.Bool("lazy-expire", true, "In lazy mode, cache could still be used when DNS timeout happens, even if it was expired.")
+import (
+	"container/list"
+	"encoding/binary"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
 )
+
+// CacheBackend stores replies cached by a server, so that deployments may share them in memory of other processes
+// or Redis, see WithCacheBackend. Keys are opaque binary strings identifying queries answered by the same reply.
+// Methods are called concurrently, and Get is called before each query is resolved, so they should return quickly.
+type CacheBackend interface {
+	// Get returns the reply cached for key, or nil if there is none. Expired replies are missed.
+	Get(key string) *CachedReply
+	// Set caches reply for key at least until it expires. reply is never changed once it's set.
+	Set(key string, reply *CachedReply)
+	// Purge removes all replies, such as when lists or resolvers change.
+	Purge()
+}
+
+// CachedReply is a reply cached by a CacheBackend, with its TTL and trust metadata.
+type CachedReply struct {
+	Wire   []byte    //the reply as packed, with TTLs as it's stored
+	Stored time.Time //when the reply is stored, by which TTLs are aged
+	Expire time.Time //when the least TTL of the reply passes
+	Origin string    //OriginTrusted or OriginUntrusted, the origin of the resolver which answers
+	Server string    //address of the resolver which answers
+
+	ttls []int    //offsets of TTLs in Wire, of records but OPT, nil for replies of other backends
+	msg  *dns.Msg //a copy of the reply unpacked for metrics and query logs of hits, never changed
+}
+
+// replyCache caches replies to clients as they are packed in a CacheBackend, so that a hit is answered by copying
+// the packed reply with its ID, the case of its question and TTLs patched, without resolving, unpacking or packing,
+// and allocating with the default backend.
+type replyCache struct {
+	backend CacheBackend
+	memory  *memoryCache //backend if it's the default one, whose lookups don't allocate
+}
+
+// _maxCacheKeyLen is the max length of cache keys: the longest name without escapes, and 5 bytes of the rest.
+const _maxCacheKeyLen = 255 + 5
+
+func newReplyCache(backend CacheBackend) *replyCache {
+	memory, _ := backend.(*memoryCache)
+	return &replyCache{backend: backend, memory: memory}
+}
+
+// appendCacheKey appends the key of req to buf, which identifies queries answered by the same reply: the name
+// in lower case, the type, the class, and whether the query has an OPT record with the DNSSEC OK bit.
+// It returns false if the reply to req is not cached, such as a query with ECS, whose answers depend on the client.
+func appendCacheKey(buf []byte, req *dns.Msg) ([]byte, bool) {
+	if len(req.Question) != 1 || req.Opcode != dns.OpcodeQuery {
+		return buf, false
+	}
+	q := &req.Question[0]
+	// names with escapes are packed in other lengths, which patchName doesn't handle.
+	if len(q.Name)+5 > _maxCacheKeyLen || strings.IndexByte(q.Name, '\\') >= 0 {
+		return buf, false
+	}
+	for i := 0; i < len(q.Name); i++ {
+		c := q.Name[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		buf = append(buf, c)
+	}
+	var flags byte
+	if opt := req.IsEdns0(); opt != nil {
+		for _, e := range opt.Option {
+			if e.Option() == dns.EDNS0SUBNET {
+				return buf, false
+			}
+		}
+		if flags = 1; opt.Do() {
+			flags = 2
+		}
+	}
+	return append(buf, byte(q.Qtype>>8), byte(q.Qtype), byte(q.Qclass>>8), byte(q.Qclass), flags), true
+}
+
+// keyOf returns the key of req, or false if it's not cached, see appendCacheKey.
+func (c *replyCache) keyOf(req *dns.Msg) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	var buf [_maxCacheKeyLen]byte
+	key, ok := appendCacheKey(buf[:0], req)
+	return string(key), ok
+}
+
+// Store caches reply to queries of key, packed as wire, or packs it if wire is nil, with the origin and the address
+// of the resolver which answers. Only NOERROR and NXDOMAIN replies which are not truncated, and have records
+// with TTLs, are cached.
+func (c *replyCache) Store(key string, reply *dns.Msg, wire []byte, origin, server string) {
+	if c == nil || reply.Truncated || (reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError) {
+		return
+	}
+	if wire == nil {
+		var err error
+		if wire, err = reply.Pack(); err != nil {
+			return
+		}
+	} else {
+		wire = append([]byte(nil), wire...)
+	}
+	ttls, least, ok := recordTTLs(wire)
+	if !ok || least == 0 {
+		return
+	}
+	now := time.Now()
+	c.backend.Set(key, &CachedReply{
+		Wire:   wire,
+		Stored: now,
+		Expire: now.Add(time.Duration(least) * time.Second),
+		Origin: origin,
+		Server: server,
+		ttls:   ttls,
+		msg:    reply.Copy(),
+	})
+}
+
+// Answer writes the cached reply to req into buf, with the ID, the RD flag, the case of the question and TTLs patched,
+// and returns it with the reply unpacked, or nil if there is none, it expires at now, or it's longer than max.
+func (c *replyCache) Answer(req *dns.Msg, buf []byte, max int, now time.Time) ([]byte, *dns.Msg) {
+	if c == nil {
+		return nil, nil
+	}
+	var keyBuf [_maxCacheKeyLen]byte
+	key, ok := appendCacheKey(keyBuf[:0], req)
+	if !ok {
+		return nil, nil
+	}
+	var e *CachedReply
+	if c.memory != nil {
+		e = c.memory.get(key, now)
+	} else if e = c.backend.Get(string(key)); e != nil && !now.Before(e.Expire) {
+		e = nil
+	}
+	if e == nil || len(e.Wire) > max || len(e.Wire) > len(buf) {
+		return nil, nil
+	}
+	ttls := e.ttls
+	if ttls == nil {
+		if ttls, _, ok = recordTTLs(e.Wire); !ok {
+			return nil, nil
+		}
+	}
+
+	packet := append(buf[:0], e.Wire...)
+	binary.BigEndian.PutUint16(packet, req.Id)
+	if req.RecursionDesired {
+		packet[2] |= 1
+	} else {
+		packet[2] &^= 1
+	}
+	patchName(packet[12:], req.Question[0].Name)
+	// TTLs are at least the least one, which is longer than elapsed before the entry expires.
+	elapsed := uint32(now.Sub(e.Stored) / time.Second)
+	for _, off := range ttls {
+		binary.BigEndian.PutUint32(packet[off:], binary.BigEndian.Uint32(packet[off:])-elapsed)
+	}
+	msg := e.msg
+	if msg == nil {
+		if msg = new(dns.Msg); msg.Unpack(e.Wire) != nil {
+			return nil, nil
+		}
+	}
+	return packet, msg
+}
+
+// Purge removes all entries, such as when lists or resolvers change.
+func (c *replyCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.backend.Purge()
+}
+
+// Len returns the number of entries of the default backend, or 0 of others.
+func (c *replyCache) Len() int {
+	if c == nil || c.memory == nil {
+		return 0
+	}
+	return c.memory.Len()
+}
+
+// memoryCache is the default CacheBackend, which keeps replies in memory. Replies are evicted once they expire,
+// or the least recently used one when the cache is full.
+type memoryCache struct {
+	mu      sync.Mutex
+	size    int                      //max number of entries
+	entries map[string]*list.Element //by cache key, see appendCacheKey
+	lru     *list.List               //of *memoryEntry, the most recently used first
+}
+
+type memoryEntry struct {
+	key   string
+	reply *CachedReply
+}
+
+func newMemoryCache(size int) *memoryCache {
+	return &memoryCache{size: size, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// Get returns the reply cached for key, or nil if there is none or it expires.
+func (m *memoryCache) Get(key string) *CachedReply {
+	return m.get([]byte(key), time.Now())
+}
+
+// get returns the reply cached for key, or nil if there is none or it expires at now, which is removed.
+func (m *memoryCache) get(key []byte, now time.Time) *CachedReply {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// the conversion of the map key doesn't allocate.
+	el, ok := m.entries[string(key)]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*memoryEntry)
+	if !now.Before(e.reply.Expire) {
+		m.remove(el)
+		return nil
+	}
+	m.lru.MoveToFront(el)
+	return e.reply
+}
+
+// Set caches reply for key, and evicts the least recently used reply if the cache is full.
+func (m *memoryCache) Set(key string, reply *CachedReply) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		el.Value.(*memoryEntry).reply = reply
+		m.lru.MoveToFront(el)
+		return
+	}
+	m.entries[key] = m.lru.PushFront(&memoryEntry{key: key, reply: reply})
+	for m.lru.Len() > m.size {
+		m.remove(m.lru.Back())
+	}
+}
+
+func (m *memoryCache) remove(el *list.Element) {
+	m.lru.Remove(el)
+	delete(m.entries, el.Value.(*memoryEntry).key)
+}
+
+// Purge removes all replies.
+func (m *memoryCache) Purge() {
+	m.mu.Lock()
+	m.entries = make(map[string]*list.Element)
+	m.lru.Init()
+	m.mu.Unlock()
+}
+
+// Len returns the number of replies.
+func (m *memoryCache) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+// recordTTLs returns the offsets of TTLs of records of the packed message but OPT, whose TTL field holds flags,
+// and the least TTL. It returns false if the message is malformed or has no such records.
+func recordTTLs(wire []byte) ([]int, uint32, bool) {
+	if len(wire) < 12 {
+		return nil, 0, false
+	}
+	off, ok := 12, true
+	for i := binary.BigEndian.Uint16(wire[4:]); i > 0; i-- {
+		if off, ok = skipName(wire, off); !ok {
+			return nil, 0, false
+		}
+		off += 4
+	}
+	records := int(binary.BigEndian.Uint16(wire[6:])) + int(binary.BigEndian.Uint16(wire[8:])) +
+		int(binary.BigEndian.Uint16(wire[10:]))
+	var ttls []int
+	least := uint32(math.MaxUint32)
+	for i := 0; i < records; i++ {
+		if off, ok = skipName(wire, off); !ok || off+10 > len(wire) {
+			return nil, 0, false
+		}
+		if binary.BigEndian.Uint16(wire[off:]) != dns.TypeOPT {
+			ttls = append(ttls, off+4)
+			if ttl := binary.BigEndian.Uint32(wire[off+4:]); ttl < least {
+				least = ttl
+			}
+		}
+		off += 10 + int(binary.BigEndian.Uint16(wire[off+8:]))
+	}
+	if off > len(wire) || len(ttls) == 0 {
+		return nil, 0, false
+	}
+	return ttls, least, true
+}
+
+// skipName returns the offset after the packed name at off.
+func skipName(wire []byte, off int) (int, bool) {
+	for off < len(wire) {
+		n := int(wire[off])
+		switch {
+		case n == 0:
+			return off + 1, true
+		case n&0xC0 == 0xC0:
+			return off + 2, off+2 <= len(wire)
+		case n&0xC0 != 0:
+			return 0, false
+		}
+		off += 1 + n
+	}
+	return 0, false
+}
+
+// patchName writes name into the packed name at the start of wire, which is the same but for case.
+func patchName(wire []byte, name string) {
+	for off, i := 0, 0; off < len(wire); {
+		n := int(wire[off])
+		if n == 0 || n&0xC0 != 0 || off+1+n > len(wire) || i+n > len(name) {
+			return
+		}
+		copy(wire[off+1:off+1+n], name[i:i+n])
+		off, i = off+1+n, i+n+1
+	}
+}
+
+// maxReplySize returns the max length of the reply to req over w: 64KB over TCP, the UDP size of EDNS,
+// or 512 bytes otherwise.
+func maxReplySize(w dns.ResponseWriter, req *dns.Msg) int {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return dns.MaxMsgSize
+	}
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// serveCached answers req from the cache, and reports whether it's answered.
+func (s *Server) serveCached(w dns.ResponseWriter, req *dns.Msg) bool {
+	if s.cache == nil || len(req.Question) != 1 {
+		return false
+	}
+	start := time.Now()
+	// the domain blacklist may change at runtime.
+	if s.options().DomainBlacklist.Contain(req.Question[0].Name) {
+		return false
+	}
+	b := getPacketBuffer()
+	defer putPacketBuffer(b)
+	packet, msg := s.cache.Answer(req, *b, maxReplySize(w, req), start)
+	if packet == nil {
+		return false
+	}
+	s.tapClientQuery(w, req, start)
+	if _, err := w.Write(packet); err != nil {
+		s.log.WithError(err).Debug("Fail to write a cached reply.")
+	}
+	s.stats.cacheHits.Add(1)
+	s.finishQuery(w, req, msg, &queryResult{path: pathCache, reason: reasonCached}, start)
+	return true
+}
@@ -0,0 +1,186 @@
+package gochinadns
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestReplyCache(t *testing.T) {
+	c := newReplyCache(newMemoryCache(1))
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	key, ok := c.keyOf(req)
+	if !ok {
+		t.Fatal("A query should be cacheable")
+	}
+	c.Store(key, newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.2.3.4", "example.com. 300 IN A 1.2.3.5"), nil, OriginTrusted, "")
+	// age the entry by 10 seconds.
+	e := c.memory.entries[key].Value.(*memoryEntry).reply
+	e.Stored, e.Expire = e.Stored.Add(-10*time.Second), e.Expire.Add(-10*time.Second)
+
+	hit := new(dns.Msg)
+	hit.SetQuestion("EXAMPLE.com.", dns.TypeA)
+	buf := make([]byte, dns.MaxMsgSize)
+	packet, _ := c.Answer(hit, buf, dns.MaxMsgSize, time.Now())
+	if packet == nil {
+		t.Fatal("Answer() = nil, want the cached reply")
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(packet); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Id != hit.Id || reply.Question[0].Name != "EXAMPLE.com." || !reply.RecursionDesired {
+		t.Errorf("Answer() = %v, want ID %d and the question of %v", reply, hit.Id, hit)
+	}
+	if len(reply.Answer) != 2 || reply.Answer[0].Header().Ttl != 50 || reply.Answer[1].Header().Ttl != 290 {
+		t.Errorf("Answer() = %v, want TTLs 50 and 290", reply.Answer)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { c.Answer(hit, buf, dns.MaxMsgSize, time.Now()) }); allocs != 0 {
+		t.Errorf("Answer() allocates %v times, want 0", allocs)
+	}
+	if packet, _ := c.Answer(hit, buf, 20, time.Now()); packet != nil {
+		t.Error("Answer() should miss a reply longer than max")
+	}
+	if packet, _ := c.Answer(hit, buf, dns.MaxMsgSize, time.Now().Add(time.Minute)); packet != nil || c.Len() != 0 {
+		t.Errorf("Answer() should miss and remove an expired reply, %d entries left", c.Len())
+	}
+
+	c.Store(key, newTestReply(t, dns.RcodeServerFailure), nil, OriginTrusted, "")
+	c.Store(key, newTestReply(t, dns.RcodeSuccess, "example.com. 0 IN A 1.2.3.4"), nil, OriginTrusted, "")
+	if c.Len() != 0 {
+		t.Error("SERVFAIL replies and replies of TTL 0 should not be cached")
+	}
+	other := new(dns.Msg)
+	other.SetQuestion("example.org.", dns.TypeA)
+	otherKey, _ := c.keyOf(other)
+	c.Store(key, newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.2.3.4"), nil, OriginTrusted, "")
+	c.Store(otherKey, newTestReply(t, dns.RcodeNameError, "example.com. 60 IN SOA ns.example.com. admin.example.com. 1 60 60 60 60"), nil, OriginTrusted, "")
+	if packet, _ := c.Answer(req, buf, dns.MaxMsgSize, time.Now()); packet != nil || c.Len() != 1 {
+		t.Errorf("The least recently used reply should be evicted, %d entries left", c.Len())
+	}
+
+	ecs := new(dns.Msg)
+	ecs.SetQuestion("example.com.", dns.TypeA)
+	ecs.SetEdns0(dns.DefaultMsgSize, false)
+	ecs.IsEdns0().Option = append(ecs.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1})
+	if _, ok := c.keyOf(ecs); ok {
+		t.Error("Queries with ECS should not be cacheable")
+	}
+}
+
+func TestServeCached(t *testing.T) {
+	var queries int32
+	addr := startSlowUpstream(t, &queries)
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr),
+		WithDelay(time.Second), WithTestDomains(), WithCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		w := new(explainWriter)
+		s.Serve(w, req)
+		if w.reply == nil || w.reply.Id != req.Id || len(w.reply.Answer) != 1 {
+			t.Fatalf("Reply %d = %v, want an answer to %v", i, w.reply, req)
+		}
+	}
+	if n, hits := atomic.LoadInt32(&queries), s.Stats().CacheHits; n != 1 || hits != 1 {
+		t.Errorf("%d queries sent upstream and %d cache hits, want 1 and 1", n, hits)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.cache.Len(); n != 0 {
+		t.Errorf("%d replies cached after reload, want 0", n)
+	}
+}
+
+// mapCache is a CacheBackend of a map, as of a shared store whose replies are copies.
+type mapCache struct {
+	mu      sync.Mutex
+	replies map[string]CachedReply
+}
+
+func (m *mapCache) Get(key string) *CachedReply {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reply, ok := m.replies[key]
+	if !ok {
+		return nil
+	}
+	return &CachedReply{Wire: reply.Wire, Stored: reply.Stored, Expire: reply.Expire, Origin: reply.Origin, Server: reply.Server}
+}
+
+func (m *mapCache) Set(key string, reply *CachedReply) {
+	m.mu.Lock()
+	m.replies[key] = *reply
+	m.mu.Unlock()
+}
+
+func (m *mapCache) Purge() {
+	m.mu.Lock()
+	m.replies = make(map[string]CachedReply)
+	m.mu.Unlock()
+}
+
+func TestCacheBackend(t *testing.T) {
+	var queries int32
+	addr := startSlowUpstream(t, &queries)
+	backend := &mapCache{replies: make(map[string]CachedReply)}
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr),
+		WithDelay(time.Second), WithTestDomains(), WithCacheBackend(backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		w := new(explainWriter)
+		s.Serve(w, req)
+		if w.reply == nil || w.reply.Id != req.Id || len(w.reply.Answer) != 1 {
+			t.Fatalf("Reply %d = %v, want an answer to %v", i, w.reply, req)
+		}
+	}
+	if n, hits := atomic.LoadInt32(&queries), s.Stats().CacheHits; n != 1 || hits != 1 {
+		t.Errorf("%d queries sent upstream and %d cache hits, want 1 and 1", n, hits)
+	}
+	if len(backend.replies) != 1 {
+		t.Fatalf("%d replies in the backend, want 1", len(backend.replies))
+	}
+	for _, reply := range backend.replies {
+		if reply.Origin != OriginTrusted || reply.Server != addr {
+			t.Errorf("Reply is cached from %s %s, want trusted %s", reply.Origin, reply.Server, addr)
+		}
+	}
+	if !s.Config().CustomCacheBackend {
+		t.Error("Config should report the custom cache backend")
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.replies) != 0 {
+		t.Errorf("%d replies in the backend after reload, want 0", len(backend.replies))
+	}
+}
+
+func BenchmarkServeCached(b *testing.B) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+startTestUpstream(b, "1.2.3.4")),
+		WithTimeout(time.Second), WithSkipStartupTest(true), WithCache(10))
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	w := new(discardWriter)
+	s.Serve(w, req)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Serve(w, req)
+	}
+}
@@ -0,0 +1,163 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// canary checks resolvers periodically with queries of known answers,
+// to detect transparent hijacking or NXDOMAIN redirection of upstreams.
+type canary struct {
+	log       Logger
+	events    *eventHooks
+	interval  time.Duration
+	nxZone    string   //zone under which random names never exist
+	name      string   //name with stable answers
+	answerIPs []net.IP //stable answers of name
+
+	mu       sync.RWMutex
+	hijacked map[string]string //resolver address -> reason
+}
+
+func newCanary(o *serverOptions, log Logger, events *eventHooks) *canary {
+	return &canary{
+		log:       log,
+		events:    events,
+		interval:  o.CanaryInterval,
+		nxZone:    dns.Fqdn(o.CanaryNXZone),
+		name:      dns.Fqdn(o.CanaryName),
+		answerIPs: o.CanaryIPs,
+		hijacked:  make(map[string]string),
+	}
+}
+
+func (s *Server) runCanary(ctx context.Context) {
+	ticker := time.NewTicker(s.canary.interval)
+	defer ticker.Stop()
+	for {
+		s.checkCanary()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) checkCanary() {
+	o := s.options()
+	var wg sync.WaitGroup
+	for _, servers := range []resolverArray{o.TrustedServers, o.UntrustedServers} {
+		for _, server := range servers {
+			wg.Add(1)
+			go func(server Resolver) {
+				defer wg.Done()
+				reason := s.canaryReason(server)
+				s.canary.update(server, reason)
+				s.metrics.observeCanary(server, reason != "")
+			}(server)
+		}
+	}
+	wg.Wait()
+}
+
+// canaryReason returns why the server is considered hijacked, or empty if it's not.
+// Lookup errors are not treated as hijacking.
+func (s *Server) canaryReason(server Resolver) string {
+	req := new(dns.Msg)
+	req.SetQuestion(fmt.Sprintf("canary-%08x.%s", rand.Uint32(), s.canary.nxZone), dns.TypeA)
+	if reply, _, err := s.LookupMutated(s.ctx, req, server); err == nil && reply.Rcode != dns.RcodeNameError && len(reply.Answer) > 0 {
+		return fmt.Sprintf("NXDOMAIN redirected to %s", answerIPs(reply))
+	}
+
+	if len(s.canary.answerIPs) == 0 {
+		return ""
+	}
+	req.SetQuestion(s.canary.name, dns.TypeA)
+	reply, _, err := s.LookupMutated(s.ctx, req, server)
+	if err != nil {
+		return ""
+	}
+	for _, ip := range answerIPs(reply) {
+		for _, expected := range s.canary.answerIPs {
+			if ip.Equal(expected) {
+				return ""
+			}
+		}
+	}
+	return fmt.Sprintf("%s answered with unexpected %s", s.canary.name, answerIPs(reply))
+}
+
+func (c *canary) update(server Resolver, reason string) {
+	c.mu.Lock()
+	logger := c.log.WithField("server", server)
+	old, ok := c.hijacked[server.GetAddr()]
+	var state string
+	switch {
+	case reason != "" && !ok:
+		logger.Warnf("Resolver seems to be hijacked (%s). Disable it.", reason)
+		c.hijacked[server.GetAddr()] = reason
+		state = UpstreamHijacked
+	case reason != "" && old != reason:
+		logger.Warnf("Resolver is still hijacked (%s).", reason)
+		c.hijacked[server.GetAddr()] = reason
+	case reason == "" && ok:
+		logger.Info("Resolver passed canary check. Enable it.")
+		delete(c.hijacked, server.GetAddr())
+		state = UpstreamCanaryPassed
+	}
+	c.mu.Unlock()
+	if state != "" {
+		c.events.upstreamState(server.GetAddr(), state, "", reason)
+	}
+}
+
+// filter returns servers which are not hijacked. All servers are returned if none of them pass the check.
+func (c *canary) filter(servers resolverArray) resolverArray {
+	if c == nil {
+		return servers
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.hijacked) == 0 {
+		return servers
+	}
+	available := make(resolverArray, 0, len(servers))
+	for _, server := range servers {
+		if _, ok := c.hijacked[server.GetAddr()]; !ok {
+			available = append(available, server)
+		}
+	}
+	if len(available) == 0 {
+		return servers
+	}
+	return available
+}
+
+// reason returns why the resolver at addr is considered hijacked, or empty if it's not.
+func (c *canary) reason(addr string) string {
+	if c == nil {
+		return ""
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.hijacked[addr]
+}
+
+func answerIPs(reply *dns.Msg) (ips []net.IP) {
+	for _, rr := range reply.Answer {
+		switch answer := rr.(type) {
+		case *dns.A:
+			ips = append(ips, answer.A)
+		case *dns.AAAA:
+			ips = append(ips, answer.AAAA)
+		}
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package gochinadns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCanary(t *testing.T) {
+	hijacker := startTestUpstream(t, "6.6.6.6")
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		if req.Question[0].Name == "stable.example." {
+			rr, _ := dns.NewRR("stable.example. 60 IN A 1.2.3.4")
+			reply.Answer = append(reply.Answer, rr)
+		} else {
+			reply.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	honest := pc.LocalAddr().String()
+
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTimeout(time.Second), WithSkipStartupTest(true),
+		WithTrustedResolvers("udp@"+hijacker, "udp@"+honest), WithCanary(time.Hour),
+		WithCanaryDomains("canary.test", "stable.example", "1.2.3.4"), WithMetricsListen("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.checkCanary()
+	if reason := s.canary.reason(hijacker); !strings.Contains(reason, "NXDOMAIN redirected to [6.6.6.6]") {
+		t.Errorf("Hijacker is flagged for %q, want NXDOMAIN redirection", reason)
+	}
+	if reason := s.canary.reason(honest); reason != "" {
+		t.Errorf("Honest resolver is flagged for %q", reason)
+	}
+	if available := s.canary.filter(s.options().TrustedServers); len(available) != 1 || available[0].GetAddr() != honest {
+		t.Errorf("Available resolvers = %v, want the honest one", available)
+	}
+
+	w := httptest.NewRecorder()
+	s.metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		`chinadns_canary_checks_total{resolver="` + hijacker + `",result="hijacked"} 1`,
+		`chinadns_canary_checks_total{resolver="` + honest + `",result="passed"} 1`,
+		`chinadns_upstream_hijacked{resolver="` + hijacker + `"} 1`,
+		`chinadns_upstream_hijacked{resolver="` + honest + `"} 0`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("Metrics miss %s:\n%s", line, w.Body)
+		}
+	}
+}
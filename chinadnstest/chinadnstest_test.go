@@ -0,0 +1,70 @@
+package chinadnstest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cherrot/gochinadns"
+	"github.com/miekg/dns"
+)
+
+func TestUpstream(t *testing.T) {
+	u := NewUpstream(t)
+	u.Answer("example.com. 60 IN A 1.2.3.4")
+	u.Rcode("fail.example.com", dns.RcodeServerFailure)
+	u.Inject("blocked.com. 60 IN A 5.6.7.8")
+	u.Answer("blocked.com. 60 IN A 1.1.1.1")
+
+	for _, network := range []string{"udp", "tcp"} {
+		req := new(dns.Msg)
+		req.SetQuestion("EXAMPLE.com.", dns.TypeA)
+		reply, _, err := (&dns.Client{Net: network}).Exchange(req, u.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 1 || reply.Answer[0].Header().Name != "EXAMPLE.com." {
+			t.Errorf("Reply over %s = %v, want the canned answer", network, reply)
+		}
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("fail.example.com.", dns.TypeA)
+	if reply, err := dns.Exchange(req, u.Addr); err != nil || reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Reply = %v, %v, want SERVFAIL", reply, err)
+	}
+
+	// the forged reply comes first over UDP, and the genuine one over TCP.
+	req.SetQuestion("blocked.com.", dns.TypeA)
+	if reply, err := dns.Exchange(req, u.Addr); err != nil || reply.Answer[0].(*dns.A).A.String() != "5.6.7.8" {
+		t.Errorf("Reply over UDP = %v, %v, want the injected answer", reply, err)
+	}
+	reply, _, err := (&dns.Client{Net: "tcp"}).Exchange(req, u.Addr)
+	if err != nil || reply.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Errorf("Reply over TCP = %v, %v, want the genuine answer", reply, err)
+	}
+	if n := len(u.Queries()); n != 5 {
+		t.Errorf("%d queries received, want 5", n)
+	}
+}
+
+func TestPollutedScenario(t *testing.T) {
+	domestic, overseas := NewUpstream(t), NewUpstream(t)
+	domestic.Answer("baidu.com. 60 IN A 1.0.1.1")
+	domestic.Inject("google.com. 60 IN A 8.7.198.46")
+	overseas.Answer("baidu.com. 60 IN A 104.0.0.1", "google.com. 60 IN A 142.250.0.1")
+	overseas.Delay(50 * time.Millisecond)
+
+	// the loopback address is in China, so that the domestic resolver is untrusted.
+	s := StartServer(t,
+		gochinadns.WithCHNListSource(gochinadns.DataList([]byte("1.0.1.0/24\n127.0.0.0/8\n"))),
+		gochinadns.WithResolvers("udp@"+domestic.Addr),
+		gochinadns.WithTrustedResolvers("udp+tcp@"+overseas.Addr),
+		gochinadns.WithTimeout(time.Second),
+	)
+	for name, want := range map[string]string{"baidu.com": "1.0.1.1", "google.com": "142.250.0.1"} {
+		reply := s.Exchange(t, name, dns.TypeA)
+		if len(reply.Answer) != 1 || !reply.Answer[0].(*dns.A).A.Equal(net.ParseIP(want)) {
+			t.Errorf("Reply of %s = %v, want %s", name, reply.Answer, want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package chinadnstest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cherrot/gochinadns"
+	"github.com/miekg/dns"
+)
+
+// Server is a gochinadns server listening on random ports of the loopback address.
+type Server struct {
+	*gochinadns.Server
+	UDPAddr string //address queries are received over UDP
+	TCPAddr string //address queries are received over TCP
+}
+
+// StartServer creates and starts a server with opts, listening on random ports of the loopback address,
+// which is shut down once the test ends. Resolvers are not tested on start unless opts enable it.
+func StartServer(t testing.TB, opts ...gochinadns.ServerOption) *Server {
+	t.Helper()
+	opts = append([]gochinadns.ServerOption{
+		gochinadns.WithListenAddr("127.0.0.1:0"),
+		gochinadns.WithSkipStartupTest(true),
+	}, opts...)
+	s, err := gochinadns.NewServer(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	udp, tcp := s.Listeners()
+	return &Server{
+		Server:  s,
+		UDPAddr: udp.PacketConn.LocalAddr().String(),
+		TCPAddr: tcp.Listener.Addr().String(),
+	}
+}
+
+// Exchange queries the server over UDP for name of qtype, and fails the test if there is no reply.
+func (s *Server) Exchange(t testing.TB, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	reply, err := dns.Exchange(req, s.UDPAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
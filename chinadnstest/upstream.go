@@ -0,0 +1,186 @@
+// Package chinadnstest provides utilities for integration tests of gochinadns: a scriptable mock upstream resolver,
+// which injects forged replies as the GFW does, and a server started on random ports of the loopback address.
+package chinadnstest
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream is a mock upstream resolver listening both UDP and TCP on the same random port of the loopback address.
+// It answers queries by canned records, after a delay if any, or with no records if there is none.
+// It's safe to script while it's queried.
+type Upstream struct {
+	Addr string //ip:port of both UDP and TCP
+
+	mu       sync.Mutex
+	answers  map[dns.Question][]dns.RR
+	rcodes   map[string]int      //by name
+	injected map[string][]dns.RR //forged records by name
+	delay    time.Duration
+	queries  []dns.Question
+
+	servers []*dns.Server
+}
+
+// NewUpstream starts a mock upstream resolver, which is closed once the test ends.
+func NewUpstream(t testing.TB) *Upstream {
+	t.Helper()
+	u := &Upstream{
+		answers:  make(map[dns.Question][]dns.RR),
+		rcodes:   make(map[string]int),
+		injected: make(map[string][]dns.RR),
+	}
+	pc, l, err := listenPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Addr = pc.LocalAddr().String()
+	u.servers = []*dns.Server{
+		{PacketConn: pc, Handler: dns.HandlerFunc(u.serve)},
+		{Listener: l, Handler: dns.HandlerFunc(u.serve)},
+	}
+	for _, srv := range u.servers {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+	}
+	t.Cleanup(u.Close)
+	return u
+}
+
+// listenPair listens UDP and TCP on the same random port, retrying if the TCP port is taken.
+func listenPair() (net.PacketConn, net.Listener, error) {
+	var err error
+	for i := 0; i < 10; i++ {
+		var pc net.PacketConn
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			return nil, nil, err
+		}
+		var l net.Listener
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			return pc, l, nil
+		}
+		pc.Close()
+	}
+	return nil, nil, err
+}
+
+// Close stops the upstream.
+func (u *Upstream) Close() {
+	for _, srv := range u.servers {
+		srv.Shutdown()
+	}
+}
+
+// Answer adds records in the format of zone files, such as "example.com. 60 IN A 1.2.3.4", which answer queries
+// of their names and types. It panics if a record is invalid.
+func (u *Upstream) Answer(records ...string) {
+	rrs := mustRRs(records)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, rr := range rrs {
+		h := rr.Header()
+		q := dns.Question{Name: strings.ToLower(h.Name), Qtype: h.Rrtype, Qclass: h.Class}
+		u.answers[q] = append(u.answers[q], rr)
+	}
+}
+
+// Rcode answers queries of name with rcode, such as dns.RcodeServerFailure, instead of records.
+func (u *Upstream) Rcode(name string, rcode int) {
+	u.mu.Lock()
+	u.rcodes[strings.ToLower(dns.Fqdn(name))] = rcode
+	u.mu.Unlock()
+}
+
+// Delay delays replies by d, which are sent after injected ones.
+func (u *Upstream) Delay(d time.Duration) {
+	u.mu.Lock()
+	u.delay = d
+	u.mu.Unlock()
+}
+
+// Inject answers UDP queries of the names of records at once with the records, before the genuine reply,
+// as the GFW injects forged replies to queries on their way. It panics if a record is invalid.
+func (u *Upstream) Inject(records ...string) {
+	rrs := mustRRs(records)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		u.injected[name] = append(u.injected[name], rr)
+	}
+}
+
+// Queries returns questions of queries received, in order.
+func (u *Upstream) Queries() []dns.Question {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]dns.Question(nil), u.queries...)
+}
+
+func (u *Upstream) serve(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		reply := new(dns.Msg)
+		w.WriteMsg(reply.SetRcode(req, dns.RcodeFormatError))
+		return
+	}
+	q := req.Question[0]
+	key := dns.Question{Name: strings.ToLower(q.Name), Qtype: q.Qtype, Qclass: q.Qclass}
+	u.mu.Lock()
+	u.queries = append(u.queries, q)
+	answers, injected, delay := u.answers[key], u.injected[key.Name], u.delay
+	rcode, ok := u.rcodes[key.Name]
+	u.mu.Unlock()
+
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	if udp && len(injected) > 0 {
+		// forged replies have the records of any type, without EDNS, as those of the GFW.
+		forged := new(dns.Msg)
+		forged.SetReply(req)
+		forged.Answer = renamed(injected, q.Name)
+		w.WriteMsg(forged)
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	reply := new(dns.Msg)
+	if ok {
+		reply.SetRcode(req, rcode)
+	} else {
+		reply.SetReply(req)
+		reply.Answer = renamed(answers, q.Name)
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		reply.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	w.WriteMsg(reply)
+}
+
+// renamed returns copies of rrs with the name of the query, whose case may be mutated.
+func renamed(rrs []dns.RR, name string) []dns.RR {
+	copies := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		copies[i] = dns.Copy(rr)
+		copies[i].Header().Name = name
+	}
+	return copies
+}
+
+func mustRRs(records []string) []dns.RR {
+	rrs := make([]dns.RR, len(records))
+	for i, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil || rr == nil {
+			panic("chinadnstest: invalid record " + record)
+		}
+		rrs[i] = rr
+	}
+	return rrs
+}
@@ -0,0 +1,143 @@
+package gochinadns
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// cidrSet is a set of IP networks, flattened to sorted ranges of addresses which don't overlap, so that a lookup
+// is a binary search of plain integers without allocating. It's read-mostly: networks are inserted while a list
+// is loaded, before the set is shared, and never after. A refreshed list is loaded into a new set, which ReloadLists
+// swaps in atomically.
+type cidrSet struct {
+	v4       []v4Range
+	v6       []v6Range
+	networks int //number of networks inserted
+}
+
+// v4Range is the range of IPv4 addresses from first to last, both inclusive.
+type v4Range struct {
+	first, last uint32
+}
+
+// v6Range is the range of IPv6 addresses from first to last, both inclusive, as high and low 64 bits.
+type v6Range struct {
+	first, last [2]uint64
+}
+
+func newCIDRSet() *cidrSet {
+	return new(cidrSet)
+}
+
+// Insert adds the network to the set. Ranges are not merged until compact is called.
+func (s *cidrSet) Insert(network *net.IPNet) {
+	ones, bits := network.Mask.Size()
+	if ip := network.IP.To4(); ip != nil && bits == 32 {
+		first := binary.BigEndian.Uint32(ip) & (^uint32(0) << (32 - ones))
+		s.v4 = append(s.v4, v4Range{first, first | ^uint32(0)>>ones})
+	} else if ip := network.IP.To16(); ip != nil && bits == 128 {
+		first, last := [2]uint64{binary.BigEndian.Uint64(ip), binary.BigEndian.Uint64(ip[8:])}, [2]uint64{}
+		for i := range first {
+			// bits of the host part in this half
+			host := 128 - ones - 64*(1-i)
+			switch {
+			case host >= 64:
+				first[i], last[i] = 0, ^uint64(0)
+			case host <= 0:
+				last[i] = first[i]
+			default:
+				first[i] &= ^uint64(0) << host
+				last[i] = first[i] | ^uint64(0)>>(64-host)
+			}
+		}
+		s.v6 = append(s.v6, v6Range{first, last})
+	} else {
+		return
+	}
+	s.networks++
+}
+
+// compact sorts ranges and merges the overlapping and adjacent ones, which lookups need.
+func (s *cidrSet) compact() {
+	sort.Slice(s.v4, func(i, j int) bool { return s.v4[i].first < s.v4[j].first })
+	merged4 := s.v4[:0]
+	for _, r := range s.v4 {
+		if n := len(merged4); n > 0 && (r.first <= merged4[n-1].last || r.first == merged4[n-1].last+1) {
+			if r.last > merged4[n-1].last {
+				merged4[n-1].last = r.last
+			}
+			continue
+		}
+		merged4 = append(merged4, r)
+	}
+	s.v4 = merged4
+
+	sort.Slice(s.v6, func(i, j int) bool { return less128(s.v6[i].first, s.v6[j].first) })
+	merged6 := s.v6[:0]
+	for _, r := range s.v6 {
+		if n := len(merged6); n > 0 && (!less128(merged6[n-1].last, r.first) || inc128(merged6[n-1].last) == r.first) {
+			if less128(merged6[n-1].last, r.last) {
+				merged6[n-1].last = r.last
+			}
+			continue
+		}
+		merged6 = append(merged6, r)
+	}
+	s.v6 = merged6
+}
+
+func less128(a, b [2]uint64) bool {
+	return a[0] < b[0] || a[0] == b[0] && a[1] < b[1]
+}
+
+func inc128(a [2]uint64) [2]uint64 {
+	if a[1]++; a[1] == 0 {
+		a[0]++
+	}
+	return a
+}
+
+// Contains reports whether the IP is in a network of the set. IPv4-mapped IPv6 addresses are treated as IPv4.
+func (s *cidrSet) Contains(ip net.IP) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		x := binary.BigEndian.Uint32(ip4)
+		lo, hi := 0, len(s.v4)
+		for lo < hi {
+			mid := int(uint(lo+hi) >> 1)
+			if s.v4[mid].last < x {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		return lo < len(s.v4) && s.v4[lo].first <= x, nil
+	}
+	if len(ip) != net.IPv6len {
+		return false, errors.Errorf("invalid IP %v", ip)
+	}
+	x := [2]uint64{binary.BigEndian.Uint64(ip), binary.BigEndian.Uint64(ip[8:])}
+	lo, hi := 0, len(s.v6)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if less128(s.v6[mid].last, x) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo < len(s.v6) && !less128(x, s.v6[lo].first), nil
+}
+
+// Len returns the number of networks inserted.
+func (s *cidrSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.networks
+}
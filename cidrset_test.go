@@ -0,0 +1,89 @@
+package gochinadns
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func newTestCIDRSet(t testing.TB, cidrs ...string) *cidrSet {
+	set := newCIDRSet()
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set.Insert(network)
+	}
+	set.compact()
+	return set
+}
+
+func TestCIDRSet(t *testing.T) {
+	set := newTestCIDRSet(t, "1.0.1.0/24", "1.0.2.0/23", "1.0.1.128/25", "10.0.0.0/8", "223.255.252.0/23",
+		"2001:250::/35", "2001:da8::/32", "2001:da8:8000::/33", "255.255.255.255/32")
+	if n := set.Len(); n != 9 {
+		t.Errorf("Len() = %d, want 9", n)
+	}
+	if len(set.v4) != 4 || len(set.v6) != 2 {
+		t.Errorf("ranges are not merged: %v %v", set.v4, set.v6)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"1.0.0.255", false},
+		{"1.0.1.0", true},
+		{"1.0.3.255", true},
+		{"1.0.4.0", false},
+		{"10.255.255.255", true},
+		{"223.255.253.1", true},
+		{"223.255.254.1", false},
+		{"255.255.255.255", true},
+		{"::ffff:1.0.2.3", true},
+		{"2001:250::1", true},
+		{"2001:250:2000::", false},
+		{"2001:da8:ffff::1", true},
+		{"2001:db8::1", false},
+		{"::", false},
+	}
+	for _, tt := range tests {
+		if got, err := set.Contains(net.ParseIP(tt.ip)); err != nil || got != tt.want {
+			t.Errorf("Contains(%s) = %t, %v, want %t", tt.ip, got, err, tt.want)
+		}
+	}
+	if _, err := set.Contains(nil); err == nil {
+		t.Error("Contains() of an invalid IP should fail")
+	}
+	all := newTestCIDRSet(t, "0.0.0.0/0", "1.2.3.0/24", "::/0", "2001:db8::/32")
+	if len(all.v4) != 1 || len(all.v6) != 1 {
+		t.Errorf("ranges of the whole space are not merged: %v %v", all.v4, all.v6)
+	}
+	if ok, _ := all.Contains(net.ParseIP("2001:db8::1")); !ok {
+		t.Error("::/0 should contain every IPv6 address")
+	}
+	ip := net.ParseIP("1.0.2.3")
+	if allocs := testing.AllocsPerRun(100, func() { set.Contains(ip) }); allocs != 0 {
+		t.Errorf("Contains() allocates %v times", allocs)
+	}
+}
+
+func BenchmarkCIDRSetContains(b *testing.B) {
+	// about the size of a China route list.
+	r := rand.New(rand.NewSource(1))
+	cidrs := make([]string, 0, 8000)
+	for i := 0; i < cap(cidrs); i++ {
+		cidrs = append(cidrs, fmt.Sprintf("%d.%d.%d.0/%d", 1+r.Intn(222), r.Intn(256), r.Intn(256), 16+r.Intn(9)))
+	}
+	set := newTestCIDRSet(b, cidrs...)
+	ips := make([]net.IP, 1024)
+	for i := range ips {
+		ips[i] = net.IPv4(byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.Contains(ips[i%len(ips)])
+	}
+}
@@ -0,0 +1,150 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// Errors of queries answered without a usable answer, along with which Client.Exchange returns the reply.
+var (
+	ErrAllUpstreamsFailed = errors.New("all upstreams failed")
+	ErrBlockedDomain      = errors.New("domain is blocked")
+	ErrPollutedAnswer     = errors.New("answer is polluted")
+)
+
+// Client resolves queries with the verdict of trusted and untrusted resolvers, as a server does, without listening,
+// so that other Go programs, such as proxies, may reuse the resolution against DNS pollution directly.
+type Client struct {
+	s *Server
+}
+
+// NewClient returns a client resolving queries like a server created with opts, whose domain blacklist, cache
+// and middlewares apply to its queries as well. Options of listeners and endpoints are ignored.
+func NewClient(opts ...ServerOption) (*Client, error) {
+	s, err := NewServer(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{s: s}, nil
+}
+
+// Exchange resolves req, and returns the reply. If there is no usable answer, the reply is returned along with
+// ErrAllUpstreamsFailed if no resolver answers, ErrBlockedDomain if the domain is in the domain blacklist,
+// or ErrPollutedAnswer if every answer is polluted. It returns no reply but an error if ctx is done first,
+// or the query is dropped, such as by the concurrency limit. Lookups to resolvers are given up once ctx is done.
+func (c *Client) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, errors.Errorf("invalid query with %d questions", len(req.Question))
+	}
+	// the server rewrites the query, such as its EDNS0 options.
+	req = req.Copy()
+	w := &clientWriter{ctx: ctx}
+	done := make(chan struct{})
+	go func() {
+		c.s.handler.ServeDNS(w, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if w.reply == nil {
+		return nil, errors.New("no reply is written")
+	}
+	switch {
+	case w.result == nil:
+	case w.result.path == pathBlocked:
+		return w.reply, ErrBlockedDomain
+	case w.result.path == pathNone:
+		return w.reply, ErrAllUpstreamsFailed
+	case w.result.polluted:
+		return w.reply, ErrPollutedAnswer
+	}
+	return w.reply, nil
+}
+
+// LookupIP looks up IPv4 and IPv6 addresses of host, IPv4 ones first. It returns an error if there are none.
+func (c *Client) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	ips := make([][]net.IP, len(qtypes))
+	errs := make([]error, len(qtypes))
+	done := make(chan struct{}, len(qtypes))
+	for i, qtype := range qtypes {
+		go func(i int, qtype uint16) {
+			defer func() { done <- struct{}{} }()
+			req := new(dns.Msg)
+			req.SetQuestion(dns.Fqdn(host), qtype)
+			reply, err := c.Exchange(ctx, req)
+			if err != nil {
+				if err == ErrAllUpstreamsFailed || err == ErrPollutedAnswer || err == ErrBlockedDomain {
+					err = errors.WithMessagef(err, "fail to look up %s", host)
+				}
+				errs[i] = err
+				return
+			}
+			if reply.Rcode != dns.RcodeSuccess {
+				errs[i] = errors.Errorf("fail to look up %s: %s", host, dns.RcodeToString[reply.Rcode])
+				return
+			}
+			for _, rr := range reply.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					if qtype == dns.TypeA {
+						ips[i] = append(ips[i], rr.A)
+					}
+				case *dns.AAAA:
+					if qtype == dns.TypeAAAA {
+						ips[i] = append(ips[i], rr.AAAA)
+					}
+				}
+			}
+		}(i, qtype)
+	}
+	for range qtypes {
+		<-done
+	}
+	all := append(ips[0], ips[1]...)
+	if len(all) > 0 {
+		return all, nil
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.Errorf("no address of %s", host)
+}
+
+// Close gives up queries in flight, and closes the query log, the audit log and upstream sockets of the client.
+func (c *Client) Close() error {
+	c.s.cancelQueries()
+	c.s.upstreams.Close()
+	if err := c.s.queryLog.Close(); err != nil {
+		return errors.Wrap(err, "fail to close query log")
+	}
+	if err := c.s.audit.Close(); err != nil {
+		return errors.Wrap(err, "fail to close audit log")
+	}
+	return nil
+}
+
+// resultWriter is a ResponseWriter which records how its query is answered, such as of Client.Exchange.
+// Middlewares which wrap it hide it, and their queries are not recorded.
+type resultWriter interface {
+	recordResult(result *queryResult)
+}
+
+// clientWriter is the ResponseWriter of a query of Client.Exchange, whose context is the one of the query.
+type clientWriter struct {
+	explainWriter
+	ctx    context.Context
+	result *queryResult //nil if the query is answered from the cache, or by a middleware
+}
+
+func (w *clientWriter) Context() context.Context { return w.ctx }
+
+func (w *clientWriter) recordResult(result *queryResult) { w.result = result }
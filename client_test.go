@@ -0,0 +1,101 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestClient(t *testing.T) {
+	f, err := ioutil.TempFile("", "blacklist-*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("blocked.test\n")
+	f.Close()
+
+	c, err := NewClient(WithTrustedResolvers("udp@"+startTestUpstream(t, "1.2.3.4")), WithSkipStartupTest(true),
+		WithDomainBlacklist(f.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	reply, err := c.Exchange(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Id != req.Id || len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("Exchange() = %v", reply)
+	}
+
+	ips, err := c.LookupIP(context.Background(), "example.com")
+	if err != nil || len(ips) != 1 || ips[0].String() != "1.2.3.4" {
+		t.Errorf("LookupIP() = %v, %v, want 1.2.3.4", ips, err)
+	}
+	if ips, err := c.LookupIP(context.Background(), "blocked.test"); !errors.Is(err, ErrBlockedDomain) {
+		t.Errorf("LookupIP() of a blocked domain = %v, %v, want ErrBlockedDomain", ips, err)
+	}
+	req.SetQuestion("blocked.test.", dns.TypeA)
+	if reply, err := c.Exchange(context.Background(), req); reply == nil || err != ErrBlockedDomain {
+		t.Errorf("Exchange() of a blocked domain = %v, %v, want the reply and ErrBlockedDomain", reply, err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	f, err := ioutil.TempFile("", "blacklist-*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("1.2.3.4\n")
+	f.Close()
+
+	polluted, err := NewClient(WithTrustedResolvers("udp@"+startTestUpstream(t, "1.2.3.4")), WithSkipStartupTest(true),
+		WithIPBlacklist(f.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer polluted.Close()
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if reply, err := polluted.Exchange(context.Background(), req); reply == nil || err != ErrPollutedAnswer {
+		t.Errorf("Exchange() = %v, %v, want the reply and ErrPollutedAnswer", reply, err)
+	}
+
+	// nothing answers at the discard port.
+	failed, err := NewClient(WithTrustedResolvers("udp@127.0.0.1:9"), WithSkipStartupTest(true),
+		WithTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer failed.Close()
+	reply, err := failed.Exchange(context.Background(), req)
+	if reply == nil || err != ErrAllUpstreamsFailed {
+		t.Errorf("Exchange() = %v, %v, want the reply and ErrAllUpstreamsFailed", reply, err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	var queries int32
+	c, err := NewClient(WithTrustedResolvers("udp@"+startSlowUpstream(t, &queries)), WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := c.Exchange(ctx, req); err != context.DeadlineExceeded {
+		t.Errorf("Exchange() = %v, want the deadline exceeded", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// _compatName is the program name which selects the flags of ChinaDNS, the C implementation.
+const _compatName = "chinadns-c"
+
+// compatBuild is set by building with -tags chinadns_c, for packages which replace ChinaDNS at its path.
+var compatBuild = false
+
+// compatOptions are the options of ChinaDNS by getopt letter, and the flags they set. Options with a value end with :.
+var compatOptions = map[byte]string{
+	'l': "l:", 'c': "c:", 'd': "d", 'y': "y:", 'b': "b:", 'p': "p:", 's': "s:", 'm': "m", 'v': "v", 'V': "V", 'h': "h",
+}
+
+// compatDefaults are defaults of ChinaDNS which differ from ours: CHNRoute is off without -c,
+// and the bidirectional filter is off without -d.
+var compatDefaults = map[string]string{
+	"b": "0.0.0.0",
+	"c": "",
+	"d": "false",
+	"s": "114.114.114.114,208.67.222.222:443,8.8.8.8",
+	"y": "0.3",
+}
+
+const _compatUsage = `usage: %s [-h] [-l IPLIST_FILE] [-b BIND_ADDR] [-p BIND_PORT]
+       [-c CHNROUTE_FILE] [-s DNS] [-m] [-v] [-V]
+Forward DNS requests. Flags of ChinaDNS (C implementation) are accepted, see %s.
+
+  -l IPLIST_FILE        path to ip blacklist file
+  -c CHNROUTE_FILE      path to china route file
+                        if not specified, CHNRoute will be turned off
+  -d                    enable bi-directional CHNRoute filter
+  -y                    delay time for suspects, default: 0.3
+  -b BIND_ADDR          address that listens, default: 0.0.0.0
+  -p BIND_PORT          port that listens, default: 53
+  -s DNS                DNS servers to use, default:
+                        114.114.114.114,208.67.222.222:443,8.8.8.8
+  -m                    using DNS compression pointer mutation
+  -v                    verbose logging
+  -h                    show this help message and exit
+  -V                    print version and exit
+`
+
+// compatMode reports whether flags are those of ChinaDNS: the program is run as chinadns-c, or built with -tags chinadns_c.
+func compatMode() bool {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	return compatBuild || name == _compatName
+}
+
+// parseCompatFlags parses args like getopt(3) as ChinaDNS does, and sets flags they correspond to,
+// after defaults of ChinaDNS. It returns flags set by args, like flags on the command line.
+func parseCompatFlags(args []string) (map[string]bool, error) {
+	for name, value := range compatDefaults {
+		f := flag.Lookup(name)
+		if err := f.Value.Set(value); err != nil {
+			return nil, err
+		}
+		// keep them on reload, which resets flags to defaults.
+		f.DefValue = value
+	}
+
+	cmdline := make(map[string]bool)
+	set := func(name, value string) error {
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid argument of -%s: %v", name, err)
+		}
+		cmdline[name] = true
+		return nil
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			return nil, fmt.Errorf("unexpected argument %s", arg)
+		}
+		// options may be grouped, such as -dm, and values may follow options, such as -p5353.
+		for j := 1; j < len(arg); j++ {
+			opt, ok := compatOptions[arg[j]]
+			if !ok {
+				return nil, fmt.Errorf("invalid option -- '%c'", arg[j])
+			}
+			if opt == "h" {
+				compatUsage()
+				os.Exit(0)
+			}
+			if !strings.HasSuffix(opt, ":") {
+				if err := set(opt, "true"); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			name, value := strings.TrimSuffix(opt, ":"), arg[j+1:]
+			if value == "" {
+				if i+1 == len(args) {
+					return nil, fmt.Errorf("option requires an argument -- '%s'", name)
+				}
+				i++
+				value = args[i]
+			}
+			if err := set(name, value); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return cmdline, nil
+}
+
+func compatUsage() {
+	fmt.Fprintf(flag.CommandLine.Output(), _compatUsage, filepath.Base(os.Args[0]), "https://github.com/shadowsocks/ChinaDNS")
+}
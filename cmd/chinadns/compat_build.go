@@ -0,0 +1,8 @@
+//go:build chinadns_c
+// +build chinadns_c
+
+package main
+
+func init() {
+	compatBuild = true
+}
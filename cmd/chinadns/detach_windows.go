@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// detach is not supported on Windows. Run gochinadns as a service instead.
+func detach() (int, error) {
+	return 0, errors.New("detach is not supported on Windows, use -service install instead")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cherrot/gochinadns"
+)
+
+var (
+	flagUpdateInterval  = flag.Duration("update-interval", 0, "Interval to update lists from their URLs and reload, such as 24h. 0 to disable. See the update-lists subcommand.")
+	flagChnroutesURL    = flag.String("chnroutes-url", gochinadns.ChnroutesURL, "URL of IPv4 China routes, written to -c by update-lists. Empty to skip.")
+	flagChnroutes6URL   = flag.String("chnroutes6-url", gochinadns.Chnroutes6URL, "URL of IPv6 China routes, written to -c by update-lists along with IPv4 ones. Empty to skip.")
+	flagChinaDomainsURL = flag.String("china-domains-url", gochinadns.ChinaDomainsURL, "URL of China domains such as dnsmasq-china-list, written to -bidirectional-exempt by update-lists. Empty to skip.")
+	flagGFWListURL      = flag.String("gfwlist-url", gochinadns.GFWListURL, "URL of polluted domains such as gfwlist, written to -domain-polluted by update-lists. Empty to skip.")
+)
+
+// listUpdates returns updates of lists by URL flags. Lists without a URL or a path are skipped.
+func listUpdates() []gochinadns.ListUpdate {
+	var chnroutes []string
+	for _, url := range []string{*flagChnroutesURL, *flagChnroutes6URL} {
+		if url != "" {
+			chnroutes = append(chnroutes, url)
+		}
+	}
+	all := []gochinadns.ListUpdate{
+		{Name: "China route list", URLs: chnroutes, Path: *flagCHNList, Format: gochinadns.ListCIDR, MinEntries: 1000},
+		{Name: "China domain list", URLs: []string{*flagChinaDomainsURL}, Path: *flagBidiExempt, Format: gochinadns.ListDomains, MinEntries: 10000},
+		{Name: "polluted domain list", URLs: []string{*flagGFWListURL}, Path: *flagDomainPolluted, Format: gochinadns.ListDomains, MinEntries: 1000},
+	}
+	var updates []gochinadns.ListUpdate
+	for _, u := range all {
+		if len(u.URLs) > 0 && u.URLs[0] != "" && u.Path != "" {
+			updates = append(updates, u)
+		}
+	}
+	return updates
+}
+
+// updateLists updates lists, and returns the number of lists updated and failed.
+func updateLists(ctx context.Context, updates []gochinadns.ListUpdate) (updated, failed int) {
+	client := &http.Client{Timeout: time.Minute}
+	for _, u := range updates {
+		n, err := gochinadns.UpdateList(ctx, client, u)
+		if err != nil {
+			logrus.WithError(err).Errorf("Fail to update %s.", u.Name)
+			failed++
+			continue
+		}
+		logrus.Infof("%s updated with %d entries at %s.", u.Name, n, u.Path)
+		updated++
+	}
+	return
+}
+
+// updateListsCommand runs the update-lists subcommand, and returns the exit code.
+func updateListsCommand() int {
+	updates := listUpdates()
+	if len(updates) == 0 {
+		fmt.Fprintln(os.Stderr, "No list to update. Set -c, -bidirectional-exempt or -domain-polluted.")
+		return 2
+	}
+	if _, failed := updateLists(context.Background(), updates); failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runListUpdates updates lists at -update-interval and reloads the server if any is updated, until ctx is done.
+func runListUpdates(ctx context.Context, server *gochinadns.Server) {
+	if *flagUpdateInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(*flagUpdateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reloadMu.Lock()
+		updates := listUpdates()
+		reloadMu.Unlock()
+		if updated, _ := updateLists(ctx, updates); updated == 0 {
+			continue
+		}
+		if err := server.Reload(); err != nil {
+			logrus.WithError(err).Error("Fail to reload.")
+		}
+	}
+}
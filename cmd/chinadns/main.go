@@ -2,39 +2,158 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 
 	"github.com/cherrot/gochinadns"
 )
 
 var (
-	flagVersion = flag.Bool("V", false, "Print version and exit.")
-	flagVerbose = flag.Bool("v", false, "Enable verbose logging.")
+	flagVersion     = flag.Bool("V", false, "Print version, commit and build date, and exit.")
+	flagPrintConfig = flag.String("print-config", "", "Print the effective configuration after flags, the config file and lists are loaded in json or yaml, and exit. Resolvers are not tested.")
+	flagCheck       = flag.Bool("check", false, "Check the configuration, lists and listening addresses, print every problem found and exit.")
+	flagProfile     = flag.String("profile", "", "Name of the profile of the config file to use, such as travel. Empty for none.")
+	flagConfig      = flag.String("config", "", "Path to a TOML or YAML (.yaml, .yml) config file, where keys are long names of flags. Flags on the command line override it.")
+	flagVerbose     = flag.Bool("v", false, "Enable verbose logging.")
+	flagDetach      = flag.Bool("detach", false, "Run in the background, detached from the terminal. Logs are discarded unless sent to -syslog.")
+	flagPIDFile     = flag.String("pidfile", "", "Path to write the process ID to, which is removed on exit. Empty to disable.")
+	flagLogLevels   = flag.String("log-levels", "", "Log levels of components, such as verdict=debug,upstream=warn. Components are server, upstream, verdict and lists.")
 
 	flagBind            = flag.String("b", "::", "Bind address.")
 	flagPort            = flag.Int("p", 53, "Listening port.")
+	flagMetricsListen   = flag.String("metrics-listen", "", "Listening address of the Prometheus metrics endpoint /metrics, such as 127.0.0.1:9153. Empty to disable.")
+	flagStatsd          = flag.String("statsd", "", "Address of a StatsD server to push metrics to over UDP, such as 127.0.0.1:8125. Empty to disable.")
+	flagDogStatsd       = flag.Bool("dogstatsd", false, "Push metrics with DogStatsD tags, instead of appending labels to metric names.")
+	flagAdminListen     = flag.String("admin-listen", "", "Listening address of the admin HTTP API, such as 127.0.0.1:8053. Empty to disable.")
+	flagAdminToken      = flag.String("admin-token", "", "Bearer token required by the admin HTTP API. Set CHINADNS_ADMIN_TOKEN instead to keep it out of process lists.")
+	flagAdminTLSCert    = flag.String("admin-tls-cert", "", "Path to the TLS certificate of the admin HTTP API. Empty to serve plain HTTP.")
+	flagAdminTLSKey     = flag.String("admin-tls-key", "", "Path to the private key of -admin-tls-cert.")
+	flagAdminClientCA   = flag.String("admin-client-ca", "", "Path to CA certificates. Clients of the admin HTTP API must present certificates signed by them.")
+	flagDebugListen     = flag.String("debug-listen", "", "Listening address of the pprof endpoint /debug/pprof/, such as 127.0.0.1:6060. Empty to disable.")
+	flagDnstap          = flag.String("dnstap", "", "Path to a Frame Streams unix socket to send dnstap messages to, such as one created by dnstap -u. Empty to disable.")
+	flagOTLPEndpoint    = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint to export OpenTelemetry traces to, such as http://localhost:4318/v1/traces. Empty to disable.")
+	flagTraceRatio      = flag.Float64("trace-ratio", 1, "Ratio of queries to trace, in [0, 1].")
+	flagAuditLog        = flag.String("audit-log", "", "Path to append blocked queries and answers rejected as polluted to, in JSON. Empty to disable.")
+	flagRecentQueries   = flag.Int("recent-queries", 0, "Number of latest queries to keep in memory for the admin API. 0 to disable.")
+	flagSyslog          = flag.String("syslog", "", "Send logs to syslog: local, or a remote server such as udp://192.168.1.1:514. Empty to disable.")
+	flagSyslogFacility  = flag.String("syslog-facility", "daemon", "Syslog facility, such as daemon or local0.")
+	flagQueryLog        = flag.String("query-log", "", "Path to write one JSON object per query to, - for stdout, or syslog for the syslog of -syslog, or the local one without it. Empty to disable.")
+	flagQueryLogFormat  = flag.String("query-log-format", "json", "Format of the query log: json, or dnsmasq for lines like dnsmasq with log-queries.")
+	flagQueryLogSize    = flag.Int("query-log-max-size", 0, "Rotate the query log when it grows over this size in MB. 0 to disable.")
+	flagQueryLogRotate  = flag.Duration("query-log-rotate", 0, "Rotate the query log at this interval, such as 24h. 0 to disable.")
+	flagQueryLogBackups = flag.Int("query-log-backups", 0, "Number of rotated query logs to keep. 0 keeps all.")
+	flagQueryLogSample  = flag.Int("query-log-sample", 0, "Log 1 in N queries randomly. 0 or 1 logs all queries.")
+	flagCacheEntries    = flag.Int("cache-entries", 5000, "Max DNS replies cached for their TTL. 0 to disable the cache.")
+	flagCacheRedis      = flag.String("cache-redis", "", "URL of Redis to share cached replies and learned polluted domains among servers, such as redis://:password@10.0.0.2:6379/0. -cache-entries are cached in memory in front of it.")
+	flagStateFile       = flag.String("state-file", "", "Path to save cached replies and learned polluted domains to on shutdown, which are restored on start. Empty to disable.")
 	flagUDPMaxBytes     = flag.Int("udp-max-bytes", 4096, "Default DNS max message size on UDP.")
 	flagForceTCP        = flag.Bool("force-tcp", false, "Force DNS queries use TCP only. Only applies to resolvers declared in ip:port format.")
 	flagMutation        = flag.Bool("m", false, "Enable compression pointer mutation in DNS queries.")
+	flagMutationMethod  = flag.String("mutation", "", "Default mutation method for trusted servers: none, pointer, case or edns. Overrides -m if set.")
 	flagBidirectional   = flag.Bool("d", true, "Drop results of trusted servers which containing IPs in China. (Bidirectional mode.)")
+	flagMaxConcurrency  = flag.Int("max-concurrency", 0, "Max queries resolved at once. 0 for no limit.")
+	flagOverloadQueue   = flag.Int("overload-queue", 0, "Max queries waiting to be resolved when -max-concurrency is reached, for at most -timeout.")
+	flagOverloadAction  = flag.String("overload-action", "servfail", "Answer to queries over -max-concurrency and -overload-queue: servfail, or drop for none.")
+	flagRateLimit       = flag.Float64("rate-limit", 0, "Max queries per second of each client IP. 0 for no limit.")
+	flagRateLimitBurst  = flag.Int("rate-limit-burst", 0, "Queries a client may send at once over -rate-limit. 0 for -rate-limit rounded up.")
+	flagRateLimitAction = flag.String("rate-limit-action", "refused", "Answer to queries of clients over -rate-limit: refused, or drop for none.")
+	flagRateLimitExempt = flag.String("rate-limit-exempt", "127.0.0.1,::1", "Comma separated CIDRs or IPs of clients which are not rate limited by -rate-limit or -rrl-rate.")
+	flagRRLRate         = flag.Int("rrl-rate", 0, "Max identical UDP responses per second to a network of clients, against amplification attacks. 0 for no limit.")
+	flagRRLSlip         = flag.Int("rrl-slip", 2, "Send every n-th response over -rrl-rate truncated so that clients retry over TCP, and drop the rest. 0 to drop all.")
+	flagRRLIPv4Prefix   = flag.Int("rrl-ipv4-prefix", 24, "Prefix length of IPv4 networks of clients limited together by -rrl-rate.")
+	flagRRLIPv6Prefix   = flag.Int("rrl-ipv6-prefix", 56, "Prefix length of IPv6 networks of clients limited together by -rrl-rate.")
+	flagAllowedClients  = flag.String("allowed-clients", "", "Comma separated CIDRs or IPs of clients which are served, over both UDP and TCP. Empty for all clients.")
+	flagDeniedClients   = flag.String("denied-clients", "", "Comma separated CIDRs or IPs of clients which are not served, even if they are in -allowed-clients.")
+	flagACLAction       = flag.String("acl-action", "refused", "Answer to queries of clients which are not served: refused, or drop for none.")
+	flagRawForward      = flag.Bool("raw-forward", true, "Forward replies as they are received with only the ID rewritten, and unpack only answers for the verdict.")
+	flagCoalesce        = flag.Bool("coalesce", true, "Resolve identical queries in flight once, and answer all of them with the reply.")
+	flagSuspectEmpty    = flag.Bool("suspect-empty", false, "Treat empty NOERROR replies of untrusted servers as suspect and wait for trusted replies.")
+	flagQNAMEMinimize   = flag.Bool("qname-minimization", false, "Resolve queries iteratively from root servers with QNAME minimization, instead of querying untrusted servers.")
+	flagUDPSockets      = flag.Int("udp-sockets", 0, "Number of UDP sockets to receive queries with, spread across cores by the kernel with -reuse-port. 0 for the number of CPUs.")
+	flagUDPBatch        = flag.Int("udp-batch", 32, "Max number of UDP packets read or written in one system call on Linux. 0 to read and write them one by one.")
 	flagReusePort       = flag.Bool("reuse-port", true, "Enable SO_REUSEPORT to gain some performance optimization. Need Linux>=3.9")
+	flagUpstreamSockets = flag.Int("upstream-sockets", 0, "Number of long-lived UDP sockets per resolver, which queries share, such as 2. Their source ports don't change, which leaves only query IDs against spoofing. 0 for a socket per query. Ignored with -source-ports.")
+	flagUpstreamRotate  = flag.Duration("upstream-rotation", 0, "Replace every long-lived socket of -upstream-sockets by one of a new source port once it's older than this, such as 10m. 0 to keep sockets.")
+	flagSourcePorts     = flag.String("source-ports", "", "Range of local ports to randomize for UDP queries, such as 20000-30000. Empty to use OS assigned ports.")
+	flagTrustedQuorum   = flag.Int("trusted-quorum", 0, "Query all trusted servers at once and only accept an answer when this many of them agree. 0 to disable.")
+	flagDNS64           = flag.String("dns64", "", "NAT64 prefix to synthesize AAAA answers with for names without them, such as 64:ff9b::/96. Empty to disable.")
+	flagMDNS            = flag.String("mdns", "", "Resolve .local names by multicast DNS on this interface, default for that of the default route, or by a responder at ip:port. Empty to send them to upstreams.")
+	flagMergeAnswers    = flag.String("merge-answers", "", "Merge addresses of trusted and untrusted answers if both are accepted, with those of trusted or untrusted first. Empty to disable.")
+	flagFastestIP       = flag.String("fastest-ip", "", "Probe addresses of answers by tcp:PORT, such as tcp:443, or icmp, and order them by RTT. Empty to keep the order of upstreams.")
+	flagFastestIPWait   = flag.Duration("fastest-ip-wait", 200*time.Millisecond, "How long answers wait for probes of -fastest-ip. Slower probes are cached for later answers.")
 	flagTimeout         = flag.Duration("timeout", time.Second, "DNS request timeout")
 	flagDelay           = flag.Float64("y", 0.1, "Delay (in seconds) to query another DNS server when no reply received.")
+	flagFastestFirst    = flag.Bool("fastest-first", false, "Query servers with the lowest average RTT first instead of in the given order, and try slower ones now and then.")
+	flagDispatch        = flag.String("dispatch", "sequential", "How queries are dispatched to servers: sequential with -y delay, parallel to all at once, or grouped to servers of a group at once and groups in sequence.")
+	flagTrustedECS      = flag.String("trusted-ecs", "forward", "How client supplied EDNS Client Subnet is sent to trusted servers: forward, strip, or a CIDR prefix to replace it with.")
+	flagUntrustedECS    = flag.String("untrusted-ecs", "forward", "How client supplied EDNS Client Subnet is sent to untrusted servers: forward, strip, or a CIDR prefix to replace it with.")
+	flagTrustedMark     = flag.Int("trusted-mark", 0, "SO_MARK of queries to trusted servers, for policy routing on Linux. 0 for none.")
+	flagUntrustedMark   = flag.Int("untrusted-mark", 0, "SO_MARK of queries to untrusted servers, for policy routing on Linux. 0 for none.")
+	flagTrustedDevice   = flag.String("trusted-device", "", "Interface queries to trusted servers are bound to on Linux, such as a VPN one.")
+	flagUntrustedDevice = flag.String("untrusted-device", "", "Interface queries to untrusted servers are bound to on Linux, such as the WAN one.")
+	flagTrustedDSCP     = flag.Int("trusted-dscp", 0, "DSCP of queries to trusted servers on Linux, for QoS rules, such as 46 for EF. 0 for the default.")
+	flagUntrustedDSCP   = flag.Int("untrusted-dscp", 0, "DSCP of queries to untrusted servers on Linux, for QoS rules. 0 for the default.")
+	flagTrustedSource   = flag.String("trusted-source", "", "Local IP queries to trusted servers are sent from, such as the VPN-assigned one. Empty for any.")
+	flagUntrustedSource = flag.String("untrusted-source", "", "Local IP queries to untrusted servers are sent from, such as the ISP-assigned one. Empty for any.")
 	flagTestDomains     = flag.String("test-domains", "qq.com,163.com", "Domain names to test DNS connection health.")
+	flagTestQType       = flag.String("test-qtype", "A", "Query type of test domains, such as A or AAAA.")
+	flagTestExpect      = flag.String("test-expect", "", "Expected answers of a test domain, in format name=ip[,ip]. Resolvers answering others fail the test. Empty for none.")
+	flagLazyLists       = flag.Bool("lazy-lists", false, "Serve before lists are loaded, and load them in the background. Until then, answers are not checked against lists.")
+	flagSkipStartupTest = flag.Bool("skip-startup-test", false, "Skip testing resolvers with test domains on start, such as on a router which boots before its WAN link is up.")
+	flagRcodeFailover   = flag.Bool("rcode-failover", true, "Treat SERVFAIL, REFUSED and NOTIMP replies as failures, and try the next protocol or server.")
+	flagRelayAgreed     = flag.Bool("relay-agreed", true, "Relay the failure with -rcode-failover if every server replies the same rcode, instead of an empty reply.")
+	flagRetries         = flag.Int("retries", 0, "Attempts after the first one to query a server over a protocol when it times out, before trying its next protocol.")
+	flagRetryTimeout    = flag.Duration("retry-timeout", 0, "Timeout of each attempt with -retries. 0 means -timeout.")
+	flagRetryBackoff    = flag.Duration("retry-backoff", 10*time.Millisecond, "Wait before the first retry, doubled before each one after it.")
+	flagBreakerFails    = flag.Int("breaker-threshold", 5, "Consecutive failed lookups of a server to stop querying it for -breaker-cooldown, until it answers a probe. 0 to disable.")
+	flagBreakerCooldown = flag.Duration("breaker-cooldown", 30*time.Second, "How long a server gets no queries once it fails -breaker-threshold lookups in a row, before it's probed.")
+	flagHealthInterval  = flag.Duration("health-interval", 5*time.Minute, "Interval of health checks of servers with test domains. Protocols of servers found down are skipped until they are up. 0 to disable.")
+	flagCanaryInterval  = flag.Duration("canary-interval", 0, "Interval of canary queries to detect hijacked upstreams, which are disabled until they pass again. 0 to disable.")
+	flagCanaryNXDomain  = flag.String("canary-nxdomain", "example.com", "Zone under which random names never exist, for canary queries.")
+	flagCanaryStable    = flag.String("canary-stable", "a.root-servers.net=198.41.0.4", "Domain name with stable answers for canary queries, in format name=ip[,ip]. Empty to skip.")
 	flagCHNList         = flag.String("c", "./china.list", "Path to China route list. Both IPv4 and IPv6 are supported. See http://ipverse.net")
 	flagIPBlacklist     = flag.String("l", "", "Path to IP blacklist file.")
 	flagDomainBlacklist = flag.String("domain-blacklist", "", "Path to domain blacklist file.")
 	flagDomainPolluted  = flag.String("domain-polluted", "", "Path to polluted domains list. Queries of these domains will not be sent to DNS in China.")
+	flagKVConfig        = flag.String("kv-config", "", "Read resolvers and domain lists from keys of consul://[token@]host:port/prefix or etcd://[user:password@]host:port/prefix, and reload once they change.")
+	flagBogusNXDomain   = flag.String("bogus-nxdomain", "", "Path to IP list of search portals of ISPs. Answers of only these IPs are replaced by NXDOMAIN.")
+	flagDnsmasqConf     = flag.String("dnsmasq-conf", "", "Path to dnsmasq conf of server=, local=, address= and bogus-nxdomain= lines, such as OpenWrt rule files.")
+	flagForwardingRules = flag.String("forwarding-rules", "", "Path to forwarding-rules.txt of dnscrypt-proxy. Queries of its domains are forwarded to their servers.")
+	flagDHCPLeases      = flag.String("dhcp-leases", "", "Path to the lease file of dnsmasq or Kea, whose hostnames are answered under -dhcp-domain, and addresses by PTR.")
+	flagDHCPDomain      = flag.String("dhcp-domain", "lan", "Local domain of hostnames of -dhcp-leases.")
+	flagDiscover        = flag.Duration("discover-interval", 0, "Add resolvers of the network from resolv.conf, as provided by DHCP and router advertisements, and check it for changes every interval, such as 5s. 0 to disable.")
+	flagPeers           = flag.String("peers", "", "Comma separated URLs of admin APIs of other instances, such as https://vps:8053, to share learned polluted domains and upstream health with. Requires -admin-token.")
+	flagPeerInterval    = flag.Duration("peer-interval", time.Minute, "Interval to sync state with -peers.")
+	flagZoneFiles       = flag.String("zone-files", "", "Comma separated paths to zone files of RFC 1035, whose zones are answered authoritatively before upstreams.")
+	flagCloakingRules   = flag.String("cloaking-rules", "", "Path to cloaking-rules.txt of dnscrypt-proxy. Queries of its names are answered with their addresses, or resolved as their targets.")
+	flagPollutionHook   = flag.String("pollution-webhook", "", "URL to post a JSON event to whenever an answer is rejected as polluted.")
+	flagUpstreamHook    = flag.String("upstream-webhook", "", "URL to post a JSON event to whenever a resolver goes down or up, or every trusted resolver becomes unreachable.")
+	flagWatchInterval   = flag.Duration("watch-interval", 0, "Watch list and config files, and reload them once changed files stay the same for this interval, such as 2s. 0 to disable.")
+	flagShutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "Time to wait for queries in flight to be answered on SIGINT or SIGTERM.")
+	flagUpstreamSummary = flag.Duration("upstream-summary", 0, "Interval to log a summary of upstream health and latency, such as 10m. 0 to disable.")
+	flagBidiExempt      = flag.String("bidirectional-exempt", "", "Path to domain list exempt from bidirectional mode. Trusted answers of these domains are used even if containing IPs in China.")
+	flagIPSet           = flag.String("ipset", "", "Add addresses answered for domains of a list to Linux ipsets, in format path=set4[,set6], such as ./gfwlist.txt=gfwlist,gfwlist6. Empty to disable.")
+	flagNFTSet          = flag.String("nftset", "", "Add addresses answered for domains of a list to nftables sets, in format path=family#table#set4[,family#table#set6], such as ./gfwlist.txt=inet#fw#gfwlist. Empty to disable.")
 
 	flagResolvers        resolverAddrs = []string{"udp+tcp@119.29.29.29:53", "udp+tcp@114.114.114.114:53"}
 	flagTrustedResolvers resolverAddrs = []string{}
@@ -42,13 +161,16 @@ var (
 
 func init() {
 	flag.Var(&flagResolvers, "s", "Comma separated list of upstream DNS servers. Need China route list to check whether it's a trusted server or not.\n"+
-		"Servers can be in format ip:port or protocol[+protocol]@ip:port where protocol is udp or tcp.\n"+
+		"Servers can be in format ip:port or protocol[+protocol]@ip:port[?key=value] where protocol is udp or tcp.\n"+
 		"Protocols are dialed in order left to right. Rightmost protocol will only be dialed if the leftmost fails.\n"+
 		"Protocols will override force-tcp flag. "+
+		"A hostname instead of ip is resolved by the system on start, and its IPv6 and IPv4 addresses are raced. "+
 		"If empty, protocol defaults to udp+tcp (tcp if force-tcp is set) and port defaults to 53.\n"+
+		"Supported parameters: mutation=none|pointer|case|edns, group=name, weight=n (see -dispatch), timeout=duration, delay=duration (override -timeout and -y).\n"+
 		"Examples: udp@8.8.8.8,udp+tcp@127.0.0.1:5353,1.1.1.1")
 	flag.Var(&flagTrustedResolvers, "trusted-servers", "Comma separated list of servers which (located in China but) can be trusted. \n"+
 		"Uses the same format as -s.")
+	flag.BoolVar(flagVersion, "version", false, "Print version, commit and build date, and exit. The same as -V.")
 }
 
 type resolverAddrs []string
@@ -71,11 +193,19 @@ func (rs *resolverAddrs) String() string {
 }
 
 func (rs *resolverAddrs) Set(s string) error {
+	if s == "" {
+		*rs = nil
+		return nil
+	}
 	addrs := strings.Split(s, ",")
 	for i, addr := range addrs {
+		var params string
+		if idx := strings.IndexByte(addr, '?'); idx >= 0 {
+			addr, params = addr[:idx], addr[idx:]
+		}
 		if _, _, err := net.SplitHostPort(addr); err != nil {
 			if strings.Contains(err.Error(), "missing port") {
-				addrs[i] = net.JoinHostPort(addr, "53")
+				addrs[i] = net.JoinHostPort(addr, "53") + params
 			} else {
 				return err
 			}
@@ -85,6 +215,170 @@ func (rs *resolverAddrs) Set(s string) error {
 	return nil
 }
 
+// parseLogLevels parses log levels of components in format component=level[,component=level].
+// Components not listed get the base level, and the level of logrus is raised to the most verbose one.
+func parseLogLevels(s string, base logrus.Level) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	levels := map[string]string{"server": base.String(), "upstream": base.String(), "verdict": base.String(), "lists": base.String()}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid log level [%s], should be component=level", pair)
+		}
+		level, err := logrus.ParseLevel(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		levels[kv[0]] = level.String()
+		if level > logrus.GetLevel() {
+			logrus.SetLevel(level)
+		}
+	}
+	return levels, nil
+}
+
+// configFlags are flags of config file keys which are not named after flags.
+var configFlags = map[string]string{
+	"verbose":          "v",
+	"china-list":       "c",
+	"ip-blacklist":     "l",
+	"resolvers":        "s",
+	"bidirectional":    "d",
+	"pointer-mutation": "m",
+	"delay":            "y",
+}
+
+// configFiles are the config file and those it includes.
+var configFiles []string
+
+// configProfiles are settings of profiles of the config file, by name in order of definition.
+var configProfiles []configProfile
+
+type configProfile struct {
+	name     string
+	settings []gochinadns.ConfigSetting
+}
+
+// loadConfigFile sets flags which are not on the command line by the config file, and loads its profiles.
+// Invalid settings are skipped, and returned in order.
+func loadConfigFile(path string, cmdline map[string]bool) []error {
+	settings, err := gochinadns.ReadConfigFile(path)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	configFiles, configProfiles = []string{path}, nil
+	for _, s := range settings {
+		if s.Path != configFiles[len(configFiles)-1] {
+			configFiles = append(configFiles, s.Path)
+		}
+		if s.Profile != "" {
+			addProfileSetting(s)
+			continue
+		}
+		if s.Key == "config" {
+			errs = append(errs, fmt.Errorf("%s:%d: unknown key %s", s.Path, s.Line, s.Key))
+			continue
+		}
+		if err := setFlag(s.Key, s.Value, cmdline); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", s.Path, s.Line, err))
+		}
+	}
+	return errs
+}
+
+func addProfileSetting(s gochinadns.ConfigSetting) {
+	for i := range configProfiles {
+		if configProfiles[i].name == s.Profile {
+			configProfiles[i].settings = append(configProfiles[i].settings, s)
+			return
+		}
+	}
+	configProfiles = append(configProfiles, configProfile{name: s.Profile, settings: []gochinadns.ConfigSetting{s}})
+}
+
+// _envPrefix is the prefix of environment variables of flags.
+const _envPrefix = "CHINADNS_"
+
+// loadEnv sets flags which are not on the command line by environment variables, named after config file keys
+// in upper case with _ for -, such as CHINADNS_CHINA_LIST. Flags set are added to cmdline, so that they override
+// the config file and are kept on reload. Invalid variables are skipped, and returned in order.
+func loadEnv(environ []string, cmdline map[string]bool) []error {
+	var errs []error
+	set := make(map[string]bool)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, _envPrefix) {
+			continue
+		}
+		kv := strings.SplitN(kv, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(kv[0], _envPrefix), "_", "-"))
+		if err := setFlag(key, kv[1], cmdline); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", kv[0], err))
+			continue
+		}
+		for _, name := range flagNames(key) {
+			set[name] = true
+		}
+	}
+	for name := range set {
+		cmdline[name] = true
+	}
+	return errs
+}
+
+// flagNames returns names of flags set by the config key.
+func flagNames(key string) []string {
+	if key == "listen" {
+		return []string{"b", "p"}
+	}
+	if alias, ok := configFlags[key]; ok {
+		return []string{alias}
+	}
+	return []string{key}
+}
+
+// setFlag sets flags of the config key to value, unless they are on the command line.
+func setFlag(key, value string, cmdline map[string]bool) error {
+	values := []string{value}
+	if key == "listen" {
+		host, port, err := net.SplitHostPort(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		values = []string{host, port}
+	}
+	for i, name := range flagNames(key) {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown key %s", key)
+		}
+		if cmdline[name] {
+			continue
+		}
+		if err := flag.Set(name, values[i]); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func parsePortRange(s string) (min, max int, err error) {
+	bounds := strings.SplitN(s, "-", 2)
+	if min, err = strconv.Atoi(bounds[0]); err != nil {
+		return
+	}
+	max = min
+	if len(bounds) == 2 {
+		max, err = strconv.Atoi(bounds[1])
+	}
+	return
+}
+
 func runUntilCanceled(ctx context.Context, f func() error) {
 	minGap := time.Millisecond * 100
 	maxGap := time.Second * 16
@@ -129,33 +423,119 @@ func trimLocPrefix(s string) string {
 	return s
 }
 
-func main() {
-	flag.Parse()
-	if *flagVersion {
-		fmt.Println(gochinadns.GetVersion())
-		fmt.Printf("Go version: %s\n", runtime.Version())
-		return
-	}
-	if *flagVerbose {
-		logrus.SetLevel(logrus.DebugLevel)
+// serverOptions builds server options from flags. Flags which fail to parse are skipped, and returned in order.
+func serverOptions(cmdline map[string]bool) ([]gochinadns.ServerOption, []error) {
+	var errs []error
+	logLevels, err := parseLogLevels(*flagLogLevels, logrus.GetLevel())
+	if err != nil {
+		errs = append(errs, err)
 	}
 
 	listen := net.JoinHostPort(*flagBind, strconv.Itoa(*flagPort))
 	opts := []gochinadns.ServerOption{
 		gochinadns.WithListenAddr(listen),
+		gochinadns.WithLogLevels(logLevels),
+		gochinadns.WithMetricsListen(*flagMetricsListen),
+		gochinadns.WithStatsd(*flagStatsd, *flagDogStatsd),
+		gochinadns.WithAdminListen(*flagAdminListen),
+		gochinadns.WithAdminToken(*flagAdminToken),
+		gochinadns.WithAdminTLS(*flagAdminTLSCert, *flagAdminTLSKey, *flagAdminClientCA),
+		gochinadns.WithDebugListen(*flagDebugListen),
+		gochinadns.WithUpstreamSummary(*flagUpstreamSummary),
+		gochinadns.WithWatchFiles(*flagWatchInterval),
+		gochinadns.WithReloader(func() ([]gochinadns.ServerOption, error) { return reloadOptions(cmdline) }, configFiles...),
+		gochinadns.WithDnstap(*flagDnstap),
+		gochinadns.WithTracing(*flagOTLPEndpoint, *flagTraceRatio),
+		gochinadns.WithAuditLog(*flagAuditLog),
+		gochinadns.WithRecentQueries(*flagRecentQueries),
+		gochinadns.WithQueryLog(*flagQueryLog),
+		gochinadns.WithQueryLogFormat(*flagQueryLogFormat),
+		gochinadns.WithQueryLogRotation(int64(*flagQueryLogSize)<<20, *flagQueryLogRotate, *flagQueryLogBackups),
+		gochinadns.WithQueryLogSampling(*flagQueryLogSample),
+		gochinadns.WithCache(*flagCacheEntries),
+		gochinadns.WithRedisCache(*flagCacheRedis),
+		gochinadns.WithStateFile(*flagStateFile),
 		gochinadns.WithUDPMaxBytes(*flagUDPMaxBytes),
 		gochinadns.WithTCPOnly(*flagForceTCP),
 		gochinadns.WithMutation(*flagMutation),
 		gochinadns.WithBidirectional(*flagBidirectional),
+		gochinadns.WithSuspectEmpty(*flagSuspectEmpty),
+		gochinadns.WithCoalescing(*flagCoalesce),
+		gochinadns.WithRawForward(*flagRawForward),
+		gochinadns.WithMaxConcurrency(*flagMaxConcurrency, *flagOverloadQueue, *flagOverloadAction),
+		gochinadns.WithClientRateLimit(*flagRateLimit, *flagRateLimitBurst, *flagRateLimitAction),
+		gochinadns.WithRateLimitExempt(strings.Split(*flagRateLimitExempt, ",")...),
+		gochinadns.WithResponseRateLimit(*flagRRLRate, *flagRRLSlip),
+		gochinadns.WithRRLPrefixes(*flagRRLIPv4Prefix, *flagRRLIPv6Prefix),
+		gochinadns.WithAllowedClients(strings.Split(*flagAllowedClients, ",")...),
+		gochinadns.WithDeniedClients(strings.Split(*flagDeniedClients, ",")...),
+		gochinadns.WithACLAction(*flagACLAction),
+		gochinadns.WithQNAMEMinimization(*flagQNAMEMinimize),
 		gochinadns.WithReusePort(*flagReusePort),
+		gochinadns.WithUDPSockets(*flagUDPSockets),
+		gochinadns.WithUDPBatch(*flagUDPBatch),
+		gochinadns.WithUpstreamSockets(*flagUpstreamSockets),
+		gochinadns.WithUpstreamRotation(*flagUpstreamRotate),
 		gochinadns.WithTimeout(*flagTimeout),
 		gochinadns.WithDelay(time.Duration(*flagDelay * float64(time.Second))),
+		gochinadns.WithDispatch(*flagDispatch),
+		gochinadns.WithFastestFirst(*flagFastestFirst),
+		gochinadns.WithRcodeFailover(*flagRcodeFailover, *flagRelayAgreed),
+		gochinadns.WithRetry(*flagRetries, *flagRetryTimeout, *flagRetryBackoff),
+		gochinadns.WithCircuitBreaker(*flagBreakerFails, *flagBreakerCooldown),
+		gochinadns.WithHealthCheck(*flagHealthInterval),
+		gochinadns.WithECSPolicy(*flagTrustedECS, *flagUntrustedECS),
+		gochinadns.WithUpstreamSocketOptions(
+			gochinadns.SocketOptions{Mark: *flagTrustedMark, Device: *flagTrustedDevice, DSCP: *flagTrustedDSCP,
+				Source: *flagTrustedSource},
+			gochinadns.SocketOptions{Mark: *flagUntrustedMark, Device: *flagUntrustedDevice, DSCP: *flagUntrustedDSCP,
+				Source: *flagUntrustedSource},
+		),
+		gochinadns.WithTrustedQuorum(*flagTrustedQuorum),
+		gochinadns.WithDNS64(*flagDNS64),
+		gochinadns.WithMDNS(*flagMDNS),
+		gochinadns.WithMergedAnswers(*flagMergeAnswers),
+		gochinadns.WithFastestIP(*flagFastestIP, *flagFastestIPWait),
+		gochinadns.WithSkipStartupTest(*flagSkipStartupTest),
+		gochinadns.WithLazyLists(*flagLazyLists),
 		gochinadns.WithTrustedResolvers(flagTrustedResolvers...),
 		gochinadns.WithResolvers(flagResolvers...),
 	}
+	for _, p := range configProfiles {
+		opts = append(opts, gochinadns.WithProfile(p.name, gochinadns.WithConfigSettings(p.settings...)))
+	}
+	opts = append(opts, gochinadns.WithActiveProfile(*flagProfile))
 	if *flagTestDomains != "" {
 		opts = append(opts, gochinadns.WithTestDomains(strings.Split(*flagTestDomains, ",")...))
 	}
+	opts = append(opts, gochinadns.WithTestQueryType(*flagTestQType))
+	if *flagTestExpect != "" {
+		name, ips := *flagTestExpect, []string(nil)
+		if idx := strings.IndexByte(name, '='); idx >= 0 {
+			name, ips = name[:idx], strings.Split(name[idx+1:], ",")
+		}
+		opts = append(opts, gochinadns.WithTestExpect(name, ips...))
+	}
+	if *flagMutationMethod != "" {
+		opts = append(opts, gochinadns.WithMutationMethod(*flagMutationMethod))
+	}
+	if *flagSourcePorts != "" {
+		if min, max, err := parsePortRange(*flagSourcePorts); err != nil {
+			errs = append(errs, err)
+		} else {
+			opts = append(opts, gochinadns.WithSourcePortRange(min, max))
+		}
+	}
+	if *flagCanaryInterval > 0 {
+		name, ips := *flagCanaryStable, []string(nil)
+		if idx := strings.IndexByte(name, '='); idx >= 0 {
+			name, ips = name[:idx], strings.Split(name[idx+1:], ",")
+		}
+		opts = append(opts,
+			gochinadns.WithCanary(*flagCanaryInterval),
+			gochinadns.WithCanaryDomains(*flagCanaryNXDomain, name, ips...),
+		)
+	}
 	if *flagCHNList != "" {
 		opts = append(opts, gochinadns.WithCHNList(*flagCHNList))
 	}
@@ -168,11 +548,492 @@ func main() {
 	if *flagDomainPolluted != "" {
 		opts = append(opts, gochinadns.WithDomainPolluted(*flagDomainPolluted))
 	}
+	if *flagKVConfig != "" {
+		opts = append(opts, gochinadns.WithKVConfigURL(*flagKVConfig))
+	}
+	if *flagBogusNXDomain != "" {
+		opts = append(opts, gochinadns.WithBogusNXDomain(*flagBogusNXDomain))
+	}
+	if *flagDnsmasqConf != "" {
+		opts = append(opts, gochinadns.WithDnsmasqConf(*flagDnsmasqConf))
+	}
+	if *flagForwardingRules != "" {
+		opts = append(opts, gochinadns.WithForwardingRules(*flagForwardingRules))
+	}
+	if *flagCloakingRules != "" {
+		opts = append(opts, gochinadns.WithCloakingRules(*flagCloakingRules))
+	}
+	if *flagDHCPLeases != "" {
+		opts = append(opts, gochinadns.WithDHCPLeases(*flagDHCPLeases, *flagDHCPDomain))
+	}
+	if *flagDiscover > 0 {
+		opts = append(opts, gochinadns.WithResolverSource(gochinadns.SystemResolvers(), *flagDiscover))
+	}
+	if *flagPeers != "" {
+		opts = append(opts, gochinadns.WithPeers(strings.Split(*flagPeers, ","), *flagPeerInterval))
+	}
+	if *flagZoneFiles != "" {
+		for _, path := range strings.Split(*flagZoneFiles, ",") {
+			opts = append(opts, gochinadns.WithZoneFile(path))
+		}
+	}
+	if *flagSyslog != "" {
+		opts = append(opts, gochinadns.WithSyslog(*flagSyslog, *flagSyslogFacility))
+	}
+	if *flagPollutionHook != "" {
+		opts = append(opts, gochinadns.WithPollutionWebhook(*flagPollutionHook))
+	}
+	if *flagUpstreamHook != "" {
+		opts = append(opts, gochinadns.WithUpstreamWebhook(*flagUpstreamHook))
+	}
+	if *flagBidiExempt != "" {
+		opts = append(opts, gochinadns.WithBidirectionalExempt(*flagBidiExempt))
+	}
+	if *flagIPSet != "" {
+		path, sets := *flagIPSet, []string{""}
+		if idx := strings.LastIndexByte(path, '='); idx >= 0 {
+			path, sets = path[:idx], strings.SplitN(path[idx+1:], ",", 2)
+		}
+		sets = append(sets, "")
+		opts = append(opts, gochinadns.WithIPSet(path, sets[0], sets[1]))
+	}
+	if *flagNFTSet != "" {
+		path, sets := *flagNFTSet, []string{""}
+		if idx := strings.LastIndexByte(path, '='); idx >= 0 {
+			path, sets = path[:idx], strings.SplitN(path[idx+1:], ",", 2)
+		}
+		sets = append(sets, "")
+		opts = append(opts, gochinadns.WithNFTSet(path, sets[0], sets[1]))
+	}
+	return opts, errs
+}
+
+// reloadOnSignal reloads flags from the config file and options of the server on SIGHUP,
+// and switches to the next profile on switchProfileSignals.
+func reloadOnSignal(server *gochinadns.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, append([]os.Signal{syscall.SIGHUP}, switchProfileSignals...)...)
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			logrus.Infof("%s received. Switch to the next profile.", s)
+			if err := server.SwitchProfile(nextProfile(server.Profiles())); err != nil {
+				logrus.WithError(err).Error("Fail to switch profile.")
+			}
+			continue
+		}
+		logrus.Info("SIGHUP received. Reload.")
+		if err := server.Reload(); err != nil {
+			logrus.WithError(err).Error("Fail to reload.")
+		}
+	}
+}
+
+// nextProfile returns the profile after active in names, wrapping around to the first one.
+func nextProfile(names []string, active string) string {
+	for i, name := range names {
+		if name == active {
+			return names[(i+1)%len(names)]
+		}
+	}
+	if len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
+
+// reloadMu serializes reloads, which reset and set flags, and reads of flags while the server runs.
+var reloadMu sync.Mutex
+
+// reloadOptions reloads flags from the config file, and returns options of them.
+func reloadOptions(cmdline map[string]bool) ([]gochinadns.ServerOption, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if *flagConfig != "" {
+		// reset flags, so that keys removed from the config file fall back to defaults.
+		flag.VisitAll(func(f *flag.Flag) {
+			if !cmdline[f.Name] {
+				f.Value.Set(f.DefValue)
+			}
+		})
+		if errs := loadConfigFile(*flagConfig, cmdline); len(errs) > 0 {
+			return nil, errs[0]
+		}
+	}
+	opts, errs := serverOptions(cmdline)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return opts, nil
+}
+
+// check prints problems of flags and those of opts, and returns the exit code.
+func check(opts []gochinadns.ServerOption, problems []error) int {
+	problems = append(problems, gochinadns.Validate(opts...)...)
+	for _, err := range problems {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problems found.\n", len(problems))
+		return 1
+	}
+	fmt.Println("Configuration OK.")
+	return 0
+}
+
+// printConfig prints the effective configuration of opts to w in format, and returns the exit code.
+func printConfig(w io.Writer, format string, opts []gochinadns.ServerOption) int {
+	c, err := gochinadns.EffectiveConfig(opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err == nil && format == "yaml" {
+		// convert from JSON, so that keys are named after json tags.
+		var v interface{}
+		if err = json.Unmarshal(b, &v); err == nil {
+			b, err = yaml.Marshal(v)
+		}
+	} else if err == nil && format != "json" {
+		err = fmt.Errorf("unknown config format [%s]", format)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	w.Write(b)
+	if format == "json" {
+		fmt.Fprintln(w)
+	}
+	return 0
+}
+
+// trace runs the trace subcommand with args, domain [qtype], and returns the exit code.
+func trace(opts []gochinadns.ServerOption, args []string) int {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "Usage: chinadns [flags] trace domain [qtype]")
+		return 2
+	}
+	qtype := dns.TypeA
+	if len(args) == 2 {
+		t, ok := dns.StringToType[strings.ToUpper(args[1])]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown query type [%s]\n", args[1])
+			return 2
+		}
+		qtype = t
+	}
+	server, err := gochinadns.NewServer(opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ex, err := server.Explain(args[0], qtype)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(ex)
+	return 0
+}
+
+// bench runs the bench subcommand with args, [-rounds N] [-suggest] [domain...], and returns the exit code.
+func bench(opts []gochinadns.ServerOption, args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	rounds := fs.Int("rounds", 3, "Number of times to query each domain.")
+	suggest := fs.Bool("suggest", false, "Print suggested resolvers in the config file format.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: chinadns [flags] bench [-rounds N] [-suggest] [domain...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	domains := fs.Args()
+	if len(domains) == 0 {
+		domains = gochinadns.BenchDomains
+	}
+	server, err := gochinadns.NewServer(append(opts, gochinadns.WithSkipStartupTest(true))...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	results := server.Benchmark(domains, *rounds)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RANK\tRESOLVER\tTRUSTED\tLOSS\tPOLLUTED\tP50\tP90")
+	for i, r := range results {
+		fmt.Fprintf(w, "%d\t%s\t%t\t%.1f%%\t%.1f%%\t%.1fms\t%.1fms\n",
+			i+1, r.Addr, r.Trusted, r.LossRate*100, r.PollutionRate*100, r.LatencyP50, r.LatencyP90)
+	}
+	w.Flush()
+	if *suggest {
+		trusted, untrusted := gochinadns.SuggestResolvers(results)
+		fmt.Println()
+		fmt.Println("# Resolvers without pollution which answer at least half of the queries, fastest first.")
+		fmt.Printf("trusted-servers = %q\n", strings.Join(trusted, ","))
+		fmt.Printf("resolvers = %q\n", strings.Join(untrusted, ","))
+	}
+	return 0
+}
+
+// loadtest runs the loadtest subcommand with args, [-c N] [-d duration] [-net udp|tcp] [-corpus file] [-json] [addr],
+// and returns the exit code.
+func loadtest(args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	concurrency := fs.Int("c", 16, "Number of clients querying at once, each sending a query once the last one is answered.")
+	duration := fs.Duration("d", 10*time.Second, "Duration of the test.")
+	network := fs.String("net", "udp", "Protocol to query with: udp or tcp.")
+	timeout := fs.Duration("timeout", 2*time.Second, "Timeout of each query, after which it counts as an error.")
+	corpusPath := fs.String("corpus", "", "File of queries to replay in turn, one \"domain [qtype]\" per line. Sample domains if empty.")
+	asJSON := fs.Bool("json", false, "Print the result in JSON.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: chinadns [flags] loadtest [-c N] [-d duration] [-net udp|tcp] [-corpus file] [-json] [addr]")
+		fmt.Fprintln(fs.Output(), "addr is the listening address of -b and -p if empty, at 127.0.0.1 if -b is :: or 0.0.0.0.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 {
+		return 2
+	}
+	addr := fs.Arg(0)
+	if addr == "" {
+		host := *flagBind
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		addr = net.JoinHostPort(host, strconv.Itoa(*flagPort))
+	}
+
+	var corpus []gochinadns.LoadQuery
+	if *corpusPath == "" {
+		for _, domain := range gochinadns.BenchDomains {
+			corpus = append(corpus, gochinadns.LoadQuery{Name: dns.Fqdn(domain), Qtype: dns.TypeA})
+		}
+	} else {
+		f, err := os.Open(*corpusPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		corpus, err = gochinadns.ReadLoadCorpus(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Fail to read %s: %v\n", *corpusPath, err)
+			return 1
+		}
+	}
+
+	r, err := gochinadns.LoadTest(context.Background(), addr, *network, corpus, *concurrency, *duration, *timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *asJSON {
+		b, _ := json.MarshalIndent(r, "", "  ")
+		fmt.Println(string(b))
+		return 0
+	}
+	fmt.Printf("%d queries in %.1fs to %s over %s, %.0f QPS.\n", r.Queries, r.Duration, addr, *network, r.QPS)
+	fmt.Printf("Errors: %d without a reply. Error rate %.2f%%, SERVFAIL included.\n", r.Errors, r.ErrorRate*100)
+	rcodes := make([]string, 0, len(r.Rcodes))
+	for rcode := range r.Rcodes {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Strings(rcodes)
+	for _, rcode := range rcodes {
+		fmt.Printf("  %-9s %d\n", rcode, r.Rcodes[rcode])
+	}
+	fmt.Printf("Latency: p50 %.1fms, p90 %.1fms, p99 %.1fms, max %.1fms.\n", r.LatencyP50, r.LatencyP90, r.LatencyP99, r.LatencyMax)
+	return 0
+}
+
+// convert runs the convert subcommand with args, [-from format] [-to format] [-o file] input..., and returns the exit code.
+func convert(args []string) int {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	from := fs.String("from", "", "Format of inputs: domains, hosts, dnsmasq, autoproxy or cidr. Detected by content if empty.")
+	to := fs.String("to", gochinadns.ListDomains, "Format of the output: domains, hosts, dnsmasq, autoproxy or cidr.")
+	output := fs.String("o", "-", "Output file. - for stdout.")
+	dnsmasqServer := fs.String("dnsmasq-server", "114.114.114.114", "Upstream of server= lines in dnsmasq output.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: chinadns convert [-from format] [-to format] [-o file] input...")
+		fmt.Fprintln(fs.Output(), "Inputs are merged and deduplicated. - for stdin.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := gochinadns.CheckListConversion(*from, *to); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var lists [][]string
+	for _, input := range fs.Args() {
+		entries, format, err := readList(input, *from)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Fail to read %s: %v\n", input, err)
+			return 1
+		}
+		if err := gochinadns.CheckListConversion(format, *to); err != nil {
+			fmt.Fprintf(os.Stderr, "Fail to convert %s: %v\n", input, err)
+			return 1
+		}
+		lists = append(lists, entries)
+	}
+	entries := gochinadns.MergeLists(*to, lists...)
+
+	w := os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := gochinadns.WriteList(w, *to, entries, *dnsmasqServer); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%d entries written.\n", len(entries))
+	return 0
+}
+
+// readList reads entries of the list at path in format, or of stdin if path is -, and the format read.
+func readList(path, format string) ([]string, string, error) {
+	if path == "-" {
+		return gochinadns.ReadList(os.Stdin, format)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, format, err
+	}
+	defer f.Close()
+	return gochinadns.ReadList(f, format)
+}
+
+func main() {
+	var cmdline map[string]bool
+	if compatMode() {
+		var err error
+		if cmdline, err = parseCompatFlags(os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+			compatUsage()
+			os.Exit(1)
+		}
+	} else {
+		flag.Parse()
+		cmdline = make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { cmdline[f.Name] = true })
+	}
+	// problems of flags are reported along with those of options by -check, or else panic.
+	problems := loadEnv(os.Environ(), cmdline)
+	if *flagVersion {
+		info := gochinadns.GetBuildInfo()
+		fmt.Println(gochinadns.GetVersion())
+		if info.Commit != "" {
+			fmt.Printf("Commit: %s\n", info.Commit)
+		}
+		if info.Date != "" {
+			fmt.Printf("Build date: %s\n", info.Date)
+		}
+		fmt.Printf("Go version: %s\n", info.GoVersion)
+		return
+	}
+	if flag.Arg(0) == "convert" {
+		os.Exit(convert(flag.Args()[1:]))
+	}
+	if code, ok := serviceCommand(); ok {
+		os.Exit(code)
+	}
+	inService := enterService()
+	if *flagVerbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	if *flagConfig != "" {
+		problems = append(problems, loadConfigFile(*flagConfig, cmdline)...)
+	}
+	if len(problems) > 0 && !*flagCheck {
+		panic(problems[0])
+	}
+
+	if flag.Arg(0) == "update-lists" {
+		os.Exit(updateListsCommand())
+	}
+	if flag.Arg(0) == "loadtest" {
+		os.Exit(loadtest(flag.Args()[1:]))
+	}
 
+	opts, errs := serverOptions(cmdline)
+	if problems = append(problems, errs...); *flagCheck {
+		os.Exit(check(opts, problems))
+	}
+	if len(problems) > 0 {
+		panic(problems[0])
+	}
+	if *flagPrintConfig != "" {
+		os.Exit(printConfig(os.Stdout, *flagPrintConfig, opts))
+	}
+	switch flag.Arg(0) {
+	case "trace":
+		os.Exit(trace(opts, flag.Args()[1:]))
+	case "bench":
+		os.Exit(bench(opts, flag.Args()[1:]))
+	}
+	if *flagDetach && !inService {
+		pid, err := detach()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Detached as process %d.\n", pid)
+		return
+	}
 	server, err := gochinadns.NewServer(opts...)
 	if err != nil {
 		panic(err)
 	}
+	if *flagPIDFile != "" {
+		if err := writePIDFile(*flagPIDFile); err != nil {
+			panic(err)
+		}
+		defer func() {
+			if err := removePIDFile(*flagPIDFile); err != nil {
+				logrus.WithError(err).Error("Fail to remove PID file.")
+			}
+		}()
+	}
+	if inService {
+		runService(server)
+		return
+	}
+	go reloadOnSignal(server)
 
-	runUntilCanceled(context.Background(), server.Run)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go shutdownOnSignal(server, cancel, done)
+	go notifySystemd(ctx, server)
+	go runListUpdates(ctx, server)
+	runUntilCanceled(ctx, server.Run)
+	<-done
+}
+
+// shutdownOnSignal shuts down the server gracefully on SIGINT or SIGTERM, and closes done when finished.
+func shutdownOnSignal(server *gochinadns.Server, cancel context.CancelFunc, done chan<- struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	logrus.Infof("%s received. Shut down.", s)
+	// stop restarting the server first.
+	cancel()
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+	defer cancelTimeout()
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Error("Fail to shut down gracefully.")
+	}
+	close(done)
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestCheckBadFlags(t *testing.T) {
+	for name, value := range map[string]string{"source-ports": "abc", "log-levels": "verdict=bogus"} {
+		old := flag.Lookup(name).Value.String()
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+		defer flag.Set(name, old)
+	}
+	opts, errs := serverOptions(map[string]bool{})
+	if len(errs) != 2 {
+		t.Fatalf("Problems of bad flags = %v, want 2", errs)
+	}
+	for i, want := range []string{"bogus", "abc"} {
+		if !strings.Contains(errs[i].Error(), want) {
+			t.Errorf("Problem %d = %v, want one of %s", i, errs[i], want)
+		}
+	}
+	if code := check(opts, errs); code != 1 {
+		t.Errorf("check() = %d, want 1", code)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "github.com/cherrot/gochinadns"
+
+// serviceCommand runs the command of -service, and returns the exit code, or false if there is none.
+// Only Windows services are supported. Elsewhere, use an init system such as systemd.
+func serviceCommand() (int, bool) {
+	return 0, false
+}
+
+// enterService reports whether the process is started as a Windows service, and prepares for it.
+func enterService() bool {
+	return false
+}
+
+// runService runs server as a Windows service until the service is stopped.
+func runService(server *gochinadns.Server) {}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"github.com/cherrot/gochinadns"
+)
+
+const _serviceName = "gochinadns"
+
+var flagService = flag.String("service", "", "Control the Windows service: install with the other flags, uninstall, start or stop.")
+
+// serviceCommand runs the command of -service, and returns the exit code, or false if there is none.
+func serviceCommand() (int, bool) {
+	if *flagService == "" {
+		return 0, false
+	}
+	var err error
+	switch *flagService {
+	case "install":
+		err = installService(serviceArgs(os.Args[1:]))
+	case "uninstall":
+		err = uninstallService()
+	case "start":
+		err = controlService(func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		err = controlService(stopService)
+	default:
+		err = fmt.Errorf("unknown service command [%s]", *flagService)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1, true
+	}
+	fmt.Printf("Service %s %s.\n", _serviceName, *flagService)
+	return 0, true
+}
+
+// serviceArgs returns args without -service, to run the service with.
+func serviceArgs(args []string) []string {
+	kept := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if name == "service" {
+			i++ // skip the value
+			continue
+		}
+		if strings.HasPrefix(name, "service=") {
+			continue
+		}
+		kept = append(kept, args[i])
+	}
+	return kept
+}
+
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(_serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", _serviceName)
+	}
+	s, err := m.CreateService(_serviceName, exe, mgr.Config{
+		DisplayName: "gochinadns",
+		Description: "DNS forwarder which avoids DNS pollution in China.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	// restart on failure, like a supervisor would.
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}, 60); err != nil {
+		s.Delete()
+		return err
+	}
+	if err := eventlog.InstallAsEventCreate(_serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return err
+	}
+	return nil
+}
+
+func uninstallService() error {
+	if err := controlService(func(s *mgr.Service) error { return s.Delete() }); err != nil {
+		return err
+	}
+	return eventlog.Remove(_serviceName)
+}
+
+func controlService(f func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(_serviceName)
+	if err != nil {
+		return fmt.Errorf("fail to open service %s: %v", _serviceName, err)
+	}
+	defer s.Close()
+	return f(s)
+}
+
+// stopService stops the service and waits for it to shut down.
+func stopService(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(*flagShutdownTimeout + 5*time.Second)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s is still in state %d", _serviceName, status.State)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enterService reports whether the process is started as a Windows service, and prepares for it:
+// relative paths are resolved against the directory of the executable instead of the system directory,
+// and warnings and errors are logged to the event log as well.
+func enterService() bool {
+	inService, err := svc.IsWindowsService()
+	if err != nil {
+		logrus.WithError(err).Error("Fail to detect Windows service.")
+		return false
+	}
+	if !inService {
+		return false
+	}
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+	if el, err := eventlog.Open(_serviceName); err == nil {
+		logrus.AddHook(eventlogHook{el})
+	}
+	return true
+}
+
+// runService runs server as a Windows service until the service is stopped.
+func runService(server *gochinadns.Server) {
+	if err := svc.Run(_serviceName, &service{server: server}); err != nil {
+		logrus.WithError(err).Error("Fail to run Windows service.")
+	}
+}
+
+type service struct {
+	server *gochinadns.Server
+}
+
+// Execute serves until the service is stopped, and reloads like SIGHUP on parameter changes.
+// A server stopped by an error fails the service, which is then restarted by its recovery actions.
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	changes <- svc.Status{State: svc.StartPending}
+	if err := s.server.Start(); err != nil {
+		logrus.WithError(err).Error("Fail to start server.")
+		return true, 1
+	}
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.server.Wait() }()
+	changes <- svc.Status{State: svc.Running, Accepts: accepts}
+
+	for {
+		select {
+		case err := <-stopped:
+			logrus.WithError(err).Error("Server stopped.")
+			return true, 1
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				changes <- r.CurrentStatus
+			case svc.ParamChange:
+				logrus.Info("Parameter change received. Reload.")
+				if err := s.server.Reload(); err != nil {
+					logrus.WithError(err).Error("Fail to reload.")
+				}
+			case svc.Stop, svc.Shutdown:
+				logrus.Info("Service stop received. Shut down.")
+				changes <- svc.Status{State: svc.StopPending}
+				ctx, cancel := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+				if err := s.server.Shutdown(ctx); err != nil {
+					logrus.WithError(err).Error("Fail to shut down gracefully.")
+				}
+				cancel()
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventlogHook logs warnings and errors to the Windows event log.
+type eventlogHook struct {
+	log *eventlog.Log
+}
+
+func (h eventlogHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+func (h eventlogHook) Fire(e *logrus.Entry) error {
+	msg, err := e.String()
+	if err != nil {
+		return err
+	}
+	if e.Level == logrus.WarnLevel {
+		return h.log.Warning(1, msg)
+	}
+	return h.log.Error(1, msg)
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// switchProfileSignals are signals to switch to the next profile on.
+var switchProfileSignals = []os.Signal{syscall.SIGUSR1}
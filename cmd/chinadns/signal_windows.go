@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// switchProfileSignals are signals to switch to the next profile on. Windows has no SIGUSR1.
+var switchProfileSignals []os.Signal
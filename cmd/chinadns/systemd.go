@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// notifySystemd tells systemd the server is ready once it's listening, lists are loaded and an upstream is responsive,
+// and pings the watchdog, if gochinadns is a Type=notify service. It tells systemd the server is stopping when ctx is done.
+// See sd_notify(3).
+func notifySystemd(ctx context.Context, server *gochinadns.Server) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	notify := func(state string) {
+		if err := sdNotify(socket, state); err != nil {
+			logrus.WithError(err).Errorf("Fail to notify systemd of %s.", state)
+		}
+	}
+
+	var watchdog <-chan time.Time
+	if interval := watchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+	poll := time.NewTicker(500 * time.Millisecond)
+	defer poll.Stop()
+	ready := false
+	for {
+		select {
+		case <-ctx.Done():
+			notify("STOPPING=1")
+			return
+		case <-watchdog:
+			notify("WATCHDOG=1")
+		case <-poll.C:
+			if ready {
+				continue
+			}
+			if err := server.Ready(); err != nil {
+				logrus.WithError(err).Debug("Not ready yet.")
+				continue
+			}
+			ready = true
+			notify("READY=1")
+		}
+	}
+}
+
+// watchdogInterval returns the watchdog timeout systemd set for this process, or 0 if there is none.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+func sdNotify(socket, state string) error {
+	if socket[0] == '@' { // abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
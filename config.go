@@ -0,0 +1,368 @@
+package gochinadns
+
+import "github.com/miekg/dns"
+
+// Config is the effective configuration of a running server, after defaults and reloads are applied.
+// It's a snapshot, which shares nothing with the server: it doesn't follow later reloads, and changing it
+// changes nothing of the server.
+type Config struct {
+	Listen        string            `json:"listen"`
+	MetricsListen string            `json:"metrics_listen,omitempty"`
+	AdminListen   string            `json:"admin_listen,omitempty"`
+	AdminAuth     []string          `json:"admin_auth,omitempty"` //bearer-token, tls and client-cert
+	DebugListen   string            `json:"debug_listen,omitempty"`
+	LogLevels     map[string]string `json:"log_levels,omitempty"`
+	Profile       string            `json:"profile,omitempty"`
+	Profiles      []string          `json:"profiles,omitempty"`
+
+	TrustedResolvers   []ResolverConfig `json:"trusted_resolvers"`
+	UntrustedResolvers []ResolverConfig `json:"untrusted_resolvers"`
+	Lists              ListSizes        `json:"lists"`
+
+	Timeout          string        `json:"timeout"`
+	Delay            string        `json:"delay"`
+	Dispatch         string        `json:"dispatch,omitempty"`
+	FastestFirst     bool          `json:"fastest_first"`
+	Retries          int           `json:"retries,omitempty"`
+	RetryTimeout     string        `json:"retry_timeout,omitempty"`
+	RetryBackoff     string        `json:"retry_backoff,omitempty"`
+	RcodeFailover    bool          `json:"rcode_failover"`
+	RelayAgreed      bool          `json:"relay_agreed"`
+	LazyLists        bool          `json:"lazy_lists"`
+	UDPMaxSize       int           `json:"udp_max_size"`
+	TCPOnly          bool          `json:"tcp_only"`
+	Bidirectional    bool          `json:"bidirectional"`
+	SuspectEmpty     bool          `json:"suspect_empty"`
+	Coalesce         bool          `json:"coalesce"`
+	RawForward       bool          `json:"raw_forward"`
+	MaxConcurrency   int           `json:"max_concurrency,omitempty"`
+	OverloadQueue    int           `json:"overload_queue,omitempty"`
+	OverloadAction   string        `json:"overload_action,omitempty"`
+	RateLimit        float64       `json:"rate_limit,omitempty"`
+	RateLimitBurst   int           `json:"rate_limit_burst,omitempty"`
+	RateLimitAction  string        `json:"rate_limit_action,omitempty"`
+	RateLimitExempt  []string      `json:"rate_limit_exempt,omitempty"`
+	RRLRate          int           `json:"rrl_rate,omitempty"`
+	RRLSlip          int           `json:"rrl_slip"`
+	RRLIPv4Prefix    int           `json:"rrl_ipv4_prefix"`
+	RRLIPv6Prefix    int           `json:"rrl_ipv6_prefix"`
+	AllowedClients   []string      `json:"allowed_clients,omitempty"`
+	DeniedClients    []string      `json:"denied_clients,omitempty"`
+	ACLAction        string        `json:"acl_action,omitempty"`
+	QNAMEMinimize    bool          `json:"qname_minimization"`
+	ReusePort        bool          `json:"reuse_port"`
+	UDPSockets       int           `json:"udp_sockets"`
+	UDPBatch         int           `json:"udp_batch"`
+	SourcePortMin    int           `json:"source_port_min,omitempty"`
+	SourcePortMax    int           `json:"source_port_max,omitempty"`
+	UpstreamSockets  int           `json:"upstream_sockets"`
+	UpstreamRotation string        `json:"upstream_rotation,omitempty"`
+	TrustedQuorum    int           `json:"trusted_quorum,omitempty"`
+	DNS64            string        `json:"dns64,omitempty"`
+	DomainRoutes     int           `json:"domain_routes,omitempty"` //domains with routes of dnsmasq conf and dnscrypt-proxy rules
+	MDNS             string        `json:"mdns,omitempty"`
+	Zones            []string      `json:"zones,omitempty"`       //origins of zone files
+	DHCPLeases       int           `json:"dhcp_leases,omitempty"` //hostnames of DHCP leases
+	DHCPDomain       string        `json:"dhcp_domain,omitempty"`
+	MergedAnswers    string        `json:"merged_answers,omitempty"`
+	FastestIP        string        `json:"fastest_ip,omitempty"`
+	FastestIPWait    string        `json:"fastest_ip_wait,omitempty"`
+	TrustedECS       string        `json:"trusted_ecs"`
+	UntrustedECS     string        `json:"untrusted_ecs"`
+	TrustedSockets   SocketOptions `json:"trusted_sockets"`
+	UntrustedSockets SocketOptions `json:"untrusted_sockets"`
+	IPSets           []string      `json:"ipsets,omitempty"`
+	NFTSets          []string      `json:"nftsets,omitempty"`
+	TestDomains      []string      `json:"test_domains"`
+	TestQueryType    string        `json:"test_query_type"`
+	SkipStartupTest  bool          `json:"skip_startup_test"`
+	CanaryInterval   string        `json:"canary_interval,omitempty"`
+	BreakerFails     int           `json:"breaker_threshold,omitempty"`
+	BreakerCooldown  string        `json:"breaker_cooldown,omitempty"`
+	HealthInterval   string        `json:"health_interval,omitempty"`
+	UpstreamSummary  string        `json:"upstream_summary,omitempty"`
+
+	QueryLog       string  `json:"query_log,omitempty"`
+	QueryLogFormat string  `json:"query_log_format,omitempty"`
+	QueryLogSample int     `json:"query_log_sample,omitempty"`
+	RecentQueries  int     `json:"recent_queries,omitempty"`
+	CacheEntries   int     `json:"cache_entries,omitempty"`
+	StateFile      string  `json:"state_file,omitempty"`
+	AuditLog       string  `json:"audit_log,omitempty"`
+	Syslog         string  `json:"syslog,omitempty"`
+	StatsdAddr     string  `json:"statsd,omitempty"`
+	DnstapSocket   string  `json:"dnstap,omitempty"`
+	OTLPEndpoint   string  `json:"otlp_endpoint,omitempty"`
+	TraceRatio     float64 `json:"trace_ratio,omitempty"`
+	Webhook        bool    `json:"pollution_webhook"` //the URL is not shown since it may contain credentials
+	CacheRedis     bool    `json:"cache_redis"`       //the URL is not shown since it may contain credentials
+	UpstreamHook   bool    `json:"upstream_webhook"`  //the URL is not shown since it may contain credentials
+
+	// Extensions of library users, which are not shown but counted.
+	Middlewares            int    `json:"middlewares,omitempty"`
+	EventHooks             int    `json:"event_hooks,omitempty"`
+	CustomTrustPolicy      bool   `json:"custom_trust_policy"`
+	CustomCacheBackend     bool   `json:"custom_cache_backend"`
+	ResolverSourceInterval string `json:"resolver_source_interval,omitempty"` //how often the resolver source is polled
+	KVConfig               string `json:"kv_config,omitempty"`                //store and prefix of keys of resolvers and domain lists
+	Peers                  int    `json:"peers,omitempty"`                    //the URLs are not shown since they may contain credentials
+	PeerInterval           string `json:"peer_interval,omitempty"`            //how often state is synced with peers
+}
+
+// ResolverConfig is the effective configuration and state of an upstream resolver.
+type ResolverConfig struct {
+	Addr      string   `json:"addr"`
+	Addrs     []string `json:"addrs,omitempty"` //resolved from the host of Addr
+	Protocols []string `json:"protocols"`
+	Mutation  string   `json:"mutation"`
+	Group     string   `json:"group,omitempty"`
+	Weight    int      `json:"weight,omitempty"`
+	Timeout   string   `json:"timeout,omitempty"`
+	Delay     string   `json:"delay,omitempty"`
+	Source    string   `json:"source,omitempty"`
+	Enabled   bool     `json:"enabled"`
+	Hijacked  string   `json:"hijacked,omitempty"`
+	Reason    string   `json:"reason,omitempty"` //why it's trusted or untrusted
+}
+
+// ListSizes is the number of entries in each loaded list.
+type ListSizes struct {
+	ChinaCIDR        int `json:"china_cidr"`
+	IPBlacklist      int `json:"ip_blacklist"`
+	DomainBlacklist  int `json:"domain_blacklist"`
+	DomainPolluted   int `json:"domain_polluted"`
+	DomainBidiExempt int `json:"bidirectional_exempt"`
+	BogusNXDomain    int `json:"bogus_nxdomain"`
+}
+
+// Config returns a snapshot of the effective configuration of the server, with states of resolvers,
+// so that management UIs need not mirror the configuration themselves.
+func (s *Server) Config() *Config {
+	return newConfig(s.options(), s)
+}
+
+// EffectiveConfig returns the configuration of a server created with opts, without creating it,
+// so that resolvers are neither tested nor sorted. All resolvers are enabled.
+func EffectiveConfig(opts ...ServerOption) (*Config, error) {
+	o, err := buildOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return newConfig(o, nil), nil
+}
+
+// newConfig returns the configuration of o, with states of resolvers in s if it's not nil.
+func newConfig(o *serverOptions, s *Server) *Config {
+	c := &Config{
+		Listen:             o.Listen,
+		MetricsListen:      o.MetricsListen,
+		AdminListen:        o.AdminListen,
+		DebugListen:        o.DebugListen,
+		Profile:            o.Profile,
+		TrustedResolvers:   resolverConfigs(o.TrustedServers, s),
+		UntrustedResolvers: resolverConfigs(o.UntrustedServers, s),
+		Lists: ListSizes{
+			DomainBlacklist:  o.DomainBlacklist.Len(),
+			DomainPolluted:   o.DomainPolluted.Len(),
+			DomainBidiExempt: o.DomainBidiExempt.Len(),
+		},
+		Timeout:          o.Timeout.String(),
+		Delay:            o.Delay.String(),
+		Dispatch:         o.Dispatch,
+		FastestFirst:     o.FastestFirst,
+		RcodeFailover:    o.RcodeFailover,
+		RelayAgreed:      o.RelayAgreed,
+		LazyLists:        o.LazyLists,
+		UDPMaxSize:       o.UDPMaxSize,
+		TCPOnly:          o.TCPOnly,
+		Bidirectional:    o.Bidirectional,
+		SuspectEmpty:     o.SuspectEmpty,
+		Coalesce:         o.Coalesce,
+		RawForward:       o.RawForward,
+		MaxConcurrency:   o.MaxConcurrency,
+		OverloadQueue:    o.OverloadQueue,
+		OverloadAction:   o.OverloadAction,
+		RateLimit:        o.RateLimit,
+		RateLimitBurst:   o.RateLimitBurst,
+		RateLimitAction:  o.RateLimitAction,
+		RateLimitExempt:  copyStrings(o.RateLimitExempt),
+		RRLRate:          o.RRLRate,
+		RRLSlip:          o.RRLSlip,
+		RRLIPv4Prefix:    o.RRLIPv4Prefix,
+		RRLIPv6Prefix:    o.RRLIPv6Prefix,
+		AllowedClients:   copyStrings(o.AllowedClients),
+		DeniedClients:    copyStrings(o.DeniedClients),
+		QNAMEMinimize:    o.QNAMEMinimize,
+		ReusePort:        o.ReusePort,
+		UDPSockets:       o.UDPSockets,
+		UDPBatch:         o.UDPBatch,
+		SourcePortMin:    o.SourcePortMin,
+		SourcePortMax:    o.SourcePortMax,
+		UpstreamSockets:  o.UpstreamSockets,
+		TrustedQuorum:    o.TrustedQuorum,
+		TrustedECS:       o.TrustedECS.String(),
+		UntrustedECS:     o.UntrustedECS.String(),
+		TrustedSockets:   o.TrustedSockets,
+		UntrustedSockets: o.UntrustedSockets,
+		IPSets:           setConfigs(o.IPSets),
+		NFTSets:          setConfigs(o.NFTSets),
+		TestDomains:      copyStrings(o.TestDomains),
+		TestQueryType:    dns.TypeToString[o.TestQType],
+		SkipStartupTest:  o.SkipStartupTest,
+		QueryLog:         o.QueryLog,
+		QueryLogSample:   o.QueryLogSample,
+		RecentQueries:    o.RecentQueries,
+		CacheEntries:     o.CacheEntries,
+		StateFile:        o.StateFile,
+		AuditLog:         o.AuditLog,
+		StatsdAddr:       o.StatsdAddr,
+		DnstapSocket:     o.DnstapSocket,
+		OTLPEndpoint:     o.OTLPEndpoint,
+		Webhook:          o.PollutionWebhook != "",
+		CacheRedis:       o.CacheRedis != "",
+		UpstreamHook:     o.UpstreamWebhook != "",
+
+		Middlewares:        len(o.Middlewares),
+		EventHooks:         len(o.EventHooks),
+		CustomTrustPolicy:  o.TrustPolicy != nil,
+		CustomCacheBackend: o.CacheBackend != nil,
+	}
+	if o.AdminToken != "" {
+		c.AdminAuth = append(c.AdminAuth, "bearer-token")
+	}
+	if o.AdminCert != "" {
+		c.AdminAuth = append(c.AdminAuth, "tls")
+	}
+	if o.AdminClientCA != "" {
+		c.AdminAuth = append(c.AdminAuth, "client-cert")
+	}
+	if o.ChinaCIDR != nil {
+		c.Lists.ChinaCIDR = o.ChinaCIDR.Len()
+	}
+	if o.IPBlacklist != nil {
+		c.Lists.IPBlacklist = o.IPBlacklist.Len()
+	}
+	if o.BogusNXDomain != nil {
+		c.Lists.BogusNXDomain = o.BogusNXDomain.Len()
+	}
+	if len(o.LogLevels) > 0 {
+		c.LogLevels = make(map[string]string, len(o.LogLevels))
+		for component, level := range o.LogLevels {
+			c.LogLevels[component] = level.String()
+		}
+	}
+	for _, p := range o.Profiles {
+		c.Profiles = append(c.Profiles, p.name)
+	}
+	if o.BreakerThreshold > 0 {
+		c.BreakerFails, c.BreakerCooldown = o.BreakerThreshold, o.BreakerCooldown.String()
+	}
+	if o.Retries > 0 {
+		c.Retries, c.RetryBackoff = o.Retries, o.RetryBackoff.String()
+		if o.RetryTimeout > 0 {
+			c.RetryTimeout = o.RetryTimeout.String()
+		}
+	}
+	if o.UpstreamRotation > 0 {
+		c.UpstreamRotation = o.UpstreamRotation.String()
+	}
+	if o.HealthInterval > 0 {
+		c.HealthInterval = o.HealthInterval.String()
+	}
+	if o.CanaryInterval > 0 {
+		c.CanaryInterval = o.CanaryInterval.String()
+	}
+	if o.UpstreamSummary > 0 {
+		c.UpstreamSummary = o.UpstreamSummary.String()
+	}
+	if o.QueryLog != "" {
+		c.QueryLogFormat = o.QueryLogFormat
+	}
+	if o.OTLPEndpoint != "" {
+		c.TraceRatio = o.TraceRatio
+	}
+	if o.Syslog {
+		c.Syslog = o.SyslogAddr
+	}
+	if o.KVStore != nil {
+		c.KVConfig = kvName(o.KVStore, o.KVPrefix)
+	}
+	if o.ResolverSource != nil {
+		c.ResolverSourceInterval = o.ResolverSourceInterval.String()
+	}
+	if len(o.Peers) > 0 {
+		c.Peers, c.PeerInterval = len(o.Peers), o.PeerInterval.String()
+	}
+	if len(o.AllowedClients) > 0 || len(o.DeniedClients) > 0 {
+		c.ACLAction = o.ACLAction
+	}
+	if o.DNS64 != nil {
+		c.DNS64 = o.DNS64.String()
+	}
+	c.DomainRoutes = len(o.DomainRoutes)
+	for _, zone := range o.LocalZones {
+		c.Zones = append(c.Zones, zone.origin)
+	}
+	if o.DHCPLeases != nil {
+		c.DHCPLeases, c.DHCPDomain = len(o.DHCPLeases.hosts), o.DHCPDomain
+	}
+	c.MergedAnswers = o.MergedAnswers
+	if o.FastestIP != nil {
+		c.FastestIP = o.FastestIP.String()
+		c.FastestIPWait = _probeWait.String()
+		if o.FastestIPWait > 0 {
+			c.FastestIPWait = o.FastestIPWait.String()
+		}
+	}
+	if o.MDNS != nil {
+		c.MDNS = o.MDNS.target
+	}
+	return c
+}
+
+func setConfigs(rules []setRule) []string {
+	var configs []string
+	for _, rule := range rules {
+		configs = append(configs, rule.String())
+	}
+	return configs
+}
+
+func resolverConfigs(servers resolverArray, s *Server) []ResolverConfig {
+	configs := make([]ResolverConfig, 0, len(servers))
+	for _, server := range servers {
+		c := ResolverConfig{
+			Addr:      server.GetAddr(),
+			Addrs:     copyStrings(server.addrs),
+			Protocols: copyStrings(server.GetProtocols()),
+			Mutation:  server.GetMutation(),
+			Group:     server.group,
+			Weight:    server.weight,
+			Enabled:   true,
+			Reason:    server.reason,
+		}
+		if server.timeout > 0 {
+			c.Timeout = server.timeout.String()
+		}
+		if server.delay > 0 {
+			c.Delay = server.delay.String()
+		}
+		if server.source != nil {
+			c.Source = server.source.String()
+		}
+		if s != nil {
+			c.Enabled = !s.isDisabled(server.GetAddr())
+			c.Hijacked = s.canary.reason(server.GetAddr())
+		}
+		configs = append(configs, c)
+	}
+	return configs
+}
+
+// copyStrings returns a copy of ss, which is nil if ss is.
+func copyStrings(ss []string) []string {
+	if ss == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(ss)), ss...)
+}
@@ -0,0 +1,828 @@
+package gochinadns
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigSetting is a setting of a config file.
+// Arrays are joined by commas, so that values are in the same format as command line flags.
+type ConfigSetting struct {
+	Path    string //Path of the config file, which differs from the one read for included files
+	Line    int
+	Key     string
+	Value   string
+	Profile string //Name of the profile the setting belongs to. Empty for settings outside of profiles.
+}
+
+// ReadConfigFile reads settings from a config file, which is a subset of TOML (https://toml.io) without tables:
+//
+//	# comments
+//	listen = "[::]:53"
+//	resolvers = ["udp+tcp@119.29.29.29:53", "8.8.8.8:53"]
+//	bidirectional = true
+//	query-log-max-size = 100
+//	include = "conf.d/*.toml"
+//	profile = "home"
+//
+//	[profile.travel]
+//	bidirectional = false
+//
+// Settings after a [profile.NAME] header belong to the profile, which is applied over other settings when it's active.
+// Other tables are not supported. Profiles end at the end of the file, so included files start outside of profiles.
+//
+// include reads files matching the glob patterns, relative to the directory of the including file,
+// in lexical order as if their settings were written at the include line. Included files may include others.
+// A key set in more than one file takes the value of the last one read, at its place.
+//
+// Files ending in .yaml or .yml are read as YAML instead, with the same keys, lists for arrays and profiles under
+// a profiles mapping:
+//
+//	listen: "[::]:53"
+//	resolvers: [udp+tcp@119.29.29.29:53, 8.8.8.8:53]
+//	profiles:
+//	  travel:
+//	    bidirectional: false
+//
+// Files of both formats may include each other.
+//
+// Errors are prefixed with the path and line number.
+func ReadConfigFile(path string) ([]ConfigSetting, error) {
+	settings, err := readConfigFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	last := make(map[[2]string]int, len(settings))
+	for i, setting := range settings {
+		last[[2]string{setting.Profile, setting.Key}] = i
+	}
+	merged := settings[:0]
+	for i, setting := range settings {
+		if last[[2]string{setting.Profile, setting.Key}] == i {
+			merged = append(merged, setting)
+		}
+	}
+	return merged, nil
+}
+
+// readConfigFile reads settings of path and the files it includes. including are paths of files including path.
+func readConfigFile(path string, including []string) ([]ConfigSetting, error) {
+	for _, p := range including {
+		if p == path {
+			return nil, errors.Errorf("%s: include cycle: %s", path, strings.Join(append(including, path), " -> "))
+		}
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		return readYAMLConfigFile(path, including)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to open config file")
+	}
+	defer file.Close()
+
+	var (
+		settings []ConfigSetting
+		section  string                 //profile of the following settings
+		seen     = make(map[string]int) //profile.key -> line
+		scanner  = bufio.NewScanner(file)
+		lineNo   int
+	)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			name := strings.TrimPrefix(strings.TrimSuffix(line, "]"), "[profile.")
+			if !strings.HasPrefix(line, "[profile.") || !strings.HasSuffix(line, "]") || !isProfileName(name) {
+				return nil, errors.Errorf("%s:%d: tables other than [profile.NAME] are not supported", path, lineNo)
+			}
+			section = name
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, errors.Errorf("%s:%d: expect key = value", path, lineNo)
+		}
+		key, raw := strings.TrimSpace(line[:eq]), strings.TrimSpace(line[eq+1:])
+		if unquoted, err := parseConfigString(key); err == nil {
+			key = unquoted
+		}
+		if key == "" {
+			return nil, errors.Errorf("%s:%d: empty key", path, lineNo)
+		}
+		if prev, ok := seen[section+"."+key]; ok {
+			return nil, errors.Errorf("%s:%d: duplicate key %s, first set at line %d", path, lineNo, key, prev)
+		}
+		seen[section+"."+key] = lineNo
+
+		start := lineNo
+		// arrays may span lines.
+		for strings.HasPrefix(raw, "[") && !strings.HasSuffix(raw, "]") {
+			if !scanner.Scan() {
+				return nil, errors.Errorf("%s:%d: unterminated array of %s", path, start, key)
+			}
+			lineNo++
+			raw += " " + strings.TrimSpace(stripComment(scanner.Text()))
+		}
+		value, err := parseConfigValue(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d: %s", path, start, key)
+		}
+		if key == "include" {
+			if section != "" {
+				return nil, errors.Errorf("%s:%d: include is not supported in profiles", path, start)
+			}
+			included, err := includeConfigFiles(path, value, including)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s:%d: include", path, start)
+			}
+			settings = append(settings, included...)
+			continue
+		}
+		settings = append(settings, ConfigSetting{Path: path, Line: start, Key: key, Value: value, Profile: section})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "fail to scan config file")
+	}
+	return settings, nil
+}
+
+// includeConfigFiles reads settings of files matching patterns, which are relative to the directory of path.
+func includeConfigFiles(path, patterns string, including []string) ([]ConfigSetting, error) {
+	var settings []ConfigSetting
+	for _, pattern := range splitConfigList(patterns) {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 && !hasGlobMeta(pattern) {
+			return nil, errors.Errorf("no such file %s", pattern)
+		}
+		for _, match := range matches {
+			included, err := readConfigFile(match, append(including, path))
+			if err != nil {
+				return nil, err
+			}
+			settings = append(settings, included...)
+		}
+	}
+	return settings, nil
+}
+
+// readYAMLConfigFile reads settings of the YAML file at path and the files it includes.
+func readYAMLConfigFile(path string, including []string) ([]ConfigSetting, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to open config file")
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, errors.Wrapf(err, "%s", path)
+	}
+	var (
+		settings []ConfigSetting
+		lines    = yamlLines{lines: strings.Split(string(b), "\n")}
+	)
+	var add func(section string, items yaml.MapSlice) error
+	add = func(section string, items yaml.MapSlice) error {
+		seen := make(map[string]int) //key -> line
+		for _, item := range items {
+			key := fmt.Sprint(item.Key)
+			lineNo := lines.find(key)
+			if prev, ok := seen[key]; ok {
+				return errors.Errorf("%s:%d: duplicate key %s, first set at line %d", path, lineNo, key, prev)
+			}
+			seen[key] = lineNo
+			if key == "profiles" && section == "" {
+				profiles, ok := item.Value.(yaml.MapSlice)
+				if !ok {
+					return errors.Errorf("%s:%d: profiles should be a mapping of names to settings", path, lineNo)
+				}
+				for _, profile := range profiles {
+					name := fmt.Sprint(profile.Key)
+					nameLine := lines.find(name)
+					profileItems, ok := profile.Value.(yaml.MapSlice)
+					if !isProfileName(name) || !ok && profile.Value != nil {
+						return errors.Errorf("%s:%d: invalid profile %s", path, nameLine, name)
+					}
+					if _, ok := seen["profiles."+name]; ok {
+						return errors.Errorf("%s:%d: duplicate profile %s", path, nameLine, name)
+					}
+					seen["profiles."+name] = nameLine
+					if err := add(name, profileItems); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			value, err := yamlConfigValue(item.Value)
+			if err != nil {
+				return errors.Wrapf(err, "%s:%d: %s", path, lineNo, key)
+			}
+			if key == "include" {
+				if section != "" {
+					return errors.Errorf("%s:%d: include is not supported in profiles", path, lineNo)
+				}
+				included, err := includeConfigFiles(path, value, including)
+				if err != nil {
+					return errors.Wrapf(err, "%s:%d: include", path, lineNo)
+				}
+				settings = append(settings, included...)
+				continue
+			}
+			settings = append(settings, ConfigSetting{Path: path, Line: lineNo, Key: key, Value: value, Profile: section})
+		}
+		return nil
+	}
+	if err := add("", doc); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// yamlLines finds line numbers of keys of a YAML document, which yaml.v2 doesn't report, by looking for them in
+// order after the last one found.
+type yamlLines struct {
+	lines []string
+	next  int //index of the line to look from
+}
+
+// find returns the line number of key, or 0 if it's not found.
+func (l *yamlLines) find(key string) int {
+	for i := l.next; i < len(l.lines); i++ {
+		line := strings.TrimLeft(l.lines[i], " \t")
+		for _, k := range []string{key, `"` + key + `"`, "'" + key + "'"} {
+			if strings.HasPrefix(line, k) && strings.HasPrefix(strings.TrimSpace(line[len(k):]), ":") {
+				l.next = i + 1
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// yamlConfigValue formats a YAML scalar or list of scalars as a value of a setting.
+func yamlConfigValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", errors.New("empty value")
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, elem := range v {
+			switch elem.(type) {
+			case []interface{}, yaml.MapSlice:
+				return "", errors.New("nested lists and mappings are not supported")
+			}
+			value, err := yamlConfigValue(elem)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ","), nil
+	case yaml.MapSlice:
+		return "", errors.New("mappings are not supported")
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+func isProfileName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// stripComment removes the comment after # outside of strings.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseConfigValue(raw string) (string, error) {
+	if raw == "" {
+		return "", errors.New("empty value")
+	}
+	if !strings.HasPrefix(raw, "[") {
+		return parseConfigScalar(raw)
+	}
+	inner := strings.TrimSpace(raw[1 : len(raw)-1])
+	var values []string
+	for inner != "" {
+		elem, rest := splitConfigElement(inner)
+		v, err := parseConfigScalar(strings.TrimSpace(elem))
+		if err != nil {
+			return "", err
+		}
+		values = append(values, v)
+		inner = strings.TrimSpace(rest)
+	}
+	return strings.Join(values, ","), nil
+}
+
+// splitConfigElement splits s at the first comma outside of strings.
+func splitConfigElement(s string) (elem, rest string) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+func parseConfigScalar(raw string) (string, error) {
+	switch {
+	case raw == "true" || raw == "false":
+		return raw, nil
+	case strings.HasPrefix(raw, `"`) || strings.HasPrefix(raw, "'"):
+		return parseConfigString(raw)
+	case strings.HasPrefix(raw, "["):
+		return "", errors.New("nested arrays are not supported")
+	}
+	if _, err := strconv.ParseFloat(strings.Replace(raw, "_", "", -1), 64); err != nil {
+		return "", errors.Errorf("invalid value %s, strings should be quoted", raw)
+	}
+	return strings.Replace(raw, "_", "", -1), nil
+}
+
+func parseConfigString(raw string) (string, error) {
+	if len(raw) < 2 || raw[len(raw)-1] != raw[0] {
+		return "", errors.Errorf("unterminated string %s", raw)
+	}
+	switch raw[0] {
+	case '\'':
+		return raw[1 : len(raw)-1], nil
+	case '"':
+		return strconv.Unquote(raw)
+	}
+	return "", errors.Errorf("invalid string %s", raw)
+}
+
+// configSetters apply settings of a config file. Keys are the same as long flags of the chinadns command.
+var configSetters = map[string]func(o *serverOptions, v string) error{
+	"listen":     func(o *serverOptions, v string) error { return WithListenAddr(v)(o) },
+	"log-levels": func(o *serverOptions, v string) error { return setConfigLogLevels(o, v) },
+
+	"metrics-listen": func(o *serverOptions, v string) error { return WithMetricsListen(v)(o) },
+	"statsd":         func(o *serverOptions, v string) error { return WithStatsd(v, o.DogStatsd)(o) },
+	"dogstatsd":      configBool(func(o *serverOptions, b bool) { o.DogStatsd = b }),
+	"admin-listen":   func(o *serverOptions, v string) error { return WithAdminListen(v)(o) },
+	"admin-token":    func(o *serverOptions, v string) error { return WithAdminToken(v)(o) },
+	"debug-listen":   func(o *serverOptions, v string) error { return WithDebugListen(v)(o) },
+	"dnstap":         func(o *serverOptions, v string) error { return WithDnstap(v)(o) },
+	"otlp-endpoint":  func(o *serverOptions, v string) error { return WithTracing(v, o.TraceRatio)(o) },
+	"trace-ratio": func(o *serverOptions, v string) error {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		return WithTracing(o.OTLPEndpoint, ratio)(o)
+	},
+	"audit-log":      func(o *serverOptions, v string) error { return WithAuditLog(v)(o) },
+	"recent-queries": configInt(func(o *serverOptions, n int) error { return WithRecentQueries(n)(o) }),
+	"cache-entries":  configInt(func(o *serverOptions, n int) error { return WithCache(n)(o) }),
+	"cache-redis":    func(o *serverOptions, v string) error { return WithRedisCache(v)(o) },
+	"state-file":     func(o *serverOptions, v string) error { return WithStateFile(v)(o) },
+	"syslog": func(o *serverOptions, v string) error {
+		facility := o.SyslogFacility
+		if facility == "" {
+			facility = "daemon"
+		}
+		return WithSyslog(v, facility)(o)
+	},
+	"syslog-facility": func(o *serverOptions, v string) error {
+		if err := checkSyslogFacility(v); err != nil {
+			return err
+		}
+		o.SyslogFacility = v
+		return nil
+	},
+
+	// the certificate and the key are checked in pairs when the server is created.
+	"admin-tls-cert":  func(o *serverOptions, v string) error { o.AdminCert = v; return nil },
+	"admin-tls-key":   func(o *serverOptions, v string) error { o.AdminKey = v; return nil },
+	"admin-client-ca": func(o *serverOptions, v string) error { o.AdminClientCA = v; return nil },
+
+	"query-log":        func(o *serverOptions, v string) error { return WithQueryLog(v)(o) },
+	"query-log-format": func(o *serverOptions, v string) error { return WithQueryLogFormat(v)(o) },
+	"query-log-max-size": configInt(func(o *serverOptions, n int) error {
+		return WithQueryLogRotation(int64(n)<<20, o.QueryLogRotateInterval, o.QueryLogMaxBackups)(o)
+	}),
+	"query-log-rotate": configDuration(func(o *serverOptions, d time.Duration) error {
+		return WithQueryLogRotation(o.QueryLogMaxSize, d, o.QueryLogMaxBackups)(o)
+	}),
+	"query-log-backups": configInt(func(o *serverOptions, n int) error {
+		return WithQueryLogRotation(o.QueryLogMaxSize, o.QueryLogRotateInterval, n)(o)
+	}),
+	"query-log-sample": configInt(func(o *serverOptions, n int) error { return WithQueryLogSampling(n)(o) }),
+
+	"udp-max-bytes":    configInt(func(o *serverOptions, n int) error { return WithUDPMaxBytes(n)(o) }),
+	"force-tcp":        configBool(func(o *serverOptions, b bool) { o.TCPOnly = b }),
+	"pointer-mutation": configBool(func(o *serverOptions, b bool) { o.Mutation = b }),
+	"mutation":         func(o *serverOptions, v string) error { return WithMutationMethod(v)(o) },
+	"bidirectional":    configBool(func(o *serverOptions, b bool) { o.Bidirectional = b }),
+	"suspect-empty":    configBool(func(o *serverOptions, b bool) { o.SuspectEmpty = b }),
+	"coalesce":         configBool(func(o *serverOptions, b bool) { o.Coalesce = b }),
+	"raw-forward":      configBool(func(o *serverOptions, b bool) { o.RawForward = b }),
+	"fastest-first":    configBool(func(o *serverOptions, b bool) { o.FastestFirst = b }),
+	"max-concurrency": configInt(func(o *serverOptions, n int) error {
+		return WithMaxConcurrency(n, o.OverloadQueue, o.OverloadAction)(o)
+	}),
+	"overload-queue": configInt(func(o *serverOptions, n int) error {
+		return WithMaxConcurrency(o.MaxConcurrency, n, o.OverloadAction)(o)
+	}),
+	"overload-action": func(o *serverOptions, v string) error {
+		return WithMaxConcurrency(o.MaxConcurrency, o.OverloadQueue, v)(o)
+	},
+	"rate-limit": func(o *serverOptions, v string) error {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		return WithClientRateLimit(rate, o.RateLimitBurst, o.RateLimitAction)(o)
+	},
+	"rate-limit-burst": configInt(func(o *serverOptions, n int) error {
+		return WithClientRateLimit(o.RateLimit, n, o.RateLimitAction)(o)
+	}),
+	"rate-limit-action": func(o *serverOptions, v string) error {
+		return WithClientRateLimit(o.RateLimit, o.RateLimitBurst, v)(o)
+	},
+	"rate-limit-exempt":  func(o *serverOptions, v string) error { return WithRateLimitExempt(splitConfigList(v)...)(o) },
+	"rrl-rate":           configInt(func(o *serverOptions, n int) error { return WithResponseRateLimit(n, o.RRLSlip)(o) }),
+	"rrl-slip":           configInt(func(o *serverOptions, n int) error { return WithResponseRateLimit(o.RRLRate, n)(o) }),
+	"rrl-ipv4-prefix":    configInt(func(o *serverOptions, n int) error { return WithRRLPrefixes(n, o.RRLIPv6Prefix)(o) }),
+	"rrl-ipv6-prefix":    configInt(func(o *serverOptions, n int) error { return WithRRLPrefixes(o.RRLIPv4Prefix, n)(o) }),
+	"allowed-clients":    func(o *serverOptions, v string) error { return WithAllowedClients(splitConfigList(v)...)(o) },
+	"denied-clients":     func(o *serverOptions, v string) error { return WithDeniedClients(splitConfigList(v)...)(o) },
+	"acl-action":         func(o *serverOptions, v string) error { return WithACLAction(v)(o) },
+	"qname-minimization": configBool(func(o *serverOptions, b bool) { o.QNAMEMinimize = b }),
+	"reuse-port":         configBool(func(o *serverOptions, b bool) { o.ReusePort = b }),
+	"udp-sockets":        configInt(func(o *serverOptions, n int) error { return WithUDPSockets(n)(o) }),
+	"udp-batch":          configInt(func(o *serverOptions, n int) error { return WithUDPBatch(n)(o) }),
+	"upstream-sockets":   configInt(func(o *serverOptions, n int) error { return WithUpstreamSockets(n)(o) }),
+	"upstream-rotation": configDuration(func(o *serverOptions, d time.Duration) error {
+		return WithUpstreamRotation(d)(o)
+	}),
+	"source-ports": func(o *serverOptions, v string) error {
+		bounds := strings.SplitN(v, "-", 2)
+		min, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return err
+		}
+		max := min
+		if len(bounds) == 2 {
+			if max, err = strconv.Atoi(bounds[1]); err != nil {
+				return err
+			}
+		}
+		return WithSourcePortRange(min, max)(o)
+	},
+	"trusted-quorum": configInt(func(o *serverOptions, n int) error { return WithTrustedQuorum(n)(o) }),
+	"dns64":          func(o *serverOptions, v string) error { return WithDNS64(v)(o) },
+	"mdns":           func(o *serverOptions, v string) error { return WithMDNS(v)(o) },
+	"merge-answers":  func(o *serverOptions, v string) error { return WithMergedAnswers(v)(o) },
+	"fastest-ip":     func(o *serverOptions, v string) error { return WithFastestIP(v, o.FastestIPWait)(o) },
+	"timeout":        configDuration(func(o *serverOptions, d time.Duration) error { return WithTimeout(d)(o) }),
+	"delay": func(o *serverOptions, v string) error {
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		return WithDelay(time.Duration(seconds * float64(time.Second)))(o)
+	},
+	"fastest-ip-wait": configDuration(func(o *serverOptions, d time.Duration) error {
+		probe := ""
+		if o.FastestIP != nil {
+			probe = o.FastestIP.String()
+		}
+		return WithFastestIP(probe, d)(o)
+	}),
+	"dispatch": func(o *serverOptions, v string) error { return WithDispatch(v)(o) },
+	"retries": configInt(func(o *serverOptions, n int) error {
+		return WithRetry(n, o.RetryTimeout, o.RetryBackoff)(o)
+	}),
+	"retry-timeout": configDuration(func(o *serverOptions, d time.Duration) error {
+		return WithRetry(o.Retries, d, o.RetryBackoff)(o)
+	}),
+	"retry-backoff": configDuration(func(o *serverOptions, d time.Duration) error {
+		return WithRetry(o.Retries, o.RetryTimeout, d)(o)
+	}),
+	"rcode-failover": configBool(func(o *serverOptions, b bool) { o.RcodeFailover = b }),
+	"relay-agreed":   configBool(func(o *serverOptions, b bool) { o.RelayAgreed = b }),
+	"lazy-lists":     configBool(func(o *serverOptions, b bool) { o.LazyLists = b }),
+	"trusted-ecs": func(o *serverOptions, v string) (err error) {
+		o.TrustedECS, err = parseECSPolicy(v)
+		return
+	},
+	"untrusted-ecs": func(o *serverOptions, v string) (err error) {
+		o.UntrustedECS, err = parseECSPolicy(v)
+		return
+	},
+	"trusted-mark": configInt(func(o *serverOptions, n int) error {
+		sockets := o.TrustedSockets
+		sockets.Mark = n
+		return WithUpstreamSocketOptions(sockets, o.UntrustedSockets)(o)
+	}),
+	"untrusted-mark": configInt(func(o *serverOptions, n int) error {
+		sockets := o.UntrustedSockets
+		sockets.Mark = n
+		return WithUpstreamSocketOptions(o.TrustedSockets, sockets)(o)
+	}),
+	"trusted-device": func(o *serverOptions, v string) error {
+		sockets := o.TrustedSockets
+		sockets.Device = v
+		return WithUpstreamSocketOptions(sockets, o.UntrustedSockets)(o)
+	},
+	"untrusted-device": func(o *serverOptions, v string) error {
+		sockets := o.UntrustedSockets
+		sockets.Device = v
+		return WithUpstreamSocketOptions(o.TrustedSockets, sockets)(o)
+	},
+	"trusted-dscp": configInt(func(o *serverOptions, n int) error {
+		sockets := o.TrustedSockets
+		sockets.DSCP = n
+		return WithUpstreamSocketOptions(sockets, o.UntrustedSockets)(o)
+	}),
+	"untrusted-dscp": configInt(func(o *serverOptions, n int) error {
+		sockets := o.UntrustedSockets
+		sockets.DSCP = n
+		return WithUpstreamSocketOptions(o.TrustedSockets, sockets)(o)
+	}),
+	"trusted-source": func(o *serverOptions, v string) error {
+		sockets := o.TrustedSockets
+		sockets.Source = v
+		return WithUpstreamSocketOptions(sockets, o.UntrustedSockets)(o)
+	},
+	"untrusted-source": func(o *serverOptions, v string) error {
+		sockets := o.UntrustedSockets
+		sockets.Source = v
+		return WithUpstreamSocketOptions(o.TrustedSockets, sockets)(o)
+	},
+	"test-domains": func(o *serverOptions, v string) error { return WithTestDomains(splitConfigList(v)...)(o) },
+	"test-qtype":   func(o *serverOptions, v string) error { return WithTestQueryType(v)(o) },
+	"test-expect": func(o *serverOptions, v string) error {
+		name, ips := v, []string(nil)
+		if idx := strings.IndexByte(name, '='); idx >= 0 {
+			name, ips = name[:idx], strings.Split(name[idx+1:], ",")
+		}
+		return WithTestExpect(name, ips...)(o)
+	},
+	"skip-startup-test": configBool(func(o *serverOptions, b bool) { o.SkipStartupTest = b }),
+
+	"breaker-threshold": configInt(func(o *serverOptions, n int) error {
+		cooldown := o.BreakerCooldown
+		if cooldown <= 0 {
+			cooldown = _defaultBreakerCooldown
+		}
+		return WithCircuitBreaker(n, cooldown)(o)
+	}),
+	"breaker-cooldown": configDuration(func(o *serverOptions, d time.Duration) error {
+		return WithCircuitBreaker(o.BreakerThreshold, d)(o)
+	}),
+	"health-interval": configDuration(func(o *serverOptions, d time.Duration) error { return WithHealthCheck(d)(o) }),
+	"canary-interval": configDuration(func(o *serverOptions, d time.Duration) error { return WithCanary(d)(o) }),
+	"canary-nxdomain": func(o *serverOptions, v string) error {
+		return WithCanaryDomains(v, o.CanaryName, ipStrings(o.CanaryIPs)...)(o)
+	},
+	"canary-stable": func(o *serverOptions, v string) error {
+		name, ips := v, []string(nil)
+		if idx := strings.IndexByte(name, '='); idx >= 0 {
+			name, ips = name[:idx], strings.Split(name[idx+1:], ",")
+		}
+		nxZone := o.CanaryNXZone
+		if nxZone == "" {
+			nxZone = "example.com"
+		}
+		return WithCanaryDomains(nxZone, name, ips...)(o)
+	},
+
+	"china-list":           func(o *serverOptions, v string) error { return WithCHNList(v)(o) },
+	"ip-blacklist":         func(o *serverOptions, v string) error { return WithIPBlacklist(v)(o) },
+	"domain-blacklist":     func(o *serverOptions, v string) error { return WithDomainBlacklist(v)(o) },
+	"domain-polluted":      func(o *serverOptions, v string) error { return WithDomainPolluted(v)(o) },
+	"bidirectional-exempt": func(o *serverOptions, v string) error { return WithBidirectionalExempt(v)(o) },
+	"dnsmasq-conf":         func(o *serverOptions, v string) error { return WithDnsmasqConf(v)(o) },
+	"forwarding-rules":     func(o *serverOptions, v string) error { return WithForwardingRules(v)(o) },
+	"cloaking-rules":       func(o *serverOptions, v string) error { return WithCloakingRules(v)(o) },
+	"kv-config":            func(o *serverOptions, v string) error { return WithKVConfigURL(v)(o) },
+	"bogus-nxdomain":       func(o *serverOptions, v string) error { return WithBogusNXDomain(v)(o) },
+	"pollution-webhook":    func(o *serverOptions, v string) error { return WithPollutionWebhook(v)(o) },
+	"upstream-webhook":     func(o *serverOptions, v string) error { return WithUpstreamWebhook(v)(o) },
+	"watch-interval":       configDuration(func(o *serverOptions, d time.Duration) error { return WithWatchFiles(d)(o) }),
+	"dhcp-leases":          func(o *serverOptions, v string) error { return WithDHCPLeases(v, o.DHCPDomain)(o) },
+	"dhcp-domain": func(o *serverOptions, v string) error {
+		path := ""
+		if o.DHCPLeases != nil {
+			path = o.DHCPLeases.path
+		}
+		return WithDHCPLeases(path, v)(o)
+	},
+	"zone-files": func(o *serverOptions, v string) error {
+		for _, path := range splitConfigList(v) {
+			if err := WithZoneFile(path)(o); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	"upstream-summary": configDuration(func(o *serverOptions, d time.Duration) error {
+		return WithUpstreamSummary(d)(o)
+	}),
+	"discover-interval": configDuration(func(o *serverOptions, d time.Duration) error {
+		if d <= 0 {
+			return nil
+		}
+		return WithResolverSource(SystemResolvers(), d)(o)
+	}),
+	"peers": func(o *serverOptions, v string) error { return WithPeers(splitConfigList(v), o.PeerInterval)(o) },
+	"peer-interval": configDuration(func(o *serverOptions, d time.Duration) error {
+		return WithPeers(o.Peers, d)(o)
+	}),
+	"ipset": func(o *serverOptions, v string) error {
+		path, sets := v, []string{""}
+		if idx := strings.LastIndexByte(v, '='); idx >= 0 {
+			path, sets = v[:idx], strings.SplitN(v[idx+1:], ",", 2)
+		}
+		sets = append(sets, "")
+		return WithIPSet(path, sets[0], sets[1])(o)
+	},
+	"nftset": func(o *serverOptions, v string) error {
+		path, sets := v, []string{""}
+		if idx := strings.LastIndexByte(v, '='); idx >= 0 {
+			path, sets = v[:idx], strings.SplitN(v[idx+1:], ",", 2)
+		}
+		sets = append(sets, "")
+		return WithNFTSet(path, sets[0], sets[1])(o)
+	},
+	"profile":         func(o *serverOptions, v string) error { return WithActiveProfile(v)(o) },
+	"resolvers":       func(o *serverOptions, v string) error { return WithResolvers(splitConfigList(v)...)(o) },
+	"trusted-servers": func(o *serverOptions, v string) error { return WithTrustedResolvers(splitConfigList(v)...)(o) },
+}
+
+// WithConfigFile applies settings of the config file read by ReadConfigFile, in order of lines.
+// Keys are the long flags of the chinadns command, such as `resolvers`, `trusted-servers` and `query-log`,
+// plus `listen` for the listening address, `china-list` (-c), `ip-blacklist` (-l), `bidirectional` (-d),
+// `pointer-mutation` (-m) and `delay` (-y). Errors are prefixed with the path and line number.
+func WithConfigFile(path string) ServerOption {
+	return func(o *serverOptions) error {
+		settings, err := ReadConfigFile(path)
+		if err != nil {
+			return err
+		}
+		o.Files = uniqueAppendString(o.Files, path)
+		var base []ConfigSetting
+		profiles := make(map[string][]ConfigSetting)
+		for _, setting := range settings {
+			o.Files = uniqueAppendString(o.Files, setting.Path)
+			if setting.Profile == "" {
+				base = append(base, setting)
+				continue
+			}
+			if _, ok := profiles[setting.Profile]; !ok {
+				if err := WithProfile(setting.Profile)(o); err != nil {
+					return err
+				}
+			}
+			profiles[setting.Profile] = append(profiles[setting.Profile], setting)
+		}
+		for name, settings := range profiles {
+			if err := WithProfile(name, WithConfigSettings(settings...))(o); err != nil {
+				return err
+			}
+		}
+		return WithConfigSettings(base...)(o)
+	}
+}
+
+// WithConfigSettings applies settings in order, as WithConfigFile does. Profiles of settings are ignored.
+func WithConfigSettings(settings ...ConfigSetting) ServerOption {
+	return func(o *serverOptions) error {
+		for _, setting := range settings {
+			set, ok := configSetters[setting.Key]
+			if !ok {
+				if err := o.fail(errors.Errorf("%s:%d: unknown key %s", setting.Path, setting.Line, setting.Key)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := set(o, setting.Value); err != nil {
+				if err := o.fail(errors.Wrapf(err, "%s:%d: %s", setting.Path, setting.Line, setting.Key)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+func configBool(set func(*serverOptions, bool)) func(*serverOptions, string) error {
+	return func(o *serverOptions, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		set(o, b)
+		return nil
+	}
+}
+
+func configInt(set func(*serverOptions, int) error) func(*serverOptions, string) error {
+	return func(o *serverOptions, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		return set(o, n)
+	}
+}
+
+func configDuration(set func(*serverOptions, time.Duration) error) func(*serverOptions, string) error {
+	return func(o *serverOptions, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		return set(o, d)
+	}
+}
+
+func setConfigLogLevels(o *serverOptions, v string) error {
+	levels := make(map[string]string)
+	for _, pair := range splitConfigList(v) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("invalid log level [%s], should be component=level", pair)
+		}
+		levels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return WithLogLevels(levels)(o)
+}
+
+func splitConfigList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func ipStrings(ips []net.IP) []string {
+	s := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return s
+}
@@ -0,0 +1,248 @@
+package gochinadns
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTempConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "chinadns-*.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestReadConfigFile(t *testing.T) {
+	path := writeTempConfig(t, `# chinadns
+listen = "127.0.0.1:5353"  # comment
+"trusted-servers" = [
+  "udp@8.8.8.8:53", # google
+  'tcp@1.1.1.1:53',
+]
+timeout = "2s"
+query-log-max-size = 1_00
+bidirectional = true
+`)
+	defer os.Remove(path)
+
+	settings, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ConfigSetting{
+		{path, 2, "listen", "127.0.0.1:5353", ""},
+		{path, 3, "trusted-servers", "udp@8.8.8.8:53,tcp@1.1.1.1:53", ""},
+		{path, 7, "timeout", "2s", ""},
+		{path, 8, "query-log-max-size", "100", ""},
+		{path, 9, "bidirectional", "true", ""},
+	}
+	if !reflect.DeepEqual(settings, want) {
+		t.Errorf("ReadConfigFile() = %v, want %v", settings, want)
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	for content, msg := range map[string]string{
+		"listen = 127.0.0.1":            ":1: listen: invalid value",
+		"\n[server]":                    ":2: tables other than [profile.NAME] are not supported",
+		"a = 1\nb = \"x\nc = 2":         ":2: b: unterminated string",
+		"a = 1\na = 2":                  ":2: duplicate key a, first set at line 1",
+		"resolvers = [\n\"8.8.8.8:53\"": ":1: unterminated array of resolvers",
+	} {
+		path := writeTempConfig(t, content)
+		_, err := ReadConfigFile(path)
+		os.Remove(path)
+		if err == nil || !strings.Contains(err.Error(), path+msg) {
+			t.Errorf("Expect error %q for %q, got %v", msg, content, err)
+		}
+	}
+}
+
+func TestReadConfigFileInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chinadns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"chinadns.toml":        "timeout = \"1s\"\ninclude = \"conf.d/*.toml\"\nbidirectional = true\n",
+		"conf.d/10-lists.toml": "china-list = \"china.list\"\ntimeout = \"2s\"\n",
+		"conf.d/20-dns.toml":   "resolvers = [\"udp@1.1.1.1:53\"]\n",
+		"conf.d/readme.txt":    "not a config file",
+	}
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings, err := ReadConfigFile(filepath.Join(dir, "chinadns.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lists, dns := filepath.Join(dir, "conf.d/10-lists.toml"), filepath.Join(dir, "conf.d/20-dns.toml")
+	want := []ConfigSetting{
+		{lists, 1, "china-list", "china.list", ""},
+		{lists, 2, "timeout", "2s", ""},
+		{dns, 1, "resolvers", "udp@1.1.1.1:53", ""},
+		{filepath.Join(dir, "chinadns.toml"), 3, "bidirectional", "true", ""},
+	}
+	if !reflect.DeepEqual(settings, want) {
+		t.Errorf("ReadConfigFile() = %v, want %v", settings, want)
+	}
+
+	cycle := filepath.Join(dir, "conf.d/30-cycle.toml")
+	if err := ioutil.WriteFile(cycle, []byte("include = \"../chinadns.toml\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfigFile(filepath.Join(dir, "chinadns.toml")); err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("Expect include cycle error, got %v", err)
+	}
+	if err := ioutil.WriteFile(cycle, []byte("include = \"missing.toml\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfigFile(filepath.Join(dir, "chinadns.toml")); err == nil || !strings.Contains(err.Error(), cycle+":1: include: no such file") {
+		t.Errorf("Expect missing file error, got %v", err)
+	}
+}
+
+func TestWithConfigFile(t *testing.T) {
+	path := writeTempConfig(t, `
+timeout = "2s"
+trusted-servers = ["udp@8.8.8.8:53"]
+resolvers = ["udp@1.1.1.1:53"]
+query-log-max-size = 1
+query-log-backups = 3
+`)
+	defer os.Remove(path)
+
+	o, err := buildOptions([]ServerOption{WithConfigFile(path)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Timeout != 2*time.Second || o.QueryLogMaxSize != 1<<20 || o.QueryLogMaxBackups != 3 {
+		t.Errorf("Unexpected options %v %v %v", o.Timeout, o.QueryLogMaxSize, o.QueryLogMaxBackups)
+	}
+	// resolvers are classified once all options are applied.
+	if len(o.TrustedServers) != 2 {
+		t.Errorf("Expect 2 trusted servers, got %v", o.TrustedServers)
+	}
+
+	path2 := writeTempConfig(t, "timeout = \"2s\"\nunknown = 1\n")
+	defer os.Remove(path2)
+	if _, err := buildOptions([]ServerOption{WithConfigFile(path2)}); err == nil || !strings.Contains(err.Error(), path2+":2: unknown key unknown") {
+		t.Errorf("Expect unknown key error, got %v", err)
+	}
+}
+
+func TestWithConfigFileProfiles(t *testing.T) {
+	path := writeTempConfig(t, `
+timeout = "2s"
+profile = "home"
+
+[profile.home]
+timeout = "3s"
+
+[profile.travel]
+bidirectional = true
+`)
+	defer os.Remove(path)
+
+	o, err := buildOptions([]ServerOption{WithConfigFile(path)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Profile != "home" || len(o.Profiles) != 2 || o.Timeout != 3*time.Second || o.Bidirectional {
+		t.Errorf("Unexpected options of profile home: %v %v %v %v", o.Profile, o.Profiles, o.Timeout, o.Bidirectional)
+	}
+
+	o, err = buildOptions([]ServerOption{WithConfigFile(path), WithActiveProfile("travel")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Timeout != 2*time.Second || !o.Bidirectional {
+		t.Errorf("Unexpected options of profile travel: %v %v", o.Timeout, o.Bidirectional)
+	}
+
+	if _, err := buildOptions([]ServerOption{WithConfigFile(path), WithActiveProfile("moon")}); err == nil {
+		t.Error("Expect unknown profile error")
+	}
+}
+
+func TestReadYAMLConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chinadns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, extra := filepath.Join(dir, "chinadns.yaml"), filepath.Join(dir, "extra.toml")
+	files := map[string]string{
+		"chinadns.yaml": `# chinadns
+listen: "127.0.0.1:5353"
+trusted-servers:
+  - udp@8.8.8.8:53  # google
+  - "tcp@1.1.1.1:53"
+include: extra.toml
+query-log-max-size: 100
+trace-ratio: 0.5
+profile: travel
+profiles:
+  travel:
+    bidirectional: true
+    resolvers: [udp@1.1.1.1:53]
+`,
+		"extra.toml": "timeout = \"2s\"\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ConfigSetting{
+		{path, 2, "listen", "127.0.0.1:5353", ""},
+		{path, 3, "trusted-servers", "udp@8.8.8.8:53,tcp@1.1.1.1:53", ""},
+		{extra, 1, "timeout", "2s", ""},
+		{path, 7, "query-log-max-size", "100", ""},
+		{path, 8, "trace-ratio", "0.5", ""},
+		{path, 9, "profile", "travel", ""},
+		{path, 12, "bidirectional", "true", "travel"},
+		{path, 13, "resolvers", "udp@1.1.1.1:53", "travel"},
+	}
+	if !reflect.DeepEqual(settings, want) {
+		t.Errorf("ReadConfigFile() = %v, want %v", settings, want)
+	}
+
+	for content, msg := range map[string]string{
+		"a: 1\nlisten:\n":                           ":2: listen: empty value",
+		"a: 1\nb:\n  c: 1\n":                        ":2: b: mappings are not supported",
+		"a: 1\nb: [[1]]\n":                          ":2: b: nested lists and mappings are not supported",
+		"a: 1\nprofiles: [travel]\n":                ":2: profiles should be a mapping of names to settings",
+		"profiles:\n  home:\n    include: x.toml\n": ":3: include is not supported in profiles",
+		"a: 1\na: 2\n":                              ":2: duplicate key a, first set at line 1",
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadConfigFile(path); err == nil || !strings.Contains(err.Error(), path+msg) {
+			t.Errorf("Expect error %q for %q, got %v", msg, content, err)
+		}
+	}
+}
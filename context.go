@@ -0,0 +1,57 @@
+package gochinadns
+
+import (
+	"context"
+	"io"
+
+	"github.com/miekg/dns"
+)
+
+// contextWriter is a ResponseWriter of a query with a context of its own, such as a query of Client.Exchange.
+type contextWriter interface {
+	Context() context.Context
+}
+
+// queryContext returns the context a query answered by w is resolved in, which is done once the server shuts down,
+// or the context of w is done if it has one, and a function to release it once the query is answered.
+// Middlewares which wrap w hide its context, and their queries are resolved in the context of the server.
+func (s *Server) queryContext(w dns.ResponseWriter) (context.Context, context.CancelFunc) {
+	cw, ok := w.(contextWriter)
+	if !ok {
+		return s.ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(cw.Context())
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// closeOnDone closes conn once ctx is done, which interrupts reads and writes of conn in flight,
+// until the function returned is called.
+func closeOnDone(ctx context.Context, conn io.Closer) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// interrupted returns the error of ctx if it's done, which err is caused by, or err itself.
+func interrupted(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+// Package coredns runs gochinadns as the chinadns plugin of CoreDNS, so that queries of its zones are resolved with
+// the verdict of trusted and untrusted resolvers in the plugin chain of an existing CoreDNS, without another daemon.
+//
+// The plugin is registered by setup.go, which is built with the tag coredns, since this module doesn't depend on
+// CoreDNS. Add `chinadns:github.com/cherrot/gochinadns/coredns` to plugin.cfg of CoreDNS, and build it with
+// `-tags coredns`. Then, in a Corefile:
+//
+//	. {
+//		chinadns [ZONES...] {
+//			resolvers udp@114.114.114.114:53 udp@8.8.8.8:53
+//			china-list /etc/chinadns/china.list
+//		}
+//	}
+//
+// Every line of the block is a key of the config file of gochinadns with its values, see ReadConfigFile.
+// Queries out of the zones, which default to those of the server block, are passed to the next plugin.
+package coredns
+
+import (
+	"context"
+
+	"github.com/cherrot/gochinadns"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// Name is the name of the plugin.
+const Name = "chinadns"
+
+// Handler is plugin.Handler of CoreDNS, which is declared again so that the plugin is built without CoreDNS.
+// Handlers of CoreDNS and the plugin implement each other.
+type Handler interface {
+	ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error)
+	Name() string
+}
+
+// Plugin resolves queries of its zones with a gochinadns server, which doesn't listen, and passes others to Next.
+type Plugin struct {
+	Next  Handler
+	Zones []string //Zones of queries resolved, in the canonical form. The root zone if empty.
+
+	server *gochinadns.Server
+	stop   context.CancelFunc
+	done   chan error
+}
+
+// New returns a plugin resolving queries of zones like a server created with opts.
+// Options of listeners and endpoints are ignored, since CoreDNS serves queries.
+func New(zones []string, opts ...gochinadns.ServerOption) (*Plugin, error) {
+	server, err := gochinadns.NewServer(opts...)
+	if err != nil {
+		return nil, err
+	}
+	p := &Plugin{server: server}
+	for _, zone := range zones {
+		p.Zones = append(p.Zones, dns.CanonicalName(zone))
+	}
+	return p, nil
+}
+
+// Server returns the server resolving queries of p, such as to reload it.
+func (p *Plugin) Server() *gochinadns.Server { return p.server }
+
+// Name implements Handler.
+func (p *Plugin) Name() string { return Name }
+
+// ServeDNS implements Handler. Queries are resolved in ctx, and given up once it's done.
+// It returns SERVFAIL with an error if the query is dropped without a reply, such as by the concurrency limit,
+// so that CoreDNS answers it.
+func (p *Plugin) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if len(r.Question) != 1 || !p.match(r.Question[0].Name) {
+		if p.Next == nil {
+			return dns.RcodeServerFailure, errors.New("no next plugin found")
+		}
+		return p.Next.ServeDNS(ctx, w, r)
+	}
+	pw := &writer{ResponseWriter: w, ctx: ctx}
+	p.server.ServeDNS(pw, r)
+	if !pw.written {
+		return dns.RcodeServerFailure, errors.Errorf("no reply of %s is written", r.Question[0].Name)
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// match reports whether name is in zones of p.
+func (p *Plugin) match(name string) bool {
+	if len(p.Zones) == 0 {
+		return true
+	}
+	name = dns.CanonicalName(name)
+	for _, zone := range p.Zones {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// OnStartup runs background checks of resolvers, list updates and watches of the server, for OnStartup of CoreDNS.
+func (p *Plugin) OnStartup() error {
+	if p.stop != nil {
+		return errors.New("plugin already started")
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	p.stop, p.done = stop, make(chan error, 1)
+	go func() { p.done <- p.server.RunBackground(ctx) }()
+	return nil
+}
+
+// OnShutdown stops background checks, gives up queries in flight, and closes upstream sockets and logs of the server,
+// for OnShutdown of CoreDNS.
+func (p *Plugin) OnShutdown() error {
+	if p.stop == nil {
+		return nil
+	}
+	p.stop()
+	err := <-p.done
+	p.stop, p.done = nil, nil
+	return err
+}
+
+// writer is the ResponseWriter of a query of the plugin, whose context is the one of the query.
+type writer struct {
+	dns.ResponseWriter
+	ctx     context.Context
+	written bool
+}
+
+func (w *writer) Context() context.Context { return w.ctx }
+
+func (w *writer) WriteMsg(m *dns.Msg) error {
+	w.written = true
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,90 @@
+package coredns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cherrot/gochinadns"
+	"github.com/cherrot/gochinadns/chinadnstest"
+	"github.com/miekg/dns"
+)
+
+// recorder is a ResponseWriter of CoreDNS, which records the reply.
+type recorder struct {
+	dns.ResponseWriter
+	reply *dns.Msg
+}
+
+func (w *recorder) LocalAddr() net.Addr  { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *recorder) RemoteAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 53} }
+
+func (w *recorder) WriteMsg(m *dns.Msg) error {
+	w.reply = m
+	return nil
+}
+
+func (w *recorder) Write(b []byte) (int, error) {
+	w.reply = new(dns.Msg)
+	return len(b), w.reply.Unpack(b)
+}
+
+// next is the next plugin, which answers REFUSED.
+type next struct{ queries int }
+
+func (n *next) Name() string { return "next" }
+func (n *next) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	n.queries++
+	return dns.RcodeRefused, nil
+}
+
+func TestPlugin(t *testing.T) {
+	u := chinadnstest.NewUpstream(t)
+	u.Answer("www.example.com. 60 IN A 1.2.3.4")
+
+	p, err := New([]string{"Example.com"}, gochinadns.WithTrustedResolvers("udp@"+u.Addr),
+		gochinadns.WithSkipStartupTest(true), gochinadns.WithConfigSettings(gochinadns.ConfigSetting{Key: "timeout", Value: "1s"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.OnStartup(); err == nil {
+		t.Error("Plugin started twice should fail")
+	}
+	n := new(next)
+	p.Next = n
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	w := new(recorder)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if rcode, err := p.ServeDNS(ctx, w, req); rcode != dns.RcodeSuccess || err != nil {
+		t.Fatalf("ServeDNS = %d, %v", rcode, err)
+	}
+	if w.reply == nil || len(w.reply.Answer) != 1 || w.reply.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("Reply = %v, want the upstream answer", w.reply)
+	}
+
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	if rcode, err := p.ServeDNS(ctx, new(recorder), req); rcode != dns.RcodeRefused || err != nil || n.queries != 1 {
+		t.Errorf("ServeDNS out of zones = %d, %v, want it passed to the next plugin", rcode, err)
+	}
+	p.Next = nil
+	if rcode, err := p.ServeDNS(ctx, new(recorder), req); rcode != dns.RcodeServerFailure || err == nil {
+		t.Errorf("ServeDNS without the next plugin = %d, %v, want SERVFAIL", rcode, err)
+	}
+
+	if err := p.OnShutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.OnShutdown(); err != nil {
+		t.Errorf("Plugin shut down twice = %v", err)
+	}
+	if len(u.Queries()) != 1 {
+		t.Errorf("Upstream queries = %v, want only the one in the zone", u.Queries())
+	}
+}
@@ -0,0 +1,54 @@
+//go:build coredns
+// +build coredns
+
+package coredns
+
+import (
+	"strings"
+
+	"github.com/cherrot/gochinadns"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+)
+
+func init() { plugin.Register(Name, setup) }
+
+func setup(c *caddy.Controller) error {
+	p, err := parse(c)
+	if err != nil {
+		return plugin.Error(Name, err)
+	}
+	c.OnStartup(p.OnStartup)
+	c.OnShutdown(p.OnShutdown)
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		p.Next = next
+		return p
+	})
+	return nil
+}
+
+// parse parses the chinadns directive of a server block, whose lines are settings of the config file of gochinadns.
+func parse(c *caddy.Controller) (*Plugin, error) {
+	var p *Plugin
+	for c.Next() {
+		if p != nil {
+			return nil, plugin.ErrOnce
+		}
+		zones := plugin.OriginsFromArgsOrServerBlock(c.RemainingArgs(), c.ServerBlockKeys)
+		var settings []gochinadns.ConfigSetting
+		for c.NextBlock() {
+			key, line := c.Val(), c.Line()
+			values := c.RemainingArgs()
+			if len(values) == 0 {
+				return nil, c.ArgErr()
+			}
+			settings = append(settings, gochinadns.ConfigSetting{Path: c.File(), Line: line, Key: key, Value: strings.Join(values, ",")})
+		}
+		var err error
+		if p, err = New(zones, gochinadns.WithConfigSettings(settings...)); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,73 @@
+package gochinadns
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// _cacheLineSize pads shards of counters, so that cores adding to distinct shards don't share cache lines.
+const _cacheLineSize = 64
+
+// counterShards is the number of shards of counters, the number of CPUs rounded up to a power of 2.
+var counterShards = func() int {
+	n := 1
+	for n < runtime.NumCPU() {
+		n <<= 1
+	}
+	return n
+}()
+
+// shardIndexes hands out indexes of shards by a sync.Pool, which keeps a value per P: a goroutine mostly gets
+// the index its P put back last, so that goroutines on distinct Ps add to distinct shards without locking.
+// Indexes dropped by garbage collection are replaced by the next ones in turn.
+var shardIndexes = sync.Pool{
+	New: func() interface{} {
+		i := int(atomic.AddUint32(&nextShardIndex, 1)) % counterShards
+		return &i
+	},
+}
+
+var nextShardIndex uint32
+
+// shardedCounter is a counter split into shards of atomics, which are summed when it's read, so that goroutines
+// counting on many cores at once don't contend on a lock or a cache line.
+type shardedCounter struct {
+	shards []paddedUint64
+}
+
+type paddedUint64 struct {
+	n uint64
+	_ [_cacheLineSize - 8]byte
+}
+
+func newShardedCounter() *shardedCounter {
+	return &shardedCounter{shards: make([]paddedUint64, counterShards)}
+}
+
+// Add adds n to the counter.
+func (c *shardedCounter) Add(n uint64) {
+	i := shardIndexes.Get().(*int)
+	atomic.AddUint64(&c.shards[*i].n, n)
+	shardIndexes.Put(i)
+}
+
+// Load returns the sum of the shards.
+func (c *shardedCounter) Load() uint64 {
+	var sum uint64
+	for i := range c.shards {
+		sum += atomic.LoadUint64(&c.shards[i].n)
+	}
+	return sum
+}
+
+// addFloat adds v to the float64 stored as bits in addr atomically.
+func addFloat(addr *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if atomic.CompareAndSwapUint64(addr, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
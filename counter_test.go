@@ -0,0 +1,52 @@
+package gochinadns
+
+import (
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestShardedCounter(t *testing.T) {
+	c := newShardedCounter()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Add(10)
+	if n := c.Load(); n != 8010 {
+		t.Errorf("Load() = %d, want 8010", n)
+	}
+
+	var sum uint64
+	addFloat(&sum, 0.25)
+	addFloat(&sum, 0.5)
+	if v := math.Float64frombits(sum); v != 0.75 {
+		t.Errorf("sum = %v, want 0.75", v)
+	}
+}
+
+func BenchmarkShardedCounter(b *testing.B) {
+	c := newShardedCounter()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Add(1)
+		}
+	})
+}
+
+func BenchmarkCounterVecInc(b *testing.B) {
+	c := newCounterVec("test_total", "Test counter.", "path")
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Inc("trusted")
+		}
+	})
+}
@@ -0,0 +1,254 @@
+package gochinadns
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	_leaseTTL    = 60    //TTL of answers of DHCP leases, in seconds
+	_leaseDomain = "lan" //domain of hostnames of DHCP leases by default
+)
+
+// dhcpLease is an address leased to a host.
+type dhcpLease struct {
+	ip      net.IP
+	expires time.Time //zero if the lease never expires
+}
+
+// leasedHost is a lease of the host.
+type leasedHost struct {
+	host string //empty if the lease has no hostname
+	dhcpLease
+}
+
+// dhcpLeases are hostnames of a DHCP lease file, answered under a local domain, see WithDHCPLeases.
+type dhcpLeases struct {
+	path   string
+	domain string                 //canonical local domain of hostnames
+	hosts  map[string][]dhcpLease //leases by lowercase hostname
+	ptrs   map[string]leasedHost  //leases by reverse name of their addresses
+}
+
+// WithDHCPLeases answers A and AAAA queries of hostnames of DHCP clients under domain, lan by default, and PTR queries
+// of their addresses, from the lease file of dnsmasq or Kea at path, like dnsmasq does for its DHCP clients.
+// Names which are not leased under domain are NXDOMAIN, so that they don't leak to upstreams. Expired leases and
+// leases without hostnames are skipped. The file is watched like lists. An empty path disables it.
+func WithDHCPLeases(path, domain string) ServerOption {
+	return func(o *serverOptions) error {
+		if domain == "" {
+			domain = _leaseDomain
+		}
+		o.DHCPDomain = domain
+		if path == "" {
+			o.DHCPLeases = nil
+			return nil
+		}
+		if _, ok := dns.IsDomainName(domain); !ok || dns.CanonicalName(domain) == "." {
+			return errors.Errorf("invalid domain of DHCP leases [%s]", domain)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "fail to open DHCP lease file")
+		}
+		defer f.Close()
+		o.Files = uniqueAppendString(o.Files, path)
+		leases := &dhcpLeases{
+			path:   path,
+			domain: dns.CanonicalName(domain),
+			hosts:  make(map[string][]dhcpLease),
+			ptrs:   make(map[string]leasedHost),
+		}
+		// leases by address, of which the last one of Kea, which appends changes of leases, is current.
+		byAddr := make(map[string]leasedHost)
+		var kea []string //columns of Kea CSV
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "duid ") {
+				continue
+			}
+			if n == 1 && strings.HasPrefix(line, "address,") {
+				kea = strings.Split(line, ",")
+				continue
+			}
+			var entry leasedHost
+			var err error
+			if kea != nil {
+				entry.host, entry.dhcpLease, err = parseKeaLease(kea, line)
+			} else {
+				entry.host, entry.dhcpLease, err = parseDnsmasqLease(line)
+			}
+			if err != nil {
+				o.logger(logServer).WithField("file", path).Warnf("Skip invalid lease at line %d: %v.", n, err)
+				continue
+			}
+			byAddr[entry.ip.String()] = entry
+		}
+		if err := scanner.Err(); err != nil {
+			return errors.Wrap(err, "fail to scan DHCP lease file")
+		}
+		for _, entry := range byAddr {
+			if entry.host == "" {
+				continue
+			}
+			leases.hosts[entry.host] = append(leases.hosts[entry.host], entry.dhcpLease)
+			if reverse, err := dns.ReverseAddr(entry.ip.String()); err == nil {
+				leases.ptrs[reverse] = entry
+			}
+		}
+		o.DHCPLeases = leases
+		return nil
+	}
+}
+
+// parseDnsmasqLease parses a line of the lease file of dnsmasq: expiry MAC-or-IAID address hostname client-ID,
+// of which the hostname is * if there is none, and the expiry is 0 if the lease never expires.
+func parseDnsmasqLease(line string) (string, dhcpLease, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return "", dhcpLease{}, errors.Errorf("invalid lease [%s]", line)
+	}
+	var lease dhcpLease
+	expiry, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", lease, errors.Errorf("invalid expiry [%s]", fields[0])
+	}
+	if expiry > 0 {
+		lease.expires = time.Unix(expiry, 0)
+	}
+	if lease.ip = net.ParseIP(fields[2]); lease.ip == nil {
+		return "", lease, errors.Errorf("invalid address [%s]", fields[2])
+	}
+	host := fields[3]
+	if host == "*" {
+		host = ""
+	}
+	return leaseHostname(host), lease, nil
+}
+
+// parseKeaLease parses a line of the CSV lease file of Kea, whose columns include address, expire, hostname and
+// state. Leases of valid_lifetime 0, which are deleted, and those not in the default state 0 have no hostnames.
+func parseKeaLease(columns []string, line string) (string, dhcpLease, error) {
+	fields := strings.Split(line, ",")
+	var (
+		lease      dhcpLease
+		host       string
+		deleted    bool
+		hasAddress bool
+	)
+	for i, column := range columns {
+		if i >= len(fields) {
+			break
+		}
+		value := fields[i]
+		switch column {
+		case "address":
+			if lease.ip = net.ParseIP(value); lease.ip == nil {
+				return "", lease, errors.Errorf("invalid address [%s]", value)
+			}
+			hasAddress = true
+		case "expire":
+			expire, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return "", lease, errors.Errorf("invalid expire [%s]", value)
+			}
+			lease.expires = time.Unix(expire, 0)
+		case "valid_lifetime":
+			deleted = deleted || value == "0"
+		case "state":
+			deleted = deleted || value != "0"
+		case "hostname":
+			host = value
+		}
+	}
+	if !hasAddress {
+		return "", lease, errors.Errorf("invalid lease [%s]", line)
+	}
+	if deleted {
+		host = ""
+	}
+	return leaseHostname(host), lease, nil
+}
+
+// leaseHostname returns the lowercase first label of host, which may be a FQDN, or "" if it's not a valid label.
+func leaseHostname(host string) string {
+	if idx := strings.IndexByte(host, '.'); idx >= 0 {
+		host = host[:idx]
+	}
+	host = strings.ToLower(host)
+	if _, ok := dns.IsDomainName(host); !ok || strings.ContainsAny(host, "&\\ ") {
+		return ""
+	}
+	return host
+}
+
+// match reports whether the query of name is answered by leases: names under the local domain, hostnames of a single
+// label which are leased, and reverse names of leased addresses.
+func (l *dhcpLeases) match(name string) bool {
+	if l == nil {
+		return false
+	}
+	name = dns.CanonicalName(name)
+	if dns.IsSubDomain(l.domain, name) {
+		return true
+	}
+	if _, ok := l.ptrs[name]; ok {
+		return true
+	}
+	_, ok := l.hosts[strings.TrimSuffix(name, ".")]
+	return ok && dns.CountLabel(name) == 1
+}
+
+// reply returns the answer to req, whose name is matched by l, with addresses of leases which are not expired.
+func (l *dhcpLeases) reply(req *dns.Msg, now time.Time) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Authoritative = true
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: _leaseTTL}
+
+	if entry, ok := l.ptrs[name]; ok {
+		if q.Qtype == dns.TypePTR && !entry.expired(now) {
+			reply.Answer = append(reply.Answer, &dns.PTR{Hdr: hdr, Ptr: entry.host + "." + l.domain})
+		}
+		return reply
+	}
+	if name == l.domain {
+		return reply
+	}
+	host := strings.TrimSuffix(name, ".")
+	if dns.IsSubDomain(l.domain, name) {
+		host = strings.TrimSuffix(name[:len(name)-len(l.domain)], ".")
+	}
+	exists := false
+	for _, lease := range l.hosts[host] {
+		if lease.expired(now) {
+			continue
+		}
+		exists = true
+		switch ip4 := lease.ip.To4(); {
+		case q.Qtype == dns.TypeA && ip4 != nil:
+			reply.Answer = append(reply.Answer, &dns.A{Hdr: hdr, A: ip4})
+		case q.Qtype == dns.TypeAAAA && ip4 == nil:
+			reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: hdr, AAAA: lease.ip})
+		}
+	}
+	if !exists {
+		reply.Rcode = dns.RcodeNameError
+	}
+	return reply
+}
+
+// expired reports whether the lease is expired at now.
+func (lease dhcpLease) expired(now time.Time) bool {
+	return !lease.expires.IsZero() && lease.expires.Before(now)
+}
@@ -0,0 +1,98 @@
+package gochinadns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDHCPLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dhcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := startTestUpstream(t, "1.2.3.4")
+	now := time.Now().Unix()
+	dnsmasq := filepath.Join(dir, "dnsmasq.leases")
+	content := fmt.Sprintf(`%d 00:11:22:33:44:55 192.168.1.10 NAS 01:00:11:22:33:44:55
+0 00:11:22:33:44:66 192.168.1.11 printer *
+%d 00:11:22:33:44:77 192.168.1.12 old-phone *
+%d 00:11:22:33:44:88 192.168.1.13 * *
+duid 00:01:00:01:2a:bc:de:f0:00:11:22:33:44:55
+%d 1234 fd00::10 nas 00:01:00:01:2a:bc:de:f0:00:11:22:33:44:55
+`, now+3600, now-60, now+3600, now+3600)
+	if err := ioutil.WriteFile(dnsmasq, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+upstream),
+		WithSkipStartupTest(true), WithDHCPLeases(dnsmasq, "home.arpa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"nas.home.arpa.", dns.TypeA, dns.RcodeSuccess, "192.168.1.10"},
+		{"NAS.home.arpa.", dns.TypeAAAA, dns.RcodeSuccess, "fd00::10"},
+		{"nas.", dns.TypeA, dns.RcodeSuccess, "192.168.1.10"},
+		{"printer.home.arpa.", dns.TypeA, dns.RcodeSuccess, "192.168.1.11"},
+		{"printer.home.arpa.", dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{"old-phone.home.arpa.", dns.TypeA, dns.RcodeNameError, ""},
+		{"missing.home.arpa.", dns.TypeA, dns.RcodeNameError, ""},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, "nas.home.arpa."},
+		{"12.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, ""},
+		{"missing.", dns.TypeA, dns.RcodeSuccess, "1.2.3.4"},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, tt.qtype)
+		w := new(explainWriter)
+		s.Serve(w, req)
+		if w.reply == nil {
+			t.Fatalf("No reply to %s", tt.name)
+		}
+		if w.reply.Rcode != tt.rcode {
+			t.Errorf("Rcode of %s %s = %s, want %s", tt.name, dns.TypeToString[tt.qtype], dns.RcodeToString[w.reply.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		var got string
+		if len(w.reply.Answer) > 0 {
+			got = dns.Field(w.reply.Answer[0], 1)
+		}
+		if got != tt.answer {
+			t.Errorf("Answer of %s %s = %q, want %q", tt.name, dns.TypeToString[tt.qtype], got, tt.answer)
+		}
+	}
+	if c := s.Config(); c.DHCPLeases != 3 || c.DHCPDomain != "home.arpa" {
+		t.Errorf("Config reports %d hostnames under %s, want 3 under home.arpa", c.DHCPLeases, c.DHCPDomain)
+	}
+
+	// Kea appends changes of leases, of which the last one is current.
+	kea := filepath.Join(dir, "kea-leases4.csv")
+	content = fmt.Sprintf(`address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context
+192.168.1.20,00:11:22:33:44:99,,3600,%d,1,0,0,laptop.example.com,0,
+192.168.1.21,00:11:22:33:44:aa,,3600,%d,1,0,0,tv,0,
+192.168.1.21,00:11:22:33:44:aa,,0,%d,1,0,0,tv,0,
+192.168.1.22,00:11:22:33:44:bb,,3600,%d,1,0,0,declined,1,
+`, now+3600, now+3600, now, now+3600)
+	if err := ioutil.WriteFile(kea, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	o := new(serverOptions)
+	if err := WithDHCPLeases(kea, "")(o); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.DHCPLeases.hosts) != 1 || o.DHCPLeases.hosts["laptop"] == nil || o.DHCPLeases.domain != "lan." {
+		t.Errorf("Kea leases = %v under %s, want laptop under lan.", o.DHCPLeases.hosts, o.DHCPLeases.domain)
+	}
+	if err := WithDHCPLeases(kea, ".")(o); err == nil {
+		t.Error("Root domain should fail")
+	}
+}
@@ -0,0 +1,102 @@
+package gochinadns
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// resolvConfPaths are the resolv.conf files SystemResolvers reads by default: those of systemd-resolved, whose
+// /etc/resolv.conf has its local stub only, of the system, written by DHCP clients and NetworkManager, and of rdnssd,
+// which keeps the RDNSS servers of router advertisements.
+var resolvConfPaths = []string{"/run/systemd/resolve/resolv.conf", "/etc/resolv.conf", "/run/rdnssd/resolv.conf"}
+
+// SystemResolvers returns a source of the nameservers of resolv.conf files at paths, or else of those of
+// systemd-resolved, the system and rdnssd, so that a host roaming between networks queries the resolvers each network
+// provides by DHCP or router advertisements, with WithResolverSource polling it to pick up changes of the network.
+//
+// Resolvers are queried over UDP then TCP, and classified by the China route list like those of WithResolvers, except
+// those at addresses of the local network, such as a router, which are untrusted, since where they forward queries
+// to is unknown. Loopback nameservers, such as the stub of systemd-resolved or the server itself, are skipped to
+// avoid loops. Files which don't exist are skipped, unless none of them does.
+func SystemResolvers(paths ...string) ResolverSource {
+	if len(paths) == 0 {
+		paths = resolvConfPaths
+	}
+	return func(ctx context.Context) ([]*Resolver, error) {
+		var resolvers []*Resolver
+		seen := make(map[string]bool)
+		found := false
+		for _, path := range paths {
+			nameservers, err := readNameservers(path)
+			if os.IsNotExist(errors.Cause(err)) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			found = true
+			for _, ns := range nameservers {
+				addr := net.JoinHostPort(ns, "53")
+				if seen[addr] {
+					continue
+				}
+				seen[addr] = true
+				r := &Resolver{addr: addr, protocols: []string{"udp", "tcp"}, local: isLocalNetwork(ns)}
+				resolvers = append(resolvers, r)
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("no resolv.conf in %s", strings.Join(paths, ", "))
+		}
+		return resolvers, nil
+	}
+}
+
+// readNameservers returns addresses of nameserver lines of the resolv.conf at path, without those of loopback.
+// IPv6 link-local addresses keep their zones, such as fe80::1%wlan0.
+func readNameservers(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to open resolv.conf")
+	}
+	defer f.Close()
+	var nameservers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		ip := net.ParseIP(strings.SplitN(fields[1], "%", 2)[0])
+		if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+			continue
+		}
+		nameservers = append(nameservers, fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "fail to scan resolv.conf")
+	}
+	return nameservers, nil
+}
+
+// isLocalNetwork reports whether the address, which may have a zone, is private, shared by carrier-grade NAT,
+// or link-local, so that it's of the local network, rather than somewhere the China route list tells.
+func isLocalNetwork(addr string) bool {
+	ip := net.ParseIP(strings.SplitN(addr, "%", 2)[0])
+	if ip == nil {
+		return false
+	}
+	if ip.IsLinkLocalUnicast() {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 || ip4[0] == 172 && ip4[1]&0xf0 == 16 || ip4[0] == 192 && ip4[1] == 168 ||
+			ip4[0] == 100 && ip4[1]&0xc0 == 64
+	}
+	return ip[0]&0xfe == 0xfc
+}
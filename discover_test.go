@@ -0,0 +1,76 @@
+package gochinadns
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSystemResolvers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	resolved := filepath.Join(dir, "resolved.conf")
+	content := `# upstreams of systemd-resolved
+nameserver 192.168.1.1
+nameserver 114.114.114.114
+nameserver fe80::1%wlan0
+search lan
+`
+	if err := ioutil.WriteFile(resolved, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	system := filepath.Join(dir, "resolv.conf")
+	if err := ioutil.WriteFile(system, []byte("nameserver 127.0.0.53\nnameserver 192.168.1.1\nnameserver 8.8.8.8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := SystemResolvers(resolved, system, filepath.Join(dir, "missing.conf"))
+	resolvers, err := source(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		addr  string
+		local bool
+	}{
+		{"192.168.1.1:53", true},
+		{"114.114.114.114:53", false},
+		{"[fe80::1%wlan0]:53", true},
+		{"8.8.8.8:53", false},
+	}
+	if len(resolvers) != len(want) {
+		t.Fatalf("Resolvers = %v, want %v", resolvers, want)
+	}
+	for i, r := range resolvers {
+		if r.GetAddr() != want[i].addr || r.local != want[i].local {
+			t.Errorf("Resolver %d = %s (local %v), want %s (local %v)", i, r, r.local, want[i].addr, want[i].local)
+		}
+	}
+
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithCHNListSource(DataList([]byte("114.114.114.0/24\n"))),
+		WithSkipStartupTest(true), WithResolverSource(source, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RefreshResolvers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var trusted, untrusted []string
+	for _, r := range s.options().TrustedServers {
+		trusted = append(trusted, r.GetAddr())
+	}
+	for _, r := range s.options().UntrustedServers {
+		untrusted = append(untrusted, r.GetAddr())
+	}
+	if len(trusted) != 1 || trusted[0] != "8.8.8.8:53" || len(untrusted) != 3 {
+		t.Errorf("Trusted %v and untrusted %v, want 8.8.8.8 trusted only", trusted, untrusted)
+	}
+
+	if _, err := SystemResolvers(filepath.Join(dir, "missing.conf"))(context.Background()); err == nil {
+		t.Error("No resolv.conf should fail")
+	}
+}
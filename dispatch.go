@@ -0,0 +1,170 @@
+package gochinadns
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// _probeInterval is how often, in queries, a random resolver is tried first instead of the fastest, see WithFastestFirst.
+const _probeInterval = 32
+
+// Strategies to dispatch queries to resolvers of the same kind, see WithDispatch.
+const (
+	DispatchSequential = "sequential" //one resolver after another, moving on after the delay or a failure
+	DispatchParallel   = "parallel"   //all resolvers at once, the first reply wins
+	DispatchGrouped    = "grouped"    //resolvers of a group at once, one group after another like sequential
+)
+
+// checkDispatch checks if a valid dispatch strategy is specified.
+func checkDispatch(d string) error {
+	switch d {
+	case DispatchSequential, DispatchParallel, DispatchGrouped:
+		return nil
+	}
+	return errors.Errorf("unknown dispatch strategy [%s]", d)
+}
+
+// dispatchStages splits servers into stages by the dispatch strategy. Resolvers of a stage are queried at once,
+// and the next stage is queried after the delay, or once every resolver of a stage fails.
+// Grouped resolvers are staged in the order their groups first appear, and ungrouped ones are groups of their own.
+// Weighted resolvers are balanced by weightedOrder, among all servers in sequence, or within their groups,
+// whose resolvers are then queried one after another instead of at once.
+func dispatchStages(dispatch string, servers []Resolver) [][]Resolver {
+	switch dispatch {
+	case DispatchParallel:
+		if len(servers) == 0 {
+			return nil
+		}
+		return [][]Resolver{servers}
+	case DispatchGrouped:
+		var stages [][]Resolver
+		index := make(map[string]int)
+		for _, server := range servers {
+			if i, ok := index[server.group]; ok && server.group != "" {
+				stages[i] = append(stages[i], server)
+				continue
+			}
+			index[server.group] = len(stages)
+			stages = append(stages, []Resolver{server})
+		}
+		var balanced [][]Resolver
+		for _, group := range stages {
+			if !isWeighted(group) {
+				balanced = append(balanced, group)
+				continue
+			}
+			for _, server := range weightedOrder(group) {
+				balanced = append(balanced, []Resolver{server})
+			}
+		}
+		return balanced
+	default:
+		servers = weightedOrder(servers)
+		stages := make([][]Resolver, len(servers))
+		for i := range servers {
+			stages[i] = servers[i : i+1]
+		}
+		return stages
+	}
+}
+
+// isWeighted reports whether any of servers has a weight.
+func isWeighted(servers []Resolver) bool {
+	for _, server := range servers {
+		if server.weight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// weightedOrder returns servers with weighted ones shuffled among their own positions, so that each is first
+// among them in proportion to its weight, and the rest in proportion to their weights too. Unweighted resolvers
+// keep their positions, and servers are returned as they are if none is weighted.
+func weightedOrder(servers []Resolver) []Resolver {
+	if !isWeighted(servers) {
+		return servers
+	}
+	// a weighted random permutation: every resolver is ranked by a random key of u^(1/weight), the highest first.
+	type keyed struct {
+		server Resolver
+		key    float64
+	}
+	var (
+		positions []int
+		weighted  []keyed
+	)
+	for i, server := range servers {
+		if server.weight > 0 {
+			positions = append(positions, i)
+			weighted = append(weighted, keyed{server, math.Pow(rand.Float64(), 1/float64(server.weight))})
+		}
+	}
+	sort.Slice(weighted, func(i, j int) bool { return weighted[i].key > weighted[j].key })
+	ordered := append([]Resolver(nil), servers...)
+	for i, pos := range positions {
+		ordered[pos] = weighted[i].server
+	}
+	return ordered
+}
+
+// stageDelay returns the delay to query the next stage after the stage: the shortest delay of its resolvers
+// which have their own, or waitInterval.
+func stageDelay(stage []Resolver, waitInterval time.Duration) time.Duration {
+	delay := time.Duration(0)
+	for _, server := range stage {
+		if server.delay > 0 && (delay == 0 || server.delay < delay) {
+			delay = server.delay
+		}
+	}
+	if delay == 0 {
+		return waitInterval
+	}
+	return delay
+}
+
+// dispatch returns the stages available servers are queried in, by the options of dispatch.
+func (s *Server) dispatch(o *serverOptions, servers resolverArray) [][]Resolver {
+	servers = s.available(servers)
+	if o.FastestFirst && o.Dispatch != DispatchParallel {
+		servers = s.fastestFirst(servers)
+	}
+	return dispatchStages(o.Dispatch, servers)
+}
+
+// fastestFirst returns servers ordered by their moving average RTTs, fastest first, see WithFastestFirst.
+// Untried resolvers come first, so that they are measured, and failing ones last, in the order they are given.
+func (s *Server) fastestFirst(servers resolverArray) resolverArray {
+	if len(servers) < 2 {
+		return servers
+	}
+	type ranked struct {
+		server Resolver
+		rtt    time.Duration
+		ok     bool
+	}
+	ranks := make([]ranked, len(servers))
+	for i, server := range servers {
+		rtt, ok := s.stats.upstream(server.GetAddr()).averageRTT()
+		ranks[i] = ranked{server, rtt, ok}
+	}
+	sort.SliceStable(ranks, func(i, j int) bool {
+		if ranks[i].ok != ranks[j].ok {
+			return ranks[i].ok
+		}
+		return ranks[i].ok && ranks[i].rtt < ranks[j].rtt
+	})
+	ordered := make(resolverArray, len(servers))
+	for i, r := range ranks {
+		ordered[i] = r.server
+	}
+	if rand.Intn(_probeInterval) == 0 {
+		i := 1 + rand.Intn(len(ordered)-1)
+		ordered[0], ordered[i] = ordered[i], ordered[0]
+	}
+	return ordered
+}
@@ -0,0 +1,197 @@
+package gochinadns
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestDispatchStages(t *testing.T) {
+	servers := []Resolver{
+		{addr: "1.1.1.1:53", group: "a"},
+		{addr: "2.2.2.2:53"},
+		{addr: "3.3.3.3:53", group: "a"},
+		{addr: "4.4.4.4:53"},
+		{addr: "5.5.5.5:53", group: "b"},
+	}
+	addrs := func(stages [][]Resolver) (s [][]string) {
+		for _, stage := range stages {
+			var stageAddrs []string
+			for _, server := range stage {
+				stageAddrs = append(stageAddrs, server.GetAddr()[:1])
+			}
+			s = append(s, stageAddrs)
+		}
+		return
+	}
+	tests := []struct {
+		dispatch string
+		want     [][]string
+	}{
+		{"", [][]string{{"1"}, {"2"}, {"3"}, {"4"}, {"5"}}},
+		{DispatchSequential, [][]string{{"1"}, {"2"}, {"3"}, {"4"}, {"5"}}},
+		{DispatchParallel, [][]string{{"1", "2", "3", "4", "5"}}},
+		{DispatchGrouped, [][]string{{"1", "3"}, {"2"}, {"4"}, {"5"}}},
+	}
+	for _, tt := range tests {
+		if got := addrs(dispatchStages(tt.dispatch, servers)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("dispatchStages(%q) = %v, want %v", tt.dispatch, got, tt.want)
+		}
+	}
+	if stages := dispatchStages(DispatchParallel, nil); stages != nil {
+		t.Errorf("dispatchStages of no servers = %v, want nil", stages)
+	}
+	if err := WithDispatch("random")(new(serverOptions)); err == nil {
+		t.Error("unknown dispatch strategy should fail")
+	}
+}
+
+func TestWeightedOrder(t *testing.T) {
+	servers := []Resolver{
+		{addr: "1.1.1.1:53", weight: 1},
+		{addr: "2.2.2.2:53"},
+		{addr: "3.3.3.3:53", weight: 9},
+	}
+	firsts := 0
+	for i := 0; i < 10000; i++ {
+		got := weightedOrder(servers)
+		if got[1].GetAddr() != "2.2.2.2:53" {
+			t.Fatalf("unweighted resolver is moved: %v", got)
+		}
+		if got[0].GetAddr() == "3.3.3.3:53" {
+			firsts++
+		}
+	}
+	if firsts < 8500 || firsts > 9500 {
+		t.Errorf("resolver of weight 9 is first %d times in 10000, want about 9000", firsts)
+	}
+	if servers[0].GetAddr() != "1.1.1.1:53" {
+		t.Error("servers given are reordered")
+	}
+
+	// a weighted group is queried one after another.
+	servers = append(servers, Resolver{addr: "4.4.4.4:53", group: "a"}, Resolver{addr: "5.5.5.5:53", group: "a"})
+	for i := range servers[:3] {
+		servers[i].group = "b"
+	}
+	stages := dispatchStages(DispatchGrouped, servers)
+	if len(stages) != 4 || len(stages[0]) != 1 || len(stages[3]) != 2 {
+		t.Errorf("weighted group is staged as %v", stages)
+	}
+}
+
+func TestLookupInServersDispatch(t *testing.T) {
+	// servers of the first group fail, and the second group is queried at once instead of after the delay.
+	servers := []Resolver{
+		{addr: "1.1.1.1:53", group: "a"},
+		{addr: "2.2.2.2:53", group: "a"},
+		{addr: "3.3.3.3:53", group: "b"},
+		{addr: "4.4.4.4:53", group: "c"},
+	}
+	for _, dispatch := range []string{DispatchSequential, DispatchParallel, DispatchGrouped} {
+		var mu sync.Mutex
+		var queried []string
+		lookup := func(_ context.Context, server Resolver) (*upstreamReply, time.Duration, error) {
+			mu.Lock()
+			queried = append(queried, server.GetAddr())
+			mu.Unlock()
+			if server.group == "a" {
+				return nil, 0, errors.New("refused")
+			}
+			time.Sleep(50 * time.Millisecond)
+			return &upstreamReply{Msg: newTestReply(t, 0), server: server}, 0, nil
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan *upstreamReply, 1)
+		start := time.Now()
+		lookupInServers(ctx, cancel, NewLogrusLogger(logrus.StandardLogger()), result,
+			dispatchStages(dispatch, servers), time.Second, lookup)
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("%s dispatch takes %s", dispatch, elapsed)
+		}
+
+		var want []string
+		switch dispatch {
+		case DispatchParallel:
+			want = []string{"1.1.1.1:53", "2.2.2.2:53", "3.3.3.3:53", "4.4.4.4:53"}
+		default:
+			want = []string{"1.1.1.1:53", "2.2.2.2:53", "3.3.3.3:53"}
+		}
+		mu.Lock()
+		if len(queried) != len(want) {
+			t.Errorf("%s dispatch queries %v, want %v", dispatch, queried, want)
+		}
+		mu.Unlock()
+		if rep := <-result; rep.server.group != "b" && rep.server.group != "c" {
+			t.Errorf("%s dispatch answers with %s", dispatch, rep.server)
+		}
+	}
+}
+
+func TestLookupInServersDelay(t *testing.T) {
+	// the first resolver never answers, and the second is queried after its own delay instead of the global one.
+	servers := []Resolver{{addr: "1.1.1.1:53", delay: 20 * time.Millisecond}, {addr: "2.2.2.2:53"}}
+	lookup := func(_ context.Context, server Resolver) (*upstreamReply, time.Duration, error) {
+		if server.GetAddr() == "1.1.1.1:53" {
+			time.Sleep(time.Second)
+			return nil, 0, errors.New("timeout")
+		}
+		return &upstreamReply{Msg: newTestReply(t, 0), server: server}, 0, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan *upstreamReply, 1)
+	start := time.Now()
+	go lookupInServers(ctx, cancel, NewLogrusLogger(logrus.StandardLogger()), result,
+		dispatchStages(DispatchSequential, servers), 10*time.Second, lookup)
+	rep := <-result
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("second resolver is queried after %s", elapsed)
+	}
+	if rep.server.GetAddr() != "2.2.2.2:53" {
+		t.Errorf("answered by %s", rep.server)
+	}
+	if d := stageDelay(servers[1:], time.Second); d != time.Second {
+		t.Errorf("delay of a stage without overrides is %s", d)
+	}
+}
+
+func TestFastestFirst(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := resolverArray{
+		{addr: "1.1.1.1:53"},
+		{addr: "2.2.2.2:53"},
+		{addr: "3.3.3.3:53"},
+		{addr: "4.4.4.4:53"},
+	}
+	s.stats.observeUpstream(servers[0], 50*time.Millisecond, nil)
+	s.stats.observeUpstream(servers[1], 10*time.Millisecond, nil)
+	s.stats.observeUpstream(servers[2], 5*time.Millisecond, nil)
+	s.stats.observeUpstream(servers[2], time.Second, errors.New("timeout"))
+
+	// the untried resolver first, then by average RTT, and the failing one last, except for probes.
+	want := resolverArray{servers[3], servers[1], servers[0], servers[2]}
+	ordered := 0
+	firsts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		got := s.fastestFirst(servers)
+		if reflect.DeepEqual(got, want) {
+			ordered++
+		}
+		firsts[got[0].GetAddr()]++
+	}
+	if ordered < 900 || len(firsts) != len(servers) {
+		t.Errorf("servers are ordered %d times in 1000, and tried first %v", ordered, firsts)
+	}
+	if servers[0].GetAddr() != "1.1.1.1:53" {
+		t.Error("servers given are reordered")
+	}
+}
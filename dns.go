@@ -2,31 +2,201 @@ package gochinadns
 
 import (
 	"context"
-	"net"
+	"fmt"
+	"math/rand"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
-	"github.com/sirupsen/logrus"
 )
 
+var _ dns.Handler = (*Server)(nil)
+
+// ServeDNS serves DNS request, so that the server is a dns.Handler, which may be mounted in another dns.Server,
+// or in a dns.ServeMux with other handlers. The server need not be started to serve queries, but Start runs
+// background checks of resolvers and list updates, and endpoints of metrics and the admin API.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Serve(w, req)
+}
+
 // Serve serves DNS request.
 func (s *Server) Serve(w dns.ResponseWriter, req *dns.Msg) {
+	w = s.limitResponses(w, req)
+	if s.events.wantQuery() && len(req.Question) > 0 {
+		s.events.query(&QueryEvent{
+			Time:   time.Now(),
+			Client: clientIP(w.RemoteAddr()),
+			Name:   req.Question[0].Name,
+			QType:  dns.TypeToString[req.Question[0].Qtype],
+		})
+	}
+	if s.denied(w, req) || s.rateLimited(w, req) {
+		return
+	}
+	s.handler.ServeDNS(w, req)
+}
+
+// serve serves DNS request in ctx, recording every step in ex if it's not nil, and returns how it's answered.
+// Upstream lookups are given up once ctx is done, and the query is answered as if no resolver replies.
+func (s *Server) serve(ctx context.Context, w dns.ResponseWriter, req *dns.Msg, ex *explainer) *queryResult {
+	o := s.options()
 	// Its client's responsibility to close this conn.
 	// defer w.Close()
 	var reply *dns.Msg
 
 	start := time.Now()
 	qName := req.Question[0].Name
-	logger := logrus.WithField("question", questionString(&req.Question[0]))
+	logger := ex.logger(s.verdictLog).WithField("question", questionString(&req.Question[0]))
+	s.tapClientQuery(w, req, start)
+	trace := s.tracer.startTrace("dns.query")
+	trace.set("dns.question.name", qName)
+	trace.set("dns.question.type", dns.TypeToString[req.Question[0].Qtype])
+	trace.set("client.address", clientIP(w.RemoteAddr()))
+	ex.matchLists(o, qName)
 
-	if s.DomainBlacklist.Contain(qName) {
+	if rule, ok := o.DomainBlacklist.Match(qName); ok {
+		entry := &AuditEntry{
+			Time:   start,
+			Event:  auditBlocked,
+			Client: clientIP(w.RemoteAddr()),
+			Domain: qName,
+			QType:  dns.TypeToString[req.Question[0].Qtype],
+			Rule:   rule,
+		}
+		s.audit.Log(entry)
+		s.events.blocked(entry)
+		reply = new(dns.Msg)
+		reply.SetReply(req)
+		result := &queryResult{path: pathBlocked, reason: reasonBlocked, trace: trace}
+		s.respond(w, reply, trace)
+		s.finishQuery(w, req, reply, result, start)
+		return result
+	}
+
+	if isVersionQuery(&req.Question[0]) {
+		reply = versionReply(req)
+		result := &queryResult{path: pathLocal, reason: reasonVersion, trace: trace}
+		s.respond(w, reply, trace)
+		s.finishQuery(w, req, reply, result, start)
+		return result
+	}
+
+	if o.MDNS != nil && isLocalName(qName) {
+		reply = resolveMDNS(ctx, o, req, logger)
+		result := &queryResult{path: pathLocal, reason: reasonMDNS, trace: trace}
+		s.respond(w, reply, trace)
+		s.finishQuery(w, req, reply, result, start)
+		return result
+	}
+
+	if o.DHCPLeases.match(qName) {
+		reply = o.DHCPLeases.reply(req, start)
+		result := &queryResult{path: pathLocal, reason: reasonDHCPLease, trace: trace}
+		s.respond(w, reply, trace)
+		s.finishQuery(w, req, reply, result, start)
+		return result
+	}
+
+	if zone := o.LocalZones.match(qName); zone != nil {
+		reply = zone.reply(req)
+		result := &queryResult{path: pathLocal, reason: reasonZone, trace: trace}
+		s.respond(w, reply, trace)
+		s.finishQuery(w, req, reply, result, start)
+		return result
+	}
+
+	route := o.DomainRoutes.match(qName)
+	if route != nil && route.local() {
+		reply = route.reply(req)
+		result := &queryResult{path: pathLocal, reason: reasonDomainRoute, trace: trace}
+		s.respond(w, reply, trace)
+		s.finishQuery(w, req, reply, result, start)
+		return result
+	}
+
+	// the key is of the query as the client sends it, before it's normalized.
+	key, cacheable := s.cache.keyOf(req)
+	// replies of explained queries are not cached, so that diagnostics don't change the state of the server.
+	cacheable = cacheable && ex == nil
+	s.normalizeRequest(req)
+	var (
+		rep *upstreamReply
+		err error
+	)
+	if route != nil && route.target != "" {
+		rep, err = s.resolveCloaked(ctx, o, req, route.target, logger, trace, ex)
+	} else if route != nil {
+		rep, err = s.forward(ctx, o, req, route, logger, trace, ex)
+	} else if o.Coalesce && ex == nil {
+		rep, err = s.resolveCoalesced(o, req, logger, trace)
+	} else {
+		rep, err = s.resolveLimited(ctx, o, req, logger, trace, ex)
+	}
+	if err == errOverloaded {
+		s.stats.overloaded.Add(1)
+		s.metrics.observeOverloaded(o.OverloadAction)
+		logger.Debugf("Too many queries in flight. Answer %s.", o.OverloadAction)
+		result := &queryResult{path: pathOverload, reason: reasonOverload, trace: trace}
+		if o.OverloadAction == OverloadDrop {
+			trace.finish()
+			return result
+		}
+		reply = new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeServerFailure)
+		s.respond(w, reply, trace)
+		s.finishQuery(w, req, reply, result, start)
+		return result
+	}
+
+	if rep != nil && o.DNS64 != nil && req.Question[0].Qtype == dns.TypeAAAA {
+		rep = s.dns64(ctx, o, req, rep, logger, trace, ex)
+	}
+	if rep != nil && o.BogusNXDomain != nil {
+		rep = bogusNXDomain(o.BogusNXDomain, rep, logger)
+	}
+	if rep != nil && s.prober != nil {
+		rep = s.prober.order(ctx, rep, logger)
+	}
+
+	result := &queryResult{path: pathNone, reason: reasonNoReply, trace: trace}
+	if rep != nil && rep.raw != nil {
+		reply = rep.Msg
+		result.path, result.server, result.reason = s.pathOf(rep.server), rep.server.GetAddr(), rep.reason
+		result.polluted = rep.polluted
+		s.respondRaw(w, rep.raw, req.Id, trace)
+		if cacheable {
+			s.cache.Store(key, reply, rep.raw, result.path, result.server)
+		}
+		s.finishQuery(w, req, reply, result, start)
+		logger.Debug("SERVING RTT: ", time.Since(start))
+		return result
+	}
+	if rep != nil {
+		reply = rep.Msg
+		result.path, result.server, result.reason = s.pathOf(rep.server), rep.server.GetAddr(), rep.reason
+		result.polluted = rep.polluted
+		// https://github.com/miekg/dns/issues/216
+		reply.Compress = true
+		s.normalizeReplyECS(reply)
+	} else {
 		reply = new(dns.Msg)
 		reply.SetReply(req)
-		w.WriteMsg(reply)
-		return
 	}
 
-	ctx, cancel := context.WithCancel(context.TODO())
+	s.respond(w, reply, trace)
+	if rep != nil && cacheable {
+		s.cache.Store(key, reply, nil, result.path, result.server)
+	}
+	s.finishQuery(w, req, reply, result, start)
+	logger.Debug("SERVING RTT: ", time.Since(start))
+	return result
+}
+
+// resolve queries trusted and untrusted servers, and returns the reply chosen, or nil if there is none,
+// such as if parent is done first.
+func (s *Server) resolve(parent context.Context, o *serverOptions, req *dns.Msg, logger Logger, trace *span, ex *explainer) (rep *upstreamReply) {
+	qName := req.Question[0].Name
+	ctx, cancel := context.WithCancel(parent)
 	uctx, ucancel := context.WithCancel(ctx)
 	tctx, tcancel := context.WithCancel(ctx)
 	go func() {
@@ -35,137 +205,360 @@ func (s *Server) Serve(w dns.ResponseWriter, req *dns.Msg) {
 		cancel()
 	}()
 
-	s.normalizeRequest(req)
-
-	trusted := make(chan *dns.Msg, 1)
-	untrusted := make(chan *dns.Msg, 1)
-	if s.Mutation {
-		go lookupInServers(tctx, tcancel, trusted, req, s.TrustedServers, s.Delay, s.LookupMutation)
-	} else {
-		go lookupInServers(tctx, tcancel, trusted, req, s.TrustedServers, s.Delay, s.Lookup)
+	trusted := make(chan *upstreamReply, 1)
+	untrusted := make(chan *upstreamReply, 1)
+	lookup := ex.lookup(traceLookup(trace, s.LookupMutated))
+	trustedLookup, untrustedLookup := lookupMsg(o.TrustedECS.apply(req), lookup), lookupMsg(o.UntrustedECS.apply(req), lookup)
+	if s.canForwardRaw(o, trace, ex) {
+		// the query is packed once for all servers. It's not pooled, since lookups may outlive resolve.
+		if query, err := req.Pack(); err == nil {
+			trustedLookup, untrustedLookup = s.lookupRaw(req, query, lookup), s.lookupRaw(req, query, lookup)
+		}
+	}
+	var votes *rcodeVotes
+	if o.RcodeFailover && o.RelayAgreed {
+		votes = new(rcodeVotes)
+		trustedLookup, untrustedLookup = votes.record(trustedLookup), votes.record(untrustedLookup)
 	}
-	if !s.DomainPolluted.Contain(qName) {
-		go lookupInServers(uctx, ucancel, untrusted, req, s.UntrustedServers, s.Delay, s.Lookup)
+	if o.TrustedQuorum > 1 {
+		go lookupQuorum(tctx, tcancel, logger, trusted, o.TrustedECS.apply(req), s.available(o.TrustedServers), o.TrustedQuorum, lookup)
 	} else {
+		go lookupInServers(tctx, tcancel, logger, trusted, s.dispatch(o, o.TrustedServers), o.Delay, trustedLookup)
+	}
+	if o.DomainPolluted.Contain(qName) {
 		ucancel()
+	} else if o.QNAMEMinimize {
+		root := resolverArray{rootResolvers[rand.Intn(len(rootResolvers))]}
+		go lookupInServers(uctx, ucancel, logger, untrusted, [][]Resolver{root}, o.Delay, votes.record(lookupMsg(req, ex.lookup(traceLookup(trace, s.LookupIterative)))))
+	} else {
+		go lookupInServers(uctx, ucancel, logger, untrusted, s.dispatch(o, o.UntrustedServers), o.Delay, untrustedLookup)
 	}
 
+	verdict := trace.child("verdict", spanKindInternal)
 	select {
-	case rep := <-untrusted:
-		reply = s.processReply(ctx, logger, rep, trusted, s.processUntrustedAnswer)
-	case rep := <-trusted:
-		reply = s.processReply(ctx, logger, rep, untrusted, s.processTrustedAnswer)
+	case r := <-untrusted:
+		rep = s.processUntrustedReply(ctx, logger, r, trusted)
+		if o.MergedAnswers != "" && rep == r && rep.reason != reasonFallback {
+			rep = s.mergeAnswers(ctx, o, logger, rep, OriginUntrusted, trusted)
+		}
+	case r := <-trusted:
+		rep = s.judge(ctx, logger, r, OriginTrusted, untrusted)
+		if o.MergedAnswers != "" && rep == r && rep.reason != reasonFallback {
+			rep = s.mergeAnswers(ctx, o, logger, rep, OriginTrusted, untrusted)
+		}
 	case <-ctx.Done():
+		// replies sent right before ctx is done are still judged.
+		if r := awaitReply(ctx, untrusted); r != nil {
+			rep = s.processUntrustedReply(ctx, logger, r, trusted)
+		} else if r := awaitReply(ctx, trusted); r != nil {
+			rep = s.judge(ctx, logger, r, OriginTrusted, untrusted)
+		} else if rep = votes.agreed(); rep != nil {
+			logger.Debugf("Every upstream replies %s. Relay it.", dns.RcodeToString[rep.Rcode])
+		}
 	}
 	// notify lookupInServers to quit.
 	cancel()
 
-	if reply != nil {
-		// https://github.com/miekg/dns/issues/216
-		reply.Compress = true
-	} else {
-		reply = new(dns.Msg)
-		reply.SetReply(req)
+	reason := reasonNoReply
+	if rep != nil {
+		reason = rep.reason
 	}
+	verdict.set("chinadns.reason", reason)
+	verdict.finish()
+	return rep
+}
 
-	w.WriteMsg(reply)
-	logger.Debug("SERVING RTT: ", time.Since(start))
+// resolveLimited resolves req like resolve once a slot of the concurrency limit is free,
+// or fails with errOverloaded if there is none in time.
+func (s *Server) resolveLimited(ctx context.Context, o *serverOptions, req *dns.Msg, logger Logger, trace *span, ex *explainer) (*upstreamReply, error) {
+	if !s.limiter.acquire(o.Timeout) {
+		return nil, errOverloaded
+	}
+	defer s.limiter.release()
+	return s.resolve(ctx, o, req, logger, trace, ex), nil
 }
 
-func (s *Server) normalizeRequest(req *dns.Msg) {
-	req.RecursionDesired = true
-	if !s.TCPOnly {
-		setUDPSize(req, uint16(s.UDPMaxSize))
+// resolveCoalesced resolves req like resolveLimited, or waits for the resolution of an identical query in flight,
+// and returns a copy of the reply for req. Resolutions are shared by queries, so they are given up only once
+// the server shuts down, rather than when the query which starts one is.
+func (s *Server) resolveCoalesced(o *serverOptions, req *dns.Msg, logger Logger, trace *span) (*upstreamReply, error) {
+	leader := false
+	v, err, _ := s.flights.Do(flightKey(req), func() (interface{}, error) {
+		leader = true
+		return s.resolveLimited(s.ctx, o, req, logger, trace, nil)
+	})
+	if !leader {
+		logger.Debug("Answered by an identical query in flight.")
+		s.metrics.observeCoalesced()
+	}
+	rep := v.(*upstreamReply)
+	if err != nil || rep == nil {
+		return nil, err
+	}
+	// every query gets its own copy, with its own ID and question, which may differ in letter case.
+	// A raw reply is forwarded with the ID patched, unless the question differs.
+	c := *rep
+	if c.raw != nil && c.Question[0].Name != req.Question[0].Name {
+		if err := c.unpackAll(); err != nil {
+			return nil, err
+		}
 	}
+	c.Msg = shareMsg(c.Msg)
+	c.Id = req.Id
+	c.Question = append([]dns.Question(nil), req.Question...)
+	return &c, nil
 }
 
-func (s *Server) processReply(
-	ctx context.Context, logger *logrus.Entry, rep *dns.Msg, other <-chan *dns.Msg,
-	process func(context.Context, *logrus.Entry, *dns.Msg, net.IP, <-chan *dns.Msg) *dns.Msg,
-) (reply *dns.Msg) {
-	reply = rep
-	for i, rr := range rep.Answer {
-		switch answer := rr.(type) {
-		case *dns.A:
-			return process(ctx, logger, rep, answer.A, other)
-		case *dns.AAAA:
-			return process(ctx, logger, rep, answer.AAAA, other)
-		case *dns.CNAME:
-			if i < len(rep.Answer)-1 {
-				continue
+// flightKey returns the key of queries which are answered the same: the same name, type and class, DO and CD bits,
+// and client subnet.
+func flightKey(req *dns.Msg) string {
+	q := req.Question[0]
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(q.Name))
+	fmt.Fprintf(&sb, "/%d/%d/%t", q.Qtype, q.Qclass, req.CheckingDisabled)
+	if opt := req.IsEdns0(); opt != nil {
+		fmt.Fprintf(&sb, "/%t", opt.Do())
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				sb.WriteString("/" + subnet.String())
 			}
-			logger.Debug("CNAME to ", answer.Target)
-			return
-		default:
-			return
 		}
 	}
-	return
+	return sb.String()
 }
 
-func (s *Server) processUntrustedAnswer(ctx context.Context, logger *logrus.Entry, rep *dns.Msg, answer net.IP, trusted <-chan *dns.Msg) (reply *dns.Msg) {
-	reply = rep
-	logger = logger.WithField("answer", answer)
+// queryResult is how a query is answered.
+type queryResult struct {
+	path     string //where the answer comes from
+	server   string //address of the resolver which gives the answer
+	reason   string //why the answer is chosen
+	polluted bool   //the answer is polluted, chosen since there is no other
+	trace    *span  //root span of the query, nil if it's not traced
+}
+
+// respond writes the reply to the client.
+func (s *Server) respond(w dns.ResponseWriter, reply *dns.Msg, trace *span) {
+	sp := trace.child("respond", spanKindInternal)
+	sp.fail(writeMsg(w, reply))
+	sp.finish()
+}
+
+// Reasons why answers are chosen.
+const (
+	reasonBlocked         = "blocked"              //domain is in the blacklist
+	reasonVersion         = "version"              //version.bind query answered by the server itself
+	reasonOverload        = "overload"             //too many queries in flight
+	reasonNoReply         = "no-reply"             //no upstream replies
+	reasonNoAddress       = "no-address"           //reply has no A or AAAA answer to check
+	reasonCNAME           = "cname"                //reply ends with a CNAME
+	reasonChina           = "untrusted-china"      //untrusted answer is in China
+	reasonTrusted         = "trusted"              //trusted answer, not in bidirectional mode
+	reasonBidiExempt      = "bidirectional-exempt" //trusted answer of a domain exempt from bidirectional mode
+	reasonTrustedOverseas = "trusted-overseas"     //trusted answer is overseas
+	reasonFallback        = "fallback"             //the other path gives no acceptable reply
+	reasonAgreedFailure   = "agreed-failure"       //every upstream fails with the same rcode
+	reasonCached          = "cached"               //reply is cached
+	reasonRateLimit       = "rate-limit"           //client is over its rate limit
+	reasonDenied          = "acl"                  //client is not allowed by the client ACL
+	reasonDNS64           = "dns64"                //AAAA answers are synthesized from A answers by DNS64
+	reasonMDNS            = "mdns"                 //.local name resolved by multicast DNS
+	reasonDomainRoute     = "domain-route"         //answered by an address= or local= line of dnsmasq conf, or a cloaking rule
+	reasonForwarded       = "forwarded"            //forwarded to the server of the domain by dnsmasq conf or forwarding rules
+	reasonCloaked         = "cloaked"              //answers of the name of a cloaking rule, resolved instead
+	reasonZone            = "zone"                 //answered authoritatively by a zone file
+	reasonDHCPLease       = "dhcp-lease"           //hostname or address of a DHCP lease
+	reasonBogusNXDomain   = "bogus-nxdomain"       //answer of only bogus addresses replaced by NXDOMAIN
+	reasonMerged          = "merged"               //accepted answers of both origins are merged
+)
 
-	hit, err := s.IPBlacklist.Contains(answer)
-	if err != nil {
-		logger.WithError(err).Error("Blacklist CIDR error.")
+// finishQuery reports a served query to metrics, dnstap and the query log.
+func (s *Server) finishQuery(w dns.ResponseWriter, req, reply *dns.Msg, result *queryResult, start time.Time) {
+	q := &req.Question[0]
+	client := clientIP(w.RemoteAddr())
+	s.stats.observeQuery(q.Name, client, result.path == pathBlocked)
+	s.tapClientResponse(w, reply, start)
+	s.metrics.observeQuery(dns.TypeToString[q.Qtype], dns.RcodeToString[reply.Rcode], result.path, time.Since(start))
+	entry := &QueryLogEntry{
+		Time:     start,
+		Client:   client,
+		Name:     q.Name,
+		Type:     dns.TypeToString[q.Qtype],
+		Path:     result.path,
+		Resolver: result.server,
+		Rcode:    dns.RcodeToString[reply.Rcode],
+		Latency:  time.Since(start).Seconds() * 1000,
+		Reason:   result.reason,
+		Answers:  queryAnswers(reply),
 	}
-	if hit {
-		logger.Debug("Answer hit blacklist. Wait for trusted reply.")
-	} else {
-		contain, err := s.ChinaCIDR.Contains(answer)
-		if err != nil {
-			logger.WithError(err).Error("CIDR error.")
-		}
-		if contain {
-			logger.Debug("Answer belongs to China. Use it.")
-			return
-		}
-		logger.Debug("Answer is overseas. Wait for trusted reply.")
+	s.queryLog.Log(entry)
+	s.recent.Add(entry)
+	s.events.answer(entry)
+	if (s.ipsets != nil || s.nftsets != nil) && result.path != pathBlocked {
+		o := s.options()
+		s.ipsets.observe(o.IPSets, q, reply)
+		s.nftsets.observe(o.NFTSets, q, reply)
 	}
 
-	select {
-	case rep := <-trusted:
-		reply = s.processReply(ctx, logger, rep, nil, s.processTrustedAnswer)
-	case <-ctx.Done():
-		logger.Warn("No trusted reply. Use this as fallback.")
+	result.trace.set("chinadns.path", result.path)
+	result.trace.set("chinadns.reason", result.reason)
+	result.trace.set("dns.rcode", dns.RcodeToString[reply.Rcode])
+	if result.server != "" {
+		result.trace.set("chinadns.resolver", result.server)
 	}
-	return
+	result.trace.finish()
 }
 
-func (s *Server) processTrustedAnswer(ctx context.Context, logger *logrus.Entry, rep *dns.Msg, answer net.IP, untrusted <-chan *dns.Msg) (reply *dns.Msg) {
-	reply = rep
-	logger = logger.WithField("answer", answer)
+// Paths where answers come from.
+const (
+	pathTrusted   = "trusted"
+	pathUntrusted = "untrusted"
+	pathBlocked   = "blocked"
+	pathLocal     = "local"
+	pathOverload  = "overload"
+	pathNone      = "none"
+	pathCache     = "cache"
+	pathRateLimit = "ratelimit"
+	pathDenied    = "denied"
+)
 
-	hit, err := s.IPBlacklist.Contains(answer)
-	if err != nil {
-		logger.WithError(err).Error("Blacklist CIDR error.")
+// isVersionQuery reports whether q asks for the version of the server, as version.bind CH TXT does for BIND.
+func isVersionQuery(q *dns.Question) bool {
+	if q.Qclass != dns.ClassCHAOS || q.Qtype != dns.TypeTXT {
+		return false
 	}
-	if hit {
-		logger.Debug("Answer hit blacklist. Wait for trusted reply.")
-	} else {
-		if !s.Bidirectional {
-			logger.Debug("Answer is trusted. Use it.")
-			return
-		}
+	name := strings.ToLower(q.Name)
+	return name == "version.bind." || name == "version.server."
+}
+
+func versionReply(req *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	q := req.Question[0]
+	reply.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{GetBuildInfo().String()},
+	}}
+	return reply
+}
 
-		contain, err := s.ChinaCIDR.Contains(answer)
-		if err != nil {
-			logger.WithError(err).Error("CIDR error.")
+func (s *Server) pathOf(server Resolver) string {
+	o := s.options()
+	for _, r := range o.TrustedServers {
+		if r.GetAddr() == server.GetAddr() {
+			return pathTrusted
 		}
-		if !contain {
-			logger.Debug("Answer is trusted and overseas. Use it.")
-			return
+	}
+	return pathUntrusted
+}
+
+func (s *Server) normalizeRequest(req *dns.Msg) {
+	o := s.options()
+	req.RecursionDesired = true
+	if !o.TCPOnly {
+		setUDPSize(req, uint16(o.UDPMaxSize))
+	}
+}
+
+// normalizeReplyECS drops ECS options in the reply if they were not forwarded from the client.
+func (s *Server) normalizeReplyECS(reply *dns.Msg) {
+	o := s.options()
+	if o.TrustedECS.action == ecsForward && o.UntrustedECS.action == ecsForward {
+		return
+	}
+	if opt := reply.IsEdns0(); opt != nil {
+		stripECS(opt)
+	}
+}
+
+// judge returns the reply chosen between rep of origin and the reply of the other origin by the trust policy,
+// waiting for the other one if rep is not accepted.
+func (s *Server) judge(ctx context.Context, logger Logger, rep *upstreamReply, origin string, other <-chan *upstreamReply) (reply *upstreamReply) {
+	reply = rep
+	var q dns.Question
+	if len(rep.Question) > 0 {
+		q = rep.Question[0]
+	}
+	d := s.policy().AcceptAnswer(&q, rep.Msg, origin)
+	reply.reason, reply.polluted = d.Reason, d.Polluted
+	if ip, _ := firstAnswerIP(rep.Msg); ip != nil {
+		logger = logger.WithField("answer", ip)
+	}
+	otherOrigin := OriginTrusted
+	if origin == OriginTrusted {
+		otherOrigin = OriginUntrusted
+	}
+	switch msg, ok := decisionMessages[d.Reason]; {
+	case d.Polluted:
+		logger.Debugf("Answer is polluted (%s). Wait for %s reply.", d.Heuristic, otherOrigin)
+		s.reportPollution(rep, d.Heuristic)
+	case ok:
+		logger.Debug(msg)
+	case d.Accept:
+		logger.Debugf("Answer is accepted (%s). Use it.", d.Reason)
+	default:
+		logger.Debugf("Answer is not accepted (%s). Wait for %s reply.", d.Reason, otherOrigin)
+	}
+	if d.Accept {
+		return
+	}
+
+	orep := awaitReply(ctx, other)
+	switch {
+	case orep == nil && origin == OriginUntrusted:
+		logger.Warn("No trusted reply. Use this as fallback.")
+		reply.reason = reasonFallback
+	case orep == nil:
+		logger.Debug("No untrusted reply. Use this as fallback.")
+		reply.reason = reasonFallback
+	case origin == OriginTrusted && s.isSuspectEmpty(orep):
+		logger.Debug("Empty NOERROR reply from untrusted server. Use the trusted reply.")
+		s.reportPollution(orep, heuristicEmptyNoError)
+		reply.reason = reasonFallback
+	default:
+		reply = s.judge(ctx, logger, orep, otherOrigin, nil)
+		if origin == OriginUntrusted && !d.Polluted && reply == orep && !overlapIPs(answerIPs(rep.Msg), answerIPs(orep.Msg)) {
+			s.reportPollution(rep, heuristicOverseasMismatch)
 		}
-		logger.Debug("Answer may not be the nearest. Wait for untrusted reply.")
 	}
+	return
+}
 
+// awaitReply returns the reply from ch, or nil if ctx is done first. ctx is done once lookups of both origins
+// finish, right after the last one sends its reply, which is still returned.
+func awaitReply(ctx context.Context, ch <-chan *upstreamReply) *upstreamReply {
 	select {
-	case rep := <-untrusted:
-		reply = s.processReply(ctx, logger, rep, nil, s.processUntrustedAnswer)
+	case rep := <-ch:
+		return rep
 	case <-ctx.Done():
-		logger.Debug("No untrusted reply. Use this as fallback.")
+		select {
+		case rep := <-ch:
+			return rep
+		default:
+			return nil
+		}
+	}
+}
+
+// processUntrustedReply treats an empty NOERROR reply of untrusted servers as a failure if SuspectEmpty is set,
+// since it's a common pattern of soft censorship.
+func (s *Server) processUntrustedReply(ctx context.Context, logger Logger, rep *upstreamReply, trusted <-chan *upstreamReply) (reply *upstreamReply) {
+	if !s.isSuspectEmpty(rep) {
+		return s.judge(ctx, logger, rep, OriginUntrusted, trusted)
+	}
+
+	reply = rep
+	logger.Debug("Empty NOERROR reply from untrusted server. Wait for trusted reply.")
+	s.reportPollution(rep, heuristicEmptyNoError)
+	if rep := awaitReply(ctx, trusted); rep != nil {
+		reply = s.judge(ctx, logger, rep, OriginTrusted, nil)
+	} else {
+		logger.Warn("No trusted reply. Use the empty reply as fallback.")
+		reply.reason = reasonFallback
 	}
 	return
 }
+
+func (s *Server) isSuspectEmpty(rep *upstreamReply) bool {
+	o := s.options()
+	return o.SuspectEmpty && rep.Rcode == dns.RcodeSuccess && len(rep.Answer) == 0
+}
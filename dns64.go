@@ -0,0 +1,104 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// parseNAT64Prefix parses a NAT64 prefix of RFC 6052, such as the Well-Known Prefix 64:ff9b::/96.
+func parseNAT64Prefix(prefix string) (*net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil || ip.To4() != nil {
+		return nil, errors.Errorf("invalid NAT64 prefix [%s]", prefix)
+	}
+	switch ones, _ := ipNet.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, errors.Errorf("invalid length of NAT64 prefix [%s]", prefix)
+	}
+	if ipNet.IP[8] != 0 {
+		return nil, errors.Errorf("invalid NAT64 prefix [%s]: bits 64 to 71 must be zero", prefix)
+	}
+	return ipNet, nil
+}
+
+// embedIPv4 returns the IPv6 address of ip embedded in prefix, skipping bits 64 to 71, see RFC 6052 section 2.2.
+func embedIPv4(prefix *net.IPNet, ip net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	embedded := make(net.IP, net.IPv6len)
+	copy(embedded, prefix.IP)
+	i := ones / 8
+	for _, b := range ip.To4() {
+		if i == 8 {
+			i++
+		}
+		embedded[i] = b
+		i++
+	}
+	return embedded
+}
+
+// hasAAAA reports whether reply has an AAAA answer which isn't an IPv4-mapped address, which is excluded by DNS64.
+func hasAAAA(reply *dns.Msg) bool {
+	for _, rr := range reply.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && aaaa.AAAA.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// dns64 synthesizes AAAA answers of req from the A answers of its name, which are judged like any other reply,
+// if rep, the judged reply to req, has none, see RFC 6147. It returns rep if there is nothing to synthesize.
+func (s *Server) dns64(ctx context.Context, o *serverOptions, req *dns.Msg, rep *upstreamReply, logger Logger, trace *span, ex *explainer) *upstreamReply {
+	// validating resolvers which set the CD bit synthesize answers themselves.
+	if req.CheckingDisabled {
+		return rep
+	}
+	if err := rep.unpackAll(); err != nil || rep.Rcode != dns.RcodeSuccess || hasAAAA(rep.Msg) {
+		return rep
+	}
+	// the TTL of synthesized answers is no longer than that of the negative answer, which is the SOA minimum.
+	negativeTTL := ^uint32(0)
+	for _, rr := range rep.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			negativeTTL = soa.Minttl
+			if soa.Hdr.Ttl < negativeTTL {
+				negativeTTL = soa.Hdr.Ttl
+			}
+		}
+	}
+
+	areq := req.Copy()
+	areq.Question[0].Qtype = dns.TypeA
+	arep, err := s.resolveLimited(ctx, o, areq, logger, trace, ex)
+	if err != nil || arep == nil || arep.unpackAll() != nil || arep.Rcode != dns.RcodeSuccess {
+		return rep
+	}
+	var answer []dns.RR
+	synthesized := false
+	for _, rr := range arep.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			answer = append(answer, rr)
+		case *dns.A:
+			hdr := rr.Hdr
+			hdr.Rrtype, hdr.Rdlength = dns.TypeAAAA, 0
+			if hdr.Ttl > negativeTTL {
+				hdr.Ttl = negativeTTL
+			}
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: embedIPv4(o.DNS64, rr.A)})
+			synthesized = true
+		}
+	}
+	if !synthesized {
+		return rep
+	}
+	logger.Debug("No AAAA answer. Synthesize them from A answers by DNS64.")
+	reply := rep.Copy()
+	reply.Answer, reply.Ns = answer, nil
+	return &upstreamReply{Msg: reply, server: arep.server, reason: reasonDNS64, polluted: arep.polluted}
+}
@@ -0,0 +1,119 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEmbedIPv4(t *testing.T) {
+	// examples of RFC 6052 section 2.4.
+	ip := net.ParseIP("192.0.2.33")
+	for prefix, want := range map[string]string{
+		"2001:db8::/32":          "2001:db8:c000:221::",
+		"2001:db8:100::/40":      "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":      "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56":  "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64":  "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96":  "2001:db8:122:344::c000:221",
+		"64:ff9b::/96":           "64:ff9b::c000:221",
+		"64:ff9b:1:fffe::/96":    "64:ff9b:1:fffe::c000:221",
+		"2001:db8:122:344::1/96": "2001:db8:122:344::c000:221",
+	} {
+		ipNet, err := parseNAT64Prefix(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := embedIPv4(ipNet, ip); !got.Equal(net.ParseIP(want)) {
+			t.Errorf("embedIPv4(%s, %s) = %s, want %s", prefix, ip, got, want)
+		}
+	}
+	for _, prefix := range []string{"64:ff9b::/80", "192.0.2.0/24", "2001:db8:0:0:100::/96", "64:ff9b::"} {
+		if _, err := parseNAT64Prefix(prefix); err == nil {
+			t.Errorf("NAT64 prefix %s should fail", prefix)
+		}
+	}
+}
+
+func TestDNS64(t *testing.T) {
+	records := map[uint16]map[string][]string{
+		dns.TypeA: {
+			"v4.example.":     {"v4.example. 300 IN A 192.0.2.33", "v4.example. 300 IN A 192.0.2.34"},
+			"www.v4.example.": {"www.v4.example. 600 IN CNAME v4.example.", "v4.example. 300 IN A 192.0.2.33"},
+			"dual.example.":   {"dual.example. 300 IN A 192.0.2.1"},
+			"mapped.example.": {"mapped.example. 300 IN A 192.0.2.2"},
+		},
+		dns.TypeAAAA: {
+			"dual.example.":   {"dual.example. 300 IN AAAA 2001:db8::1"},
+			"mapped.example.": {"mapped.example. 300 IN AAAA ::ffff:192.0.2.2"},
+		},
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		q := req.Question[0]
+		for _, s := range records[q.Qtype][q.Name] {
+			rr, _ := dns.NewRR(s)
+			reply.Answer = append(reply.Answer, rr)
+		}
+		if len(reply.Answer) == 0 {
+			soa, _ := dns.NewRR("example. 3600 IN SOA ns.example. admin.example. 1 3600 600 86400 60")
+			reply.Ns = append(reply.Ns, soa)
+		}
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+pc.LocalAddr().String()),
+		WithSkipStartupTest(true), WithDNS64("64:ff9b::/96"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		cd   bool
+		want []string
+		ttl  uint32
+	}{
+		{"v4.example.", false, []string{"64:ff9b::c000:221", "64:ff9b::c000:222"}, 60},
+		{"www.v4.example.", false, []string{"64:ff9b::c000:221"}, 60},
+		{"dual.example.", false, []string{"2001:db8::1"}, 300},
+		{"mapped.example.", false, []string{"64:ff9b::c000:202"}, 300},
+		{"v4.example.", true, nil, 0},
+		{"none.example.", false, nil, 0},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, dns.TypeAAAA)
+		req.CheckingDisabled = tt.cd
+		w := new(explainWriter)
+		s.Serve(w, req)
+		if w.reply == nil {
+			t.Fatalf("No reply to %s", tt.name)
+		}
+		var got []string
+		for _, rr := range w.reply.Answer {
+			if aaaa, ok := rr.(*dns.AAAA); ok {
+				got = append(got, aaaa.AAAA.String())
+				if aaaa.Hdr.Ttl != tt.ttl {
+					t.Errorf("TTL of %s = %d, want %d", rr, aaaa.Hdr.Ttl, tt.ttl)
+				}
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("AAAA answers of %s with CD %v = %v, want %v", tt.name, tt.cd, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if !net.ParseIP(got[i]).Equal(net.ParseIP(tt.want[i])) {
+				t.Errorf("AAAA answers of %s with CD %v = %v, want %v", tt.name, tt.cd, got, tt.want)
+				break
+			}
+		}
+	}
+}
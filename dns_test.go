@@ -0,0 +1,303 @@
+package gochinadns
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startSlowUpstream serves A queries over UDP with answer 1.2.3.4 after 200ms, counting queries in queries,
+// and returns its address.
+func startSlowUpstream(t *testing.T, queries *int32) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		time.Sleep(200 * time.Millisecond)
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+		reply.Answer = append(reply.Answer, rr)
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestCoalescing(t *testing.T) {
+	var queries int32
+	addr := startSlowUpstream(t, &queries)
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr),
+		WithDelay(time.Second), WithTestDomains(), WithCoalescing(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"example.com.", "EXAMPLE.com.", "example.COM."}
+	writers := make([]*explainWriter, 10)
+	var wg sync.WaitGroup
+	for i := range writers {
+		writers[i] = &explainWriter{}
+		req := new(dns.Msg)
+		req.SetQuestion(names[i%len(names)], dns.TypeA)
+		req.Id = uint16(i + 1)
+		wg.Add(1)
+		go func(w *explainWriter, req *dns.Msg) {
+			defer wg.Done()
+			s.Serve(w, req)
+		}(writers[i], req)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("%d queries sent upstream, want 1", n)
+	}
+	for i, w := range writers {
+		if w.reply == nil || len(w.reply.Answer) != 1 {
+			t.Fatalf("query %d is answered with %v", i, w.reply)
+		}
+		if w.reply.Id != uint16(i+1) || w.reply.Question[0].Name != names[i%len(names)] {
+			t.Errorf("query %d is answered with ID %d and question %s", i, w.reply.Id, w.reply.Question[0].Name)
+		}
+	}
+
+	// queries of another type are resolved separately.
+	if flightKey(new(dns.Msg).SetQuestion("example.com.", dns.TypeA)) == flightKey(new(dns.Msg).SetQuestion("example.com.", dns.TypeAAAA)) {
+		t.Error("queries of A and AAAA share a flight")
+	}
+}
+
+func TestShareMsg(t *testing.T) {
+	reply := benchmarkReply()
+	reply.SetEdns0(dns.DefaultMsgSize, true)
+	id := reply.Id
+	opt := reply.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(1, 2, 3, 0)})
+
+	// copies are modified and packed concurrently, as replies of coalesced queries are.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			c := shareMsg(reply)
+			c.Id = id
+			c.Question[0].Name = "WWW.example.com."
+			c.Rcode = dns.RcodeNameError
+			c.Answer = append(c.Answer, c.Answer[0])
+			stripECS(c.IsEdns0())
+			if _, err := c.Pack(); err != nil {
+				t.Error(err)
+			}
+		}(uint16(i))
+	}
+	wg.Wait()
+
+	if reply.Id != id || reply.Question[0].Name != "www.example.com." || reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 4 {
+		t.Errorf("original is modified by its copies: %v", reply)
+	}
+	if len(opt.Option) != 1 {
+		t.Errorf("ECS option of the original is stripped by its copies")
+	}
+}
+
+func BenchmarkShareMsg(b *testing.B) {
+	reply := benchmarkReply()
+	reply.SetEdns0(dns.DefaultMsgSize, false)
+	b.Run("Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reply.Copy()
+		}
+	})
+	b.Run("Share", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			shareMsg(reply)
+		}
+	})
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	var queries int32
+	addr := startSlowUpstream(t, &queries)
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr), WithTimeout(time.Second),
+		WithDelay(time.Second), WithTestDomains(), WithMaxConcurrency(1, 0, OverloadServfail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan *queryResult, 2)
+	writers := []*explainWriter{{}, {}}
+	for i, name := range []string{"a.example.", "b.example."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		go func(w *explainWriter, req *dns.Msg) { results <- s.serve(context.Background(), w, req, nil) }(writers[i], req)
+	}
+	paths := map[string]int{}
+	for i := 0; i < 2; i++ {
+		paths[(<-results).path]++
+	}
+	if paths[pathTrusted] != 1 || paths[pathOverload] != 1 {
+		t.Errorf("queries are answered by paths %v, want one trusted and one overload", paths)
+	}
+	if st := s.Stats(); st.Overloaded != 1 {
+		t.Errorf("Stats().Overloaded = %d, want 1", st.Overloaded)
+	}
+	for _, w := range writers {
+		if w.reply.Rcode == dns.RcodeServerFailure {
+			return
+		}
+	}
+	t.Error("no query is answered with SERVFAIL")
+}
+
+func BenchmarkServe(b *testing.B) {
+	clean, other := startTestUpstream(b, "1.2.3.4"), startTestUpstream(b, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+clean, "udp@"+other),
+		WithDelay(time.Second), WithTimeout(time.Second), WithSkipStartupTest(true))
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := new(discardWriter)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		s.Serve(w, req)
+	}
+}
+
+// BenchmarkServeVerdict benchmarks queries answered by an untrusted server with an IP in China, which the verdict
+// checks against the China route list and the IP blacklist.
+func BenchmarkServeVerdict(b *testing.B) {
+	trusted, untrusted := startTestUpstream(b, "8.8.8.8"), startTestUpstream(b, "1.2.3.4")
+	f, err := ioutil.TempFile("", "china-*.list")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("127.0.0.0/8\n1.2.3.0/24\n")
+	f.Close()
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithCHNList(f.Name()), WithTrustedResolvers("udp@"+trusted),
+		WithResolvers("udp@"+untrusted), WithBidirectional(true), WithTimeout(time.Second), WithSkipStartupTest(true))
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := new(discardWriter)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		s.Serve(w, req)
+	}
+}
+
+func TestResolverTimeout(t *testing.T) {
+	var queries int32
+	addr := startSlowUpstream(t, &queries)
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr+"?timeout=50ms"),
+		WithTimeout(time.Second), WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	if _, _, err := s.LookupMutated(context.Background(), req, s.options().TrustedServers[0]); err == nil {
+		t.Error("lookup of a slow resolver is answered within its own timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("lookup takes %s, want about the timeout of the resolver", elapsed)
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	var queries int32
+	addr := startSlowUpstream(t, &queries)
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr), WithRetry(2, 0, 0),
+		WithTimeout(time.Second), WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if result := s.serve(ctx, new(explainWriter), req, nil); result.path != pathNone {
+		t.Errorf("path = %s, want %s", result.path, pathNone)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("query takes %s after its context is done", elapsed)
+	}
+	for _, st := range s.Stats().Upstreams {
+		if st.Samples != 0 {
+			t.Errorf("lookups given up are counted: %+v", st)
+		}
+	}
+
+	// queries in flight are given up once the server shuts down.
+	done := make(chan struct{})
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		s.ServeDNS(new(explainWriter), req)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.cancelQueries()
+	select {
+	case <-done:
+	case <-time.After(150 * time.Millisecond):
+		t.Error("query in flight is not given up")
+	}
+}
+
+func TestSuspectEmpty(t *testing.T) {
+	var queries int32
+	trusted := startSlowUpstream(t, &queries)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	untrusted := pc.LocalAddr().String()
+
+	for _, suspect := range []bool{false, true} {
+		s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithCHNListSource(DataList([]byte("127.0.0.0/8\n"))),
+			WithTrustedResolvers("udp@"+trusted), WithResolvers("udp@"+untrusted), WithSuspectEmpty(suspect),
+			WithTimeout(time.Second), WithSkipStartupTest(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		w := new(explainWriter)
+		s.serve(s.ctx, w, req, nil)
+		ips := answerIPs(w.reply)
+		switch {
+		case suspect && (len(ips) != 1 || ips[0].String() != "1.2.3.4"):
+			t.Errorf("Answers with suspect empty replies = %v, want the trusted 1.2.3.4", ips)
+		case !suspect && len(ips) != 0:
+			t.Errorf("Answers = %v, want the empty untrusted reply", ips)
+		}
+	}
+}
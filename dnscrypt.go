@@ -0,0 +1,178 @@
+package gochinadns
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// WithForwardingRules applies forwarding-rules.txt of dnscrypt-proxy at path, of lines like
+//
+//	example.com 9.9.9.9,8.8.8.8:53,[2620:fe::fe]:53
+//
+// so that queries of the domain and its subdomains are forwarded to the servers without verdicts, like server= lines
+// of dnsmasq conf. Routes of the longest domain matching a name apply. Servers of $BOOTSTRAP and $DHCP are not
+// supported, and their lines are skipped with a warning. The file is watched like lists.
+func WithForwardingRules(path string) ServerOption {
+	return func(o *serverOptions) error {
+		return o.applyRules(path, "forwarding rules", func(pattern, value string) (bool, error) {
+			domain := strings.TrimPrefix(pattern, "*.")
+			if strings.ContainsAny(domain, "*=") {
+				return false, nil
+			}
+			var resolvers resolverArray
+			for _, server := range strings.Split(value, ",") {
+				server = strings.TrimSpace(server)
+				if strings.HasPrefix(server, "$") {
+					return false, nil
+				}
+				addr := server
+				if net.ParseIP(server) != nil {
+					addr = net.JoinHostPort(server, "53")
+				} else if host, _, err := net.SplitHostPort(server); err != nil || net.ParseIP(host) == nil {
+					return false, errors.Errorf("invalid server [%s]", server)
+				}
+				resolver, err := schemaToResolver(addr, o.TCPOnly)
+				if err != nil {
+					return false, err
+				}
+				resolvers = append(resolvers, resolver)
+			}
+			route := o.route(domain)
+			route.servers = append(route.servers, resolvers...)
+			return true, nil
+		})
+	}
+}
+
+// WithCloakingRules applies cloaking-rules.txt of dnscrypt-proxy at path, of lines like
+//
+//	example.com      10.1.1.1
+//	*.example.org    fd00::1
+//	=www.google.com  forcesafesearch.google.com
+//
+// so that A or AAAA queries of example.com, example.org and their subdomains are answered with the addresses,
+// and queries of only www.google.com are resolved as forcesafesearch.google.com, whose answers are renamed.
+// Lines of the same pattern add addresses. Rules of only names apply before those of domains, of which the one of
+// the longest domain matching a name applies. Other patterns, such as ads.* and *ads*, are skipped with a warning.
+// The file is watched like lists.
+func WithCloakingRules(path string) ServerOption {
+	return func(o *serverOptions) error {
+		return o.applyRules(path, "cloaking rules", func(pattern, value string) (bool, error) {
+			var key string
+			switch {
+			case strings.HasPrefix(pattern, "="):
+				key = "=" + normalizeDomain(pattern[1:])
+			case strings.HasPrefix(pattern, "*."):
+				key = normalizeDomain(pattern[2:])
+			default:
+				key = normalizeDomain(pattern)
+			}
+			if strings.Contains(key, "*") {
+				return false, nil
+			}
+			route := o.DomainRoutes[key]
+			if route == nil {
+				route = new(domainRoute)
+				o.DomainRoutes[key] = route
+			}
+			if ip := net.ParseIP(value); ip != nil {
+				if route.target != "" {
+					return false, errors.Errorf("%s is cloaked by %s already", pattern, route.target)
+				}
+				route.address = true
+				route.ips = append(route.ips, ip)
+				return true, nil
+			}
+			if _, ok := dns.IsDomainName(value); !ok {
+				return false, errors.Errorf("invalid target [%s]", value)
+			}
+			if route.address || route.target != "" {
+				return false, errors.Errorf("%s is cloaked already", pattern)
+			}
+			route.target = dns.Fqdn(strings.ToLower(value))
+			return true, nil
+		})
+	}
+}
+
+// applyRules applies rules of dnscrypt-proxy at path, of lines of a pattern and a value separated by spaces with
+// comments after #, by apply, which returns false if the rule is not supported.
+func (o *serverOptions) applyRules(path, kind string, apply func(pattern, value string) (bool, error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "fail to open %s", kind)
+	}
+	defer f.Close()
+	o.Files = uniqueAppendString(o.Files, path)
+	if o.DomainRoutes == nil {
+		o.DomainRoutes = make(domainRoutes)
+	}
+	skipped := 0
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var ok bool
+		if len(fields) != 2 {
+			err = errors.Errorf("invalid rule [%s]", strings.TrimSpace(line))
+		} else {
+			ok, err = apply(fields[0], fields[1])
+		}
+		if err != nil {
+			if err := o.fail(errors.Wrapf(err, "%s:%d", path, n)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !ok {
+			skipped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "fail to scan %s", kind)
+	}
+	if skipped > 0 {
+		o.logger(logServer).WithField("file", path).Warnf("Skip %d unsupported %s.", skipped, kind)
+	}
+	return nil
+}
+
+// resolveCloaked resolves req as the query of target, as by a cloaking rule of dnscrypt-proxy, and returns the reply
+// with answers of target of the type of req renamed to the name of req, or nil if there is none.
+func (s *Server) resolveCloaked(ctx context.Context, o *serverOptions, req *dns.Msg, target string, logger Logger, trace *span, ex *explainer) (*upstreamReply, error) {
+	treq := req.Copy()
+	treq.Question[0].Name = target
+	logger.Debugf("Cloaked. Resolve %s instead.", target)
+	rep, err := s.resolveLimited(ctx, o, treq, logger, trace, ex)
+	if rep == nil || err != nil {
+		return rep, err
+	}
+	if err := rep.unpackAll(); err != nil {
+		return nil, nil
+	}
+	reply := rep.Copy()
+	reply.Question = req.Question
+	reply.Answer = nil
+	q := req.Question[0]
+	for _, rr := range rep.Answer {
+		if rr.Header().Rrtype != q.Qtype {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		reply.Answer = append(reply.Answer, rr)
+	}
+	return &upstreamReply{Msg: reply, server: rep.server, reason: reasonCloaked, polluted: rep.polluted}, nil
+}
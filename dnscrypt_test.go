@@ -0,0 +1,117 @@
+package gochinadns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDnscryptRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnscrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	forwarder := startTestUpstream(t, "10.0.0.1")
+
+	// the upstream answers only the target of the cloaked name.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		if req.Question[0].Name == "forcesafesearch.google.com." && req.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR("forcesafesearch.google.com. 60 IN A 216.239.38.120")
+			reply.Answer = append(reply.Answer, rr)
+		} else {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+			reply.Answer = append(reply.Answer, rr)
+		}
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	forwarding := filepath.Join(dir, "forwarding-rules.txt")
+	content := fmt.Sprintf(`# forwarding rules
+fwd.test %s
+lan.test $DHCP
+`, forwarder)
+	if err := ioutil.WriteFile(forwarding, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cloaking := filepath.Join(dir, "cloaking-rules.txt")
+	content = `# cloaking rules
+ad.test         0.0.0.0
+*.v6.test       fd00::1   # comment
+=www.google.com forcesafesearch.google.com
+ads.*           127.0.0.1
+`
+	if err := ioutil.WriteFile(cloaking, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+pc.LocalAddr().String()),
+		WithSkipStartupTest(true), WithForwardingRules(forwarding), WithCloakingRules(cloaking))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		qtype  uint16
+		answer string
+		reason string
+	}{
+		{"www.fwd.test.", dns.TypeA, "10.0.0.1", reasonForwarded},
+		{"host.lan.test.", dns.TypeA, "1.2.3.4", reasonTrusted},
+		{"www.ad.test.", dns.TypeA, "0.0.0.0", reasonDomainRoute},
+		{"v6.test.", dns.TypeAAAA, "fd00::1", reasonDomainRoute},
+		{"www.google.com.", dns.TypeA, "216.239.38.120", reasonCloaked},
+		{"mail.google.com.", dns.TypeA, "1.2.3.4", reasonTrusted},
+		{"ads.example.", dns.TypeA, "1.2.3.4", reasonTrusted},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, tt.qtype)
+		result := s.serve(s.ctx, new(explainWriter), req, nil)
+		w := new(explainWriter)
+		req.SetQuestion(tt.name, tt.qtype)
+		s.Serve(w, req)
+		if w.reply == nil || w.reply.Rcode != dns.RcodeSuccess {
+			t.Fatalf("Reply to %s = %v", tt.name, w.reply)
+		}
+		var got string
+		if ips := answerIPs(w.reply); len(ips) > 0 {
+			got = ips[0].String()
+		}
+		if got != tt.answer || result.reason != tt.reason {
+			t.Errorf("Answer of %s %s = %q (%s), want %q (%s)", tt.name, dns.TypeToString[tt.qtype], got, result.reason, tt.answer, tt.reason)
+		}
+		for _, rr := range w.reply.Answer {
+			if rr.Header().Name != tt.name {
+				t.Errorf("Answer of %s = %s, want it of the name", tt.name, rr)
+			}
+		}
+	}
+	if n := s.Config().DomainRoutes; n != 4 {
+		t.Errorf("%d domain routes, want 4", n)
+	}
+
+	if err := ioutil.WriteFile(cloaking, []byte("=www.google.com 1.2.3.4\n=www.google.com forcesafesearch.google.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WithCloakingRules(cloaking)(new(serverOptions)); err == nil {
+		t.Error("Name cloaked by both an address and a name should fail")
+	}
+	if err := ioutil.WriteFile(forwarding, []byte("fwd.test dns.google\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WithForwardingRules(forwarding)(new(serverOptions)); err == nil {
+		t.Error("Server of a host name should fail")
+	}
+}
@@ -0,0 +1,295 @@
+package gochinadns
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// domainRoute is how queries of a domain and its subdomains are answered, as by server=, local= and address= lines
+// of dnsmasq conf.
+type domainRoute struct {
+	servers resolverArray //resolvers queries are forwarded to without verdicts, as by server=/domain/ip
+	ips     []net.IP      //answers of address=/domain/ip
+	address bool          //answered with ips, or NXDOMAIN if there are none, whether there are servers or not
+	usual   bool          //resolved as usual, as by server=/domain/#, despite the route of a parent domain
+	target  string        //name resolved instead, whose answers are renamed, as by cloaking rules of dnscrypt-proxy
+}
+
+// domainRoutes are routes by normalized domain, of which the one of the longest domain matching a name applies.
+// Routes of only the name itself, as by =name of cloaking rules, are keyed by = and the name, and apply first.
+type domainRoutes map[string]*domainRoute
+
+// match returns the route of the longest domain containing name, or nil if there is none or it's resolved as usual.
+func (r domainRoutes) match(name string) *domainRoute {
+	if len(r) == 0 {
+		return nil
+	}
+	name = normalizeDomain(name)
+	if route, ok := r["="+name]; ok {
+		return route
+	}
+	for {
+		if route, ok := r[name]; ok {
+			if route.usual {
+				return nil
+			}
+			return route
+		}
+		idx := strings.IndexByte(name, '.')
+		if idx < 0 {
+			return nil
+		}
+		name = name[idx+1:]
+	}
+}
+
+// local reports whether queries are answered by the route itself rather than forwarded or resolved.
+func (route *domainRoute) local() bool {
+	return route.address || len(route.servers) == 0 && route.target == ""
+}
+
+// reply returns the local answer to req: A or AAAA answers of address= lines of its type, or NXDOMAIN if there are
+// none of any type, as local= lines are answered without local data.
+func (route *domainRoute) reply(req *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	if len(route.ips) == 0 {
+		reply.Rcode = dns.RcodeNameError
+		return reply
+	}
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET}
+	for _, ip := range route.ips {
+		switch ip4 := ip.To4(); {
+		case q.Qtype == dns.TypeA && ip4 != nil:
+			reply.Answer = append(reply.Answer, &dns.A{Hdr: hdr, A: ip4})
+		case q.Qtype == dns.TypeAAAA && ip4 == nil:
+			reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return reply
+}
+
+// forward resolves req by the servers of route like resolveLimited, and returns the first reply as it is, or nil
+// if there is none.
+func (s *Server) forward(ctx context.Context, o *serverOptions, req *dns.Msg, route *domainRoute, logger Logger, trace *span, ex *explainer) (*upstreamReply, error) {
+	if !s.limiter.acquire(o.Timeout) {
+		return nil, errOverloaded
+	}
+	defer s.limiter.release()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	replies := make(chan *upstreamReply, 1)
+	lookup := lookupMsg(req, ex.lookup(traceLookup(trace, s.LookupMutated)))
+	go lookupInServers(ctx, cancel, logger, replies, s.dispatch(o, route.servers), o.Delay, lookup)
+	rep := awaitReply(ctx, replies)
+	if rep != nil {
+		rep.reason = reasonForwarded
+	}
+	return rep, nil
+}
+
+// WithDnsmasqConf applies dnsmasq conf at path, such as rule files of OpenWrt, so that they are consumed as they are:
+//
+//	server=/a.com/b.com/8.8.8.8#53  queries of the domains are forwarded to the server without verdicts
+//	server=/a.com/#                 queries of the domain are resolved as usual despite routes of parent domains
+//	local=/a.com/, server=/a.com/   queries of the domain are answered NXDOMAIN
+//	address=/a.com/1.2.3.4          A or AAAA queries of the domain are answered with the address, # for 0.0.0.0 and ::,
+//	                                or NXDOMAIN if the address is empty
+//	server=8.8.8.8#53               the resolver is added like WithResolvers
+//	bogus-nxdomain=1.2.3.4          answers of only bogus addresses, or networks, are replaced by NXDOMAIN
+//	no-resolv                       accepted, since resolv.conf is never read
+//
+// Routes of the longest domain matching a name apply. Other options are skipped with a warning.
+// The file is watched like lists.
+func WithDnsmasqConf(path string) ServerOption {
+	return func(o *serverOptions) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "fail to open dnsmasq conf")
+		}
+		defer f.Close()
+		o.Files = uniqueAppendString(o.Files, path)
+		if o.DomainRoutes == nil {
+			o.DomainRoutes = make(domainRoutes)
+		}
+		skipped := make(map[string]bool)
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			key, value := line, ""
+			if idx := strings.IndexByte(line, '='); idx >= 0 {
+				key, value = strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])
+			}
+			var err error
+			switch key {
+			case "server", "local":
+				err = o.addDnsmasqServer(value)
+			case "address":
+				err = o.addDnsmasqAddress(value)
+			case "bogus-nxdomain":
+				err = o.addBogusNXDomain(value)
+			case "no-resolv":
+			default:
+				skipped[key] = true
+			}
+			if err != nil {
+				if err := o.fail(errors.Wrapf(err, "%s:%d: %s", path, n, key)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return errors.Wrap(err, "fail to scan dnsmasq conf")
+		}
+		if len(skipped) > 0 {
+			keys := make([]string, 0, len(skipped))
+			for key := range skipped {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			o.logger(logServer).WithField("file", path).Warnf("Skip unsupported dnsmasq options: %s.", strings.Join(keys, ", "))
+		}
+		return nil
+	}
+}
+
+// splitDnsmasqDomains splits value of format /a.com/b.com/rest into its domains and the rest, or returns false
+// if it has no domains.
+func splitDnsmasqDomains(value string) ([]string, string, bool) {
+	if !strings.HasPrefix(value, "/") {
+		return nil, value, false
+	}
+	fields := strings.Split(value[1:], "/")
+	if len(fields) < 2 {
+		return nil, "", false
+	}
+	return fields[:len(fields)-1], fields[len(fields)-1], true
+}
+
+// route returns the route of domain, which is added if there is none.
+func (o *serverOptions) route(domain string) *domainRoute {
+	domain = normalizeDomain(domain)
+	route := o.DomainRoutes[domain]
+	if route == nil {
+		route = new(domainRoute)
+		o.DomainRoutes[domain] = route
+	}
+	return route
+}
+
+// addDnsmasqServer applies the value of a server= or local= line.
+func (o *serverOptions) addDnsmasqServer(value string) error {
+	domains, server, ok := splitDnsmasqDomains(value)
+	if !ok && (strings.HasPrefix(value, "/") || server == "" || server == "#") {
+		return errors.Errorf("invalid server [%s]", value)
+	}
+	// the source address or interface after @ is not supported.
+	if idx := strings.IndexByte(server, '@'); idx >= 0 {
+		server = server[:idx]
+	}
+	var resolver Resolver
+	if server != "" && server != "#" {
+		host, port := server, "53"
+		if idx := strings.IndexByte(server, '#'); idx >= 0 {
+			host, port = server[:idx], server[idx+1:]
+		}
+		if net.ParseIP(host) == nil {
+			return errors.Errorf("invalid server [%s]", server)
+		}
+		var err error
+		if resolver, err = schemaToResolver(net.JoinHostPort(host, port), o.TCPOnly); err != nil {
+			return err
+		}
+	}
+	if !ok {
+		return o.addResolvers([]string{resolver.GetAddr()}, false)
+	}
+	for _, domain := range domains {
+		route := o.route(domain)
+		switch server {
+		case "#":
+			route.usual = true
+		case "":
+		default:
+			route.servers = append(route.servers, resolver)
+		}
+	}
+	return nil
+}
+
+// addDnsmasqAddress applies the value of an address= line.
+func (o *serverOptions) addDnsmasqAddress(value string) error {
+	domains, address, ok := splitDnsmasqDomains(value)
+	if !ok {
+		return errors.Errorf("invalid address [%s]", value)
+	}
+	var ips []net.IP
+	switch address {
+	case "":
+	case "#":
+		ips = []net.IP{net.IPv4zero, net.IPv6zero}
+	default:
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return errors.Errorf("invalid address [%s]", address)
+		}
+		ips = []net.IP{ip}
+	}
+	for _, domain := range domains {
+		route := o.route(domain)
+		route.address = true
+		route.ips = append(route.ips, ips...)
+	}
+	return nil
+}
+
+// addBogusNXDomain adds an address or network of a bogus-nxdomain= line to BogusNXDomain.
+func (o *serverOptions) addBogusNXDomain(value string) error {
+	network := parseCIDR(value)
+	if network == nil {
+		return errors.Errorf("invalid bogus address [%s]", value)
+	}
+	if o.BogusNXDomain == nil {
+		o.BogusNXDomain = newCIDRSet()
+	}
+	o.BogusNXDomain.Insert(network)
+	o.BogusNXDomain.compact()
+	return nil
+}
+
+// isBogusNXDomain reports whether reply is NOERROR with addresses, all of which are bogus, see WithBogusNXDomain.
+func isBogusNXDomain(bogus *cidrSet, reply *dns.Msg) bool {
+	if reply.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	ips := answerIPs(reply)
+	for _, ip := range ips {
+		if ok, _ := bogus.Contains(ip); !ok {
+			return false
+		}
+	}
+	return len(ips) > 0
+}
+
+// bogusNXDomain replaces rep with NXDOMAIN if its addresses are all bogus, as ISPs redirect names which don't exist
+// to their search portals. It returns rep otherwise.
+func bogusNXDomain(bogus *cidrSet, rep *upstreamReply, logger Logger) *upstreamReply {
+	if err := rep.unpackAll(); err != nil || !isBogusNXDomain(bogus, rep.Msg) {
+		return rep
+	}
+	logger.Debug("Answer has only bogus addresses. Answer NXDOMAIN.")
+	reply := rep.Copy()
+	reply.Rcode, reply.Answer, reply.Ns = dns.RcodeNameError, nil, nil
+	return &upstreamReply{Msg: reply, server: rep.server, reason: reasonBogusNXDomain}
+}
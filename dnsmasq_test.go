@@ -0,0 +1,138 @@
+package gochinadns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDnsmasqConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream, forwarder := startTestUpstream(t, "1.2.3.4"), startTestUpstream(t, "10.0.0.1")
+	host, port, _ := net.SplitHostPort(forwarder)
+	conf := filepath.Join(dir, "dnsmasq.conf")
+	content := fmt.Sprintf(`# rules
+no-resolv
+cache-size=1000
+server=/fwd.test/%s#%s
+server=/usual.fwd.test/#
+local=/lan.test/
+address=/ad.test/0.0.0.0
+address=/v6.test/::1
+`, host, port)
+	if err := ioutil.WriteFile(conf, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+upstream),
+		WithSkipStartupTest(true), WithDnsmasqConf(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"www.fwd.test.", dns.TypeA, dns.RcodeSuccess, "10.0.0.1"},
+		{"www.usual.fwd.test.", dns.TypeA, dns.RcodeSuccess, "1.2.3.4"},
+		{"host.lan.test.", dns.TypeA, dns.RcodeNameError, ""},
+		{"ad.test.", dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{"ad.test.", dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{"www.v6.test.", dns.TypeAAAA, dns.RcodeSuccess, "::1"},
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, "1.2.3.4"},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, tt.qtype)
+		w := new(explainWriter)
+		s.Serve(w, req)
+		if w.reply == nil {
+			t.Fatalf("No reply to %s", tt.name)
+		}
+		if w.reply.Rcode != tt.rcode {
+			t.Errorf("Rcode of %s = %s, want %s", tt.name, dns.RcodeToString[w.reply.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		var got string
+		if ips := answerIPs(w.reply); len(ips) > 0 {
+			got = ips[0].String()
+		}
+		if got != tt.answer {
+			t.Errorf("Answer of %s %s = %q, want %q", tt.name, dns.TypeToString[tt.qtype], got, tt.answer)
+		}
+	}
+	if n := s.Config().DomainRoutes; n != 5 {
+		t.Errorf("%d domain routes, want 5", n)
+	}
+
+	bogus := filepath.Join(dir, "bogus.conf")
+	if err := ioutil.WriteFile(bogus, []byte("bogus-nxdomain=1.2.3.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+upstream),
+		WithSkipStartupTest(true), WithDnsmasqConf(bogus))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("nonexistent.example.", dns.TypeA)
+	w := new(explainWriter)
+	s.Serve(w, req)
+	if w.reply == nil || w.reply.Rcode != dns.RcodeNameError || len(w.reply.Answer) != 0 {
+		t.Errorf("Reply of bogus answer = %v, want NXDOMAIN", w.reply)
+	}
+
+	for _, line := range []string{"server=/a.com", "address=1.2.3.4", "server=/a.com/example", "bogus-nxdomain=x"} {
+		if err := ioutil.WriteFile(conf, []byte(line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := WithDnsmasqConf(conf)(new(serverOptions)); err == nil {
+			t.Errorf("dnsmasq line %s should fail", line)
+		}
+	}
+}
+
+func TestBogusNXDomain(t *testing.T) {
+	f, err := ioutil.TempFile("", "bogus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("1.2.3.4\n10.0.0.0/8\n")
+	f.Close()
+	for _, tt := range []struct {
+		upstream string
+		rcode    int
+	}{
+		{"1.2.3.4", dns.RcodeNameError},
+		{"10.1.1.1", dns.RcodeNameError},
+		{"1.2.3.5", dns.RcodeSuccess},
+	} {
+		s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+startTestUpstream(t, tt.upstream)),
+			WithSkipStartupTest(true), WithBogusNXDomain(f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("nonexistent.example.", dns.TypeA)
+		w := new(explainWriter)
+		s.Serve(w, req)
+		if w.reply == nil || w.reply.Rcode != tt.rcode {
+			t.Errorf("Reply of answer %s = %v, want %s", tt.upstream, w.reply, dns.RcodeToString[tt.rcode])
+		}
+		if n := s.Config().Lists.BogusNXDomain; n != 2 {
+			t.Errorf("%d entries of bogus NXDOMAIN list, want 2", n)
+		}
+		if learned := s.LearnedPolluted(); len(learned) != 0 {
+			t.Errorf("Learned polluted domains = %v, want none", learned)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package gochinadns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// dnstap: https://dnstap.info
+// Frame Streams: https://github.com/farsightsec/fstrm
+
+// Types of dnstap messages.
+const (
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// Control frame types and fields of Frame Streams.
+const (
+	fstrmAccept = 1
+	fstrmStart  = 2
+	fstrmStop   = 3
+	fstrmReady  = 4
+	fstrmFinish = 5
+
+	fstrmFieldContentType = 1
+	fstrmContentType      = "protobuf:dnstap.Dnstap"
+)
+
+// _dnstapQueue is the max number of pending dnstap frames. Frames are dropped when the queue is full.
+const _dnstapQueue = 1024
+
+// dnstapMessage is a dnstap.Message.
+type dnstapMessage struct {
+	typ          int
+	tcp          bool
+	queryAddr    net.Addr
+	responseAddr net.Addr
+	queryTime    time.Time
+	responseTime time.Time
+	query        *dns.Msg
+	response     *dns.Msg
+}
+
+// dnstapWriter sends dnstap frames to a Frame Streams unix socket reader (such as fstrm_capture or dnstap -u).
+type dnstapWriter struct {
+	log      Logger
+	path     string
+	identity []byte
+	version  []byte
+	queue    chan []byte
+}
+
+func newDnstapWriter(path string, log Logger) *dnstapWriter {
+	hostname, _ := os.Hostname()
+	t := &dnstapWriter{
+		log:      log,
+		path:     path,
+		identity: []byte(hostname),
+		version:  []byte(GetVersion()),
+		queue:    make(chan []byte, _dnstapQueue),
+	}
+	go t.run()
+	return t
+}
+
+// Send queues a message to be sent. It does nothing if t is nil.
+func (t *dnstapWriter) Send(m *dnstapMessage) {
+	if t == nil {
+		return
+	}
+	frame, err := m.marshal(t.identity, t.version)
+	if err != nil {
+		t.log.WithError(err).Debug("Fail to marshal dnstap message.")
+		return
+	}
+	select {
+	case t.queue <- frame:
+	default:
+	}
+}
+
+func (t *dnstapWriter) run() {
+	minGap, maxGap := time.Second, time.Minute
+	gap := minGap
+	for {
+		if err := t.serve(); err != nil {
+			t.log.WithError(err).WithField("dnstap", t.path).Warn("dnstap connection failed.")
+		} else {
+			gap = minGap
+		}
+		time.Sleep(gap)
+		if gap *= 2; gap > maxGap {
+			gap = maxGap
+		}
+	}
+}
+
+// serve connects to the reader, does the bidirectional handshake and writes frames until an error occurs.
+func (t *dnstapWriter) serve() error {
+	conn, err := net.Dial("unix", t.path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := writeControlFrame(conn, fstrmReady, fstrmContentType); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	typ, err := readControlFrame(conn)
+	if err != nil {
+		return errors.Wrap(err, "fail to read ACCEPT frame")
+	}
+	if typ != fstrmAccept {
+		return errors.Errorf("unexpected control frame %d", typ)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if err := writeControlFrame(conn, fstrmStart, fstrmContentType); err != nil {
+		return err
+	}
+	t.log.WithField("dnstap", t.path).Info("dnstap connected.")
+
+	w := bufio.NewWriter(conn)
+	for frame := range t.queue {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(frame)))
+		w.Write(size[:])
+		w.Write(frame)
+		// flush if there are no more pending frames.
+		if len(t.queue) == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeControlFrame(w io.Writer, typ uint32, contentType string) error {
+	var payload []byte
+	payload = appendUint32(payload, typ)
+	if typ == fstrmReady || typ == fstrmStart || typ == fstrmAccept {
+		payload = appendUint32(payload, fstrmFieldContentType)
+		payload = appendUint32(payload, uint32(len(contentType)))
+		payload = append(payload, contentType...)
+	}
+	frame := appendUint32(nil, 0) // escape
+	frame = appendUint32(frame, uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+func readControlFrame(r io.Reader) (typ uint32, err error) {
+	var header [8]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return 0, errors.New("not a control frame")
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[4:]))
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if len(payload) < 4 {
+		return 0, errors.New("short control frame")
+	}
+	return binary.BigEndian.Uint32(payload[:4]), nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// tapClientQuery sends a CLIENT_QUERY message if dnstap is enabled.
+func (s *Server) tapClientQuery(w dns.ResponseWriter, req *dns.Msg, t time.Time) {
+	if s.dnstap == nil {
+		return
+	}
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+	s.dnstap.Send(&dnstapMessage{
+		typ:          dnstapClientQuery,
+		tcp:          tcp,
+		queryAddr:    w.RemoteAddr(),
+		responseAddr: w.LocalAddr(),
+		queryTime:    t,
+		query:        req,
+	})
+}
+
+// tapClientResponse sends a CLIENT_RESPONSE message if dnstap is enabled.
+func (s *Server) tapClientResponse(w dns.ResponseWriter, reply *dns.Msg, t time.Time) {
+	if s.dnstap == nil {
+		return
+	}
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+	s.dnstap.Send(&dnstapMessage{
+		typ:          dnstapClientResponse,
+		tcp:          tcp,
+		queryAddr:    w.RemoteAddr(),
+		responseAddr: w.LocalAddr(),
+		queryTime:    t,
+		responseTime: time.Now(),
+		response:     reply,
+	})
+}
+
+// tapForwarder sends a FORWARDER_QUERY message, or a FORWARDER_RESPONSE message if reply is not nil, if dnstap is enabled.
+func (s *Server) tapForwarder(server Resolver, req, reply *dns.Msg, t time.Time) {
+	if s.dnstap == nil {
+		return
+	}
+	m := &dnstapMessage{
+		typ:       dnstapForwarderQuery,
+		tcp:       len(server.GetProtocols()) > 0 && server.GetProtocols()[0] == "tcp",
+		queryTime: t,
+		query:     req,
+	}
+	if host, port, err := net.SplitHostPort(server.GetAddr()); err == nil {
+		p, _ := strconv.Atoi(port)
+		m.responseAddr = &net.UDPAddr{IP: net.ParseIP(host), Port: p}
+	}
+	if reply != nil {
+		m.typ = dnstapForwarderResponse
+		m.responseTime = time.Now()
+		m.response = reply
+	}
+	s.dnstap.Send(m)
+}
+
+// marshal encodes the message as a dnstap.Dnstap protobuf.
+func (m *dnstapMessage) marshal(identity, version []byte) ([]byte, error) {
+	var msg []byte
+	msg = appendVarintField(msg, 1, uint64(m.typ))
+
+	addr := m.queryAddr
+	if addr == nil {
+		addr = m.responseAddr
+	}
+	if ip, _ := addrIPPort(addr); ip != nil {
+		family := uint64(1)
+		if ip.To4() == nil {
+			family = 2
+		}
+		msg = appendVarintField(msg, 2, family)
+	}
+	protocol := uint64(1)
+	if m.tcp {
+		protocol = 2
+	}
+	msg = appendVarintField(msg, 3, protocol)
+	if ip, port := addrIPPort(m.queryAddr); ip != nil {
+		msg = appendBytesField(msg, 4, ipBytes(ip))
+		msg = appendVarintField(msg, 6, uint64(port))
+	}
+	if ip, port := addrIPPort(m.responseAddr); ip != nil {
+		msg = appendBytesField(msg, 5, ipBytes(ip))
+		msg = appendVarintField(msg, 7, uint64(port))
+	}
+	if !m.queryTime.IsZero() {
+		msg = appendVarintField(msg, 8, uint64(m.queryTime.Unix()))
+		msg = appendFixed32Field(msg, 9, uint32(m.queryTime.Nanosecond()))
+	}
+	if m.query != nil {
+		buf, err := m.query.Pack()
+		if err != nil {
+			return nil, err
+		}
+		msg = appendBytesField(msg, 10, buf)
+	}
+	if !m.responseTime.IsZero() {
+		msg = appendVarintField(msg, 12, uint64(m.responseTime.Unix()))
+		msg = appendFixed32Field(msg, 13, uint32(m.responseTime.Nanosecond()))
+	}
+	if m.response != nil {
+		buf, err := m.response.Pack()
+		if err != nil {
+			return nil, err
+		}
+		msg = appendBytesField(msg, 14, buf)
+	}
+
+	var frame []byte
+	frame = appendBytesField(frame, 1, identity)
+	frame = appendBytesField(frame, 2, version)
+	frame = appendBytesField(frame, 14, msg)
+	frame = appendVarintField(frame, 15, 1) // type: MESSAGE
+	return frame, nil
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *udpSession:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+func ipBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// Protocol buffers encoding: https://developers.google.com/protocol-buffers/docs/encoding
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3)
+	return appendVarint(b, v)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = appendVarint(b, uint64(field)<<3|5)
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|2)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
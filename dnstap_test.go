@@ -0,0 +1,73 @@
+package gochinadns
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestDnstapWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnstap.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	w := newDnstapWriter(path, NewLogrusLogger(logrus.StandardLogger()))
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if typ, err := readControlFrame(conn); err != nil || typ != fstrmReady {
+		t.Fatalf("expect READY frame, got %d %v", typ, err)
+	}
+	if err := writeControlFrame(conn, fstrmAccept, fstrmContentType); err != nil {
+		t.Fatal(err)
+	}
+	if typ, err := readControlFrame(conn); err != nil || typ != fstrmStart {
+		t.Fatalf("expect START frame, got %d %v", typ, err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w.Send(&dnstapMessage{
+		typ:       dnstapClientQuery,
+		queryAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353},
+		queryTime: time.Now(),
+		query:     req,
+	})
+
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		t.Fatal(err)
+	}
+	// field 1 (identity), wire type 2
+	if len(frame) == 0 || frame[0] != 0x0a {
+		t.Errorf("unexpected dnstap frame % x", frame)
+	}
+	// field 15 (type), wire type 0, value MESSAGE
+	if frame[len(frame)-2] != 15<<3 || frame[len(frame)-1] != 1 {
+		t.Errorf("dnstap frame should end with type MESSAGE, got % x", frame[len(frame)-2:])
+	}
+}
@@ -0,0 +1,80 @@
+package gochinadns
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// DomainSet is a set of domains, each of which contains its subdomains, matched as domain lists of a server are,
+// so that other programs may reuse the lists without a server. It's safe for concurrent use: lookups read
+// a snapshot without locks, while Add and Remove swap in a copy of the nodes they change.
+// The zero value is an empty set.
+type DomainSet struct {
+	mu   sync.Mutex   //serializes changes
+	trie atomic.Value //*domainTrie
+}
+
+// NewDomainSet returns a set of domains. "." contains all domains.
+func NewDomainSet(domains ...string) *DomainSet {
+	d := new(DomainSet)
+	tr := new(domainTrie)
+	for _, domain := range domains {
+		tr.Add(domain)
+	}
+	d.trie.Store(tr)
+	return d
+}
+
+// LoadDomainSet reads a set of domains from a list in format, detected if it's empty, see ReadList.
+func LoadDomainSet(r io.Reader, format string) (*DomainSet, error) {
+	domains, format, err := ReadList(r, format)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to read domain list")
+	}
+	if isCIDRList(format) {
+		return nil, errors.Errorf("invalid domain list format [%s]", format)
+	}
+	return NewDomainSet(domains...), nil
+}
+
+func (d *DomainSet) load() *domainTrie {
+	tr, _ := d.trie.Load().(*domainTrie)
+	return tr
+}
+
+// Add adds domains to the set. Subdomains of domains in the set are skipped.
+func (d *DomainSet) Add(domains ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.trie.Store(d.load().With(domains...))
+}
+
+// Remove removes domain from the set, and reports whether it's in the set. Only the domain itself is removed:
+// its parent domains in the set still contain it, and its subdomains which are in the set are kept.
+func (d *DomainSet) Remove(domain string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tr, ok := d.load().Without(domain)
+	if ok {
+		d.trie.Store(tr)
+	}
+	return ok
+}
+
+// Contain reports whether domain is in the set, or a subdomain of one in it.
+func (d *DomainSet) Contain(domain string) bool {
+	return d.load().Contain(domain)
+}
+
+// Match returns the domain in the set which contains the given domain, such as `google.com` for `www.google.com.`.
+func (d *DomainSet) Match(domain string) (string, bool) {
+	return d.load().Match(domain)
+}
+
+// Len returns the number of domains in the set.
+func (d *DomainSet) Len() int {
+	return d.load().Len()
+}
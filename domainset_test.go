@@ -0,0 +1,75 @@
+package gochinadns
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDomainSet(t *testing.T) {
+	set := NewDomainSet("google.com", "12306.cn")
+	set.Add("github.com", "www.google.com")
+	if n := set.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+	if rule, ok := set.Match("Mail.Google.com."); !ok || rule != "google.com" {
+		t.Errorf("Match() = %q, %v, want google.com", rule, ok)
+	}
+	if set.Remove("mail.google.com") {
+		t.Error("Remove() removes a subdomain which is not in the set")
+	}
+	if !set.Remove("google.com") || set.Contain("mail.google.com") || set.Len() != 2 {
+		t.Error("Remove() misses google.com")
+	}
+
+	var zero DomainSet
+	if zero.Contain("cn") || zero.Len() != 0 || zero.Remove("cn") {
+		t.Error("the zero value should be an empty set")
+	}
+	zero.Add("cn")
+	if !zero.Contain("12306.cn") {
+		t.Error("Add() of the zero value misses domains")
+	}
+}
+
+func TestDomainSetConcurrent(t *testing.T) {
+	set := NewDomainSet()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				domain := fmt.Sprintf("d%d-%d.com", i, j)
+				set.Add(domain)
+				if !set.Remove(domain) {
+					t.Errorf("Remove() misses %s", domain)
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				set.Contain("www.example.com")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := set.Len(); n != 0 {
+		t.Errorf("Len() = %d, want 0", n)
+	}
+}
+
+func TestLoadDomainSet(t *testing.T) {
+	set, err := LoadDomainSet(strings.NewReader("server=/google.com/127.0.0.1#5353\nserver=/github.com/127.0.0.1#5353\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set.Contain("www.github.com") || set.Len() != 2 {
+		t.Error("LoadDomainSet() misses dnsmasq domains")
+	}
+	if _, err := LoadDomainSet(strings.NewReader("1.0.1.0/24\n"), ""); err == nil {
+		t.Error("LoadDomainSet() should reject CIDR lists")
+	}
+}
@@ -0,0 +1,137 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// _bootstrapTimeout bounds the resolution of the hostname of a resolver.
+const _bootstrapTimeout = 5 * time.Second
+
+// _happyEyeballsDelay is how long the preferred address family of a dual-stack resolver is queried alone,
+// before the other one is raced with it, like the Connection Attempt Delay of RFC 8305.
+const _happyEyeballsDelay = 250 * time.Millisecond
+
+// bootstrap resolves the hostname of a resolver like dns.google:53 with the system resolver, into an IPv6
+// and an IPv4 address to query. Resolvers at IP addresses are left as they are.
+func (r *Resolver) bootstrap() error {
+	host, port, err := net.SplitHostPort(r.addr)
+	if err != nil || net.ParseIP(host) != nil || r.isJSON() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), _bootstrapTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return errors.Wrapf(err, "fail to resolve resolver %s", host)
+	}
+	var v6, v4 string
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			if v4 == "" {
+				v4 = net.JoinHostPort(ip.IP.String(), port)
+			}
+		} else if v6 == "" {
+			v6 = net.JoinHostPort(ip.IP.String(), port)
+		}
+	}
+	r.addrs = nil
+	for _, addr := range []string{v6, v4} {
+		if addr != "" {
+			r.addrs = append(r.addrs, addr)
+		}
+	}
+	return nil
+}
+
+// dialAddr returns the address to send queries to: the first address resolved by bootstrap, or addr.
+func (r Resolver) dialAddr() string {
+	if len(r.addrs) > 0 {
+		return r.addrs[0]
+	}
+	return r.addr
+}
+
+// isDualStack reports whether the resolver has both an IPv6 and an IPv4 address.
+func (r Resolver) isDualStack() bool {
+	return len(r.addrs) > 1
+}
+
+// at returns a copy of the resolver which is queried at addr only, and raced after _happyEyeballsDelay.
+func (r Resolver) at(addr string) Resolver {
+	r.addrs, r.delay = []string{addr}, 0
+	return r
+}
+
+// familyMemory remembers which address family of dual-stack resolvers answers last, so that it's tried first.
+type familyMemory struct {
+	mu sync.RWMutex
+	v4 map[string]bool //by address of resolver, whether IPv4 answers last
+}
+
+func newFamilyMemory() *familyMemory {
+	return &familyMemory{v4: make(map[string]bool)}
+}
+
+// order returns the addresses of a dual-stack resolver, the family which answers last first, or IPv6 if none does.
+func (m *familyMemory) order(server Resolver) (first, second string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.v4[server.GetAddr()] {
+		return server.addrs[1], server.addrs[0]
+	}
+	return server.addrs[0], server.addrs[1]
+}
+
+// answered remembers the family of addr, at which the resolver answers.
+func (m *familyMemory) answered(server Resolver, addr string) {
+	v4 := addr == server.addrs[1]
+	m.mu.Lock()
+	m.v4[server.GetAddr()] = v4
+	m.mu.Unlock()
+}
+
+// lookupDualStack looks up req like lookupMutated, at both addresses of a dual-stack resolver: the family which
+// answers last first, and the other one too if there is no reply in _happyEyeballsDelay, or it fails.
+// The first reply wins, and its family is tried first next time.
+func (s *Server) lookupDualStack(parent context.Context, req *dns.Msg, server Resolver) (*dns.Msg, time.Duration, error) {
+	first, second := s.families.order(server)
+	ctx, cancel := context.WithCancel(parent)
+	result := make(chan *upstreamReply, 1)
+	var mu sync.Mutex
+	var lastErr error
+	lookup := func(ctx context.Context, pinned Resolver) (*upstreamReply, time.Duration, error) {
+		reply, rtt, err := s.lookupMutated(ctx, shareMsg(req), pinned)
+		if err != nil {
+			mu.Lock()
+			lastErr = err
+			mu.Unlock()
+			return nil, rtt, err
+		}
+		return &upstreamReply{Msg: reply, server: pinned}, rtt, nil
+	}
+
+	t := time.Now()
+	stages := [][]Resolver{{server.at(first)}, {server.at(second)}}
+	go lookupInServers(ctx, cancel, s.upstreamLog, result, stages, _happyEyeballsDelay, lookup)
+	select {
+	case rep := <-result:
+		s.families.answered(server, rep.server.dialAddr())
+		return rep.Msg, time.Since(t), nil
+	case <-ctx.Done():
+	}
+	select {
+	case rep := <-result:
+		s.families.answered(server, rep.server.dialAddr())
+		return rep.Msg, time.Since(t), nil
+	default:
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return nil, time.Since(t), lastErr
+}
@@ -0,0 +1,62 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestBootstrap(t *testing.T) {
+	r := Resolver{addr: "localhost:5353"}
+	if err := r.bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.addrs) == 0 || r.dialAddr() == r.GetAddr() {
+		t.Errorf("localhost is resolved to %v", r.addrs)
+	}
+	r = Resolver{addr: "127.0.0.1:53"}
+	if err := r.bootstrap(); err != nil || r.addrs != nil || r.dialAddr() != "127.0.0.1:53" {
+		t.Errorf("resolver at an IP address is resolved to %v: %v", r.addrs, err)
+	}
+	r = Resolver{addr: "nonexistent.invalid:53"}
+	if err := r.bootstrap(); err == nil {
+		t.Error("bootstrap of a nonexistent host should fail")
+	}
+}
+
+func TestLookupDualStack(t *testing.T) {
+	// IPv6 is broken: the upstream never answers over it.
+	pc, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback: ", err)
+	}
+	defer pc.Close()
+	v4 := startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTimeout(time.Second), WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := Resolver{addr: "dns.example:53", addrs: []string{pc.LocalAddr().String(), v4}, protocols: []string{"udp"}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	for i, max := range []time.Duration{time.Second, 100 * time.Millisecond} {
+		start := time.Now()
+		reply, _, err := s.LookupMutated(context.Background(), req, server)
+		if err != nil || len(reply.Answer) != 1 {
+			t.Fatalf("lookup %d is answered with %v: %v", i, reply, err)
+		}
+		if elapsed := time.Since(start); elapsed > max || i == 0 && elapsed < _happyEyeballsDelay {
+			t.Errorf("lookup %d takes %s", i, elapsed)
+		}
+	}
+	if first, _ := s.families.order(server); first != v4 {
+		t.Errorf("%s is tried first, want IPv4 which answers", first)
+	}
+	if req.Question[0].Name != "example.com." {
+		t.Error("request is changed")
+	}
+}
@@ -0,0 +1,90 @@
+package gochinadns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	ecsForward = "forward"
+	ecsStrip   = "strip"
+)
+
+// ecsPolicy decides how client supplied EDNS Client Subnet options are sent to upstream servers.
+// Client Subnet in DNS Queries: https://tools.ietf.org/html/rfc7871
+type ecsPolicy struct {
+	action string            //forward, strip, or empty if subnet is set
+	subnet *dns.EDNS0_SUBNET //subnet to replace the client supplied one with
+}
+
+// parseECSPolicy parses an ECS policy, which is forward, strip or a CIDR prefix to replace client subnets with.
+func parseECSPolicy(policy string) (p ecsPolicy, err error) {
+	switch policy = strings.ToLower(strings.TrimSpace(policy)); policy {
+	case "", ecsForward:
+		p.action = ecsForward
+		return
+	case ecsStrip:
+		p.action = ecsStrip
+		return
+	}
+
+	_, network, err := net.ParseCIDR(policy)
+	if err != nil {
+		return p, errors.Wrapf(err, "invalid ECS policy [%s]", policy)
+	}
+	ones, _ := network.Mask.Size()
+	p.subnet = &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(ones),
+		Address:       network.IP,
+	}
+	if network.IP.To4() == nil {
+		p.subnet.Family = 2
+	}
+	return
+}
+
+func (p ecsPolicy) String() string {
+	if p.subnet != nil {
+		return p.subnet.String()
+	}
+	return p.action
+}
+
+// apply returns the request to be sent upstream. req is copied if it needs to be modified.
+func (p ecsPolicy) apply(req *dns.Msg) *dns.Msg {
+	if p.action == ecsForward {
+		return req
+	}
+
+	opt := req.IsEdns0()
+	if opt == nil && p.subnet == nil {
+		return req
+	}
+	req = req.Copy()
+	if opt = req.IsEdns0(); opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+	}
+	stripECS(opt)
+	if p.subnet != nil {
+		subnet := *p.subnet
+		opt.Option = append(opt.Option, &subnet)
+	}
+	return req
+}
+
+// stripECS removes all EDNS Client Subnet options from opt.
+func stripECS(opt *dns.OPT) {
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
@@ -0,0 +1,43 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestECSPolicy(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(10, 0, 0, 0)})
+
+	forward, _ := parseECSPolicy("forward")
+	if forward.apply(req) != req {
+		t.Error("forward policy should not copy the request")
+	}
+
+	strip, _ := parseECSPolicy("strip")
+	stripped := strip.apply(req)
+	if len(stripped.IsEdns0().Option) != 0 {
+		t.Error("strip policy should remove ECS options")
+	}
+	if len(req.IsEdns0().Option) != 1 {
+		t.Error("strip policy should not modify the original request")
+	}
+
+	replace, err := parseECSPolicy("114.240.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced := replace.apply(req).IsEdns0().Option
+	if len(replaced) != 1 || !replaced[0].(*dns.EDNS0_SUBNET).Address.Equal(net.IPv4(114, 240, 0, 0)) {
+		t.Errorf("replace policy should replace ECS options, got %v", replaced)
+	}
+
+	if _, err := parseECSPolicy("foo"); err == nil {
+		t.Error("foo should be an invalid ECS policy")
+	}
+}
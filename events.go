@@ -0,0 +1,136 @@
+package gochinadns
+
+import (
+	"time"
+)
+
+// States of resolvers of UpstreamStateEvent.
+const (
+	UpstreamDown          = "down"           //a health check fails over the protocol, see WithHealthCheck
+	UpstreamUp            = "up"             //a health check passes again over the protocol
+	UpstreamCircuitOpen   = "circuit-open"   //lookups fail in a row, see WithCircuitBreaker
+	UpstreamCircuitClosed = "circuit-closed" //a lookup succeeds again
+	UpstreamHijacked      = "hijacked"       //a canary check fails, see WithCanary
+	UpstreamCanaryPassed  = "canary-passed"  //a canary check passes again
+	UpstreamDisabled      = "disabled"       //disabled by the admin API
+	UpstreamEnabled       = "enabled"        //enabled again by the admin API
+
+	// States of all trusted resolvers, which are only posted by WithUpstreamWebhook without a resolver.
+	TrustedUnreachable = "trusted-unreachable" //every trusted resolver is down, hijacked, disabled or its circuit is open
+	TrustedReachable   = "trusted-reachable"   //a trusted resolver is reachable again
+)
+
+// QueryEvent is a query received from a client.
+type QueryEvent struct {
+	Time   time.Time
+	Client string
+	Name   string
+	QType  string
+}
+
+// UpstreamStateEvent is a change of the state of a resolver.
+type UpstreamStateEvent struct {
+	Time     time.Time `json:"time"`
+	Resolver string    `json:"resolver,omitempty"`
+	State    string    `json:"state"`              //UpstreamDown, UpstreamCircuitOpen, etc.
+	Protocol string    `json:"protocol,omitempty"` //protocol of UpstreamDown and UpstreamUp
+	Reason   string    `json:"reason,omitempty"`   //error of UpstreamCircuitOpen, or why the resolver is UpstreamHijacked
+}
+
+// EventHooks are callbacks of events of a server, registered by WithEventHooks. Nil callbacks are skipped.
+// They are called synchronously, some of them for every query, so they should return quickly and never block.
+// Events are shared with logs of the server, and must not be changed.
+type EventHooks struct {
+	OnQuery               func(*QueryEvent)         //a query is received, before it's rate limited
+	OnAnswer              func(*QueryLogEntry)      //a query is answered, as it's logged by the query log
+	OnBlocked             func(*AuditEntry)         //a query of the domain blacklist is blocked
+	OnPollutionDetected   func(*PollutionEvent)     //an answer is rejected as polluted
+	OnUpstreamStateChange func(*UpstreamStateEvent) //a resolver goes down or up
+}
+
+// eventHooks are callbacks of every EventHooks registered, by event. All methods are no-op on a nil *eventHooks.
+type eventHooks struct {
+	onQuery         []func(*QueryEvent)
+	onAnswer        []func(*QueryLogEntry)
+	onBlocked       []func(*AuditEntry)
+	onPollution     []func(*PollutionEvent)
+	onUpstreamState []func(*UpstreamStateEvent)
+}
+
+// newEventHooks returns callbacks of all hooks, or nil if there are none.
+func newEventHooks(hooks []EventHooks) *eventHooks {
+	if len(hooks) == 0 {
+		return nil
+	}
+	e := new(eventHooks)
+	for _, h := range hooks {
+		if h.OnQuery != nil {
+			e.onQuery = append(e.onQuery, h.OnQuery)
+		}
+		if h.OnAnswer != nil {
+			e.onAnswer = append(e.onAnswer, h.OnAnswer)
+		}
+		if h.OnBlocked != nil {
+			e.onBlocked = append(e.onBlocked, h.OnBlocked)
+		}
+		if h.OnPollutionDetected != nil {
+			e.onPollution = append(e.onPollution, h.OnPollutionDetected)
+		}
+		if h.OnUpstreamStateChange != nil {
+			e.onUpstreamState = append(e.onUpstreamState, h.OnUpstreamStateChange)
+		}
+	}
+	return e
+}
+
+// wantQuery reports whether there are callbacks of queries, so that events are not built for nothing.
+func (e *eventHooks) wantQuery() bool {
+	return e != nil && len(e.onQuery) > 0
+}
+
+func (e *eventHooks) query(event *QueryEvent) {
+	if e == nil {
+		return
+	}
+	for _, f := range e.onQuery {
+		f(event)
+	}
+}
+
+func (e *eventHooks) answer(entry *QueryLogEntry) {
+	if e == nil {
+		return
+	}
+	for _, f := range e.onAnswer {
+		f(entry)
+	}
+}
+
+func (e *eventHooks) blocked(entry *AuditEntry) {
+	if e == nil {
+		return
+	}
+	for _, f := range e.onBlocked {
+		f(entry)
+	}
+}
+
+func (e *eventHooks) pollution(event *PollutionEvent) {
+	if e == nil {
+		return
+	}
+	for _, f := range e.onPollution {
+		f(event)
+	}
+}
+
+// upstreamState reports the resolver at addr changes to state.
+func (e *eventHooks) upstreamState(addr, state, protocol, reason string) {
+	if e == nil {
+		return
+	}
+	event := &UpstreamStateEvent{Time: time.Now(), Resolver: addr, State: state, Protocol: protocol, Reason: reason}
+	for _, f := range e.onUpstreamState {
+		f(event)
+	}
+}
@@ -0,0 +1,85 @@
+package gochinadns
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+func TestEventHooks(t *testing.T) {
+	f, err := ioutil.TempFile("", "blacklist-*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("blocked.test\n")
+	f.Close()
+
+	var (
+		queries   []*QueryEvent
+		answers   []*QueryLogEntry
+		blocked   []*AuditEntry
+		pollution []*PollutionEvent
+		states    []*UpstreamStateEvent
+	)
+	addr := startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithTrustedResolvers("udp@"+addr),
+		WithDomainBlacklist(f.Name()), WithCircuitBreaker(1, time.Minute),
+		WithEventHooks(EventHooks{
+			OnQuery:               func(e *QueryEvent) { queries = append(queries, e) },
+			OnAnswer:              func(e *QueryLogEntry) { answers = append(answers, e) },
+			OnBlocked:             func(e *AuditEntry) { blocked = append(blocked, e) },
+			OnPollutionDetected:   func(e *PollutionEvent) { pollution = append(pollution, e) },
+			OnUpstreamStateChange: func(e *UpstreamStateEvent) { states = append(states, e) },
+		}),
+		// hooks of another registration are called too.
+		WithEventHooks(EventHooks{OnQuery: func(e *QueryEvent) { queries = append(queries, e) }}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"example.com.", "blocked.test."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		s.Serve(new(explainWriter), req)
+	}
+	if len(queries) != 4 || queries[0].Name != "example.com." || queries[0].QType != "A" || queries[0].Client != "127.0.0.1" {
+		t.Errorf("query events = %+v, want 2 of each query", queries)
+	}
+	if len(answers) != 2 || answers[0].Path != pathTrusted || answers[1].Path != pathBlocked {
+		t.Errorf("answer events = %+v", answers)
+	}
+	if len(blocked) != 1 || blocked[0].Domain != "blocked.test." || blocked[0].Event != auditBlocked {
+		t.Errorf("blocked events = %+v, want blocked.test.", blocked)
+	}
+
+	rep := &upstreamReply{Msg: newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 10.0.0.1"), server: Resolver{addr: addr}}
+	s.reportPollution(rep, heuristicIPBlacklist)
+	if len(pollution) != 1 || pollution[0].Heuristic != heuristicIPBlacklist || pollution[0].Resolver != addr {
+		t.Errorf("pollution events = %+v", pollution)
+	}
+
+	s.breaker.observe(Resolver{addr: addr}, errors.New("refused"))
+	s.breaker.observe(Resolver{addr: addr}, nil)
+	if err := s.DisableResolver(addr); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range states {
+		if e.Resolver != addr {
+			t.Errorf("state event of %s, want %s", e.Resolver, addr)
+		}
+		got = append(got, e.State)
+	}
+	if want := []string{UpstreamCircuitOpen, UpstreamCircuitClosed, UpstreamDisabled}; len(got) != 3 ||
+		got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("state events = %q, want %q", got, want)
+	}
+	if states[0].Reason != "refused" {
+		t.Errorf("reason of the open circuit = %q, want the error", states[0].Reason)
+	}
+}
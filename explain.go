@@ -0,0 +1,270 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// Explanation is how a query is answered, step by step. See Explain.
+type Explanation struct {
+	Question string        `json:"question"`
+	Steps    []ExplainStep `json:"steps"`
+	Path     string        `json:"path"`
+	Resolver string        `json:"resolver,omitempty"`
+	Reason   string        `json:"reason"`
+	Reply    string        `json:"reply"` //the final response in presentation format
+}
+
+// ExplainStep is a step of answering a query: a domain list match, a lookup to a resolver, its reply,
+// or a verdict on an answer.
+type ExplainStep struct {
+	Elapsed string            `json:"elapsed"` //since the query starts
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Explain sends a query of name and qtype through the same pipeline as queries of clients, and records every step,
+// starting with the cache lookup. The query is reported to metrics, stats and logs like any other, from client 127.0.0.1,
+// but its reply is not cached, so that explaining a query doesn't change what clients are answered.
+func (s *Server) Explain(name string, qtype uint16) (*Explanation, error) {
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, errors.Errorf("invalid domain name [%s]", name)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	ex := &explainer{start: time.Now()}
+	w := &explainWriter{}
+	var result *queryResult
+	if s.serveCached(w, req) {
+		ex.stepf(nil, "Reply is cached. Answer it.")
+		result = &queryResult{path: pathCache, reason: reasonCached}
+	} else {
+		if s.cache != nil {
+			ex.stepf(nil, "Reply is not cached. Resolve it.")
+		}
+		result = s.serve(s.ctx, w, req, ex)
+	}
+	if w.reply == nil {
+		return nil, errors.New("no reply is written")
+	}
+	return &Explanation{
+		Question: questionString(&req.Question[0]),
+		Steps:    ex.steps,
+		Path:     result.path,
+		Resolver: result.server,
+		Reason:   result.reason,
+		Reply:    w.reply.String(),
+	}, nil
+}
+
+// explainer records steps of a query. All methods are no-op on a nil *explainer, so other queries cost nothing.
+type explainer struct {
+	mu    sync.Mutex
+	start time.Time
+	steps []ExplainStep
+}
+
+func (e *explainer) stepf(fields map[string]interface{}, format string, args ...interface{}) {
+	if e == nil {
+		return
+	}
+	step := ExplainStep{Elapsed: time.Since(e.start).String(), Message: fmt.Sprintf(format, args...)}
+	if len(fields) > 0 {
+		step.Fields = make(map[string]string, len(fields))
+		for k, v := range fields {
+			step.Fields[k] = fmt.Sprint(v)
+		}
+	}
+	e.mu.Lock()
+	e.steps = append(e.steps, step)
+	e.mu.Unlock()
+}
+
+// matchLists records domain lists which name matches.
+func (e *explainer) matchLists(o *serverOptions, name string) {
+	if e == nil {
+		return
+	}
+	if rule, ok := o.DomainBlacklist.Match(name); ok {
+		e.stepf(nil, "Domain matches rule %s of the domain blacklist.", rule)
+	}
+	if o.DomainPolluted.Contain(name) {
+		e.stepf(nil, "Domain is in the polluted domain list. Untrusted resolvers are not queried.")
+	}
+	if o.DomainBidiExempt.Contain(name) {
+		e.stepf(nil, "Domain is exempt from bidirectional mode.")
+	}
+}
+
+// logger returns l which records its logs as steps as well.
+func (e *explainer) logger(l Logger) Logger {
+	if e == nil {
+		return l
+	}
+	return explainLogger{Logger: l, explainer: e}
+}
+
+// lookup wraps lookup to record queries to resolvers and their replies.
+func (e *explainer) lookup(lookup LookupFunc) LookupFunc {
+	if e == nil {
+		return lookup
+	}
+	return func(ctx context.Context, req *dns.Msg, server Resolver) (*dns.Msg, time.Duration, error) {
+		mutation := server.GetMutation()
+		if mutation == "" {
+			mutation = mutationNone
+		}
+		e.stepf(nil, "Query %s over %s with %s mutation.", server.GetAddr(), strings.Join(server.GetProtocols(), "+"), mutation)
+		reply, rtt, err := lookup(ctx, req, server)
+		if err != nil {
+			e.stepf(nil, "Lookup to %s fails: %v", server.GetAddr(), err)
+			return reply, rtt, err
+		}
+		answers := make([]string, 0, len(reply.Answer))
+		for _, a := range queryAnswers(reply) {
+			answers = append(answers, a.Type+" "+a.Data)
+		}
+		e.stepf(nil, "Reply from %s in %s: %s [%s]", server.GetAddr(), rtt, dns.RcodeToString[reply.Rcode], strings.Join(answers, ", "))
+		return reply, rtt, err
+	}
+}
+
+// explainLogger logs to Logger, and records every log as a step.
+type explainLogger struct {
+	Logger
+	explainer *explainer
+	fields    map[string]interface{}
+}
+
+func (l explainLogger) WithField(key string, value interface{}) Logger {
+	return l.with(l.Logger.WithField(key, value), map[string]interface{}{key: value})
+}
+
+func (l explainLogger) WithFields(fields map[string]interface{}) Logger {
+	return l.with(l.Logger.WithFields(fields), fields)
+}
+
+func (l explainLogger) WithError(err error) Logger {
+	return l.with(l.Logger.WithError(err), map[string]interface{}{"error": err})
+}
+
+func (l explainLogger) with(logger Logger, fields map[string]interface{}) Logger {
+	merged := make(map[string]interface{}, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return explainLogger{Logger: logger, explainer: l.explainer, fields: merged}
+}
+
+// record records a log without the question, which is the same for every step.
+func (l explainLogger) record(msg string) {
+	fields := make(map[string]interface{}, len(l.fields))
+	for k, v := range l.fields {
+		if k != "question" {
+			fields[k] = v
+		}
+	}
+	l.explainer.stepf(fields, "%s", msg)
+}
+
+func (l explainLogger) Debug(args ...interface{}) {
+	l.record(fmt.Sprint(args...))
+	l.Logger.Debug(args...)
+}
+
+func (l explainLogger) Debugf(format string, args ...interface{}) {
+	l.record(fmt.Sprintf(format, args...))
+	l.Logger.Debugf(format, args...)
+}
+
+func (l explainLogger) Info(args ...interface{}) {
+	l.record(fmt.Sprint(args...))
+	l.Logger.Info(args...)
+}
+
+func (l explainLogger) Infof(format string, args ...interface{}) {
+	l.record(fmt.Sprintf(format, args...))
+	l.Logger.Infof(format, args...)
+}
+
+func (l explainLogger) Warn(args ...interface{}) {
+	l.record(fmt.Sprint(args...))
+	l.Logger.Warn(args...)
+}
+
+func (l explainLogger) Warnf(format string, args ...interface{}) {
+	l.record(fmt.Sprintf(format, args...))
+	l.Logger.Warnf(format, args...)
+}
+
+func (l explainLogger) Error(args ...interface{}) {
+	l.record(fmt.Sprint(args...))
+	l.Logger.Error(args...)
+}
+
+func (l explainLogger) Errorf(format string, args ...interface{}) {
+	l.record(fmt.Sprintf(format, args...))
+	l.Logger.Errorf(format, args...)
+}
+
+// String formats the explanation for humans, like the output of dig.
+func (e *Explanation) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, ";; Question: %s\n", e.Question)
+	for _, step := range e.Steps {
+		fmt.Fprintf(&sb, ";; %10s  %s", step.Elapsed, step.Message)
+		keys := make([]string, 0, len(step.Fields))
+		for k := range step.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&sb, " %s=%s", k, step.Fields[k])
+		}
+		sb.WriteByte('\n')
+	}
+	fmt.Fprintf(&sb, ";; Answered by path %s, reason %s", e.Path, e.Reason)
+	if e.Resolver != "" {
+		fmt.Fprintf(&sb, ", resolver %s", e.Resolver)
+	}
+	sb.WriteString("\n\n")
+	sb.WriteString(e.Reply)
+	return sb.String()
+}
+
+// explainWriter is a dns.ResponseWriter keeping the reply of an explained query.
+type explainWriter struct {
+	reply *dns.Msg
+}
+
+var _explainAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+func (w *explainWriter) LocalAddr() net.Addr  { return _explainAddr }
+func (w *explainWriter) RemoteAddr() net.Addr { return _explainAddr }
+func (w *explainWriter) WriteMsg(m *dns.Msg) error {
+	w.reply = m
+	return nil
+}
+func (w *explainWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.reply = m
+	return len(b), nil
+}
+func (w *explainWriter) Close() error        { return nil }
+func (w *explainWriter) TsigStatus() error   { return nil }
+func (w *explainWriter) TsigTimersOnly(bool) {}
+func (w *explainWriter) Hijack()             {}
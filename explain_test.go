@@ -0,0 +1,74 @@
+package gochinadns
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestExplain(t *testing.T) {
+	addr := startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr), WithDelay(100*time.Millisecond), WithTestDomains())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := s.Explain("example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Path != pathTrusted || ex.Resolver != addr || ex.Reason != reasonTrusted {
+		t.Errorf("Explain() = %+v, want a trusted answer of %s", ex, addr)
+	}
+	var messages []string
+	for _, step := range ex.Steps {
+		messages = append(messages, step.Message)
+	}
+	steps := strings.Join(messages, "\n")
+	for _, want := range []string{
+		"Query " + addr + " over udp with none mutation.",
+		"Reply from " + addr,
+		"Answer is trusted. Use it.",
+	} {
+		if !strings.Contains(steps, want) {
+			t.Errorf("steps %q do not contain %q", steps, want)
+		}
+	}
+	if !strings.Contains(ex.Reply, "1.2.3.4") {
+		t.Errorf("Reply = %s, want 1.2.3.4", ex.Reply)
+	}
+
+	if _, err := s.Explain("bad..name", dns.TypeA); err == nil {
+		t.Error("Explain should fail with an invalid name")
+	}
+}
+
+func TestExplainCache(t *testing.T) {
+	addr := startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr), WithDelay(100*time.Millisecond),
+		WithTestDomains(), WithCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := s.Explain("example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Path != pathTrusted || len(ex.Steps) == 0 || ex.Steps[0].Message != "Reply is not cached. Resolve it." {
+		t.Errorf("Explain() = %+v, want a miss resolved by %s", ex, addr)
+	}
+	if n := s.cache.Len(); n != 0 {
+		t.Errorf("%d replies cached by Explain, want 0", n)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	s.serve(s.ctx, &explainWriter{}, req, nil)
+	if ex, err = s.Explain("example.com", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+	if ex.Path != pathCache || ex.Reason != reasonCached || len(ex.Steps) != 1 || !strings.Contains(ex.Reply, "1.2.3.4") {
+		t.Errorf("Explain() = %+v, want a cache hit", ex)
+	}
+}
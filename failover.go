@@ -0,0 +1,82 @@
+package gochinadns
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// rcodeError is the error of a reply whose rcode is a failure of the resolver, see WithRcodeFailover.
+type rcodeError struct {
+	reply *dns.Msg
+	raw   []byte //the reply as received, if it's forwarded raw
+}
+
+func (e *rcodeError) Error() string {
+	return "reply of " + dns.RcodeToString[e.reply.Rcode]
+}
+
+// rcodeFailure returns an rcodeError if RcodeFailover is set and reply is SERVFAIL, REFUSED or NOTIMP.
+func (s *Server) rcodeFailure(reply *dns.Msg, raw []byte) error {
+	if !s.options().RcodeFailover {
+		return nil
+	}
+	switch reply.Rcode {
+	case dns.RcodeServerFailure, dns.RcodeRefused, dns.RcodeNotImplemented:
+		return &rcodeError{reply: reply, raw: raw}
+	}
+	return nil
+}
+
+// rcodeVotes collects failed lookups of a query, so that a failure every resolver agrees on is relayed,
+// see WithRcodeFailover.
+type rcodeVotes struct {
+	mu       sync.Mutex
+	rep      *upstreamReply //the first reply of an rcodeError
+	disagree bool           //whether a lookup fails otherwise, or with another rcode
+}
+
+// record returns lookup which votes with its failures.
+func (v *rcodeVotes) record(lookup upstreamLookup) upstreamLookup {
+	if v == nil {
+		return lookup
+	}
+	return func(ctx context.Context, server Resolver) (*upstreamReply, time.Duration, error) {
+		rep, rtt, err := lookup(ctx, server)
+		if err != nil {
+			v.add(server, err)
+		}
+		return rep, rtt, err
+	}
+}
+
+func (v *rcodeVotes) add(server Resolver, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	e, ok := errors.Cause(err).(*rcodeError)
+	switch {
+	case !ok:
+		v.disagree = true
+	case v.rep == nil:
+		v.rep = &upstreamReply{Msg: e.reply, server: server, raw: e.raw}
+	case v.rep.Rcode != e.reply.Rcode:
+		v.disagree = true
+	}
+}
+
+// agreed returns the reply of the rcode every failed lookup agrees on, or nil if they don't.
+func (v *rcodeVotes) agreed() *upstreamReply {
+	if v == nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.disagree || v.rep == nil {
+		return nil
+	}
+	v.rep.reason = reasonAgreedFailure
+	return v.rep
+}
@@ -0,0 +1,68 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startRcodeUpstream replies every query over UDP with rcode, and returns its address.
+func startRcodeUpstream(t *testing.T, rcode int) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetRcode(req, rcode)
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestRcodeFailover(t *testing.T) {
+	servfail, refused := startRcodeUpstream(t, dns.RcodeServerFailure), startRcodeUpstream(t, dns.RcodeRefused)
+	good := startTestUpstream(t, "1.2.3.4")
+	tests := []struct {
+		servers     []string
+		failover    bool
+		relayAgreed bool
+		wantRcode   int
+		wantAnswers int
+	}{
+		{[]string{servfail, good}, false, false, dns.RcodeServerFailure, 0},
+		{[]string{servfail, good}, true, false, dns.RcodeSuccess, 1},
+		{[]string{refused, servfail, good}, true, true, dns.RcodeSuccess, 1},
+		{[]string{servfail, servfail}, true, false, dns.RcodeSuccess, 0},
+		{[]string{servfail, servfail}, true, true, dns.RcodeServerFailure, 0},
+		{[]string{refused, servfail}, true, true, dns.RcodeSuccess, 0},
+	}
+	for _, tt := range tests {
+		for _, raw := range []bool{true, false} {
+			var servers []string
+			for _, addr := range tt.servers {
+				servers = append(servers, "udp@"+addr)
+			}
+			s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers(servers...), WithDelay(time.Second),
+				WithTimeout(time.Second), WithRawForward(raw), WithRcodeFailover(tt.failover, tt.relayAgreed), WithSkipStartupTest(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := new(explainWriter)
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			start := time.Now()
+			s.Serve(w, req)
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("%+v with raw forward %t takes %s", tt, raw, elapsed)
+			}
+			if w.reply == nil || w.reply.Rcode != tt.wantRcode || len(w.reply.Answer) != tt.wantAnswers {
+				t.Errorf("%+v with raw forward %t is answered with %v", tt, raw, w.reply)
+			}
+		}
+	}
+}
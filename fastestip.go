@@ -0,0 +1,292 @@
+package gochinadns
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	_probeWait        = 200 * time.Millisecond //how long answers wait for probes by default
+	_probeTimeout     = time.Second            //how long a probe waits, so that it's cached for later answers
+	_probeTTL         = 10 * time.Minute       //how long a measured RTT is cached
+	_probeFailTTL     = time.Minute            //how long an unreachable address is cached
+	_probeConcurrency = 64                     //probes in flight at most
+	_probeEntries     = 4096                   //cached addresses at most
+)
+
+// ipProbe is how addresses of answers are probed: by connecting to a TCP port, or by ICMP echo.
+type ipProbe struct {
+	network string //tcp or icmp
+	port    string //port of tcp
+}
+
+func parseIPProbe(probe string) (*ipProbe, error) {
+	if probe == "icmp" {
+		return &ipProbe{network: "icmp"}, nil
+	}
+	if strings.HasPrefix(probe, "tcp:") {
+		if port, err := strconv.ParseUint(probe[4:], 10, 16); err == nil && port > 0 {
+			return &ipProbe{network: "tcp", port: probe[4:]}, nil
+		}
+	}
+	return nil, errors.Errorf("invalid probe [%s]: want tcp:PORT or icmp", probe)
+}
+
+func (p *ipProbe) String() string {
+	if p.network == "tcp" {
+		return "tcp:" + p.port
+	}
+	return p.network
+}
+
+// rtt probes ip once, and returns the round-trip time, or an error if ip is unreachable.
+func (p *ipProbe) rtt(ctx context.Context, ip net.IP) (time.Duration, error) {
+	start := time.Now()
+	if p.network == "tcp" {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), p.port))
+		if err != nil {
+			return 0, err
+		}
+		conn.Close()
+		return time.Since(start), nil
+	}
+	if err := pingICMP(ctx, ip); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// pingICMP sends an ICMP echo to ip, and waits for the reply until ctx is done. Unprivileged ICMP sockets are
+// preferred, see net.ipv4.ping_group_range of Linux, and raw sockets are used otherwise.
+func pingICMP(ctx context.Context, ip net.IP) error {
+	network, raw, proto := "udp4", "ip4:icmp", 1
+	var echo, echoReply icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if ip.To4() == nil {
+		network, raw, proto = "udp6", "ip6:ipv6-icmp", 58
+		echo, echoReply = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	conn, err := icmp.ListenPacket(network, "")
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if err != nil {
+		if conn, err = icmp.ListenPacket(raw, ""); err != nil {
+			return errors.Wrap(err, "fail to open ICMP socket")
+		}
+		dst = &net.IPAddr{IP: ip}
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// the kernel replaces the ID of unprivileged sockets, so replies are matched by the sequence and the peer.
+	seq := rand.Intn(1 << 16)
+	msg := icmp.Message{Type: echo, Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: seq, Data: []byte("gochinadns")}}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteTo(b, dst); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		var from net.IP
+		switch peer := peer.(type) {
+		case *net.UDPAddr:
+			from = peer.IP
+		case *net.IPAddr:
+			from = peer.IP
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != echoReply || !from.Equal(ip) {
+			continue
+		}
+		if body, ok := reply.Body.(*icmp.Echo); ok && body.Seq == seq {
+			return nil
+		}
+	}
+}
+
+// probeResult is a cached probe of an address. rtt is negative if it's unreachable.
+type probeResult struct {
+	rtt    time.Duration
+	expire time.Time
+}
+
+// ipProber orders addresses of answers by RTT of probes, whose results are cached, like SmartDNS.
+type ipProber struct {
+	probe *ipProbe
+	wait  time.Duration
+	sem   chan struct{}
+	log   Logger
+
+	mu      sync.Mutex
+	results map[string]probeResult
+	pending map[string]bool
+}
+
+func newIPProber(probe *ipProbe, wait time.Duration, logger Logger) *ipProber {
+	if wait <= 0 {
+		wait = _probeWait
+	}
+	return &ipProber{
+		probe:   probe,
+		wait:    wait,
+		sem:     make(chan struct{}, _probeConcurrency),
+		log:     logger,
+		results: make(map[string]probeResult),
+		pending: make(map[string]bool),
+	}
+}
+
+// rtts returns RTTs of ips, which are probed unless they are cached. It waits for probes until ctx is done or the
+// wait is over. RTTs of addresses not probed in time are 0, and those of unreachable ones negative.
+func (p *ipProber) rtts(ctx context.Context, ips []net.IP) []time.Duration {
+	rtts := make([]time.Duration, len(ips))
+	done := make(chan int, len(ips))
+	probing := 0
+	now := time.Now()
+	p.mu.Lock()
+	for i, ip := range ips {
+		key := ip.String()
+		if r, ok := p.results[key]; ok && now.Before(r.expire) {
+			rtts[i] = r.rtt
+			continue
+		}
+		if p.pending[key] {
+			continue
+		}
+		select {
+		case p.sem <- struct{}{}:
+		default:
+			// too many probes in flight. The address is probed by a later answer.
+			continue
+		}
+		p.pending[key] = true
+		probing++
+		go p.run(ip, i, done)
+	}
+	p.mu.Unlock()
+	if probing == 0 {
+		return rtts
+	}
+
+	timer := time.NewTimer(p.wait)
+	defer timer.Stop()
+	for ; probing > 0; probing-- {
+		select {
+		case i := <-done:
+			p.mu.Lock()
+			rtts[i] = p.results[ips[i].String()].rtt
+			p.mu.Unlock()
+		case <-timer.C:
+			return rtts
+		case <-ctx.Done():
+			return rtts
+		}
+	}
+	return rtts
+}
+
+// run probes ip in the background, which outlives the answer waiting for it, and caches the result.
+func (p *ipProber) run(ip net.IP, i int, done chan<- int) {
+	defer func() { <-p.sem }()
+	ctx, cancel := context.WithTimeout(context.Background(), _probeTimeout)
+	defer cancel()
+	r := probeResult{expire: time.Now().Add(_probeTTL)}
+	var err error
+	if r.rtt, err = p.probe.rtt(ctx, ip); err != nil {
+		p.log.WithError(err).Debugf("Fail to probe %s.", ip)
+		r.rtt, r.expire = -1, time.Now().Add(_probeFailTTL)
+	} else if r.rtt <= 0 {
+		r.rtt = 1
+	}
+
+	p.mu.Lock()
+	key := ip.String()
+	delete(p.pending, key)
+	if len(p.results) >= _probeEntries {
+		now := time.Now()
+		for k, v := range p.results {
+			if now.After(v.expire) {
+				delete(p.results, k)
+			}
+		}
+		if len(p.results) >= _probeEntries {
+			p.results = make(map[string]probeResult)
+		}
+	}
+	p.results[key] = r
+	p.mu.Unlock()
+	done <- i
+}
+
+// order returns rep with its A or AAAA answers ordered by RTT: measured ones from the fastest, then those not
+// probed in time, then unreachable ones, each in the order of upstreams. Other answers, such as CNAMEs, are
+// kept in place. It returns rep if it has less than two addresses.
+func (p *ipProber) order(ctx context.Context, rep *upstreamReply, logger Logger) *upstreamReply {
+	if err := rep.unpackAll(); err != nil || rep.Rcode != dns.RcodeSuccess {
+		return rep
+	}
+	var (
+		idx []int
+		ips []net.IP
+	)
+	for i, rr := range rep.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			idx, ips = append(idx, i), append(ips, rr.A)
+		case *dns.AAAA:
+			idx, ips = append(idx, i), append(ips, rr.AAAA)
+		}
+	}
+	if len(ips) < 2 {
+		return rep
+	}
+
+	rtts := p.rtts(ctx, ips)
+	rank := func(i int) (int, time.Duration) {
+		switch rtt := rtts[i]; {
+		case rtt > 0:
+			return 0, rtt
+		case rtt == 0:
+			return 1, 0
+		default:
+			return 2, 0
+		}
+	}
+	order := make([]int, len(ips))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ra, ta := rank(order[a])
+		rb, tb := rank(order[b])
+		return ra < rb || ra == rb && ta < tb
+	})
+	logger.Debugf("Order answers by RTT of probes: %v.", rtts)
+	reply := rep.Copy()
+	answer := append([]dns.RR(nil), reply.Answer...)
+	for i, j := range order {
+		reply.Answer[idx[i]] = answer[idx[j]]
+	}
+	return &upstreamReply{Msg: reply, server: rep.server, reason: rep.reason, polluted: rep.polluted}
+}
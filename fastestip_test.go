@@ -0,0 +1,73 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFastestIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		for _, s := range []string{"www.example.com. 60 IN CNAME cdn.example.com.",
+			"cdn.example.com. 60 IN A 127.0.0.2", "cdn.example.com. 60 IN A 127.0.0.1"} {
+			rr, _ := dns.NewRR(s)
+			reply.Answer = append(reply.Answer, rr)
+		}
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+pc.LocalAddr().String()),
+		WithSkipStartupTest(true), WithFastestIP("tcp:"+port, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		w := new(explainWriter)
+		s.Serve(w, req)
+		if w.reply == nil || len(w.reply.Answer) != 3 {
+			t.Fatalf("Reply %d = %v, want 3 answers", i, w.reply)
+		}
+		if _, ok := w.reply.Answer[0].(*dns.CNAME); !ok {
+			t.Errorf("First answer of reply %d = %s, want the CNAME", i, w.reply.Answer[0])
+		}
+		if ips := answerIPs(w.reply); len(ips) != 2 || ips[0].String() != "127.0.0.1" {
+			t.Errorf("Addresses of reply %d = %v, want 127.0.0.1 with the open port first", i, ips)
+		}
+	}
+	s.prober.mu.Lock()
+	if r := s.prober.results["127.0.0.1"]; r.rtt <= 0 {
+		t.Errorf("Cached RTT of 127.0.0.1 = %v, want it reachable", r.rtt)
+	}
+	if r := s.prober.results["127.0.0.2"]; r.rtt >= 0 {
+		t.Errorf("Cached RTT of 127.0.0.2 = %v, want it unreachable", r.rtt)
+	}
+	s.prober.mu.Unlock()
+	if c := s.Config(); c.FastestIP != "tcp:"+port || c.FastestIPWait != "1s" {
+		t.Errorf("Config reports probe %s waiting %s", c.FastestIP, c.FastestIPWait)
+	}
+
+	for _, probe := range []string{"tcp", "tcp:0", "tcp:https", "udp:53"} {
+		if err := WithFastestIP(probe, 0)(new(serverOptions)); err == nil {
+			t.Errorf("Probe %s should fail", probe)
+		}
+	}
+}
@@ -3,9 +3,13 @@ module github.com/cherrot/gochinadns
 go 1.15
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/miekg/dns v1.1.35
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.7.0
-	github.com/yl2chen/cidranger v1.0.2
+	github.com/stretchr/testify v1.4.0 // indirect
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58
+	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,143 @@
+package gochinadns
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// healthChecker tests resolvers periodically with test domains, like on start, and keeps which protocols of them
+// are down, so that queries skip them. Lookups of checks count for metrics, stats and the circuit breaker like others.
+type healthChecker struct {
+	log      Logger
+	events   *eventHooks
+	interval time.Duration
+
+	mu    sync.RWMutex
+	down  map[string]map[string]bool //resolver address -> protocol -> whether it's down
+	downs int                        //number of protocols down
+}
+
+func newHealthChecker(o *serverOptions, log Logger, events *eventHooks) *healthChecker {
+	return &healthChecker{log: log, events: events, interval: o.HealthInterval, down: make(map[string]map[string]bool)}
+}
+
+func (s *Server) runHealthCheck(ctx context.Context) {
+	ticker := time.NewTicker(s.health.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.checkHealth()
+	}
+}
+
+// checkHealth tests all resolvers in parallel, and updates protocols up and down.
+func (s *Server) checkHealth() {
+	o := s.options()
+	if len(o.TestDomains) == 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, servers := range []resolverArray{o.TrustedServers, o.UntrustedServers} {
+		for _, server := range servers {
+			wg.Add(1)
+			go func(server Resolver) {
+				defer wg.Done()
+				t := s.checkResolver(o, server)
+				for _, p := range t.report.Protocols {
+					s.health.update(server, p.Protocol, p.Reachable)
+					s.metrics.observeHealth(server, p.Protocol, p.Reachable)
+				}
+			}(server)
+		}
+	}
+	wg.Wait()
+}
+
+// update sets whether the resolver is up over the protocol, and logs if it changes.
+func (h *healthChecker) update(server Resolver, protocol string, up bool) {
+	h.mu.Lock()
+	down := h.down[server.GetAddr()]
+	if down == nil {
+		down = make(map[string]bool)
+		h.down[server.GetAddr()] = down
+	}
+	logger := h.log.WithField("server", server)
+	var state string
+	switch {
+	case !up && !down[protocol]:
+		logger.Warnf("Resolver is down over %s.", protocol)
+		h.downs++
+		state = UpstreamDown
+	case up && down[protocol]:
+		logger.Infof("Resolver is up again over %s.", protocol)
+		h.downs--
+		state = UpstreamUp
+	}
+	down[protocol] = !up
+	h.mu.Unlock()
+	// hooks are called without the lock, so that they may read the state.
+	if state != "" {
+		h.events.upstreamState(server.GetAddr(), state, protocol, "")
+	}
+}
+
+// filter returns servers without the protocols which are down. Resolvers which are down over every protocol
+// are returned as they are, since there is no better choice for them.
+func (h *healthChecker) filter(servers resolverArray) resolverArray {
+	if h == nil {
+		return servers
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.downs == 0 {
+		return servers
+	}
+	var filtered resolverArray
+	for i, server := range servers {
+		down := h.down[server.GetAddr()]
+		protocols := make([]string, 0, len(server.protocols))
+		for _, protocol := range server.protocols {
+			if !down[protocol] {
+				protocols = append(protocols, protocol)
+			}
+		}
+		if len(protocols) == len(server.protocols) || len(protocols) == 0 {
+			if filtered != nil {
+				filtered = append(filtered, server)
+			}
+			continue
+		}
+		if filtered == nil {
+			filtered = append(make(resolverArray, 0, len(servers)), servers[:i]...)
+		}
+		server.protocols = protocols
+		filtered = append(filtered, server)
+	}
+	if filtered == nil {
+		return servers
+	}
+	return filtered
+}
+
+// downProtocols returns protocols the resolver at addr is down over.
+func (h *healthChecker) downProtocols(addr string) []string {
+	if h == nil {
+		return nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var protocols []string
+	for protocol, down := range h.down[addr] {
+		if down {
+			protocols = append(protocols, protocol)
+		}
+	}
+	sort.Strings(protocols)
+	return protocols
+}
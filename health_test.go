@@ -0,0 +1,51 @@
+package gochinadns
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	// the test upstream listens on UDP only, so it's down over TCP.
+	addr := startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp+tcp@"+addr), WithTimeout(200*time.Millisecond),
+		WithTestDomains("example.com"), WithSkipStartupTest(true), WithHealthCheck(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.metrics = newMetrics()
+	o := s.options()
+	if got := s.available(o.TrustedServers); !reflect.DeepEqual(got[0].GetProtocols(), []string{"udp", "tcp"}) {
+		t.Fatalf("protocols before health checks are %v", got[0].GetProtocols())
+	}
+
+	s.checkHealth()
+	if got := s.available(o.TrustedServers); !reflect.DeepEqual(got[0].GetProtocols(), []string{"udp"}) {
+		t.Errorf("protocols after health checks are %v, want [udp]", got[0].GetProtocols())
+	}
+	if !reflect.DeepEqual(o.TrustedServers[0].GetProtocols(), []string{"udp", "tcp"}) {
+		t.Error("protocols of resolvers in options are changed")
+	}
+	if st := s.Stats().Upstreams[0]; !reflect.DeepEqual(st.Down, []string{"tcp"}) {
+		t.Errorf("upstream status is %+v, want down over tcp", st)
+	}
+	sb := new(strings.Builder)
+	s.metrics.upstreamUp.writeTo(sb)
+	if !strings.Contains(sb.String(), `chinadns_upstream_up{resolver="`+addr+`",protocol="tcp"} 0`) ||
+		!strings.Contains(sb.String(), `chinadns_upstream_up{resolver="`+addr+`",protocol="udp"} 1`) {
+		t.Errorf("unexpected metrics:\n%s", sb)
+	}
+
+	// resolvers down over every protocol are queried as usual.
+	s.health.update(o.TrustedServers[0], "udp", false)
+	if got := s.available(o.TrustedServers); !reflect.DeepEqual(got[0].GetProtocols(), []string{"udp", "tcp"}) {
+		t.Errorf("protocols of a resolver down over all are %v, want all", got[0].GetProtocols())
+	}
+	s.health.update(o.TrustedServers[0], "udp", true)
+	s.health.update(o.TrustedServers[0], "tcp", true)
+	if s.health.downs != 0 || s.health.downProtocols(addr) != nil {
+		t.Errorf("%d protocols are still down", s.health.downs)
+	}
+}
@@ -0,0 +1,166 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	_setQueue   = 1024    //max number of pending set elements. Elements are dropped when the queue is full.
+	_setBatch   = 128     //max number of set elements written at once
+	_setAdded   = 65536   //max number of set elements remembered, so that they are not added again until they expire
+	_setTimeout = 2147483 //max timeout of set elements in seconds, which the kernel takes in milliseconds
+)
+
+// setRule adds addresses answered for domains in a list to the sets set4 and set6 of the kernel, which are ipsets
+// or nftables sets, see WithIPSet and WithNFTSet.
+type setRule struct {
+	path    string
+	domains *domainTrie //nil until it's loaded by WithLazyLists
+	set4    string      //set of IPv4 addresses. Empty to skip them.
+	set6    string      //set of IPv6 addresses. Empty to skip them.
+}
+
+// setElement is an address to add to a set, which expires after timeout seconds.
+type setElement struct {
+	set     string
+	ip      net.IP
+	timeout uint32
+}
+
+// answerSets adds addresses answered for domains of rules to sets of the kernel in the background, so that
+// firewall and transparent proxy rules follow DNS. All methods are no-op on a nil *answerSets.
+type answerSets struct {
+	log   Logger
+	add   func(elems []setElement) error
+	queue chan setElement
+
+	mu    sync.Mutex
+	added map[string]time.Time //expiry of elements added, by set and address
+}
+
+func newAnswerSets(add func(elems []setElement) error, log Logger) *answerSets {
+	return &answerSets{
+		log:   log,
+		add:   add,
+		queue: make(chan setElement, _setQueue),
+		added: make(map[string]time.Time),
+	}
+}
+
+// observe queues addresses of reply to q to the sets of rules matching q. An address is not queued again until half
+// of its timeout passes, so that busy domains don't flood the kernel.
+func (a *answerSets) observe(rules []setRule, q *dns.Question, reply *dns.Msg) {
+	if a == nil || reply.Rcode != dns.RcodeSuccess {
+		return
+	}
+	for _, rule := range rules {
+		if !rule.domains.Contain(q.Name) {
+			continue
+		}
+		for _, rr := range reply.Answer {
+			var ip net.IP
+			var set string
+			switch answer := rr.(type) {
+			case *dns.A:
+				ip, set = answer.A, rule.set4
+			case *dns.AAAA:
+				ip, set = answer.AAAA, rule.set6
+			}
+			if set == "" || ip == nil || ip.IsUnspecified() {
+				continue
+			}
+			timeout := rr.Header().Ttl
+			if timeout < 1 {
+				// 0 is never expiring to the kernel.
+				timeout = 1
+			} else if timeout > _setTimeout {
+				timeout = _setTimeout
+			}
+			a.enqueue(setElement{set: set, ip: ip, timeout: timeout})
+		}
+	}
+}
+
+// enqueue queues elem unless it's added recently, and remembers it.
+func (a *answerSets) enqueue(elem setElement) {
+	key := elem.set + "/" + elem.ip.String()
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if expire, ok := a.added[key]; ok && expire.Sub(now) > time.Duration(elem.timeout)*time.Second/2 {
+		return
+	}
+	select {
+	case a.queue <- elem:
+	default:
+		a.log.WithField("set", elem.set).Warn("Set queue is full. Drop answer.")
+		return
+	}
+	if len(a.added) >= _setAdded {
+		for k, expire := range a.added {
+			if expire.Before(now) {
+				delete(a.added, k)
+			}
+		}
+		if len(a.added) >= _setAdded {
+			a.added = make(map[string]time.Time)
+		}
+	}
+	a.added[key] = now.Add(time.Duration(elem.timeout) * time.Second)
+}
+
+// run adds queued elements in batches until ctx is done.
+func (a *answerSets) run(ctx context.Context) {
+	batch := make([]setElement, 0, _setBatch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case elem := <-a.queue:
+			batch = append(batch[:0], elem)
+		}
+	drain:
+		for len(batch) < _setBatch {
+			select {
+			case elem := <-a.queue:
+				batch = append(batch, elem)
+			default:
+				break drain
+			}
+		}
+		if err := a.add(batch); err != nil {
+			a.log.WithError(err).Warn("Fail to add answers to sets.")
+			// add them again on the next answers.
+			a.mu.Lock()
+			for _, elem := range batch {
+				delete(a.added, elem.set+"/"+elem.ip.String())
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+// String returns the rule in format path=set4[,set6], as the ipset and nftset flags are given.
+func (r setRule) String() string {
+	if r.set6 == "" {
+		return r.path + "=" + r.set4
+	}
+	return r.path + "=" + r.set4 + "," + r.set6
+}
+
+// loadSetList loads the domain list at path of the rule i of rules, which matches nothing until it's loaded
+// by WithLazyLists.
+func (o *serverOptions) loadSetList(rules *[]setRule, i int, path, name string) error {
+	load := func(o *serverOptions) error {
+		return o.loadDomainFile(&(*rules)[i].domains, path, name)
+	}
+	if o.deferList(load) {
+		return nil
+	}
+	return load(o)
+}
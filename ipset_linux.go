@@ -0,0 +1,89 @@
+//go:build linux
+// +build linux
+
+package gochinadns
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// supportsIPSet is whether ipsets are supported on this platform.
+const supportsIPSet = true
+
+// Constants of the ipset netlink protocol, see linux/netfilter/ipset/ip_set.h.
+const (
+	_ipsetProtocol     = 6
+	_ipsetCmdAdd       = 9
+	_ipsetAttrProtocol = 1
+	_ipsetAttrSetName  = 2
+	_ipsetAttrData     = 7
+	_ipsetAttrIP       = 1
+	_ipsetAttrTimeout  = 6
+	_ipsetAttrIPv4     = 1
+	_ipsetAttrIPv6     = 2
+	_ipsetErrTimeout   = 4107 //the set is created without timeout support
+)
+
+// ipsetNoTimeout is the sets created without timeout support, whose elements are added without timeouts.
+var ipsetNoTimeout sync.Map
+
+// addIPSet adds elems to ipsets in one write. Elements of sets without timeout support are added again
+// without timeouts.
+func addIPSet(elems []setElement) error {
+	msgs := make([]*netlinkMessage, len(elems))
+	for i, elem := range elems {
+		_, noTimeout := ipsetNoTimeout.Load(elem.set)
+		msgs[i] = ipsetAddMessage(uint32(i+1), elem, !noTimeout)
+	}
+	errs, err := netfilterExchange(msgs, len(msgs))
+	if err != nil {
+		return err
+	}
+	var retries []*netlinkMessage
+	for i, elem := range elems {
+		switch errs[uint32(i+1)] {
+		case nil:
+		case syscall.Errno(_ipsetErrTimeout):
+			ipsetNoTimeout.Store(elem.set, true)
+			retries = append(retries, ipsetAddMessage(uint32(i+1), elem, false))
+		default:
+			return errors.Wrapf(errs[uint32(i+1)], "fail to add %s to ipset [%s]", elem.ip, elem.set)
+		}
+	}
+	if len(retries) == 0 {
+		return nil
+	}
+	if errs, err = netfilterExchange(retries, len(retries)); err != nil {
+		return err
+	}
+	for seq, err := range errs {
+		elem := elems[seq-1]
+		return errors.Wrapf(err, "fail to add %s to ipset [%s]", elem.ip, elem.set)
+	}
+	return nil
+}
+
+// ipsetAddMessage returns the message adding elem, which updates the timeout of an element added already.
+func ipsetAddMessage(seq uint32, elem setElement, timeout bool) *netlinkMessage {
+	family, ip := uint8(unix.AF_INET), elem.ip.To4()
+	attrIP := uint16(_ipsetAttrIPv4)
+	if ip == nil {
+		family, ip, attrIP = unix.AF_INET6, elem.ip.To16(), _ipsetAttrIPv6
+	}
+	m := newNetfilterMessage(unix.NFNL_SUBSYS_IPSET<<8|_ipsetCmdAdd, unix.NLM_F_REQUEST|unix.NLM_F_ACK, seq, family, 0)
+	m.attr(_ipsetAttrProtocol, []byte{_ipsetProtocol})
+	m.attrString(_ipsetAttrSetName, elem.set)
+	m.begin(_ipsetAttrData)
+	m.begin(_ipsetAttrIP)
+	m.attr(attrIP|unix.NLA_F_NET_BYTEORDER, ip)
+	m.end()
+	if timeout {
+		m.attrUint32(_ipsetAttrTimeout|unix.NLA_F_NET_BYTEORDER, elem.timeout)
+	}
+	m.end()
+	return m
+}
@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+package gochinadns
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Commands and attributes of the ipset netlink protocol to set up tests.
+const (
+	_ipsetCmdCreate  = 2
+	_ipsetCmdDestroy = 3
+	_ipsetCmdTest    = 11
+	_ipsetAttrType   = 3
+	_ipsetAttrRev    = 4
+	_ipsetAttrFamily = 5
+)
+
+// ipsetCommand sends the command cmd on set, with attributes appended by attrs if it isn't nil, and returns its error.
+func ipsetCommand(t *testing.T, cmd uint16, set string, attrs func(m *netlinkMessage)) error {
+	m := newNetfilterMessage(unix.NFNL_SUBSYS_IPSET<<8|cmd, unix.NLM_F_REQUEST|unix.NLM_F_ACK, 1, unix.AF_INET, 0)
+	m.attr(_ipsetAttrProtocol, []byte{_ipsetProtocol})
+	m.attrString(_ipsetAttrSetName, set)
+	if attrs != nil {
+		attrs(m)
+	}
+	errs, err := netfilterExchange([]*netlinkMessage{m}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return errs[1]
+}
+
+// createIPSet creates a hash:ip set of IPv4 addresses, which is destroyed once the test finishes.
+func createIPSet(t *testing.T, set string, timeout bool) {
+	err := ipsetCommand(t, _ipsetCmdCreate, set, func(m *netlinkMessage) {
+		m.attrString(_ipsetAttrType, "hash:ip")
+		m.attr(_ipsetAttrRev, []byte{0})
+		m.attr(_ipsetAttrFamily, []byte{unix.AF_INET})
+		m.begin(_ipsetAttrData)
+		if timeout {
+			m.attrUint32(_ipsetAttrTimeout|unix.NLA_F_NET_BYTEORDER, 0)
+		}
+		m.end()
+	})
+	if err != nil {
+		t.Skipf("Fail to create ipset %s: %v", set, err)
+	}
+	t.Cleanup(func() { ipsetCommand(t, _ipsetCmdDestroy, set, nil) })
+}
+
+func TestAddIPSet(t *testing.T) {
+	createIPSet(t, "chinadns_test", true)
+	createIPSet(t, "chinadns_test_nt", false)
+	elems := []setElement{
+		{set: "chinadns_test", ip: net.ParseIP("1.2.3.4"), timeout: 60},
+		{set: "chinadns_test_nt", ip: net.ParseIP("1.2.3.5"), timeout: 60},
+	}
+	// the second time updates the elements.
+	for i := 0; i < 2; i++ {
+		if err := addIPSet(elems); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, elem := range append(elems, setElement{set: "chinadns_test", ip: net.ParseIP("1.2.3.5")}) {
+		err := ipsetCommand(t, _ipsetCmdTest, elem.set, func(m *netlinkMessage) {
+			m.begin(_ipsetAttrData)
+			m.begin(_ipsetAttrIP)
+			m.attr(_ipsetAttrIPv4|unix.NLA_F_NET_BYTEORDER, elem.ip.To4())
+			m.end()
+			m.end()
+		})
+		if in := err == nil; in != (elem.timeout > 0) {
+			t.Errorf("%s in ipset %s = %v, want %v", elem.ip, elem.set, err, elem.timeout > 0)
+		}
+	}
+	if err := addIPSet([]setElement{{set: "chinadns_none", ip: net.ParseIP("1.2.3.4"), timeout: 60}}); err == nil {
+		t.Error("Adding to a nonexistent ipset should fail")
+	}
+}
+
+func TestIPSetConfig(t *testing.T) {
+	list := writeTempConfig(t, "google.com\n")
+	defer os.Remove(list)
+	path := writeTempConfig(t, "ipset = \""+list+"=gfw,gfw6\"\n")
+	defer os.Remove(path)
+
+	o, err := buildOptions([]ServerOption{WithConfigFile(path), WithIPSet(list, "", "ex6")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := setConfigs(o.IPSets), []string{list + "=gfw,gfw6", list + "=,ex6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ipsets = %q, want %q", got, want)
+	}
+	if !o.IPSets[0].domains.Contain("www.google.com.") {
+		t.Error("ipset list is not loaded")
+	}
+	for _, sets := range [][2]string{{"", ""}, {strings.Repeat("x", 32), ""}} {
+		if _, err := buildOptions([]ServerOption{WithIPSet(list, sets[0], sets[1])}); err == nil {
+			t.Errorf("ipsets %q should fail", sets)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package gochinadns
+
+import "github.com/pkg/errors"
+
+// supportsIPSet is whether ipsets are supported on this platform. Only Linux has them.
+const supportsIPSet = false
+
+func addIPSet(elems []setElement) error {
+	return errors.New("ipsets are not supported on this platform")
+}
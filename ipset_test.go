@@ -0,0 +1,66 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAnswerSets(t *testing.T) {
+	var mu sync.Mutex
+	var added []string
+	done := make(chan struct{}, 16)
+	a := newAnswerSets(func(elems []setElement) error {
+		mu.Lock()
+		for _, elem := range elems {
+			added = append(added, fmt.Sprintf("%s %s %d", elem.set, elem.ip, elem.timeout))
+		}
+		mu.Unlock()
+		done <- struct{}{}
+		return nil
+	}, NewLogrusLogger(logrus.StandardLogger()))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.run(ctx)
+
+	rules := []setRule{
+		{domains: NewDomainSet("google.com").load(), set4: "gfw", set6: "gfw6"},
+		{domains: NewDomainSet("example.com").load(), set6: "ex6"},
+	}
+	observe := func(name string, rcode int, rrs ...string) {
+		reply := new(dns.Msg)
+		reply.SetQuestion(name, dns.TypeA)
+		reply.Rcode = rcode
+		for _, rr := range rrs {
+			answer, err := dns.NewRR(rr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply.Answer = append(reply.Answer, answer)
+		}
+		a.observe(rules, &reply.Question[0], reply)
+	}
+	observe("www.google.com.", dns.RcodeSuccess,
+		"www.google.com. 300 IN CNAME google.com.", "google.com. 300 IN A 1.2.3.4", "google.com. 0 IN AAAA 2001:db8::1")
+	<-done
+	// added recently, and not matched.
+	observe("google.com.", dns.RcodeSuccess, "google.com. 300 IN A 1.2.3.4")
+	observe("example.com.", dns.RcodeSuccess, "example.com. 300 IN A 1.2.3.5")
+	observe("qq.com.", dns.RcodeSuccess, "qq.com. 300 IN A 1.2.3.6")
+	observe("google.com.", dns.RcodeServerFailure, "google.com. 300 IN A 1.2.3.7")
+	// expiring soon.
+	observe("google.com.", dns.RcodeSuccess, "google.com. 300 IN AAAA 2001:db8::1")
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"gfw 1.2.3.4 300", "gfw6 2001:db8::1 1", "gfw6 2001:db8::1 300"}
+	if !reflect.DeepEqual(added, want) {
+		t.Errorf("added = %q, want %q", added, want)
+	}
+}
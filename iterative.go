@@ -0,0 +1,227 @@
+package gochinadns
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// rootResolvers are the IPv4 addresses of the root name servers, used as the starting point of iterative lookups.
+var rootResolvers = resolverArray{
+	{addr: "198.41.0.4:53", protocols: []string{"udp", "tcp"}},
+	{addr: "199.9.14.201:53", protocols: []string{"udp", "tcp"}},
+	{addr: "192.33.4.12:53", protocols: []string{"udp", "tcp"}},
+	{addr: "199.7.91.13:53", protocols: []string{"udp", "tcp"}},
+	{addr: "192.203.230.10:53", protocols: []string{"udp", "tcp"}},
+	{addr: "192.5.5.241:53", protocols: []string{"udp", "tcp"}},
+	{addr: "192.112.36.4:53", protocols: []string{"udp", "tcp"}},
+	{addr: "198.97.190.53:53", protocols: []string{"udp", "tcp"}},
+	{addr: "192.36.148.17:53", protocols: []string{"udp", "tcp"}},
+	{addr: "192.58.128.30:53", protocols: []string{"udp", "tcp"}},
+	{addr: "193.0.14.129:53", protocols: []string{"udp", "tcp"}},
+	{addr: "199.7.83.42:53", protocols: []string{"udp", "tcp"}},
+	{addr: "202.12.27.33:53", protocols: []string{"udp", "tcp"}},
+}
+
+// _maxIterDepth limits the recursion of iterative lookups (CNAME chasing and glueless delegations).
+const _maxIterDepth = 8
+
+var errIterDepth = errors.New("iterative lookup exceeds max depth")
+
+// LookupIterative resolves the request iteratively, starting from the given (root) server and other root servers,
+// with QNAME minimization so that each authoritative server only sees the labels it is responsible for.
+// It is layered on Lookup, so the protocols of the server are respected.
+// QNAME minimization: https://tools.ietf.org/html/rfc7816
+func (s *Server) LookupIterative(ctx context.Context, req *dns.Msg, server Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	t := time.Now()
+	servers := uniqueAppendResolver(resolverArray{server}, rootResolvers...)
+	reply, err = s.iterate(ctx, req.Question[0], servers, 0)
+	rtt = time.Since(t)
+	if err != nil {
+		return nil, rtt, err
+	}
+	reply.Id = req.Id
+	reply.Question = req.Question
+	reply.Response = true
+	reply.Authoritative = false
+	reply.RecursionDesired = req.RecursionDesired
+	reply.RecursionAvailable = true
+	reply.Ns = nil
+	reply.Extra = nil
+	return
+}
+
+func (s *Server) iterate(ctx context.Context, q dns.Question, servers resolverArray, depth int) (*dns.Msg, error) {
+	if depth > _maxIterDepth {
+		return nil, errIterDepth
+	}
+	logger := s.upstreamLog.WithField("question", questionString(&q))
+
+	var (
+		names = minimizedNames(q.Name)
+		zone  = "."
+	)
+	for i := 0; i < len(names); {
+		name, final := names[i], i == len(names)-1
+		qtype := dns.TypeNS
+		if final {
+			qtype = q.Qtype
+		}
+		logger.Debugf("Iterative query %s %s in zone %s", name, dns.TypeToString[qtype], zone)
+
+		rep, err := s.exchangeIterative(ctx, name, qtype, servers)
+		if err != nil {
+			return nil, err
+		}
+		if rep.Rcode == dns.RcodeNameError {
+			// https://tools.ietf.org/html/rfc8020
+			return rep, nil
+		}
+		if rep.Rcode != dns.RcodeSuccess {
+			return rep, nil
+		}
+
+		if len(rep.Answer) == 0 {
+			cut, nsNames := referral(rep, zone, q.Name)
+			if cut == "" {
+				// NODATA: no zone cut at this name.
+				if final {
+					return rep, nil
+				}
+				i++
+				continue
+			}
+			next, err := s.delegationServers(ctx, rep, nsNames, depth)
+			if err != nil {
+				return nil, err
+			}
+			zone, servers = cut, next
+			// skip the labels already covered by the delegated zone.
+			for i < len(names)-1 && dns.CountLabel(names[i]) <= dns.CountLabel(cut) {
+				i++
+			}
+			continue
+		}
+
+		if !final {
+			// The name is a zone cut served by the same servers, or it has other data. Go on with the next label.
+			i++
+			continue
+		}
+		return s.chaseCNAME(ctx, q, rep, depth)
+	}
+	return nil, errors.New("iterative lookup ended without reply")
+}
+
+// chaseCNAME follows a CNAME chain which terminates outside of the answer.
+func (s *Server) chaseCNAME(ctx context.Context, q dns.Question, rep *dns.Msg, depth int) (*dns.Msg, error) {
+	last := rep.Answer[len(rep.Answer)-1]
+	cname, ok := last.(*dns.CNAME)
+	if !ok || q.Qtype == dns.TypeCNAME {
+		return rep, nil
+	}
+	next, err := s.iterate(ctx, dns.Question{Name: cname.Target, Qtype: q.Qtype, Qclass: q.Qclass}, rootResolvers, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	rep.Answer = append(rep.Answer, next.Answer...)
+	rep.Rcode = next.Rcode
+	return rep, nil
+}
+
+func (s *Server) exchangeIterative(ctx context.Context, name string, qtype uint16, servers resolverArray) (rep *dns.Msg, err error) {
+	o := s.options()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.RecursionDesired = false
+	if !o.TCPOnly {
+		setUDPSize(req, uint16(o.UDPMaxSize))
+	}
+	for _, server := range servers {
+		rep, _, err = s.Lookup(ctx, req, server)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+	}
+	return nil, errors.Wrap(err, "all authoritative servers failed")
+}
+
+// delegationServers returns addresses of name servers in a referral, by glue records or by resolving them.
+func (s *Server) delegationServers(ctx context.Context, rep *dns.Msg, nsNames []string, depth int) (servers resolverArray, err error) {
+	o := s.options()
+	proto := []string{"udp", "tcp"}
+	if o.TCPOnly {
+		proto = []string{"tcp"}
+	}
+	for _, rr := range rep.Extra {
+		if a, ok := rr.(*dns.A); ok && containsFold(nsNames, a.Hdr.Name) {
+			servers = uniqueAppendResolver(servers, Resolver{addr: a.A.String() + ":53", protocols: proto})
+		}
+	}
+	if len(servers) > 0 {
+		return
+	}
+	// glueless delegation
+	for _, ns := range nsNames {
+		var addrRep *dns.Msg
+		addrRep, err = s.iterate(ctx, dns.Question{Name: ns, Qtype: dns.TypeA, Qclass: dns.ClassINET}, rootResolvers, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, rr := range addrRep.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				servers = uniqueAppendResolver(servers, Resolver{addr: a.A.String() + ":53", protocols: proto})
+			}
+		}
+		if len(servers) > 0 {
+			return servers, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no address for delegated name servers")
+	}
+	return nil, err
+}
+
+// referral returns the delegated zone and its name servers if rep is a referral to a zone below zone,
+// which is also an ancestor of qname.
+func referral(rep *dns.Msg, zone, qname string) (cut string, nsNames []string) {
+	for _, rr := range rep.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		if !dns.IsSubDomain(zone, ns.Hdr.Name) || !dns.IsSubDomain(ns.Hdr.Name, qname) || strings.EqualFold(ns.Hdr.Name, zone) {
+			continue
+		}
+		cut = ns.Hdr.Name
+		nsNames = append(nsNames, ns.Ns)
+	}
+	return
+}
+
+// minimizedNames returns the names to query in order, e.g. `com.`, `example.com.`, `www.example.com.`.
+func minimizedNames(qname string) []string {
+	qname = dns.Fqdn(qname)
+	if qname == "." {
+		return []string{"."}
+	}
+	idx := dns.Split(qname)
+	names := make([]string, len(idx))
+	for i, off := range idx {
+		names[len(idx)-1-i] = qname[off:]
+	}
+	return names
+}
+
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
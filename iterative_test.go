@@ -0,0 +1,42 @@
+package gochinadns
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMinimizedNames(t *testing.T) {
+	tests := []struct {
+		qname string
+		want  []string
+	}{
+		{".", []string{"."}},
+		{"com", []string{"com."}},
+		{"www.example.com.", []string{"com.", "example.com.", "www.example.com."}},
+	}
+	for _, tt := range tests {
+		if got := minimizedNames(tt.qname); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("minimizedNames(%q) = %v, want %v", tt.qname, got, tt.want)
+		}
+	}
+}
+
+func TestReferral(t *testing.T) {
+	rep := new(dns.Msg)
+	ns1, _ := dns.NewRR("example.com. 3600 IN NS a.iana-servers.net.")
+	ns2, _ := dns.NewRR("example.com. 3600 IN NS b.iana-servers.net.")
+	rep.Ns = []dns.RR{ns1, ns2}
+
+	cut, names := referral(rep, "com.", "www.example.com.")
+	if cut != "example.com." || !reflect.DeepEqual(names, []string{"a.iana-servers.net.", "b.iana-servers.net."}) {
+		t.Errorf("unexpected referral %s %v", cut, names)
+	}
+	if cut, _ := referral(rep, "example.com.", "www.example.com."); cut != "" {
+		t.Error("NS records of the current zone are not a referral")
+	}
+	if cut, _ := referral(rep, "com.", "www.example.org."); cut != "" {
+		t.Error("A zone which is not an ancestor of qname is not a referral")
+	}
+}
@@ -0,0 +1,216 @@
+package gochinadns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// _maxJSONReply bounds the body of a reply of a JSON resolver.
+const _maxJSONReply = 64 << 10
+
+// jsonReply is a reply of a JSON resolve API, such as https://dns.google/resolve or https://dns.alidns.com/resolve.
+// Its question is left out, since it's a list of some providers and an object of others.
+type jsonReply struct {
+	Status    int
+	TC        bool
+	RA        bool
+	AD        bool
+	CD        bool
+	Answer    []jsonRR
+	Authority []jsonRR
+}
+
+// jsonRR is a record of a jsonReply, whose data is in the presentation format.
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// isJSON reports whether the resolver is queried over a JSON resolve API, such as json@https://dns.google/resolve.
+func (r Resolver) isJSON() bool {
+	return len(r.protocols) == 1 && r.protocols[0] == "json"
+}
+
+// checkJSON checks that the resolver of the json protocol has no other protocols, and is at an HTTP(S) URL.
+func (r Resolver) checkJSON() error {
+	if len(r.protocols) > 1 {
+		return errors.New("json can't be combined with other protocols")
+	}
+	u, err := url.Parse(r.addr)
+	if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return errors.Errorf("Invalid URL of json resolver [%s]", r.addr)
+	}
+	return nil
+}
+
+// jsonIP returns the IP of the host of the URL of a JSON resolver, resolved with the system resolver if it's a name,
+// so that the resolver is told to be in China or not like any other.
+func (r Resolver) jsonIP() (string, error) {
+	u, err := url.Parse(r.addr)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid URL of json resolver [%s]", r.addr)
+	}
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), _bootstrapTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", errors.Wrapf(err, "fail to resolve resolver %s", host)
+	}
+	if len(ips) == 0 {
+		return "", errors.Errorf("fail to resolve resolver %s", host)
+	}
+	return ips[0].IP.String(), nil
+}
+
+// LookupJSON looks up req at the JSON resolve API of server, which some providers, such as Google and AliDNS, serve
+// next to DNS over HTTPS, and which gets through some networks throttling DoH. The reply is converted to a dns.Msg,
+// so that it's judged like those of other resolvers. Records which fail to convert are left out.
+// Mutation doesn't apply to it, since its queries are not in wire format.
+func (s *Server) LookupJSON(ctx context.Context, req *dns.Msg, server Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	logger := s.upstreamLog.WithFields(map[string]interface{}{
+		"question": questionString(&req.Question[0]),
+		"server":   server,
+	})
+	retry := s.retryPolicy()
+	cli := s.upstreamClient(retry, s.TCPCli, server)
+	client := s.jsonClient(cli, server)
+	query := jsonQuery(req, server.addr)
+
+	logger.Debug("Query upstream json")
+	t := time.Now()
+	err = retry.do(ctx, logger, func() (err error) {
+		reply, err = s.exchangeJSON(ctx, client, cli.Timeout, query, req)
+		if err == nil {
+			err = s.rcodeFailure(reply, nil)
+		}
+		return
+	})
+	rtt = time.Since(t)
+	if err != nil && ctx.Err() == nil {
+		logger.WithError(err).Error("Fail to send json query.")
+	}
+	return
+}
+
+// jsonClient returns the HTTP client of server, whose connections are kept alive across queries, with sockets
+// dialed like those of cli.
+func (s *Server) jsonClient(cli *dns.Client, server Resolver) *http.Client {
+	if client, ok := s.jsonConns.Load(server.addr); ok {
+		return client.(*http.Client)
+	}
+	dialer := cli.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: cli.Timeout}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	client, _ := s.jsonConns.LoadOrStore(server.addr, &http.Client{Transport: transport})
+	return client.(*http.Client)
+}
+
+// jsonQuery returns the URL querying req at the JSON resolve API at addr, with the DO and CD bits, and the client
+// subnet of req if any.
+func jsonQuery(req *dns.Msg, addr string) string {
+	q := req.Question[0]
+	params := url.Values{}
+	params.Set("name", q.Name)
+	params.Set("type", strconv.Itoa(int(q.Qtype)))
+	if req.CheckingDisabled {
+		params.Set("cd", "1")
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		if opt.Do() {
+			params.Set("do", "1")
+		}
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				params.Set("edns_client_subnet", fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask))
+			}
+		}
+	}
+	return addr + "?" + params.Encode()
+}
+
+// exchangeJSON sends query to a JSON resolve API in timeout, and returns its reply converted to a reply to req.
+// It gives up once ctx is done, and returns the error of ctx.
+func (s *Server) exchangeJSON(ctx context.Context, client *http.Client, timeout time.Duration, query string, req *dns.Msg) (*dns.Msg, error) {
+	tctx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		tctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	r, err := http.NewRequestWithContext(tctx, http.MethodGet, query, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to create json query")
+	}
+	r.Header.Set("Accept", "application/dns-json")
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, interrupted(ctx, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, _maxJSONReply))
+		return nil, errors.Errorf("json resolver replies %s", resp.Status)
+	}
+	var jr jsonReply
+	if err := json.NewDecoder(io.LimitReader(resp.Body, _maxJSONReply)).Decode(&jr); err != nil {
+		return nil, interrupted(ctx, errors.Wrap(err, "fail to decode json reply"))
+	}
+	return jr.msg(req), nil
+}
+
+// msg returns the reply converted to a reply to req.
+func (jr *jsonReply) msg(req *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Rcode = jr.Status
+	reply.Truncated = jr.TC
+	reply.RecursionAvailable = jr.RA
+	reply.AuthenticatedData = jr.AD
+	reply.CheckingDisabled = jr.CD
+	reply.Answer = jsonRRs(jr.Answer)
+	reply.Ns = jsonRRs(jr.Authority)
+	return reply
+}
+
+// jsonRRs returns records of the JSON records which convert.
+func jsonRRs(records []jsonRR) []dns.RR {
+	var rrs []dns.RR
+	for _, record := range records {
+		typ, ok := dns.TypeToString[record.Type]
+		if !ok {
+			continue
+		}
+		data := record.Data
+		// some providers give TXT strings without quotes.
+		if record.Type == dns.TypeTXT && !strings.HasPrefix(data, `"`) {
+			data = strconv.Quote(data)
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(record.Name), record.TTL, typ, data))
+		if err != nil || rr == nil {
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
@@ -0,0 +1,109 @@
+package gochinadns
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLookupJSON(t *testing.T) {
+	queries := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.RawQuery
+		name := r.URL.Query().Get("name")
+		switch name {
+		case "www.example.com.":
+			fmt.Fprintf(w, `{"Status":0,"TC":false,"RD":true,"RA":true,"AD":false,"CD":false,
+"Question":{"name":"%s","type":1},
+"Answer":[{"name":"www.example.com","TTL":300,"type":5,"data":"cdn.example.com."},
+{"name":"cdn.example.com.","TTL":60,"type":1,"data":"1.2.3.4"},
+{"name":"cdn.example.com.","TTL":60,"type":65280,"data":"private"}]}`, name)
+		case "txt.example.com.":
+			fmt.Fprint(w, `{"Status":0,"Answer":[{"name":"txt.example.com.","TTL":60,"type":16,"data":"v=spf1 -all"}]}`)
+		case "missing.example.com.":
+			fmt.Fprint(w, `{"Status":3,"Authority":[{"name":"example.com.","TTL":60,"type":6,"data":"ns.example.com. admin.example.com. 1 3600 600 86400 60"}]}`)
+		default:
+			http.Error(w, "throttled", http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("json@"+srv.URL+"/resolve"),
+		WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := s.options().TrustedServers[0]
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	reply, _, err := s.LookupMutated(s.ctx, req, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := <-queries; q != "do=1&name=www.example.com.&type=1" {
+		t.Errorf("Query = %s, want do=1&name=www.example.com.&type=1", q)
+	}
+	if reply.Id != req.Id || len(reply.Answer) != 2 || !reply.RecursionAvailable {
+		t.Fatalf("Reply = %v, want CNAME and A of the query", reply)
+	}
+	if ips := answerIPs(reply); len(ips) != 1 || ips[0].String() != "1.2.3.4" {
+		t.Errorf("Addresses = %v, want 1.2.3.4", ips)
+	}
+
+	req.SetQuestion("txt.example.com.", dns.TypeTXT)
+	if reply, _, err = s.LookupMutated(s.ctx, req, server); err != nil {
+		t.Fatal(err)
+	}
+	<-queries
+	if len(reply.Answer) != 1 || reply.Answer[0].(*dns.TXT).Txt[0] != "v=spf1 -all" {
+		t.Errorf("Answer = %v, want v=spf1 -all", reply.Answer)
+	}
+
+	req.SetQuestion("missing.example.com.", dns.TypeA)
+	if reply, _, err = s.LookupMutated(s.ctx, req, server); err != nil {
+		t.Fatal(err)
+	}
+	<-queries
+	if reply.Rcode != dns.RcodeNameError || len(reply.Ns) != 1 {
+		t.Errorf("Reply = %v, want NXDOMAIN with SOA", reply)
+	}
+
+	req.SetQuestion("throttled.example.com.", dns.TypeA)
+	if _, _, err = s.LookupMutated(s.ctx, req, server); err == nil {
+		t.Error("HTTP error should fail")
+	}
+	<-queries
+
+	// replies of JSON resolvers are judged and served like any other.
+	w := new(explainWriter)
+	req = new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	s.Serve(w, req)
+	if w.reply == nil || len(answerIPs(w.reply)) != 1 {
+		t.Errorf("Reply to client = %v, want 1.2.3.4", w.reply)
+	}
+
+	for _, schema := range []string{
+		"json+udp@https://dns.google/resolve",
+		"json@8.8.8.8:53",
+		"json@ftp://dns.google/resolve",
+	} {
+		if _, err := NewResolver(schema); err == nil {
+			t.Errorf("Schema %s should fail", schema)
+		}
+	}
+	r, err := NewResolver("json@https://223.5.5.5/resolve?timeout=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := r.jsonIP(); err != nil || ip != "223.5.5.5" {
+		t.Errorf("IP of %s = %s, %v, want 223.5.5.5", r, ip, err)
+	}
+	if r.Schema() != "json@https://223.5.5.5/resolve?timeout=1s" {
+		t.Errorf("Schema = %s", r.Schema())
+	}
+}
@@ -0,0 +1,395 @@
+package gochinadns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	_kvTimeout = 5 * time.Second //timeout of reading keys
+	_kvWait    = time.Minute     //how long a blocking query of Consul waits for changes
+	_kvRetry   = 5 * time.Second //wait before watching keys again after a failure
+)
+
+// KVStore is a key-value store of configuration shared by servers, such as etcd or Consul, see WithKVConfig.
+type KVStore interface {
+	// List returns values of keys under prefix, keyed by the rest of the keys after prefix.
+	List(ctx context.Context, prefix string) (map[string]string, error)
+	// Watch calls changed whenever keys under prefix may have changed until ctx is done, or it fails.
+	Watch(ctx context.Context, prefix string, changed func()) error
+}
+
+// applyKVConfig applies values of keys of the KV store, see WithKVConfig.
+func (o *serverOptions) applyKVConfig(values map[string]string, name string) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var skipped []string
+	for _, key := range keys {
+		value := values[key]
+		var err error
+		switch key {
+		case "":
+		case "trusted-resolvers", "resolvers":
+			schemas := strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t' })
+			err = o.addResolvers(schemas, key == "trusted-resolvers")
+		case "domain-blacklist":
+			err = o.loadDomainList(&o.DomainBlacklist, DataList([]byte(value)), "domain blacklist of "+name)
+		case "domain-polluted":
+			err = o.loadDomainList(&o.DomainPolluted, DataList([]byte(value)), "polluted domains of "+name)
+		case "bidirectional-exempt":
+			err = o.loadDomainList(&o.DomainBidiExempt, DataList([]byte(value)), "bidirectional exempt domains of "+name)
+		default:
+			skipped = append(skipped, key)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "%s: %s", name, key)
+		}
+	}
+	if len(skipped) > 0 {
+		o.logger(logServer).WithField("kv", name).Warnf("Skip unknown keys: %s.", strings.Join(skipped, ", "))
+	}
+	return nil
+}
+
+// watchKV reloads the server whenever keys of the KV store change, until ctx is done. Failures of watching are
+// retried, with the last options kept.
+func (s *Server) watchKV(ctx context.Context, store KVStore, prefix string) {
+	name := kvName(store, prefix)
+	for {
+		err := store.Watch(ctx, prefix, func() {
+			s.log.Infof("Config of %s changed. Reload.", name)
+			if err := s.Reload(); err != nil {
+				s.log.WithError(err).Error("Fail to reload changed config of the KV store.")
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		s.log.WithError(err).WithField("kv", name).Warnf("Fail to watch config. Retry in %s.", _kvRetry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(_kvRetry):
+		}
+	}
+}
+
+// kvName names prefix of store in logs and the config, without credentials.
+func kvName(store KVStore, prefix string) string {
+	switch store := store.(type) {
+	case nil:
+		return ""
+	case *consulKV:
+		return "consul " + store.addr + "/" + prefix
+	case *etcdKV:
+		return "etcd " + store.endpoint + " " + prefix
+	case fmt.Stringer:
+		return store.String() + " " + prefix
+	}
+	return fmt.Sprintf("%T %s", store, prefix)
+}
+
+// parseKVURL parses the URL of a KV store and its prefix:
+//
+//	consul://[token@]host:port/prefix
+//	etcd://[user:password@]host:port/prefix
+//
+// consul+https and etcd+https connect over HTTPS. Keys of Consul have no leading slash, while those of etcd do.
+func parseKVURL(rawURL string) (KVStore, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, "", errors.Errorf("invalid KV store URL [%s]", redactURL(rawURL))
+	}
+	kind, scheme := u.Scheme, "http"
+	if strings.HasSuffix(kind, "+https") {
+		kind, scheme = strings.TrimSuffix(kind, "+https"), "https"
+	}
+	base := scheme + "://" + u.Host
+	prefix := strings.TrimSuffix(u.Path, "/") + "/"
+	switch kind {
+	case "consul":
+		var token string
+		if u.User != nil {
+			token = u.User.Username()
+		}
+		return ConsulKV(nil, base, token), strings.TrimPrefix(prefix, "/"), nil
+	case "etcd":
+		var user, password string
+		if u.User != nil {
+			user = u.User.Username()
+			password, _ = u.User.Password()
+		}
+		return EtcdKV(nil, base, user, password), prefix, nil
+	}
+	return nil, "", errors.Errorf("invalid KV store URL [%s]: want consul or etcd", redactURL(rawURL))
+}
+
+// ConsulKV returns the KV store of Consul at addr, such as http://127.0.0.1:8500, with the ACL token if it's not
+// empty. Keys are watched by blocking queries. client, or http.DefaultClient if it's nil, should not time out
+// in a minute.
+func ConsulKV(client *http.Client, addr, token string) KVStore {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &consulKV{client: client, addr: strings.TrimSuffix(addr, "/"), token: token}
+}
+
+type consulKV struct {
+	client *http.Client
+	addr   string
+	token  string
+
+	mu    sync.Mutex
+	index string //of the keys listed last, after which they are watched
+}
+
+// get reads keys under prefix, waiting for a change after index if it's not empty, and returns them with the index.
+func (c *consulKV) get(ctx context.Context, prefix, index string) (map[string]string, string, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index != "" {
+		query.Set("index", index)
+		query.Set("wait", _kvWait.String())
+	}
+	req, err := http.NewRequest(http.MethodGet, c.addr+"/v1/kv/"+prefix+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	values := make(map[string]string)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var pairs []struct {
+			Key   string
+			Value []byte
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+			return nil, "", errors.Wrap(err, "fail to decode keys of consul")
+		}
+		for _, pair := range pairs {
+			values[strings.TrimPrefix(pair.Key, prefix)] = string(pair.Value)
+		}
+	case http.StatusNotFound:
+		// no keys under prefix.
+	default:
+		return nil, "", errors.Errorf("unexpected status of consul %s", resp.Status)
+	}
+	return values, resp.Header.Get("X-Consul-Index"), nil
+}
+
+func (c *consulKV) List(ctx context.Context, prefix string) (map[string]string, error) {
+	values, index, err := c.get(ctx, prefix, "")
+	if err == nil {
+		c.mu.Lock()
+		c.index = index
+		c.mu.Unlock()
+	}
+	return values, err
+}
+
+// Watch watches keys after the index listed last, so that changes in between are not missed.
+func (c *consulKV) Watch(ctx context.Context, prefix string, changed func()) error {
+	c.mu.Lock()
+	index := c.index
+	c.mu.Unlock()
+	if index == "" {
+		var err error
+		if _, index, err = c.get(ctx, prefix, ""); err != nil {
+			return err
+		}
+	}
+	for ctx.Err() == nil {
+		_, next, err := c.get(ctx, prefix, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		// the index may also change for keys out of prefix, or go backwards once consul restarts.
+		if next != index {
+			changed()
+		}
+		index = next
+	}
+	return nil
+}
+
+// EtcdKV returns the KV store of etcd v3 at endpoint, such as http://127.0.0.1:2379, over its JSON gateway,
+// authenticated as user if it's not empty. Keys are watched by a stream of the watch API. client, or
+// http.DefaultClient if it's nil, should not time out while keys are watched.
+func EtcdKV(client *http.Client, endpoint, user, password string) KVStore {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &etcdKV{client: client, endpoint: strings.TrimSuffix(endpoint, "/"), user: user, password: password}
+}
+
+type etcdKV struct {
+	client         *http.Client
+	endpoint       string
+	user, password string
+
+	mu       sync.Mutex
+	revision int64 //of the keys listed last, after which they are watched
+}
+
+// post posts the JSON of in to the API at path, authenticated as user if there is one, and returns the response,
+// which is closed by the caller.
+func (e *etcdKV) post(ctx context.Context, path string, in interface{}) (*http.Response, error) {
+	if e.user == "" {
+		return e.do(ctx, path, in, "")
+	}
+	resp, err := e.do(ctx, "/v3/auth/authenticate", map[string]string{"name": e.user, "password": e.password}, "")
+	if err != nil {
+		return nil, err
+	}
+	var auth struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&auth)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to authenticate to etcd")
+	}
+	return e.do(ctx, path, in, auth.Token)
+}
+
+func (e *etcdKV) do(ctx context.Context, path string, in interface{}, token string) (*http.Response, error) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, errors.Errorf("unexpected status of etcd %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return resp, nil
+}
+
+// etcdRange returns the key range of keys under prefix, whose end is prefix with the last byte incremented.
+func etcdRange(prefix string) map[string][]byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			end = end[:i+1]
+			break
+		}
+	}
+	return map[string][]byte{"key": []byte(prefix), "range_end": end}
+}
+
+func (e *etcdKV) List(ctx context.Context, prefix string) (map[string]string, error) {
+	resp, err := e.post(ctx, "/v3/kv/range", etcdRange(prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var r struct {
+		Header struct {
+			Revision int64 `json:"revision,string"`
+		} `json:"header"`
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, errors.Wrap(err, "fail to decode keys of etcd")
+	}
+	values := make(map[string]string, len(r.Kvs))
+	for _, kv := range r.Kvs {
+		values[strings.TrimPrefix(string(kv.Key), prefix)] = string(kv.Value)
+	}
+	e.mu.Lock()
+	e.revision = r.Header.Revision
+	e.mu.Unlock()
+	return values, nil
+}
+
+// Watch watches keys after the revision listed last, so that changes in between are not missed.
+func (e *etcdKV) Watch(ctx context.Context, prefix string, changed func()) error {
+	e.mu.Lock()
+	revision := e.revision
+	e.mu.Unlock()
+	create := map[string]interface{}{}
+	for k, v := range etcdRange(prefix) {
+		create[k] = v
+	}
+	if revision > 0 {
+		create["start_revision"] = strconv.FormatInt(revision+1, 10)
+	}
+	resp, err := e.post(ctx, "/v3/watch", map[string]interface{}{"create_request": create})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Canceled bool              `json:"canceled"`
+				Reason   string            `json:"cancel_reason"`
+				Events   []json.RawMessage `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "fail to decode events of etcd")
+		}
+		switch {
+		case msg.Error != nil:
+			return errors.Errorf("watch of etcd failed: %s", msg.Error.Message)
+		case msg.Result.Canceled:
+			// such as if the revision is compacted. Keys are read again on reload.
+			e.mu.Lock()
+			e.revision = 0
+			e.mu.Unlock()
+			changed()
+			return errors.Errorf("watch of etcd canceled: %s", msg.Result.Reason)
+		case len(msg.Result.Events) > 0:
+			changed()
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConsul is the KV API of Consul with blocking queries, which requires the ACL token.
+type testConsul struct {
+	token string
+
+	mu      sync.Mutex
+	index   int
+	values  map[string]string
+	changed chan struct{} //closed once values change
+}
+
+func (c *testConsul) set(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *testConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Consul-Token") != c.token {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+		return
+	}
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	c.mu.Lock()
+	if index := r.FormValue("index"); index == strconv.Itoa(c.index) {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		c.mu.Lock()
+	}
+	defer c.mu.Unlock()
+	type pair struct {
+		Key   string
+		Value []byte
+	}
+	var pairs []pair
+	for key, value := range c.values {
+		if strings.HasPrefix(key, prefix) {
+			pairs = append(pairs, pair{key, []byte(value)})
+		}
+	}
+	w.Header().Set("X-Consul-Index", strconv.Itoa(c.index))
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func TestConsulKVConfig(t *testing.T) {
+	consul := &testConsul{token: "secret", index: 1, changed: make(chan struct{}), values: map[string]string{
+		"chinadns/trusted-resolvers": "udp@" + startTestUpstream(t, "1.2.3.4"),
+		"chinadns/domain-blacklist":  "blocked.example\n",
+		"chinadns/unknown":           "x",
+		"other/resolvers":            "udp@8.8.8.8:53",
+	}}
+	srv := httptest.NewServer(consul)
+	defer srv.Close()
+
+	url := "consul://secret@" + strings.TrimPrefix(srv.URL, "http://") + "/chinadns"
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithKVConfigURL(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.Config()
+	if len(c.TrustedResolvers) != 1 || len(c.UntrustedResolvers) != 0 || c.Lists.DomainBlacklist != 1 {
+		t.Fatalf("Config of keys = %+v, want a trusted resolver and a blacklisted domain", c)
+	}
+	if want := "consul " + srv.URL + "/chinadns/"; c.KVConfig != want {
+		t.Errorf("Config().KVConfig = %s, want %s", c.KVConfig, want)
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	consul.set("chinadns/domain-blacklist", "blocked.example\nblocked.example.org\n")
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := s.options().DomainBlacklist.Match("www.blocked.example.org."); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Changed keys should reload the server")
+		}
+	}
+
+	if err := WithKVConfigURL("consul://secret@" + strings.TrimPrefix(srv.URL, "http://") + "/missing")(new(serverOptions)); err != nil {
+		t.Errorf("Config of a missing prefix = %v, want no keys", err)
+	}
+	if err := WithKVConfigURL("consul://" + strings.TrimPrefix(srv.URL, "http://") + "/chinadns")(new(serverOptions)); err == nil {
+		t.Error("Config without the ACL token should fail")
+	}
+	for _, url := range []string{"redis://127.0.0.1/chinadns", "consul://127.0.0.1:8500", "etcd:///chinadns"} {
+		if _, _, err := parseKVURL(url); err == nil {
+			t.Errorf("KV store URL %s should fail", url)
+		}
+	}
+}
+
+func TestEtcdKVConfig(t *testing.T) {
+	upstream := "udp@" + startTestUpstream(t, "1.2.3.4")
+	var (
+		mu      sync.Mutex
+		ranges  int
+		watches []string //start revisions of watches
+	)
+	event := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v3/auth/authenticate" {
+			var auth map[string]string
+			json.NewDecoder(r.Body).Decode(&auth)
+			if auth["name"] != "root" || auth["password"] != "pass" {
+				http.Error(w, `{"error":"authentication failed"}`, http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"token":"tok"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "tok" {
+			http.Error(w, `{"error":"user name is empty"}`, http.StatusUnauthorized)
+			return
+		}
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			// prefix /chinadns/ ends with /chinadns0.
+			if req["key"] != "L2NoaW5hZG5zLw==" || req["range_end"] != "L2NoaW5hZG5zMA==" {
+				t.Errorf("Range of keys = %v", req)
+			}
+			mu.Lock()
+			ranges++
+			mu.Unlock()
+			b, _ := json.Marshal(map[string]interface{}{
+				"header": map[string]string{"revision": "41"},
+				"kvs": []map[string][]byte{
+					{"key": []byte("/chinadns/resolvers"), "value": []byte(upstream + ",udp@114.114.114.114:53")},
+					{"key": []byte("/chinadns/domain-polluted"), "value": []byte("google.com\n")},
+				},
+			})
+			w.Write(b)
+		case "/v3/watch":
+			create, _ := req["create_request"].(map[string]interface{})
+			mu.Lock()
+			watches = append(watches, fmt.Sprint(create["start_revision"]))
+			mu.Unlock()
+			fmt.Fprintln(w, `{"result":{"header":{"revision":"41"},"created":true}}`)
+			w.(http.Flusher).Flush()
+			select {
+			case <-event:
+				fmt.Fprintln(w, `{"result":{"header":{"revision":"42"},"events":[{"kv":{"key":"L2NoaW5hZG5zL3Jlc29sdmVycw=="}}]}}`)
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer srv.Close()
+
+	url := "etcd://root:pass@" + strings.TrimPrefix(srv.URL, "http://") + "/chinadns"
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithKVConfigURL(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.Config()
+	if n := len(c.TrustedResolvers) + len(c.UntrustedResolvers); n != 2 || c.Lists.DomainPolluted != 1 {
+		t.Fatalf("Config of keys = %+v, want 2 resolvers and a polluted domain", c)
+	}
+	if strings.Contains(c.KVConfig, "pass") {
+		t.Errorf("Config().KVConfig = %s, want no password", c.KVConfig)
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := len(watches)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Keys should be watched once the server starts")
+		}
+	}
+	close(event)
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := ranges
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Events of keys should reload the server")
+		}
+	}
+	mu.Lock()
+	if watches[0] != "42" {
+		t.Errorf("Keys are watched from revision %s, want 42 after the listed one", watches[0])
+	}
+	mu.Unlock()
+
+	if err := WithKVConfigURL("etcd://root:wrong@" + strings.TrimPrefix(srv.URL, "http://") + "/chinadns")(new(serverOptions)); err == nil {
+		t.Error("Config with a wrong password should fail")
+	}
+}
@@ -0,0 +1,69 @@
+package gochinadns
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Actions on queries which exceed the concurrency limit, see WithMaxConcurrency.
+const (
+	OverloadServfail = "servfail" //answer SERVFAIL, so that clients fail fast or try another server
+	OverloadDrop     = "drop"     //answer nothing, so that clients time out as if the server were down
+)
+
+// errOverloaded is returned for queries which exceed the concurrency limit.
+var errOverloaded = errors.New("too many queries in flight")
+
+// limiter bounds resolutions in flight, with a queue of those waiting for a slot.
+type limiter struct {
+	slots   chan struct{}
+	queue   int32 //max number of resolutions waiting for a slot
+	waiting int32
+}
+
+func newLimiter(max, queue int) *limiter {
+	return &limiter{slots: make(chan struct{}, max), queue: int32(queue)}
+}
+
+// acquire takes a slot, waiting in the queue for at most timeout if there is none free.
+// It reports false if the queue is full or no slot is freed in time. All methods are no-op on a nil *limiter.
+func (l *limiter) acquire(timeout time.Duration) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if atomic.AddInt32(&l.waiting, 1) > l.queue {
+		atomic.AddInt32(&l.waiting, -1)
+		return false
+	}
+	defer atomic.AddInt32(&l.waiting, -1)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// inFlight returns the number of resolutions in flight and waiting for a slot.
+func (l *limiter) inFlight() (running, waiting int) {
+	if l == nil {
+		return 0, 0
+	}
+	return len(l.slots), int(atomic.LoadInt32(&l.waiting))
+}
@@ -0,0 +1,41 @@
+package gochinadns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(2, 1)
+	if !l.acquire(0) || !l.acquire(0) {
+		t.Fatal("free slots are not acquired")
+	}
+
+	acquired := make(chan bool)
+	go func() { acquired <- l.acquire(time.Second) }()
+	for {
+		if _, waiting := l.inFlight(); waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if l.acquire(time.Second) {
+		t.Error("slot is acquired while the queue is full")
+	}
+	l.release()
+	if !<-acquired {
+		t.Error("queued acquire fails after a slot is released")
+	}
+	if l.acquire(10 * time.Millisecond) {
+		t.Error("slot is acquired while all are taken")
+	}
+	if running, waiting := l.inFlight(); running != 2 || waiting != 0 {
+		t.Errorf("inFlight() = %d, %d, want 2, 0", running, waiting)
+	}
+
+	var none *limiter
+	if !none.acquire(0) {
+		t.Error("nil limiter should not limit")
+	}
+	none.release()
+}
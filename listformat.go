@@ -0,0 +1,297 @@
+package gochinadns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// Formats of domain lists and CIDR lists, see ReadList and WriteList.
+const (
+	ListDomains   = "domains"   //one domain per line, the format of domain lists
+	ListHosts     = "hosts"     //hosts file, where names after IPs are domains
+	ListDnsmasq   = "dnsmasq"   //dnsmasq conf of server=/domain/ip lines, such as dnsmasq-china-list
+	ListAutoProxy = "autoproxy" //AutoProxy rules such as gfwlist, either plain or base64 encoded
+	ListCIDR      = "cidr"      //one CIDR or IP per line, the format of the China route list and the IP blacklist
+)
+
+// isCIDRList reports whether format is a list of CIDRs rather than domains.
+func isCIDRList(format string) bool {
+	return format == ListCIDR
+}
+
+func checkListFormat(format string) error {
+	switch format {
+	case ListDomains, ListHosts, ListDnsmasq, ListAutoProxy, ListCIDR:
+		return nil
+	default:
+		return errors.Errorf("unknown list format [%s]", format)
+	}
+}
+
+// DetectListFormat guesses the format of a list by its content.
+func DetectListFormat(b []byte) string {
+	if decoded, ok := decodeAutoProxy(b); ok && bytes.Contains(decoded, []byte("[AutoProxy")) {
+		return ListAutoProxy
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "[AutoProxy") || strings.HasPrefix(line, "||"):
+			return ListAutoProxy
+		case strings.Contains(line, "=/"):
+			return ListDnsmasq
+		case net.ParseIP(fields[0]) != nil && len(fields) > 1:
+			return ListHosts
+		case net.ParseIP(fields[0]) != nil || strings.Contains(fields[0], "/"):
+			return ListCIDR
+		default:
+			return ListDomains
+		}
+	}
+	return ListDomains
+}
+
+// ReadList reads entries of a list in format, detected by DetectListFormat if it's empty: domains for domain lists,
+// or CIDRs for CIDR lists. Comments, whitelist rules of AutoProxy and invalid entries are skipped.
+// The format read is returned along with entries.
+func ReadList(r io.Reader, format string) (entries []string, _ string, err error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, format, err
+	}
+	if format == "" {
+		format = DetectListFormat(b)
+	}
+	if err := checkListFormat(format); err != nil {
+		return nil, format, err
+	}
+	if format == ListAutoProxy {
+		if decoded, ok := decodeAutoProxy(b); ok {
+			b = decoded
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		switch format {
+		case ListDomains:
+			entries = appendDomain(entries, strings.Fields(line)[0])
+		case ListHosts:
+			for _, name := range strings.Fields(line)[1:] {
+				if name[0] == '#' {
+					break
+				}
+				entries = appendDomain(entries, name)
+			}
+		case ListDnsmasq:
+			// server=/a.com/b.com/114.114.114.114, ipset=/a.com/set, address=/a.com/
+			if idx := strings.IndexByte(line, '/'); idx >= 0 {
+				fields := strings.Split(line[idx+1:], "/")
+				for _, name := range fields[:len(fields)-1] {
+					entries = appendDomain(entries, name)
+				}
+			}
+		case ListAutoProxy:
+			entries = appendDomain(entries, autoProxyDomain(line))
+		case ListCIDR:
+			if cidr := parseCIDR(strings.Fields(line)[0]); cidr != nil {
+				entries = append(entries, cidr.String())
+			}
+		}
+	}
+	return entries, format, scanner.Err()
+}
+
+// decodeAutoProxy decodes base64 encoded AutoProxy rules, such as gfwlist.txt.
+func decodeAutoProxy(b []byte) ([]byte, bool) {
+	compact := bytes.Join(bytes.Fields(b), nil)
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(compact)))
+	n, err := base64.StdEncoding.Decode(decoded, compact)
+	if err != nil || n == 0 {
+		return nil, false
+	}
+	return decoded[:n], true
+}
+
+// autoProxyDomain returns the domain of an AutoProxy rule, or empty if it has none.
+// Rules: https://github.com/gfwlist/gfwlist/wiki/Syntax
+func autoProxyDomain(rule string) string {
+	switch {
+	case rule[0] == '!' || rule[0] == '[': // comment or header
+		return ""
+	case strings.HasPrefix(rule, "@@"): // whitelist
+		return ""
+	case rule[0] == '/': // regular expression
+		return ""
+	}
+	rule = strings.TrimLeft(rule, "|")
+	if idx := strings.Index(rule, "://"); idx >= 0 {
+		rule = rule[idx+3:]
+	}
+	rule = strings.TrimLeft(rule, ".")
+	if idx := strings.IndexAny(rule, "/^|"); idx >= 0 {
+		rule = rule[:idx]
+	}
+	if host, _, err := net.SplitHostPort(rule); err == nil {
+		rule = host
+	}
+	if strings.ContainsAny(rule, "*%") {
+		return ""
+	}
+	return rule
+}
+
+// appendDomain appends name to domains if it's a domain name with at least two labels and not an IP.
+func appendDomain(domains []string, name string) []string {
+	name = strings.ToLower(strings.Trim(name, "."))
+	if !strings.Contains(name, ".") || net.ParseIP(name) != nil {
+		return domains
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return domains
+	}
+	return append(domains, name)
+}
+
+// parseCIDR parses a CIDR or an IP, which is a network of a single address.
+func parseCIDR(s string) *net.IPNet {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	l := 8 * len(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(l, l)}
+}
+
+// MergeLists merges entries of lists in format into one sorted list without duplicates.
+// Domains covered by their parent domains, and CIDRs covered by larger ones, are dropped.
+func MergeLists(format string, lists ...[]string) []string {
+	if isCIDRList(format) {
+		return mergeCIDRs(lists)
+	}
+	trie := new(domainTrie)
+	seen := make(map[string]bool)
+	var domains []string
+	for _, list := range lists {
+		for _, domain := range list {
+			if !seen[domain] {
+				seen[domain] = true
+				domains = append(domains, domain)
+			}
+		}
+	}
+	// add parents first, so that subdomains are found covered.
+	sort.Slice(domains, func(i, j int) bool {
+		return strings.Count(domains[i], ".") < strings.Count(domains[j], ".")
+	})
+	merged := domains[:0]
+	for _, domain := range domains {
+		if trie.Contain(domain) {
+			continue
+		}
+		trie.Add(domain)
+		merged = append(merged, domain)
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+func mergeCIDRs(lists [][]string) []string {
+	var networks []*net.IPNet
+	for _, list := range lists {
+		for _, s := range list {
+			if network := parseCIDR(s); network != nil {
+				networks = append(networks, network)
+			}
+		}
+	}
+	// larger networks come first among networks of the same address, so that smaller ones are found covered.
+	sort.Slice(networks, func(i, j int) bool {
+		a, b := networks[i], networks[j]
+		if len(a.IP) != len(b.IP) {
+			return len(a.IP) < len(b.IP)
+		}
+		if c := bytes.Compare(a.IP, b.IP); c != 0 {
+			return c < 0
+		}
+		onesA, _ := a.Mask.Size()
+		onesB, _ := b.Mask.Size()
+		return onesA < onesB
+	})
+	var merged []string
+	var last *net.IPNet
+	for _, network := range networks {
+		if last != nil && len(last.IP) == len(network.IP) && last.Contains(network.IP) {
+			continue
+		}
+		last = network
+		merged = append(merged, network.String())
+	}
+	return merged
+}
+
+// WriteList writes entries to w in format, one per line. dnsmasqServer is the upstream of server= lines of dnsmasq conf.
+func WriteList(w io.Writer, format string, entries []string, dnsmasqServer string) error {
+	if err := checkListFormat(format); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if format == ListAutoProxy {
+		fmt.Fprintln(bw, "[AutoProxy 0.2.9]")
+	}
+	for _, entry := range entries {
+		switch format {
+		case ListDomains, ListCIDR:
+			fmt.Fprintln(bw, entry)
+		case ListHosts:
+			fmt.Fprintf(bw, "0.0.0.0 %s\n", entry)
+		case ListDnsmasq:
+			fmt.Fprintf(bw, "server=/%s/%s\n", entry, dnsmasqServer)
+		case ListAutoProxy:
+			fmt.Fprintf(bw, "||%s\n", entry)
+		}
+	}
+	return bw.Flush()
+}
+
+// CheckListConversion returns an error if lists cannot be converted from one format to the other,
+// which is the case between domain lists and CIDR lists.
+func CheckListConversion(from, to string) error {
+	for _, format := range []string{from, to} {
+		if format == "" {
+			continue
+		}
+		if err := checkListFormat(format); err != nil {
+			return err
+		}
+	}
+	if from != "" && isCIDRList(from) != isCIDRList(to) {
+		return errors.Errorf("cannot convert a list from %s to %s", from, to)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package gochinadns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadList(t *testing.T) {
+	gfwlist := "[AutoProxy 0.2.9]\n! comment\n||google.com\n|https://www.example.org/path\n.twitter.com\n@@||baidu.com\n/^https?:\\/\\/[^\\/]+blogspot\\.(.*)/\n*.wildcard.com\n"
+	cases := []struct {
+		name, input, format, want string
+		entries                   []string
+	}{
+		{"domains", "a.com\n# comment\n.b.com.\nlocalhost\n", "", ListDomains, []string{"a.com", "b.com"}},
+		{"hosts", "127.0.0.1 localhost\n0.0.0.0 ads.a.com ads.b.com # comment\n", "", ListHosts, []string{"ads.a.com", "ads.b.com"}},
+		{"dnsmasq", "server=/a.com/114.114.114.114\nipset=/b.com/c.com/china\n", "", ListDnsmasq, []string{"a.com", "b.com", "c.com"}},
+		{"autoproxy", gfwlist, "", ListAutoProxy, []string{"google.com", "www.example.org", "twitter.com"}},
+		{"autoproxy base64", base64.StdEncoding.EncodeToString([]byte(gfwlist)), "", ListAutoProxy, []string{"google.com", "www.example.org", "twitter.com"}},
+		{"cidr", "1.0.1.0/24\n1.2.3.4\n2001:db8::/32\n", "", ListCIDR, []string{"1.0.1.0/24", "1.2.3.4/32", "2001:db8::/32"}},
+		{"explicit", "1.2.3.4 a.com\n", ListHosts, ListHosts, []string{"a.com"}},
+	}
+	for _, c := range cases {
+		entries, format, err := ReadList(strings.NewReader(c.input), c.format)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if format != c.want {
+			t.Errorf("%s: format %s, want %s", c.name, format, c.want)
+		}
+		if !reflect.DeepEqual(entries, c.entries) {
+			t.Errorf("%s: entries %v, want %v", c.name, entries, c.entries)
+		}
+	}
+	if _, _, err := ReadList(strings.NewReader(""), "unknown"); err == nil {
+		t.Error("unknown format is accepted")
+	}
+}
+
+func TestMergeLists(t *testing.T) {
+	domains := MergeLists(ListDomains, []string{"b.com", "a.b.com", "c.com"}, []string{"c.com", "x.y.a.com", "a.com"})
+	if want := []string{"a.com", "b.com", "c.com"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("merged domains %v, want %v", domains, want)
+	}
+	cidrs := MergeLists(ListCIDR, []string{"1.0.1.0/24", "1.0.0.0/16", "2.2.2.2/32"}, []string{"2.2.2.2/32", "2001:db8::/32", "2001:db8:1::/48"})
+	if want := []string{"1.0.0.0/16", "2.2.2.2/32", "2001:db8::/32"}; !reflect.DeepEqual(cidrs, want) {
+		t.Errorf("merged CIDRs %v, want %v", cidrs, want)
+	}
+}
+
+func TestWriteList(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteList(&buf, ListDnsmasq, []string{"a.com", "b.com"}, "114.114.114.114"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "server=/a.com/114.114.114.114\nserver=/b.com/114.114.114.114\n"; buf.String() != want {
+		t.Errorf("dnsmasq output %q, want %q", buf.String(), want)
+	}
+	entries, _, err := ReadList(&buf, "")
+	if err != nil || !reflect.DeepEqual(entries, []string{"a.com", "b.com"}) {
+		t.Errorf("round trip %v, %v", entries, err)
+	}
+
+	if err := CheckListConversion(ListCIDR, ListDomains); err == nil {
+		t.Error("conversion from CIDRs to domains is accepted")
+	}
+	if err := CheckListConversion(ListAutoProxy, ListHosts); err != nil {
+		t.Error(err)
+	}
+}
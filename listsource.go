@@ -0,0 +1,174 @@
+package gochinadns
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ListSource is where a list is read from, such as a file, an HTTP endpoint, an etcd key, or data embedded in
+// the program, see WithCHNListSource. Lists are read in the same format as the files of lists.
+type ListSource interface {
+	// Open opens the list to read, which is closed once it's read.
+	Open() (io.ReadCloser, error)
+	// Watch calls changed whenever the list may have changed until ctx is done, and the server reloads.
+	// It returns at once if the list never changes.
+	Watch(ctx context.Context, changed func()) error
+}
+
+// sourceName names source in errors, by its String method if it has one.
+func sourceName(source ListSource) string {
+	if s, ok := source.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", source)
+}
+
+// FileList returns the source of the list file at path, which is how lists of paths are loaded.
+// It's watched by fsnotify, and changes once the file stays the same for a second.
+func FileList(path string) ListSource {
+	return fileList(path)
+}
+
+type fileList string
+
+func (f fileList) Open() (io.ReadCloser, error) {
+	return os.Open(string(f))
+}
+
+// Watch watches the directory of the file, since lists are often replaced by renaming.
+func (f fileList) Watch(ctx context.Context, changed func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	path := filepath.Clean(string(f))
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+	timer := time.NewTimer(time.Second)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			return err
+		case event := <-watcher.Events:
+			if filepath.Clean(event.Name) == path && event.Op != fsnotify.Chmod {
+				timer.Reset(time.Second)
+			}
+		case <-timer.C:
+			changed()
+		}
+	}
+}
+
+func (f fileList) String() string {
+	return string(f)
+}
+
+// DataList returns the source of a list in b, such as data embedded in the program, which never changes.
+func DataList(b []byte) ListSource {
+	return dataList(b)
+}
+
+type dataList []byte
+
+func (d dataList) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(d)), nil
+}
+
+func (d dataList) Watch(ctx context.Context, changed func()) error {
+	return nil
+}
+
+func (d dataList) String() string {
+	return fmt.Sprintf("data of %d bytes", len(d))
+}
+
+// HTTPList returns the source of the list at url, fetched by client, or http.DefaultClient if it's nil, which should
+// have a timeout. It's fetched again every interval, and changes if its content does. 0 to never fetch it again.
+func HTTPList(client *http.Client, url string, interval time.Duration) ListSource {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpList{client: client, url: url, interval: interval}
+}
+
+type httpList struct {
+	client   *http.Client
+	url      string
+	interval time.Duration
+
+	mu  sync.Mutex
+	sum [sha256.Size]byte //of the list opened last
+}
+
+func (h *httpList) Open() (io.ReadCloser, error) {
+	b, err := fetchBody(context.Background(), h.client, h.url)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	h.sum = sha256.Sum256(b)
+	h.mu.Unlock()
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Watch fetches the list every interval, and calls changed if it differs from the list opened last.
+// Failures of fetching are skipped until the next interval.
+func (h *httpList) Watch(ctx context.Context, changed func()) error {
+	if h.interval <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		b, err := fetchBody(ctx, h.client, h.url)
+		if err != nil {
+			continue
+		}
+		h.mu.Lock()
+		same := h.sum == sha256.Sum256(b)
+		h.mu.Unlock()
+		if !same {
+			changed()
+		}
+	}
+}
+
+func (h *httpList) String() string {
+	return h.url
+}
+
+// watchList reloads the server whenever source changes, until ctx is done.
+func (s *Server) watchList(ctx context.Context, source ListSource) {
+	name := sourceName(source)
+	err := source.Watch(ctx, func() {
+		s.log.Infof("List %s changed. Reload.", name)
+		if err := s.Reload(); err != nil {
+			s.log.WithError(err).Error("Fail to reload changed list.")
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		s.log.WithError(err).WithField("list", name).Warn("Fail to watch list.")
+	}
+}
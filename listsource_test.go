@@ -0,0 +1,77 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListSources(t *testing.T) {
+	var mu sync.Mutex
+	blacklist := "1.2.3.4\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(blacklist))
+	}))
+	defer srv.Close()
+	source := HTTPList(srv.Client(), srv.URL, 10*time.Millisecond)
+
+	s, err := NewServer(
+		WithListenAddr("127.0.0.1:0"),
+		WithSkipStartupTest(true),
+		WithTrustedResolvers("udp@8.8.8.8:53"),
+		WithCHNListSource(DataList([]byte("1.0.1.0/24\n"))),
+		WithIPBlacklistSource(source),
+		WithDomainBlacklistSource(DataList([]byte("example.com\n"))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.IsChinaIP(net.ParseIP("1.0.1.1")) || !s.IsBlacklistedIP(net.ParseIP("1.2.3.4")) {
+		t.Error("CIDR lists of sources are not loaded")
+	}
+	if !s.options().DomainBlacklist.Contain("www.example.com.") {
+		t.Error("Domain list of the source is not loaded")
+	}
+	if n := len(s.options().ListSources); n != 3 {
+		t.Errorf("%d list sources, want 3", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	go source.Watch(ctx, func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	select {
+	case <-changed:
+		t.Fatal("The list changes before its content does")
+	case <-time.After(50 * time.Millisecond):
+	}
+	mu.Lock()
+	blacklist = "5.6.7.8\n"
+	mu.Unlock()
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("The list doesn't change after its content does")
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if s.IsBlacklistedIP(net.ParseIP("1.2.3.4")) || !s.IsBlacklistedIP(net.ParseIP("5.6.7.8")) {
+		t.Error("The changed list is not loaded on reload")
+	}
+
+	if _, err := NewServer(WithListenAddr("127.0.0.1:0"), WithCHNListSource(DataList([]byte("example.com\n")))); err == nil {
+		t.Error("Invalid CIDRs of the source should fail")
+	}
+}
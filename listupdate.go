@@ -0,0 +1,131 @@
+package gochinadns
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Default sources of lists, see ListUpdate.
+const (
+	ChnroutesURL    = "https://raw.githubusercontent.com/ipverse/rir-ip/master/country/cn/ipv4-aggregated.txt"
+	Chnroutes6URL   = "https://raw.githubusercontent.com/ipverse/rir-ip/master/country/cn/ipv6-aggregated.txt"
+	ChinaDomainsURL = "https://raw.githubusercontent.com/felixonmars/dnsmasq-china-list/master/accelerated-domains.china.conf"
+	GFWListURL      = "https://raw.githubusercontent.com/gfwlist/gfwlist/master/gfwlist.txt"
+)
+
+// _maxListSize is the max size of a downloaded list, to bound memory in case of a wrong URL.
+const _maxListSize = 64 << 20
+
+// ListUpdate updates a list file from URLs. Lists of URLs are fetched, converted and merged into one list
+// in Format, which is written to Path atomically. The file is kept as is if any URL fails,
+// or if the merged list has fewer than MinEntries entries, which catches truncated or wrong downloads.
+type ListUpdate struct {
+	Name       string
+	URLs       []string
+	Path       string
+	Format     string //ListDomains or ListCIDR
+	MinEntries int
+}
+
+// UpdateList fetches and writes the list of u, and returns the number of entries written.
+func UpdateList(ctx context.Context, client *http.Client, u ListUpdate) (int, error) {
+	if u.Path == "" {
+		return 0, errors.Errorf("empty path for %s", u.Name)
+	}
+	lists := make([][]string, 0, len(u.URLs))
+	for _, url := range u.URLs {
+		entries, err := fetchList(ctx, client, url, u.Format)
+		if err != nil {
+			return 0, errors.Wrapf(err, "fail to fetch %s", url)
+		}
+		lists = append(lists, entries)
+	}
+	entries := MergeLists(u.Format, lists...)
+	if len(entries) < u.MinEntries {
+		return 0, errors.Errorf("%s has %d entries, fewer than %d", u.Name, len(entries), u.MinEntries)
+	}
+	var buf bytes.Buffer
+	if err := WriteList(&buf, u.Format, entries, ""); err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(u.Path, buf.Bytes()); err != nil {
+		return 0, errors.Wrapf(err, "fail to write %s", u.Path)
+	}
+	return len(entries), nil
+}
+
+// fetchList downloads the list at url, and reads it in any format which converts to format.
+func fetchList(ctx context.Context, client *http.Client, url, format string) ([]string, error) {
+	b, err := fetchBody(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+	entries, detected, err := ReadList(bytes.NewReader(b), "")
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckListConversion(detected, format); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// fetchBody downloads the content at url, up to _maxListSize bytes.
+func fetchBody(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, _maxListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > _maxListSize {
+		return nil, errors.Errorf("list is larger than %d bytes", _maxListSize)
+	}
+	return b, nil
+}
+
+// writeFileAtomic writes b to a temporary file next to path and renames it to path,
+// so that readers never see a partial file. The mode of an existing file is kept.
+func writeFileAtomic(path string, b []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
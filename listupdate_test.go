@@ -0,0 +1,51 @@
+package gochinadns
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateList(t *testing.T) {
+	lists := map[string]string{
+		"/v4":      "# comment\n1.0.1.0/24\n1.0.2.0/23\n",
+		"/v6":      "2001:250::/35\n",
+		"/dnsmasq": "server=/qq.com/114.114.114.114\nserver=/163.com/114.114.114.114\n",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list, ok := lists[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(list))
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "china.list")
+	u := ListUpdate{Name: "China route list", URLs: []string{ts.URL + "/v4", ts.URL + "/v6"}, Path: path, Format: ListCIDR}
+	n, err := UpdateList(context.Background(), ts.Client(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if want := "1.0.1.0/24\n1.0.2.0/23\n2001:250::/35\n"; n != 3 || string(b) != want {
+		t.Errorf("%d entries written: %q, want %q", n, b, want)
+	}
+
+	for _, bad := range []ListUpdate{
+		{Name: "missing", URLs: []string{ts.URL + "/v4", ts.URL + "/missing"}, Path: path, Format: ListCIDR},
+		{Name: "short", URLs: []string{ts.URL + "/v4"}, Path: path, Format: ListCIDR, MinEntries: 100},
+		{Name: "wrong kind", URLs: []string{ts.URL + "/dnsmasq"}, Path: path, Format: ListCIDR},
+	} {
+		if _, err := UpdateList(context.Background(), ts.Client(), bad); err == nil {
+			t.Errorf("%s: list is updated", bad.Name)
+		}
+		if kept, _ := ioutil.ReadFile(path); string(kept) != string(b) {
+			t.Errorf("%s: list is changed to %q", bad.Name, kept)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package gochinadns
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// LoadQuery is a query of a load test corpus.
+type LoadQuery struct {
+	Name  string
+	Qtype uint16
+}
+
+// ReadLoadCorpus reads a load test corpus of "domain [qtype]" lines, where qtype is A if omitted.
+// Blank lines and lines starting with # are skipped.
+func ReadLoadCorpus(r io.Reader) ([]LoadQuery, error) {
+	var corpus []LoadQuery
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		q := LoadQuery{Name: dns.Fqdn(fields[0]), Qtype: dns.TypeA}
+		if len(fields) > 1 {
+			t, ok := dns.StringToType[strings.ToUpper(fields[1])]
+			if !ok {
+				return nil, errors.Errorf("line %d: unknown query type [%s]", n, fields[1])
+			}
+			q.Qtype = t
+		}
+		corpus = append(corpus, q)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "fail to read corpus")
+	}
+	return corpus, nil
+}
+
+// LoadTestResult is the result of a load test. See LoadTest.
+type LoadTestResult struct {
+	Queries    int            `json:"queries"`
+	Errors     int            `json:"errors"`     //queries without a reply, such as timeouts
+	Rcodes     map[string]int `json:"rcodes"`     //replies by rcode
+	ErrorRate  float64        `json:"error_rate"` //ratio of queries without a reply or answered with SERVFAIL
+	Duration   float64        `json:"duration_s"`
+	QPS        float64        `json:"qps"` //replies per second
+	LatencyP50 float64        `json:"latency_p50_ms"`
+	LatencyP90 float64        `json:"latency_p90_ms"`
+	LatencyP99 float64        `json:"latency_p99_ms"`
+	LatencyMax float64        `json:"latency_max_ms"`
+}
+
+// LoadTest replays corpus in turn against the DNS server at addr over network, udp or tcp, with concurrency clients
+// each sending a query once the last one is answered or times out, until duration passes or ctx is done.
+// Queries answered after that are not counted.
+// Queries are replayed from the start once the corpus runs out.
+func LoadTest(ctx context.Context, addr, network string, corpus []LoadQuery, concurrency int, duration, timeout time.Duration) (*LoadTestResult, error) {
+	if len(corpus) == 0 {
+		return nil, errors.New("corpus is empty")
+	}
+	if concurrency <= 0 {
+		return nil, errors.Errorf("invalid concurrency %d", concurrency)
+	}
+	if network != "udp" && network != "tcp" {
+		return nil, errors.Errorf("invalid network [%s]", network)
+	}
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		next   int
+		rtts   []time.Duration
+		result = &LoadTestResult{Rcodes: make(map[string]int)}
+		wg     sync.WaitGroup
+	)
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cli := &dns.Client{Net: network, Timeout: timeout}
+			req := new(dns.Msg)
+			for ctx.Err() == nil {
+				mu.Lock()
+				q := corpus[next%len(corpus)]
+				next++
+				mu.Unlock()
+				req.SetQuestion(q.Name, q.Qtype)
+				reply, rtt, err := cli.Exchange(req, addr)
+				if ctx.Err() != nil {
+					// answered after the end of the test, which doesn't count.
+					return
+				}
+
+				mu.Lock()
+				result.Queries++
+				if err != nil {
+					result.Errors++
+				} else {
+					result.Rcodes[dns.RcodeToString[reply.Rcode]]++
+					rtts = append(rtts, rtt)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	result.Duration = elapsed.Seconds()
+	result.QPS = float64(len(rtts)) / elapsed.Seconds()
+	if result.Queries > 0 {
+		failed := result.Errors + result.Rcodes[dns.RcodeToString[dns.RcodeServerFailure]]
+		result.ErrorRate = float64(failed) / float64(result.Queries)
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	result.LatencyP50 = percentileMillis(rtts, 0.5)
+	result.LatencyP90 = percentileMillis(rtts, 0.9)
+	result.LatencyP99 = percentileMillis(rtts, 0.99)
+	result.LatencyMax = percentileMillis(rtts, 1)
+	return result, nil
+}
@@ -0,0 +1,46 @@
+package gochinadns
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestReadLoadCorpus(t *testing.T) {
+	corpus, err := ReadLoadCorpus(strings.NewReader("# comment\nexample.com\n\nexample.org aaaa\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LoadQuery{{"example.com.", dns.TypeA}, {"example.org.", dns.TypeAAAA}}
+	if len(corpus) != len(want) || corpus[0] != want[0] || corpus[1] != want[1] {
+		t.Errorf("ReadLoadCorpus() = %v, want %v", corpus, want)
+	}
+	if _, err := ReadLoadCorpus(strings.NewReader("example.com XYZ\n")); err == nil {
+		t.Error("ReadLoadCorpus should fail with an unknown query type")
+	}
+}
+
+func TestLoadTest(t *testing.T) {
+	addr := startTestUpstream(t, "1.2.3.4")
+	corpus := []LoadQuery{{"example.com.", dns.TypeA}, {"example.org.", dns.TypeA}}
+	r, err := LoadTest(context.Background(), addr, "udp", corpus, 4, 200*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Queries == 0 || r.Rcodes["NOERROR"] != r.Queries || r.Errors != 0 || r.ErrorRate != 0 {
+		t.Errorf("LoadTest() = %+v, want all queries answered with NOERROR", r)
+	}
+	if r.QPS <= 0 || r.LatencyP50 <= 0 || r.LatencyP50 > r.LatencyP99 || r.LatencyP99 > r.LatencyMax {
+		t.Errorf("LoadTest() = %+v, want positive QPS and ordered percentiles", r)
+	}
+
+	if _, err := LoadTest(context.Background(), addr, "udp", nil, 4, time.Second, time.Second); err == nil {
+		t.Error("LoadTest should fail with an empty corpus")
+	}
+	if _, err := LoadTest(context.Background(), addr, "quic", corpus, 4, time.Second, time.Second); err == nil {
+		t.Error("LoadTest should fail with an unknown network")
+	}
+}
@@ -0,0 +1,196 @@
+package gochinadns
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is the logging interface of the server. Set it by WithLogger to route logs to other logging libraries.
+type Logger interface {
+	WithField(key string, value interface{}) Logger
+	WithFields(fields map[string]interface{}) Logger
+	WithError(err error) Logger
+
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+	Warn(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NewLogrusLogger adapts a logrus logger or entry to Logger.
+func NewLogrusLogger(l logrus.FieldLogger) Logger {
+	return logrusLogger{l}
+}
+
+type logrusLogger struct {
+	logrus.FieldLogger
+}
+
+func (l logrusLogger) WithField(key string, value interface{}) Logger {
+	return logrusLogger{l.FieldLogger.WithField(key, value)}
+}
+
+func (l logrusLogger) WithFields(fields map[string]interface{}) Logger {
+	return logrusLogger{l.FieldLogger.WithFields(fields)}
+}
+
+func (l logrusLogger) WithError(err error) Logger {
+	return logrusLogger{l.FieldLogger.WithError(err)}
+}
+
+// teeLogger sends logs to both loggers.
+type teeLogger struct {
+	a, b Logger
+}
+
+func (l teeLogger) WithField(key string, value interface{}) Logger {
+	return teeLogger{l.a.WithField(key, value), l.b.WithField(key, value)}
+}
+
+func (l teeLogger) WithFields(fields map[string]interface{}) Logger {
+	return teeLogger{l.a.WithFields(fields), l.b.WithFields(fields)}
+}
+
+func (l teeLogger) WithError(err error) Logger {
+	return teeLogger{l.a.WithError(err), l.b.WithError(err)}
+}
+
+func (l teeLogger) Debug(args ...interface{}) {
+	l.a.Debug(args...)
+	l.b.Debug(args...)
+}
+
+func (l teeLogger) Debugf(format string, args ...interface{}) {
+	l.a.Debugf(format, args...)
+	l.b.Debugf(format, args...)
+}
+
+func (l teeLogger) Info(args ...interface{}) {
+	l.a.Info(args...)
+	l.b.Info(args...)
+}
+
+func (l teeLogger) Infof(format string, args ...interface{}) {
+	l.a.Infof(format, args...)
+	l.b.Infof(format, args...)
+}
+
+func (l teeLogger) Warn(args ...interface{}) {
+	l.a.Warn(args...)
+	l.b.Warn(args...)
+}
+
+func (l teeLogger) Warnf(format string, args ...interface{}) {
+	l.a.Warnf(format, args...)
+	l.b.Warnf(format, args...)
+}
+
+func (l teeLogger) Error(args ...interface{}) {
+	l.a.Error(args...)
+	l.b.Error(args...)
+}
+
+func (l teeLogger) Errorf(format string, args ...interface{}) {
+	l.a.Errorf(format, args...)
+	l.b.Errorf(format, args...)
+}
+
+// Components of which log levels can be set separately by WithLogLevels.
+const (
+	logServer   = "server"   //server lifecycle, admin API and other subsystems
+	logUpstream = "upstream" //upstream lookups and canary checks
+	logVerdict  = "verdict"  //choosing answers and detecting pollution
+	logLists    = "lists"    //loading lists
+)
+
+func checkLogComponent(name string) error {
+	switch name {
+	case logServer, logUpstream, logVerdict, logLists:
+		return nil
+	default:
+		return errors.Errorf("Unknown log component [%s]", name)
+	}
+}
+
+// leveledLogger drops logs less severe than level. The underlying logger still filters logs by its own level.
+type leveledLogger struct {
+	Logger
+	level logrus.Level
+}
+
+func (l leveledLogger) WithField(key string, value interface{}) Logger {
+	return leveledLogger{l.Logger.WithField(key, value), l.level}
+}
+
+func (l leveledLogger) WithFields(fields map[string]interface{}) Logger {
+	return leveledLogger{l.Logger.WithFields(fields), l.level}
+}
+
+func (l leveledLogger) WithError(err error) Logger {
+	return leveledLogger{l.Logger.WithError(err), l.level}
+}
+
+func (l leveledLogger) Debug(args ...interface{}) {
+	if l.level >= logrus.DebugLevel {
+		l.Logger.Debug(args...)
+	}
+}
+
+func (l leveledLogger) Debugf(format string, args ...interface{}) {
+	if l.level >= logrus.DebugLevel {
+		l.Logger.Debugf(format, args...)
+	}
+}
+
+func (l leveledLogger) Info(args ...interface{}) {
+	if l.level >= logrus.InfoLevel {
+		l.Logger.Info(args...)
+	}
+}
+
+func (l leveledLogger) Infof(format string, args ...interface{}) {
+	if l.level >= logrus.InfoLevel {
+		l.Logger.Infof(format, args...)
+	}
+}
+
+func (l leveledLogger) Warn(args ...interface{}) {
+	if l.level >= logrus.WarnLevel {
+		l.Logger.Warn(args...)
+	}
+}
+
+func (l leveledLogger) Warnf(format string, args ...interface{}) {
+	if l.level >= logrus.WarnLevel {
+		l.Logger.Warnf(format, args...)
+	}
+}
+
+func (l leveledLogger) Error(args ...interface{}) {
+	if l.level >= logrus.ErrorLevel {
+		l.Logger.Error(args...)
+	}
+}
+
+func (l leveledLogger) Errorf(format string, args ...interface{}) {
+	if l.level >= logrus.ErrorLevel {
+		l.Logger.Errorf(format, args...)
+	}
+}
+
+// logger returns the logger of the component, with fields set by WithLogFields and its own level if set.
+func (o *serverOptions) logger(component string) Logger {
+	l := o.Logger
+	if len(o.LogFields) > 0 {
+		l = l.WithFields(o.LogFields)
+	}
+	level, ok := o.LogLevels[component]
+	if !ok {
+		return l
+	}
+	return leveledLogger{l, level}
+}
@@ -0,0 +1,50 @@
+package gochinadns
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestLeveledLogger(t *testing.T) {
+	base, hook := test.NewNullLogger()
+	base.SetLevel(logrus.DebugLevel)
+	l := leveledLogger{NewLogrusLogger(base), logrus.WarnLevel}
+
+	l.Debug("dropped")
+	l.WithField("k", "v").Info("dropped")
+	l.WithError(nil).Warn("kept")
+	l.Errorf("%s", "kept")
+	if len(hook.Entries) != 2 {
+		t.Fatalf("Expect 2 entries, got %d", len(hook.Entries))
+	}
+	for _, e := range hook.Entries {
+		if e.Message != "kept" {
+			t.Errorf("Unexpected entry %q", e.Message)
+		}
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	base, hook := test.NewNullLogger()
+	o, err := buildOptions([]ServerOption{
+		WithLogFields(map[string]interface{}{"instance": "lan"}),
+		WithLogger(NewLogrusLogger(base)),
+		WithLogLevels(map[string]string{logVerdict: "warn"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.Reset()
+	o.logger(logServer).Info("server")
+	o.logger(logVerdict).Warn("verdict")
+	if len(hook.Entries) != 2 {
+		t.Fatalf("Expect 2 entries, got %d", len(hook.Entries))
+	}
+	for _, e := range hook.Entries {
+		if e.Data["instance"] != "lan" {
+			t.Errorf("Entry %q has fields %v, want instance=lan", e.Message, e.Data)
+		}
+	}
+}
@@ -2,40 +2,68 @@ package gochinadns
 
 import (
 	"context"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
+// upstreamReply is a DNS reply with the resolver it comes from.
+type upstreamReply struct {
+	*dns.Msg
+	server   Resolver
+	reason   string //why the reply is chosen
+	polluted bool   //the reply is judged polluted by the trust policy
+	raw      []byte //the reply as received, if Msg is unpacked by unpackAnswers; see WithRawForward
+}
+
 // LookupFunc looks up DNS request to the given server and returns DNS reply, its RTT time and an error.
-type LookupFunc func(request *dns.Msg, server resolver) (reply *dns.Msg, rtt time.Duration, err error)
+// It gives up once ctx is done.
+type LookupFunc func(ctx context.Context, request *dns.Msg, server Resolver) (reply *dns.Msg, rtt time.Duration, err error)
+
+// upstreamLookup looks up a query to the given server, and returns the reply, its RTT time and an error.
+type upstreamLookup func(ctx context.Context, server Resolver) (*upstreamReply, time.Duration, error)
+
+// lookupMsg returns an upstreamLookup of req with lookup, which gets a copy of req for every server.
+func lookupMsg(req *dns.Msg, lookup LookupFunc) upstreamLookup {
+	return func(ctx context.Context, server Resolver) (*upstreamReply, time.Duration, error) {
+		reply, rtt, err := lookup(ctx, shareMsg(req), server)
+		if err != nil {
+			return nil, rtt, err
+		}
+		return &upstreamReply{Msg: reply, server: server}, rtt, nil
+	}
+}
 
+// lookupInServers queries stages of servers, see dispatchStages, and sends the first reply to result.
 func lookupInServers(
-	ctx context.Context, cancel context.CancelFunc, result chan<- *dns.Msg, req *dns.Msg,
-	servers []resolver, waitInterval time.Duration, lookup LookupFunc,
+	ctx context.Context, cancel context.CancelFunc, logger Logger, result chan<- *upstreamReply,
+	stages [][]Resolver, waitInterval time.Duration, lookup upstreamLookup,
 ) {
 	defer cancel()
-	if len(servers) == 0 {
+	if len(stages) == 0 {
 		return
 	}
-	logger := logrus.WithField("question", questionString(&req.Question[0]))
-
-	ticker := time.NewTicker(waitInterval)
-	defer ticker.Stop()
-	queryNext := make(chan struct{}, len(servers))
-	queryNext <- struct{}{}
+	timer := time.NewTimer(stageDelay(stages[0], waitInterval))
+	defer timer.Stop()
+	// failed receives the stage of every failed lookup, and the next stage is queried once a stage fails entirely.
+	remaining := make([]int, len(stages))
+	servers := 0
+	for _, stage := range stages {
+		servers += len(stage)
+	}
+	failed := make(chan int, servers)
 	var wg sync.WaitGroup
 
-	doLookup := func(server resolver) {
+	doLookup := func(stage int, server Resolver) {
 		defer wg.Done()
 		logger := logger.WithField("server", server.GetAddr())
 
-		reply, rtt, err := lookup(req.Copy(), server)
+		reply, rtt, err := lookup(ctx, server)
 		if err != nil {
-			queryNext <- struct{}{}
+			failed <- stage
 			return
 		}
 
@@ -48,41 +76,125 @@ func lookupInServers(
 	}
 
 LOOP:
-	for _, server := range servers {
-		select {
-		case <-ctx.Done():
-			break LOOP
-		case <-queryNext:
-			wg.Add(1)
-			go doLookup(server)
-		case <-ticker.C:
+	for next := 0; next < len(stages); {
+		if next > 0 {
+			select {
+			case <-ctx.Done():
+				break LOOP
+			case stage := <-failed:
+				if remaining[stage]--; remaining[stage] > 0 {
+					continue
+				}
+			case <-timer.C:
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(stageDelay(stages[next], waitInterval))
+		}
+		remaining[next] = len(stages[next])
+		for _, server := range stages[next] {
 			wg.Add(1)
-			go doLookup(server)
+			go doLookup(next, server)
 		}
+		next++
 	}
 
 	wg.Wait()
 }
 
+const (
+	mutationNone    = "none"
+	mutationPointer = "pointer"
+	mutationCase    = "case"
+	mutationEDNS    = "edns"
+)
+
+// checkMutation checks if a valid mutation method is specified.
+func checkMutation(m string) error {
+	switch m {
+	case mutationNone, mutationPointer, mutationCase, mutationEDNS:
+		return nil
+	default:
+		return errors.Errorf("Unknown mutation method [%s]", m)
+	}
+}
+
+// LookupMutated looks up DNS request with the mutation method of the given server.
+func (s *Server) LookupMutated(ctx context.Context, req *dns.Msg, server Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	t := time.Now()
+	s.tapForwarder(server, req, nil, t)
+	defer func() {
+		// lookups given up are not failures of the server.
+		if err == nil || ctx.Err() == nil {
+			s.observeUpstream(server, rtt, err)
+		}
+		if err == nil {
+			s.tapForwarder(server, req, reply, t)
+		}
+	}()
+	if server.isJSON() {
+		return s.LookupJSON(ctx, req, server)
+	}
+	if server.isDualStack() {
+		return s.lookupDualStack(ctx, req, server)
+	}
+	return s.lookupMutated(ctx, req, server)
+}
+
+// lookupMutated looks up DNS request with the mutation method of the given server, at its first address.
+func (s *Server) lookupMutated(ctx context.Context, req *dns.Msg, server Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	switch server.GetMutation() {
+	case mutationPointer:
+		return s.LookupMutation(ctx, req, server)
+	case mutationCase:
+		return s.LookupCaseMutation(ctx, req, server)
+	case mutationEDNS:
+		return s.LookupEDNSMutation(ctx, req, server)
+	default:
+		return s.Lookup(ctx, req, server)
+	}
+}
+
+// observeUpstream reports the result of a lookup to metrics, stats and the circuit breaker.
+func (s *Server) observeUpstream(server Resolver, rtt time.Duration, err error) {
+	s.metrics.observeUpstream(server, rtt, err)
+	s.stats.observeUpstream(server, rtt, err)
+	s.breaker.observe(server, err)
+}
+
 // Lookup send a DNS request to the specific server and get its corresponding reply.
 // DNS Proxy Implementation Guidelines: https://tools.ietf.org/html/rfc5625
 // DNS query processing: https://tools.ietf.org/html/rfc1034#section-3.7
 // Happy Eyeballs: https://tools.ietf.org/html/rfc6555#section-5.4 and #section-6
-func (s *Server) Lookup(req *dns.Msg, server resolver) (reply *dns.Msg, rtt time.Duration, err error) {
-	logger := logrus.WithFields(logrus.Fields{
+func (s *Server) Lookup(ctx context.Context, req *dns.Msg, server Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	logger := s.upstreamLog.WithFields(map[string]interface{}{
 		"question": questionString(&req.Question[0]),
 		"server":   server,
 	})
 
-	var rtt0 time.Duration
+	retry := s.retryPolicy()
+	attempt := func(cli *dns.Client) func() error {
+		return func() (err error) {
+			var rtt0 time.Duration
+			reply, rtt0, err = s.exchange(ctx, cli, req, server.dialAddr())
+			rtt += rtt0
+			if err == nil {
+				err = s.rcodeFailure(reply, nil)
+			}
+			return
+		}
+	}
 
 	for _, protocol := range server.GetProtocols() {
 		switch protocol {
 		case "udp":
 			logger.Debug("Query upstream udp")
-			reply, rtt0, err = s.UDPCli.Exchange(req, server.GetAddr())
-			rtt += rtt0
-			if err == nil {
+			err = retry.do(ctx, logger, attempt(s.upstreamClient(retry, s.UDPCli, server)))
+			if err == nil || ctx.Err() != nil {
 				return
 			}
 			logger.WithError(err).Error("Fail to send UDP query.")
@@ -91,15 +203,23 @@ func (s *Server) Lookup(req *dns.Msg, server resolver) (reply *dns.Msg, rtt time
 			}
 		case "tcp":
 			logger.Debug("Query upstream tcp")
-			reply, rtt0, err = s.TCPCli.Exchange(req, server.GetAddr())
-			rtt += rtt0
-			if err == nil {
+			err = retry.do(ctx, logger, attempt(s.upstreamClient(retry, s.TCPCli, server)))
+			if err == nil || ctx.Err() != nil {
 				return
 			}
 			logger.WithError(err).Error("Fail to send TCP query.")
 		default:
-			logger.Errorf("No available protocols for resolver %s", server)
-			return
+			cli, ok := s.protocolClient(retry, protocol, server)
+			if !ok {
+				logger.Errorf("No available protocols for resolver %s", server)
+				return
+			}
+			logger.Debugf("Query upstream %s", protocol)
+			err = retry.do(ctx, logger, attempt(cli))
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			logger.WithError(err).Errorf("Fail to send %s query.", protocol)
 		}
 	}
 	return
@@ -108,28 +228,39 @@ func (s *Server) Lookup(req *dns.Msg, server resolver) (reply *dns.Msg, rtt time
 // LookupMutation does the same as Lookup, with pointer mutation for DNS query.
 // DNS Compression: https://tools.ietf.org/html/rfc1035#section-4.1.4
 // DNS compression pointer mutation: https://gist.github.com/klzgrad/f124065c0616022b65e5#file-sendmsg-c-L30-L63
-func (s *Server) LookupMutation(req *dns.Msg, server resolver) (reply *dns.Msg, rtt time.Duration, err error) {
-	logger := logrus.WithFields(logrus.Fields{
+func (s *Server) LookupMutation(ctx context.Context, req *dns.Msg, server Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	logger := s.upstreamLog.WithFields(map[string]interface{}{
 		"question": questionString(&req.Question[0]),
 		"server":   server,
 	})
 
+	b := getPacketBuffer()
+	defer putPacketBuffer(b)
 	var buffer []byte
-	buffer, err = req.Pack()
+	buffer, err = req.PackBuffer(*b)
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "fail to pack request")
 	}
 	buffer = mutateQuestion(buffer)
 
+	retry := s.retryPolicy()
+	attempt := func(cli *dns.Client, udpSize uint16) func() error {
+		return func() (err error) {
+			reply, err = s.rawLookup(ctx, cli, req.Id, buffer, server, time.Now().Add(cli.Timeout), udpSize)
+			if err == nil {
+				err = s.rcodeFailure(reply, nil)
+			}
+			return
+		}
+	}
+
 	t := time.Now()
 	for _, protocol := range server.GetProtocols() {
 		switch protocol {
 		case "udp":
 			logger.Debug("Query upstream udp")
-			ddl := t.Add(s.UDPCli.Timeout)
-			udpSize := getUDPSize(req)
-			reply, err = rawLookup(s.UDPCli, req.Id, buffer, server, ddl, udpSize)
-			if err == nil {
+			err = retry.do(ctx, logger, attempt(s.upstreamClient(retry, s.UDPCli, server), getUDPSize(req)))
+			if err == nil || ctx.Err() != nil {
 				rtt = time.Since(t)
 				return
 			}
@@ -139,39 +270,126 @@ func (s *Server) LookupMutation(req *dns.Msg, server resolver) (reply *dns.Msg,
 			}
 		case "tcp":
 			logger.Debug("Query upstream tcp")
-			ddl := time.Now().Add(s.TCPCli.Timeout)
-			reply, err = rawLookup(s.TCPCli, req.Id, buffer, server, ddl, 0)
-			if err == nil {
+			err = retry.do(ctx, logger, attempt(s.upstreamClient(retry, s.TCPCli, server), 0))
+			if err == nil || ctx.Err() != nil {
 				rtt = time.Since(t)
 				return
 			}
 			logger.WithError(err).Error("Fail to send TCP mutation query.")
 		default:
-			logger.Errorf("No available protocols for resolver %s", server)
-			return
+			cli, ok := s.protocolClient(retry, protocol, server)
+			if !ok {
+				logger.Errorf("No available protocols for resolver %s", server)
+				return
+			}
+			logger.Debugf("Query upstream %s", protocol)
+			err = retry.do(ctx, logger, attempt(cli, 0))
+			if err == nil || ctx.Err() != nil {
+				rtt = time.Since(t)
+				return
+			}
+			logger.WithError(err).Errorf("Fail to send %s mutation query.", protocol)
 		}
 	}
 	rtt = time.Since(t)
 	return
 }
 
-func rawLookup(cli *dns.Client, id uint16, req []byte, server resolver, ddl time.Time, udpSize uint16) (*dns.Msg, error) {
-	conn, err := cli.Dial(server.GetAddr())
+// dial connects to the address, from a random port of the source port pool for UDP if configured,
+// or over the custom transport of cli. It gives up once ctx is done.
+func (s *Server) dial(ctx context.Context, cli *dns.Client, address string) (*dns.Conn, error) {
+	if dial, ok := lookupTransport(cli.Net); ok {
+		return dialTransport(ctx, dial, cli, address)
+	}
+	if s.ports != nil && cli.Net == "udp" {
+		return s.ports.Dial(cli, address)
+	}
+	return cli.Dial(address)
+}
+
+// exchange sends req to address, and returns the reply. It gives up once ctx is done, and returns the error of ctx.
+func (s *Server) exchange(ctx context.Context, cli *dns.Client, req *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if s.upstreams != nil && cli.Net == "udp" {
+		b := getPacketBuffer()
+		defer putPacketBuffer(b)
+		query, err := req.PackBuffer(*b)
+		if err != nil {
+			return nil, 0, err
+		}
+		t := time.Now()
+		reply, err := s.upstreams.Exchange(ctx, cli.Dialer, address, query, t.Add(cli.Timeout))
+		return reply, time.Since(t), err
+	}
+	conn, err := s.dial(ctx, cli, address)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+	reply, rtt, err := exchangeWithConn(cli, req, conn)
+	return reply, rtt, interrupted(ctx, err)
+}
+
+// LookupCaseMutation does the same as Lookup, with randomized letter case in the question name.
+// Replies which do not echo the exact question are dropped as spoofed.
+// DNS 0x20: https://tools.ietf.org/html/draft-vixie-dnsext-dns0x20-00
+func (s *Server) LookupCaseMutation(ctx context.Context, req *dns.Msg, server Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	name := req.Question[0].Name
+	mutated := mutateCase(name)
+	req.Question[0].Name = mutated
+	defer func() { req.Question[0].Name = name }()
+
+	reply, rtt, err = s.Lookup(ctx, req, server)
+	if err != nil {
+		return
+	}
+	if len(reply.Question) == 0 || reply.Question[0].Name != mutated {
+		return nil, rtt, errors.New("question case mismatch in reply")
+	}
+	reply.Question[0].Name = name
+	for _, rr := range reply.Answer {
+		if h := rr.Header(); h.Name == mutated {
+			h.Name = name
+		}
+	}
+	return
+}
+
+// LookupEDNSMutation does the same as Lookup, with an extra padding option in the EDNS0 OPT RR.
+// EDNS(0) Padding Option: https://tools.ietf.org/html/rfc7830
+func (s *Server) LookupEDNSMutation(ctx context.Context, req *dns.Msg, server Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	req = req.Copy()
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.MinMsgSize, false)
+		opt = req.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 1+rand.Intn(16))})
+	return s.Lookup(ctx, req, server)
+}
+
+// rawLookup sends the packed query of LookupMutation to server, and returns the reply.
+// Sockets of WithUpstreamSockets are not used, since they match replies by the question, which is compressed.
+func (s *Server) rawLookup(ctx context.Context, cli *dns.Client, id uint16, req []byte, server Resolver, ddl time.Time, udpSize uint16) (*dns.Msg, error) {
+	conn, err := s.dial(ctx, cli, server.dialAddr())
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
 	conn.UDPSize = udpSize
 
 	conn.SetWriteDeadline(ddl)
 	if _, err := conn.Write(req); err != nil {
-		return nil, err
+		return nil, interrupted(ctx, err)
 	}
 
 	conn.SetReadDeadline(ddl)
-	reply, err := conn.ReadMsg()
+	b := getPacketBuffer()
+	defer putPacketBuffer(b)
+	reply, err := readMsg(conn, *b)
 	if err != nil {
-		return nil, err
+		return nil, interrupted(ctx, err)
 	}
 	if reply.Id != id {
 		err = dns.ErrId
@@ -211,6 +429,25 @@ func cleanEdns0(req *dns.Msg) {
 	}
 }
 
+// shareMsg returns a copy of m for another request or client, which costs less than m.Copy.
+// The copy has its own header, question and additional section, and shares RRs of the answer and authority sections,
+// which are never modified once received. RRs of the additional section are copied, since packing a message sets
+// the extended rcode in its OPT RR, and ECS options are stripped from it.
+func shareMsg(m *dns.Msg) *dns.Msg {
+	c := *m
+	c.Question = append([]dns.Question(nil), m.Question...)
+	// appending to shared sections must not overwrite RRs after them.
+	c.Answer = m.Answer[:len(m.Answer):len(m.Answer)]
+	c.Ns = m.Ns[:len(m.Ns):len(m.Ns)]
+	if m.Extra != nil {
+		c.Extra = make([]dns.RR, len(m.Extra))
+		for i, rr := range m.Extra {
+			c.Extra[i] = dns.Copy(rr)
+		}
+	}
+	return &c
+}
+
 func mutateQuestion(bytes []byte) []byte {
 	// 16 is the minimum length of a valid DNS query
 	length := len(bytes)
@@ -246,6 +483,16 @@ func mutateQuestion(bytes []byte) []byte {
 	return buffer
 }
 
+func mutateCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.Intn(2) == 0 {
+			b[i] ^= 0x20
+		}
+	}
+	return string(b)
+}
+
 func questionString(q *dns.Question) string {
 	return q.Name + " " + dns.TypeToString[q.Qtype]
 }
@@ -0,0 +1,123 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+)
+
+// mdnsGroup is the IPv4 group address of multicast DNS, see RFC 6762.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsCacheFlush is the bit of classes of records in mDNS replies which tells caches to flush older records.
+const mdnsCacheFlush = 1 << 15
+
+// mdnsTarget is where .local names are resolved, see WithMDNS.
+type mdnsTarget struct {
+	target string       //as it's given to WithMDNS
+	iface  string       //interface to send multicast queries on. Empty for the default one.
+	addr   *net.UDPAddr //address queries are sent to: the group of multicast DNS, or a responder
+}
+
+// parseMDNSTarget parses the target of WithMDNS: the name of an interface, default, or ip:port of a responder.
+func parseMDNSTarget(target string) (*mdnsTarget, error) {
+	t := &mdnsTarget{target: target, addr: mdnsGroup}
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, errors.Errorf("invalid mDNS responder [%s]", target)
+		}
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip.String(), port))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid mDNS responder [%s]", target)
+		}
+		t.addr = addr
+	} else if target != "default" {
+		t.iface = target
+	}
+	return t, nil
+}
+
+// isLocalName reports whether name is under local., which is resolved by multicast DNS, see RFC 6762.
+func isLocalName(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return name == "local" || strings.HasSuffix(name, ".local")
+}
+
+// lookupMDNS sends the question of req to the target as a one-shot mDNS query from an ephemeral port, which
+// responders answer by unicast with the ID of the query, and returns the first reply in timeout, or nil if there
+// is none.
+func lookupMDNS(ctx context.Context, target *mdnsTarget, req *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to listen for mDNS replies")
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+	if target.iface != "" {
+		ifi, err := net.InterfaceByName(target.iface)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to find interface [%s]", target.iface)
+		}
+		if err := ipv4.NewPacketConn(conn).SetMulticastInterface(ifi); err != nil {
+			return nil, errors.Wrapf(err, "fail to send mDNS queries on [%s]", target.iface)
+		}
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(req.Question[0].Name, req.Question[0].Qtype)
+	query.RecursionDesired = false
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(packed, target.addr); err != nil {
+		return nil, errors.Wrap(err, "fail to send mDNS query")
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return nil, nil
+			}
+			return nil, interrupted(ctx, err)
+		}
+		reply := new(dns.Msg)
+		if reply.Unpack(buf[:n]) == nil && reply.Response && reply.Id == query.Id {
+			return reply, nil
+		}
+	}
+}
+
+// resolveMDNS answers req of a .local name by multicast DNS, with answers of its type or CNAMEs of the first reply,
+// or NXDOMAIN if no responder replies in the timeout of the server.
+func resolveMDNS(ctx context.Context, o *serverOptions, req *dns.Msg, logger Logger) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	mreply, err := lookupMDNS(ctx, o.MDNS, req, o.Timeout)
+	if err != nil {
+		logger.WithError(err).Warn("Fail to query mDNS.")
+		reply.Rcode = dns.RcodeServerFailure
+		return reply
+	}
+	if mreply == nil {
+		logger.Debug("No mDNS responder replies.")
+		reply.Rcode = dns.RcodeNameError
+		return reply
+	}
+	qtype := req.Question[0].Qtype
+	for _, rr := range mreply.Answer {
+		if hdr := rr.Header(); hdr.Rrtype == qtype || hdr.Rrtype == dns.TypeCNAME || qtype == dns.TypeANY {
+			hdr.Class &^= mdnsCacheFlush
+			reply.Answer = append(reply.Answer, rr)
+		}
+	}
+	return reply
+}
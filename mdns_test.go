@@ -0,0 +1,84 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestMDNS(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		// responders don't reply to names they don't own.
+		if req.Question[0].Name != "printer.local." || req.RecursionDesired {
+			return
+		}
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		a, _ := dns.NewRR("printer.local. 120 IN A 192.168.1.20")
+		aaaa, _ := dns.NewRR("printer.local. 120 IN AAAA fe80::20")
+		a.Header().Class |= mdnsCacheFlush
+		reply.Answer = append(reply.Answer, a, aaaa)
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	upstream := startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+upstream),
+		WithSkipStartupTest(true), WithTimeout(200*time.Millisecond), WithMDNS(pc.LocalAddr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		rcode  int
+		answer string
+	}{
+		{"printer.local.", dns.RcodeSuccess, "192.168.1.20"},
+		{"Printer.LOCAL.", dns.RcodeNameError, ""},
+		{"nobody.local.", dns.RcodeNameError, ""},
+		{"local.example.", dns.RcodeSuccess, "1.2.3.4"},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, dns.TypeA)
+		w := new(explainWriter)
+		s.Serve(w, req)
+		if w.reply == nil {
+			t.Fatalf("No reply to %s", tt.name)
+		}
+		if w.reply.Rcode != tt.rcode {
+			t.Errorf("Rcode of %s = %s, want %s", tt.name, dns.RcodeToString[w.reply.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		var got string
+		for _, rr := range w.reply.Answer {
+			a, ok := rr.(*dns.A)
+			if !ok {
+				t.Errorf("Answer of %s = %s, want only A", tt.name, rr)
+				continue
+			}
+			if a.Hdr.Class != dns.ClassINET {
+				t.Errorf("Class of %s = %d, want IN", rr, a.Hdr.Class)
+			}
+			got = a.A.String()
+		}
+		if got != tt.answer {
+			t.Errorf("Answer of %s = %q, want %q", tt.name, got, tt.answer)
+		}
+	}
+
+	for target, iface := range map[string]string{"default": "", "br-lan": "br-lan"} {
+		mt, err := parseMDNSTarget(target)
+		if err != nil || mt.iface != iface || !mt.addr.IP.Equal(mdnsGroup.IP) {
+			t.Errorf("parseMDNSTarget(%s) = %+v, %v", target, mt, err)
+		}
+	}
+	if _, err := parseMDNSTarget("avahi:5353"); err == nil {
+		t.Error("mDNS responder avahi:5353 should fail")
+	}
+}
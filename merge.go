@@ -0,0 +1,83 @@
+package gochinadns
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// mergeAnswers waits for the reply of the other origin to rep, the accepted reply of origin, and returns addresses
+// of both without duplicates if the other one is accepted as well, see WithMergedAnswers. It returns rep otherwise.
+func (s *Server) mergeAnswers(ctx context.Context, o *serverOptions, logger Logger, rep *upstreamReply, origin string, other <-chan *upstreamReply) *upstreamReply {
+	if ip, _ := firstAnswerIP(rep.Msg); ip == nil {
+		return rep
+	}
+	orep := awaitReply(ctx, other)
+	if orep == nil {
+		return rep
+	}
+	otherOrigin := OriginTrusted
+	if origin == OriginTrusted {
+		otherOrigin = OriginUntrusted
+	}
+	var q dns.Question
+	if len(orep.Question) > 0 {
+		q = orep.Question[0]
+	}
+	d := s.policy().AcceptAnswer(&q, orep.Msg, otherOrigin)
+	if d.Polluted {
+		s.reportPollution(orep, d.Heuristic)
+	}
+	if ip, _ := firstAnswerIP(orep.Msg); !d.Accept || ip == nil {
+		logger.Debugf("Answer of %s servers is not accepted (%s). Do not merge it.", otherOrigin, d.Reason)
+		return rep
+	}
+	if rep.unpackAll() != nil || orep.unpackAll() != nil {
+		return rep
+	}
+
+	first, second := rep, orep
+	if origin != o.MergedAnswers {
+		first, second = orep, rep
+	}
+	reply := first.Copy()
+	// addresses of the second reply are renamed after those of the first one, so that clients following
+	// the CNAME chain of the first reply don't drop them.
+	var name string
+	seen := make(map[string]bool)
+	for _, rr := range reply.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			name = rr.Hdr.Name
+			seen[rr.A.String()] = true
+		case *dns.AAAA:
+			name = rr.Hdr.Name
+			seen[rr.AAAA.String()] = true
+		}
+	}
+	merged := 0
+	for _, rr := range second.Answer {
+		var ip string
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A.String()
+		case *dns.AAAA:
+			ip = rr.AAAA.String()
+		default:
+			continue
+		}
+		if seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		reply.Answer = append(reply.Answer, rr)
+		merged++
+	}
+	if merged == 0 {
+		return rep
+	}
+	logger.Debugf("Answer of %s servers is accepted as well (%s). Merge %d addresses of it.", otherOrigin, d.Reason, merged)
+	return &upstreamReply{Msg: reply, server: first.server, reason: reasonMerged}
+}
@@ -0,0 +1,82 @@
+package gochinadns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestMergedAnswers(t *testing.T) {
+	f, err := ioutil.TempFile("", "china-*.list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("127.0.0.0/8\n114.114.114.0/24\n")
+	f.Close()
+
+	// the untrusted server answers a China CDN edge through a CNAME, or an overseas address for other.example.com.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		answers := []string{"www.example.com. 60 IN CNAME edge.cdn.example.", "edge.cdn.example. 60 IN A 114.114.114.114"}
+		if req.Question[0].Name == "other.example.com." {
+			answers = []string{"other.example.com. 60 IN A 8.8.8.8"}
+		}
+		for _, s := range answers {
+			rr, _ := dns.NewRR(s)
+			reply.Answer = append(reply.Answer, rr)
+		}
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	trusted := startTestUpstream(t, "1.1.1.1")
+
+	for _, tt := range []struct {
+		first, name string
+		want        []string
+	}{
+		{OriginUntrusted, "www.example.com.", []string{"www.example.com.", "edge.cdn.example.", "edge.cdn.example."}},
+		{OriginTrusted, "www.example.com.", []string{"www.example.com.", "www.example.com."}},
+		{OriginUntrusted, "other.example.com.", []string{"other.example.com."}},
+	} {
+		s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithCHNList(f.Name()), WithTrustedResolvers("udp@"+trusted),
+			WithResolvers("udp@"+pc.LocalAddr().String()), WithTimeout(time.Second), WithSkipStartupTest(true),
+			WithMergedAnswers(tt.first))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, dns.TypeA)
+		result := s.serve(s.ctx, new(explainWriter), req, nil)
+		w := new(explainWriter)
+		s.Serve(w, req)
+		if w.reply == nil || len(w.reply.Answer) != len(tt.want) {
+			t.Fatalf("Reply of %s with %s first = %v, want %d answers", tt.name, tt.first, w.reply, len(tt.want))
+		}
+		for i, rr := range w.reply.Answer {
+			if rr.Header().Name != tt.want[i] {
+				t.Errorf("Answer %d of %s with %s first = %s, want name %s", i, tt.name, tt.first, rr, tt.want[i])
+			}
+		}
+		if merged := len(tt.want) > 1; merged != (result.reason == reasonMerged) {
+			t.Errorf("Reason of %s with %s first = %s", tt.name, tt.first, result.reason)
+		}
+		if ips := answerIPs(w.reply); tt.first == OriginTrusted && ips[0].String() != "1.1.1.1" {
+			t.Errorf("Addresses of %s with trusted first = %v", tt.name, ips)
+		}
+	}
+
+	if err := WithMergedAnswers("china")(new(serverOptions)); err == nil {
+		t.Error("Origin china should fail")
+	}
+}
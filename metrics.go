@@ -0,0 +1,414 @@
+package gochinadns
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defBuckets are the default histogram buckets in seconds.
+var defBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// collector writes metrics in Prometheus text exposition format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+// counterVec is a set of counters partitioned by label values. Counters are sharded, and summed on scrape.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	values sync.Map //label key -> *shardedCounter
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels}
+}
+
+// Inc increases the counter of the label values by 1.
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter of the label values by n.
+func (c *counterVec) Add(n uint64, labelValues ...string) {
+	key := labelKey(labelValues)
+	v, ok := c.values.Load(key)
+	if !ok {
+		v, _ = c.values.LoadOrStore(key, newShardedCounter())
+	}
+	v.(*shardedCounter).Add(n)
+}
+
+// snapshot returns the counters by label key.
+func (c *counterVec) snapshot() map[string]uint64 {
+	values := make(map[string]uint64)
+	c.values.Range(func(key, v interface{}) bool {
+		values[key.(string)] = v.(*shardedCounter).Load()
+		return true
+	})
+	return values
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	values := c.snapshot()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, key, ""), values[key])
+	}
+}
+
+// gaugeVec is a set of gauges partitioned by label values.
+type gaugeVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	return &gaugeVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Set sets the gauge of the label values to v.
+func (g *gaugeVec) Set(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	g.mu.Lock()
+	g.values[key] = v
+	g.mu.Unlock()
+}
+
+func (g *gaugeVec) writeTo(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	keys := make([]string, 0, len(g.values))
+	for key := range g.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, key, ""), formatFloat(g.values[key]))
+	}
+}
+
+// histogramVec is a set of histograms partitioned by label values. Histograms are sharded like counters,
+// and shards are summed on scrape.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	values sync.Map //label key -> []histogram of shards
+}
+
+type histogram struct {
+	counts []uint64 //counts[i] is the number of observations in (buckets[i-1], buckets[i]], the last one for +Inf
+	sum    uint64   //float64 bits
+	count  uint64
+	_      [_cacheLineSize - 8]byte
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets}
+}
+
+// Observe adds an observation to the histogram of the label values.
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	idx := sort.SearchFloat64s(h.buckets, v)
+
+	shards, ok := h.values.Load(key)
+	if !ok {
+		fresh := make([]histogram, counterShards)
+		for i := range fresh {
+			fresh[i].counts = make([]uint64, len(h.buckets)+1)
+		}
+		shards, _ = h.values.LoadOrStore(key, fresh)
+	}
+	i := shardIndexes.Get().(*int)
+	hist := &shards.([]histogram)[*i]
+	atomic.AddUint64(&hist.counts[idx], 1)
+	addFloat(&hist.sum, v)
+	atomic.AddUint64(&hist.count, 1)
+	shardIndexes.Put(i)
+}
+
+// ObserveDuration adds a duration in seconds to the histogram of the label values.
+func (h *histogramVec) ObserveDuration(d time.Duration, labelValues ...string) {
+	h.Observe(d.Seconds(), labelValues...)
+}
+
+// histogramSum is a histogram summed from shards.
+type histogramSum struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// snapshot returns the histograms by label key.
+func (h *histogramVec) snapshot() map[string]*histogramSum {
+	values := make(map[string]*histogramSum)
+	h.values.Range(func(key, v interface{}) bool {
+		total := &histogramSum{counts: make([]uint64, len(h.buckets)+1)}
+		for i := range v.([]histogram) {
+			shard := &v.([]histogram)[i]
+			for j := range shard.counts {
+				total.counts[j] += atomic.LoadUint64(&shard.counts[j])
+			}
+			total.sum += math.Float64frombits(atomic.LoadUint64(&shard.sum))
+			total.count += atomic.LoadUint64(&shard.count)
+		}
+		values[key.(string)] = total
+		return true
+	})
+	return values
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	values := h.snapshot()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), hist.count)
+	}
+}
+
+// labelSep separates label values in keys of metric maps.
+const labelSep = "\x00"
+
+func labelKey(values []string) string {
+	return strings.Join(values, labelSep)
+}
+
+func formatLabels(names []string, key, le string) string {
+	if len(names) == 0 && le == "" {
+		return ""
+	}
+	sb := new(strings.Builder)
+	sb.WriteByte('{')
+	if len(names) > 0 {
+		values := strings.Split(key, labelSep)
+		for i, name := range names {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			var v string
+			if i < len(values) {
+				v = values[i]
+			}
+			fmt.Fprintf(sb, `%s="%s"`, name, labelEscaper.Replace(v))
+		}
+	}
+	if le != "" {
+		if len(names) > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(sb, `le="%s"`, le)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return fmt.Sprint(v)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metrics holds all metrics of a server, and pushes them to statsd if it's set.
+// All methods are no-op on a nil *metrics.
+type metrics struct {
+	statsd *statsdClient
+
+	queries          *counterVec
+	queryDuration    *histogramVec
+	upstreamDuration *histogramVec
+	upstreamErrors   *counterVec
+	upstreamTimeouts *counterVec
+	wins             *counterVec
+	coalesced        *counterVec
+	overloaded       *counterVec
+	rateLimited      *counterVec
+	rrlLimited       *counterVec
+	denied           *counterVec
+	pollution        *counterVec
+	canaryChecks     *counterVec
+	upstreamUp       *gaugeVec
+	hijacked         *gaugeVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		queries:          newCounterVec("chinadns_queries_total", "DNS queries served, by qtype and rcode.", "qtype", "rcode"),
+		queryDuration:    newHistogramVec("chinadns_query_duration_seconds", "Latency of serving queries, by the path answers come from.", defBuckets, "path"),
+		upstreamDuration: newHistogramVec("chinadns_upstream_duration_seconds", "Latency of upstream lookups, by resolver.", defBuckets, "resolver"),
+		upstreamErrors:   newCounterVec("chinadns_upstream_errors_total", "Failed upstream lookups, by resolver.", "resolver"),
+		upstreamTimeouts: newCounterVec("chinadns_upstream_timeouts_total", "Timed out upstream lookups, by resolver.", "resolver"),
+		wins:             newCounterVec("chinadns_answers_total", "Answers served, by the path they come from.", "path"),
+		overloaded:       newCounterVec("chinadns_overloaded_queries_total", "Queries over the concurrency limit, by the action taken.", "action"),
+		rateLimited:      newCounterVec("chinadns_rate_limited_queries_total", "Queries of clients over their rate limit, by the action taken.", "action"),
+		rrlLimited:       newCounterVec("chinadns_rrl_limited_responses_total", "Responses over the response rate limit, by the action taken.", "action"),
+		denied:           newCounterVec("chinadns_denied_queries_total", "Queries of clients denied by the client ACL, by the action taken.", "action"),
+		coalesced:        newCounterVec("chinadns_coalesced_queries_total", "Queries answered by the resolution of an identical query in flight."),
+		pollution:        newCounterVec("chinadns_pollution_rejections_total", "Answers rejected as polluted, by heuristic.", "heuristic"),
+		canaryChecks:     newCounterVec("chinadns_canary_checks_total", "Canary checks of resolvers, by resolver and result.", "resolver", "result"),
+		upstreamUp:       newGaugeVec("chinadns_upstream_up", "Whether resolvers answer health checks, by resolver and protocol.", "resolver", "protocol"),
+		hijacked:         newGaugeVec("chinadns_upstream_hijacked", "Whether resolvers fail canary checks as hijacked, by resolver.", "resolver"),
+	}
+}
+
+func (m *metrics) collectors() []collector {
+	return []collector{m.queries, m.wins, m.coalesced, m.overloaded, m.rateLimited, m.rrlLimited, m.denied, m.pollution, m.queryDuration, m.upstreamDuration, m.upstreamErrors, m.upstreamTimeouts, m.canaryChecks, m.upstreamUp, m.hijacked}
+}
+
+func (m *metrics) observeUpstream(server Resolver, rtt time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.upstreamErrors.Inc(server.GetAddr())
+		m.statsd.count("upstream.errors", 1, "resolver", server.GetAddr())
+		if isTimeout(err) {
+			m.upstreamTimeouts.Inc(server.GetAddr())
+			m.statsd.count("upstream.timeouts", 1, "resolver", server.GetAddr())
+		}
+		return
+	}
+	m.upstreamDuration.ObserveDuration(rtt, server.GetAddr())
+	m.statsd.timing("upstream.duration", rtt, "resolver", server.GetAddr())
+}
+
+func (m *metrics) observeHealth(server Resolver, protocol string, up bool) {
+	if m == nil {
+		return
+	}
+	v := 0.0
+	if up {
+		v = 1
+	}
+	m.upstreamUp.Set(v, server.GetAddr(), protocol)
+	m.statsd.gauge("upstream.up", v, "resolver", server.GetAddr(), "protocol", protocol)
+}
+
+func (m *metrics) observeCanary(server Resolver, hijacked bool) {
+	if m == nil {
+		return
+	}
+	result, v := "passed", 0.0
+	if hijacked {
+		result, v = "hijacked", 1
+	}
+	m.canaryChecks.Inc(server.GetAddr(), result)
+	m.hijacked.Set(v, server.GetAddr())
+	m.statsd.count("canary.checks", 1, "resolver", server.GetAddr(), "result", result)
+	m.statsd.gauge("upstream.hijacked", v, "resolver", server.GetAddr())
+}
+
+func (m *metrics) observeQuery(qtype, rcode, path string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.queries.Inc(qtype, rcode)
+	m.statsd.count("queries", 1, "qtype", qtype, "rcode", rcode)
+	if path != "" {
+		m.wins.Inc(path)
+		m.queryDuration.ObserveDuration(d, path)
+		m.statsd.count("answers", 1, "path", path)
+		m.statsd.timing("query.duration", d, "path", path)
+	}
+}
+
+func (m *metrics) observeCoalesced() {
+	if m == nil {
+		return
+	}
+	m.coalesced.Inc()
+	m.statsd.count("queries.coalesced", 1)
+}
+
+func (m *metrics) observeOverloaded(action string) {
+	if m == nil {
+		return
+	}
+	m.overloaded.Inc(action)
+	m.statsd.count("queries.overloaded", 1, "action", action)
+}
+
+func (m *metrics) observeRateLimited(action string) {
+	if m == nil {
+		return
+	}
+	m.rateLimited.Inc(action)
+	m.statsd.count("queries.rate_limited", 1, "action", action)
+}
+
+func (m *metrics) observeDenied(action string) {
+	if m == nil {
+		return
+	}
+	m.denied.Inc(action)
+	m.statsd.count("queries.denied", 1, "action", action)
+}
+
+func (m *metrics) observeRRL(action string) {
+	if m == nil {
+		return
+	}
+	m.rrlLimited.Inc(action)
+	m.statsd.count("responses.rrl_limited", 1, "action", action)
+}
+
+func (m *metrics) observePollution(heuristic string) {
+	if m == nil {
+		return
+	}
+	m.pollution.Inc(heuristic)
+	m.statsd.count("pollution.rejections", 1, "heuristic", heuristic)
+}
+
+// ServeHTTP writes all metrics in Prometheus text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range m.collectors() {
+		c.writeTo(w)
+	}
+}
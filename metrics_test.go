@@ -0,0 +1,64 @@
+package gochinadns
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "qtype", "rcode")
+	c.Inc("A", "NOERROR")
+	c.Inc("A", "NOERROR")
+	c.Inc("AAAA", `"quoted"`)
+
+	buf := new(bytes.Buffer)
+	c.writeTo(buf)
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{qtype="A",rcode="NOERROR"} 2
+test_total{qtype="AAAA",rcode="\"quoted\""} 1
+`
+	if buf.String() != want {
+		t.Errorf("unexpected output:\n%s", buf)
+	}
+}
+
+func TestGaugeVec(t *testing.T) {
+	g := newGaugeVec("test_up", "Test gauge.", "resolver")
+	g.Set(1, "1.1.1.1:53")
+	g.Set(0.5, "8.8.8.8:53")
+	g.Set(0, "1.1.1.1:53")
+
+	buf := new(bytes.Buffer)
+	g.writeTo(buf)
+	want := `# HELP test_up Test gauge.
+# TYPE test_up gauge
+test_up{resolver="1.1.1.1:53"} 0
+test_up{resolver="8.8.8.8:53"} 0.5
+`
+	if buf.String() != want {
+		t.Errorf("unexpected output:\n%s", buf)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1}, "path")
+	h.Observe(0.05, "trusted")
+	h.Observe(0.1, "trusted")
+	h.Observe(3, "trusted")
+
+	buf := new(bytes.Buffer)
+	h.writeTo(buf)
+	for _, line := range []string{
+		`test_seconds_bucket{path="trusted",le="0.1"} 2`,
+		`test_seconds_bucket{path="trusted",le="1"} 2`,
+		`test_seconds_bucket{path="trusted",le="+Inf"} 3`,
+		`test_seconds_sum{path="trusted"} 3.15`,
+		`test_seconds_count{path="trusted"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %s in output:\n%s", line, buf)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package gochinadns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Middleware wraps the handler of queries with next, the rest of the chain, so that it may filter, rewrite or log
+// queries and replies without forking the server. It may answer a query itself by writing to the ResponseWriter
+// without calling next, or wrap the ResponseWriter to see or rewrite the reply. See WithMiddleware.
+type Middleware func(next dns.Handler) dns.Handler
+
+// chainMiddlewares returns h wrapped by middlewares, the first of which sees queries first.
+func chainMiddlewares(h dns.Handler, middlewares []Middleware) dns.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// serveQuery answers req from the cache, or resolves it. It's the end of the chain of middlewares.
+func (s *Server) serveQuery(w dns.ResponseWriter, req *dns.Msg) {
+	if s.serveCached(w, req) {
+		return
+	}
+	ctx, cancel := s.queryContext(w)
+	defer cancel()
+	result := s.serve(ctx, w, req, nil)
+	if rw, ok := w.(resultWriter); ok {
+		rw.recordResult(result)
+	}
+}
@@ -0,0 +1,63 @@
+package gochinadns
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next dns.Handler) dns.Handler {
+			return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+				order = append(order, name)
+				next.ServeDNS(w, req)
+			})
+		}
+	}
+	block := func(next dns.Handler) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			if req.Question[0].Name == "blocked.test." {
+				reply := new(dns.Msg)
+				reply.SetRcode(req, dns.RcodeNameError)
+				w.WriteMsg(reply)
+				return
+			}
+			next.ServeDNS(w, req)
+		})
+	}
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true),
+		WithMiddleware(trace("first"), block), WithMiddleware(trace("second")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("blocked.test.", dns.TypeA)
+	w := new(explainWriter)
+	s.Serve(w, req)
+	if w.reply == nil || w.reply.Rcode != dns.RcodeNameError {
+		t.Errorf("reply = %v, want NXDOMAIN by the middleware", w.reply)
+	}
+	if !reflect.DeepEqual(order, []string{"first"}) {
+		t.Errorf("middlewares run %q, want only the first before the blocking one", order)
+	}
+
+	order = nil
+	req.SetQuestion("version.bind.", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	w = new(explainWriter)
+	s.Serve(w, req)
+	if w.reply == nil || len(w.reply.Answer) == 0 {
+		t.Errorf("reply = %v, want the version", w.reply)
+	}
+	if !reflect.DeepEqual(order, []string{"first", "second"}) {
+		t.Errorf("middlewares run %q, want in order", order)
+	}
+
+	if _, err := NewServer(WithMiddleware(nil)); err == nil {
+		t.Error("NewServer should fail with a nil middleware")
+	}
+}
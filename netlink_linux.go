@@ -0,0 +1,141 @@
+//go:build linux
+// +build linux
+
+package gochinadns
+
+import (
+	"encoding/binary"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// _netlinkTimeout is the timeout to wait for acks of netlink messages.
+const _netlinkTimeout = time.Second
+
+// nativeEndian is the byte order of the host, in which netlink headers are.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// netlinkMessage builds a netfilter netlink message of attributes.
+type netlinkMessage struct {
+	b      []byte
+	nested []int //offsets of nested attributes which are not ended yet
+}
+
+// newNetfilterMessage returns a message of typ with flags and seq, and the netfilter header of family and resID.
+func newNetfilterMessage(typ, flags uint16, seq uint32, family uint8, resID uint16) *netlinkMessage {
+	m := &netlinkMessage{b: make([]byte, unix.NLMSG_HDRLEN+4, 128)}
+	nativeEndian.PutUint16(m.b[4:], typ)
+	nativeEndian.PutUint16(m.b[6:], flags)
+	nativeEndian.PutUint32(m.b[8:], seq)
+	m.b[unix.NLMSG_HDRLEN] = family
+	m.b[unix.NLMSG_HDRLEN+1] = unix.NFNETLINK_V0
+	binary.BigEndian.PutUint16(m.b[unix.NLMSG_HDRLEN+2:], resID)
+	return m
+}
+
+// attr appends an attribute of typ, padded to 4 bytes.
+func (m *netlinkMessage) attr(typ uint16, data []byte) {
+	var hdr [unix.SizeofNlAttr]byte
+	nativeEndian.PutUint16(hdr[:], uint16(unix.SizeofNlAttr+len(data)))
+	nativeEndian.PutUint16(hdr[2:], typ)
+	m.b = append(m.b, hdr[:]...)
+	m.b = append(m.b, data...)
+	for len(m.b)%4 != 0 {
+		m.b = append(m.b, 0)
+	}
+}
+
+// attrString appends a NUL terminated string attribute.
+func (m *netlinkMessage) attrString(typ uint16, s string) {
+	m.attr(typ, append([]byte(s), 0))
+}
+
+// attrUint32 appends an attribute of v in network byte order.
+func (m *netlinkMessage) attrUint32(typ uint16, v uint32) {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], v)
+	m.attr(typ, data[:])
+}
+
+// attrUint64 appends an attribute of v in network byte order.
+func (m *netlinkMessage) attrUint64(typ uint16, v uint64) {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], v)
+	m.attr(typ, data[:])
+}
+
+// begin begins a nested attribute of typ, which ends at end.
+func (m *netlinkMessage) begin(typ uint16) {
+	m.nested = append(m.nested, len(m.b))
+	m.attr(typ|unix.NLA_F_NESTED, nil)
+}
+
+// end ends the last nested attribute begun.
+func (m *netlinkMessage) end() {
+	off := m.nested[len(m.nested)-1]
+	m.nested = m.nested[:len(m.nested)-1]
+	nativeEndian.PutUint16(m.b[off:], uint16(len(m.b)-off))
+}
+
+// bytes returns the message.
+func (m *netlinkMessage) bytes() []byte {
+	nativeEndian.PutUint32(m.b, uint32(len(m.b)))
+	return m.b
+}
+
+// netfilterExchange sends messages to netfilter in one write, and waits for acks of those numbered acks,
+// which are requested by NLM_F_ACK. It returns the errors of messages in reply by their sequence numbers.
+func netfilterExchange(msgs []*netlinkMessage, acks int) (map[uint32]error, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to open netlink socket")
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, errors.Wrap(err, "fail to bind netlink socket")
+	}
+	tv := unix.NsecToTimeval(_netlinkTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return nil, errors.Wrap(err, "fail to set timeout of netlink socket")
+	}
+	var buf []byte
+	for _, m := range msgs {
+		buf = append(buf, m.bytes()...)
+	}
+	if err := unix.Sendto(fd, buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, errors.Wrap(err, "fail to send netlink messages")
+	}
+
+	errs := make(map[uint32]error)
+	buf = make([]byte, 65536)
+	for acks > 0 {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, errors.Wrap(err, "fail to receive netlink acks")
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, errors.Wrap(err, "fail to parse netlink acks")
+		}
+		for _, reply := range replies {
+			if reply.Header.Type != unix.NLMSG_ERROR || len(reply.Data) < 4 {
+				continue
+			}
+			acks--
+			if code := int32(nativeEndian.Uint32(reply.Data)); code < 0 {
+				errs[reply.Header.Seq] = syscall.Errno(-code)
+			}
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,24 @@
+package gochinadns
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// splitNFTSet splits the nftables set in format family#table#set, where family is that of the table:
+// inet, ip or ip6.
+func splitNFTSet(name string) (family, table, set string, err error) {
+	parts := strings.Split(name, "#")
+	if len(parts) != 3 {
+		return "", "", "", errors.Errorf("invalid nftables set [%s]", name)
+	}
+	switch family, table, set = parts[0], parts[1], parts[2]; {
+	case family != "inet" && family != "ip" && family != "ip6":
+		return "", "", "", errors.Errorf("invalid family of nftables set [%s]", name)
+	// NFT_NAME_MAXLEN is 256, including the terminating NUL.
+	case table == "" || set == "" || len(table) >= 256 || len(set) >= 256:
+		return "", "", "", errors.Errorf("invalid nftables set [%s]", name)
+	}
+	return family, table, set, nil
+}
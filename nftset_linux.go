@@ -0,0 +1,104 @@
+//go:build linux
+// +build linux
+
+package gochinadns
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// supportsNFTSet is whether nftables sets are supported on this platform.
+const supportsNFTSet = true
+
+// nftFamilies are the protocol families of nftables tables by names.
+var nftFamilies = map[string]uint8{"inet": unix.NFPROTO_INET, "ip": unix.NFPROTO_IPV4, "ip6": unix.NFPROTO_IPV6}
+
+// nftNoTimeout is the nftables sets without the timeout flag, whose elements are added without timeouts.
+var nftNoTimeout sync.Map
+
+// addNFTSet adds elems to nftables sets in a batch, with a message of the elements of each set. Sets which reject
+// elements with timeouts are tried again without timeouts, which are remembered if it works.
+func addNFTSet(elems []setElement) error {
+	var sets []string
+	bySet := make(map[string][]setElement)
+	for _, elem := range elems {
+		if _, ok := bySet[elem.set]; !ok {
+			sets = append(sets, elem.set)
+		}
+		bySet[elem.set] = append(bySet[elem.set], elem)
+	}
+	noTimeout := make(map[string]bool)
+	for _, set := range sets {
+		_, noTimeout[set] = nftNoTimeout.Load(set)
+	}
+	retried := false
+	for {
+		msgs := []*netlinkMessage{newNetfilterMessage(unix.NFNL_MSG_BATCH_BEGIN, unix.NLM_F_REQUEST, 0,
+			unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES)}
+		for i, set := range sets {
+			m, err := nftAddMessage(uint32(i+1), set, bySet[set], !noTimeout[set])
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, m)
+		}
+		msgs = append(msgs, newNetfilterMessage(unix.NFNL_MSG_BATCH_END, unix.NLM_F_REQUEST, uint32(len(sets)+1),
+			unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES))
+		errs, err := netfilterExchange(msgs, len(sets))
+		if err != nil {
+			return err
+		}
+		if len(errs) == 0 {
+			break
+		}
+		// the batch is aborted as a whole if any message fails, so it's sent again once the sets are fixed.
+		for seq, err := range errs {
+			set := sets[seq-1]
+			if err != syscall.EINVAL || noTimeout[set] || retried {
+				return errors.Wrapf(err, "fail to add elements to nftables set [%s]", set)
+			}
+			noTimeout[set] = true
+		}
+		retried = true
+	}
+	for set, no := range noTimeout {
+		if no {
+			nftNoTimeout.Store(set, true)
+		}
+	}
+	return nil
+}
+
+// nftAddMessage returns the message adding elems to the set in format family#table#set, which doesn't fail
+// if they are added already.
+func nftAddMessage(seq uint32, name string, elems []setElement, timeout bool) (*netlinkMessage, error) {
+	family, table, set, err := splitNFTSet(name)
+	if err != nil {
+		return nil, err
+	}
+	m := newNetfilterMessage(unix.NFNL_SUBSYS_NFTABLES<<8|unix.NFT_MSG_NEWSETELEM,
+		unix.NLM_F_REQUEST|unix.NLM_F_CREATE|unix.NLM_F_ACK, seq, nftFamilies[family], 0)
+	m.attrString(unix.NFTA_SET_ELEM_LIST_TABLE, table)
+	m.attrString(unix.NFTA_SET_ELEM_LIST_SET, set)
+	m.begin(unix.NFTA_SET_ELEM_LIST_ELEMENTS)
+	for _, elem := range elems {
+		key := elem.ip.To4()
+		if key == nil {
+			key = elem.ip.To16()
+		}
+		m.begin(unix.NFTA_LIST_ELEM)
+		m.begin(unix.NFTA_SET_ELEM_KEY)
+		m.attr(unix.NFTA_DATA_VALUE, key)
+		m.end()
+		if timeout {
+			m.attrUint64(unix.NFTA_SET_ELEM_TIMEOUT, uint64(elem.timeout)*1000)
+		}
+		m.end()
+	}
+	m.end()
+	return m, nil
+}
@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+package gochinadns
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// _nftTypeIPv4 is the type of keys of IPv4 addresses, which is only kept by the kernel for the nft command.
+const _nftTypeIPv4 = 7
+
+// nftCommand sends the nftables message of typ in a batch, with attributes appended by attrs, and returns its error.
+func nftCommand(t *testing.T, typ uint16, attrs func(m *netlinkMessage)) error {
+	m := newNetfilterMessage(unix.NFNL_SUBSYS_NFTABLES<<8|typ, unix.NLM_F_REQUEST|unix.NLM_F_CREATE|unix.NLM_F_ACK,
+		1, unix.NFPROTO_INET, 0)
+	attrs(m)
+	errs, err := netfilterExchange([]*netlinkMessage{
+		newNetfilterMessage(unix.NFNL_MSG_BATCH_BEGIN, unix.NLM_F_REQUEST, 0, unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES),
+		m,
+		newNetfilterMessage(unix.NFNL_MSG_BATCH_END, unix.NLM_F_REQUEST, 2, unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES),
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return errs[1]
+}
+
+// createNFTSets creates the inet table of sets of IPv4 addresses, with the timeout flag or not, which is deleted
+// once the test finishes.
+func createNFTSets(t *testing.T, table string, sets map[string]bool) {
+	err := nftCommand(t, unix.NFT_MSG_NEWTABLE, func(m *netlinkMessage) {
+		m.attrString(unix.NFTA_TABLE_NAME, table)
+	})
+	if err != nil {
+		t.Skipf("Fail to create nftables table %s: %v", table, err)
+	}
+	t.Cleanup(func() {
+		nftCommand(t, unix.NFT_MSG_DELTABLE, func(m *netlinkMessage) { m.attrString(unix.NFTA_TABLE_NAME, table) })
+	})
+	id := uint32(0)
+	for set, timeout := range sets {
+		id++
+		err := nftCommand(t, unix.NFT_MSG_NEWSET, func(m *netlinkMessage) {
+			m.attrString(unix.NFTA_SET_TABLE, table)
+			m.attrString(unix.NFTA_SET_NAME, set)
+			if timeout {
+				m.attrUint32(unix.NFTA_SET_FLAGS, unix.NFT_SET_TIMEOUT)
+			}
+			m.attrUint32(unix.NFTA_SET_KEY_TYPE, _nftTypeIPv4)
+			m.attrUint32(unix.NFTA_SET_KEY_LEN, 4)
+			m.attrUint32(unix.NFTA_SET_ID, id)
+		})
+		if err != nil {
+			t.Fatalf("Fail to create nftables set %s: %v", set, err)
+		}
+	}
+}
+
+func TestAddNFTSet(t *testing.T) {
+	createNFTSets(t, "chinadns_test", map[string]bool{"gfw": true, "gfw_nt": false})
+	elems := []setElement{
+		{set: "inet#chinadns_test#gfw", ip: net.ParseIP("1.2.3.4"), timeout: 60},
+		{set: "inet#chinadns_test#gfw", ip: net.ParseIP("1.2.3.5"), timeout: 60},
+		{set: "inet#chinadns_test#gfw_nt", ip: net.ParseIP("1.2.3.6"), timeout: 60},
+	}
+	// the second time adds the elements again.
+	for i := 0; i < 2; i++ {
+		if err := addNFTSet(elems); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, elem := range append(elems, setElement{set: "inet#chinadns_test#gfw", ip: net.ParseIP("1.2.3.6")}) {
+		_, table, set, _ := splitNFTSet(elem.set)
+		// an element is deleted only if it's in the set.
+		err := nftCommand(t, unix.NFT_MSG_DELSETELEM, func(m *netlinkMessage) {
+			m.attrString(unix.NFTA_SET_ELEM_LIST_TABLE, table)
+			m.attrString(unix.NFTA_SET_ELEM_LIST_SET, set)
+			m.begin(unix.NFTA_SET_ELEM_LIST_ELEMENTS)
+			m.begin(unix.NFTA_LIST_ELEM)
+			m.begin(unix.NFTA_SET_ELEM_KEY)
+			m.attr(unix.NFTA_DATA_VALUE, elem.ip.To4())
+			m.end()
+			m.end()
+			m.end()
+		})
+		if in := err == nil; in != (elem.timeout > 0) {
+			t.Errorf("%s in nftables set %s = %v, want %v", elem.ip, elem.set, err, elem.timeout > 0)
+		}
+	}
+	if _, ok := nftNoTimeout.Load("inet#chinadns_test#gfw_nt"); !ok {
+		t.Error("Set without the timeout flag is not remembered")
+	}
+	if err := addNFTSet([]setElement{{set: "inet#chinadns_test#none", ip: net.ParseIP("1.2.3.4"), timeout: 60}}); err == nil {
+		t.Error("Adding to a nonexistent nftables set should fail")
+	}
+}
+
+func TestNFTSetConfig(t *testing.T) {
+	list := writeTempConfig(t, "google.com\n")
+	defer os.Remove(list)
+	o, err := buildOptions([]ServerOption{WithNFTSet(list, "inet#fw#gfw", "ip6#fw#gfw6")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := setConfigs(o.NFTSets), []string{list + "=inet#fw#gfw,ip6#fw#gfw6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nftsets = %q, want %q", got, want)
+	}
+	for _, set := range []string{"fw#gfw", "arp#fw#gfw", "inet##gfw", "inet#fw#"} {
+		if _, err := buildOptions([]ServerOption{WithNFTSet(list, set, "")}); err == nil {
+			t.Errorf("nftables set %q should fail", set)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package gochinadns
+
+import "github.com/pkg/errors"
+
+// supportsNFTSet is whether nftables sets are supported on this platform. Only Linux has them.
+const supportsNFTSet = false
+
+func addNFTSet(elems []setElement) error {
+	return errors.New("nftables sets are not supported on this platform")
+}
@@ -2,277 +2,1566 @@ package gochinadns
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"math"
 	"net"
-	"os"
+	"runtime"
+	"strings"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/yl2chen/cidranger"
 )
 
 // ServerOption provides ChinaDNS server options. Please use WithXXX functions to generate Options.
 type ServerOption func(*serverOptions) error
 
 type serverOptions struct {
-	Listen           string           //Listening address, such as `[::]:53`, `0.0.0.0:53`
-	ChinaCIDR        cidranger.Ranger //CIDR ranger to check whether an IP belongs to China
-	IPBlacklist      cidranger.Ranger
-	DomainBlacklist  *domainTrie
-	DomainPolluted   *domainTrie
-	TrustedServers   resolverArray //DNS servers which can be trusted
-	UntrustedServers resolverArray //DNS servers which may return polluted results
-	Timeout          time.Duration // Timeout for one DNS query
-	UDPMaxSize       int           //Max message size for UDP queries
-	TCPOnly          bool          //Use TCP only
-	Mutation         bool          //Enable DNS pointer mutation for trusted servers
-	Bidirectional    bool          //Drop results of trusted servers which containing IPs in China
-	ReusePort        bool          //Enable SO_REUSEPORT
-	Delay            time.Duration //Delay (in seconds) to query another DNS server when no reply received
-	TestDomains      []string      //Domain names to test connection health before starting a server
+	Logger                 Logger                  //Logger of the server
+	LogLevels              map[string]logrus.Level //Log levels of components
+	LogFields              map[string]interface{}  //Fields added to every log
+	Listen                 string                  //Listening address, such as `[::]:53`, `0.0.0.0:53`
+	MetricsListen          string                  //Listening address of the Prometheus metrics endpoint. Empty to disable.
+	StatsdAddr             string                  //Address of the StatsD server to push metrics to. Empty to disable.
+	DogStatsd              bool                    //Push metrics with DogStatsD tags
+	AdminListen            string                  //Listening address of the admin HTTP API. Empty to disable.
+	AdminToken             string                  //Bearer token required by the admin HTTP API. Empty to disable.
+	AdminCert              string                  //Path to the TLS certificate of the admin HTTP API. Empty to serve plain HTTP.
+	AdminKey               string                  //Path to the private key of AdminCert
+	AdminClientCA          string                  //Path to CA certificates which client certificates of the admin HTTP API are verified by
+	DebugListen            string                  //Listening address of the pprof endpoint. Empty to disable.
+	DnstapSocket           string                  //Path to the Frame Streams unix socket to send dnstap messages to. Empty to disable.
+	OTLPEndpoint           string                  //OTLP/HTTP endpoint to export traces to, such as `http://localhost:4318/v1/traces`. Empty to disable.
+	TraceRatio             float64                 //Ratio of queries to trace
+	Syslog                 bool                    //Send logs to syslog
+	SyslogAddr             string                  //Syslog server address: `local`, udp://host:port or tcp://host:port
+	SyslogFacility         string                  //Syslog facility, such as daemon or local0
+	AuditLog               string                  //Path to the audit log of blocked queries and rejected answers. Empty to disable.
+	RecentQueries          int                     //Number of latest queries to keep in memory. 0 to disable.
+	CacheEntries           int                     //Max replies cached. 0 to disable.
+	CacheBackend           CacheBackend            //Store of cached replies. nil for memory of CacheEntries.
+	CacheRedis             string                  //URL of Redis to cache replies in, with CacheEntries in memory in front. Empty to disable.
+	StateFile              string                  //Path to the file cached replies and learned state persist in across restarts. Empty to disable.
+	ListSources            []ListSource            //Sources of lists but files, which are watched
+	QueryLog               string                  //Path to the JSON query log, or `-` for stdout. Empty to disable.
+	QueryLogFormat         string                  //Format of the query log: json or dnsmasq
+	QueryLogMaxSize        int64                   //Rotate the query log when it grows over this size in bytes. 0 to disable.
+	QueryLogRotateInterval time.Duration           //Rotate the query log at this interval. 0 to disable.
+	QueryLogMaxBackups     int                     //Number of rotated query logs to keep. 0 keeps all.
+	QueryLogSample         int                     //Log 1 in QueryLogSample queries. 0 or 1 logs all.
+	ChinaCIDR              *cidrSet                //CIDR set to check whether an IP belongs to China
+	IPBlacklist            *cidrSet
+	DomainBlacklist        *domainTrie
+	DomainPolluted         *domainTrie
+	DomainBidiExempt       *domainTrie         //Domains exempt from the bidirectional mode
+	TrustedServers         resolverArray       //DNS servers which can be trusted
+	UntrustedServers       resolverArray       //DNS servers which may return polluted results
+	Timeout                time.Duration       // Timeout for one DNS query
+	UDPMaxSize             int                 //Max message size for UDP queries
+	TCPOnly                bool                //Use TCP only
+	Mutation               bool                //Enable DNS pointer mutation for trusted servers
+	MutationMethod         string              //Default mutation method for trusted servers. Overrides Mutation if set.
+	Bidirectional          bool                //Drop results of trusted servers which containing IPs in China
+	SuspectEmpty           bool                //Treat empty NOERROR replies of untrusted servers as suspect
+	Coalesce               bool                //Resolve identical queries in flight once
+	RawForward             bool                //Forward replies as they are received, without unpacking them fully
+	MaxConcurrency         int                 //Max resolutions in flight. 0 for no limit.
+	OverloadQueue          int                 //Max resolutions waiting for a slot when MaxConcurrency is reached
+	OverloadAction         string              //OverloadServfail or OverloadDrop
+	RateLimit              float64             //Queries per second of each client. 0 for no limit.
+	RateLimitBurst         int                 //Queries a client may send at once over RateLimit
+	RateLimitAction        string              //RateLimitRefused or RateLimitDrop
+	RateLimitExempt        []string            //CIDRs of clients which are not rate limited, by either rate limit
+	RRLRate                int                 //Identical responses per second to a network of clients. 0 for no limit.
+	RRLSlip                int                 //Every RRLSlip-th response over RRLRate is sent truncated. 0 to drop all.
+	RRLIPv4Prefix          int                 //Prefix length of IPv4 networks of clients limited together
+	RRLIPv6Prefix          int                 //Prefix length of IPv6 networks of clients limited together
+	AllowedClients         []string            //CIDRs of clients which are served. Empty for all clients.
+	DeniedClients          []string            //CIDRs of clients which are not served, even if they are allowed
+	ACLAction              string              //ACLRefused or ACLDrop
+	Middlewares            []Middleware        //Handlers which queries go through, the first first
+	EventHooks             []EventHooks        //Callbacks of events
+	TrustPolicy            TrustPolicy         //Verdict of answers. nil for the China route list.
+	ResolverSource         ResolverSource      //Source of resolvers added at runtime
+	ResolverSourceInterval time.Duration       //How often ResolverSource is polled. 0 to poll only on start.
+	KVStore                KVStore             //Store of resolvers and domain lists under KVPrefix, which is watched for changes
+	KVPrefix               string              //Prefix of keys of KVStore
+	Peers                  []string            //URLs of admin APIs of instances state is synced with
+	PeerInterval           time.Duration       //How often state is synced with Peers
+	QNAMEMinimize          bool                //Resolve iteratively with QNAME minimization instead of querying untrusted servers
+	ReusePort              bool                //Enable SO_REUSEPORT
+	UDPSockets             int                 //Number of UDP sockets to receive queries with, when ReusePort is enabled
+	UDPBatch               int                 //Max number of UDP packets read or written in one system call, 0 or 1 for one by one
+	SourcePortMin          int                 //Lower bound of local ports for UDP queries. 0 means OS assigned ports.
+	SourcePortMax          int                 //Upper bound of local ports for UDP queries.
+	UpstreamSockets        int                 //Number of long-lived UDP sockets per resolver. 0 for a socket per query.
+	UpstreamRotation       time.Duration       //How often long-lived UDP sockets are replaced by ones of new source ports
+	Delay                  time.Duration       //Delay (in seconds) to query another DNS server when no reply received
+	Dispatch               string              //DispatchSequential, DispatchParallel or DispatchGrouped. Empty means sequential.
+	FastestFirst           bool                //Query resolvers with the lowest average RTT first, instead of in the given order
+	Retries                int                 //Attempts after the first one to query a resolver over a protocol when it times out
+	RetryTimeout           time.Duration       //Timeout of each attempt. 0 means Timeout.
+	RetryBackoff           time.Duration       //Wait before the first retry, doubled before each one after it
+	RcodeFailover          bool                //Treat SERVFAIL, REFUSED and NOTIMP replies as failures, and try the next protocol or resolver
+	RelayAgreed            bool                //Relay the failure of RcodeFailover if every upstream replies the same rcode
+	TrustedQuorum          int                 //Number of trusted servers which must agree on an answer. 0 or 1 disables quorum mode.
+	DNS64                  *net.IPNet          //NAT64 prefix to synthesize AAAA answers with. nil disables DNS64.
+	MDNS                   *mdnsTarget         //Where .local names are resolved by multicast DNS. nil sends them to upstreams.
+	DomainRoutes           domainRoutes        //Routes of domains of dnsmasq conf and dnscrypt-proxy rules, which skip verdicts
+	BogusNXDomain          *cidrSet            //Addresses of answers replaced by NXDOMAIN, such as of search portals of ISPs
+	LocalZones             localZones          //Zones of zone files answered authoritatively
+	DHCPLeases             *dhcpLeases         //Hostnames of DHCP leases answered under DHCPDomain
+	DHCPDomain             string              //Local domain of hostnames of DHCP leases
+	MergedAnswers          string              //Origin whose addresses come first when accepted answers of both origins are merged. Empty disables it.
+	FastestIP              *ipProbe            //How addresses of answers are probed to be ordered by RTT. nil keeps the order of upstreams.
+	FastestIPWait          time.Duration       //How long answers wait for probes. 0 means 200ms.
+	TrustedECS             ecsPolicy           //How client supplied ECS options are sent to trusted servers
+	UntrustedECS           ecsPolicy           //How client supplied ECS options are sent to untrusted servers
+	TrustedSockets         SocketOptions       //Options of sockets of queries to trusted servers
+	UntrustedSockets       SocketOptions       //Options of sockets of queries to untrusted servers
+	IPSets                 []setRule           //Rules adding answered addresses to ipsets
+	NFTSets                []setRule           //Rules adding answered addresses to nftables sets
+	TestDomains            []string            //Domain names to test connection health before starting a server
+	TestQType              uint16              //Query type of TestDomains
+	TestExpect             map[string][]net.IP //Expected answers of some TestDomains, keyed by FQDN
+	SkipStartupTest        bool                //Skip testing resolvers with TestDomains, and keep them in the configured order
+	CanaryInterval         time.Duration       //Interval of canary checks for upstream hijacking. 0 disables canary checks.
+	BreakerThreshold       int                 //Consecutive failures of a resolver to stop querying it. 0 disables the circuit breaker.
+	BreakerCooldown        time.Duration       //How long a resolver gets no queries once its circuit breaker opens
+	HealthInterval         time.Duration       //Interval of health checks of resolvers with test domains. 0 disables them.
+	CanaryNXZone           string              //Zone under which random names never exist
+	CanaryName             string              //Domain name with stable answers
+	CanaryIPs              []net.IP            //Stable answers of CanaryName
+	UpstreamSummary        time.Duration       //Interval to log a summary of upstream health. 0 to disable.
+	PollutionWebhook       string              //URL to post pollution events to
+	UpstreamWebhook        string              //URL to post changes of states of resolvers to
+	Files                  []string            //Paths of loaded lists and config files
+	LazyLists              bool                //Serve before lists are loaded, and load them in the background
+	WatchInterval          time.Duration       //Interval changed Files should settle for before reload. 0 to disable.
+	Profiles               []profile           //Named sets of options, in order of definition
+	Profile                string              //Name of the active profile. Empty for none.
+
+	Reloader func() ([]ServerOption, error) //Builds options of reloads without options. Nil to build the last ones.
+
+	pendingResolvers []pendingResolver //resolvers to add once all options are applied
+	checking         bool              //collect problems in problems instead of failing on the first one, see Validate
+	lazy             bool              //defer lists, and leave them in lists if LazyLists is set, to load them in the background
+	lists            []ServerOption    //list loaders deferred until all options are applied, see deferList
+	loadingLists     bool              //whether lists are being loaded, see deferList
+	problems         []error
+}
+
+func newServerOptions() *serverOptions {
+	return &serverOptions{
+		Logger:         NewLogrusLogger(logrus.StandardLogger()),
+		QueryLogFormat: queryLogJSON,
+		Listen:         "[::]:53",
+		Timeout:        time.Second,
+		TestDomains:    []string{"qq.com"},
+		TestQType:      dns.TypeA,
+		IPBlacklist:    newCIDRSet(),
+		TrustedECS:     ecsPolicy{action: ecsForward},
+		UntrustedECS:   ecsPolicy{action: ecsForward},
+		RRLSlip:        2,
+		RRLIPv4Prefix:  24,
+		RRLIPv6Prefix:  56,
+		ACLAction:      ACLRefused,
+	}
+}
+
+// normalizeReusePort disables ReusePort if it's not supported, so that the same options work on every platform.
+// UDP sockets default to GOMAXPROCS with ReusePort, and 1 without it.
+func (o *serverOptions) normalizeReusePort() {
+	if o.ReusePort && !supportsReusePort {
+		o.ReusePort = false
+		o.logger(logServer).Info("SO_REUSEPORT is not supported on this platform. Disable it.")
+	}
+	if !o.ReusePort {
+		o.UDPSockets = 1
+	} else if o.UDPSockets <= 0 {
+		o.UDPSockets = runtime.GOMAXPROCS(0)
+	}
+}
+
+// normalizeUDPBatch reads and writes UDP packets one by one if batches are not supported on this platform.
+func (o *serverOptions) normalizeUDPBatch() {
+	if o.UDPBatch > 1 && !supportsUDPBatch {
+		o.UDPBatch = 0
+		o.logger(logServer).Debug("Batches of UDP packets are not supported on this platform. Disable them.")
+	}
+}
+
+func (o *serverOptions) normalizeChinaCIDR() {
+	if o.ChinaCIDR == nil {
+		o.ChinaCIDR = newCIDRSet()
+		if len(o.lists) == 0 {
+			o.logger(logLists).Warn("China route list is not specified. Disable CHNRoute.")
+		}
+	}
+}
+
+// normalizeMutation applies the default mutation method to resolvers without their own.
+func (o *serverOptions) normalizeMutation() {
+	method := o.MutationMethod
+	if method == "" {
+		method = mutationNone
+		if o.Mutation {
+			method = mutationPointer
+		}
+	}
+	for i := range o.TrustedServers {
+		if o.TrustedServers[i].mutation == "" {
+			o.TrustedServers[i].mutation = method
+		}
+	}
+	for i := range o.UntrustedServers {
+		if o.UntrustedServers[i].mutation == "" {
+			o.UntrustedServers[i].mutation = mutationNone
+		}
+	}
+}
+
+// fail returns err, or records it and returns nil when checking, so that the option goes on to find more problems.
+func (o *serverOptions) fail(err error) error {
+	if !o.checking {
+		return err
+	}
+	o.problems = append(o.problems, err)
+	return nil
+}
+
+// WithLogger sets the logger of the server. It's the standard logger of logrus by default.
+// Use NewLogrusLogger for a logrus logger or entry.
+func WithLogger(l Logger) ServerOption {
+	return func(o *serverOptions) error {
+		if l == nil {
+			return errors.New("Logger should not be nil")
+		}
+		o.Logger = l
+		return nil
+	}
+}
+
+// WithLogFields adds fields to every log of the server, such as an instance name to tell servers in a process apart.
+func WithLogFields(fields map[string]interface{}) ServerOption {
+	return func(o *serverOptions) error {
+		if o.LogFields == nil {
+			o.LogFields = make(map[string]interface{}, len(fields))
+		}
+		for k, v := range fields {
+			o.LogFields[k] = v
+		}
+		return nil
+	}
+}
+
+// WithLogLevels sets log levels of components, which are server, upstream, verdict and lists.
+// Logs less severe than the level of its component are dropped. The logger still filters logs by its own level.
+func WithLogLevels(levels map[string]string) ServerOption {
+	return func(o *serverOptions) error {
+		o.LogLevels = make(map[string]logrus.Level, len(levels))
+		for component, level := range levels {
+			if err := checkLogComponent(component); err != nil {
+				return err
+			}
+			l, err := logrus.ParseLevel(level)
+			if err != nil {
+				return errors.Wrapf(err, "invalid log level of %s", component)
+			}
+			o.LogLevels[component] = l
+		}
+		return nil
+	}
+}
+
+func WithListenAddr(addr string) ServerOption {
+	return func(o *serverOptions) error {
+		o.Listen = addr
+		return nil
+	}
+}
+
+// WithMetricsListen serves Prometheus metrics at http://addr/metrics.
+func WithMetricsListen(addr string) ServerOption {
+	return func(o *serverOptions) error {
+		o.MetricsListen = addr
+		return nil
+	}
+}
+
+// WithStatsd pushes metrics to the StatsD server at addr over UDP. Labels are sent as DogStatsD tags if dog is set,
+// or appended to metric names otherwise.
+func WithStatsd(addr string, dog bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.StatsdAddr = addr
+		o.DogStatsd = dog
+		return nil
+	}
+}
+
+// WithAdminListen serves the admin HTTP API at addr.
+func WithAdminListen(addr string) ServerOption {
+	return func(o *serverOptions) error {
+		o.AdminListen = addr
+		return nil
+	}
+}
+
+// WithAdminToken requires requests of the admin HTTP API to carry `Authorization: Bearer token`, except /healthz.
+// The token changes on reload.
+func WithAdminToken(token string) ServerOption {
+	return func(o *serverOptions) error {
+		o.AdminToken = token
+		return nil
+	}
+}
+
+// WithAdminTLS serves the admin HTTP API over TLS with the certificate and private key files, and requires client
+// certificates signed by CA certificates of clientCAFile if it's not empty. The certificate is loaded again once its
+// file changes, so that renewed certificates apply without a restart.
+func WithAdminTLS(certFile, keyFile, clientCAFile string) ServerOption {
+	return func(o *serverOptions) error {
+		if (certFile == "") != (keyFile == "") {
+			return errors.New("TLS of the admin API requires both a certificate and a private key")
+		}
+		o.AdminCert, o.AdminKey, o.AdminClientCA = certFile, keyFile, clientCAFile
+		return nil
+	}
+}
+
+// WithDebugListen serves net/http/pprof profiles at addr. Never expose it to untrusted networks.
+func WithDebugListen(addr string) ServerOption {
+	return func(o *serverOptions) error {
+		o.DebugListen = addr
+		return nil
+	}
+}
+
+// WithDnstap sends dnstap messages of client and upstream queries to the Frame Streams unix socket at path.
+func WithDnstap(path string) ServerOption {
+	return func(o *serverOptions) error {
+		o.DnstapSocket = path
+		return nil
+	}
+}
+
+// WithTracing exports OpenTelemetry traces of a ratio of queries to the OTLP/HTTP endpoint,
+// such as `http://localhost:4318/v1/traces`.
+func WithTracing(endpoint string, ratio float64) ServerOption {
+	return func(o *serverOptions) error {
+		if ratio < 0 || ratio > 1 {
+			return errors.Errorf("Trace ratio %g should be in [0, 1]", ratio)
+		}
+		o.OTLPEndpoint = endpoint
+		o.TraceRatio = ratio
+		return nil
+	}
+}
+
+// WithAuditLog appends one JSON object per blocked query or answer rejected as polluted to the file at path,
+// with the rule or heuristic which fired.
+func WithAuditLog(path string) ServerOption {
+	return func(o *serverOptions) error {
+		o.AuditLog = path
+		return nil
+	}
+}
+
+// WithCache caches up to entries replies to clients for their least TTL, which answer identical queries
+// without resolving them again. Cached replies are purged on reload. 0 to disable.
+func WithCache(entries int) ServerOption {
+	return func(o *serverOptions) error {
+		if entries < 0 {
+			return errors.Errorf("invalid cache size %d", entries)
+		}
+		o.CacheEntries = entries
+		return nil
+	}
+}
+
+// WithCacheBackend caches replies in backend instead of memory of the server, such as to share them among servers,
+// which enables the cache regardless of WithCache. Replies are purged from the backend on reload as well.
+func WithCacheBackend(backend CacheBackend) ServerOption {
+	return func(o *serverOptions) error {
+		if backend == nil {
+			return errors.New("invalid nil cache backend")
+		}
+		o.CacheBackend = backend
+		return nil
+	}
+}
+
+// WithRedisCache caches replies in Redis at url, in format redis://[[user]:password@]host[:port][/db][?prefix=chinadns:],
+// so that servers behind a load balancer share them, along with the polluted domains any of them learns.
+// Replies are cached in memory of WithCache as well for a few seconds, so that hits don't wait for Redis.
+// Redis is skipped for a while after it fails. Replies of all servers are purged on reload. Empty to disable.
+func WithRedisCache(url string) ServerOption {
+	return func(o *serverOptions) error {
+		if url != "" {
+			if _, err := parseRedisURL(url); err != nil {
+				return err
+			}
+		}
+		o.CacheRedis = url
+		return nil
+	}
+}
+
+// WithRecentQueries keeps the latest n queries in memory, which are served by the admin API.
+func WithRecentQueries(n int) ServerOption {
+	return func(o *serverOptions) error {
+		if n < 0 {
+			return errors.New("Number of recent queries should not be negative")
+		}
+		o.RecentQueries = n
+		return nil
+	}
+}
+
+// WithSyslog sends logs to the syslog server at addr with the facility.
+// Only logs of the server are sent, including those to the logger of WithLogger.
+// addr is `local` for the local syslog, or in format udp://host:port or tcp://host:port.
+func WithSyslog(addr, facility string) ServerOption {
+	return func(o *serverOptions) error {
+		if err := checkSyslogFacility(facility); err != nil {
+			return err
+		}
+		o.Syslog = true
+		o.SyslogAddr = addr
+		o.SyslogFacility = facility
+		return nil
+	}
+}
+
+// WithQueryLog writes one JSON object per query to the file at path, stdout if path is `-`,
+// or syslog if path is `syslog`: the one of WithSyslog if it's set, or else the local one with the daemon facility.
+func WithQueryLog(path string) ServerOption {
+	return func(o *serverOptions) error {
+		o.QueryLog = path
+		return nil
+	}
+}
+
+// WithQueryLogFormat sets the format of the query log: json (one JSON object per query, by default),
+// or dnsmasq (lines like `query[A] example.com from 192.168.1.2` of dnsmasq with log-queries).
+func WithQueryLogFormat(format string) ServerOption {
+	return func(o *serverOptions) error {
+		if err := checkQueryLogFormat(format); err != nil {
+			return err
+		}
+		o.QueryLogFormat = format
+		return nil
+	}
+}
+
+// WithQueryLogRotation rotates the query log when it grows over maxSize bytes or every interval,
+// and keeps the latest maxBackups rotated files. Zero values disable the limits.
+func WithQueryLogRotation(maxSize int64, interval time.Duration, maxBackups int) ServerOption {
+	return func(o *serverOptions) error {
+		if maxSize < 0 || interval < 0 || maxBackups < 0 {
+			return errors.New("Query log rotation limits should not be negative")
+		}
+		o.QueryLogMaxSize = maxSize
+		o.QueryLogRotateInterval = interval
+		o.QueryLogMaxBackups = maxBackups
+		return nil
+	}
+}
+
+// WithQueryLogSampling logs 1 in n queries randomly. 0 or 1 logs all queries.
+func WithQueryLogSampling(n int) ServerOption {
+	return func(o *serverOptions) error {
+		if n < 0 {
+			return errors.New("Query log sampling rate should not be negative")
+		}
+		o.QueryLogSample = n
+		return nil
+	}
+}
+
+func WithCHNList(path string) ServerOption {
+	return func(o *serverOptions) error {
+		if o.deferList(WithCHNList(path)) {
+			return nil
+		}
+		if path == "" {
+			return errors.New("empty path for China route list")
+		}
+		o.Files = uniqueAppendString(o.Files, path)
+		return o.loadCIDRList(&o.ChinaCIDR, FileList(path), "China route list", false)
+	}
+}
+
+// WithCHNListSource loads the China route list from source, which is watched for changes once the server starts.
+func WithCHNListSource(source ListSource) ServerOption {
+	return func(o *serverOptions) error {
+		o.addListSource(source)
+		if o.deferList(WithCHNListSource(source)) {
+			return nil
+		}
+		return o.loadCIDRList(&o.ChinaCIDR, source, "China route list", false)
+	}
+}
+
+func WithIPBlacklist(path string) ServerOption {
+	return func(o *serverOptions) error {
+		if o.deferList(WithIPBlacklist(path)) {
+			return nil
+		}
+		if path == "" {
+			return errors.New("empty path for IP blacklist")
+		}
+		o.Files = uniqueAppendString(o.Files, path)
+		return o.loadCIDRList(&o.IPBlacklist, FileList(path), "IP blacklist", true)
+	}
+}
+
+// WithIPBlacklistSource loads the IP blacklist from source, which is watched for changes once the server starts.
+func WithIPBlacklistSource(source ListSource) ServerOption {
+	return func(o *serverOptions) error {
+		o.addListSource(source)
+		if o.deferList(WithIPBlacklistSource(source)) {
+			return nil
+		}
+		return o.loadCIDRList(&o.IPBlacklist, source, "IP blacklist", true)
+	}
+}
+
+// WithBogusNXDomain loads addresses and CIDRs of search portals of ISPs, which are not treated as pollution like
+// the IP blacklist. Answers of only these addresses are replaced by NXDOMAIN, like bogus-nxdomain of dnsmasq.
+func WithBogusNXDomain(path string) ServerOption {
+	return func(o *serverOptions) error {
+		if o.deferList(WithBogusNXDomain(path)) {
+			return nil
+		}
+		if path == "" {
+			return errors.New("empty path for bogus NXDOMAIN list")
+		}
+		o.Files = uniqueAppendString(o.Files, path)
+		return o.loadCIDRList(&o.BogusNXDomain, FileList(path), "bogus NXDOMAIN list", true)
+	}
+}
+
+// WithBogusNXDomainSource loads the bogus NXDOMAIN list from source, which is watched for changes once the server starts.
+func WithBogusNXDomainSource(source ListSource) ServerOption {
+	return func(o *serverOptions) error {
+		o.addListSource(source)
+		if o.deferList(WithBogusNXDomainSource(source)) {
+			return nil
+		}
+		return o.loadCIDRList(&o.BogusNXDomain, source, "bogus NXDOMAIN list", true)
+	}
+}
+
+// loadCIDRList adds CIDRs of the list of source to set, and IPs as well if ips is true.
+func (o *serverOptions) loadCIDRList(set **cidrSet, source ListSource, name string, ips bool) error {
+	if source == nil {
+		return errors.New("nil source for " + name)
+	}
+	file, err := source.Open()
+	if err != nil {
+		return errors.Wrap(err, "fail to open "+name)
+	}
+	defer file.Close()
+
+	if *set == nil {
+		*set = newCIDRSet()
+	}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		_, network, err := net.ParseCIDR(scanner.Text())
+		if err != nil {
+			ip := net.ParseIP(scanner.Text())
+			if !ips || ip == nil {
+				if err := o.fail(errors.Wrapf(err, "%s:%d: parse %s as CIDR failed", sourceName(source), line, scanner.Text())); err != nil {
+					return err
+				}
+				continue
+			}
+			// net.ParseIP returns IPv4 addresses in 16 bytes, whose /128 network is an IPv6 one,
+			// which IPv4 answers never match.
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			l := 8 * len(ip)
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(l, l)}
+		}
+		(*set).Insert(network)
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "fail to scan "+name)
+	}
+	(*set).compact()
+	return nil
+}
+
+func WithDomainBlacklist(path string) ServerOption {
+	return func(o *serverOptions) error {
+		if o.deferList(WithDomainBlacklist(path)) {
+			return nil
+		}
+		return o.loadDomainFile(&o.DomainBlacklist, path, "domain blacklist")
+	}
+}
+
+// WithDomainBlacklistSource loads the domain blacklist from source, which is watched for changes once the server starts.
+func WithDomainBlacklistSource(source ListSource) ServerOption {
+	return func(o *serverOptions) error {
+		o.addListSource(source)
+		if o.deferList(WithDomainBlacklistSource(source)) {
+			return nil
+		}
+		return o.loadDomainList(&o.DomainBlacklist, source, "domain blacklist")
+	}
+}
+
+func WithDomainPolluted(path string) ServerOption {
+	return func(o *serverOptions) error {
+		if o.deferList(WithDomainPolluted(path)) {
+			return nil
+		}
+		return o.loadDomainFile(&o.DomainPolluted, path, "domain polluted")
+	}
+}
+
+// WithDomainPollutedSource loads the polluted domain list from source, which is watched for changes once the server starts.
+func WithDomainPollutedSource(source ListSource) ServerOption {
+	return func(o *serverOptions) error {
+		o.addListSource(source)
+		if o.deferList(WithDomainPollutedSource(source)) {
+			return nil
+		}
+		return o.loadDomainList(&o.DomainPolluted, source, "domain polluted")
+	}
+}
+
+// WithBidirectionalExempt loads domains whose trusted answers are accepted even if they contain IPs in China,
+// regardless of the bidirectional mode.
+func WithBidirectionalExempt(path string) ServerOption {
+	return func(o *serverOptions) error {
+		if o.deferList(WithBidirectionalExempt(path)) {
+			return nil
+		}
+		return o.loadDomainFile(&o.DomainBidiExempt, path, "bidirectional exempt list")
+	}
+}
+
+// WithBidirectionalExemptSource loads the bidirectional exempt list from source, which is watched for changes
+// once the server starts.
+func WithBidirectionalExemptSource(source ListSource) ServerOption {
+	return func(o *serverOptions) error {
+		o.addListSource(source)
+		if o.deferList(WithBidirectionalExemptSource(source)) {
+			return nil
+		}
+		return o.loadDomainList(&o.DomainBidiExempt, source, "bidirectional exempt list")
+	}
+}
+
+// addListSource adds source to the sources watched once, even if it's loaded later by deferList.
+func (o *serverOptions) addListSource(source ListSource) {
+	if source != nil && !o.loadingLists {
+		o.ListSources = append(o.ListSources, source)
+	}
+}
+
+// deferList defers the list loader opt of the options a server is created with until all options are applied,
+// so that WithLazyLists applies wherever it is. It returns false if the list is to be loaded now.
+func (o *serverOptions) deferList(opt ServerOption) bool {
+	if !o.lazy || o.loadingLists {
+		return false
+	}
+	o.lists = append(o.lists, opt)
+	return true
+}
+
+// WithLazyLists starts serving before the China route list, the IP blacklist and domain lists are loaded,
+// which are loaded in the background and swapped in like Reload once they are ready, instead of delaying the start.
+// Until then, lists are empty: answers are not checked for pollution, resolvers are classified as trusted unless
+// they are declared untrusted, and Ready fails. Errors of lists are logged instead of failing NewServer.
+func WithLazyLists(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.LazyLists = b
+		return nil
+	}
+}
+
+func (o *serverOptions) loadDomainFile(trie **domainTrie, path, name string) error {
+	if path == "" {
+		return errors.New("empty path for " + name)
+	}
+	o.Files = uniqueAppendString(o.Files, path)
+	return o.loadDomainList(trie, FileList(path), name)
+}
+
+func (o *serverOptions) loadDomainList(trie **domainTrie, source ListSource, name string) error {
+	if source == nil {
+		return errors.New("nil source for " + name)
+	}
+	file, err := source.Open()
+	if err != nil {
+		return errors.Wrap(err, "fail to open "+name)
+	}
+	defer file.Close()
+
+	if *trie == nil {
+		*trie = new(domainTrie)
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		(*trie).Add(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "fail to scan "+name)
+	}
+	return nil
+}
+
+func WithTrustedResolvers(resolvers ...string) ServerOption {
+	return func(o *serverOptions) error {
+		return o.addResolvers(resolvers, true)
+	}
+}
+
+// WithResolvers adds resolvers which are trusted unless they are in China by the China route list.
+// They are classified once all options are applied, so the route list may be loaded by a later option.
+func WithResolvers(resolvers ...string) ServerOption {
+	return func(o *serverOptions) error {
+		return o.addResolvers(resolvers, false)
+	}
+}
+
+// WithTrustedUpstreams adds resolvers constructed by NewResolver as trusted, like WithTrustedResolvers.
+func WithTrustedUpstreams(resolvers ...*Resolver) ServerOption {
+	return func(o *serverOptions) error {
+		return o.addUpstreams(resolvers, true)
+	}
+}
+
+// WithUpstreams adds resolvers constructed by NewResolver, like WithResolvers.
+func WithUpstreams(resolvers ...*Resolver) ServerOption {
+	return func(o *serverOptions) error {
+		return o.addUpstreams(resolvers, false)
+	}
+}
+
+// pendingResolver is a resolver schema, or a resolver constructed by NewResolver, to add once all options are applied,
+// when the China route list and the TCPOnly option it depends on are final.
+type pendingResolver struct {
+	schema   string
+	resolver *Resolver //nil if it's a schema
+	trusted  bool      //trusted regardless of the China route list
+}
+
+// addUpstreams adds resolvers as pending resolvers.
+func (o *serverOptions) addUpstreams(resolvers []*Resolver, trusted bool) error {
+	for _, r := range resolvers {
+		if r == nil || r.addr == "" {
+			if err := o.fail(errors.New("Schema error: empty resolver")); err != nil {
+				return err
+			}
+			continue
+		}
+		o.pendingResolvers = append(o.pendingResolvers, pendingResolver{resolver: r, trusted: trusted})
+	}
+	return nil
+}
+
+// addResolvers checks schemas at once, and adds them as pending resolvers.
+func (o *serverOptions) addResolvers(schemas []string, trusted bool) error {
+	for _, schema := range schemas {
+		if _, err := schemaToResolver(schema, o.TCPOnly); err != nil {
+			if err := o.fail(errors.Wrap(err, "Schema error")); err != nil {
+				return err
+			}
+			continue
+		}
+		o.pendingResolvers = append(o.pendingResolvers, pendingResolver{schema: schema, trusted: trusted})
+	}
+	return nil
+}
+
+// normalizeResolvers adds pending resolvers, which are untrusted if they are in China and not trusted explicitly.
+func (o *serverOptions) normalizeResolvers() error {
+	pending := o.pendingResolvers
+	o.pendingResolvers = nil
+	for _, p := range pending {
+		newResolver, err := p.newResolver(o.TCPOnly)
+		if err != nil {
+			return errors.Wrap(err, "Schema error")
+		}
+		if err := newResolver.bootstrap(); err != nil {
+			if err := o.fail(err); err != nil {
+				return err
+			}
+			continue
+		}
+		if p.trusted {
+			newResolver.reason = "declared trusted"
+			o.TrustedServers = uniqueAppendResolver(o.TrustedServers, newResolver)
+			continue
+		}
+		host, _, _ := net.SplitHostPort(newResolver.dialAddr())
+		if newResolver.local {
+			newResolver.reason = fmt.Sprintf("%s is of the local network, which forwards queries to anywhere", host)
+			o.UntrustedServers = uniqueAppendResolver(o.UntrustedServers, newResolver)
+			continue
+		}
+		if newResolver.isJSON() {
+			if host, err = newResolver.jsonIP(); err != nil {
+				if err := o.fail(err); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		contain, err := o.ChinaCIDR.Contains(net.ParseIP(host))
+		if err != nil {
+			if err := o.fail(errors.Wrap(err, fmt.Sprintf("fail to check whether %s is in China", host))); err != nil {
+				return err
+			}
+			continue
+		}
+		if contain {
+			newResolver.reason = fmt.Sprintf("%s is in the China route list", host)
+			o.UntrustedServers = uniqueAppendResolver(o.UntrustedServers, newResolver)
+		} else {
+			newResolver.reason = fmt.Sprintf("%s is not in the China route list", host)
+			o.TrustedServers = uniqueAppendResolver(o.TrustedServers, newResolver)
+		}
+	}
+	return nil
+}
+
+// newResolver returns a copy of the resolver, so that the server doesn't share it with the caller of NewResolver,
+// or parses the schema.
+func (p pendingResolver) newResolver(tcpOnly bool) (Resolver, error) {
+	if p.resolver == nil {
+		return schemaToResolver(p.schema, tcpOnly)
+	}
+	r := *p.resolver
+	r.protocols = append([]string(nil), r.protocols...)
+	r.addrs = nil
+	return r, nil
+}
+
+func uniqueAppendString(to []string, item string) []string {
+	for _, e := range to {
+		if item == e {
+			return to
+		}
+	}
+	return append(to, item)
+}
+
+func containsString(list []string, item string) bool {
+	for _, e := range list {
+		if item == e {
+			return true
+		}
+	}
+	return false
+}
+
+func uniqueAppendResolver(to []Resolver, items ...Resolver) []Resolver {
+LOOP:
+	for _, item := range items {
+		for _, e := range to {
+			if item.GetAddr() == e.GetAddr() {
+				continue LOOP
+			}
+		}
+		to = append(to, item)
+	}
+	return to
+}
+
+func WithTimeout(t time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		o.Timeout = t
+		return nil
+	}
+}
+
+func WithUDPMaxBytes(max int) ServerOption {
+	return func(o *serverOptions) error {
+		o.UDPMaxSize = max
+		return nil
+	}
+}
+
+func WithTCPOnly(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.TCPOnly = b
+		return nil
+	}
+}
+
+func WithMutation(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.Mutation = b
+		return nil
+	}
+}
+
+// WithMutationMethod sets the default mutation method for trusted servers: none, pointer, case or edns.
+// Resolvers can override it with the mutation parameter of their schemas.
+func WithMutationMethod(method string) ServerOption {
+	return func(o *serverOptions) error {
+		method = strings.ToLower(method)
+		if err := checkMutation(method); err != nil {
+			return err
+		}
+		o.MutationMethod = method
+		return nil
+	}
 }
 
-func newServerOptions() *serverOptions {
-	return &serverOptions{
-		Listen:      "[::]:53",
-		Timeout:     time.Second,
-		TestDomains: []string{"qq.com"},
-		IPBlacklist: cidranger.NewPCTrieRanger(),
+func WithBidirectional(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.Bidirectional = b
+		return nil
 	}
 }
 
-func (o *serverOptions) normalizeChinaCIDR() {
-	if o.ChinaCIDR == nil {
-		o.ChinaCIDR = cidranger.NewPCTrieRanger()
-		logrus.Warn("China route list is not specified. Disable CHNRoute.")
+func WithSuspectEmpty(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.SuspectEmpty = b
+		return nil
+	}
+}
+
+// WithCoalescing resolves identical queries in flight, of the same name, type, class, DO and CD bits and client subnet,
+// only once, and answers all of them with the reply, so that a burst of queries of a hot name costs one resolution.
+func WithCoalescing(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.Coalesce = b
+		return nil
 	}
 }
 
-var errNotReady = errors.New("not ready")
+// WithRawForward forwards replies to clients as they are received, with only the ID rewritten, and unpacks only
+// the answer section of replies for the verdict, instead of unpacking and packing every message. It saves most of
+// the CPU and garbage of a query. Queries which are explained, traced, tapped by dnstap, or rewritten beyond the ID,
+// such as with QNAME minimization, a trusted quorum, ECS rewriting, or mutations, are not forwarded raw.
+func WithRawForward(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.RawForward = b
+		return nil
+	}
+}
 
-func WithListenAddr(addr string) ServerOption {
+// WithMaxConcurrency limits resolutions in flight to max, so that a burst of queries can't spawn unbounded goroutines.
+// Up to queue more wait for a slot, for at most the timeout of queries. The others are answered by action,
+// OverloadServfail or OverloadDrop. Local answers, such as those of the domain blacklist, are not limited.
+func WithMaxConcurrency(max, queue int, action string) ServerOption {
 	return func(o *serverOptions) error {
-		o.Listen = addr
+		if max < 0 || queue < 0 {
+			return errors.Errorf("invalid concurrency limit %d with queue %d", max, queue)
+		}
+		if action == "" {
+			action = OverloadServfail
+		}
+		if action != OverloadServfail && action != OverloadDrop {
+			return errors.Errorf("unknown overload action [%s]", action)
+		}
+		o.MaxConcurrency, o.OverloadQueue, o.OverloadAction = max, queue, action
 		return nil
 	}
 }
 
-func WithCHNList(path string) ServerOption {
+// WithClientRateLimit limits queries of each client IP to rate per second, with bursts of up to burst queries,
+// so that a client flooding the server can't starve the others. burst is rate rounded up if it's less than 1.
+// Queries over the limit are answered by action, RateLimitRefused or RateLimitDrop. 0 rate for no limit.
+func WithClientRateLimit(rate float64, burst int, action string) ServerOption {
 	return func(o *serverOptions) error {
-		if path == "" {
-			return errors.New("empty path for China route list")
+		if rate < 0 || burst < 0 {
+			return errors.Errorf("invalid rate limit %v with burst %d", rate, burst)
 		}
-		file, err := os.Open(path)
-		if err != nil {
-			return errors.Wrap(err, "fail to open China route list")
+		if burst < 1 && rate > 0 {
+			burst = int(math.Ceil(rate))
+		}
+		if action == "" {
+			action = RateLimitRefused
+		}
+		if action != RateLimitRefused && action != RateLimitDrop {
+			return errors.Errorf("unknown rate limit action [%s]", action)
+		}
+		o.RateLimit, o.RateLimitBurst, o.RateLimitAction = rate, burst, action
+		return nil
+	}
+}
+
+// WithRateLimitExempt exempts clients in cidrs, such as 192.168.1.0/24 or single IPs, from WithClientRateLimit
+// and WithResponseRateLimit.
+func WithRateLimitExempt(cidrs ...string) ServerOption {
+	return func(o *serverOptions) error {
+		if _, err := parseClientCIDRs(cidrs, "exempt"); err != nil {
+			return err
+		}
+		o.RateLimitExempt = cidrs
+		return nil
+	}
+}
 
+// WithResponseRateLimit limits identical UDP responses to each network of clients to rate per second, as Response
+// Rate Limiting of BIND does, so that the server can't be abused as a reflector of amplification attacks.
+// Responses over the limit are dropped, but every slip-th one is sent truncated, so that legitimate clients retry
+// over TCP. 0 slip to drop all of them, and 0 rate for no limit. See WithRRLPrefixes for the networks.
+func WithResponseRateLimit(rate, slip int) ServerOption {
+	return func(o *serverOptions) error {
+		if rate < 0 || slip < 0 {
+			return errors.Errorf("invalid response rate limit %d with slip %d", rate, slip)
 		}
-		defer file.Close()
+		o.RRLRate, o.RRLSlip = rate, slip
+		return nil
+	}
+}
 
-		if o.ChinaCIDR == nil {
-			o.ChinaCIDR = cidranger.NewPCTrieRanger()
+// WithRRLPrefixes sets the prefix lengths of IPv4 and IPv6 networks of clients, whose responses are limited together
+// by WithResponseRateLimit. They are 24 and 56 by default.
+func WithRRLPrefixes(v4, v6 int) ServerOption {
+	return func(o *serverOptions) error {
+		if v4 < 0 || v4 > 32 || v6 < 0 || v6 > 128 {
+			return errors.Errorf("invalid RRL prefix lengths /%d and /%d", v4, v6)
 		}
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			_, network, err := net.ParseCIDR(scanner.Text())
-			if err != nil {
-				return errors.Wrap(err, fmt.Sprintf("parse %s as CIDR failed", scanner.Text()))
+		o.RRLIPv4Prefix, o.RRLIPv6Prefix = v4, v6
+		return nil
+	}
+}
+
+// WithAllowedClients serves only clients in cidrs, such as 192.168.1.0/24 or single IPs, over both UDP and TCP,
+// which a server listening on a public address needs. Queries of other clients are answered by WithACLAction.
+// Empty cidrs to serve all clients.
+func WithAllowedClients(cidrs ...string) ServerOption {
+	return func(o *serverOptions) error {
+		if _, err := parseClientCIDRs(cidrs, "allowed"); err != nil {
+			return err
+		}
+		o.AllowedClients = trimCIDRs(cidrs)
+		return nil
+	}
+}
+
+// WithDeniedClients serves no clients in cidrs, even if they are allowed by WithAllowedClients.
+// Their queries are answered by WithACLAction.
+func WithDeniedClients(cidrs ...string) ServerOption {
+	return func(o *serverOptions) error {
+		if _, err := parseClientCIDRs(cidrs, "denied"); err != nil {
+			return err
+		}
+		o.DeniedClients = trimCIDRs(cidrs)
+		return nil
+	}
+}
+
+// WithACLAction sets how queries of clients which are not allowed, or denied, are answered: ACLRefused,
+// the default, or ACLDrop.
+func WithACLAction(action string) ServerOption {
+	return func(o *serverOptions) error {
+		if action == "" {
+			action = ACLRefused
+		}
+		if action != ACLRefused && action != ACLDrop {
+			return errors.Errorf("unknown ACL action [%s]", action)
+		}
+		o.ACLAction = action
+		return nil
+	}
+}
+
+// WithMiddleware adds middlewares which queries go through in order, after the client rate limit and before the cache,
+// so that they may filter, rewrite or log queries and replies. Queries answered by a middleware itself are not counted
+// in metrics and logs of the server.
+func WithMiddleware(middlewares ...Middleware) ServerOption {
+	return func(o *serverOptions) error {
+		for _, m := range middlewares {
+			if m == nil {
+				return errors.New("invalid nil middleware")
 			}
-			o.ChinaCIDR.Insert(cidranger.NewBasicRangerEntry(*network))
 		}
-		if err := scanner.Err(); err != nil {
-			return errors.Wrap(err, "fail to scan china route list")
+		o.Middlewares = append(o.Middlewares, middlewares...)
+		return nil
+	}
+}
+
+// WithEventHooks registers callbacks of queries, answers, blocked queries, polluted answers and changes of states
+// of resolvers, so that embedders may build their own logging or alerting. Hooks registered more than once are
+// all called, in order.
+func WithEventHooks(hooks EventHooks) ServerOption {
+	return func(o *serverOptions) error {
+		o.EventHooks = append(o.EventHooks, hooks)
+		return nil
+	}
+}
+
+// WithTrustPolicy replaces the verdict of answers by the China route list with policy, such as to research other
+// heuristics. Nil for the default policy. The policy is swapped on reload, and queries in flight keep the old one.
+func WithTrustPolicy(policy TrustPolicy) ServerOption {
+	return func(o *serverOptions) error {
+		o.TrustPolicy = policy
+		return nil
+	}
+}
+
+// WithResolverSource adds resolvers of source to the configured ones, so that upstreams may come from service
+// discovery rather than static configuration. The source is polled once the server starts, and then every interval
+// if it's positive, while it may push changes at any time by Server.RefreshResolvers. Changes of resolvers reload
+// the server, and failures of the source are logged, with the last resolvers of the source kept.
+func WithResolverSource(source ResolverSource, interval time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if source == nil || interval < 0 {
+			return errors.Errorf("invalid resolver source with interval %s", interval)
 		}
+		o.ResolverSource, o.ResolverSourceInterval = source, interval
 		return nil
 	}
 }
 
-func WithIPBlacklist(path string) ServerOption {
+// WithKVConfig adds resolvers and domain lists of keys under prefix of store, such as etcd or Consul, so that
+// a fleet of servers is configured centrally. Keys after prefix are trusted-resolvers and resolvers, of schemas
+// separated by commas or lines, and domain-blacklist, domain-polluted and bidirectional-exempt, of domain lists.
+// Others are skipped with a warning. Keys are watched once the server starts, and changes reload the server.
+// Keys failing to be read fail the option, so that a reload keeps the last options.
+func WithKVConfig(store KVStore, prefix string) ServerOption {
 	return func(o *serverOptions) error {
-		if path == "" {
-			return errors.New("empty path for IP blacklist")
+		if store == nil {
+			return errors.New("nil KV store")
 		}
-		file, err := os.Open(path)
+		ctx, cancel := context.WithTimeout(context.Background(), _kvTimeout)
+		defer cancel()
+		name := kvName(store, prefix)
+		values, err := store.List(ctx, prefix)
 		if err != nil {
-			return errors.Wrap(err, "fail to open IP blacklist")
+			return errors.Wrap(err, "fail to read config of "+name)
 		}
-		defer file.Close()
+		o.KVStore, o.KVPrefix = store, prefix
+		return o.applyKVConfig(values, name)
+	}
+}
 
-		if o.IPBlacklist == nil {
-			o.IPBlacklist = cidranger.NewPCTrieRanger()
+// WithKVConfigURL is WithKVConfig of the store and the prefix of url, which is consul://[token@]host:port/prefix,
+// or etcd://[user:password@]host:port/prefix, with consul+https or etcd+https for HTTPS.
+func WithKVConfigURL(url string) ServerOption {
+	return func(o *serverOptions) error {
+		if url == "" {
+			return nil
 		}
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			_, network, err := net.ParseCIDR(scanner.Text())
-			if err != nil {
-				ip := net.ParseIP(scanner.Text())
-				if ip == nil {
-					return errors.Wrap(err, fmt.Sprintf("parse %s as CIDR failed", scanner.Text()))
-				}
-				l := 8 * len(ip)
-				network = &net.IPNet{IP: ip, Mask: net.CIDRMask(l, l)}
-			}
-			o.IPBlacklist.Insert(cidranger.NewBasicRangerEntry(*network))
+		store, prefix, err := parseKVURL(url)
+		if err != nil {
+			return err
 		}
-		if err := scanner.Err(); err != nil {
-			return errors.Wrap(err, "fail to scan IP blacklist")
+		return WithKVConfig(store, prefix)(o)
+	}
+}
+
+func WithQNAMEMinimization(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.QNAMEMinimize = b
+		return nil
+	}
+}
+
+// WithUDPSockets receives queries with n UDP sockets bound to the listening address with SO_REUSEPORT, each read by
+// its own goroutine, so that the kernel spreads packets across cores. 0 for GOMAXPROCS. It's ignored without ReusePort.
+func WithUDPSockets(n int) ServerOption {
+	return func(o *serverOptions) error {
+		if n < 0 {
+			return errors.Errorf("invalid number of UDP sockets %d", n)
 		}
+		o.UDPSockets = n
 		return nil
 	}
 }
 
-func WithDomainBlacklist(path string) ServerOption {
+// WithUDPBatch reads and writes UDP packets of clients in batches of at most n packets, with recvmmsg and sendmmsg,
+// to save system calls under load. 0 or 1 to read and write them one by one. It's ignored on platforms other than Linux.
+func WithUDPBatch(n int) ServerOption {
 	return func(o *serverOptions) error {
-		if path == "" {
-			return errors.New("empty path for domain blacklist")
+		if n < 0 {
+			return errors.Errorf("invalid UDP batch size %d", n)
+		}
+		o.UDPBatch = n
+		return nil
+	}
+}
+
+// WithReusePort binds listeners with SO_REUSEPORT. It's ignored on platforms without it, such as Windows.
+func WithReusePort(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.ReusePort = b
+		return nil
+	}
+}
+
+// WithSourcePortRange randomizes local ports of UDP queries among [min, max].
+func WithSourcePortRange(min, max int) ServerOption {
+	return func(o *serverOptions) error {
+		if min <= 0 || max > 65535 || min > max {
+			return errors.Errorf("invalid source port range %d-%d", min, max)
+		}
+		o.SourcePortMin = min
+		o.SourcePortMax = max
+		return nil
+	}
+}
+
+// WithUpstreamSockets sends UDP queries to every resolver over n long-lived connected sockets, matching replies
+// by random IDs and questions, instead of a socket per query. It saves ephemeral ports and conntrack entries on
+// routers, at the cost of the entropy of source ports against off-path spoofing, since the ports of the sockets don't
+// change. 0, the default, for a socket per query. It's ignored with WithSourcePortRange, which randomizes the port
+// of every query. Queries with compression pointer mutation, see WithMutation, still get a socket per query.
+func WithUpstreamSockets(n int) ServerOption {
+	return func(o *serverOptions) error {
+		if n < 0 {
+			return errors.Errorf("invalid number of upstream sockets %d", n)
+		}
+		o.UpstreamSockets = n
+		return nil
+	}
+}
+
+// WithUpstreamRotation replaces every long-lived socket of WithUpstreamSockets by one of a new source port once it's
+// older than d, while queries in flight on the old socket wait for their replies, so that off-path attackers have a
+// moving port to guess as well as the ID. 0, the default, to keep sockets until they fail.
+func WithUpstreamRotation(d time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if d < 0 {
+			return errors.Errorf("invalid upstream socket rotation %s", d)
+		}
+		o.UpstreamRotation = d
+		return nil
+	}
+}
+
+// WithTrustedQuorum queries all trusted servers at once and only accepts an answer when at least n of them agree.
+func WithTrustedQuorum(n int) ServerOption {
+	return func(o *serverOptions) error {
+		o.TrustedQuorum = n
+		return nil
+	}
+}
+
+// WithDNS64 synthesizes AAAA answers from A answers with the NAT64 prefix, such as the Well-Known Prefix
+// 64:ff9b::/96, for names without AAAA answers, like DNS64 of RFC 6147, so that IPv6-only clients reach IPv4-only
+// hosts through NAT64. A answers are judged like any other reply before AAAA answers are synthesized from them.
+// Answers are synthesized for every client, except those setting the CD bit. An empty prefix disables DNS64.
+func WithDNS64(prefix string) ServerOption {
+	return func(o *serverOptions) error {
+		if prefix == "" {
+			o.DNS64 = nil
+			return nil
 		}
-		file, err := os.Open(path)
+		ipNet, err := parseNAT64Prefix(prefix)
 		if err != nil {
-			return errors.Wrap(err, "fail to open domain blacklist")
+			return err
 		}
-		defer file.Close()
+		o.DNS64 = ipNet
+		return nil
+	}
+}
 
-		if o.DomainBlacklist == nil {
-			o.DomainBlacklist = new(domainTrie)
+// WithMDNS resolves names under local. by multicast DNS of RFC 6762, instead of leaking them to upstreams.
+// The target is the name of an interface to send multicast queries on, default for the interface of the default
+// route, or ip:port of a responder, such as an Avahi reflector, to send queries to directly. Names nobody answers
+// in the timeout are NXDOMAIN. An empty target disables it.
+func WithMDNS(target string) ServerOption {
+	return func(o *serverOptions) error {
+		if target == "" {
+			o.MDNS = nil
+			return nil
 		}
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			o.DomainBlacklist.Add(scanner.Text())
+		t, err := parseMDNSTarget(target)
+		if err != nil {
+			return err
 		}
-		if err := scanner.Err(); err != nil {
-			return errors.Wrap(err, "fail to scan domain blacklist")
+		o.MDNS = t
+		return nil
+	}
+}
+
+// WithMergedAnswers waits for replies of both trusted and untrusted servers, and if both are accepted, such as
+// answers of a China CDN edge and an overseas one, answers addresses of both without duplicates, so that clients
+// with Happy Eyeballs choose between them. Addresses of first, OriginTrusted or OriginUntrusted, come first, and
+// those of the other origin are renamed after them. Merged answers wait for the slower origin. An empty first
+// disables it.
+func WithMergedAnswers(first string) ServerOption {
+	return func(o *serverOptions) error {
+		switch first {
+		case "", OriginTrusted, OriginUntrusted:
+		default:
+			return errors.Errorf("invalid origin of merged answers [%s]", first)
 		}
+		o.MergedAnswers = first
 		return nil
 	}
 }
 
-func WithDomainPolluted(path string) ServerOption {
+// WithFastestIP probes addresses of answers, by connecting to a TCP port with tcp:PORT, such as tcp:443, or by ICMP
+// echo with icmp, and orders them by RTT like SmartDNS, so that clients connect to the fastest CDN edge first.
+// Answers wait for probes at most wait, 0 for 200ms, and probes taking longer are cached for later answers,
+// like all results of probes. An empty probe disables it.
+func WithFastestIP(probe string, wait time.Duration) ServerOption {
 	return func(o *serverOptions) error {
-		if path == "" {
-			return errors.New("empty path for domain polluted")
+		if wait < 0 {
+			return errors.Errorf("invalid wait of probes [%s]", wait)
 		}
-		file, err := os.Open(path)
+		o.FastestIPWait = wait
+		if probe == "" {
+			o.FastestIP = nil
+			return nil
+		}
+		p, err := parseIPProbe(probe)
 		if err != nil {
-			return errors.Wrap(err, "fail to open domain polluted")
+			return err
 		}
-		defer file.Close()
+		o.FastestIP = p
+		return nil
+	}
+}
 
-		if o.DomainPolluted == nil {
-			o.DomainPolluted = new(domainTrie)
+func WithDelay(t time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		o.Delay = t
+		return nil
+	}
+}
+
+// WithDispatch sets how queries are dispatched to trusted or untrusted servers: DispatchSequential (default) queries
+// one server after another, moving on after the delay or a failure; DispatchParallel queries all at once, which answers
+// fastest at the cost of upstream load; DispatchGrouped queries servers of a group, given by the group parameter of
+// resolvers, all at once, and groups one after another like DispatchSequential.
+//
+// Resolvers with the weight parameter are balanced: with DispatchSequential, they take turns at the positions of
+// weighted resolvers in proportion to their weights, while unweighted ones keep their positions. With DispatchGrouped,
+// resolvers of a group with weights are queried one after another, in a weighted random order, instead of at once.
+func WithDispatch(dispatch string) ServerOption {
+	return func(o *serverOptions) error {
+		if dispatch == "" {
+			dispatch = DispatchSequential
 		}
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			o.DomainPolluted.Add(scanner.Text())
+		if err := checkDispatch(dispatch); err != nil {
+			return err
 		}
-		if err := scanner.Err(); err != nil {
-			return errors.Wrap(err, "fail to scan domain polluted")
+		o.Dispatch = dispatch
+		return nil
+	}
+}
+
+// WithFastestFirst queries healthy resolvers in the order of their moving average RTTs, fastest first,
+// instead of the order they are given in, and failing ones last. One in _probeInterval queries tries a random other
+// resolver first, so that slower ones are measured again. With DispatchGrouped, groups are ordered by their
+// fastest resolvers. It has no effect with DispatchParallel.
+func WithFastestFirst(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.FastestFirst = b
+		return nil
+	}
+}
+
+// WithRetry queries a resolver again over the same protocol, up to retries times, when it times out,
+// before moving on to its next protocol. Each attempt times out after timeout, or Timeout if it's 0, unless the
+// resolver has its own timeout. The first retry waits for backoff, and each one after it twice as long as the last.
+func WithRetry(retries int, timeout, backoff time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if retries < 0 || timeout < 0 || backoff < 0 {
+			return errors.Errorf("invalid retry policy of %d retries with timeout %s and backoff %s", retries, timeout, backoff)
 		}
+		o.Retries, o.RetryTimeout, o.RetryBackoff = retries, timeout, backoff
 		return nil
 	}
 }
 
-func WithTrustedResolvers(resolvers ...string) ServerOption {
+// WithRcodeFailover treats SERVFAIL, REFUSED and NOTIMP replies as failures of resolvers, which try their next
+// protocol, and then the next resolver, instead of relaying the error to the client. If relayAgreed is set and every
+// upstream queried fails with the same rcode, such as SERVFAIL for a broken domain, that reply is relayed instead
+// of an empty one. Lookups of quorum mode don't vote.
+func WithRcodeFailover(failover, relayAgreed bool) ServerOption {
 	return func(o *serverOptions) error {
-		for _, schema := range resolvers {
-			newResolver, err := schemaToResolver(schema, o.TCPOnly)
-			if err != nil {
-				return errors.Wrap(err, "Schema error")
-			}
-			o.TrustedServers = uniqueAppendResolver(o.TrustedServers, newResolver)
+		o.RcodeFailover, o.RelayAgreed = failover, relayAgreed
+		return nil
+	}
+}
+
+// WithECSPolicy sets how client supplied EDNS Client Subnet options are sent to trusted and untrusted servers.
+// A policy is one of `forward` (default), `strip`, or a CIDR prefix to replace client subnets with.
+func WithECSPolicy(trusted, untrusted string) ServerOption {
+	return func(o *serverOptions) (err error) {
+		if o.TrustedECS, err = parseECSPolicy(trusted); err != nil {
+			return
+		}
+		o.UntrustedECS, err = parseECSPolicy(untrusted)
+		return
+	}
+}
+
+// WithUpstreamSocketOptions sets options of sockets of queries to trusted and untrusted servers, such as SO_MARK
+// for policy routing, so that trusted queries may go out of a VPN interface and untrusted ones out of the WAN,
+// or DSCP for QoS rules. They are only supported on Linux, where SO_MARK requires CAP_NET_ADMIN, except Source,
+// the local IP queries are sent from on multi-homed hosts, which the source parameter of a resolver overrides.
+func WithUpstreamSocketOptions(trusted, untrusted SocketOptions) ServerOption {
+	return func(o *serverOptions) error {
+		if err := trusted.check(); err != nil {
+			return err
+		}
+		if err := untrusted.check(); err != nil {
+			return err
 		}
+		o.TrustedSockets, o.UntrustedSockets = trusted, untrusted
 		return nil
 	}
 }
 
-func WithResolvers(resolvers ...string) ServerOption {
+// WithIPSet adds addresses answered for domains in the domain list at path to the Linux ipset set4 if they are IPv4,
+// or set6 if they are IPv6, like the ipset option of dnsmasq, so that firewall and transparent proxy rules follow DNS.
+// Either set may be empty to skip addresses of its family. Addresses expire after their TTLs if the sets are created
+// with timeout support, such as `ipset create gfwlist hash:ip timeout 0`, and never otherwise.
+// It may be given more than once for more lists. Only supported on Linux, where ipsets require CAP_NET_ADMIN.
+func WithIPSet(path, set4, set6 string) ServerOption {
 	return func(o *serverOptions) error {
-		if o.ChinaCIDR == nil {
-			return errNotReady
+		if !supportsIPSet {
+			return errors.New("ipsets are not supported on this platform")
 		}
-		for _, schema := range resolvers {
-			newResolver, err := schemaToResolver(schema, o.TCPOnly)
-			if err != nil {
-				return errors.Wrap(err, "Schema error")
+		if set4 == "" && set6 == "" {
+			return errors.New("empty ipset for " + path)
+		}
+		for _, set := range []string{set4, set6} {
+			// IPSET_MAXNAMELEN is 32, including the terminating NUL.
+			if len(set) >= 32 {
+				return errors.Errorf("invalid ipset [%s]", set)
 			}
-			host, _, _ := net.SplitHostPort(newResolver.GetAddr())
-			contain, err := o.ChinaCIDR.Contains(net.ParseIP(host))
-			if err != nil {
-				return errors.Wrap(err, fmt.Sprintf("fail to check whether %s is in China", host))
+		}
+		o.IPSets = append(o.IPSets, setRule{path: path, set4: set4, set6: set6})
+		return o.loadSetList(&o.IPSets, len(o.IPSets)-1, path, "ipset list")
+	}
+}
+
+// WithNFTSet adds addresses answered for domains in the domain list at path to the nftables set set4 if they are IPv4,
+// or set6 if they are IPv6, like WithIPSet for systems which have moved off iptables. Sets are in format
+// family#table#set, such as inet#fw#gfwlist, and either may be empty to skip addresses of its family.
+// Addresses are added in batches, and expire after their TTLs if the sets have the timeout flag.
+// It may be given more than once for more lists. Only supported on Linux, where it requires CAP_NET_ADMIN.
+func WithNFTSet(path, set4, set6 string) ServerOption {
+	return func(o *serverOptions) error {
+		if !supportsNFTSet {
+			return errors.New("nftables sets are not supported on this platform")
+		}
+		if set4 == "" && set6 == "" {
+			return errors.New("empty nftables set for " + path)
+		}
+		for _, set := range []string{set4, set6} {
+			if set == "" {
+				continue
 			}
-			if contain {
-				o.UntrustedServers = uniqueAppendResolver(o.UntrustedServers, newResolver)
-			} else {
-				o.TrustedServers = uniqueAppendResolver(o.TrustedServers, newResolver)
+			if _, _, _, err := splitNFTSet(set); err != nil {
+				return err
 			}
 		}
-		return nil
+		o.NFTSets = append(o.NFTSets, setRule{path: path, set4: set4, set6: set6})
+		return o.loadSetList(&o.NFTSets, len(o.NFTSets)-1, path, "nftables set list")
 	}
 }
 
-func uniqueAppendString(to []string, item string) []string {
-	for _, e := range to {
-		if item == e {
-			return to
-		}
+// WithCanary enables periodic canary checks to detect hijacked or NXDOMAIN redirecting upstreams.
+// Resolvers failing the check are not used until they pass it again.
+func WithCanary(interval time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		o.CanaryInterval = interval
+		return nil
 	}
-	return append(to, item)
 }
 
-func uniqueAppendResolver(to []resolver, item resolver) []resolver {
-	for _, e := range to {
-		if item.GetAddr() == e.GetAddr() {
-			return to
+// WithCircuitBreaker stops sending queries to a resolver once it fails threshold lookups in a row, for cooldown.
+// Then the resolver is probed in the background, with the first test domain, and queried again once it answers.
+// A threshold of 0 disables it. If every resolver of a kind fails, they are all queried anyway.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if threshold < 0 || threshold > 0 && cooldown <= 0 {
+			return errors.Errorf("invalid circuit breaker threshold %d with cooldown %s", threshold, cooldown)
 		}
+		o.BreakerThreshold, o.BreakerCooldown = threshold, cooldown
+		return nil
 	}
-	return append(to, item)
 }
 
-func WithTimeout(t time.Duration) ServerOption {
+// WithHealthCheck tests resolvers with test domains at interval, like on start, and queries skip protocols
+// of resolvers which answer no test query over them, until they do again. Resolvers down over every protocol
+// are queried as usual. Lookups of checks also count for metrics, stats and the circuit breaker.
+func WithHealthCheck(interval time.Duration) ServerOption {
 	return func(o *serverOptions) error {
-		o.Timeout = t
+		o.HealthInterval = interval
 		return nil
 	}
 }
 
-func WithUDPMaxBytes(max int) ServerOption {
+// WithCanaryDomains sets the canary queries: random names under nxZone should not exist,
+// and name should be answered with at least one of ips. Leave ips empty to skip the latter.
+func WithCanaryDomains(nxZone, name string, ips ...string) ServerOption {
 	return func(o *serverOptions) error {
-		o.UDPMaxSize = max
+		if nxZone == "" {
+			return errors.New("empty zone for NXDOMAIN canary")
+		}
+		o.CanaryNXZone, o.CanaryName, o.CanaryIPs = nxZone, name, nil
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return errors.Errorf("invalid canary answer %s", s)
+			}
+			o.CanaryIPs = append(o.CanaryIPs, ip)
+		}
 		return nil
 	}
 }
 
-func WithTCPOnly(b bool) ServerOption {
+// WithPollutionWebhook posts a JSON event to url whenever an answer is rejected as polluted.
+func WithPollutionWebhook(url string) ServerOption {
 	return func(o *serverOptions) error {
-		o.TCPOnly = b
+		o.PollutionWebhook = url
 		return nil
 	}
 }
 
-func WithMutation(b bool) ServerOption {
+// WithUpstreamWebhook posts a JSON UpstreamStateEvent to url whenever a resolver changes state, and whenever
+// every trusted resolver becomes unreachable or one of them is reachable again. Resolvers change states
+// by WithHealthCheck, WithCircuitBreaker, WithCanary and the admin API.
+func WithUpstreamWebhook(url string) ServerOption {
 	return func(o *serverOptions) error {
-		o.Mutation = b
+		o.UpstreamWebhook = url
 		return nil
 	}
 }
 
-func WithBidirectional(b bool) ServerOption {
+// WithUpstreamSummary logs a summary of the health and latency of every resolver at the interval.
+func WithUpstreamSummary(interval time.Duration) ServerOption {
 	return func(o *serverOptions) error {
-		o.Bidirectional = b
+		o.UpstreamSummary = interval
 		return nil
 	}
 }
 
-func WithReusePort(b bool) ServerOption {
+// WithWatchFiles watches files of lists and config files, and reloads the server like Reload
+// once changed files stay the same for the interval, so that a file being written is not loaded. 0 to disable.
+func WithWatchFiles(interval time.Duration) ServerOption {
 	return func(o *serverOptions) error {
-		o.ReusePort = b
+		if interval < 0 {
+			return errors.New("Watch interval should not be negative")
+		}
+		o.WatchInterval = interval
 		return nil
 	}
 }
 
-func WithDelay(t time.Duration) ServerOption {
+// WithReloader builds options by reload when the server is reloaded without options, such as by WithWatchFiles or
+// the admin API, instead of those it was last created or reloaded with, so that a caller parsing a config file
+// itself, such as the chinadns command, re-reads it. Files read by reload are watched by WithWatchFiles.
+func WithReloader(reload func() ([]ServerOption, error), files ...string) ServerOption {
 	return func(o *serverOptions) error {
-		o.Delay = t
+		o.Reloader = reload
+		for _, path := range files {
+			o.Files = uniqueAppendString(o.Files, path)
+		}
 		return nil
 	}
 }
@@ -283,3 +1572,50 @@ func WithTestDomains(testDomains ...string) ServerOption {
 		return nil
 	}
 }
+
+// WithTestQueryType sets the query type of test domains, such as A or AAAA. The default is A.
+func WithTestQueryType(qtype string) ServerOption {
+	return func(o *serverOptions) error {
+		t, ok := dns.StringToType[strings.ToUpper(qtype)]
+		if !ok {
+			return errors.Errorf("unknown test query type [%s]", qtype)
+		}
+		o.TestQType = t
+		return nil
+	}
+}
+
+// WithTestExpect sets the expected answers of the test domain name. A resolver passes a test of name only if
+// one of the A or AAAA records answered is in ips. Empty ips removes the expectation.
+func WithTestExpect(name string, ips ...string) ServerOption {
+	return func(o *serverOptions) error {
+		expect := make([]net.IP, 0, len(ips))
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return errors.Errorf("invalid expected answer %s of test domain %s", s, name)
+			}
+			expect = append(expect, ip)
+		}
+		testExpect := make(map[string][]net.IP, len(o.TestExpect)+1)
+		for k, v := range o.TestExpect {
+			testExpect[k] = v
+		}
+		if len(expect) == 0 {
+			delete(testExpect, dns.Fqdn(name))
+		} else {
+			testExpect[dns.Fqdn(name)] = expect
+		}
+		o.TestExpect = testExpect
+		return nil
+	}
+}
+
+// WithSkipStartupTest skips testing resolvers with test domains when the server is created or resolvers change,
+// such as on a router which boots before its WAN link is up. Resolvers are queried in the configured order.
+func WithSkipStartupTest(skip bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.SkipStartupTest = skip
+		return nil
+	}
+}
@@ -0,0 +1,152 @@
+package gochinadns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolversOrderIndependent(t *testing.T) {
+	f, err := ioutil.TempFile("", "china-*.list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("114.114.114.0/24\n")
+	f.Close()
+
+	for _, opts := range [][]ServerOption{
+		{WithResolvers("114.114.114.114:53", "8.8.8.8:53"), WithTCPOnly(true), WithCHNList(f.Name())},
+		{WithCHNList(f.Name()), WithTCPOnly(true), WithResolvers("114.114.114.114:53", "8.8.8.8:53")},
+	} {
+		o, err := buildOptions(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(o.UntrustedServers) != 1 || o.UntrustedServers[0].GetAddr() != "114.114.114.114:53" {
+			t.Errorf("Untrusted servers = %v, want 114.114.114.114:53", o.UntrustedServers)
+		}
+		if len(o.TrustedServers) != 1 || o.TrustedServers[0].GetAddr() != "8.8.8.8:53" {
+			t.Errorf("Trusted servers = %v, want 8.8.8.8:53", o.TrustedServers)
+		}
+		if p := o.TrustedServers[0].GetProtocols(); !reflect.DeepEqual(p, []string{"tcp"}) {
+			t.Errorf("Protocols = %v, want tcp only", p)
+		}
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "china-*.list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("114.114.114.0/24\n")
+	f.Close()
+
+	c, err := EffectiveConfig(WithCHNList(f.Name()), WithResolvers("114.114.114.114:53", "8.8.8.8:53"), WithTrustedResolvers("119.29.29.29:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]string)
+	for _, r := range append(c.TrustedResolvers, c.UntrustedResolvers...) {
+		reasons[r.Addr] = r.Reason
+	}
+	want := map[string]string{
+		"114.114.114.114:53": "114.114.114.114 is in the China route list",
+		"8.8.8.8:53":         "8.8.8.8 is not in the China route list",
+		"119.29.29.29:53":    "declared trusted",
+	}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("reasons = %v, want %v", reasons, want)
+	}
+	if len(c.UntrustedResolvers) != 1 || c.Lists.ChinaCIDR != 1 {
+		t.Errorf("EffectiveConfig() = %+v, want 1 untrusted resolver and 1 China route", c)
+	}
+
+	if _, err := EffectiveConfig(WithResolvers("tls@1.1.1.1:853")); err == nil {
+		t.Error("EffectiveConfig should fail with an invalid resolver")
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp+tcp@8.8.8.8:53"), WithSkipStartupTest(true),
+		WithTestDomains("www.qq.com"), WithMiddleware(func(next dns.Handler) dns.Handler { return next }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.Config()
+	if c.Middlewares != 1 || c.CustomTrustPolicy || len(c.TrustedResolvers) != 1 {
+		t.Errorf("Config() = %+v, want 1 middleware and 1 trusted resolver", c)
+	}
+	c.TrustedResolvers[0].Protocols[0] = "tcp"
+	c.TestDomains[0] = "www.google.com"
+	if c := s.Config(); c.TrustedResolvers[0].Protocols[0] != "udp" || c.TestDomains[0] != "www.qq.com" {
+		t.Error("changes of a snapshot change the server")
+	}
+}
+
+func TestLazyLists(t *testing.T) {
+	f, err := ioutil.TempFile("", "china-*.list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("114.114.114.0/24\n")
+	f.Close()
+	opts := []ServerOption{WithCHNList(f.Name()), WithResolvers("114.114.114.114:53"), WithTCPOnly(true),
+		WithSkipStartupTest(true), WithListenAddr("127.0.0.1:0"), WithLazyLists(true)}
+
+	o := newServerOptions()
+	o.lazy = true
+	if err := o.apply(opts); err != nil {
+		t.Fatal(err)
+	}
+	if o.ChinaCIDR.Len() != 0 || len(o.lists) != 1 || len(o.TrustedServers) != 1 {
+		t.Errorf("China routes %d, pending lists %d, trusted %v before lists are loaded, want 0, 1 and 1",
+			o.ChinaCIDR.Len(), len(o.lists), o.TrustedServers)
+	}
+
+	s, err := NewServer(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.options().ChinaCIDR.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Lists should be loaded in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if o := s.options(); len(o.UntrustedServers) != 1 || len(o.TrustedServers) != 0 {
+		t.Errorf("Trusted %v, untrusted %v after lists are loaded, want 114.114.114.114:53 untrusted",
+			o.TrustedServers, o.UntrustedServers)
+	}
+}
+
+func TestIPBlacklistSingleIPs(t *testing.T) {
+	o, err := buildOptions([]ServerOption{WithIPBlacklistSource(DataList([]byte("1.2.3.4\n2001:db8::1\n10.0.0.0/8\n")))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"1.2.3.4":         true,
+		"::ffff:1.2.3.4":  true,
+		"1.2.3.5":         false,
+		"2001:db8::1":     true,
+		"2001:db8::2":     false,
+		"10.1.2.3":        true,
+		"::ffff:10.1.2.3": true,
+		"::ffff:1.2.3.5":  false,
+		"::ffff:11.0.0.0": false,
+	} {
+		if hit, err := o.IPBlacklist.Contains(net.ParseIP(ip)); err != nil || hit != want {
+			t.Errorf("IP blacklist contains %s = %v (%v), want %v", ip, hit, err, want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package gochinadns
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Heuristics by which answers are rejected as polluted.
+const (
+	heuristicIPBlacklist      = "ip-blacklist"      //answer contains IPs in the IP blacklist
+	heuristicEmptyNoError     = "empty-noerror"     //untrusted server replies NOERROR without answers
+	heuristicOverseasMismatch = "overseas-mismatch" //untrusted answer is overseas and shares no IP with the trusted one
+)
+
+// PollutionEvent describes an answer rejected as polluted.
+type PollutionEvent struct {
+	Time      time.Time `json:"time"`
+	Domain    string    `json:"domain"`
+	QType     string    `json:"qtype"`
+	IPs       []string  `json:"ips"`
+	Resolver  string    `json:"resolver"`
+	Heuristic string    `json:"heuristic"`
+}
+
+// PollutionStats is a snapshot of pollution detected since the server starts.
+type PollutionStats struct {
+	Total      uint64            `json:"total"`
+	Heuristics map[string]uint64 `json:"heuristics"` //heuristic -> number of rejected answers
+	Domains    []PollutedDomain  `json:"domains"`    //most polluted domains
+}
+
+// PollutedDomain is the number of rejected answers of a domain, by heuristic.
+type PollutedDomain struct {
+	Domain     string            `json:"domain"`
+	Count      uint64            `json:"count"`
+	Heuristics map[string]uint64 `json:"heuristics"`
+	LastSeen   time.Time         `json:"last_seen"`
+}
+
+// pollutionStats counts rejected answers per domain and per heuristic, with at most
+// _topCapacity domains. The least polluted domain is evicted when it's full.
+type pollutionStats struct {
+	mu         sync.Mutex
+	heuristics map[string]uint64
+	domains    map[string]*PollutedDomain
+}
+
+func newPollutionStats() *pollutionStats {
+	return &pollutionStats{heuristics: make(map[string]uint64), domains: make(map[string]*PollutedDomain)}
+}
+
+func (p *pollutionStats) observe(domain, heuristic string, t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.heuristics[heuristic]++
+	d := p.domains[domain]
+	if d == nil {
+		if len(p.domains) >= _topCapacity {
+			var least *PollutedDomain
+			for _, d := range p.domains {
+				if least == nil || d.Count < least.Count {
+					least = d
+				}
+			}
+			delete(p.domains, least.Domain)
+		}
+		d = &PollutedDomain{Domain: domain, Heuristics: make(map[string]uint64)}
+		p.domains[domain] = d
+	}
+	d.Count++
+	d.Heuristics[heuristic]++
+	d.LastSeen = t
+}
+
+// snapshot returns the n most polluted domains in descending order of counts, or all of them if n <= 0.
+func (p *pollutionStats) snapshot(n int) *PollutionStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := &PollutionStats{Heuristics: make(map[string]uint64), Domains: make([]PollutedDomain, 0, len(p.domains))}
+	for h, c := range p.heuristics {
+		st.Heuristics[h] = c
+		st.Total += c
+	}
+	for _, d := range p.domains {
+		copied := *d
+		copied.Heuristics = make(map[string]uint64, len(d.Heuristics))
+		for h, c := range d.Heuristics {
+			copied.Heuristics[h] = c
+		}
+		st.Domains = append(st.Domains, copied)
+	}
+	sort.Slice(st.Domains, func(i, j int) bool {
+		if st.Domains[i].Count == st.Domains[j].Count {
+			return st.Domains[i].Domain < st.Domains[j].Domain
+		}
+		return st.Domains[i].Count > st.Domains[j].Count
+	})
+	if n > 0 && len(st.Domains) > n {
+		st.Domains = st.Domains[:n]
+	}
+	return st
+}
+
+func (s *Server) reportPollution(rep *upstreamReply, heuristic string) {
+	atomic.AddUint64(&s.pollutionCount, 1)
+	s.metrics.observePollution(heuristic)
+
+	event := &PollutionEvent{
+		Time:      time.Now(),
+		Resolver:  rep.server.GetAddr(),
+		Heuristic: heuristic,
+	}
+	if len(rep.Question) > 0 {
+		event.Domain = rep.Question[0].Name
+		event.QType = dns.TypeToString[rep.Question[0].Qtype]
+	}
+	for _, ip := range answerIPs(rep.Msg) {
+		event.IPs = append(event.IPs, ip.String())
+	}
+	s.verdictLog.WithFields(map[string]interface{}{
+		"question":  event.Domain + " " + event.QType,
+		"server":    event.Resolver,
+		"heuristic": heuristic,
+	}).Debug("Polluted answer rejected: ", event.IPs)
+	if event.Domain != "" {
+		s.stats.pollution.observe(event.Domain, heuristic, event.Time)
+		s.redis.addPolluted(strings.TrimSuffix(event.Domain, "."))
+	}
+	s.pollutionHook.Post(event)
+	s.events.pollution(event)
+	s.audit.Log(&AuditEntry{
+		Time:     event.Time,
+		Event:    auditPolluted,
+		Domain:   event.Domain,
+		QType:    event.QType,
+		Rule:     heuristic,
+		Resolver: event.Resolver,
+		IPs:      event.IPs,
+	})
+}
+
+// PollutionCount returns how many answers have been rejected as polluted.
+func (s *Server) PollutionCount() uint64 {
+	return atomic.LoadUint64(&s.pollutionCount)
+}
+
+// PollutionStats returns pollution detected per heuristic, and the n most polluted domains.
+// All tracked domains are returned if n <= 0.
+func (s *Server) PollutionStats(n int) *PollutionStats {
+	return s.stats.pollution.snapshot(n)
+}
+
+// LearnedPolluted returns the sorted domains with answers rejected as polluted,
+// which can be saved as a list for WithDomainPolluted. Those learned by servers sharing Redis of WithRedisCache
+// and by peers of WithPeers are included.
+func (s *Server) LearnedPolluted() []string {
+	return s.learnedPolluted(true)
+}
+
+// learnedPolluted returns the sorted polluted domains learned by the server and servers sharing Redis,
+// and those learned by peers if peers is set.
+func (s *Server) learnedPolluted(peers bool) []string {
+	st := s.stats.pollution.snapshot(0)
+	seen := make(map[string]bool, len(st.Domains))
+	domains := make([]string, 0, len(st.Domains))
+	for _, d := range st.Domains {
+		domain := strings.TrimSuffix(d.Domain, ".")
+		seen[domain] = true
+		domains = append(domains, domain)
+	}
+	shared := [][]string{s.redis.pollutedDomains()}
+	if peers {
+		shared = append(shared, s.peers.pollutedDomains(time.Now()))
+	}
+	for _, shared := range shared {
+		for _, domain := range shared {
+			if !seen[domain] {
+				seen[domain] = true
+				domains = append(domains, domain)
+			}
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+func overlapIPs(a, b []net.IP) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Equal(y) {
+				return true
+			}
+		}
+	}
+	return false
+}
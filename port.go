@@ -0,0 +1,99 @@
+package gochinadns
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// _portRetry is the max number of random ports a query tries before falling back to an ephemeral port.
+const _portRetry = 8
+
+// portPool randomizes local ports of outgoing UDP queries among a reserved range,
+// so that every query gets a fresh socket with more source entropy than the OS ephemeral port allocator.
+type portPool struct {
+	min, max int
+
+	mu    sync.Mutex
+	rnd   *rand.Rand
+	inUse map[int]struct{}
+}
+
+func newPortPool(min, max int) *portPool {
+	return &portPool{
+		min:   min,
+		max:   max,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		inUse: make(map[int]struct{}),
+	}
+}
+
+// acquire picks a random port which is not in use by other queries. It returns 0 if all ports are busy.
+func (p *portPool) acquire() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	size := p.max - p.min + 1
+	if len(p.inUse) >= size {
+		return 0
+	}
+	for {
+		port := p.min + p.rnd.Intn(size)
+		if _, ok := p.inUse[port]; !ok {
+			p.inUse[port] = struct{}{}
+			return port
+		}
+	}
+}
+
+func (p *portPool) release(port int) {
+	p.mu.Lock()
+	delete(p.inUse, port)
+	p.mu.Unlock()
+}
+
+// Dial connects to address from a random port of the pool.
+func (p *portPool) Dial(cli *dns.Client, address string) (*dns.Conn, error) {
+	for i := 0; i < _portRetry; i++ {
+		port := p.acquire()
+		if port == 0 {
+			break
+		}
+		local := &net.UDPAddr{Port: port}
+		d := net.Dialer{Timeout: cli.Timeout, LocalAddr: local}
+		if cli.Dialer != nil {
+			d.Control = cli.Dialer.Control
+			if addr, ok := cli.Dialer.LocalAddr.(*net.UDPAddr); ok {
+				local.IP = addr.IP
+			}
+		}
+		conn, err := d.Dial("udp", address)
+		if err != nil {
+			p.release(port)
+			if errors.Is(err, syscall.EADDRINUSE) {
+				continue
+			}
+			return nil, err
+		}
+		return &dns.Conn{Conn: &pooledConn{UDPConn: conn.(*net.UDPConn), pool: p, port: port}, UDPSize: cli.UDPSize}, nil
+	}
+	return cli.Dial(address)
+}
+
+// pooledConn returns its port to the pool when closed.
+type pooledConn struct {
+	*net.UDPConn
+	pool *portPool
+	port int
+	once sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	err := c.UDPConn.Close()
+	c.once.Do(func() { c.pool.release(c.port) })
+	return err
+}
@@ -0,0 +1,62 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSourcePortRange(t *testing.T) {
+	var mu sync.Mutex
+	sources := make(map[string]bool)
+	addr := startEchoUpstream(t, false, &mu, sources)
+	const min, max = 42000, 42099
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTimeout(time.Second), WithSourcePortRange(min, max),
+		WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, _, err := s.exchange(context.Background(), s.UDPCli, req, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	ports := make(map[int]bool)
+	for source := range sources {
+		a, err := net.ResolveUDPAddr("udp", source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Port < min || a.Port > max {
+			t.Errorf("query is sent from port %d, out of %d-%d", a.Port, min, max)
+		}
+		ports[a.Port] = true
+	}
+	// 20 queries of 100 ports hardly ever share fewer than 10 of them.
+	if len(ports) < 10 {
+		t.Errorf("queries are sent from %d ports, want them to vary", len(ports))
+	}
+	if len(s.ports.inUse) != 0 {
+		t.Errorf("%d ports are not released", len(s.ports.inUse))
+	}
+
+	// busy ports are skipped.
+	p := newPortPool(min, min+1)
+	a, b := p.acquire(), p.acquire()
+	if a == b || p.acquire() != 0 {
+		t.Errorf("ports %d and %d of a pool of 2 are acquired, and no more should be", a, b)
+	}
+	p.release(a)
+	if port := p.acquire(); port != a {
+		t.Errorf("acquire() = %d, want the released %d", port, a)
+	}
+}
@@ -0,0 +1,84 @@
+package gochinadns
+
+import (
+	"github.com/pkg/errors"
+)
+
+// profile is a named set of options, applied over other options when it's active.
+type profile struct {
+	name string
+	opts []ServerOption
+}
+
+// WithProfile defines a profile of opts, such as `home` or `travel`, which are applied after other options
+// when the profile is active. Defining a profile again adds opts to it.
+func WithProfile(name string, opts ...ServerOption) ServerOption {
+	return func(o *serverOptions) error {
+		if name == "" {
+			return errors.New("empty profile name")
+		}
+		for i := range o.Profiles {
+			if o.Profiles[i].name == name {
+				o.Profiles[i].opts = append(o.Profiles[i].opts, opts...)
+				return nil
+			}
+		}
+		o.Profiles = append(o.Profiles, profile{name: name, opts: opts})
+		return nil
+	}
+}
+
+// WithActiveProfile activates the profile of name, defined by WithProfile or a config file. Empty for none.
+func WithActiveProfile(name string) ServerOption {
+	return func(o *serverOptions) error {
+		o.Profile = name
+		return nil
+	}
+}
+
+func (o *serverOptions) findProfile(name string) (profile, bool) {
+	for _, p := range o.Profiles {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return profile{}, false
+}
+
+// buildOptions builds options from opts with the profile switched to at runtime, if any.
+func (s *Server) buildOptions(opts []ServerOption) (*serverOptions, error) {
+	if s.profile != "" {
+		opts = append(opts[:len(opts):len(opts)], WithActiveProfile(s.profile))
+	}
+	if len(s.sourced) > 0 {
+		opts = append(opts[:len(opts):len(opts)], WithUpstreams(s.sourced...))
+	}
+	return buildOptions(opts)
+}
+
+// Profiles returns names of defined profiles in order of definition, and the active one.
+func (s *Server) Profiles() (names []string, active string) {
+	o := s.options()
+	for _, p := range o.Profiles {
+		names = append(names, p.name)
+	}
+	return names, o.Profile
+}
+
+// SwitchProfile reloads the server like Reload with the profile of name active, until it's switched again.
+// Empty name switches back to the profile set by options.
+func (s *Server) SwitchProfile(name string) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if _, ok := s.options().findProfile(name); !ok && name != "" {
+		return errors.Errorf("unknown profile [%s]", name)
+	}
+	prev := s.profile
+	s.profile = name
+	if err := s.reload(s.optFuncs); err != nil {
+		s.profile = prev
+		return err
+	}
+	s.log.WithField("profile", s.options().Profile).Info("Profile switched.")
+	return nil
+}
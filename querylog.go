@@ -0,0 +1,366 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// QueryLogEntry is a line of the query log, or a record of recent queries.
+type QueryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Path     string    `json:"path"`
+	Resolver string    `json:"resolver,omitempty"`
+	Rcode    string    `json:"rcode"`
+	Latency  float64   `json:"latency_ms"`
+	Reason   string    `json:"reason"`
+
+	Answers []QueryAnswer `json:"answers,omitempty"`
+}
+
+// QueryAnswer is an answer record of a query.
+type QueryAnswer struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+func queryAnswers(reply *dns.Msg) []QueryAnswer {
+	answers := make([]QueryAnswer, 0, len(reply.Answer))
+	for _, rr := range reply.Answer {
+		h := rr.Header()
+		a := QueryAnswer{Name: h.Name, Type: dns.TypeToString[h.Rrtype]}
+		switch rr := rr.(type) {
+		case *dns.A:
+			a.Data = rr.A.String()
+		case *dns.AAAA:
+			a.Data = rr.AAAA.String()
+		case *dns.CNAME:
+			a.Data = rr.Target
+		default:
+			a.Data = strings.TrimPrefix(rr.String(), h.String())
+		}
+		answers = append(answers, a)
+	}
+	return answers
+}
+
+// Formats of the query log.
+const (
+	queryLogJSON    = "json"
+	queryLogDnsmasq = "dnsmasq"
+)
+
+func checkQueryLogFormat(format string) error {
+	switch format {
+	case queryLogJSON, queryLogDnsmasq:
+		return nil
+	default:
+		return errors.Errorf("Unknown query log format [%s]", format)
+	}
+}
+
+// queryLogger writes one JSON object, or dnsmasq style lines, per query.
+type queryLogger struct {
+	log    Logger
+	sample int    //log 1 in sample queries
+	format string //json or dnsmasq
+	syslog bool   //syslog adds its own timestamps and tags
+
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// newQueryLogger opens the query log for appending, stdout if the path is `-`, or syslog if it's `syslog`.
+func newQueryLogger(o *serverOptions, log Logger) (*queryLogger, error) {
+	var w io.Writer = os.Stdout
+	switch {
+	case o.QueryLog == "-":
+	case o.QueryLog == "syslog":
+		// the local syslog with the daemon facility, unless WithSyslog sets them.
+		facility := o.SyslogFacility
+		if facility == "" {
+			facility = "daemon"
+		}
+		var err error
+		if w, err = openSyslog(o.SyslogAddr, facility, "chinadns-query"); err != nil {
+			return nil, err
+		}
+	default:
+		file, err := openRotatingFile(o.QueryLog, o.QueryLogMaxSize, o.QueryLogRotateInterval, o.QueryLogMaxBackups, log)
+		if err != nil {
+			return nil, errors.Wrap(err, "fail to open query log")
+		}
+		w = file
+	}
+	return &queryLogger{
+		log:    log,
+		sample: o.QueryLogSample,
+		format: o.QueryLogFormat,
+		syslog: o.QueryLog == "syslog",
+		w:      w,
+		enc:    json.NewEncoder(w),
+	}, nil
+}
+
+// Log writes an entry, if it's sampled. It does nothing if l is nil.
+func (l *queryLogger) Log(entry *QueryLogEntry) {
+	if l == nil {
+		return
+	}
+	if l.sample > 1 && rand.Intn(l.sample) != 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	if l.format == queryLogDnsmasq {
+		err = l.writeDnsmasq(entry)
+	} else {
+		err = l.enc.Encode(entry)
+	}
+	if err != nil {
+		l.log.WithError(err).Error("Fail to write query log.")
+	}
+}
+
+// Close closes the query log, unless it's stdout. It does nothing if l is nil.
+func (l *queryLogger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.w.(io.Closer); ok && l.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// writeDnsmasq writes the entry like dnsmasq with log-queries:
+//
+//	Jan  1 00:00:00 dnsmasq[1]: query[A] example.com from 192.168.1.2
+//	Jan  1 00:00:00 dnsmasq[1]: forwarded example.com to 8.8.8.8
+//	Jan  1 00:00:00 dnsmasq[1]: reply example.com is 93.184.216.34
+func (l *queryLogger) writeDnsmasq(entry *QueryLogEntry) error {
+	name := strings.TrimSuffix(entry.Name, ".")
+	lines := []string{fmt.Sprintf("query[%s] %s from %s", entry.Type, name, entry.Client)}
+	if entry.Resolver != "" {
+		host, _, _ := net.SplitHostPort(entry.Resolver)
+		lines = append(lines, fmt.Sprintf("forwarded %s to %s", name, host))
+	}
+	source := "reply"
+	if entry.Path == pathBlocked {
+		source = "config"
+	}
+	for _, a := range entry.Answers {
+		data := a.Data
+		if a.Type == "CNAME" {
+			data = "<CNAME>"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s is %s", source, strings.TrimSuffix(a.Name, "."), data))
+	}
+	if len(entry.Answers) == 0 {
+		lines = append(lines, fmt.Sprintf("%s %s is %s", source, name, dnsmasqNoData(entry)))
+	}
+
+	prefix := ""
+	if !l.syslog {
+		prefix = fmt.Sprintf("%s dnsmasq[%d]: ", entry.Time.Format(time.Stamp), os.Getpid())
+	}
+	for _, line := range lines {
+		// one write per line, so that each line is a syslog message.
+		if _, err := io.WriteString(l.w, prefix+line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dnsmasqNoData(entry *QueryLogEntry) string {
+	switch entry.Rcode {
+	case "NOERROR":
+	case "NXDOMAIN":
+		return "NXDOMAIN"
+	default:
+		return entry.Rcode
+	}
+	switch entry.Type {
+	case "A":
+		return "NODATA-IPv4"
+	case "AAAA":
+		return "NODATA-IPv6"
+	default:
+		return "NODATA"
+	}
+}
+
+// queryRing keeps the latest queries. All methods are no-op on a nil *queryRing.
+type queryRing struct {
+	mu      sync.Mutex
+	entries []QueryLogEntry
+	next    int
+	full    bool
+}
+
+func newQueryRing(size int) *queryRing {
+	return &queryRing{entries: make([]QueryLogEntry, size)}
+}
+
+func (r *queryRing) Add(entry *QueryLogEntry) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.entries[r.next] = *entry
+	if r.next++; r.next == len(r.entries) {
+		r.next, r.full = 0, true
+	}
+	r.mu.Unlock()
+}
+
+// Last returns at most n latest queries, the latest first.
+func (r *queryRing) Last(n int) []QueryLogEntry {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	size := r.next
+	if r.full {
+		size = len(r.entries)
+	}
+	if n > size {
+		n = size
+	}
+	last := make([]QueryLogEntry, n)
+	for i := range last {
+		last[i] = r.entries[(r.next-1-i+len(r.entries))%len(r.entries)]
+	}
+	return last
+}
+
+// RecentQueries returns at most n latest queries, the latest first.
+// It returns nil unless recent queries are kept by WithRecentQueries.
+func (s *Server) RecentQueries(n int) []QueryLogEntry {
+	return s.recent.Last(n)
+}
+
+// _rotateTimeFormat is the suffix of rotated files. It sorts in time order.
+const _rotateTimeFormat = "20060102-150405.000"
+
+// rotatingFile is a file which is rotated when it grows over maxSize bytes or gets older than interval.
+// Only the latest maxBackups rotated files are kept. Zero values disable the limits.
+type rotatingFile struct {
+	log        Logger
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int, log Logger) (*rotatingFile, error) {
+	f := &rotatingFile{log: log, path: path, maxSize: maxSize, interval: interval, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write is not goroutine safe. Callers should serialize writes.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.shouldRotate(len(p)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *rotatingFile) shouldRotate(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	return f.maxSize > 0 && f.size+int64(n) > f.maxSize ||
+		f.interval > 0 && time.Since(f.opened) >= f.interval
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, f.path+"."+time.Now().Format(_rotateTimeFormat)); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// prune removes rotated files except the latest maxBackups ones.
+func (f *rotatingFile) prune() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	sort.Strings(backups)
+	for i := 0; i < len(backups)-f.maxBackups; i++ {
+		if err := os.Remove(backups[i]); err != nil {
+			f.log.WithError(err).Warn("Fail to remove rotated query log.")
+		}
+	}
+}
+
+func clientIP(addr net.Addr) string {
+	if ip, _ := addrIPPort(addr); ip != nil {
+		return ip.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,118 @@
+package gochinadns
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "query.log")
+	f, err := openRotatingFile(path, 10, 0, 2, NewLogrusLogger(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := f.Write([]byte("12345678")); err != nil {
+			t.Fatal(err)
+		}
+		// rotated files are named by milliseconds.
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("Expect 2 rotated files, got %v", backups)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != 8 {
+		t.Errorf("Expect the current file to have 8 bytes, got %v, %v", info, err)
+	}
+}
+
+func TestQueryRing(t *testing.T) {
+	r := newQueryRing(3)
+	if last := r.Last(5); len(last) != 0 {
+		t.Errorf("Expect no queries, got %v", last)
+	}
+	for _, name := range []string{"a.", "b.", "c.", "d."} {
+		r.Add(&QueryLogEntry{Name: name})
+	}
+	last := r.Last(5)
+	if len(last) != 3 || last[0].Name != "d." || last[1].Name != "c." || last[2].Name != "b." {
+		t.Errorf("Unexpected latest queries %v", last)
+	}
+	if last := r.Last(1); len(last) != 1 || last[0].Name != "d." {
+		t.Errorf("Unexpected latest query %v", last)
+	}
+}
+
+func TestWriteDnsmasq(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := &queryLogger{format: queryLogDnsmasq, syslog: true, w: buf}
+	entry := &QueryLogEntry{
+		Name:     "www.baidu.com.",
+		Type:     "A",
+		Client:   "127.0.0.1",
+		Resolver: "114.114.114.114:53",
+		Rcode:    "NOERROR",
+		Answers: []QueryAnswer{
+			{Name: "www.baidu.com.", Type: "CNAME", Data: "www.a.shifen.com."},
+			{Name: "www.a.shifen.com.", Type: "A", Data: "110.242.68.3"},
+		},
+	}
+	if err := l.writeDnsmasq(entry); err != nil {
+		t.Fatal(err)
+	}
+	expected := "query[A] www.baidu.com from 127.0.0.1\n" +
+		"forwarded www.baidu.com to 114.114.114.114\n" +
+		"reply www.baidu.com is <CNAME>\n" +
+		"reply www.a.shifen.com is 110.242.68.3\n"
+	if buf.String() != expected {
+		t.Errorf("Expect %q, got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	entry = &QueryLogEntry{Name: "ads.example.", Type: "AAAA", Client: "127.0.0.1", Path: pathBlocked, Rcode: "NOERROR"}
+	l.writeDnsmasq(entry)
+	expected = "query[AAAA] ads.example from 127.0.0.1\nconfig ads.example is NODATA-IPv6\n"
+	if buf.String() != expected {
+		t.Errorf("Expect %q, got %q", expected, buf.String())
+	}
+}
+
+func TestQueryLogSyslog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// without WithSyslog, the query log goes to the local syslog, which may not run in tests, rather than a file.
+	o := newServerOptions()
+	o.QueryLog = "syslog"
+	if l, err := newQueryLogger(o, o.logger(logServer)); err == nil {
+		l.Close()
+	}
+	if _, err := os.Stat(filepath.Join(dir, "syslog")); !os.IsNotExist(err) {
+		t.Errorf("Query log to syslog should not create a file, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package gochinadns
+
+import (
+	"context"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// lookupQuorum queries all servers at once, and only sends a reply to result when at least quorum servers agree on it.
+// Two replies agree if they have the same rcode, and share an IP or have identical answers.
+func lookupQuorum(
+	ctx context.Context, cancel context.CancelFunc, logger Logger, result chan<- *upstreamReply, req *dns.Msg,
+	servers []Resolver, quorum int, lookup LookupFunc,
+) {
+	defer cancel()
+	if len(servers) == 0 {
+		return
+	}
+	type group struct {
+		rep   *upstreamReply
+		count int
+	}
+	var (
+		mu     sync.Mutex
+		groups []*group
+		done   bool
+		wg     sync.WaitGroup
+	)
+
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server Resolver) {
+			defer wg.Done()
+			reply, _, err := lookup(ctx, shareMsg(req), server)
+			if err != nil {
+				return
+			}
+			rep := &upstreamReply{Msg: reply, server: server}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if done {
+				return
+			}
+			matched := false
+			for _, g := range groups {
+				if !agree(g.rep.Msg, reply) {
+					continue
+				}
+				// agreement is not transitive when answers have several IPs, so a reply counts for every group it agrees with.
+				matched = true
+				g.count++
+				if g.count >= quorum {
+					done = true
+					logger.Debugf("%d trusted servers agree on the answer.", g.count)
+					select {
+					case result <- g.rep:
+					default:
+					}
+					cancel()
+					return
+				}
+			}
+			if !matched {
+				groups = append(groups, &group{rep: rep, count: 1})
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	if !done && quorum > 1 {
+		logger.Warnf("Trusted servers fail to reach a quorum of %d.", quorum)
+	}
+}
+
+func agree(a, b *dns.Msg) bool {
+	if a.Rcode != b.Rcode {
+		return false
+	}
+	ipsA, ipsB := answerIPs(a), answerIPs(b)
+	if len(ipsA) > 0 || len(ipsB) > 0 {
+		return overlapIPs(ipsA, ipsB)
+	}
+	if len(a.Answer) != len(b.Answer) {
+		return false
+	}
+	for i := range a.Answer {
+		if !dns.IsDuplicate(a.Answer[i], b.Answer[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestReply(t *testing.T, rcode int, rrs ...string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Rcode = rcode
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestAgree(t *testing.T) {
+	a := newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.1.1.1", "example.com. 60 IN A 2.2.2.2")
+	b := newTestReply(t, dns.RcodeSuccess, "example.com. 30 IN A 2.2.2.2")
+	c := newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 3.3.3.3")
+	if !agree(a, b) {
+		t.Error("Replies sharing an IP should agree")
+	}
+	if agree(a, c) {
+		t.Error("Replies without common IPs should not agree")
+	}
+
+	nx1, nx2 := newTestReply(t, dns.RcodeNameError), newTestReply(t, dns.RcodeNameError)
+	if !agree(nx1, nx2) {
+		t.Error("Identical NXDOMAIN replies should agree")
+	}
+	if agree(nx1, newTestReply(t, dns.RcodeSuccess)) {
+		t.Error("Replies with different rcodes should not agree")
+	}
+}
+
+func TestLookupQuorum(t *testing.T) {
+	logger := newServerOptions().logger(logServer)
+	for _, tc := range []struct {
+		name    string
+		quorum  int
+		replies []*dns.Msg //nil for a failed lookup
+		want    string     //IP of the reply agreed on, empty for none
+	}{
+		{"agree", 2, []*dns.Msg{
+			newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.1.1.1"),
+			newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 3.3.3.3"),
+			newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.1.1.1", "example.com. 60 IN A 2.2.2.2"),
+		}, "1.1.1.1"},
+		{"disagree", 2, []*dns.Msg{
+			newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.1.1.1"),
+			newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 2.2.2.2"),
+			newTestReply(t, dns.RcodeNameError),
+		}, ""},
+		{"short of quorum", 3, []*dns.Msg{
+			newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.1.1.1"),
+			newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.1.1.1"),
+			newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 2.2.2.2"),
+		}, ""},
+		{"failed lookups", 2, []*dns.Msg{
+			newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.1.1.1"),
+			nil,
+			nil,
+		}, ""},
+	} {
+		var servers []Resolver
+		replies := make(map[string]*dns.Msg)
+		for i, reply := range tc.replies {
+			server := Resolver{addr: fmt.Sprintf("10.0.0.%d:53", i+1), protocols: []string{"udp"}}
+			servers = append(servers, server)
+			replies[server.addr] = reply
+		}
+		lookup := func(ctx context.Context, req *dns.Msg, server Resolver) (*dns.Msg, time.Duration, error) {
+			if reply := replies[server.addr]; reply != nil {
+				return reply, 0, nil
+			}
+			return nil, 0, errors.New("timeout")
+		}
+		result := make(chan *upstreamReply, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		lookupQuorum(ctx, cancel, logger, result, newTestReply(t, dns.RcodeSuccess), servers, tc.quorum, lookup)
+		var got string
+		select {
+		case rep := <-result:
+			if ips := answerIPs(rep.Msg); len(ips) > 0 {
+				got = ips[0].String()
+			}
+			if got == "" {
+				got = dns.RcodeToString[rep.Rcode]
+			}
+		default:
+		}
+		if got != tc.want {
+			t.Errorf("%s: quorum of %d agrees on %q, want %q", tc.name, tc.quorum, got, tc.want)
+		}
+	}
+}
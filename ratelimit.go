@@ -0,0 +1,160 @@
+package gochinadns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// Actions on queries of clients over their rate limit, see WithClientRateLimit.
+const (
+	RateLimitRefused = "refused" //answer REFUSED, so that well-behaved clients back off
+	RateLimitDrop    = "drop"    //answer nothing, which costs a flood of spoofed queries nothing
+)
+
+// _rateLimitSweep is how often buckets of idle clients are removed, which are full again.
+const _rateLimitSweep = time.Minute
+
+// clientLimiter limits queries of each client by a token bucket, refilled at rate tokens per second up to burst.
+// All methods are no-op on a nil *clientLimiter.
+type clientLimiter struct {
+	exempt  *cidrSet //clients which are not limited
+	buckets *tokenBuckets
+}
+
+func newClientLimiter(rate float64, burst int, exempt *cidrSet) *clientLimiter {
+	return &clientLimiter{exempt: exempt, buckets: newTokenBuckets(rate, float64(burst))}
+}
+
+// allow takes a token of the client at ip, and reports whether there is one.
+func (l *clientLimiter) allow(ip net.IP, now time.Time) bool {
+	if l == nil || ip == nil {
+		return true
+	}
+	if exempt, _ := l.exempt.Contains(ip); exempt {
+		return true
+	}
+	ok, _ := l.buckets.take(ip.To16(), now)
+	return ok
+}
+
+// tokenBuckets is a set of token buckets by key, refilled at rate tokens per second up to burst.
+type tokenBuckets struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	denied int //takes denied since the last one allowed
+}
+
+func newTokenBuckets(rate, burst float64) *tokenBuckets {
+	return &tokenBuckets{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket), swept: time.Now()}
+}
+
+// take takes a token of the bucket of key, and reports whether there is one, and if not, how many takes of
+// the bucket in a row are denied with this one.
+func (t *tokenBuckets) take(key []byte, now time.Time) (bool, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.swept) >= _rateLimitSweep {
+		t.sweep(now)
+	}
+	// the conversion of the map key doesn't allocate.
+	b := t.buckets[string(key)]
+	if b == nil {
+		b = &tokenBucket{tokens: t.burst, last: now}
+		t.buckets[string(key)] = b
+	}
+	if b.tokens += now.Sub(b.last).Seconds() * t.rate; b.tokens > t.burst {
+		b.tokens = t.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		b.denied++
+		return false, b.denied
+	}
+	b.tokens--
+	b.denied = 0
+	return true, 0
+}
+
+// sweep removes buckets which are refilled by now, since they are the same as new ones.
+func (t *tokenBuckets) sweep(now time.Time) {
+	for key, b := range t.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*t.rate >= t.burst {
+			delete(t.buckets, key)
+		}
+	}
+	t.swept = now
+}
+
+// Len returns the number of buckets.
+func (t *tokenBuckets) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.buckets)
+}
+
+// parseClientCIDRs returns a set of CIDRs of clients, where an IP is a network of itself. kind is what the clients are,
+// such as exempt, in errors.
+func parseClientCIDRs(cidrs []string, kind string) (*cidrSet, error) {
+	set := newCIDRSet()
+	for _, cidr := range cidrs {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.Errorf("invalid %s CIDR [%s]", kind, cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			set.Insert(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Errorf("invalid %s CIDR [%s]", kind, cidr)
+		}
+		set.Insert(network)
+	}
+	set.compact()
+	return set, nil
+}
+
+// rateLimited answers req by the rate limit action if its client is over its rate limit, and reports whether it is.
+func (s *Server) rateLimited(w dns.ResponseWriter, req *dns.Msg) bool {
+	if s.rateLimiter == nil {
+		return false
+	}
+	start := time.Now()
+	ip, _ := addrIPPort(w.RemoteAddr())
+	if s.rateLimiter.allow(ip, start) {
+		return false
+	}
+	o := s.options()
+	s.stats.rateLimited.Add(1)
+	s.metrics.observeRateLimited(o.RateLimitAction)
+	if o.RateLimitAction == RateLimitDrop {
+		return true
+	}
+	reply := new(dns.Msg)
+	reply.SetRcode(req, dns.RcodeRefused)
+	s.respond(w, reply, nil)
+	s.finishQuery(w, req, reply, &queryResult{path: pathRateLimit, reason: reasonRateLimit}, start)
+	return true
+}
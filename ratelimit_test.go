@@ -0,0 +1,75 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientLimiter(t *testing.T) {
+	exempt, err := parseClientCIDRs([]string{"192.168.1.0/24", "::1"}, "exempt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newClientLimiter(2, 3, exempt)
+	client, now := net.ParseIP("10.0.0.1"), time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.allow(client, now) {
+			t.Fatalf("query %d of a burst of 3 is limited", i)
+		}
+	}
+	if l.allow(client, now) {
+		t.Error("query over the burst is allowed")
+	}
+	if !l.allow(net.ParseIP("10.0.0.2"), now) {
+		t.Error("query of another client is limited")
+	}
+	// 2 tokens per second.
+	now = now.Add(time.Second)
+	if !l.allow(client, now) || !l.allow(client, now) || l.allow(client, now) {
+		t.Error("tokens should be refilled at the rate")
+	}
+	for i := 0; i < 10; i++ {
+		if !l.allow(net.ParseIP("192.168.1.10"), now) || !l.allow(net.IPv6loopback, now) {
+			t.Fatal("exempt clients are limited")
+		}
+	}
+
+	l.allow(client, now.Add(_rateLimitSweep))
+	if n := l.buckets.Len(); n != 1 {
+		t.Errorf("%d buckets after sweeping, want 1 of the client querying", n)
+	}
+
+	if _, err := parseClientCIDRs([]string{"10.0.0.0/33"}, "exempt"); err == nil {
+		t.Error("parseClientCIDRs should fail with an invalid CIDR")
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true),
+		WithClientRateLimit(1, 2, RateLimitRefused))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rcodes []int
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("version.bind.", dns.TypeTXT)
+		req.Question[0].Qclass = dns.ClassCHAOS
+		w := new(explainWriter)
+		s.Serve(w, req)
+		rcodes = append(rcodes, w.reply.Rcode)
+	}
+	if rcodes[0] != dns.RcodeSuccess || rcodes[1] != dns.RcodeSuccess || rcodes[2] != dns.RcodeRefused {
+		t.Errorf("rcodes = %v, want 2 NOERROR and REFUSED", rcodes)
+	}
+	if n := s.Stats().RateLimited; n != 1 {
+		t.Errorf("Stats().RateLimited = %d, want 1", n)
+	}
+
+	if _, err := NewServer(WithClientRateLimit(1, 0, "ignore")); err == nil {
+		t.Error("NewServer should fail with an unknown rate limit action")
+	}
+}
@@ -0,0 +1,184 @@
+package gochinadns
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// canForwardRaw reports whether the reply to a query may be forwarded as it's received, with only its ID rewritten,
+// instead of being unpacked and packed again. Only the answer section of replies is unpacked for the verdict.
+// Queries which are explained, traced, tapped, or rewritten beyond the ID are not.
+func (s *Server) canForwardRaw(o *serverOptions, trace *span, ex *explainer) bool {
+	return o.RawForward && ex == nil && trace == nil && s.dnstap == nil && !o.QNAMEMinimize && o.TrustedQuorum <= 1 &&
+		o.TrustedECS.action == ecsForward && o.UntrustedECS.action == ecsForward
+}
+
+// lookupRaw returns an upstreamLookup sending the packed query as it is to every server, whose replies keep the packet
+// received. Servers with mutation, whose replies may echo the mutated question, are looked up with req and lookup instead.
+func (s *Server) lookupRaw(req *dns.Msg, query []byte, lookup LookupFunc) upstreamLookup {
+	return func(ctx context.Context, server Resolver) (rep *upstreamReply, rtt time.Duration, err error) {
+		if m := server.GetMutation(); m != "" && m != mutationNone || server.isDualStack() || server.isJSON() {
+			return lookupMsg(req, lookup)(ctx, server)
+		}
+		defer func() {
+			if err == nil || ctx.Err() == nil {
+				s.observeUpstream(server, rtt, err)
+			}
+		}()
+
+		logger := s.upstreamLog.WithFields(map[string]interface{}{
+			"question": questionString(&req.Question[0]),
+			"server":   server,
+		})
+		retry := s.retryPolicy()
+		t := time.Now()
+		for _, protocol := range server.GetProtocols() {
+			cli, ok := s.protocolClient(retry, protocol, server)
+			if !ok {
+				logger.Errorf("No available protocols for resolver %s", server)
+				return nil, time.Since(t), errors.Errorf("unknown protocol %s", protocol)
+			}
+			var packet []byte
+			err = retry.do(ctx, logger, func() (err error) {
+				packet, err = s.exchangeRaw(ctx, cli, query, server.dialAddr(), time.Now().Add(cli.Timeout), getUDPSize(req))
+				return
+			})
+			if ctx.Err() != nil {
+				return nil, time.Since(t), ctx.Err()
+			}
+			if err != nil {
+				logger.WithError(err).Errorf("Fail to send %s query.", protocol)
+				continue
+			}
+			var reply *dns.Msg
+			if reply, err = unpackAnswers(packet); err != nil {
+				logger.WithError(err).Errorf("Fail to unpack %s reply.", protocol)
+				continue
+			}
+			if err = s.rcodeFailure(reply, packet); err != nil {
+				logger.WithError(err).Errorf("Fail to send %s query.", protocol)
+				continue
+			}
+			return &upstreamReply{Msg: reply, server: server, raw: packet}, time.Since(t), nil
+		}
+		return nil, time.Since(t), err
+	}
+}
+
+// exchangeRaw sends the packed query to address, and returns the packed reply with the same ID.
+// UDP replies are read up to udpSize, as the query advertises.
+func (s *Server) exchangeRaw(ctx context.Context, cli *dns.Client, query []byte, address string, deadline time.Time, udpSize uint16) ([]byte, error) {
+	if s.upstreams != nil && cli.Net == "udp" {
+		return s.upstreams.ExchangeRaw(ctx, cli.Dialer, address, query, deadline)
+	}
+	conn, err := s.dial(ctx, cli, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+	conn.UDPSize = udpSize
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(query); err != nil {
+		return nil, interrupted(ctx, err)
+	}
+
+	b := getPacketBuffer()
+	defer putPacketBuffer(b)
+	id := binary.BigEndian.Uint16(query)
+	for {
+		packet, err := readPacket(conn, *b)
+		if err != nil {
+			return nil, interrupted(ctx, err)
+		}
+		if len(packet) < _headerSize {
+			return nil, dns.ErrShortRead
+		}
+		// replies with mismatched IDs over UDP may be ones of earlier queries which timed out.
+		if binary.BigEndian.Uint16(packet) == id {
+			return append([]byte(nil), packet...), nil
+		}
+		if _, ok := conn.Conn.(net.PacketConn); !ok {
+			return nil, dns.ErrId
+		}
+	}
+}
+
+// unpackAnswers unpacks the header, the question and the answer section of a packed message,
+// which are all the verdict needs, and leaves the authority and additional sections nil.
+// The extended rcode, which is in the OPT RR of the additional section, is not unpacked.
+func unpackAnswers(packet []byte) (*dns.Msg, error) {
+	if len(packet) < _headerSize {
+		return nil, dns.ErrShortRead
+	}
+	m := new(dns.Msg)
+	m.Id = binary.BigEndian.Uint16(packet)
+	bits := binary.BigEndian.Uint16(packet[2:])
+	m.Response = bits&(1<<15) != 0
+	m.Opcode = int(bits>>11) & 0xF
+	m.Authoritative = bits&(1<<10) != 0
+	m.Truncated = bits&(1<<9) != 0
+	m.RecursionDesired = bits&(1<<8) != 0
+	m.RecursionAvailable = bits&(1<<7) != 0
+	m.Zero = bits&(1<<6) != 0
+	m.AuthenticatedData = bits&(1<<5) != 0
+	m.CheckingDisabled = bits&(1<<4) != 0
+	m.Rcode = int(bits & 0xF)
+	qdcount, ancount := binary.BigEndian.Uint16(packet[4:]), binary.BigEndian.Uint16(packet[6:])
+
+	off := _headerSize
+	for i := 0; i < int(qdcount) && off < len(packet); i++ {
+		name, off1, err := dns.UnpackDomainName(packet, off)
+		if err != nil {
+			return nil, err
+		}
+		if off1+4 > len(packet) {
+			return nil, dns.ErrShortRead
+		}
+		m.Question = append(m.Question, dns.Question{
+			Name:   name,
+			Qtype:  binary.BigEndian.Uint16(packet[off1:]),
+			Qclass: binary.BigEndian.Uint16(packet[off1+2:]),
+		})
+		off = off1 + 4
+	}
+	for i := 0; i < int(ancount) && off < len(packet); i++ {
+		rr, off1, err := dns.UnpackRR(packet, off)
+		if err != nil {
+			return nil, err
+		}
+		m.Answer = append(m.Answer, rr)
+		off = off1
+	}
+	return m, nil
+}
+
+// unpackAll unpacks the whole raw reply into Msg, once it's needed, such as to be rewritten.
+func (r *upstreamReply) unpackAll() error {
+	if r.raw == nil {
+		return nil
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(r.raw); err != nil {
+		return err
+	}
+	r.Msg, r.raw = m, nil
+	return nil
+}
+
+// respondRaw writes the raw reply to the client with the ID of req.
+func (s *Server) respondRaw(w dns.ResponseWriter, raw []byte, id uint16, trace *span) {
+	sp := trace.child("respond", spanKindInternal)
+	b := getPacketBuffer()
+	defer putPacketBuffer(b)
+	packet := append((*b)[:0], raw...)
+	binary.BigEndian.PutUint16(packet, id)
+	_, err := w.Write(packet)
+	sp.fail(err)
+	sp.finish()
+}
@@ -0,0 +1,165 @@
+package gochinadns
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rawWriter is a dns.ResponseWriter which keeps the packed reply.
+type rawWriter struct {
+	explainWriter
+	packet []byte
+}
+
+func (w *rawWriter) Write(b []byte) (int, error) {
+	w.packet = append([]byte(nil), b...)
+	return w.explainWriter.Write(b)
+}
+
+func TestUnpackAnswers(t *testing.T) {
+	reply := benchmarkReply()
+	reply.Authoritative, reply.RecursionAvailable, reply.Rcode = true, true, dns.RcodeSuccess
+	soa, _ := dns.NewRR("example.com. 60 IN SOA ns.example.com. admin.example.com. 1 60 60 60 60")
+	reply.Ns = append(reply.Ns, soa)
+	reply.SetEdns0(dns.DefaultMsgSize, true)
+	reply.Compress = true
+	packet, err := reply.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := unpackAnswers(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MsgHdr != reply.MsgHdr {
+		t.Errorf("header is unpacked as %+v, want %+v", m.MsgHdr, reply.MsgHdr)
+	}
+	if len(m.Question) != 1 || m.Question[0] != reply.Question[0] {
+		t.Errorf("question is unpacked as %v, want %v", m.Question, reply.Question)
+	}
+	if len(m.Answer) != len(reply.Answer) {
+		t.Fatalf("%d answers are unpacked, want %d", len(m.Answer), len(reply.Answer))
+	}
+	for i := range m.Answer {
+		if !dns.IsDuplicate(m.Answer[i], reply.Answer[i]) {
+			t.Errorf("answer %d is unpacked as %v, want %v", i, m.Answer[i], reply.Answer[i])
+		}
+	}
+	if m.Ns != nil || m.Extra != nil {
+		t.Errorf("authority and additional sections are unpacked as %v and %v, want nil", m.Ns, m.Extra)
+	}
+
+	if _, err := unpackAnswers(packet[:_headerSize-1]); err == nil {
+		t.Error("unpacking a short packet should fail")
+	}
+	if _, err := unpackAnswers(packet[:_headerSize+5]); err == nil {
+		t.Error("unpacking a truncated question should fail")
+	}
+}
+
+func TestRawForward(t *testing.T) {
+	// the upstream replies uncompressed, with authority and additional sections, which are forwarded as they are.
+	var mu sync.Mutex
+	var sent []byte
+	srv := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+		soa, _ := dns.NewRR("example.com. 60 IN SOA ns.example.com. admin.example.com. 1 60 60 60 60")
+		reply.Answer = append(reply.Answer, rr)
+		reply.Ns = append(reply.Ns, soa)
+		reply.SetEdns0(dns.DefaultMsgSize, false)
+		packet, _ := reply.Pack()
+		mu.Lock()
+		sent = packet
+		mu.Unlock()
+		w.Write(packet)
+	})}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ListenAndServe()
+	<-started
+	defer srv.Shutdown()
+	addr := srv.PacketConn.LocalAddr().String()
+
+	for _, raw := range []bool{true, false} {
+		s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr),
+			WithDelay(time.Second), WithTimeout(time.Second), WithRawForward(raw), WithSkipStartupTest(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := new(rawWriter)
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		s.Serve(w, req)
+		if w.reply == nil || w.reply.Id != req.Id || len(w.reply.Answer) != 1 || len(w.reply.Ns) != 1 {
+			t.Fatalf("with raw forward %t, query is answered with %v", raw, w.reply)
+		}
+
+		mu.Lock()
+		want := append([]byte(nil), sent...)
+		mu.Unlock()
+		want[0], want[1] = w.packet[0], w.packet[1]
+		if forwarded := bytes.Equal(w.packet, want); forwarded != raw {
+			t.Errorf("with raw forward %t, the reply is forwarded as received: %t", raw, forwarded)
+		}
+	}
+}
+
+func TestRawForwardCoalesced(t *testing.T) {
+	var queries int32
+	addr := startSlowUpstream(t, &queries)
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr),
+		WithDelay(time.Second), WithTestDomains(), WithCoalescing(true), WithRawForward(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// followers get the raw reply with their own IDs, or unpacked with their own questions if the letter case differs.
+	names := []string{"example.com.", "example.com.", "EXAMPLE.com."}
+	writers := make([]*explainWriter, 9)
+	var wg sync.WaitGroup
+	for i := range writers {
+		writers[i] = &explainWriter{}
+		req := new(dns.Msg)
+		req.SetQuestion(names[i%len(names)], dns.TypeA)
+		req.Id = uint16(i + 1)
+		wg.Add(1)
+		go func(w *explainWriter, req *dns.Msg) {
+			defer wg.Done()
+			s.Serve(w, req)
+		}(writers[i], req)
+	}
+	wg.Wait()
+	for i, w := range writers {
+		if w.reply == nil || len(w.reply.Answer) != 1 {
+			t.Fatalf("query %d is answered with %v", i, w.reply)
+		}
+		if w.reply.Id != uint16(i+1) || w.reply.Question[0].Name != names[i%len(names)] {
+			t.Errorf("query %d is answered with ID %d and question %s", i, w.reply.Id, w.reply.Question[0].Name)
+		}
+	}
+}
+
+func BenchmarkServeRaw(b *testing.B) {
+	clean, other := startTestUpstream(b, "1.2.3.4"), startTestUpstream(b, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+clean, "udp@"+other),
+		WithDelay(time.Second), WithTimeout(time.Second), WithRawForward(true), WithSkipStartupTest(true))
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := new(discardWriter)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		s.Serve(w, req)
+	}
+}
@@ -0,0 +1,471 @@
+package gochinadns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	_redisTimeout  = 100 * time.Millisecond //timeout of dialing and of each command, which queries wait for
+	_redisRetry    = 5 * time.Second        //how long Redis is skipped after it fails
+	_redisIdle     = 16                     //max idle connections kept
+	_redisLocalTTL = 5 * time.Second        //max age of replies in the local cache, which bounds staleness after purges of others
+	_redisQueue    = 64                     //max number of pending polluted domains. Domains are dropped when the queue is full.
+	_redisScan     = 1000                   //number of keys scanned at once on purge
+	_redisPrefix   = "chinadns:"            //default prefix of keys
+)
+
+// redisConfig is parsed from a URL of format redis://[[user]:password@]host[:port][/db][?prefix=chinadns:].
+type redisConfig struct {
+	addr     string
+	user     string
+	password string
+	db       int
+	prefix   string //of all keys, so that deployments of different lists share a Redis apart
+}
+
+func parseRedisURL(rawURL string) (*redisConfig, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Hostname() == "" {
+		return nil, errors.Errorf("invalid Redis URL [%s]", redactURL(rawURL))
+	}
+	c := &redisConfig{addr: u.Host, prefix: _redisPrefix}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, errors.Errorf("invalid Redis database [%s]", db)
+		}
+	}
+	if prefix, ok := u.Query()["prefix"]; ok {
+		c.prefix = prefix[0]
+	}
+	return c, nil
+}
+
+// redactURL returns rawURL without its password, to be logged.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// redisError is an error reply of Redis, after which the connection is still usable.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisClient sends commands of the Redis protocol RESP over a pool of connections.
+type redisClient struct {
+	*redisConfig
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// do sends a command, and returns its reply: a string, an int64, []byte or nil of bulk strings,
+// or []interface{} of arrays. Error replies are returned as redisError.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	rc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := rc.do(args)
+	if err != nil {
+		rc.conn.Close()
+		return nil, err
+	}
+	c.put(rc)
+	if e, ok := reply.(redisError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// get returns an idle connection, or dials one, authenticated and with the database selected.
+func (c *redisClient) get() (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		rc := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return rc, nil
+	}
+	c.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", c.addr, _redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	var setup [][]string
+	if c.password != "" && c.user != "" {
+		setup = append(setup, []string{"AUTH", c.user, c.password})
+	} else if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		reply, err := rc.do(args)
+		if e, ok := reply.(redisError); ok {
+			err = e
+		}
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "fail to %s", strings.ToLower(args[0]))
+		}
+	}
+	return rc, nil
+}
+
+func (c *redisClient) put(rc *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= _redisIdle {
+		rc.conn.Close()
+		return
+	}
+	c.idle = append(c.idle, rc)
+}
+
+// Close closes idle connections.
+func (c *redisClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rc := range c.idle {
+		rc.conn.Close()
+	}
+	c.idle = nil
+}
+
+func (rc *redisConn) do(args []string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(_redisTimeout))
+	rc.w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		rc.w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		rc.w.WriteString(arg)
+		rc.w.WriteString("\r\n")
+	}
+	if err := rc.w.Flush(); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.Errorf("malformed Redis reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return redisError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = rc.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errors.Errorf("malformed Redis reply %q", kind)
+}
+
+// redisCache is a CacheBackend keeping replies in Redis, so that servers behind a load balancer share them, and
+// keeping the polluted domains learned by any of them, see WithRedisCache. Replies are cached in memory as well
+// for at most _redisLocalTTL, so that hits of busy names don't wait for Redis. Redis is skipped for _redisRetry
+// after it fails, so that the cache falls back to memory instead of slowing down queries.
+type redisCache struct {
+	log      Logger
+	client   *redisClient
+	local    *memoryCache //nil if replies are only cached in Redis
+	polluted chan string
+
+	mu    sync.Mutex
+	retry time.Time //when Redis is tried again after it fails
+}
+
+// newRedisCache returns a cache in Redis at rawURL, with up to entries replies in memory.
+func newRedisCache(rawURL string, entries int, log Logger) (*redisCache, error) {
+	config, err := parseRedisURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	r := &redisCache{
+		log:      log.WithField("redis", config.addr),
+		client:   &redisClient{redisConfig: config},
+		polluted: make(chan string, _redisQueue),
+	}
+	if entries > 0 {
+		r.local = newMemoryCache(entries)
+	}
+	go r.run()
+	return r, nil
+}
+
+// Get returns the reply cached for key in memory, or in Redis.
+func (r *redisCache) Get(key string) *CachedReply {
+	if e := r.getLocal(key); e != nil {
+		return e
+	}
+	if !r.available() {
+		return nil
+	}
+	reply, err := r.client.do("GET", r.client.prefix+"cache:"+key)
+	if err != nil {
+		r.fail(err)
+		return nil
+	}
+	b, _ := reply.([]byte)
+	e := decodeCachedReply(b)
+	if e == nil || !time.Now().Before(e.Expire) {
+		return nil
+	}
+	r.setLocal(key, e)
+	return e
+}
+
+// Set caches reply for key in memory and in Redis, which expires it along with the reply.
+func (r *redisCache) Set(key string, reply *CachedReply) {
+	r.setLocal(key, reply)
+	ttl := time.Until(reply.Expire) / time.Millisecond
+	if ttl <= 0 || !r.available() {
+		return
+	}
+	_, err := r.client.do("SET", r.client.prefix+"cache:"+key, string(encodeCachedReply(reply)),
+		"PX", strconv.FormatInt(int64(ttl), 10))
+	if err != nil {
+		r.fail(err)
+	}
+}
+
+// Purge removes replies in memory and in Redis, which are purged for all servers sharing them.
+func (r *redisCache) Purge() {
+	if r.local != nil {
+		r.local.Purge()
+	}
+	if !r.available() {
+		return
+	}
+	pattern := redisEscaper.Replace(r.client.prefix) + "cache:*"
+	for cursor := "0"; ; {
+		reply, err := r.client.do("SCAN", cursor, "MATCH", pattern, "COUNT", strconv.Itoa(_redisScan))
+		if err != nil {
+			r.fail(err)
+			return
+		}
+		items, _ := reply.([]interface{})
+		if len(items) != 2 {
+			r.fail(errors.New("malformed reply of SCAN"))
+			return
+		}
+		next, _ := items[0].([]byte)
+		keys, _ := items[1].([]interface{})
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, key := range keys {
+				if key, ok := key.([]byte); ok {
+					args = append(args, string(key))
+				}
+			}
+			if _, err := r.client.do(args...); err != nil {
+				r.fail(err)
+				return
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return
+		}
+	}
+}
+
+// redisEscaper escapes glob characters of patterns of SCAN.
+var redisEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (r *redisCache) getLocal(key string) *CachedReply {
+	if r.local == nil {
+		return nil
+	}
+	return r.local.Get(key)
+}
+
+// setLocal caches e in memory for at most _redisLocalTTL.
+func (r *redisCache) setLocal(key string, e *CachedReply) {
+	if r.local == nil {
+		return
+	}
+	if expire := time.Now().Add(_redisLocalTTL); expire.Before(e.Expire) {
+		copied := *e
+		copied.Expire = expire
+		e = &copied
+	}
+	r.local.Set(key, e)
+}
+
+// available reports whether Redis is tried, which is not for a while after it fails.
+func (r *redisCache) available() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !time.Now().Before(r.retry)
+}
+
+// fail skips Redis for _redisRetry after err.
+func (r *redisCache) fail(err error) {
+	r.mu.Lock()
+	failing := time.Now().Before(r.retry)
+	r.retry = time.Now().Add(_redisRetry)
+	r.mu.Unlock()
+	if !failing {
+		r.log.WithError(err).Warnf("Fail to access Redis. Cache in memory only for %s.", _redisRetry)
+	}
+}
+
+// addPolluted queues domain to be added to the polluted domains shared in Redis.
+// It does nothing if r is nil.
+func (r *redisCache) addPolluted(domain string) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.polluted <- domain:
+	default:
+		r.log.Debug("Redis queue is full. Drop polluted domain.")
+	}
+}
+
+// pollutedDomains returns the polluted domains shared in Redis, or nil if r is nil or Redis fails.
+func (r *redisCache) pollutedDomains() []string {
+	if r == nil || !r.available() {
+		return nil
+	}
+	reply, err := r.client.do("SMEMBERS", r.client.prefix+"polluted")
+	if err != nil {
+		r.fail(err)
+		return nil
+	}
+	items, _ := reply.([]interface{})
+	domains := make([]string, 0, len(items))
+	for _, item := range items {
+		if domain, ok := item.([]byte); ok {
+			domains = append(domains, string(domain))
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+func (r *redisCache) run() {
+	for domain := range r.polluted {
+		if !r.available() {
+			continue
+		}
+		if _, err := r.client.do("SADD", r.client.prefix+"polluted", domain); err != nil {
+			r.fail(err)
+		}
+	}
+}
+
+// Close closes idle connections to Redis. It does nothing if r is nil.
+func (r *redisCache) Close() {
+	if r == nil {
+		return
+	}
+	r.client.Close()
+}
+
+// encodeCachedReply encodes e as a version byte, when it's stored and expires in Unix nanoseconds, its origin and
+// server prefixed by their lengths, and the packed reply.
+func encodeCachedReply(e *CachedReply) []byte {
+	b := make([]byte, 17, 17+2+len(e.Origin)+len(e.Server)+len(e.Wire))
+	b[0] = 1
+	binary.BigEndian.PutUint64(b[1:], uint64(e.Stored.UnixNano()))
+	binary.BigEndian.PutUint64(b[9:], uint64(e.Expire.UnixNano()))
+	for _, s := range []string{e.Origin, e.Server} {
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		b = append(append(b, byte(len(s))), s...)
+	}
+	return append(b, e.Wire...)
+}
+
+// decodeCachedReply decodes a reply encoded by encodeCachedReply, or returns nil if b is malformed.
+func decodeCachedReply(b []byte) *CachedReply {
+	if len(b) < 18 || b[0] != 1 {
+		return nil
+	}
+	e := &CachedReply{
+		Stored: time.Unix(0, int64(binary.BigEndian.Uint64(b[1:]))),
+		Expire: time.Unix(0, int64(binary.BigEndian.Uint64(b[9:]))),
+	}
+	b = b[17:]
+	for _, s := range []*string{&e.Origin, &e.Server} {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return nil
+		}
+		n := 1 + int(b[0])
+		*s, b = string(b[1:n]), b[n:]
+	}
+	// hits in memory are answered without unpacking them again.
+	var ok bool
+	if e.ttls, _, ok = recordTTLs(b); !ok {
+		return nil
+	}
+	e.Wire, e.msg = b, new(dns.Msg)
+	if e.msg.Unpack(b) != nil {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,221 @@
+package gochinadns
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testRedis is a Redis server of the commands redisCache sends, which requires AUTH of password.
+type testRedis struct {
+	password string
+
+	mu   sync.Mutex
+	keys map[string]string
+	sets map[string]map[string]bool
+}
+
+func startTestRedis(t *testing.T, password string) (*testRedis, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	r := &testRedis{password: password, keys: make(map[string]string), sets: make(map[string]map[string]bool)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r, l.Addr().String()
+}
+
+func (r *testRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	authed := r.password == ""
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil || line[0] != '*' {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, _ = br.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			b := make([]byte, size+2)
+			if _, err := io.ReadFull(br, b); err != nil {
+				return
+			}
+			args[i] = string(b[:size])
+		}
+		var reply string
+		if cmd := strings.ToUpper(args[0]); cmd == "AUTH" {
+			authed = args[len(args)-1] == r.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		} else if !authed {
+			reply = "-NOAUTH Authentication required.\r\n"
+		} else {
+			reply = r.do(cmd, args[1:])
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (r *testRedis) do(cmd string, args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bulk := func(s string) string { return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n" }
+	array := func(items []string) string {
+		s := "*" + strconv.Itoa(len(items)) + "\r\n"
+		for _, item := range items {
+			s += item
+		}
+		return s
+	}
+	switch cmd {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		if v, ok := r.keys[args[0]]; ok {
+			return bulk(v)
+		}
+		return "$-1\r\n"
+	case "SET":
+		r.keys[args[0]] = args[1]
+		return "+OK\r\n"
+	case "DEL":
+		for _, key := range args {
+			delete(r.keys, key)
+		}
+		return ":" + strconv.Itoa(len(args)) + "\r\n"
+	case "SCAN":
+		// all keys are returned at once, and patterns are prefixes.
+		prefix := strings.NewReplacer(`\`, "", "*", "").Replace(args[2])
+		var keys []string
+		for key := range r.keys {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, bulk(key))
+			}
+		}
+		return array([]string{bulk("0"), array(keys)})
+	case "SADD":
+		if r.sets[args[0]] == nil {
+			r.sets[args[0]] = make(map[string]bool)
+		}
+		r.sets[args[0]][args[1]] = true
+		return ":1\r\n"
+	case "SMEMBERS":
+		var members []string
+		for member := range r.sets[args[0]] {
+			members = append(members, bulk(member))
+		}
+		return array(members)
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (r *testRedis) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.keys)
+}
+
+func TestRedisCache(t *testing.T) {
+	redis, addr := startTestRedis(t, "secret")
+	url := "redis://:secret@" + addr + "/1?prefix=test:"
+	var servers []*Server
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+startTestUpstream(t, ip)),
+			WithSkipStartupTest(true), WithCache(10), WithRedisCache(url))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+	}
+	for i, s := range servers {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		w := new(explainWriter)
+		s.Serve(w, req)
+		if w.reply == nil || len(w.reply.Answer) != 1 || w.reply.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+			t.Fatalf("Reply of server %d = %v, want 1.1.1.1 of server 0", i, w.reply)
+		}
+	}
+	if hits := servers[1].Stats().CacheHits; hits != 1 {
+		t.Errorf("%d cache hits of server 1, want 1", hits)
+	}
+	if n := redis.len(); n != 1 {
+		t.Errorf("%d replies in Redis, want 1", n)
+	}
+	if !servers[0].Config().CacheRedis {
+		t.Error("Config should report the Redis cache")
+	}
+
+	servers[0].redis.addPolluted("polluted.example")
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if learned := servers[1].LearnedPolluted(); len(learned) == 1 && learned[0] == "polluted.example" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Learned polluted domains of server 1 = %v, want polluted.example", servers[1].LearnedPolluted())
+		}
+	}
+
+	if err := servers[0].Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if n := redis.len(); n != 0 {
+		t.Errorf("%d replies in Redis after reload, want 0", n)
+	}
+}
+
+func TestRedisCacheDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+startTestUpstream(t, "1.2.3.4")),
+		WithSkipStartupTest(true), WithCache(10), WithRedisCache("redis://"+addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		w := new(explainWriter)
+		s.Serve(w, req)
+		if w.reply == nil || len(w.reply.Answer) != 1 {
+			t.Fatalf("Reply %d = %v, want an answer", i, w.reply)
+		}
+	}
+	// the reply is cached in memory while Redis is down.
+	if hits := s.Stats().CacheHits; hits != 1 {
+		t.Errorf("%d cache hits, want 1", hits)
+	}
+
+	for _, url := range []string{"http://127.0.0.1", "redis://", "redis://127.0.0.1/x"} {
+		if err := WithRedisCache(url)(new(serverOptions)); err == nil {
+			t.Errorf("Redis URL %s should fail", url)
+		}
+	}
+}
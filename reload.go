@@ -0,0 +1,224 @@
+package gochinadns
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// Reload builds options from opts and swaps them in atomically. Queries in flight keep using the old options.
+// Without opts, the options the server was created with (or last reloaded with) are built again,
+// which re-reads the China route list, the IP blacklist, domain lists and config files,
+// or those of the reloader of WithReloader if any.
+//
+// Lists, resolvers and how queries are resolved take effect immediately. Resolvers are tested again if they change.
+// If the listening address changes, new DNS listeners are bound before the old ones are shut down,
+// and queries in flight on the old ones, including those of established TCP clients, are still answered.
+// Settings of other listeners, timeouts, logs and exporters are kept until restart, with a warning if they change.
+func (s *Server) Reload(opts ...ServerOption) error {
+	if reloader := s.options().Reloader; len(opts) == 0 && reloader != nil {
+		var err error
+		if opts, err = reloader(); err != nil {
+			return errors.Wrap(err, "fail to reload")
+		}
+	}
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if len(opts) == 0 {
+		opts = s.optFuncs
+	}
+	return s.reload(opts)
+}
+
+func (s *Server) reload(opts []ServerOption) error {
+	fresh, err := s.buildOptions(opts)
+	if err != nil {
+		return errors.Wrap(err, "fail to reload")
+	}
+
+	old := s.options()
+	o := *old
+	o.ChinaCIDR = fresh.ChinaCIDR
+	o.IPBlacklist = fresh.IPBlacklist
+	o.DomainBlacklist = fresh.DomainBlacklist
+	o.DomainPolluted = fresh.DomainPolluted
+	o.DomainBidiExempt = fresh.DomainBidiExempt
+	o.DomainRoutes, o.BogusNXDomain = fresh.DomainRoutes, fresh.BogusNXDomain
+	o.LocalZones = fresh.LocalZones
+	o.DHCPLeases, o.DHCPDomain = fresh.DHCPLeases, fresh.DHCPDomain
+	o.UDPMaxSize = fresh.UDPMaxSize
+	o.TCPOnly = fresh.TCPOnly
+	o.Mutation = fresh.Mutation
+	o.MutationMethod = fresh.MutationMethod
+	o.Bidirectional = fresh.Bidirectional
+	o.SuspectEmpty = fresh.SuspectEmpty
+	o.Coalesce = fresh.Coalesce
+	o.RawForward = fresh.RawForward
+	o.OverloadAction = fresh.OverloadAction
+	o.ACLAction = fresh.ACLAction
+	o.TrustPolicy = fresh.TrustPolicy
+	o.QNAMEMinimize = fresh.QNAMEMinimize
+	o.Delay = fresh.Delay
+	o.Dispatch = fresh.Dispatch
+	o.FastestFirst = fresh.FastestFirst
+	o.Retries, o.RetryTimeout, o.RetryBackoff = fresh.Retries, fresh.RetryTimeout, fresh.RetryBackoff
+	o.RcodeFailover, o.RelayAgreed = fresh.RcodeFailover, fresh.RelayAgreed
+	o.TrustedQuorum = fresh.TrustedQuorum
+	o.MergedAnswers = fresh.MergedAnswers
+	o.DNS64 = fresh.DNS64
+	o.MDNS = fresh.MDNS
+	o.TrustedECS = fresh.TrustedECS
+	o.UntrustedECS = fresh.UntrustedECS
+	o.TestDomains = fresh.TestDomains
+	o.TestQType, o.TestExpect = fresh.TestQType, fresh.TestExpect
+	o.AdminToken = fresh.AdminToken
+	o.Files = fresh.Files
+	o.Profile, o.Profiles = fresh.Profile, fresh.Profiles
+	if sameResolvers(old.TrustedServers, fresh.TrustedServers) && sameResolvers(old.UntrustedServers, fresh.UntrustedServers) {
+		// keep the refined order.
+		o.TrustedServers, o.UntrustedServers = old.TrustedServers, old.UntrustedServers
+	} else {
+		o.TrustedServers, o.UntrustedServers = fresh.TrustedServers, fresh.UntrustedServers
+		s.refineResolvers(&o)
+	}
+
+	if fresh.Listen != old.Listen {
+		if err := s.relisten(fresh.Listen, old); err != nil {
+			s.log.WithError(err).Errorf("Fail to listen at %s. Keep listening at %s.", fresh.Listen, old.Listen)
+		} else {
+			o.Listen = fresh.Listen
+		}
+	}
+	for _, name := range restartRequired(old, fresh) {
+		s.log.Warnf("%s changed, which takes effect on restart.", name)
+	}
+	s.optFuncs = opts
+	s.opts.Store(&o)
+	s.cache.Purge()
+	s.log.Info("Options reloaded.")
+	return nil
+}
+
+// _shutdownTimeout is how long old DNS listeners wait for queries in flight when the listening address changes.
+const _shutdownTimeout = 5 * time.Second
+
+// relisten moves DNS listeners to addr, which are started like those of Start by o, the options they are started with.
+// Before the server runs, only addresses of the listeners change.
+func (s *Server) relisten(addr string, o *serverOptions) error {
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+	if s.running == nil {
+		s.UDPServer.Addr, s.TCPServer.Addr = addr, addr
+		return nil
+	}
+
+	oldUDP, oldTCP, oldShards := s.UDPServer, s.TCPServer, s.udpShards
+	udp := &dns.Server{Addr: addr, Net: "udp", ReusePort: oldUDP.ReusePort, Handler: oldUDP.Handler}
+	tcp := &dns.Server{Addr: addr, Net: "tcp", ReusePort: oldTCP.ReusePort, Handler: oldTCP.Handler}
+	// listeners failing to bind would stop the server in its group, so they are started in their own.
+	eg := new(errgroup.Group)
+	shards, err := startListeners(eg, udp, tcp, o)
+	if err != nil {
+		eg.Wait()
+		return err
+	}
+	s.running.Go(eg.Wait)
+	s.UDPServer, s.TCPServer, s.udpShards = udp, tcp, shards
+	s.log.Info("Start server at ", addr)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), _shutdownTimeout)
+		defer cancel()
+		for _, srv := range append([]*dns.Server{oldUDP, oldTCP}, oldShards...) {
+			if err := srv.ShutdownContext(ctx); err != nil {
+				s.log.WithError(err).Warn("Fail to shut down old listener at ", srv.Addr)
+			}
+		}
+	}()
+	return nil
+}
+
+// restartRequired returns names of changed options which are only applied when a server is created.
+func restartRequired(old, fresh *serverOptions) (names []string) {
+	for _, opt := range []struct {
+		name string
+		a, b interface{}
+	}{
+		{"MetricsListen", old.MetricsListen, fresh.MetricsListen},
+		{"AdminListen", old.AdminListen, fresh.AdminListen},
+		{"AdminTLS", [3]string{old.AdminCert, old.AdminKey, old.AdminClientCA}, [3]string{fresh.AdminCert, fresh.AdminKey, fresh.AdminClientCA}},
+		{"DebugListen", old.DebugListen, fresh.DebugListen},
+		{"ReusePort", old.ReusePort, fresh.ReusePort},
+		{"UDPSockets", old.UDPSockets, fresh.UDPSockets},
+		{"UDPBatch", old.UDPBatch, fresh.UDPBatch},
+		{"Timeout", old.Timeout, fresh.Timeout},
+		{"LogLevels", old.LogLevels, fresh.LogLevels},
+		{"LogFields", old.LogFields, fresh.LogFields},
+		{"Syslog", [3]interface{}{old.Syslog, old.SyslogAddr, old.SyslogFacility}, [3]interface{}{fresh.Syslog, fresh.SyslogAddr, fresh.SyslogFacility}},
+		{"StatsdAddr", old.StatsdAddr, fresh.StatsdAddr},
+		{"DnstapSocket", old.DnstapSocket, fresh.DnstapSocket},
+		{"OTLPEndpoint", old.OTLPEndpoint, fresh.OTLPEndpoint},
+		{"TraceRatio", old.TraceRatio, fresh.TraceRatio},
+		{"AuditLog", old.AuditLog, fresh.AuditLog},
+		{"RecentQueries", old.RecentQueries, fresh.RecentQueries},
+		{"CacheEntries", old.CacheEntries, fresh.CacheEntries},
+		{"CacheBackend", old.CacheBackend != nil, fresh.CacheBackend != nil},
+		{"CacheRedis", old.CacheRedis, fresh.CacheRedis},
+		{"StateFile", old.StateFile, fresh.StateFile},
+		{"QueryLog", old.QueryLog, fresh.QueryLog},
+		{"QueryLogFormat", old.QueryLogFormat, fresh.QueryLogFormat},
+		{"QueryLogSample", old.QueryLogSample, fresh.QueryLogSample},
+		{"SourcePorts", [2]int{old.SourcePortMin, old.SourcePortMax}, [2]int{fresh.SourcePortMin, fresh.SourcePortMax}},
+		{"UpstreamSockets", old.UpstreamSockets, fresh.UpstreamSockets},
+		{"UpstreamRotation", old.UpstreamRotation, fresh.UpstreamRotation},
+		{"FastestIP", [2]interface{}{old.FastestIP, old.FastestIPWait}, [2]interface{}{fresh.FastestIP, fresh.FastestIPWait}},
+		{"IPSets", len(old.IPSets) > 0, len(fresh.IPSets) > 0},
+		{"NFTSets", len(old.NFTSets) > 0, len(fresh.NFTSets) > 0},
+		{"SocketOptions", [2]SocketOptions{old.TrustedSockets, old.UntrustedSockets}, [2]SocketOptions{fresh.TrustedSockets, fresh.UntrustedSockets}},
+		{"CanaryInterval", old.CanaryInterval, fresh.CanaryInterval},
+		{"HealthInterval", old.HealthInterval, fresh.HealthInterval},
+		{"CircuitBreaker", [2]interface{}{old.BreakerThreshold, old.BreakerCooldown}, [2]interface{}{fresh.BreakerThreshold, fresh.BreakerCooldown}},
+		{"PollutionWebhook", old.PollutionWebhook, fresh.PollutionWebhook},
+		{"UpstreamWebhook", old.UpstreamWebhook, fresh.UpstreamWebhook},
+		{"UpstreamSummary", old.UpstreamSummary, fresh.UpstreamSummary},
+		{"WatchInterval", old.WatchInterval, fresh.WatchInterval},
+		{"ResolverSourceInterval", old.ResolverSourceInterval, fresh.ResolverSourceInterval},
+		{"KVConfig", kvName(old.KVStore, old.KVPrefix), kvName(fresh.KVStore, fresh.KVPrefix)},
+		{"Peers", [2]interface{}{strings.Join(old.Peers, ","), old.PeerInterval}, [2]interface{}{strings.Join(fresh.Peers, ","), fresh.PeerInterval}},
+		{"ListSources", len(old.ListSources), len(fresh.ListSources)},
+		{"MaxConcurrency", [2]int{old.MaxConcurrency, old.OverloadQueue}, [2]int{fresh.MaxConcurrency, fresh.OverloadQueue}},
+		{"RateLimit", [4]interface{}{old.RateLimit, old.RateLimitBurst, old.RateLimitAction, strings.Join(old.RateLimitExempt, ",")},
+			[4]interface{}{fresh.RateLimit, fresh.RateLimitBurst, fresh.RateLimitAction, strings.Join(fresh.RateLimitExempt, ",")}},
+		{"RRL", [4]int{old.RRLRate, old.RRLSlip, old.RRLIPv4Prefix, old.RRLIPv6Prefix},
+			[4]int{fresh.RRLRate, fresh.RRLSlip, fresh.RRLIPv4Prefix, fresh.RRLIPv6Prefix}},
+		{"ACL", [2]string{strings.Join(old.AllowedClients, ","), strings.Join(old.DeniedClients, ",")},
+			[2]string{strings.Join(fresh.AllowedClients, ","), strings.Join(fresh.DeniedClients, ",")}},
+	} {
+		if !reflect.DeepEqual(opt.a, opt.b) {
+			names = append(names, opt.name)
+		}
+	}
+	return
+}
+
+// sameResolvers reports whether a and b have the same resolvers regardless of order.
+func sameResolvers(a, b resolverArray) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]Resolver, len(a))
+	for _, r := range a {
+		set[r.GetAddr()] = r
+	}
+	for _, r := range b {
+		if old, ok := set[r.GetAddr()]; !ok || !reflect.DeepEqual(old, r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,238 @@
+package gochinadns
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestSameResolvers(t *testing.T) {
+	a := resolverArray{{addr: "1.1.1.1:53", protocols: []string{"udp"}}, {addr: "8.8.8.8:53", protocols: []string{"tcp"}}}
+	b := resolverArray{a[1], a[0]}
+	if !sameResolvers(a, b) {
+		t.Error("Resolvers in different order should be the same")
+	}
+	c := resolverArray{a[0], {addr: "8.8.8.8:53", protocols: []string{"udp"}}}
+	if sameResolvers(a, c) {
+		t.Error("Resolvers with different protocols should not be the same")
+	}
+	if sameResolvers(a, a[:1]) {
+		t.Error("Resolvers of different lengths should not be the same")
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	old, fresh := newServerOptions(), newServerOptions()
+	fresh.Bidirectional = true
+	if names := restartRequired(old, fresh); len(names) != 0 {
+		t.Errorf("Bidirectional should apply without restart, got %v", names)
+	}
+	fresh.Listen = "127.0.0.1:5353"
+	fresh.SourcePortMin, fresh.SourcePortMax = 20000, 30000
+	if names, want := restartRequired(old, fresh), []string{"SourcePorts"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("restartRequired() = %v, want %v", names, want)
+	}
+}
+
+func TestReloadOptions(t *testing.T) {
+	base := []ServerOption{WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true)}
+	s, err := NewServer(append(base, WithDNS64("64:ff9b::/96"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(append(base, WithDNS64("2001:db8:64::/96"), WithMDNS("127.0.0.1:5353"),
+		WithACLAction(ACLDrop), WithTrustPolicy(TrustPolicyFunc(func(*dns.Question, *dns.Msg, string) Decision {
+			return Decision{Reason: "custom"}
+		})))...); err != nil {
+		t.Fatal(err)
+	}
+	if o := s.options(); o.DNS64 == nil || o.DNS64.String() != "2001:db8:64::/96" {
+		t.Errorf("DNS64 prefix after reload = %v, want 2001:db8:64::/96", o.DNS64)
+	}
+	if o := s.options(); o.MDNS == nil || o.MDNS.target != "127.0.0.1:5353" {
+		t.Errorf("mDNS after reload = %v, want 127.0.0.1:5353", o.MDNS)
+	}
+	if o := s.options(); o.ACLAction != ACLDrop {
+		t.Errorf("ACL action after reload = %s, want %s", o.ACLAction, ACLDrop)
+	}
+	reply := newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.2.3.4")
+	if v := s.ClassifyAnswer(reply); v.Trusted.Reason != "custom" {
+		t.Errorf("Verdict after reload = %+v, want one of the reloaded policy", v.Trusted)
+	}
+	if err := s.Reload(base...); err != nil {
+		t.Fatal(err)
+	}
+	if o := s.options(); o.DNS64 != nil || o.MDNS != nil {
+		t.Errorf("DNS64 prefix %v and mDNS %v after reload without them, want nil", o.DNS64, o.MDNS)
+	}
+	if v := s.ClassifyAnswer(reply); v.Trusted.Reason == "custom" {
+		t.Errorf("Verdict after reload without the policy = %+v, want one of the default policy", v.Trusted)
+	}
+}
+
+func TestRelisten(t *testing.T) {
+	s := &Server{
+		log:       newServerOptions().logger(logServer),
+		UDPServer: &dns.Server{Addr: "127.0.0.1:0", Net: "udp"},
+		TCPServer: &dns.Server{Addr: "127.0.0.1:0", Net: "tcp"},
+	}
+	if err := s.relisten("127.0.0.1:0", newServerOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	s.running = new(errgroup.Group)
+	started := make(chan struct{}, 2)
+	old := []*dns.Server{s.UDPServer, s.TCPServer}
+	for _, srv := range old {
+		srv.NotifyStartedFunc = func() { started <- struct{}{} }
+		s.running.Go(srv.ListenAndServe)
+	}
+	<-started
+	<-started
+	if err := s.relisten("127.0.0.1:0", newServerOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if s.UDPServer == old[0] || s.TCPServer == old[1] {
+		t.Fatal("Listeners should be replaced")
+	}
+	s.UDPServer.Shutdown()
+	s.TCPServer.Shutdown()
+	if err := s.running.Wait(); err != nil {
+		t.Errorf("Listeners should exit cleanly, got %v", err)
+	}
+}
+
+func TestAddRemoveResolver(t *testing.T) {
+	s := &Server{log: newServerOptions().logger(logServer), disabled: make(map[string]struct{})}
+	s.opts.Store(newServerOptions())
+	if err := s.AddResolver("tcp@1.1.1.1:53", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddResolver("1.1.1.1:53", false); err == nil {
+		t.Error("Adding an existing resolver should fail")
+	}
+	if err := s.AddResolver("114.114.114.114", false); err != nil {
+		t.Fatal(err)
+	}
+	o := s.options()
+	if len(o.TrustedServers) != 1 || len(o.UntrustedServers) != 1 {
+		t.Fatalf("Trusted %v, untrusted %v, want one of each", o.TrustedServers, o.UntrustedServers)
+	}
+	if m := o.TrustedServers[0].GetMutation(); m != mutationNone {
+		t.Errorf("Mutation of the added resolver = %q, want %q", m, mutationNone)
+	}
+
+	if err := s.RemoveResolver("1.1.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveResolver("1.1.1.1:53"); err == nil {
+		t.Error("Removing an unknown resolver should fail")
+	}
+	if o := s.options(); len(o.TrustedServers) != 0 || len(o.UntrustedServers) != 1 {
+		t.Errorf("Trusted %v, untrusted %v after removal", o.TrustedServers, o.UntrustedServers)
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "chinadns.conf")
+	if err := ioutil.WriteFile(path, []byte("tcp-only = false\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan struct{}, 1)
+	var reloader func() ([]ServerOption, error)
+	reloader = func() ([]ServerOption, error) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case reloaded <- struct{}{}:
+		default:
+		}
+		return []ServerOption{WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true),
+			WithTCPOnly(strings.Contains(string(b), "true")), WithReloader(reloader, path)}, nil
+	}
+	opts, _ := reloader()
+	<-reloaded
+	s, err := NewServer(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := s.options().Files; len(files) != 1 || files[0] != path {
+		t.Fatalf("Files = %v, want %s", files, path)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.watchFiles(ctx, 10*time.Millisecond)
+	// the watcher may not be watching yet.
+	for i := 0; i < 100 && !s.options().TCPOnly; i++ {
+		if err := ioutil.WriteFile(path, []byte("tcp-only = true\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-reloaded:
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if !s.options().TCPOnly {
+		t.Error("Changed file of the reloader should be reloaded")
+	}
+}
+
+func TestRelistenUDPSockets(t *testing.T) {
+	if !supportsReusePort {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+	addr := startTestUpstream(t, "1.2.3.4")
+	opts := []ServerOption{WithReusePort(true), WithUDPSockets(2), WithTrustedResolvers("udp@" + addr),
+		WithSkipStartupTest(true)}
+	s, err := NewServer(append(opts, WithListenAddr("127.0.0.1:0"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// a free port, since 127.0.0.1:0 is the same listening address.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := pc.LocalAddr().String()
+	pc.Close()
+	if err := s.Reload(append(opts, WithListenAddr(listen))...); err != nil {
+		t.Fatal(err)
+	}
+	udp, tcp := s.Listeners()
+	if got := udp.PacketConn.LocalAddr().String(); got != listen || !udp.ReusePort || !tcp.ReusePort {
+		t.Errorf("UDP listener at %s (SO_REUSEPORT %v), want %s with SO_REUSEPORT", got, udp.ReusePort, listen)
+	}
+	s.listenMu.Lock()
+	shards := s.udpShards
+	s.listenMu.Unlock()
+	if len(shards) != 1 || shards[0].PacketConn.LocalAddr().String() != listen {
+		t.Errorf("UDP shards %v, want one at %s", shards, listen)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if reply, err := dns.Exchange(req, listen); err != nil || len(reply.Answer) != 1 {
+		t.Errorf("Query at the new address replies %v, %v", reply, err)
+	}
+}
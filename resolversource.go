@@ -0,0 +1,77 @@
+package gochinadns
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ResolverSource returns the resolvers to use at the moment, such as from service discovery, DHCP option 6,
+// or the state of a VPN, see WithResolverSource. It's called with a context done once the server shuts down.
+type ResolverSource func(ctx context.Context) ([]*Resolver, error)
+
+// RefreshResolvers gets resolvers from the resolver source, and reloads the server with them like Reload if they
+// change, so that a source may push changes by calling it, besides being polled. Resolvers of the source are added
+// to the resolvers of options, and classified like those of WithUpstreams.
+func (s *Server) RefreshResolvers(ctx context.Context) error {
+	source := s.options().ResolverSource
+	if source == nil {
+		return errors.New("no resolver source")
+	}
+	resolvers, err := source(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fail to get resolvers from the source")
+	}
+	for _, r := range resolvers {
+		if r == nil || r.addr == "" {
+			return errors.New("Schema error: empty resolver from the source")
+		}
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if sourceKey(resolvers) == sourceKey(s.sourced) {
+		return nil
+	}
+	prev := s.sourced
+	s.sourced = resolvers
+	if err := s.reload(s.optFuncs); err != nil {
+		s.sourced = prev
+		return err
+	}
+	s.log.Infof("Resolvers of the source change to %d.", len(resolvers))
+	return nil
+}
+
+// sourceKey returns the sorted schemas of resolvers, which are the same for the same resolvers in any order.
+func sourceKey(resolvers []*Resolver) string {
+	schemas := make([]string, len(resolvers))
+	for i, r := range resolvers {
+		schemas[i] = r.schema()
+	}
+	sort.Strings(schemas)
+	return strings.Join(schemas, ",")
+}
+
+// runResolverSource refreshes resolvers from the source at once, and then every interval if it's positive.
+func (s *Server) runResolverSource(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		if err := s.RefreshResolvers(ctx); err != nil && ctx.Err() == nil {
+			s.log.WithError(err).Warn("Fail to refresh resolvers from the source.")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package gochinadns
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestRefreshResolvers(t *testing.T) {
+	first, second := startTestUpstream(t, "1.2.3.4"), startTestUpstream(t, "5.6.7.8")
+	var mu sync.Mutex
+	schemas := []string{first}
+	var calls int
+	source := func(ctx context.Context) ([]*Resolver, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		var resolvers []*Resolver
+		for _, schema := range schemas {
+			r, err := NewResolver(schema)
+			if err != nil {
+				return nil, err
+			}
+			resolvers = append(resolvers, r)
+		}
+		return resolvers, nil
+	}
+	s, err := NewServer(
+		WithListenAddr("127.0.0.1:0"),
+		WithSkipStartupTest(true),
+		WithTrustedResolvers("udp@8.8.8.8:53"),
+		WithResolverSource(source, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	has := func(addr string) bool {
+		o := s.options()
+		for _, servers := range [][]Resolver{o.TrustedServers, o.UntrustedServers} {
+			for _, r := range servers {
+				if r.addr == addr {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if err := s.RefreshResolvers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !has(first) || !has("8.8.8.8:53") {
+		t.Fatalf("resolvers of the source are not added: %v %v", s.options().TrustedServers, s.options().UntrustedServers)
+	}
+	o := s.options()
+	if err := s.RefreshResolvers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s.options() != o {
+		t.Error("server reloads with the same resolvers")
+	}
+
+	mu.Lock()
+	schemas = []string{second}
+	mu.Unlock()
+	if err := s.RefreshResolvers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if has(first) || !has(second) {
+		t.Errorf("resolvers of the source do not change: %v %v", s.options().TrustedServers, s.options().UntrustedServers)
+	}
+	if calls != 3 {
+		t.Errorf("source is called %d times, expect 3", calls)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !has(second) {
+		t.Error("resolvers of the source are lost by Reload")
+	}
+}
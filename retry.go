@@ -0,0 +1,52 @@
+package gochinadns
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// retryPolicy is how a lookup retries a protocol of a resolver before moving on to the next one, see WithRetry.
+type retryPolicy struct {
+	retries int           //attempts after the first one
+	timeout time.Duration //timeout of each attempt. 0 means the timeout of the client.
+	backoff time.Duration //wait before the first retry, doubled before each one after it
+}
+
+func (s *Server) retryPolicy() retryPolicy {
+	o := s.options()
+	return retryPolicy{retries: o.Retries, timeout: o.RetryTimeout, backoff: o.RetryBackoff}
+}
+
+// client returns cli, or a client like it with the timeout of the server, or else of attempts, if any.
+func (p retryPolicy) client(cli *dns.Client, server Resolver) *dns.Client {
+	timeout := server.timeout
+	if timeout <= 0 {
+		timeout = p.timeout
+	}
+	if timeout <= 0 || timeout == cli.Timeout {
+		return cli
+	}
+	return &dns.Client{Net: cli.Net, UDPSize: cli.UDPSize, Dialer: cli.Dialer, Timeout: timeout}
+}
+
+// do calls attempt, and again while it times out, up to retries times or until ctx is done. Other errors are returned
+// at once, since a resolver refusing connections or sending bad replies won't do better soon.
+func (p retryPolicy) do(ctx context.Context, logger Logger, attempt func() error) (err error) {
+	backoff := p.backoff
+	for i := 0; ; i++ {
+		if err = attempt(); err == nil || i >= p.retries || !isTimeout(err) {
+			return
+		}
+		logger.WithError(err).Debugf("Retry in %s.", backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,60 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startLossyUpstream serves A queries over UDP with answer 1.2.3.4, dropping the first drops queries,
+// and returns its address.
+func startLossyUpstream(t *testing.T, drops int32) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries int32
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if atomic.AddInt32(&queries, 1) <= drops {
+			return
+		}
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+		reply.Answer = append(reply.Answer, rr)
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestRetry(t *testing.T) {
+	for _, mutation := range []string{mutationNone, mutationPointer} {
+		for _, retries := range []int{0, 2} {
+			addr := startLossyUpstream(t, 2)
+			s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr+"?mutation="+mutation),
+				WithTimeout(time.Second), WithRetry(retries, 50*time.Millisecond, 10*time.Millisecond), WithSkipStartupTest(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			start := time.Now()
+			_, _, err = s.LookupMutated(context.Background(), req, s.options().TrustedServers[0])
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("lookup with mutation %s and %d retries takes %s", mutation, retries, elapsed)
+			}
+			if (err == nil) != (retries > 0) {
+				t.Errorf("lookup with mutation %s and %d retries of a resolver dropping 2 queries: %v", mutation, retries, err)
+			}
+		}
+	}
+	if err := WithRetry(-1, 0, 0)(new(serverOptions)); err == nil {
+		t.Error("negative retries should fail")
+	}
+}
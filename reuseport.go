@@ -0,0 +1,7 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build aix darwin dragonfly freebsd linux netbsd openbsd
+
+package gochinadns
+
+// supportsReusePort is whether listeners can be bound with SO_REUSEPORT on this platform.
+const supportsReusePort = true
@@ -0,0 +1,8 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package gochinadns
+
+// supportsReusePort is whether listeners can be bound with SO_REUSEPORT on this platform.
+// There is no SO_REUSEPORT on Windows, where SO_REUSEADDR lets another process steal the port.
+const supportsReusePort = false
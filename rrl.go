@@ -0,0 +1,180 @@
+package gochinadns
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Actions on responses over the response rate limit.
+const (
+	rrlDrop = "drop" //not sent
+	rrlSlip = "slip" //sent truncated, so that the client retries over TCP
+)
+
+// Kinds of responses limited separately.
+const (
+	rrlAnswer   = 'a' //NOERROR with answers
+	rrlNoData   = 'n' //NOERROR without answers
+	rrlNXDomain = 'x' //NXDOMAIN, of any name
+	rrlError    = 'e' //other rcodes, of any name
+)
+
+// _maxRRLKeyLen is the max length of keys of responseLimiter: the network, the kind, the longest name and the type.
+const _maxRRLKeyLen = net.IPv6len + 1 + 255 + 2
+
+// responseLimiter limits UDP responses as Response Rate Limiting of BIND does, so that a server listening on a public
+// address can't be abused to reflect and amplify floods of queries with spoofed source addresses at a victim.
+// Identical responses to a network of clients are limited to a rate per second: answers and empty answers are
+// identical if they are of the same name and type, while NXDOMAIN responses, and errors, of any names are, so that
+// random names don't escape the limit. Responses over the limit are dropped, but every slip-th one is sent truncated,
+// so that a legitimate client whose network is spoofed still gets its answer over TCP, which can't be spoofed.
+type responseLimiter struct {
+	slip    int //0 to never slip
+	v4Mask  net.IPMask
+	v6Mask  net.IPMask
+	exempt  *cidrSet //clients which are not limited
+	buckets *tokenBuckets
+}
+
+func newResponseLimiter(rate, slip, v4Prefix, v6Prefix int, exempt *cidrSet) *responseLimiter {
+	return &responseLimiter{
+		slip:    slip,
+		v4Mask:  net.CIDRMask(v4Prefix, 8*net.IPv4len),
+		v6Mask:  net.CIDRMask(v6Prefix, 8*net.IPv6len),
+		exempt:  exempt,
+		buckets: newTokenBuckets(float64(rate), float64(rate)),
+	}
+}
+
+// limit returns the action on the packed response to req for the client at ip at now, or "" if it's sent as is.
+func (l *responseLimiter) limit(ip net.IP, req *dns.Msg, packet []byte, now time.Time) string {
+	if len(packet) < 12 || len(req.Question) != 1 {
+		return ""
+	}
+	var buf [_maxRRLKeyLen]byte
+	key := buf[:net.IPv6len]
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(key, net.IPv4(0, 0, 0, 0))
+		for i := range ip4 {
+			key[12+i] = ip4[i] & l.v4Mask[i]
+		}
+	} else {
+		for i := range ip {
+			key[i] = ip[i] & l.v6Mask[i]
+		}
+	}
+	switch rcode := packet[3] & 0xF; {
+	case rcode == dns.RcodeNameError:
+		key = append(key, rrlNXDomain)
+	case rcode != dns.RcodeSuccess:
+		key = append(key, rrlError)
+	default:
+		kind := byte(rrlAnswer)
+		if binary.BigEndian.Uint16(packet[6:]) == 0 {
+			kind = rrlNoData
+		}
+		key = append(key, kind)
+		q := &req.Question[0]
+		name := q.Name
+		if len(name) > 255 {
+			name = name[:255]
+		}
+		for i := 0; i < len(name); i++ {
+			c := name[i]
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			key = append(key, c)
+		}
+		key = append(key, byte(q.Qtype>>8), byte(q.Qtype))
+	}
+	ok, denied := l.buckets.take(key, now)
+	switch {
+	case ok:
+		return ""
+	case l.slip > 0 && denied%l.slip == 0:
+		return rrlSlip
+	default:
+		return rrlDrop
+	}
+}
+
+// truncated writes the header and the question of the packed response into buf, with TC set, and returns it,
+// or nil if the packet is malformed.
+func truncated(buf, packet []byte) []byte {
+	off := 12
+	for i := binary.BigEndian.Uint16(packet[4:]); i > 0; i-- {
+		var ok bool
+		if off, ok = skipName(packet, off); !ok || off+4 > len(packet) {
+			return nil
+		}
+		off += 4
+	}
+	if off > len(buf) {
+		return nil
+	}
+	b := append(buf[:0], packet[:off]...)
+	b[2] |= 2
+	// no answer, authority and additional records.
+	for i := 6; i < 12; i++ {
+		b[i] = 0
+	}
+	return b
+}
+
+// rrlWriter writes responses to a UDP client through the response rate limit.
+type rrlWriter struct {
+	dns.ResponseWriter
+	s   *Server
+	ip  net.IP
+	req *dns.Msg
+}
+
+// limitResponses returns w writing responses to req through the response rate limit, or w itself if they are
+// not limited, such as over TCP.
+func (s *Server) limitResponses(w dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	if s.rrl == nil {
+		return w
+	}
+	// clients over TCP can't spoof their addresses.
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return w
+	}
+	ip, _ := addrIPPort(w.RemoteAddr())
+	if ip == nil {
+		return w
+	}
+	if exempt, _ := s.rrl.exempt.Contains(ip); exempt {
+		return w
+	}
+	return &rrlWriter{ResponseWriter: w, s: s, ip: ip, req: req}
+}
+
+func (w *rrlWriter) Write(packet []byte) (int, error) {
+	action := w.s.rrl.limit(w.ip, w.req, packet, time.Now())
+	if action == "" {
+		return w.ResponseWriter.Write(packet)
+	}
+	w.s.stats.rrlLimited.Add(1)
+	w.s.metrics.observeRRL(action)
+	if action == rrlDrop {
+		return len(packet), nil
+	}
+	b := getPacketBuffer()
+	defer putPacketBuffer(b)
+	tc := truncated(*b, packet)
+	if tc == nil {
+		return len(packet), nil
+	}
+	if _, err := w.ResponseWriter.Write(tc); err != nil {
+		return 0, err
+	}
+	return len(packet), nil
+}
+
+func (w *rrlWriter) WriteMsg(m *dns.Msg) error {
+	return writeMsg(w, m)
+}
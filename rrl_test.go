@@ -0,0 +1,102 @@
+package gochinadns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResponseLimiter(t *testing.T) {
+	l := newResponseLimiter(2, 2, 24, 56, nil)
+	now := time.Now()
+	answer := newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.2.3.4")
+	packet, err := answer.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("Example.com.", dns.TypeA)
+
+	var actions []string
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"} {
+		actions = append(actions, l.limit(net.ParseIP(ip), req, packet, now))
+	}
+	// clients of a /24 are limited together, and every other response over the limit slips.
+	if want := []string{"", "", rrlDrop, rrlSlip, rrlDrop}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("actions = %q, want %q", actions, want)
+	}
+	if action := l.limit(net.ParseIP("10.0.1.1"), req, packet, now); action != "" {
+		t.Errorf("response to another network is %s", action)
+	}
+	other := new(dns.Msg)
+	other.SetQuestion("example.org.", dns.TypeA)
+	if action := l.limit(net.ParseIP("10.0.0.1"), other, packet, now); action != "" {
+		t.Errorf("response of another name is %s", action)
+	}
+	if action := l.limit(net.ParseIP("10.0.0.1"), req, packet, now.Add(time.Second)); action != "" {
+		t.Errorf("response after a second is %s", action)
+	}
+
+	// NXDOMAIN responses of any names are limited together.
+	nx, err := newTestReply(t, dns.RcodeNameError).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions = actions[:0]
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		req.SetQuestion(name, dns.TypeA)
+		actions = append(actions, l.limit(net.ParseIP("2001:db8::1"), req, nx, now))
+	}
+	if want := []string{"", "", rrlDrop}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("NXDOMAIN actions = %q, want %q", actions, want)
+	}
+
+	tc := truncated(make([]byte, 512), packet)
+	m := new(dns.Msg)
+	if err := m.Unpack(tc); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Truncated || len(m.Question) != 1 || len(m.Answer) != 0 || m.Id != answer.Id {
+		t.Errorf("truncated response = %v", m)
+	}
+}
+
+func TestServeResponseRateLimit(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithResponseRateLimit(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []*dns.Msg
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("version.bind.", dns.TypeTXT)
+		req.Question[0].Qclass = dns.ClassCHAOS
+		w := new(explainWriter)
+		s.Serve(w, req)
+		replies = append(replies, w.reply)
+	}
+	if replies[0] == nil || len(replies[0].Answer) == 0 {
+		t.Errorf("first reply = %v, want an answer", replies[0])
+	}
+	if replies[1] != nil {
+		t.Errorf("second reply = %v, want it dropped", replies[1])
+	}
+	if replies[2] == nil || !replies[2].Truncated || len(replies[2].Answer) != 0 {
+		t.Errorf("third reply = %v, want it truncated", replies[2])
+	}
+	if n := s.Stats().RRLLimited; n != 2 {
+		t.Errorf("Stats().RRLLimited = %d, want 2", n)
+	}
+
+	exempt, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithResponseRateLimit(1, 2),
+		WithRateLimitExempt("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := exempt.limitResponses(new(explainWriter), new(dns.Msg)).(*rrlWriter); ok {
+		t.Error("responses to exempt clients are limited")
+	}
+}
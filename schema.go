@@ -2,31 +2,137 @@ package gochinadns
 
 import (
 	"fmt"
-	"github.com/pkg/errors"
+	"net"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
-// resolver contains info about a single upstream DNS server.
-type resolver struct {
-	addr      string   //address of the resolver in format ip:port
-	protocols []string //list of protocols to use with this resolver, in order of execution
+// Resolver is an upstream DNS server, parsed from a schema by NewResolver. Its fields are read by accessors,
+// and never changed once it's used by a server.
+type Resolver struct {
+	addr      string        //address of the resolver in format ip:port, or host:port
+	addrs     []string      //addresses resolved from the host, IPv6 first, see bootstrap
+	protocols []string      //list of protocols to use with this resolver, in order of execution
+	mutation  string        //mutation method of queries to this resolver. Empty means the server default.
+	group     string        //dispatch group of the resolver, see WithDispatch. Empty means a group of its own.
+	weight    int           //share of queries among weighted resolvers of its group, see WithDispatch. 0 means unweighted.
+	timeout   time.Duration //timeout of queries to the resolver. 0 means the server default.
+	delay     time.Duration //delay to query the next resolvers when it gives no reply. 0 means the server default.
+	source    net.IP        //local address queries are sent from. nil means that of its group, see SocketOptions.
+	reason    string        //why the resolver is trusted or untrusted
+	local     bool          //of the local network, such as a router discovered by SystemResolvers, which is untrusted
+}
+
+// SchemaError is an error in the schema of a resolver, with the position of the part in error.
+type SchemaError struct {
+	Schema string //the schema in error
+	Offset int    //byte offset of the part in error in Schema
+	Err    error  //what the error is
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("Error in resolver [%s] at %d: %v", e.Schema, e.Offset, e.Err)
+}
+
+// Unwrap returns the error of the part in error.
+func (e *SchemaError) Unwrap() error {
+	return e.Err
+}
+
+// NewResolver returns the resolver of schema in the format of WithResolvers, such as udp+tcp@8.8.8.8:53?timeout=300ms,
+// or a bare ip:port queried over UDP then TCP. Errors of the schema are a *SchemaError, which errors.As finds.
+func NewResolver(schema string) (*Resolver, error) {
+	r, err := schemaToResolver(schema, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "Schema error")
+	}
+	return &r, nil
 }
 
-func (r resolver) GetAddr() string {
+// GetAddr returns the address of the resolver, ip:port or host:port, or the URL of a json resolver.
+func (r Resolver) GetAddr() string {
 	return r.addr
 }
 
-func (r resolver) GetProtocols() []string {
+// GetProtocols returns the protocols queried in order, such as udp or tcp.
+func (r Resolver) GetProtocols() []string {
 	return r.protocols
 }
 
-func (r resolver) String() string {
+// GetMutation returns the mutation method of queries, or "" for the default of the server.
+func (r Resolver) GetMutation() string {
+	return r.mutation
+}
+
+// GetGroup returns the dispatch group, or "" if it's a group of its own. See WithDispatch.
+func (r Resolver) GetGroup() string {
+	return r.group
+}
+
+// GetWeight returns the share of queries among weighted resolvers of its group, or 0 if it's unweighted.
+func (r Resolver) GetWeight() int {
+	return r.weight
+}
+
+// GetTimeout returns the timeout of queries, or 0 for the default of the server.
+func (r Resolver) GetTimeout() time.Duration {
+	return r.timeout
+}
+
+// GetDelay returns the delay to query the next resolvers when it gives no reply, or 0 for the default of the server.
+func (r Resolver) GetDelay() time.Duration {
+	return r.delay
+}
+
+// GetSource returns the local address queries are sent from, or nil for that of its group.
+func (r Resolver) GetSource() net.IP {
+	return r.source
+}
+
+// Schema returns the resolver in the format of WithResolvers, which NewResolver parses back.
+func (r Resolver) Schema() string {
+	return r.schema()
+}
+
+func (r Resolver) String() string {
 	return r.GetAddr()
 }
 
+// schema returns the resolver in the format of WithResolvers.
+func (r Resolver) schema() string {
+	s := strings.Join(r.protocols, "+") + "@" + r.addr
+	params := url.Values{}
+	if r.mutation != "" && r.mutation != mutationNone {
+		params.Set("mutation", r.mutation)
+	}
+	if r.group != "" {
+		params.Set("group", r.group)
+	}
+	if r.weight > 0 {
+		params.Set("weight", strconv.Itoa(r.weight))
+	}
+	if r.timeout > 0 {
+		params.Set("timeout", r.timeout.String())
+	}
+	if r.delay > 0 {
+		params.Set("delay", r.delay.String())
+	}
+	if r.source != nil {
+		params.Set("source", r.source.String())
+	}
+	if len(params) > 0 {
+		s += "?" + params.Encode()
+	}
+	return s
+}
+
 // resolverArray is just an array of type resolver.
 // It's not really required other than to define String() to print it nicely in the log.
-type resolverArray []resolver
+type resolverArray []Resolver
 
 func (r resolverArray) String() string {
 	sb := new(strings.Builder)
@@ -38,9 +144,34 @@ func (r resolverArray) String() string {
 
 // schemaToResolver takes a single resolver in schema format and outputs a resolver struct.
 // Will also accept regular ip:port format for backwards compatibility.
-// The schema is defined as:  protocol[+protocol]@ip:port
-func schemaToResolver(input string, tcpOnly bool) (r resolver, err error) {
+// The schema is defined as:  protocol[+protocol]@ip:port[?key=value[&key=value]]
+// Supported keys are: mutation (none, pointer, case or edns), group and weight (see WithDispatch),
+// timeout and delay, which override those of the server, such as 300ms, and source, the local IP queries
+// are sent from on multi-homed hosts. The json protocol, which can't be combined with others, takes the URL of a JSON
+// resolve API instead of ip:port, such as json@https://dns.google/resolve, see LookupJSON.
+func schemaToResolver(input string, tcpOnly bool) (r Resolver, err error) {
 	err = nil
+	schema := input
+	var params url.Values
+	query := len(input)
+	if idx := strings.IndexByte(input, '?'); idx >= 0 {
+		query = idx + 1
+		if params, err = url.ParseQuery(input[query:]); err != nil {
+			err = &SchemaError{Schema: schema, Offset: query, Err: err}
+			return
+		}
+		input = input[:idx]
+	}
+	defer func() {
+		if err == nil {
+			var key string
+			if key, err = applySchemaParams(&r, params); err != nil {
+				r = Resolver{}
+				err = &SchemaError{Schema: schema, Offset: paramOffset(schema, query, key), Err: err}
+			}
+		}
+	}()
+
 	fields := strings.Split(input, "@")
 	if len(fields) == 1 { // input is ip:port
 		var proto []string
@@ -49,7 +180,7 @@ func schemaToResolver(input string, tcpOnly bool) (r resolver, err error) {
 		} else {
 			proto = []string{"udp", "tcp"}
 		}
-		r = resolver{
+		r = Resolver{
 			addr:      fields[0],
 			protocols: proto,
 		}
@@ -59,25 +190,99 @@ func schemaToResolver(input string, tcpOnly bool) (r resolver, err error) {
 		pr := strings.Split(strings.ToLower(fields[0]), "+")
 		var proto []string
 		// check if the protocols are valid
+		offset := 0
 		for _, protocol := range pr {
 			er := checkProtocol(protocol)
 			if er != nil {
-				err = errors.Wrapf(er, "Error in resolver [%s]", input)
+				err = &SchemaError{Schema: schema, Offset: offset, Err: er}
 				return
 			}
 			proto = uniqueAppendString(proto, protocol)
+			offset += len(protocol) + 1
 		}
-		r = resolver{
+		r = Resolver{
 			addr:      fields[1],
 			protocols: proto,
 		}
+		for _, protocol := range proto {
+			if protocol != "json" {
+				continue
+			}
+			if er := r.checkJSON(); er != nil {
+				err = &SchemaError{Schema: schema, Offset: len(fields[0]) + 1, Err: er}
+			}
+			break
+		}
 		return
 	}
 }
 
+// paramOffset returns the offset of the param of key in schema, whose query starts at query, or query if it's escaped.
+func paramOffset(schema string, query int, key string) int {
+	for off := query; off < len(schema); {
+		if strings.HasPrefix(schema[off:], key+"=") || schema[off:] == key {
+			return off
+		}
+		next := strings.IndexByte(schema[off:], '&')
+		if next < 0 {
+			break
+		}
+		off += next + 1
+	}
+	return query
+}
+
+// applySchemaParams applies params to r, and returns the key of the param in error if any.
+func applySchemaParams(r *Resolver, params url.Values) (string, error) {
+	for key, values := range params {
+		if err := applySchemaParam(r, key, values[len(values)-1]); err != nil {
+			return key, err
+		}
+	}
+	return "", nil
+}
+
+func applySchemaParam(r *Resolver, key, value string) error {
+	switch strings.ToLower(key) {
+	case "mutation":
+		value = strings.ToLower(value)
+		if err := checkMutation(value); err != nil {
+			return err
+		}
+		r.mutation = value
+	case "group":
+		r.group = value
+	case "weight":
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 1 {
+			return errors.Errorf("Invalid weight [%s]", value)
+		}
+		r.weight = weight
+	case "timeout", "delay":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return errors.Errorf("Invalid %s [%s]", strings.ToLower(key), value)
+		}
+		if strings.ToLower(key) == "timeout" {
+			r.timeout = d
+		} else {
+			r.delay = d
+		}
+	case "source":
+		ip := net.ParseIP(value)
+		if ip == nil || ip.IsUnspecified() {
+			return errors.Errorf("Invalid source [%s]", value)
+		}
+		r.source = ip
+	default:
+		return errors.Errorf("Unknown parameter [%s]", key)
+	}
+	return nil
+}
+
 // checkProtocol checks if a valid protocol is specified.
 func checkProtocol(p string) error {
-	if p == "udp" || p == "tcp" {
+	if _, ok := lookupTransport(p); p == "udp" || p == "tcp" || p == "json" || ok {
 		return nil
 	} else {
 		return errors.Errorf("Unknown protocol [%s]", p)
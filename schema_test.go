@@ -1,40 +1,75 @@
 package gochinadns
 
 import (
+	"errors"
+	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func Test_schemaToResolver(t *testing.T) {
 
 	tests := []struct {
 		input   string
-		wantR   resolver
+		wantR   Resolver
 		wantErr bool
 	}{
-		{"8.8.8.8:53", resolver{
+		{"8.8.8.8:53", Resolver{
 			addr:      "8.8.8.8:53",
 			protocols: []string{"udp", "tcp"},
 		}, false},
-		{"udp@8.8.8.8:54", resolver{
+		{"udp@8.8.8.8:54", Resolver{
 			addr:      "8.8.8.8:54",
 			protocols: []string{"udp"},
 		}, false},
-		{"UDP+tcp@8.8.8.8:53", resolver{
+		{"UDP+tcp@8.8.8.8:53", Resolver{
 			addr:      "8.8.8.8:53",
 			protocols: []string{"udp", "tcp"},
 		}, false},
-		{"UDP+udp+tcp@8.8.8.8:53", resolver{
+		{"UDP+udp+tcp@8.8.8.8:53", Resolver{
 			addr:      "8.8.8.8:53",
 			protocols: []string{"udp", "tcp"},
 		}, false},
-		{"tcp+udp@8.8.8.8:53", resolver{
+		{"tcp+udp@8.8.8.8:53", Resolver{
 			addr:      "8.8.8.8:53",
 			protocols: []string{"tcp", "udp"},
 		}, false},
-		{"@8.8.8.8:53", resolver{}, true},
-		{"asdf@8.8.8.8:53", resolver{}, true},
-		{"wut+tcp@8.8.8.8:53", resolver{}, true},
+		{"udp@8.8.8.8:53?mutation=Case", Resolver{
+			addr:      "8.8.8.8:53",
+			protocols: []string{"udp"},
+			mutation:  "case",
+		}, false},
+		{"8.8.8.8:53?mutation=pointer", Resolver{
+			addr:      "8.8.8.8:53",
+			protocols: []string{"udp", "tcp"},
+			mutation:  "pointer",
+		}, false},
+		{"8.8.8.8:53?group=vps&mutation=none", Resolver{
+			addr:      "8.8.8.8:53",
+			protocols: []string{"udp", "tcp"},
+			mutation:  "none",
+			group:     "vps",
+		}, false},
+		{"8.8.8.8:53?weight=3", Resolver{
+			addr:      "8.8.8.8:53",
+			protocols: []string{"udp", "tcp"},
+			weight:    3,
+		}, false},
+		{"8.8.8.8:53?weight=0", Resolver{}, true},
+		{"tcp@8.8.8.8:853?timeout=300ms&delay=50ms", Resolver{
+			addr:      "8.8.8.8:853",
+			protocols: []string{"tcp"},
+			timeout:   300 * time.Millisecond,
+			delay:     50 * time.Millisecond,
+		}, false},
+		{"8.8.8.8:53?timeout=0s", Resolver{}, true},
+		{"8.8.8.8:53?delay=soon", Resolver{}, true},
+		{"8.8.8.8:53?mutation=foo", Resolver{}, true},
+		{"8.8.8.8:53?foo=bar", Resolver{}, true},
+		{"@8.8.8.8:53", Resolver{}, true},
+		{"asdf@8.8.8.8:53", Resolver{}, true},
+		{"wut+tcp@8.8.8.8:53", Resolver{}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
@@ -49,3 +84,59 @@ func Test_schemaToResolver(t *testing.T) {
 		})
 	}
 }
+
+func TestNewResolver(t *testing.T) {
+	r, err := NewResolver("tcp+udp@8.8.8.8:53?group=google&weight=2&timeout=300ms&delay=50ms&mutation=case&source=10.8.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.GetAddr() != "8.8.8.8:53" || !reflect.DeepEqual(r.GetProtocols(), []string{"tcp", "udp"}) ||
+		r.GetMutation() != "case" || r.GetGroup() != "google" || r.GetWeight() != 2 ||
+		r.GetTimeout() != 300*time.Millisecond || r.GetDelay() != 50*time.Millisecond ||
+		!r.GetSource().Equal(net.ParseIP("10.8.0.2")) {
+		t.Errorf("NewResolver() = %+v", r)
+	}
+	if again, err := NewResolver(r.Schema()); err != nil || !reflect.DeepEqual(again, r) {
+		t.Errorf("NewResolver(%q) = %+v, %v, want %+v", r.Schema(), again, err, r)
+	}
+	if _, err := NewResolver("quic@8.8.8.8:53"); err == nil {
+		t.Error("NewResolver() should fail with an unknown protocol")
+	}
+	if _, err := NewResolver("8.8.8.8:53?source=0.0.0.0"); err == nil {
+		t.Error("NewResolver() should fail with an invalid source")
+	}
+
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithTrustedUpstreams(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := s.options()
+	if len(o.TrustedServers) != 1 || o.TrustedServers[0].GetAddr() != r.GetAddr() {
+		t.Errorf("trusted servers = %v, want %s", o.TrustedServers, r)
+	}
+	// the server keeps a copy of the resolver.
+	o.TrustedServers[0].protocols[0] = "udp"
+	if r.GetProtocols()[0] != "tcp" {
+		t.Error("the resolver is shared with the server")
+	}
+	if _, err := NewServer(WithUpstreams(nil)); err == nil {
+		t.Error("NewServer should fail with a nil resolver")
+	}
+}
+
+func TestSchemaError(t *testing.T) {
+	for _, tt := range []struct {
+		schema string
+		offset int
+	}{
+		{"udp+wut@8.8.8.8:53", 4},
+		{"8.8.8.8:53?group=a&weight=0", 19},
+		{"8.8.8.8:53?%zz", 11},
+	} {
+		_, err := NewResolver(tt.schema)
+		var se *SchemaError
+		if !errors.As(err, &se) || se.Schema != tt.schema || se.Offset != tt.offset {
+			t.Errorf("NewResolver(%s) = %v, want a SchemaError at %d", tt.schema, err, tt.offset)
+		}
+	}
+}
@@ -2,167 +2,628 @@ package gochinadns
 
 import (
 	"context"
-	"sort"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
-	"github.com/sirupsen/logrus"
+	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 // Server represents a DNS Server instance
 type Server struct {
-	*serverOptions
-	UDPCli    *dns.Client
-	TCPCli    *dns.Client
+	UDPCli *dns.Client
+	TCPCli *dns.Client
+	// UDPServer and TCPServer are the DNS listeners, which may be set up before Start. Once started, they are swapped
+	// by reloads changing the listening address, so read them with Listeners.
 	UDPServer *dns.Server
 	TCPServer *dns.Server
+	// MetricsServer serves Prometheus metrics at /metrics. It is nil if no metrics listening address is set.
+	MetricsServer *http.Server
+	// AdminServer serves the admin HTTP API. It is nil if no admin listening address is set.
+	AdminServer *http.Server
+	// DebugServer serves pprof profiles at /debug/pprof/. It is nil if no debug listening address is set.
+	DebugServer *http.Server
+
+	log         Logger //logger of the server component
+	upstreamLog Logger
+	verdictLog  Logger
+
+	ports     *portPool
+	upstreams *upstreamConns //long-lived UDP sockets to resolvers, nil for a socket per query
+	canary    *canary
+	breaker   *breaker
+	health    *healthChecker
+	metrics   *metrics
+	dnstap    *dnstapWriter
+	queryLog  *queryLogger
+	recent    *queryRing
+	audit     *auditLogger
+	stats     *stats
+	tracer    *tracer
+	families  *familyMemory
+	peers     *peerState  //state learned from peers, see WithPeers
+	jsonConns sync.Map    //HTTP clients of JSON resolvers by URL, see LookupJSON
+	cache     *replyCache //nil if replies are not cached
+	redis     *redisCache //backend of cache with WithRedisCache, nil otherwise
+	syslog    io.Closer   //connection of logs to syslog with WithSyslog, nil otherwise
+
+	rateLimiter *clientLimiter   //nil if clients are not rate limited
+	rrl         *responseLimiter //nil if responses are not rate limited
+	acl         *clientACL       //nil if all clients are served
+
+	handler dns.Handler        //middlewares ending with serveQuery, which rate limited queries don't reach
+	flights singleflight.Group //resolutions of coalesced queries in flight
+	limiter *limiter           //bounds resolutions in flight, nil for no limit
+
+	pollutionCount uint64
+	pollutionHook  *webhook
+	prober         *ipProber   //nil without WithFastestIP
+	ipsets         *answerSets //nil without WithIPSet
+	nftsets        *answerSets //nil without WithNFTSet
+	events         *eventHooks //nil if there are no hooks
+
+	opts     atomic.Value   //*serverOptions, swapped atomically on reload
+	optFuncs []ServerOption //options the server is created with
+	profile  string         //profile switched to at runtime, which overrides the one of optFuncs
+	sourced  []*Resolver    //resolvers of the resolver source, which are added to those of optFuncs
+	reloadMu sync.Mutex
+
+	ctx           context.Context    //parent of contexts of queries, done once the server shuts down
+	cancelQueries context.CancelFunc //gives up queries in flight
+
+	listenMu  sync.Mutex         //guards UDPServer and TCPServer, which are swapped when the listening address changes
+	udpShards []*dns.Server      //UDP servers sharing the port of UDPServer with SO_REUSEPORT, see WithUDPSockets
+	running   *errgroup.Group    //listeners of a running server
+	stop      context.CancelFunc //stops background checks of a running server
+	done      chan struct{}      //closed when the server started last stops
+	err       error              //error which stops the server
+
+	startup atomic.Value //*StartupReport of the last test of resolvers
+
+	disabledMu sync.RWMutex
+	disabled   map[string]struct{} //addresses of resolvers disabled by admin
 }
 
 // NewServer creates a new server instance
 func NewServer(opts ...ServerOption) (s *Server, err error) {
-	var (
-		retryOpts []ServerOption
-		o         = newServerOptions()
-	)
-	for _, f := range opts {
-		if err = f(o); err != nil {
-			if err == errNotReady {
-				retryOpts = append(retryOpts, f)
-				continue
-			}
-			return
-		}
+	o := newServerOptions()
+	o.lazy = true
+	if err = o.apply(opts); err != nil {
+		return nil, err
 	}
-
-	o.normalizeChinaCIDR()
-
-	for _, f := range retryOpts {
-		if err = f(o); err != nil {
-			return
+	var syslogConn io.Closer
+	if o.Syslog {
+		l, conn, serr := newSyslogLogger(o.Logger, o.SyslogAddr, o.SyslogFacility)
+		if serr != nil {
+			return nil, serr
 		}
+		// only logs of the server go to syslog, rather than every log of the standard logger of logrus.
+		o.Logger, syslogConn = l, conn
+		defer func() {
+			if err != nil {
+				conn.Close()
+			}
+		}()
 	}
 
-	err = nil
 	s = &Server{
-		serverOptions: o,
-		UDPCli:        &dns.Client{Timeout: o.Timeout, Net: "udp"},
-		TCPCli:        &dns.Client{Timeout: o.Timeout, Net: "tcp"},
-		UDPServer:     &dns.Server{Addr: o.Listen, Net: "udp", ReusePort: o.ReusePort},
-		TCPServer:     &dns.Server{Addr: o.Listen, Net: "tcp", ReusePort: o.ReusePort},
+		log:         o.logger(logServer),
+		upstreamLog: o.logger(logUpstream),
+		verdictLog:  o.logger(logVerdict),
+		UDPCli:      &dns.Client{Timeout: o.Timeout, Net: "udp"},
+		TCPCli:      &dns.Client{Timeout: o.Timeout, Net: "tcp"},
+		UDPServer:   &dns.Server{Addr: o.Listen, Net: "udp", ReusePort: o.ReusePort},
+		TCPServer:   &dns.Server{Addr: o.Listen, Net: "tcp", ReusePort: o.ReusePort},
+		optFuncs:    opts,
+		stats:       newStats(),
+		families:    newFamilyMemory(),
+		peers:       newPeerState(),
+		disabled:    make(map[string]struct{}),
+		syslog:      syslogConn,
+	}
+	s.ctx, s.cancelQueries = context.WithCancel(context.Background())
+	if o.MetricsListen != "" || o.StatsdAddr != "" {
+		s.metrics = newMetrics()
+	}
+	if o.MetricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.metrics)
+		s.MetricsServer = &http.Server{Addr: o.MetricsListen, Handler: mux}
+	}
+	if o.StatsdAddr != "" {
+		s.metrics.statsd = newStatsdClient(o.StatsdAddr, o.DogStatsd, s.log)
+	}
+	if o.AdminListen != "" {
+		s.AdminServer = &http.Server{Addr: o.AdminListen, Handler: s.adminAuth(s.newAdminHandler())}
+		if s.AdminServer.TLSConfig, err = newAdminTLS(o, s.log); err != nil {
+			return nil, err
+		}
+	}
+	if o.DebugListen != "" {
+		s.DebugServer = &http.Server{Addr: o.DebugListen, Handler: newDebugHandler()}
+	}
+	if o.AuditLog != "" {
+		if s.audit, err = newAuditLogger(o.AuditLog, s.log); err != nil {
+			return nil, err
+		}
+	}
+	if o.RecentQueries > 0 {
+		s.recent = newQueryRing(o.RecentQueries)
+	}
+	if o.CacheBackend != nil {
+		s.cache = newReplyCache(o.CacheBackend)
+	} else if o.CacheRedis != "" {
+		if s.redis, err = newRedisCache(o.CacheRedis, o.CacheEntries, s.log); err != nil {
+			return nil, err
+		}
+		s.cache = newReplyCache(s.redis)
+	} else if o.CacheEntries > 0 {
+		s.cache = newReplyCache(newMemoryCache(o.CacheEntries))
+	}
+	if o.RateLimit > 0 {
+		exempt, err := parseClientCIDRs(o.RateLimitExempt, "exempt")
+		if err != nil {
+			return nil, err
+		}
+		s.rateLimiter = newClientLimiter(o.RateLimit, o.RateLimitBurst, exempt)
+	}
+	if o.RRLRate > 0 {
+		exempt, err := parseClientCIDRs(o.RateLimitExempt, "exempt")
+		if err != nil {
+			return nil, err
+		}
+		s.rrl = newResponseLimiter(o.RRLRate, o.RRLSlip, o.RRLIPv4Prefix, o.RRLIPv6Prefix, exempt)
+	}
+	if s.acl, err = newClientACL(o.AllowedClients, o.DeniedClients); err != nil {
+		return nil, err
+	}
+	if o.QueryLog != "" {
+		if s.queryLog, err = newQueryLogger(o, s.log); err != nil {
+			return nil, err
+		}
 	}
-	s.UDPServer.Handler = dns.HandlerFunc(s.Serve)
-	s.TCPServer.Handler = dns.HandlerFunc(s.Serve)
+	if o.OTLPEndpoint != "" {
+		s.tracer = newTracer(o.OTLPEndpoint, o.TraceRatio, s.log)
+	}
+	if o.DnstapSocket != "" {
+		s.dnstap = newDnstapWriter(o.DnstapSocket, s.log)
+	}
+	if o.PollutionWebhook != "" {
+		s.pollutionHook = newWebhook(o.PollutionWebhook, s.log)
+	}
+	hooks := o.EventHooks
+	if o.UpstreamWebhook != "" {
+		hook := newUpstreamWebhook(s, o.UpstreamWebhook)
+		hooks = append(hooks[:len(hooks):len(hooks)], EventHooks{OnUpstreamStateChange: hook.observe})
+	}
+	s.events = newEventHooks(hooks)
+	if o.FastestIP != nil {
+		s.prober = newIPProber(o.FastestIP, o.FastestIPWait, s.log)
+	}
+	if len(o.IPSets) > 0 {
+		s.ipsets = newAnswerSets(addIPSet, s.log)
+	}
+	if len(o.NFTSets) > 0 {
+		s.nftsets = newAnswerSets(addNFTSet, s.log)
+	}
+	if o.CanaryInterval > 0 {
+		s.canary = newCanary(o, s.upstreamLog, s.events)
+	}
+	if o.BreakerThreshold > 0 {
+		s.breaker = newBreaker(o, s.upstreamLog, s.events)
+	}
+	if o.HealthInterval > 0 {
+		s.health = newHealthChecker(o, s.upstreamLog, s.events)
+	}
+	if o.SourcePortMin > 0 {
+		s.ports = newPortPool(o.SourcePortMin, o.SourcePortMax)
+		if o.UpstreamSockets > 0 {
+			s.upstreamLog.Info("Source ports are randomized per query. Do not keep upstream sockets.")
+		}
+	} else if o.UpstreamSockets > 0 {
+		s.upstreams = newUpstreamConns(o.UpstreamSockets, o.UpstreamRotation)
+	}
+	if o.MaxConcurrency > 0 {
+		s.limiter = newLimiter(o.MaxConcurrency, o.OverloadQueue)
+	}
+	s.handler = chainMiddlewares(dns.HandlerFunc(s.serveQuery), o.Middlewares)
+	s.UDPServer.Handler = s
+	s.TCPServer.Handler = s
 
-	s.refineResolvers()
+	// lookups of startup tests read options, such as the retry policy.
+	s.opts.Store(o)
+	if err := s.loadState(); err != nil {
+		s.log.WithError(err).Warn("Fail to restore state. Start without it.")
+	}
+	s.refineResolvers(o)
+	if len(o.lists) > 0 {
+		go s.loadLazyLists()
+	}
 	return
 }
 
-// Run start the default DNS server.
-func (s *Server) Run() error {
-	logrus.Info("Start server at ", s.Listen)
-	eg, _ := errgroup.WithContext(context.Background())
-	eg.Go(s.UDPServer.ListenAndServe)
-	eg.Go(s.TCPServer.ListenAndServe)
-	return eg.Wait()
-}
-
-const _loop = 2
-
-func (s *Server) refineResolvers() {
-	type test struct {
-		server resolver
-		errCnt int
-		rttAvg time.Duration
-	}
-
-	trusted := make([]test, len(s.TrustedServers))
-	untrusted := make([]test, len(s.UntrustedServers))
-	tLen, uLen := len(s.TrustedServers), len(s.UntrustedServers)
-	req := new(dns.Msg)
-
-	for i, resolver := range s.TrustedServers {
-		trusted[i].server = resolver
-		for j := 0; j < _loop; j++ {
-			for _, name := range s.TestDomains {
-				req.SetQuestion(dns.Fqdn(name), dns.TypeA)
-				var (
-					rtt time.Duration
-					err error
-				)
-				if s.Mutation {
-					_, rtt, err = s.LookupMutation(req, resolver)
-				} else {
-					_, rtt, err = s.Lookup(req, resolver)
-				}
-				if err != nil {
-					trusted[i].errCnt++
-					continue
+func buildOptions(opts []ServerOption) (*serverOptions, error) {
+	o := newServerOptions()
+	if err := o.apply(opts); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// apply applies opts and then options of the active profile.
+// Resolvers are added at last, when the China route list and other options they depend on are final.
+func (o *serverOptions) apply(opts []ServerOption) error {
+	applyAll := func(opts []ServerOption) error {
+		for _, f := range opts {
+			if err := f(o); err != nil {
+				if err := o.fail(err); err != nil {
+					return err
 				}
-				trusted[i].rttAvg += rtt
 			}
 		}
-		if trusted[i].rttAvg > 0 {
-			trusted[i].rttAvg /= time.Duration(_loop*len(s.TestDomains) - trusted[i].errCnt)
+		return nil
+	}
+	if err := applyAll(opts); err != nil {
+		return err
+	}
+	if o.Profile != "" {
+		p, ok := o.findProfile(o.Profile)
+		if !ok {
+			if err := o.fail(errors.Errorf("unknown profile [%s]", o.Profile)); err != nil {
+				return err
+			}
+		}
+		if err := applyAll(p.opts); err != nil {
+			return err
 		}
-		if trusted[i].errCnt > _loop*len(s.TestDomains)/2 {
-			tLen--
+	}
+	if !o.lazy || !o.LazyLists {
+		lists := o.lists
+		o.lists, o.loadingLists = nil, true
+		err := applyAll(lists)
+		o.loadingLists = false
+		if err != nil {
+			return err
 		}
-		logrus.Infof("%s: average RTT %s with %d errors.", resolver, trusted[i].rttAvg, trusted[i].errCnt)
 	}
 
-	sort.Slice(trusted, func(i, j int) bool {
-		if trusted[i].errCnt == trusted[j].errCnt {
-			return trusted[i].rttAvg < trusted[j].rttAvg
+	o.normalizeReusePort()
+	o.normalizeUDPBatch()
+	o.normalizeChinaCIDR()
+	if err := o.normalizeResolvers(); err != nil {
+		return err
+	}
+	o.normalizeMutation()
+	if len(o.Peers) > 0 && o.AdminToken == "" {
+		if err := o.fail(errors.New("peers require an admin token")); err != nil {
+			return err
 		}
-		return trusted[i].errCnt < trusted[j].errCnt
-	})
+	}
+	return nil
+}
 
-	for i, resolver := range s.UntrustedServers {
-		untrusted[i].server = resolver
-		for j := 0; j < _loop; j++ {
-			for _, name := range s.TestDomains {
-				req.SetQuestion(dns.Fqdn(name), dns.TypeA)
-				_, rtt, err := s.Lookup(req, resolver)
-				if err != nil {
-					untrusted[i].errCnt++
-					continue
-				}
-				untrusted[i].rttAvg += rtt
+// loadLazyLists loads lists left by WithLazyLists, and swaps them in like Reload.
+func (s *Server) loadLazyLists() {
+	logger := s.options().logger(logLists)
+	logger.Info("Serve before lists are loaded. Load them in the background.")
+	start := time.Now()
+	if err := s.Reload(); err != nil {
+		logger.WithError(err).Error("Fail to load lists. Serve without them.")
+		return
+	}
+	logger.Infof("Lists are loaded in %s.", time.Since(start))
+}
+
+// Listeners returns the current DNS listeners, which are swapped when a reload changes the listening address.
+func (s *Server) Listeners() (udp, tcp *dns.Server) {
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+	return s.UDPServer, s.TCPServer
+}
+
+// options returns the current options. They must not be modified, since they may be swapped on reload.
+func (s *Server) options() *serverOptions {
+	return s.opts.Load().(*serverOptions)
+}
+
+// Run starts the server and waits until it stops, like Start and then Wait.
+func (s *Server) Run() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	return s.Wait()
+}
+
+// Start binds listeners of the DNS server and the metrics, admin and pprof endpoints, and serves in the background.
+// It returns an error if any listener fails to bind, with the others closed. Wait for the server to stop,
+// or Stop it. A server stopped by an error may be started again, but not a shut down one, whose logs are closed.
+func (s *Server) Start() error {
+	o := s.options()
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+	if s.running != nil {
+		return errors.New("server already started")
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	eg, ctx := errgroup.WithContext(ctx)
+	shards, err := startListeners(eg, s.UDPServer, s.TCPServer, o)
+	s.udpShards = shards
+	dnsServers := append([]*dns.Server{s.UDPServer, s.TCPServer}, shards...)
+
+	var httpListeners []net.Listener
+	for _, srv := range []*http.Server{s.MetricsServer, s.AdminServer, s.DebugServer} {
+		if srv == nil || err != nil {
+			continue
+		}
+		var l net.Listener
+		if l, err = net.Listen("tcp", srv.Addr); err == nil {
+			if srv.TLSConfig != nil {
+				l = tls.NewListener(l, srv.TLSConfig)
 			}
+			httpListeners = append(httpListeners, l)
 		}
-		if untrusted[i].rttAvg > 0 {
-			untrusted[i].rttAvg /= time.Duration(_loop*len(s.TestDomains) - untrusted[i].errCnt)
+	}
+	if err != nil {
+		for _, srv := range dnsServers {
+			srv.Shutdown()
 		}
-		if untrusted[i].errCnt > _loop*len(s.TestDomains)/2 {
-			uLen--
+		for _, l := range httpListeners {
+			l.Close()
 		}
-		logrus.Infof("%s: average RTT %s with %d errors.", resolver, untrusted[i].rttAvg, untrusted[i].errCnt)
+		eg.Wait()
+		stop()
+		return err
 	}
 
-	sort.Slice(untrusted, func(i, j int) bool {
-		if untrusted[i].errCnt == untrusted[j].errCnt {
-			return untrusted[i].rttAvg < untrusted[j].rttAvg
+	s.log.Infof("Start %s at %s", GetBuildInfo(), o.Listen)
+	if len(s.udpShards) > 0 {
+		s.log.Infof("Receive UDP queries with %d sockets.", len(s.udpShards)+1)
+	}
+	for i, srv := range []*http.Server{s.MetricsServer, s.AdminServer, s.DebugServer} {
+		if srv == nil {
+			continue
 		}
-		return untrusted[i].errCnt < untrusted[j].errCnt
-	})
+		s.log.Infof("Serve %s at %s", []string{"metrics", "admin API", "pprof"}[i], srv.Addr)
+		l := httpListeners[0]
+		httpListeners = httpListeners[1:]
+		eg.Go(serveHTTP(srv, l))
+	}
+	s.startBackground(ctx, o)
+
+	s.running, s.stop, s.done = eg, stop, make(chan struct{})
+	go func() {
+		err := eg.Wait()
+		stop()
+		s.listenMu.Lock()
+		s.err = err
+		close(s.done)
+		s.running, s.stop = nil, nil
+		s.listenMu.Unlock()
+	}()
+	return nil
+}
 
-	s.TrustedServers = make([]resolver, len(trusted))
-	s.UntrustedServers = make([]resolver, len(untrusted))
-	for i, t := range trusted {
-		s.TrustedServers[i] = t.server
+// startBackground starts background checks of resolvers, list updates and watches, which stop once ctx is done.
+func (s *Server) startBackground(ctx context.Context, o *serverOptions) {
+	if s.canary != nil {
+		go s.runCanary(ctx)
+	}
+	if s.breaker != nil {
+		go s.runBreaker(ctx)
 	}
-	for i, t := range untrusted {
-		s.UntrustedServers[i] = t.server
+	if s.health != nil {
+		go s.runHealthCheck(ctx)
 	}
+	if o.UpstreamSummary > 0 {
+		go s.runUpstreamSummary(ctx, o.UpstreamSummary)
+	}
+	if o.WatchInterval > 0 {
+		go s.watchFiles(ctx, o.WatchInterval)
+	}
+	if s.ipsets != nil {
+		go s.ipsets.run(ctx)
+	}
+	if s.nftsets != nil {
+		go s.nftsets.run(ctx)
+	}
+	if o.ResolverSource != nil {
+		go s.runResolverSource(ctx, o.ResolverSourceInterval)
+	}
+	if o.KVStore != nil {
+		go s.watchKV(ctx, o.KVStore, o.KVPrefix)
+	}
+	for _, source := range o.ListSources {
+		go s.watchList(ctx, source)
+	}
+	if len(o.Peers) > 0 {
+		go s.runPeerSync(ctx, o.Peers, o.PeerInterval)
+	}
+}
 
-	if tLen == 0 {
-		logrus.Error("There seems to be no available trusted resolver. Server may not behave properly.")
+// RunBackground runs background checks of resolvers, list updates and watches of a server which is not started,
+// such as one answering queries as a dns.Handler of another DNS server, until ctx is done. Then it gives up queries
+// in flight, saves the state to the file of WithStateFile, and closes upstream sockets, the query log and the audit
+// log, returning the first error of them.
+func (s *Server) RunBackground(ctx context.Context) error {
+	s.listenMu.Lock()
+	running := s.running != nil
+	s.listenMu.Unlock()
+	if running {
+		return errors.New("server already started")
 	}
-	if uLen == 0 && s.Bidirectional {
-		logrus.Error("There seems to be no untrusted resolver. Server may not behave properly in bidirectional mode.")
+	s.startBackground(ctx, s.options())
+	<-ctx.Done()
+	s.cancelQueries()
+	s.upstreams.Close()
+	s.redis.Close()
+	defer s.closeSyslog()
+	err := s.saveState()
+	if cerr := s.queryLog.Close(); cerr != nil && err == nil {
+		err = errors.Wrap(cerr, "fail to close query log")
 	}
+	if cerr := s.audit.Close(); cerr != nil && err == nil {
+		err = errors.Wrap(cerr, "fail to close audit log")
+	}
+	return err
+}
+
+// closeSyslog closes the connection of logs to syslog, if any. Later logs are not sent to syslog.
+func (s *Server) closeSyslog() {
+	if s.syslog != nil {
+		s.syslog.Close()
+	}
+}
 
-	logrus.Info("Refined trusted resolvers: ", s.TrustedServers)
-	logrus.Info("Refined untrusted resolvers: ", s.UntrustedServers)
+// startListeners starts udp and tcp in eg, along with UDP servers sharing the port of udp with SO_REUSEPORT
+// up to UDPSockets of o, which are returned. If any fails, those started are shut down.
+func startListeners(eg *errgroup.Group, udp, tcp *dns.Server, o *serverOptions) ([]*dns.Server, error) {
+	servers := []*dns.Server{udp, tcp}
+	err := startDNS(eg, servers, o.UDPBatch)
+	var shards []*dns.Server
+	if err == nil && o.UDPSockets > 1 {
+		// shards bind the port udp is bound to, which is chosen by the system if the listening port is 0.
+		addr := udp.PacketConn.LocalAddr().String()
+		for i := 1; i < o.UDPSockets; i++ {
+			shards = append(shards, &dns.Server{Addr: addr, Net: "udp", ReusePort: true, Handler: udp.Handler})
+		}
+		err = startDNS(eg, shards, o.UDPBatch)
+		servers = append(servers, shards...)
+	}
+	if err != nil {
+		for _, srv := range servers {
+			srv.Shutdown()
+		}
+		return nil, err
+	}
+	return shards, nil
+}
+
+// startDNS starts servers in eg, reading and writing UDP packets in batches of at most batch packets,
+// and waits until all of them are started or fail. It returns the first error failing them.
+func startDNS(eg *errgroup.Group, servers []*dns.Server, batch int) error {
+	// every DNS server sends nil once started, or the error failing it.
+	ready := make(chan error, 2*len(servers))
+	notifies := make([]func(), len(servers))
+	for i, srv := range servers {
+		srv, notify := srv, srv.NotifyStartedFunc
+		notifies[i] = notify
+		srv.NotifyStartedFunc = func() {
+			if notify != nil {
+				notify()
+			}
+			ready <- nil
+		}
+		eg.Go(func() error {
+			err := listenAndServe(srv, batch)
+			ready <- err
+			return err
+		})
+	}
+	var err error
+	for range servers {
+		if e := <-ready; err == nil {
+			err = e
+		}
+	}
+	for i, srv := range servers {
+		srv.NotifyStartedFunc = notifies[i]
+	}
+	return err
+}
+
+// Wait waits until the started server stops, and returns the error which stops it, or nil if it's shut down.
+func (s *Server) Wait() error {
+	s.listenMu.Lock()
+	done := s.done
+	s.listenMu.Unlock()
+	if done == nil {
+		return errors.New("server not started")
+	}
+	<-done
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+	return s.err
+}
+
+// Stop shuts down the server like Shutdown, waiting for queries in flight up to 5 seconds, and waits until it stops.
+func (s *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), _shutdownTimeout)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if waitErr := s.Wait(); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// serveHTTP returns a function serving srv on l, which returns nil once srv is shut down.
+func serveHTTP(srv *http.Server, l net.Listener) func() error {
+	return func() error {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	}
+}
+
+// Shutdown stops accepting queries, and waits for queries in flight to be answered until ctx is done.
+// Then it shuts down the metrics, admin and pprof endpoints, stops background checks,
+// and closes the query log and the audit log. Run returns nil once the server is shut down.
+// Cached replies and learned polluted domains are saved to the state file of WithStateFile, if any.
+// Upstream connections per query are closed once queries in flight are answered, and long-lived upstream sockets
+// of WithUpstreamSockets are closed along with background checks.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.listenMu.Lock()
+	listeners := append([]*dns.Server{s.UDPServer, s.TCPServer}, s.udpShards...)
+	stop := s.stop
+	s.listenMu.Unlock()
+	if stop == nil {
+		return errors.New("server not started")
+	}
+
+	var errs []error
+	for _, srv := range listeners {
+		if err := srv.ShutdownContext(ctx); err != nil {
+			errs = append(errs, errors.Wrapf(err, "fail to shut down %s listener", srv.Net))
+		}
+	}
+	// queries still in flight are given up, along with their upstream lookups.
+	s.cancelQueries()
+	for _, srv := range []*http.Server{s.MetricsServer, s.AdminServer, s.DebugServer} {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, errors.Wrapf(err, "fail to shut down %s", srv.Addr))
+		}
+	}
+	stop()
+	s.upstreams.Close()
+	s.redis.Close()
+	if err := s.saveState(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.queryLog.Close(); err != nil {
+		errs = append(errs, errors.Wrap(err, "fail to close query log"))
+	}
+	if err := s.audit.Close(); err != nil {
+		errs = append(errs, errors.Wrap(err, "fail to close audit log"))
+	}
+	for _, err := range errs {
+		s.log.WithError(err).Warn("Fail to shut down cleanly.")
+	}
+	s.closeSyslog()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	s.log.Info("Server shut down.")
+	return nil
 }
@@ -0,0 +1,231 @@
+package gochinadns
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestShutdown(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithAdminListen("127.0.0.1:0"), WithTestDomains())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Shutdown(context.Background()); err == nil {
+		t.Error("Shutdown before Run should fail")
+	}
+
+	started := make(chan struct{}, 2)
+	s.UDPServer.NotifyStartedFunc = func() { started <- struct{}{} }
+	s.TCPServer.NotifyStartedFunc = func() { started <- struct{}{} }
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+	<-started
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() = %v after shutdown, want nil", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("Run should return after shutdown")
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithMetricsListen("127.0.0.1:0"), WithTestDomains())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Wait(); err == nil {
+		t.Error("Wait before Start should fail")
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err == nil {
+		t.Error("Start of a started server should fail")
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s, err = NewServer(WithListenAddr("127.0.0.1:0"), WithAdminListen(l.Addr().String()), WithTestDomains())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err == nil {
+		t.Error("Start should fail if a listener fails to bind")
+	}
+	if err := s.Start(); err == nil {
+		t.Error("Start should fail again")
+	}
+}
+
+func TestReady(t *testing.T) {
+	f, err := ioutil.TempFile("", "china-*.list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("114.114.114.0/24\n")
+	f.Close()
+
+	addr := startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithCHNList(f.Name()), WithTrustedResolvers("udp@"+addr), WithTestDomains("example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ready(); err == nil {
+		t.Error("Ready before Start should fail")
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ready(); err != nil {
+		t.Errorf("Ready() = %v after Start with a responsive upstream, want nil", err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ready(); err == nil {
+		t.Error("Ready after Stop should fail")
+	}
+
+	// without the startup test, resolvers are not queried until clients query.
+	s, err = NewServer(WithListenAddr("127.0.0.1:0"), WithCHNList(f.Name()), WithTrustedResolvers("udp@"+addr),
+		WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if err := s.Ready(); err != nil {
+		t.Errorf("Ready() = %v after Start without the startup test, want nil", err)
+	}
+	s.stats.upstream(addr).add(upstreamSample{err: true})
+	if err := s.Ready(); err == nil {
+		t.Error("Ready with a failed lookup should fail")
+	}
+}
+
+func TestUDPSockets(t *testing.T) {
+	if !supportsReusePort {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+	addr := startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithReusePort(true), WithUDPSockets(4),
+		WithTrustedResolvers("udp@"+addr), WithDelay(time.Second), WithTestDomains())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if len(s.udpShards) != 3 {
+		t.Fatalf("got %d UDP shards, want 3", len(s.udpShards))
+	}
+	listen := s.UDPServer.PacketConn.LocalAddr().String()
+	for _, srv := range s.udpShards {
+		if got := srv.PacketConn.LocalAddr().String(); got != listen {
+			t.Errorf("shard bound at %s, want %s", got, listen)
+		}
+	}
+	// queries from different source ports are spread across sockets, and all of them are answered.
+	for i := 0; i < 8; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		reply, err := dns.Exchange(req, listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 1 {
+			t.Errorf("got %d answers, want 1", len(reply.Answer))
+		}
+	}
+
+	s, err = NewServer(WithListenAddr("127.0.0.1:0"), WithUDPSockets(4), WithTestDomains())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := s.options(); o.UDPSockets != 1 {
+		t.Errorf("UDPSockets = %d without ReusePort, want 1", o.UDPSockets)
+	}
+}
+
+func TestServeDNSMounted(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+startTestUpstream(t, "1.2.3.4")),
+		WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := dns.NewServeMux()
+	mux.Handle(".", s)
+	mux.HandleFunc("lan.", func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeNameError)
+		w.WriteMsg(reply)
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: mux}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	cli := new(dns.Client)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	reply, _, err := cli.Exchange(req, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("reply of the mounted server = %v", reply)
+	}
+	req.SetQuestion("host.lan.", dns.TypeA)
+	if reply, _, err = cli.Exchange(req, pc.LocalAddr().String()); err != nil || reply.Rcode != dns.RcodeNameError {
+		t.Errorf("reply of the other handler = %v, %v", reply, err)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:5353"), WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.Config()
+	if c.Listen != "127.0.0.1:5353" || c.Bidirectional {
+		t.Errorf("Config() = %s, bidirectional %v, want 127.0.0.1:5353 unidirectional", c.Listen, c.Bidirectional)
+	}
+	if err := s.Reload(WithListenAddr("127.0.0.1:5353"), WithSkipStartupTest(true), WithBidirectional(true)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Bidirectional {
+		t.Error("Snapshot of Config() should not follow reloads")
+	}
+	if !s.Config().Bidirectional {
+		t.Error("Config() should be that of the last reload")
+	}
+}
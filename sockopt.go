@@ -0,0 +1,102 @@
+package gochinadns
+
+import (
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// SocketOptions are options of sockets of queries to upstream resolvers, see WithUpstreamSocketOptions.
+type SocketOptions struct {
+	Mark   int    `json:"mark,omitempty"`   //SO_MARK of packets, for policy routing. 0 for none.
+	Device string `json:"device,omitempty"` //interface sockets are bound to by SO_BINDTODEVICE. Empty for none.
+	DSCP   int    `json:"dscp,omitempty"`   //DSCP of packets, for QoS rules, such as 46 for EF. 0 for the default.
+	Source string `json:"source,omitempty"` //local IP queries are sent from, on multi-homed hosts. Empty for any.
+}
+
+// isZero reports whether o sets no option.
+func (o SocketOptions) isZero() bool {
+	return o == SocketOptions{}
+}
+
+// controlled reports whether o sets options which are set by the control of sockets, rather than by the dialer.
+func (o SocketOptions) controlled() bool {
+	return o.Mark != 0 || o.Device != "" || o.DSCP != 0
+}
+
+func (o SocketOptions) check() error {
+	if o.isZero() {
+		return nil
+	}
+	if o.Source != "" {
+		if ip := net.ParseIP(o.Source); ip == nil || ip.IsUnspecified() {
+			return errors.Errorf("invalid source [%s]", o.Source)
+		}
+	}
+	if !o.controlled() {
+		return nil
+	}
+	if !supportsSocketOptions {
+		return errors.New("socket options of upstreams are not supported on this platform")
+	}
+	if o.Mark < 0 {
+		return errors.Errorf("invalid socket mark %d", o.Mark)
+	}
+	if o.DSCP < 0 || o.DSCP > 63 {
+		return errors.Errorf("invalid DSCP %d", o.DSCP)
+	}
+	if len(o.Device) >= 16 {
+		return errors.Errorf("invalid device [%s]", o.Device)
+	}
+	return nil
+}
+
+// socketControl sets options of sockets before they connect, see net.Dialer.Control.
+type socketControl func(network, address string, c syscall.RawConn) error
+
+// socketOptions returns the socket options of the group of server.
+func (s *Server) socketOptions(server Resolver) SocketOptions {
+	o := s.options()
+	if s.pathOf(server) == pathTrusted {
+		return o.TrustedSockets
+	}
+	return o.UntrustedSockets
+}
+
+// sourceAddr returns the local address of sockets of network to server, by the source of server, or else that of
+// its group. It returns nil for any address.
+func (s *Server) sourceAddr(network string, server Resolver) net.Addr {
+	ip := server.source
+	if ip == nil {
+		o := s.options()
+		if o.TrustedSockets.Source == "" && o.UntrustedSockets.Source == "" {
+			return nil
+		}
+		if ip = net.ParseIP(s.socketOptions(server).Source); ip == nil {
+			return nil
+		}
+	}
+	if strings.HasPrefix(network, "tcp") {
+		return &net.TCPAddr{IP: ip}
+	}
+	return &net.UDPAddr{IP: ip}
+}
+
+// upstreamClient returns cli for server by retry, which dials with the socket options of the group of server,
+// from the source address of server.
+func (s *Server) upstreamClient(retry retryPolicy, cli *dns.Client, server Resolver) *dns.Client {
+	cli = retry.client(cli, server)
+	var control socketControl
+	if o := s.options(); o.TrustedSockets.controlled() || o.UntrustedSockets.controlled() {
+		control = s.socketOptions(server).control()
+	}
+	local := s.sourceAddr(cli.Net, server)
+	if control == nil && local == nil {
+		return cli
+	}
+	return &dns.Client{Net: cli.Net, UDPSize: cli.UDPSize, Timeout: cli.Timeout,
+		Dialer: &net.Dialer{Timeout: cli.Timeout, Control: control, LocalAddr: local}}
+}
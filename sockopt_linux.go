@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package gochinadns
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// supportsSocketOptions is whether SocketOptions are supported on this platform.
+const supportsSocketOptions = true
+
+// control returns the control setting o on sockets, or nil if o sets nothing the control sets.
+func (o SocketOptions) control() socketControl {
+	if !o.controlled() {
+		return nil
+	}
+	return func(network, address string, rc syscall.RawConn) error {
+		var err error
+		if e := rc.Control(func(fd uintptr) {
+			if o.Mark > 0 {
+				if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, o.Mark); err != nil {
+					err = errors.Wrap(err, "fail to set socket mark")
+					return
+				}
+			}
+			if o.DSCP > 0 {
+				// the DSCP is the upper 6 bits of the TOS of IPv4, and of the traffic class of IPv6.
+				if strings.HasSuffix(network, "6") {
+					err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, o.DSCP<<2)
+				} else {
+					err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, o.DSCP<<2)
+				}
+				if err != nil {
+					err = errors.Wrap(err, "fail to set DSCP")
+					return
+				}
+			}
+			if o.Device != "" {
+				if err = unix.BindToDevice(int(fd), o.Device); err != nil {
+					err = errors.Wrapf(err, "fail to bind device [%s]", o.Device)
+				}
+			}
+		}); e != nil {
+			return e
+		}
+		return err
+	}
+}
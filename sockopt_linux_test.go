@@ -0,0 +1,76 @@
+//go:build linux
+// +build linux
+
+package gochinadns
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+func TestUpstreamSocketOptions(t *testing.T) {
+	addr := startTestUpstream(t, "1.2.3.4")
+	for _, tt := range []struct {
+		sockets SocketOptions
+		answer  bool
+	}{
+		{SocketOptions{Mark: 1, Device: "lo"}, true},
+		{SocketOptions{Device: "nonexistent0"}, false},
+	} {
+		for _, upstreamSockets := range []int{0, 2} {
+			s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+addr),
+				WithSkipStartupTest(true), WithTimeout(200*time.Millisecond), WithUpstreamSockets(upstreamSockets),
+				WithUpstreamSocketOptions(tt.sockets, SocketOptions{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			w := new(explainWriter)
+			s.Serve(w, req)
+			if answer := w.reply != nil && len(w.reply.Answer) == 1; answer != tt.answer {
+				t.Errorf("Reply with %+v and %d upstream sockets = %v, want an answer: %v", tt.sockets, upstreamSockets, w.reply, tt.answer)
+			}
+			s.upstreams.Close()
+		}
+	}
+	for _, sockets := range []SocketOptions{{Mark: -1}, {DSCP: 64}} {
+		if _, err := NewServer(WithUpstreamSocketOptions(sockets, SocketOptions{})); err == nil {
+			t.Errorf("Socket options %+v should fail", sockets)
+		}
+	}
+}
+
+func TestSocketDSCP(t *testing.T) {
+	for _, tt := range []struct {
+		network, address string
+		level, opt       int
+	}{
+		{"udp4", "127.0.0.1:53", unix.IPPROTO_IP, unix.IP_TOS},
+		{"udp6", "[::1]:53", unix.IPPROTO_IPV6, unix.IPV6_TCLASS},
+	} {
+		d := net.Dialer{Control: SocketOptions{DSCP: 46}.control()}
+		conn, err := d.Dial(tt.network, tt.address)
+		if err != nil {
+			t.Logf("Skip %s: %v", tt.network, err)
+			continue
+		}
+		rc, err := conn.(syscall.Conn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tos int
+		rc.Control(func(fd uintptr) {
+			tos, err = unix.GetsockoptInt(int(fd), tt.level, tt.opt)
+		})
+		conn.Close()
+		if err != nil || tos != 46<<2 {
+			t.Errorf("TOS of %s = %d, %v, want %d", tt.network, tos, err, 46<<2)
+		}
+	}
+}
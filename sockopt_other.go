@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package gochinadns
+
+// supportsSocketOptions is whether SocketOptions are supported on this platform.
+// Only Linux has SO_MARK and SO_BINDTODEVICE.
+const supportsSocketOptions = false
+
+func (o SocketOptions) control() socketControl {
+	return nil
+}
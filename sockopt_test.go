@@ -0,0 +1,44 @@
+package gochinadns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamSource(t *testing.T) {
+	addr := startTestUpstream(t, "1.2.3.4")
+	for _, tt := range []struct {
+		schema string
+		group  string
+		answer bool
+	}{
+		{"udp@" + addr, "127.0.0.1", true},
+		{"udp@" + addr + "?source=127.0.0.1", "", true},
+		// the source of the resolver overrides that of its group.
+		{"udp@" + addr + "?source=127.0.0.1", "192.0.2.1", true},
+		{"udp@" + addr + "?source=192.0.2.1", "127.0.0.1", false},
+	} {
+		for _, upstreamSockets := range []int{0, 2} {
+			s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers(tt.schema),
+				WithSkipStartupTest(true), WithTimeout(200*time.Millisecond), WithUpstreamSockets(upstreamSockets),
+				WithUpstreamSocketOptions(SocketOptions{Source: tt.group}, SocketOptions{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			w := new(explainWriter)
+			s.Serve(w, req)
+			if answer := w.reply != nil && len(w.reply.Answer) == 1; answer != tt.answer {
+				t.Errorf("Reply of %s from group source %q with %d upstream sockets = %v, want an answer: %v",
+					tt.schema, tt.group, upstreamSockets, w.reply, tt.answer)
+			}
+			s.upstreams.Close()
+		}
+	}
+	if _, err := NewServer(WithUpstreamSocketOptions(SocketOptions{Source: "vpn"}, SocketOptions{})); err == nil {
+		t.Error("An invalid source should fail")
+	}
+}
@@ -0,0 +1,210 @@
+package gochinadns
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const _loop = 2
+
+// StartupReport is the result of testing resolvers with test domains, when the server is created or resolvers change.
+type StartupReport struct {
+	Time      time.Time        `json:"time"`
+	QueryType string           `json:"query_type"`
+	Domains   []string         `json:"domains"`
+	Trusted   []ResolverReport `json:"trusted"`   //in refined order
+	Untrusted []ResolverReport `json:"untrusted"` //in refined order
+}
+
+// ResolverReport is the test result of a resolver. A test query passes if it's answered over any protocol
+// of the resolver, with one of the expected answers if any.
+type ResolverReport struct {
+	Addr      string           `json:"addr"`
+	Available bool             `json:"available"` //whether most test queries pass
+	RTT       string           `json:"rtt"`       //average RTT of passed queries
+	Errors    int              `json:"errors"`    //number of failed queries
+	Protocols []ProtocolReport `json:"protocols"`
+}
+
+// ProtocolReport is the test result of a resolver over a single protocol.
+type ProtocolReport struct {
+	Protocol   string `json:"protocol"`
+	Reachable  bool   `json:"reachable"` //whether any test query is answered
+	RTT        string `json:"rtt"`
+	Errors     int    `json:"errors"`     //number of queries not answered
+	Mismatches int    `json:"mismatches"` //number of answers other than the expected ones
+}
+
+type resolverTest struct {
+	server Resolver
+	errCnt int
+	rttAvg time.Duration
+	report ResolverReport
+}
+
+// StartupReport returns the result of the last test of resolvers, or nil if resolvers are not tested.
+func (s *Server) StartupReport() *StartupReport {
+	r, _ := s.startup.Load().(*StartupReport)
+	return r
+}
+
+// refineResolvers tests all resolvers in parallel, and sorts them by errors and then average RTT.
+func (s *Server) refineResolvers(o *serverOptions) {
+	if o.SkipStartupTest {
+		s.log.Info("Skip testing resolvers. Trusted resolvers: ", o.TrustedServers)
+		s.log.Info("Untrusted resolvers: ", o.UntrustedServers)
+		s.startup.Store((*StartupReport)(nil))
+		return
+	}
+
+	trusted := make([]resolverTest, len(o.TrustedServers))
+	untrusted := make([]resolverTest, len(o.UntrustedServers))
+	var wg sync.WaitGroup
+	test := func(tests []resolverTest, servers []Resolver) {
+		for i, server := range servers {
+			wg.Add(1)
+			go func(i int, server Resolver) {
+				defer wg.Done()
+				tests[i] = s.testResolver(o, server)
+			}(i, server)
+		}
+	}
+	test(trusted, o.TrustedServers)
+	test(untrusted, o.UntrustedServers)
+	wg.Wait()
+
+	tLen, uLen := sortResolverTests(trusted), sortResolverTests(untrusted)
+	report := &StartupReport{
+		Time:      time.Now(),
+		QueryType: dns.TypeToString[o.TestQType],
+		Domains:   o.TestDomains,
+	}
+	o.TrustedServers = make([]Resolver, len(trusted))
+	o.UntrustedServers = make([]Resolver, len(untrusted))
+	for i, t := range trusted {
+		o.TrustedServers[i] = t.server
+		report.Trusted = append(report.Trusted, t.report)
+	}
+	for i, t := range untrusted {
+		o.UntrustedServers[i] = t.server
+		report.Untrusted = append(report.Untrusted, t.report)
+	}
+	s.startup.Store(report)
+
+	s.log.Infof("%d of %d trusted and %d of %d untrusted resolvers are available.", tLen, len(trusted), uLen, len(untrusted))
+	if tLen == 0 {
+		s.log.Error("There seems to be no available trusted resolver. Server may not behave properly.")
+	}
+	if o.TrustedQuorum > 1 && tLen < o.TrustedQuorum {
+		s.log.Errorf("Only %d trusted resolvers seem to be available for a quorum of %d. Server may not behave properly.", tLen, o.TrustedQuorum)
+	}
+	if uLen == 0 && o.Bidirectional {
+		s.log.Error("There seems to be no untrusted resolver. Server may not behave properly in bidirectional mode.")
+	}
+
+	s.log.Info("Refined trusted resolvers: ", o.TrustedServers)
+	s.log.Info("Refined untrusted resolvers: ", o.UntrustedServers)
+	if o.QNAMEMinimize {
+		s.log.Info("QNAME minimization enabled. Untrusted queries are resolved iteratively from root servers.")
+	}
+}
+
+// testResolver queries test domains over every protocol of the server, one query at a time, and logs the result.
+func (s *Server) testResolver(o *serverOptions, server Resolver) resolverTest {
+	t := s.checkResolver(o, server)
+	var reachable []string
+	for _, p := range t.report.Protocols {
+		if p.Reachable {
+			reachable = append(reachable, p.Protocol)
+		}
+	}
+	s.log.Infof("%s: average RTT %s with %d errors. Reachable over %s.", server, t.rttAvg, t.errCnt, reachableString(reachable))
+	return t
+}
+
+// checkResolver queries test domains over every protocol of the server, one query at a time.
+func (s *Server) checkResolver(o *serverOptions, server Resolver) resolverTest {
+	protocols := server.GetProtocols()
+	t := resolverTest{server: server, report: ResolverReport{Addr: server.GetAddr()}}
+	rtts := make([]time.Duration, len(protocols))
+	t.report.Protocols = make([]ProtocolReport, len(protocols))
+	for i, protocol := range protocols {
+		t.report.Protocols[i].Protocol = protocol
+	}
+
+	req := new(dns.Msg)
+	for j := 0; j < _loop; j++ {
+		for _, name := range o.TestDomains {
+			name := dns.Fqdn(name)
+			req.SetQuestion(name, o.TestQType)
+			passed := false
+			for i, protocol := range protocols {
+				p := &t.report.Protocols[i]
+				single := server
+				single.protocols = []string{protocol}
+				reply, rtt, err := s.LookupMutated(s.ctx, req, single)
+				if err != nil {
+					p.Errors++
+					continue
+				}
+				p.Reachable = true
+				rtts[i] += rtt
+				if expect, ok := o.TestExpect[name]; ok && !overlapIPs(answerIPs(reply), expect) {
+					p.Mismatches++
+					continue
+				}
+				// the first passed protocol is the one queries go over.
+				if !passed {
+					passed = true
+					t.rttAvg += rtt
+				}
+			}
+			if !passed {
+				t.errCnt++
+			}
+		}
+	}
+
+	total := _loop * len(o.TestDomains)
+	if passed := total - t.errCnt; passed > 0 {
+		t.rttAvg /= time.Duration(passed)
+	}
+	for i := range protocols {
+		p := &t.report.Protocols[i]
+		if answered := total - p.Errors; answered > 0 {
+			rtts[i] /= time.Duration(answered)
+		}
+		p.RTT = rtts[i].String()
+	}
+	t.report.Available = t.errCnt <= total/2
+	t.report.RTT = t.rttAvg.String()
+	t.report.Errors = t.errCnt
+	return t
+}
+
+func reachableString(protocols []string) string {
+	if len(protocols) == 0 {
+		return "no protocol"
+	}
+	return fmt.Sprint(protocols)
+}
+
+// sortResolverTests sorts tests by errors and then average RTT, and returns the number of available resolvers.
+func sortResolverTests(tests []resolverTest) (available int) {
+	sort.SliceStable(tests, func(i, j int) bool {
+		if tests[i].errCnt == tests[j].errCnt {
+			return tests[i].rttAvg < tests[j].rttAvg
+		}
+		return tests[i].errCnt < tests[j].errCnt
+	})
+	for _, t := range tests {
+		if t.report.Available {
+			available++
+		}
+	}
+	return
+}
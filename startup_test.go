@@ -0,0 +1,83 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTestUpstream serves A queries over UDP with answer ip, and returns its address.
+func startTestUpstream(t testing.TB, ip string) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + ip)
+		reply.Answer = append(reply.Answer, rr)
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestStartupReport(t *testing.T) {
+	addr := startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(
+		WithListenAddr("127.0.0.1:0"),
+		WithTimeout(200*time.Millisecond),
+		WithTrustedResolvers("udp+tcp@"+addr),
+		WithTestDomains("example.com", "example.org"),
+		WithTestExpect("example.org", "5.6.7.8"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := s.StartupReport()
+	if r == nil || len(r.Trusted) != 1 {
+		t.Fatalf("StartupReport() = %+v, want a trusted resolver", r)
+	}
+	if r.QueryType != "A" {
+		t.Errorf("QueryType = %s, want A", r.QueryType)
+	}
+	got := r.Trusted[0]
+	if got.Addr != addr || got.Errors != 2 || !got.Available {
+		t.Errorf("resolver report = %+v, want 2 errors of mismatched example.org and available", got)
+	}
+	if len(got.Protocols) != 2 {
+		t.Fatalf("protocols = %+v, want udp and tcp", got.Protocols)
+	}
+	udp, tcp := got.Protocols[0], got.Protocols[1]
+	if udp.Protocol != "udp" || !udp.Reachable || udp.Errors != 0 || udp.Mismatches != 2 {
+		t.Errorf("udp report = %+v, want reachable with 2 mismatches", udp)
+	}
+	if tcp.Protocol != "tcp" || tcp.Reachable || tcp.Errors != 4 {
+		t.Errorf("tcp report = %+v, want unreachable", tcp)
+	}
+
+	s, err = NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers(addr), WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := s.StartupReport(); r != nil {
+		t.Errorf("StartupReport() = %+v with the test skipped, want nil", r)
+	}
+}
+
+func TestWithTestQueryType(t *testing.T) {
+	o, err := buildOptions([]ServerOption{WithTestQueryType("aaaa")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.TestQType != dns.TypeAAAA {
+		t.Errorf("TestQType = %d, want AAAA", o.TestQType)
+	}
+	if _, err := buildOptions([]ServerOption{WithTestQueryType("nope")}); err == nil {
+		t.Error("Unknown query type should fail")
+	}
+}
@@ -0,0 +1,134 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// savedState is the state persisted across restarts by WithStateFile.
+type savedState struct {
+	Cache    []savedReply     `json:"cache,omitempty"` //replies of the default cache, the least recently used first
+	Polluted []PollutedDomain `json:"polluted,omitempty"`
+}
+
+type savedReply struct {
+	Key    []byte    `json:"key"`
+	Wire   []byte    `json:"wire"`
+	Stored time.Time `json:"stored"`
+	Expire time.Time `json:"expire"`
+	Origin string    `json:"origin"`
+	Server string    `json:"server"`
+}
+
+// WithStateFile persists replies of the default cache and polluted domains learned at runtime to the file at path
+// when the server shuts down, and restores them when it's created, so that a restart doesn't start cold.
+// Replies expired by then are dropped. Replies of other cache backends are not persisted. Empty to disable.
+func WithStateFile(path string) ServerOption {
+	return func(o *serverOptions) error {
+		o.StateFile = path
+		return nil
+	}
+}
+
+// saveState writes the state to the state file, if any.
+func (s *Server) saveState() error {
+	path := s.options().StateFile
+	if path == "" {
+		return nil
+	}
+	st := savedState{Polluted: s.stats.pollution.snapshot(0).Domains}
+	if s.cache != nil && s.cache.memory != nil {
+		st.Cache = s.cache.memory.saved(time.Now())
+	}
+	b, err := json.Marshal(&st)
+	if err != nil {
+		return errors.Wrap(err, "fail to encode state")
+	}
+	if err := writeFileAtomic(path, b); err != nil {
+		return errors.Wrap(err, "fail to save state")
+	}
+	s.log.Infof("State saved with %d cached replies and %d polluted domains.", len(st.Cache), len(st.Polluted))
+	return nil
+}
+
+// loadState restores the state of the state file, if it exists.
+func (s *Server) loadState() error {
+	path := s.options().StateFile
+	if path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "fail to read state")
+	}
+	var st savedState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return errors.Wrapf(err, "invalid state file [%s]", path)
+	}
+	s.stats.pollution.restore(st.Polluted)
+	restored := 0
+	if s.cache != nil && s.cache.memory != nil {
+		restored = s.cache.memory.restore(st.Cache, time.Now())
+	}
+	s.log.Infof("State restored with %d cached replies and %d polluted domains.", restored, len(st.Polluted))
+	return nil
+}
+
+// saved returns replies which don't expire at now, the least recently used first.
+func (m *memoryCache) saved(now time.Time) []savedReply {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	replies := make([]savedReply, 0, m.lru.Len())
+	for el := m.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*memoryEntry)
+		if !now.Before(e.reply.Expire) {
+			continue
+		}
+		replies = append(replies, savedReply{Key: []byte(e.key), Wire: e.reply.Wire, Stored: e.reply.Stored,
+			Expire: e.reply.Expire, Origin: e.reply.Origin, Server: e.reply.Server})
+	}
+	return replies
+}
+
+// restore caches replies which don't expire at now, and returns the number of them.
+func (m *memoryCache) restore(replies []savedReply, now time.Time) int {
+	n := 0
+	for _, r := range replies {
+		if !now.Before(r.Expire) || now.Before(r.Stored) {
+			continue
+		}
+		ttls, _, ok := recordTTLs(r.Wire)
+		msg := new(dns.Msg)
+		if !ok || msg.Unpack(r.Wire) != nil {
+			continue
+		}
+		m.Set(string(r.Key), &CachedReply{Wire: r.Wire, Stored: r.Stored, Expire: r.Expire, Origin: r.Origin,
+			Server: r.Server, ttls: ttls, msg: msg})
+		n++
+	}
+	return n
+}
+
+// restore adds domains which are not observed yet, until there are _topCapacity of them.
+func (p *pollutionStats) restore(domains []PollutedDomain) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range domains {
+		d := domains[i]
+		if _, ok := p.domains[d.Domain]; ok || len(p.domains) >= _topCapacity || d.Domain == "" {
+			continue
+		}
+		if d.Heuristics == nil {
+			d.Heuristics = make(map[string]uint64)
+		}
+		p.domains[d.Domain] = &d
+	}
+}
@@ -0,0 +1,77 @@
+package gochinadns
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	newServer := func() *Server {
+		s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithCache(10), WithStateFile(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := newServer()
+	reply := newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.2.3.4")
+	key, _ := s.cache.keyOf(reply)
+	s.cache.Store(key, reply, nil, OriginTrusted, "8.8.8.8:53")
+	expired := newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.2.3.4")
+	expired.Question[0].Name = "expired.example."
+	expiredKey, _ := s.cache.keyOf(expired)
+	s.cache.Store(expiredKey, expired, nil, OriginTrusted, "8.8.8.8:53")
+	s.cache.memory.get([]byte(expiredKey), time.Now()).Expire = time.Now()
+	s.stats.pollution.observe("polluted.example.", heuristicIPBlacklist, time.Now())
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newServer()
+	if n := s.cache.Len(); n != 1 {
+		t.Errorf("%d replies restored, want 1", n)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("Example.com.", dns.TypeA)
+	buf := make([]byte, dns.MaxMsgSize)
+	if packet, msg := s.cache.Answer(req, buf, len(buf), time.Now()); packet == nil || len(answerIPs(msg)) != 1 {
+		t.Error("Restored reply should be answered")
+	}
+	if learned := s.LearnedPolluted(); len(learned) != 1 || learned[0] != "polluted.example" {
+		t.Errorf("Polluted domains restored = %v, want polluted.example", learned)
+	}
+
+	// a mounted server saves the state once its background work is done.
+	s.stats.pollution.observe("mounted.example.", heuristicIPBlacklist, time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.RunBackground(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if learned := newServer().LearnedPolluted(); len(learned) != 2 {
+		t.Errorf("Polluted domains restored after RunBackground = %v, want 2 domains", learned)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s := newServer(); s.cache.Len() != 0 {
+		t.Error("Invalid state file should be skipped")
+	}
+}
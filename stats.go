@@ -0,0 +1,479 @@
+package gochinadns
+
+import (
+	"context"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// _rateWindow is the number of seconds over which the query rate is averaged.
+const _rateWindow = 60
+
+// _topCapacity is the max number of keys tracked per bucket of top counters.
+const _topCapacity = 1000
+
+// Sliding window of top counters.
+const (
+	_topWindow  = time.Hour
+	_topBuckets = 6
+)
+
+// Stats is a snapshot of runtime statistics of a server.
+type Stats struct {
+	Uptime      float64          `json:"uptime_seconds"`
+	Queries     uint64           `json:"queries"`
+	QPS         float64          `json:"qps"` //average over the last minute
+	Pollution   uint64           `json:"pollution"`
+	InFlight    int              `json:"in_flight,omitempty"` //resolutions in flight, with WithMaxConcurrency
+	Queued      int              `json:"queued,omitempty"`    //resolutions waiting for a slot, with WithMaxConcurrency
+	Overloaded  uint64           `json:"overloaded"`          //queries over the concurrency limit
+	CacheHits   uint64           `json:"cache_hits"`          //queries answered from the cache
+	RateLimited uint64           `json:"rate_limited"`        //queries of clients over their rate limit
+	RRLLimited  uint64           `json:"rrl_limited"`         //responses dropped or truncated by the response rate limit
+	Denied      uint64           `json:"denied"`              //queries of clients denied by the client ACL
+	Upstreams   []UpstreamStatus `json:"upstreams"`
+	TopDomains  []TopEntry       `json:"top_domains"` //most queried domains in the last hour
+}
+
+// TopStats is a snapshot of the most frequent domains and clients in the last hour.
+type TopStats struct {
+	Domains []TopEntry `json:"domains"` //most queried domains
+	Blocked []TopEntry `json:"blocked"` //most blocked domains
+	Clients []TopEntry `json:"clients"` //busiest clients
+}
+
+// UpstreamStatus describes the state of an upstream resolver.
+type UpstreamStatus struct {
+	Addr     string   `json:"addr"`
+	Trusted  bool     `json:"trusted"`
+	Enabled  bool     `json:"enabled"`
+	Hijacked string   `json:"hijacked,omitempty"` //why the canary check considers it hijacked
+	Tripped  bool     `json:"tripped,omitempty"`  //whether the circuit breaker stops queries to it
+	Down     []string `json:"down,omitempty"`     //protocols health checks find it down over
+
+	// Health of the latest lookups.
+	Samples     int     `json:"samples"`
+	SuccessRate float64 `json:"success_rate"`
+	TimeoutRate float64 `json:"timeout_rate"`
+	LatencyP50  float64 `json:"latency_p50_ms"`
+	LatencyP90  float64 `json:"latency_p90_ms"`
+	LatencyP99  float64 `json:"latency_p99_ms"`
+	LatencyAvg  float64 `json:"latency_avg_ms"` //moving average of successful lookups, see WithFastestFirst
+}
+
+// TopEntry is the number of queries of a domain or from a client.
+type TopEntry struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// stats collects runtime statistics.
+type stats struct {
+	start   time.Time
+	queries *shardedCounter
+	rate    *rateCounter
+
+	overloaded  *shardedCounter
+	cacheHits   *shardedCounter
+	rateLimited *shardedCounter
+	rrlLimited  *shardedCounter
+	denied      *shardedCounter
+	domains     *slidingTop
+	blocked     *slidingTop
+	clients     *slidingTop
+
+	pollution *pollutionStats
+
+	upstreamsMu sync.Mutex
+	upstreams   map[string]*upstreamHealth //resolver address -> health
+}
+
+func newStats() *stats {
+	return &stats{
+		start:       time.Now(),
+		queries:     newShardedCounter(),
+		rate:        newRateCounter(),
+		overloaded:  newShardedCounter(),
+		cacheHits:   newShardedCounter(),
+		rateLimited: newShardedCounter(),
+		rrlLimited:  newShardedCounter(),
+		denied:      newShardedCounter(),
+		domains:     newSlidingTop(_topWindow, _topBuckets),
+		blocked:     newSlidingTop(_topWindow, _topBuckets),
+		clients:     newSlidingTop(_topWindow, _topBuckets),
+		pollution:   newPollutionStats(),
+		upstreams:   make(map[string]*upstreamHealth),
+	}
+}
+
+func (st *stats) observeQuery(name, client string, blocked bool) {
+	st.queries.Add(1)
+	st.rate.Inc()
+	st.domains.Inc(name)
+	st.clients.Inc(client)
+	if blocked {
+		st.blocked.Inc(name)
+	}
+}
+
+// rateCounter counts events in a sharded counter, and samples its total at the first event of each second
+// in a ring of the last _rateWindow seconds, so that only the first event of a second takes the lock.
+type rateCounter struct {
+	total  *shardedCounter
+	second int64 //the second of the latest sample, accessed atomically
+
+	mu      sync.Mutex
+	totals  [_rateWindow]uint64 //total before the events of the second
+	seconds [_rateWindow]int64  //the second totals[i] belongs to
+}
+
+func newRateCounter() *rateCounter {
+	return &rateCounter{total: newShardedCounter()}
+}
+
+func (r *rateCounter) Inc() {
+	sec := time.Now().Unix()
+	if atomic.LoadInt64(&r.second) != sec {
+		r.mu.Lock()
+		if r.second != sec {
+			i := sec % _rateWindow
+			r.seconds[i], r.totals[i] = sec, r.total.Load()
+			atomic.StoreInt64(&r.second, sec)
+		}
+		r.mu.Unlock()
+	}
+	r.total.Add(1)
+}
+
+// Rate returns the average events per second over the last _rateWindow seconds.
+func (r *rateCounter) Rate() float64 {
+	now := time.Now().Unix()
+	r.mu.Lock()
+	oldest, base := now, uint64(0)
+	found := false
+	for i, sec := range r.seconds {
+		if now-sec < _rateWindow && sec <= oldest {
+			oldest, base, found = sec, r.totals[i], true
+		}
+	}
+	r.mu.Unlock()
+	if !found {
+		return 0
+	}
+	return float64(r.total.Load()-base) / _rateWindow
+}
+
+// topCounter counts the most frequent keys approximately with bounded memory.
+// When it's full, the least frequent key is evicted and its count is inherited by the new key (Space-Saving).
+type topCounter struct {
+	capacity int
+
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newTopCounter(capacity int) *topCounter {
+	return &topCounter{capacity: capacity, counts: make(map[string]uint64)}
+}
+
+func (t *topCounter) Inc(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.counts[key]; !ok && len(t.counts) >= t.capacity {
+		var (
+			minKey   string
+			minCount uint64
+		)
+		for k, c := range t.counts {
+			if minKey == "" || c < minCount {
+				minKey, minCount = k, c
+			}
+		}
+		delete(t.counts, minKey)
+		t.counts[key] = minCount
+	}
+	t.counts[key]++
+}
+
+// Top returns the n most frequent keys in descending order of counts.
+func (t *topCounter) Top(n int) []TopEntry {
+	counts := make(map[string]uint64)
+	t.addTo(counts)
+	return topEntries(counts, n)
+}
+
+func (t *topCounter) addTo(counts map[string]uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, c := range t.counts {
+		counts[k] += c
+	}
+}
+
+func topEntries(counts map[string]uint64, n int) []TopEntry {
+	top := make([]TopEntry, 0, len(counts))
+	for k, c := range counts {
+		top = append(top, TopEntry{Name: k, Count: c})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count == top[j].Count {
+			return top[i].Name < top[j].Name
+		}
+		return top[i].Count > top[j].Count
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// slidingTop counts the most frequent keys in a sliding window, which is made of buckets of top counters.
+// The oldest bucket is dropped every window/buckets.
+type slidingTop struct {
+	bucket time.Duration
+
+	mu      sync.Mutex
+	buckets []*topCounter
+	current int
+	rotated time.Time //when the current bucket starts
+}
+
+func newSlidingTop(window time.Duration, buckets int) *slidingTop {
+	t := &slidingTop{bucket: window / time.Duration(buckets), buckets: make([]*topCounter, buckets), rotated: time.Now()}
+	for i := range t.buckets {
+		t.buckets[i] = newTopCounter(_topCapacity)
+	}
+	return t
+}
+
+// advance drops expired buckets. t.mu must be held.
+func (t *slidingTop) advance(now time.Time) {
+	for i := 0; now.Sub(t.rotated) >= t.bucket; i++ {
+		if i == len(t.buckets) {
+			// all buckets expired.
+			t.rotated = now
+			break
+		}
+		t.current = (t.current + 1) % len(t.buckets)
+		t.buckets[t.current] = newTopCounter(_topCapacity)
+		t.rotated = t.rotated.Add(t.bucket)
+	}
+}
+
+func (t *slidingTop) Inc(key string) {
+	t.mu.Lock()
+	t.advance(time.Now())
+	c := t.buckets[t.current]
+	t.mu.Unlock()
+	c.Inc(key)
+}
+
+// Top returns the n most frequent keys in the window in descending order of counts.
+func (t *slidingTop) Top(n int) []TopEntry {
+	t.mu.Lock()
+	t.advance(time.Now())
+	buckets := append([]*topCounter(nil), t.buckets...)
+	t.mu.Unlock()
+
+	counts := make(map[string]uint64)
+	for _, c := range buckets {
+		c.addTo(counts)
+	}
+	return topEntries(counts, n)
+}
+
+// Stats returns a snapshot of runtime statistics.
+func (s *Server) Stats() *Stats {
+	o := s.options()
+	st := &Stats{
+		Uptime:      time.Since(s.stats.start).Seconds(),
+		Queries:     s.stats.queries.Load(),
+		QPS:         s.stats.rate.Rate(),
+		Pollution:   s.PollutionCount(),
+		TopDomains:  s.stats.domains.Top(10),
+		Overloaded:  s.stats.overloaded.Load(),
+		CacheHits:   s.stats.cacheHits.Load(),
+		RateLimited: s.stats.rateLimited.Load(),
+		RRLLimited:  s.stats.rrlLimited.Load(),
+		Denied:      s.stats.denied.Load(),
+	}
+	st.InFlight, st.Queued = s.limiter.inFlight()
+	for _, servers := range []resolverArray{o.TrustedServers, o.UntrustedServers} {
+		for _, server := range servers {
+			status := UpstreamStatus{
+				Addr:     server.GetAddr(),
+				Trusted:  s.pathOf(server) == pathTrusted,
+				Enabled:  !s.isDisabled(server.GetAddr()),
+				Hijacked: s.canary.reason(server.GetAddr()),
+				Tripped:  s.breaker.isOpen(server.GetAddr()),
+				Down:     s.health.downProtocols(server.GetAddr()),
+			}
+			s.stats.upstream(server.GetAddr()).fill(&status)
+			st.Upstreams = append(st.Upstreams, status)
+		}
+	}
+	return st
+}
+
+// TopStats returns the n most queried domains, most blocked domains and busiest clients in the last hour.
+func (s *Server) TopStats(n int) *TopStats {
+	return &TopStats{
+		Domains: s.stats.domains.Top(n),
+		Blocked: s.stats.blocked.Top(n),
+		Clients: s.stats.clients.Top(n),
+	}
+}
+
+// _upstreamSamples is the number of the latest lookups kept per resolver for health statistics.
+const _upstreamSamples = 256
+
+// upstreamSample is the result of an upstream lookup.
+type upstreamSample struct {
+	rtt     time.Duration
+	err     bool
+	timeout bool
+}
+
+// _rttWeight is the weight of a new RTT in the moving average, the same as the smoothed RTT of TCP.
+const _rttWeight = 0.125
+
+// upstreamHealth keeps the latest lookups of a resolver in a ring.
+type upstreamHealth struct {
+	mu      sync.Mutex
+	samples [_upstreamSamples]upstreamSample
+	next    int
+	full    bool
+	rtt     time.Duration //exponentially weighted moving average of RTTs of successful lookups
+}
+
+func (h *upstreamHealth) add(sample upstreamSample) {
+	h.mu.Lock()
+	h.samples[h.next] = sample
+	if h.next++; h.next == len(h.samples) {
+		h.next, h.full = 0, true
+	}
+	if !sample.err {
+		if h.rtt == 0 {
+			h.rtt = sample.rtt
+		} else {
+			h.rtt += time.Duration(_rttWeight * float64(sample.rtt-h.rtt))
+		}
+	}
+	h.mu.Unlock()
+}
+
+// averageRTT returns the moving average of RTTs, and whether the resolver is untried or its latest lookup succeeded.
+func (h *upstreamHealth) averageRTT() (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.next == 0 && !h.full {
+		return 0, true
+	}
+	latest := (h.next - 1 + len(h.samples)) % len(h.samples)
+	return h.rtt, !h.samples[latest].err
+}
+
+// healthy reports whether the latest lookup succeeded.
+func (h *upstreamHealth) healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.next == 0 && !h.full {
+		return false
+	}
+	latest := (h.next - 1 + len(h.samples)) % len(h.samples)
+	return !h.samples[latest].err
+}
+
+// fill sets health fields of st by the latest lookups.
+func (h *upstreamHealth) fill(st *UpstreamStatus) {
+	h.mu.Lock()
+	n := h.next
+	if h.full {
+		n = len(h.samples)
+	}
+	samples := make([]upstreamSample, n)
+	copy(samples, h.samples[:n])
+	st.LatencyAvg = h.rtt.Seconds() * 1000
+	h.mu.Unlock()
+
+	st.Samples = n
+	if n == 0 {
+		return
+	}
+	var (
+		errs, timeouts int
+		rtts           = make([]time.Duration, 0, n)
+	)
+	for _, sample := range samples {
+		switch {
+		case sample.timeout:
+			timeouts++
+			errs++
+		case sample.err:
+			errs++
+		default:
+			rtts = append(rtts, sample.rtt)
+		}
+	}
+	st.SuccessRate = float64(n-errs) / float64(n)
+	st.TimeoutRate = float64(timeouts) / float64(n)
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	st.LatencyP50 = percentileMillis(rtts, 0.5)
+	st.LatencyP90 = percentileMillis(rtts, 0.9)
+	st.LatencyP99 = percentileMillis(rtts, 0.99)
+}
+
+// percentileMillis returns the p-th percentile of sorted durations in milliseconds, by the nearest rank.
+func percentileMillis(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Seconds() * 1000
+}
+
+func (st *stats) upstream(addr string) *upstreamHealth {
+	st.upstreamsMu.Lock()
+	defer st.upstreamsMu.Unlock()
+	h := st.upstreams[addr]
+	if h == nil {
+		h = new(upstreamHealth)
+		st.upstreams[addr] = h
+	}
+	return h
+}
+
+func (st *stats) observeUpstream(server Resolver, rtt time.Duration, err error) {
+	st.upstream(server.GetAddr()).add(upstreamSample{rtt: rtt, err: err != nil, timeout: isTimeout(err)})
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := errors.Cause(err).(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (s *Server) runUpstreamSummary(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, st := range s.Stats().Upstreams {
+			s.log.WithField("server", st.Addr).Infof(
+				"Upstream summary: %d lookups, %.1f%% success, %.1f%% timeout, latency p50 %.1fms p90 %.1fms p99 %.1fms.",
+				st.Samples, st.SuccessRate*100, st.TimeoutRate*100, st.LatencyP50, st.LatencyP90, st.LatencyP99)
+		}
+	}
+}
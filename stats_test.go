@@ -0,0 +1,136 @@
+package gochinadns
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTopCounter(t *testing.T) {
+	c := newTopCounter(2)
+	for i := 0; i < 3; i++ {
+		c.Inc("a.com.")
+	}
+	c.Inc("b.com.")
+	// evicts b.com. and inherits its count.
+	c.Inc("c.com.")
+
+	want := []TopEntry{{"a.com.", 3}, {"c.com.", 2}}
+	if got := c.Top(5); !reflect.DeepEqual(got, want) {
+		t.Errorf("Top(5) = %v, want %v", got, want)
+	}
+	if got := c.Top(1); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("Top(1) = %v, want %v", got, want[:1])
+	}
+}
+
+func TestSlidingTop(t *testing.T) {
+	c := newSlidingTop(time.Hour, 2)
+	c.Inc("a.com.")
+	c.Inc("a.com.")
+	// pretend the first bucket is 40 minutes old.
+	c.rotated = c.rotated.Add(-40 * time.Minute)
+	c.Inc("b.com.")
+
+	want := []TopEntry{{"a.com.", 2}, {"b.com.", 1}}
+	if got := c.Top(5); !reflect.DeepEqual(got, want) {
+		t.Errorf("Top(5) = %v, want %v", got, want)
+	}
+
+	// the first bucket expires.
+	c.rotated = c.rotated.Add(-30 * time.Minute)
+	want = []TopEntry{{"b.com.", 1}}
+	if got := c.Top(5); !reflect.DeepEqual(got, want) {
+		t.Errorf("Top(5) = %v, want %v", got, want)
+	}
+}
+
+func TestRateCounter(t *testing.T) {
+	r := newRateCounter()
+	for i := 0; i < _rateWindow; i++ {
+		r.Inc()
+	}
+	if rate := r.Rate(); rate != 1 {
+		t.Errorf("Rate() = %v, want 1", rate)
+	}
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	h := new(upstreamHealth)
+	for i := 1; i <= 8; i++ {
+		h.add(upstreamSample{rtt: time.Duration(i) * time.Millisecond})
+	}
+	h.add(upstreamSample{err: true})
+	h.add(upstreamSample{err: true, timeout: true})
+
+	var st UpstreamStatus
+	h.fill(&st)
+	if st.Samples != 10 || st.SuccessRate != 0.8 || st.TimeoutRate != 0.1 {
+		t.Errorf("unexpected rates: %+v", st)
+	}
+	if st.LatencyP50 != 4 || st.LatencyP90 != 8 || st.LatencyP99 != 8 {
+		t.Errorf("unexpected percentiles: %+v", st)
+	}
+}
+
+func TestUpstreamHealthy(t *testing.T) {
+	h := new(upstreamHealth)
+	if h.healthy() {
+		t.Error("No lookups should not be healthy")
+	}
+	h.add(upstreamSample{err: true})
+	h.add(upstreamSample{rtt: time.Millisecond})
+	if !h.healthy() {
+		t.Error("Latest lookup succeeded and should be healthy")
+	}
+	for i := 0; i < _upstreamSamples; i++ {
+		h.add(upstreamSample{err: true})
+	}
+	if h.healthy() {
+		t.Error("Latest lookup failed and should not be healthy")
+	}
+}
+
+func TestUpstreamAverageRTT(t *testing.T) {
+	h := new(upstreamHealth)
+	if rtt, ok := h.averageRTT(); rtt != 0 || !ok {
+		t.Errorf("untried resolver averages %s and %t, want 0 and true", rtt, ok)
+	}
+	h.add(upstreamSample{rtt: 80 * time.Millisecond})
+	h.add(upstreamSample{rtt: 160 * time.Millisecond})
+	if rtt, ok := h.averageRTT(); rtt != 90*time.Millisecond || !ok {
+		t.Errorf("resolver averages %s and %t, want 90ms and true", rtt, ok)
+	}
+	h.add(upstreamSample{rtt: time.Second, err: true, timeout: true})
+	if rtt, ok := h.averageRTT(); rtt != 90*time.Millisecond || ok {
+		t.Errorf("failing resolver averages %s and %t, want 90ms and false", rtt, ok)
+	}
+}
+
+func TestPollutionStats(t *testing.T) {
+	p := newPollutionStats()
+	now := time.Now()
+	p.observe("google.com.", heuristicIPBlacklist, now)
+	p.observe("google.com.", heuristicOverseasMismatch, now)
+	p.observe("twitter.com.", heuristicIPBlacklist, now)
+
+	st := p.snapshot(1)
+	if st.Total != 3 || st.Heuristics[heuristicIPBlacklist] != 2 || st.Heuristics[heuristicOverseasMismatch] != 1 {
+		t.Errorf("Unexpected totals %d %v", st.Total, st.Heuristics)
+	}
+	if len(st.Domains) != 1 {
+		t.Fatalf("snapshot(1) returns %d domains", len(st.Domains))
+	}
+	want := PollutedDomain{
+		Domain:     "google.com.",
+		Count:      2,
+		Heuristics: map[string]uint64{heuristicIPBlacklist: 1, heuristicOverseasMismatch: 1},
+		LastSeen:   now,
+	}
+	if !reflect.DeepEqual(st.Domains[0], want) {
+		t.Errorf("snapshot(1) = %v, want %v", st.Domains[0], want)
+	}
+	if n := len(p.snapshot(0).Domains); n != 2 {
+		t.Errorf("snapshot(0) returns %d domains, want 2", n)
+	}
+}
@@ -0,0 +1,128 @@
+package gochinadns
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsD: https://github.com/statsd/statsd/blob/master/docs/metric_types.md
+// DogStatsD: https://docs.datadoghq.com/developers/dogstatsd/datagram_shell
+
+const (
+	_statsdQueue  = 4096        //max number of pending metrics. Metrics are dropped when the queue is full.
+	_statsdPacket = 1432        //max size of a UDP packet, to fit in an ethernet MTU
+	_statsdFlush  = time.Second //interval to send pending metrics
+	_statsdPrefix = "chinadns."
+)
+
+// statsdClient pushes metrics to a StatsD server over UDP. All methods are no-op on a nil *statsdClient.
+type statsdClient struct {
+	log   Logger
+	addr  string
+	dog   bool //send tags in DogStatsD format, or append tag values to metric names
+	queue chan string
+}
+
+func newStatsdClient(addr string, dog bool, log Logger) *statsdClient {
+	c := &statsdClient{log: log, addr: addr, dog: dog, queue: make(chan string, _statsdQueue)}
+	go c.run()
+	return c
+}
+
+// count sends a counter with tags in pairs of name and value.
+func (c *statsdClient) count(name string, n uint64, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, strconv.FormatUint(n, 10)+"|c", tags)
+}
+
+// timing sends a timer in milliseconds with tags in pairs of name and value.
+func (c *statsdClient) timing(name string, d time.Duration, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, strconv.FormatFloat(d.Seconds()*1000, 'f', -1, 64)+"|ms", tags)
+}
+
+// gauge sends a gauge with tags in pairs of name and value.
+func (c *statsdClient) gauge(name string, v float64, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, strconv.FormatFloat(v, 'f', -1, 64)+"|g", tags)
+}
+
+func (c *statsdClient) send(name, value string, tags []string) {
+	sb := new(strings.Builder)
+	sb.WriteString(_statsdPrefix)
+	sb.WriteString(name)
+	if !c.dog {
+		for i := 1; i < len(tags); i += 2 {
+			sb.WriteByte('.')
+			sb.WriteString(statsdEscaper.Replace(tags[i]))
+		}
+	}
+	sb.WriteByte(':')
+	sb.WriteString(value)
+	if c.dog && len(tags) > 1 {
+		sb.WriteString("|#")
+		for i := 1; i < len(tags); i += 2 {
+			if i > 1 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(tags[i-1])
+			sb.WriteByte(':')
+			sb.WriteString(dogTagEscaper.Replace(tags[i]))
+		}
+	}
+	select {
+	case c.queue <- sb.String():
+	default:
+	}
+}
+
+// statsdEscaper makes tag values safe in metric names.
+var statsdEscaper = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", " ", "_", "\n", "_")
+
+// dogTagEscaper makes tag values safe in DogStatsD tags.
+var dogTagEscaper = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+
+func (c *statsdClient) run() {
+	conn, err := net.Dial("udp", c.addr)
+	if err != nil {
+		c.log.WithError(err).WithField("statsd", c.addr).Error("Fail to connect to statsd. Stop pushing metrics.")
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(_statsdFlush)
+	defer ticker.Stop()
+	buf := new(bytes.Buffer)
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			c.log.WithError(err).WithField("statsd", c.addr).Debug("Fail to push metrics.")
+		}
+		buf.Reset()
+	}
+	for {
+		select {
+		case line := <-c.queue:
+			if buf.Len() > 0 && buf.Len()+1+len(line) > _statsdPacket {
+				flush()
+			}
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(line)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package gochinadns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsdFormat(t *testing.T) {
+	c := &statsdClient{queue: make(chan string, 4)}
+	c.count("queries", 1, "qtype", "A", "rcode", "NOERROR")
+	c.timing("upstream.duration", 1500*time.Microsecond, "resolver", "8.8.8.8:53")
+	c.dog = true
+	c.count("queries", 2, "qtype", "A", "rcode", "NOERROR")
+	c.count("pollution.rejections", 1)
+
+	want := []string{
+		"chinadns.queries.A.NOERROR:1|c",
+		"chinadns.upstream.duration.8_8_8_8_53:1.5|ms",
+		"chinadns.queries:2|c|#qtype:A,rcode:NOERROR",
+		"chinadns.pollution.rejections:1|c",
+	}
+	for _, w := range want {
+		if got := <-c.queue; got != w {
+			t.Errorf("got %q, want %q", got, w)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package gochinadns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	_peerInterval    = time.Minute      //how often state is synced with peers by default
+	_peerTimeout     = 10 * time.Second //bounds an exchange of state with a peer
+	_peerPollutedTTL = time.Hour        //how long a polluted domain learned from peers is kept once it's synced
+	_maxPeerPolluted = 10000            //max number of polluted domains learned from peers
+	_maxSyncState    = 4 << 20          //max size of a state exchanged with a peer, in bytes
+)
+
+// SyncState is the state an instance learns at runtime, which it shares with peers, see WithPeers.
+type SyncState struct {
+	Polluted []string            `json:"polluted"`          //domains with polluted answers, without the trailing dot
+	Relayed  map[string]int      `json:"relayed,omitempty"` //domains learned from peers, by seconds until they expire
+	Down     map[string][]string `json:"down,omitempty"`    //protocols resolvers are down over, by address of resolvers
+}
+
+// peerState keeps the polluted domains learned from peers until they expire.
+type peerState struct {
+	mu       sync.Mutex
+	polluted map[string]time.Time //by domain, when it expires
+}
+
+func newPeerState() *peerState {
+	return &peerState{polluted: make(map[string]time.Time)}
+}
+
+// addPolluted adds domain until expire, or extends it, until there are _maxPeerPolluted domains which don't expire at now.
+func (p *peerState) addPolluted(domain string, expire, now time.Time) {
+	if domain = strings.TrimSuffix(strings.ToLower(domain), "."); domain == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old, ok := p.polluted[domain]; ok {
+		if expire.After(old) {
+			p.polluted[domain] = expire
+		}
+		return
+	}
+	if len(p.polluted) >= _maxPeerPolluted {
+		p.prune(now)
+		if len(p.polluted) >= _maxPeerPolluted {
+			return
+		}
+	}
+	p.polluted[domain] = expire
+}
+
+// prune removes domains which expire at now. p.mu must be held.
+func (p *peerState) prune(now time.Time) {
+	for domain, expire := range p.polluted {
+		if !now.Before(expire) {
+			delete(p.polluted, domain)
+		}
+	}
+}
+
+// pollutedDomains returns the polluted domains learned from peers which don't expire at now, in no order.
+func (p *peerState) pollutedDomains(now time.Time) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prune(now)
+	domains := make([]string, 0, len(p.polluted))
+	for domain := range p.polluted {
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// relayed returns the polluted domains learned from peers which don't expire at now, by whole seconds until they do.
+func (p *peerState) relayed(now time.Time) map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prune(now)
+	var domains map[string]int
+	for domain, expire := range p.polluted {
+		if ttl := int(expire.Sub(now) / time.Second); ttl > 0 {
+			if domains == nil {
+				domains = make(map[string]int)
+			}
+			domains[domain] = ttl
+		}
+	}
+	return domains
+}
+
+// WithPeers shares the state learned at runtime with other instances, such as those of a home router, a VPS and an
+// office, at the URLs of their admin APIs, so that they converge on a common view sooner than each learns it alone.
+// Every interval, 1 minute if it's 0, the state is posted to /sync of every peer, which merges it, and replies its
+// own, which is merged in turn. The state is the polluted domains learned by the instance and its peers, and the
+// protocols resolvers are down over according to health checks.
+//
+// Since a peer relays what it learns from others, instances may sync with a hub only, whose admin API is reachable
+// by all of them, such as one on a VPS, while those behind NAT serve no admin API at all. Polluted domains learned
+// from peers expire an hour after the instance which learns them last shares them, and are relayed until then only,
+// so that a domain which is not polluted any more, or is wrongly learned, is retracted once instances stop learning it.
+// Requests to peers carry the admin token of the instance, which its peers share, so peers require WithAdminToken.
+func WithPeers(peers []string, interval time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if interval < 0 {
+			return errors.Errorf("invalid interval of peers %s", interval)
+		}
+		for _, peer := range peers {
+			u, err := url.Parse(peer)
+			if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+				return errors.Errorf("invalid URL of peer [%s]", peer)
+			}
+		}
+		o.Peers = append([]string(nil), peers...)
+		if o.PeerInterval = interval; interval == 0 {
+			o.PeerInterval = _peerInterval
+		}
+		return nil
+	}
+}
+
+// SyncState returns the state shared with peers: polluted domains learned by the server and by servers sharing Redis
+// of WithRedisCache, those learned by peers which are relayed until they expire, and the protocols resolvers are down
+// over according to health checks.
+func (s *Server) SyncState() *SyncState {
+	return &SyncState{Polluted: s.learnedPolluted(false), Relayed: s.peers.relayed(time.Now()), Down: s.health.downResolvers()}
+}
+
+// MergeSyncState merges the state of a peer. Its polluted domains are learned for an hour, and those it relays until
+// they expire, at most an hour. Resolvers it finds down are marked down over the protocols until the next health
+// check, if health checks are enabled and the resolvers are queried.
+func (s *Server) MergeSyncState(st *SyncState) {
+	now := time.Now()
+	for _, domain := range st.Polluted {
+		s.peers.addPolluted(domain, now.Add(_peerPollutedTTL), now)
+	}
+	for domain, ttl := range st.Relayed {
+		if ttl := time.Duration(ttl) * time.Second; ttl > 0 {
+			if ttl > _peerPollutedTTL {
+				ttl = _peerPollutedTTL
+			}
+			s.peers.addPolluted(domain, now.Add(ttl), now)
+		}
+	}
+	if s.health == nil {
+		return
+	}
+	for addr, protocols := range st.Down {
+		server, ok := s.findResolver(addr)
+		if !ok {
+			continue
+		}
+		down := s.health.downProtocols(addr)
+		for _, protocol := range protocols {
+			if containsString(server.protocols, protocol) && !containsString(down, protocol) {
+				s.upstreamLog.WithField("server", server).Debugf("Peer finds resolver down over %s.", protocol)
+				s.health.update(server, protocol, false)
+			}
+		}
+	}
+}
+
+// syncPeer posts the state of the server to the admin API of peer, and merges the state it replies.
+func (s *Server) syncPeer(ctx context.Context, client *http.Client, peer string) error {
+	b, err := json.Marshal(s.SyncState())
+	if err != nil {
+		return errors.Wrap(err, "fail to encode state")
+	}
+	ctx, cancel := context.WithTimeout(ctx, _peerTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+"/sync", bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "fail to create sync request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.options().AdminToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "fail to sync with peer")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, _maxSyncState))
+		return errors.Errorf("peer replies %s", resp.Status)
+	}
+	var st SyncState
+	if err := json.NewDecoder(io.LimitReader(resp.Body, _maxSyncState)).Decode(&st); err != nil {
+		return errors.Wrap(err, "fail to decode state of peer")
+	}
+	s.MergeSyncState(&st)
+	return nil
+}
+
+// runPeerSync syncs state with peers every interval.
+func (s *Server) runPeerSync(ctx context.Context, peers []string, interval time.Duration) {
+	client := &http.Client{Timeout: _peerTimeout}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, peer := range peers {
+			if err := s.syncPeer(ctx, client, peer); err != nil && ctx.Err() == nil {
+				s.log.WithError(err).WithField("peer", peer).Warn("Fail to sync state with peer.")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// serveSync merges the state posted by a peer, and replies the state of the server. GET replies the state only.
+// Without an admin token, anyone reaching the admin API could feed the state, so it's refused.
+func (s *Server) serveSync(w http.ResponseWriter, r *http.Request) {
+	if s.options().AdminToken == "" {
+		http.Error(w, "sync requires an admin token", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var st SyncState
+		if err := json.NewDecoder(io.LimitReader(r.Body, _maxSyncState)).Decode(&st); err != nil {
+			http.Error(w, "invalid state: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.MergeSyncState(&st)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeJSON(w, s.SyncState())
+}
+
+// downResolvers returns the sorted protocols resolvers are down over, by address of resolvers.
+func (h *healthChecker) downResolvers() map[string][]string {
+	if h == nil {
+		return nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var resolvers map[string][]string
+	for addr, protocols := range h.down {
+		for protocol, down := range protocols {
+			if !down {
+				continue
+			}
+			if resolvers == nil {
+				resolvers = make(map[string][]string)
+			}
+			resolvers[addr] = append(resolvers[addr], protocol)
+		}
+	}
+	for _, protocols := range resolvers {
+		sort.Strings(protocols)
+	}
+	return resolvers
+}
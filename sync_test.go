@@ -0,0 +1,98 @@
+package gochinadns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerSync(t *testing.T) {
+	upstream := startTestUpstream(t, "1.2.3.4")
+	hub, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp+tcp@"+upstream),
+		WithSkipStartupTest(true), WithHealthCheck(time.Hour), WithAdminToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(hub.adminAuth(hub.newAdminHandler()))
+	defer srv.Close()
+	spoke, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp+tcp@"+upstream),
+		WithSkipStartupTest(true), WithHealthCheck(time.Hour), WithAdminToken("secret"), WithPeers([]string{srv.URL}, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := spoke.Config(); c.Peers != 1 || c.PeerInterval != "1m0s" {
+		t.Errorf("Config reports %d peers every %s, want 1 every 1m0s", c.Peers, c.PeerInterval)
+	}
+
+	hub.stats.pollution.observe("hub.example.", "bogus", time.Now())
+	hub.health.update(hub.options().TrustedServers[0], "udp", false)
+	spoke.stats.pollution.observe("spoke.example.", "bogus", time.Now())
+	if err := spoke.syncPeer(spoke.ctx, http.DefaultClient, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]*Server{"hub": hub, "spoke": spoke} {
+		if learned := s.LearnedPolluted(); len(learned) != 2 || learned[0] != "hub.example" || learned[1] != "spoke.example" {
+			t.Errorf("Polluted domains of %s = %v, want both", name, learned)
+		}
+	}
+	if down := spoke.health.downProtocols(upstream); len(down) != 1 || down[0] != "udp" {
+		t.Errorf("Spoke finds %s down over %v, want udp", upstream, down)
+	}
+
+	// peers share the admin token.
+	stranger, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+upstream),
+		WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stranger.syncPeer(stranger.ctx, http.DefaultClient, srv.URL); err == nil {
+		t.Error("Sync without the admin token should fail")
+	}
+	if err := WithPeers([]string{"vps:8053"}, 0)(new(serverOptions)); err == nil {
+		t.Error("Peer without scheme should fail")
+	}
+	if _, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithPeers([]string{srv.URL}, 0)); err == nil {
+		t.Error("Peers without the admin token should fail")
+	}
+	w := httptest.NewRecorder()
+	stranger.serveSync(w, httptest.NewRequest(http.MethodPost, "/sync", strings.NewReader(`{"polluted":["bad.example"]}`)))
+	if w.Code != http.StatusForbidden || len(stranger.LearnedPolluted()) != 0 {
+		t.Errorf("Sync without the admin token replies %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestPeerPollutedExpire(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.stats.pollution.observe("own.example.", "bogus", time.Now())
+	s.MergeSyncState(&SyncState{Polluted: []string{"peer.example"}, Relayed: map[string]int{"relayed.example": 1 << 30, "old.example": 60}})
+
+	// domains of peers are relayed, but not as learned by the server.
+	st := s.SyncState()
+	if len(st.Polluted) != 1 || st.Polluted[0] != "own.example" {
+		t.Errorf("Polluted domains shared = %v, want own.example", st.Polluted)
+	}
+	hour := int(_peerPollutedTTL / time.Second)
+	if ttl := st.Relayed["peer.example"]; ttl < hour-1 || ttl > hour {
+		t.Errorf("peer.example is relayed for %ds, want %ds", ttl, hour)
+	}
+	if ttl := st.Relayed["relayed.example"]; ttl < hour-1 || ttl > hour {
+		t.Errorf("relayed.example is relayed for %ds, want at most %ds", ttl, hour)
+	}
+	// relaying doesn't extend domains, and they expire unless peers learn them again.
+	s.MergeSyncState(&SyncState{Relayed: map[string]int{"old.example": 30}})
+	if ttl := s.SyncState().Relayed["old.example"]; ttl < 59 || ttl > 60 {
+		t.Errorf("old.example is relayed for %ds, want 60s", ttl)
+	}
+	now := time.Now()
+	if domains := s.peers.pollutedDomains(now.Add(_peerPollutedTTL)); len(domains) != 0 {
+		t.Errorf("Domains of peers %v should expire", domains)
+	}
+	if relayed := s.peers.relayed(now); len(relayed) != 0 {
+		t.Errorf("Expired domains %v should not be relayed", relayed)
+	}
+}
@@ -0,0 +1,117 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package gochinadns
+
+import (
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL, "daemon": syslog.LOG_DAEMON,
+	"auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG, "lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS,
+	"uucp": syslog.LOG_UUCP, "cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2, "local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5, "local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+func checkSyslogFacility(facility string) error {
+	if _, ok := syslogFacilities[strings.ToLower(facility)]; !ok {
+		return errors.Errorf("Unknown syslog facility [%s]", facility)
+	}
+	return nil
+}
+
+// dialSyslog connects to the syslog server at addr, which is `local` or empty for the local syslog,
+// or in format udp://host:port or tcp://host:port for a remote one.
+func dialSyslog(addr, facility, tag string, severity syslog.Priority) (*syslog.Writer, error) {
+	var network, raddr string
+	if addr != "" && addr != "local" {
+		u, err := url.Parse(addr)
+		if err != nil || u.Host == "" || u.Scheme != "udp" && u.Scheme != "tcp" {
+			return nil, errors.Errorf("invalid syslog address [%s]", addr)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, syslogFacilities[strings.ToLower(facility)]|severity, tag)
+	return w, errors.Wrap(err, "fail to connect to syslog")
+}
+
+// openSyslog returns a writer which sends each write as an informational syslog message.
+func openSyslog(addr, facility, tag string) (io.Writer, error) {
+	return dialSyslog(addr, facility, tag, syslog.LOG_INFO)
+}
+
+// newSyslogLogger returns a Logger sending logs to both l and the syslog server at addr with the facility,
+// and the connection to syslog, which the caller closes. Logs less severe than the level of the standard logger of
+// logrus are not sent to syslog.
+func newSyslogLogger(l Logger, addr, facility string) (Logger, io.Closer, error) {
+	hook, err := newSyslogHook(addr, facility)
+	if err != nil {
+		return nil, nil, err
+	}
+	sl := logrus.New()
+	sl.Out = ioutil.Discard
+	sl.SetLevel(logrus.GetLevel())
+	sl.AddHook(hook)
+	return teeLogger{l, NewLogrusLogger(sl)}, hook, nil
+}
+
+// syslogHook sends logrus entries to syslog with severities of their levels, until it's closed.
+type syslogHook struct {
+	w *syslog.Writer
+
+	mu     sync.Mutex
+	closed bool //a closed syslog.Writer connects again on write
+}
+
+func (h *syslogHook) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	return h.w.Close()
+}
+
+func newSyslogHook(addr, facility string) (*syslogHook, error) {
+	w, err := dialSyslog(addr, facility, "chinadns", syslog.LOG_INFO)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogHook{w: w}, nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return h.w.Crit(line)
+	case logrus.ErrorLevel:
+		return h.w.Err(line)
+	case logrus.WarnLevel:
+		return h.w.Warning(line)
+	case logrus.InfoLevel:
+		return h.w.Info(line)
+	default:
+		return h.w.Debug(line)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package gochinadns
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var errNoSyslog = errors.New("syslog is not supported on this platform")
+
+func checkSyslogFacility(facility string) error {
+	return errNoSyslog
+}
+
+func openSyslog(addr, facility, tag string) (io.Writer, error) {
+	return nil, errNoSyslog
+}
+
+func newSyslogLogger(l Logger, addr, facility string) (Logger, io.Closer, error) {
+	return nil, nil, errNoSyslog
+}
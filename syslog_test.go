@@ -0,0 +1,63 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package gochinadns
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSyslog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	received := func() string {
+		buf := make([]byte, 4096)
+		pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, _ := pc.ReadFrom(buf)
+		return string(buf[:n])
+	}
+
+	hooks := len(logrus.StandardLogger().Hooks[logrus.InfoLevel])
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithLogger(NewLogrusLogger(l)),
+		WithSyslog("udp://"+pc.LocalAddr().String(), "daemon"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(logrus.StandardLogger().Hooks[logrus.InfoLevel]); n != hooks {
+		t.Errorf("Expect no hook added to the standard logger, got %d hooks rather than %d", n, hooks)
+	}
+	for received() != "" {
+	}
+	s.log.Info("hello syslog.")
+	if msg := received(); !strings.Contains(msg, "hello syslog.") {
+		t.Errorf("Expect logs of the server with WithLogger sent to syslog, got %q", msg)
+	}
+	logrus.Info("not the server.")
+	if msg := received(); msg != "" {
+		t.Errorf("Expect logs of others not sent to syslog, got %q", msg)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.RunBackground(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for received() != "" {
+	}
+	s.log.Info("after stopped.")
+	if msg := received(); msg != "" {
+		t.Errorf("Expect no logs sent to syslog after the server stopped, got %q", msg)
+	}
+}
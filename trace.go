@@ -0,0 +1,214 @@
+package gochinadns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// OpenTelemetry traces exported by OTLP/HTTP in JSON encoding.
+// OTLP: https://opentelemetry.io/docs/specs/otlp/#otlphttp
+
+// Kinds of spans.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+const (
+	_traceQueue     = 2048            //max number of pending spans. Spans are dropped when the queue is full.
+	_traceBatch     = 512             //max number of spans per export
+	_traceFlushTick = 5 * time.Second //interval to export pending spans
+)
+
+// tracer samples queries and exports their spans. All methods are no-op on a nil *tracer.
+type tracer struct {
+	log      Logger
+	endpoint string
+	ratio    float64 //ratio of queries to trace
+	client   *http.Client
+	queue    chan *span
+}
+
+func newTracer(endpoint string, ratio float64, log Logger) *tracer {
+	t := &tracer{
+		log:      log,
+		endpoint: endpoint,
+		ratio:    ratio,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *span, _traceQueue),
+	}
+	go t.run()
+	return t
+}
+
+// span is an OTLP span. All methods are no-op on a nil *span, so spans of unsampled queries are nil.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      string
+}
+
+// startTrace starts the root span of a query, or returns nil if the query is not sampled.
+func (t *tracer) startTrace(name string) *span {
+	if t == nil || t.ratio < 1 && mrand.Float64() >= t.ratio {
+		return nil
+	}
+	sp := &span{tracer: t, name: name, kind: spanKindServer, start: time.Now(), attrs: make(map[string]string)}
+	rand.Read(sp.traceID[:])
+	rand.Read(sp.spanID[:])
+	return sp
+}
+
+// child starts a child span.
+func (sp *span) child(name string, kind int) *span {
+	if sp == nil {
+		return nil
+	}
+	c := &span{tracer: sp.tracer, traceID: sp.traceID, parentID: sp.spanID, name: name, kind: kind, start: time.Now(), attrs: make(map[string]string)}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+// set sets an attribute. It must not be called after finish.
+func (sp *span) set(key, value string) {
+	if sp == nil {
+		return
+	}
+	sp.attrs[key] = value
+}
+
+// fail marks the span as failed with err.
+func (sp *span) fail(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.err = err.Error()
+}
+
+// finish ends the span and queues it to be exported.
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+	select {
+	case sp.tracer.queue <- sp:
+	default:
+	}
+}
+
+// traceLookup wraps lookup with a client span per resolver under parent.
+func traceLookup(parent *span, lookup LookupFunc) LookupFunc {
+	if parent == nil {
+		return lookup
+	}
+	return func(ctx context.Context, req *dns.Msg, server Resolver) (*dns.Msg, time.Duration, error) {
+		sp := parent.child("lookup", spanKindClient)
+		sp.set("net.peer.name", server.GetAddr())
+		reply, rtt, err := lookup(ctx, req, server)
+		sp.fail(err)
+		if err == nil {
+			sp.set("dns.rcode", dns.RcodeToString[reply.Rcode])
+		}
+		sp.finish()
+		return reply, rtt, err
+	}
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(_traceFlushTick)
+	defer ticker.Stop()
+	batch := make([]*span, 0, _traceBatch)
+	for {
+		select {
+		case sp := <-t.queue:
+			if batch = append(batch, sp); len(batch) < _traceBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			t.log.WithError(err).WithField("endpoint", t.endpoint).Warn("Fail to export traces.")
+		}
+		batch = batch[:0]
+	}
+}
+
+func (t *tracer) export(spans []*span) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpRequest builds an ExportTraceServiceRequest in the protobuf JSON mapping.
+func otlpRequest(spans []*span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, sp := range spans {
+		m := map[string]interface{}{
+			"traceId":           hex.EncodeToString(sp.traceID[:]),
+			"spanId":            hex.EncodeToString(sp.spanID[:]),
+			"name":              sp.name,
+			"kind":              sp.kind,
+			"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(sp.attrs),
+		}
+		if sp.parentID != [8]byte{} {
+			m["parentSpanId"] = hex.EncodeToString(sp.parentID[:])
+		}
+		if sp.err != "" {
+			m["status"] = map[string]interface{}{"code": 2, "message": sp.err}
+		}
+		encoded = append(encoded, m)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{"service.name": "gochinadns", "service.version": GetVersion()}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "gochinadns"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]string) []interface{} {
+	encoded := make([]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		encoded = append(encoded, map[string]interface{}{"key": k, "value": map[string]string{"stringValue": v}})
+	}
+	return encoded
+}
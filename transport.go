@@ -0,0 +1,74 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// DialFunc connects to address over a custom transport, see RegisterTransport. It gives up once ctx is done.
+type DialFunc func(ctx context.Context, address string) (net.Conn, error)
+
+// transports are custom transports by protocol names of resolver schemas, of DialFunc.
+var transports sync.Map
+
+// RegisterTransport registers dial as the transport of the protocol name in resolver schemas, such as
+// mytun@10.0.0.1:53, so that private transports, such as DNS over a proprietary tunnel, may be added by embedders.
+// Connections which are a net.PacketConn carry a message per packet as UDP does, and others carry messages
+// prefixed by their length as TCP does. Queries over custom transports are sent by a connection each, and retried
+// like TCP ones. Names are case insensitive, and udp and tcp can't be registered, nor a name twice.
+func RegisterTransport(name string, dial DialFunc) error {
+	name = strings.ToLower(name)
+	if name == "" || strings.ContainsAny(name, "+@?") || dial == nil {
+		return errors.Errorf("invalid transport [%s]", name)
+	}
+	if name == "udp" || name == "tcp" || name == "json" {
+		return errors.Errorf("transport [%s] is built in", name)
+	}
+	if _, loaded := transports.LoadOrStore(name, dial); loaded {
+		return errors.Errorf("transport [%s] is registered already", name)
+	}
+	return nil
+}
+
+// lookupTransport returns the custom transport of protocol, or false if there is none.
+func lookupTransport(protocol string) (DialFunc, bool) {
+	dial, ok := transports.Load(protocol)
+	if !ok {
+		return nil, false
+	}
+	return dial.(DialFunc), true
+}
+
+// protocolClient returns the client of protocol to query server with by retry, or false if the protocol is unknown.
+func (s *Server) protocolClient(retry retryPolicy, protocol string, server Resolver) (*dns.Client, bool) {
+	switch protocol {
+	case "udp":
+		return s.upstreamClient(retry, s.UDPCli, server), true
+	case "tcp":
+		return s.upstreamClient(retry, s.TCPCli, server), true
+	}
+	if _, ok := lookupTransport(protocol); !ok {
+		return nil, false
+	}
+	cli := s.upstreamClient(retry, s.TCPCli, server)
+	return &dns.Client{Net: protocol, UDPSize: cli.UDPSize, Dialer: cli.Dialer, Timeout: cli.Timeout}, true
+}
+
+// dialTransport connects to address over the custom transport of cli, in the timeout of cli.
+func dialTransport(ctx context.Context, dial DialFunc, cli *dns.Client, address string) (*dns.Conn, error) {
+	if cli.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cli.Timeout)
+		defer cancel()
+	}
+	conn, err := dial(ctx, address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to dial %s over %s", address, cli.Net)
+	}
+	return &dns.Conn{Conn: conn, UDPSize: cli.UDPSize}, nil
+}
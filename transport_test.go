@@ -0,0 +1,72 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	registerTestTransport sync.Once
+	testTransportDials    int32
+)
+
+func TestRegisterTransport(t *testing.T) {
+	registerTestTransport.Do(func() {
+		// the tunnel is a TCP connection hidden behind net.Conn, as a proprietary one would be.
+		err := RegisterTransport("TestTun", func(ctx context.Context, address string) (net.Conn, error) {
+			atomic.AddInt32(&testTransportDials, 1)
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", address)
+			return struct{ net.Conn }{conn}, err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	for _, name := range []string{"udp", "TESTTUN", "a+b", ""} {
+		if err := RegisterTransport(name, func(context.Context, string) (net.Conn, error) { return nil, nil }); err == nil {
+			t.Errorf("RegisterTransport(%s) should fail", name)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+		reply.Answer = append(reply.Answer, rr)
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	r, err := NewResolver("testtun@" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedUpstreams(r), WithSkipStartupTest(true),
+		WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := atomic.LoadInt32(&testTransportDials)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := new(explainWriter)
+	s.Serve(w, req)
+	if w.reply == nil || len(w.reply.Answer) != 1 {
+		t.Fatalf("Reply = %v, want an answer over the transport", w.reply)
+	}
+	if n := atomic.LoadInt32(&testTransportDials) - before; n != 1 {
+		t.Errorf("Transport is dialed %d times, want 1", n)
+	}
+}
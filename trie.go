@@ -4,18 +4,117 @@ import (
 	"strings"
 )
 
+// _maxLabelLen is the max length of a domain label, RFC 1035 section 2.3.4.
+const _maxLabelLen = 63
+
+// domainTrie is a set of domains, each of which contains its subdomains, keyed by labels from the root.
+// Labels are stored in lower case, and lookups are case-insensitive without splitting or allocating.
+//
+// A trie is built with Add before it's shared, and never changed after: reads need no locks, and With updates
+// a shared trie by copying the nodes it changes, so that lists can be swapped on hot reload while queries read them.
 type domainTrie struct {
 	children map[string]*domainTrie
 	end      bool
 }
 
+// normalizeDomain returns domain without spaces and the leading and trailing dots, in lower case.
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+}
+
+// Add adds the domain to the trie, which must not be shared yet.
 func (tr *domainTrie) Add(domain string) {
-	domain = strings.TrimSpace(domain)
-	if domain == "" {
+	if strings.TrimSpace(domain) == "" {
 		return
 	}
+	tr.add(normalizeDomain(domain), nil)
+}
+
+// With returns a trie of the domains of tr and domains. tr is not changed: nodes on the paths of domains are copied,
+// and the others are shared.
+func (tr *domainTrie) With(domains ...string) *domainTrie {
+	root := tr.clone()
+	copied := map[*domainTrie]bool{root: true}
+	for _, domain := range domains {
+		if strings.TrimSpace(domain) != "" {
+			root.add(normalizeDomain(domain), copied)
+		}
+	}
+	return root
+}
+
+// Without returns a trie of the domains of tr but domain, and whether domain is in tr. Domains containing domain
+// are not removed, such as google.com for www.google.com. tr is not changed: nodes on the path of domain are copied,
+// and the others are shared.
+func (tr *domainTrie) Without(domain string) (*domainTrie, bool) {
+	if tr == nil || strings.TrimSpace(domain) == "" {
+		return tr, false
+	}
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		if !tr.end {
+			return tr, false
+		}
+		return new(domainTrie), true
+	}
+	if tr.end {
+		return tr, false
+	}
+	path := []*domainTrie{tr}
+	var labels []string
+	node := tr
+	for end := len(domain); end > 0; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		label := domain[start:end]
+		if node = node.children[label]; node == nil || node.end && start > 0 {
+			// domain is not in the trie, or is contained by another one.
+			return tr, false
+		}
+		path, labels = append(path, node), append(labels, label)
+		end = start - 1
+	}
+	if !node.end {
+		return tr, false
+	}
+
+	// subdomains added before domain are kept.
+	child := node.clone()
+	child.end = false
+	if len(child.children) == 0 {
+		child = nil
+	}
+	for i := len(path) - 2; i >= 0; i-- {
+		c := path[i].clone()
+		if child == nil {
+			delete(c.children, labels[i])
+		} else {
+			c.children[labels[i]] = child
+		}
+		if child = c; i > 0 && !c.end && len(c.children) == 0 {
+			child = nil
+		}
+	}
+	return child, true
+}
+
+// clone returns a copy of the node, with its own map of the same children.
+func (tr *domainTrie) clone() *domainTrie {
+	c := new(domainTrie)
+	if tr == nil {
+		return c
+	}
+	c.end = tr.end
+	if tr.children != nil {
+		c.children = make(map[string]*domainTrie, len(tr.children))
+		for label, child := range tr.children {
+			c.children[label] = child
+		}
+	}
+	return c
+}
 
-	domain = strings.Trim(domain, ".")
+// add adds the normalized domain. If copied is not nil, nodes not in it are copied before they are changed.
+func (tr *domainTrie) add(domain string, copied map[*domainTrie]bool) {
 	// "." contains all domains
 	if domain == "" {
 		tr.end = true
@@ -23,46 +122,121 @@ func (tr *domainTrie) Add(domain string) {
 		return
 	}
 
+	// domain is already contained in this trie.
+	if tr.end {
+		return
+	}
 	node := tr
-	labels := strings.Split(domain, ".")
-	for i := len(labels) - 1; i >= 0; i-- {
-		// domain is already contained in this trie.
-		if node.end {
-			return
-		}
-
+	for end := len(domain); end > 0; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		label := domain[start:end]
 		if node.children == nil {
 			node.children = make(map[string]*domainTrie)
 		}
-		label := labels[i]
-		if node.children[label] == nil {
-			node.children[label] = new(domainTrie)
+		child := node.children[label]
+		switch {
+		case child != nil && child.end:
+			// domain is already contained in this trie.
+			return
+		case child == nil:
+			child = new(domainTrie)
+			node.children[label] = child
+			if copied != nil {
+				copied[child] = true
+			}
+		case copied != nil && !copied[child]:
+			child = child.clone()
+			node.children[label] = child
+			copied[child] = true
 		}
-		node = node.children[label]
+		node = child
+		end = start - 1
 	}
 	node.end = true
 }
 
-func (tr *domainTrie) Contain(domain string) bool {
+// lookup returns the start of the suffix of name which is a domain in the trie, or -1 if there is none.
+// name must be without the leading and trailing dots.
+func (tr *domainTrie) lookup(name string) int {
 	if tr == nil {
-		return false
+		return -1
 	}
-	domain = strings.Trim(domain, ".")
-	labels := strings.Split(domain, ".")
-	node := tr
-	if node.end {
-		return true
+	if tr.end {
+		return 0
 	}
-	for i := len(labels) - 1; i >= 0; i-- {
-		label := labels[i]
-		node = node.children[label]
+	var buf [_maxLabelLen]byte
+	node := tr
+	for end := len(name); end > 0; {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		label := name[start:end]
+		if lower, ok := lowerLabel(&buf, label); ok {
+			// the conversion of the map key doesn't allocate.
+			node = node.children[string(buf[:lower])]
+		} else {
+			node = node.children[label]
+		}
 		if node == nil {
-			return false
+			return -1
 		}
 		if node.end {
-			return true
+			return start
+		}
+		end = start - 1
+	}
+	return -1
+}
+
+// lowerLabel writes label in lower case to buf, and returns its length, if it has upper case letters.
+// Labels too long to be in a trie are returned as they are.
+func lowerLabel(buf *[_maxLabelLen]byte, label string) (int, bool) {
+	upper := false
+	for i := 0; i < len(label); i++ {
+		if c := label[i]; 'A' <= c && c <= 'Z' {
+			upper = true
+			break
 		}
 	}
-	// should not be here
-	return false
+	if !upper || len(label) > _maxLabelLen {
+		return 0, false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		buf[i] = c
+	}
+	return len(label), true
+}
+
+func (tr *domainTrie) Contain(domain string) bool {
+	return tr.lookup(strings.Trim(domain, ".")) >= 0
+}
+
+// Match returns the domain in the trie which contains the given domain, such as `google.com` for `www.google.com.`.
+func (tr *domainTrie) Match(domain string) (string, bool) {
+	if tr != nil && tr.end {
+		return ".", true
+	}
+	name := strings.Trim(domain, ".")
+	start := tr.lookup(name)
+	if start < 0 {
+		return "", false
+	}
+	return strings.ToLower(name[start:]), true
+}
+
+// Len returns the number of domains in the trie.
+func (tr *domainTrie) Len() int {
+	if tr == nil {
+		return 0
+	}
+	if tr.end {
+		return 1
+	}
+	n := 0
+	for _, child := range tr.children {
+		n += child.Len()
+	}
+	return n
 }
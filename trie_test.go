@@ -1,6 +1,7 @@
 package gochinadns
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 )
@@ -73,3 +74,154 @@ func TestTrieContain(t *testing.T) {
 		t.Error("cn should contain all .cn domains")
 	}
 }
+
+func TestTrieMatch(t *testing.T) {
+	trie := new(domainTrie)
+	trie.Add("google.com")
+	trie.Add("goo.gl")
+
+	if rule, ok := trie.Match("www.google.com."); !ok || rule != "google.com" {
+		t.Errorf("Expect www.google.com. to match google.com, got %q", rule)
+	}
+	if rule, ok := trie.Match("goo.gl"); !ok || rule != "goo.gl" {
+		t.Errorf("Expect goo.gl to match itself, got %q", rule)
+	}
+	if _, ok := trie.Match("gl."); ok {
+		t.Error("gl. should not match")
+	}
+
+	trie.Add(".")
+	if rule, ok := trie.Match("example.com."); !ok || rule != "." {
+		t.Errorf("Expect example.com. to match root, got %q", rule)
+	}
+}
+
+func TestTrieLen(t *testing.T) {
+	trie := new(domainTrie)
+	trie.Add("www.google.com")
+	trie.Add("google.com")
+	trie.Add("goo.gl")
+	if n := trie.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+	var empty *domainTrie
+	if n := empty.Len(); n != 0 {
+		t.Errorf("Len() of nil trie = %d, want 0", n)
+	}
+}
+
+func TestTrieCase(t *testing.T) {
+	trie := new(domainTrie)
+	trie.Add("Google.COM")
+	if !trie.Contain("www.google.com") || !trie.Contain("WWW.GOOGLE.COM.") {
+		t.Error("lookups should be case-insensitive")
+	}
+	if rule, ok := trie.Match("Mail.Google.Com."); !ok || rule != "google.com" {
+		t.Errorf("Expect Mail.Google.Com. to match google.com, got %q", rule)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { trie.Contain("WWW.Google.com.") }); allocs != 0 {
+		t.Errorf("Contain() allocates %v times", allocs)
+	}
+}
+
+func TestTrieWith(t *testing.T) {
+	trie := new(domainTrie)
+	trie.Add("google.com")
+	trie.Add("api.github.com")
+
+	updated := trie.With("github.com", "goo.gl", "www.google.com")
+	if trie.Contain("www.github.com") || trie.Contain("goo.gl") || trie.Len() != 2 {
+		t.Error("With() changes the trie")
+	}
+	if !updated.Contain("www.github.com") || !updated.Contain("goo.gl") || !updated.Contain("mail.google.com") {
+		t.Error("With() misses domains")
+	}
+	if n := updated.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+	if trie.children["com"].children["google"] != updated.children["com"].children["google"] {
+		t.Error("nodes which are not changed should be shared")
+	}
+	var empty *domainTrie
+	if !empty.With("cn").Contain("12306.cn") {
+		t.Error("With() of a nil trie misses domains")
+	}
+}
+
+func TestTrieWithout(t *testing.T) {
+	trie := new(domainTrie)
+	trie.Add("www.google.com")
+	trie.Add("google.com")
+	trie.Add("api.github.com")
+	trie.Add("goo.gl")
+
+	for _, domain := range []string{"mail.google.com", "github.com", "gl", "example.com", ""} {
+		if updated, ok := trie.Without(domain); ok || updated != trie {
+			t.Errorf("Without(%q) removes a domain which is not in the trie", domain)
+		}
+	}
+	updated, ok := trie.Without("Google.COM.")
+	if !ok {
+		t.Fatal("Without() misses google.com")
+	}
+	if !trie.Contain("mail.google.com") || trie.Len() != 3 {
+		t.Error("Without() changes the trie")
+	}
+	if updated.Contain("mail.google.com") || !updated.Contain("www.google.com") || updated.Len() != 3 {
+		t.Error("Without() should keep subdomains added before the domain")
+	}
+	updated, _ = updated.Without("api.github.com")
+	if _, ok := updated.children["com"].children["github"]; ok {
+		t.Error("Without() should prune empty nodes")
+	}
+	if trie.children["gl"] != updated.children["gl"] {
+		t.Error("nodes which are not changed should be shared")
+	}
+	for _, domain := range []string{"www.google.com", "goo.gl"} {
+		updated, _ = updated.Without(domain)
+	}
+	if n := updated.Len(); n != 0 || len(updated.children) != 0 {
+		t.Errorf("Len() = %d after removing all domains, want 0", n)
+	}
+
+	all := new(domainTrie)
+	all.Add(".")
+	if updated, ok := all.Without("."); !ok || updated.Contain("cn") {
+		t.Error("Without() misses the root")
+	}
+}
+
+// benchmarkTrie returns a trie of n random domains, such as a large blocklist.
+func benchmarkTrie(n int) *domainTrie {
+	trie := new(domainTrie)
+	for i := 0; i < n; i++ {
+		trie.Add(fmt.Sprintf("ads%d.tracker%d.com", i, i%1000))
+	}
+	return trie
+}
+
+func BenchmarkTrieAdd(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchmarkTrie(100000)
+	}
+}
+
+func BenchmarkTrieContain(b *testing.B) {
+	trie := benchmarkTrie(1000000)
+	names := []string{"ads42.tracker42.com.", "www.example.com.", "Ads7.Tracker7.COM.", "a.b.c.d.example.org."}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Contain(names[i%len(names)])
+	}
+}
+
+func BenchmarkTrieWith(b *testing.B) {
+	trie := benchmarkTrie(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.With("new.example.com")
+	}
+}
@@ -0,0 +1,166 @@
+package gochinadns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Origins of answers judged by a TrustPolicy.
+const (
+	OriginTrusted   = "trusted"   //answer of a trusted resolver
+	OriginUntrusted = "untrusted" //answer of an untrusted resolver
+)
+
+// TrustPolicy decides whether an answer to a query is used, so that the verdict may be swapped for other logic.
+// An answer which is not accepted is used only if the reply of the other origin isn't either, or doesn't come
+// in time. The default policy accepts untrusted answers in the China route list, and trusted answers unless
+// they are in China in bidirectional mode. Both reject answers in the IP blacklist as polluted.
+// AcceptAnswer is called concurrently, and should return quickly.
+type TrustPolicy interface {
+	AcceptAnswer(query *dns.Question, answer *dns.Msg, origin string) Decision
+}
+
+// Decision is a verdict of a TrustPolicy on an answer.
+type Decision struct {
+	Accept    bool   //use the answer without waiting for the other origin
+	Polluted  bool   //the answer is polluted, which is reported to metrics, stats and logs
+	Heuristic string //how the answer is found polluted
+	Reason    string //why the answer is accepted or not, in query logs
+}
+
+// TrustPolicyFunc is a TrustPolicy of a function.
+type TrustPolicyFunc func(query *dns.Question, answer *dns.Msg, origin string) Decision
+
+// AcceptAnswer calls f.
+func (f TrustPolicyFunc) AcceptAnswer(query *dns.Question, answer *dns.Msg, origin string) Decision {
+	return f(query, answer, origin)
+}
+
+// Reasons of decisions of the default policy which are not accepted.
+const (
+	reasonUntrustedOverseas = "untrusted-overseas" //untrusted answer is not in China
+	reasonTrustedChina      = "trusted-china"      //trusted answer is in China in bidirectional mode
+)
+
+// decisionMessages are logs of decisions of the default policy, by reason.
+var decisionMessages = map[string]string{
+	reasonNoAddress:         "Reply has no address to check. Use it.",
+	reasonCNAME:             "Reply ends with a CNAME. Use it.",
+	reasonChina:             "Answer belongs to China. Use it.",
+	reasonUntrustedOverseas: "Answer is overseas. Wait for trusted reply.",
+	reasonTrusted:           "Answer is trusted. Use it.",
+	reasonBidiExempt:        "Answer is trusted and exempt from bidirectional mode. Use it.",
+	reasonTrustedOverseas:   "Answer is trusted and overseas. Use it.",
+	reasonTrustedChina:      "Answer may not be the nearest. Wait for untrusted reply.",
+}
+
+// policy returns the TrustPolicy of the current options, which changes on reload, or chinaPolicy by default.
+func (s *Server) policy() TrustPolicy {
+	if p := s.options().TrustPolicy; p != nil {
+		return p
+	}
+	return chinaPolicy{s}
+}
+
+// chinaPolicy is the default TrustPolicy, by the China route list and the IP blacklist of the server.
+type chinaPolicy struct {
+	s *Server
+}
+
+func (p chinaPolicy) AcceptAnswer(query *dns.Question, answer *dns.Msg, origin string) Decision {
+	ip, reason := firstAnswerIP(answer)
+	if ip == nil {
+		return Decision{Accept: true, Reason: reason}
+	}
+	o := p.s.options()
+	logger := p.s.verdictLog.WithField("answer", ip)
+	hit, err := o.IPBlacklist.Contains(ip)
+	if err != nil {
+		logger.WithError(err).Error("Blacklist CIDR error.")
+	}
+	if hit {
+		return Decision{Polluted: true, Heuristic: heuristicIPBlacklist, Reason: heuristicIPBlacklist}
+	}
+	if origin == OriginTrusted {
+		if !o.Bidirectional {
+			return Decision{Accept: true, Reason: reasonTrusted}
+		}
+		if o.DomainBidiExempt.Contain(query.Name) {
+			return Decision{Accept: true, Reason: reasonBidiExempt}
+		}
+	}
+	contain, err := o.ChinaCIDR.Contains(ip)
+	if err != nil {
+		logger.WithError(err).Error("CIDR error.")
+	}
+	switch {
+	case origin == OriginUntrusted && contain:
+		return Decision{Accept: true, Reason: reasonChina}
+	case origin == OriginUntrusted:
+		return Decision{Reason: reasonUntrustedOverseas}
+	case !contain:
+		return Decision{Accept: true, Reason: reasonTrustedOverseas}
+	default:
+		return Decision{Reason: reasonTrustedChina}
+	}
+}
+
+// firstAnswerIP returns the first A or AAAA answer of reply to check, or nil with why there is none:
+// the reply has no address, or ends with a CNAME.
+func firstAnswerIP(reply *dns.Msg) (net.IP, string) {
+	for i, rr := range reply.Answer {
+		switch answer := rr.(type) {
+		case *dns.A:
+			return answer.A, ""
+		case *dns.AAAA:
+			return answer.AAAA, ""
+		case *dns.CNAME:
+			if i < len(reply.Answer)-1 {
+				continue
+			}
+			return nil, reasonCNAME
+		default:
+			return nil, reasonNoAddress
+		}
+	}
+	return nil, reasonNoAddress
+}
+
+// Verdict is how the server classifies an answer, see ClassifyAnswer.
+type Verdict struct {
+	IP          net.IP   //the first address answered, which is checked, nil if there is none
+	China       bool     //IP is in the China route list
+	Blacklisted bool     //IP is in the IP blacklist
+	Trusted     Decision //decision of the trust policy if a trusted resolver answers
+	Untrusted   Decision //decision of the trust policy if an untrusted resolver answers
+}
+
+// IsChinaIP reports whether ip is in the China route list of the server.
+func (s *Server) IsChinaIP(ip net.IP) bool {
+	contain, _ := s.options().ChinaCIDR.Contains(ip)
+	return contain
+}
+
+// IsBlacklistedIP reports whether ip is in the IP blacklist of the server, whose answers are polluted.
+func (s *Server) IsBlacklistedIP(ip net.IP) bool {
+	hit, _ := s.options().IPBlacklist.Contains(ip)
+	return hit
+}
+
+// ClassifyAnswer classifies the answer of reply as the server does, by the lists and the trust policy of the server,
+// so that other tools, such as ipset populators, may reuse the same classification.
+func (s *Server) ClassifyAnswer(reply *dns.Msg) *Verdict {
+	v := new(Verdict)
+	if v.IP, _ = firstAnswerIP(reply); v.IP != nil {
+		v.China, v.Blacklisted = s.IsChinaIP(v.IP), s.IsBlacklistedIP(v.IP)
+	}
+	var q dns.Question
+	if len(reply.Question) > 0 {
+		q = reply.Question[0]
+	}
+	policy := s.policy()
+	v.Trusted = policy.AcceptAnswer(&q, reply, OriginTrusted)
+	v.Untrusted = policy.AcceptAnswer(&q, reply, OriginUntrusted)
+	return v
+}
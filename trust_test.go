@@ -0,0 +1,112 @@
+package gochinadns
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTrustPolicy(t *testing.T) {
+	trusted, untrusted := startTestUpstream(t, "8.8.8.8"), startTestUpstream(t, "1.2.3.4")
+	f, err := ioutil.TempFile("", "china-*.list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("127.0.0.0/8\n")
+	f.Close()
+
+	var (
+		mu      sync.Mutex
+		origins = make(map[string]int)
+	)
+	// the opposite of the default: trusted answers are polluted, and untrusted ones are accepted.
+	policy := TrustPolicyFunc(func(q *dns.Question, answer *dns.Msg, origin string) Decision {
+		mu.Lock()
+		origins[origin]++
+		mu.Unlock()
+		if q.Name != "example.com." {
+			t.Errorf("query of the decision = %s", q.Name)
+		}
+		if origin == OriginTrusted {
+			return Decision{Polluted: true, Heuristic: "test", Reason: "distrusted"}
+		}
+		return Decision{Accept: true, Reason: "accepted"}
+	})
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithCHNList(f.Name()), WithTrustedResolvers("udp@"+trusted),
+		WithResolvers("udp@"+untrusted), WithTimeout(time.Second), WithSkipStartupTest(true), WithTrustPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		w := new(explainWriter)
+		result := s.serve(context.Background(), w, req, nil)
+		if result.path != pathUntrusted || result.reason != "accepted" {
+			t.Fatalf("answer of path %s by %s, want the untrusted one", result.path, result.reason)
+		}
+		if w.reply == nil || w.reply.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+			t.Fatalf("reply = %v, want 1.2.3.4", w.reply)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if origins[OriginUntrusted] != 5 {
+		t.Errorf("untrusted answers are judged %d times, want 5", origins[OriginUntrusted])
+	}
+	if n := s.PollutionCount(); n != uint64(origins[OriginTrusted]) {
+		t.Errorf("PollutionCount() = %d, want %d of trusted answers judged", n, origins[OriginTrusted])
+	}
+}
+
+func TestClassifyAnswer(t *testing.T) {
+	china, err := ioutil.TempFile("", "china-*.list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(china.Name())
+	china.WriteString("1.2.3.0/24\n")
+	china.Close()
+	blacklist, err := ioutil.TempFile("", "iplist-*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(blacklist.Name())
+	blacklist.WriteString("10.0.0.1\n")
+	blacklist.Close()
+
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true), WithCHNList(china.Name()),
+		WithIPBlacklist(blacklist.Name()), WithBidirectional(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.IsChinaIP(net.ParseIP("1.2.3.4")) || s.IsChinaIP(net.ParseIP("8.8.8.8")) {
+		t.Error("IsChinaIP() doesn't match the China route list")
+	}
+	if !s.IsBlacklistedIP(net.ParseIP("10.0.0.1")) || s.IsBlacklistedIP(net.ParseIP("1.2.3.4")) {
+		t.Error("IsBlacklistedIP() doesn't match the IP blacklist")
+	}
+
+	v := s.ClassifyAnswer(newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 1.2.3.4"))
+	if !v.IP.Equal(net.ParseIP("1.2.3.4")) || !v.China || v.Blacklisted {
+		t.Errorf("ClassifyAnswer() = %+v, want an IP in China", v)
+	}
+	if !v.Untrusted.Accept || v.Untrusted.Reason != reasonChina || v.Trusted.Accept || v.Trusted.Reason != reasonTrustedChina {
+		t.Errorf("decisions = %+v and %+v, want only the untrusted one accepted in bidirectional mode", v.Trusted, v.Untrusted)
+	}
+	v = s.ClassifyAnswer(newTestReply(t, dns.RcodeSuccess, "example.com. 60 IN A 10.0.0.1"))
+	if !v.Blacklisted || !v.Trusted.Polluted || !v.Untrusted.Polluted {
+		t.Errorf("ClassifyAnswer() = %+v, want a polluted answer", v)
+	}
+	v = s.ClassifyAnswer(newTestReply(t, dns.RcodeNameError))
+	if v.IP != nil || !v.Trusted.Accept || v.Trusted.Reason != reasonNoAddress {
+		t.Errorf("ClassifyAnswer() = %+v, want no address", v)
+	}
+}
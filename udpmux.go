@@ -0,0 +1,294 @@
+package gochinadns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// _headerSize is the size of the header of DNS messages.
+const _headerSize = 12
+
+// upstreamConns multiplexes UDP queries to every resolver over a few long-lived connected sockets, instead of
+// a socket per query, which costs an ephemeral port and a conntrack entry per query. Replies are matched to queries
+// by ID and question: every query is sent with a random ID unused on its socket, which is restored in the reply.
+// Since the source port of a socket doesn't change, off-path attackers only have the ID to guess, which is why
+// the feature is opt-in, see WithUpstreamSockets, and sockets may be rotated, see WithUpstreamRotation.
+type upstreamConns struct {
+	size   int           //sockets per resolver
+	rotate time.Duration //age of sockets to replace, 0 to keep them
+
+	mu     sync.Mutex
+	conns  map[string][]*muxConn //by address of resolver, and the local address if any
+	next   int                   //index of the socket of the next query, round robin
+	closed bool
+}
+
+func newUpstreamConns(size int, rotate time.Duration) *upstreamConns {
+	return &upstreamConns{size: size, rotate: rotate, conns: make(map[string][]*muxConn)}
+}
+
+// Exchange sends the packed query to address, and waits for its reply until deadline, or ctx is done.
+// Sockets to address are connected by dialer, or a default one if it's nil.
+func (u *upstreamConns) Exchange(ctx context.Context, dialer *net.Dialer, address string, query []byte, deadline time.Time) (*dns.Msg, error) {
+	packet, err := u.ExchangeRaw(ctx, dialer, address, query, deadline)
+	if err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(packet); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// ExchangeRaw does the same as Exchange, and returns the reply packed, with the ID of query.
+func (u *upstreamConns) ExchangeRaw(ctx context.Context, dialer *net.Dialer, address string, query []byte, deadline time.Time) ([]byte, error) {
+	if len(query) < _headerSize {
+		return nil, dns.ErrShortRead
+	}
+	c, err := u.conn(dialer, address)
+	if err != nil {
+		return nil, err
+	}
+	return c.exchange(ctx, query, deadline)
+}
+
+// conn returns the next socket to address, and connects it by dialer if it's not connected yet, failed or is due to
+// be rotated. Sockets from different local addresses of dialers are not shared.
+func (u *upstreamConns) conn(dialer *net.Dialer, address string) (*muxConn, error) {
+	key := address
+	if dialer != nil && dialer.LocalAddr != nil {
+		key = dialer.LocalAddr.String() + ">" + address
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		return nil, errors.New("upstream sockets closed")
+	}
+	conns := u.conns[key]
+	u.next++
+	i := u.next % u.size
+	if i < len(conns) && !conns[i].isDead() {
+		if u.rotate <= 0 || time.Since(conns[i].born) < u.rotate {
+			return conns[i], nil
+		}
+		conns[i].retire()
+	}
+	if dialer == nil {
+		dialer = new(net.Dialer)
+	}
+	conn, err := dialer.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	c := &muxConn{conn: conn, born: time.Now(), pending: make(map[uint16]*muxQuery)}
+	go c.readLoop()
+	if i < len(conns) {
+		conns[i] = c
+	} else {
+		u.conns[key] = append(conns, c)
+	}
+	return c, nil
+}
+
+// Close closes all sockets. Queries in flight fail once they time out.
+func (u *upstreamConns) Close() error {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	for _, conns := range u.conns {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+	}
+	return nil
+}
+
+// muxConn is a connected UDP socket, with queries in flight on it waiting for their replies.
+type muxConn struct {
+	conn net.Conn
+	born time.Time
+
+	mu      sync.Mutex
+	pending map[uint16]*muxQuery //by ID the query is sent with
+	dead    bool                 //whether the socket fails to read, and must be replaced
+	retired bool                 //whether the socket is replaced, and is closed once no query is in flight
+}
+
+// muxQuery is a query in flight, waiting for the reply of its question.
+type muxQuery struct {
+	question []byte //question section of the query
+	ch       chan muxReply
+}
+
+// muxReply is a reply read into a pooled buffer, which its receiver puts back.
+type muxReply struct {
+	buf *[]byte
+	n   int
+}
+
+func (c *muxConn) exchange(ctx context.Context, query []byte, deadline time.Time) ([]byte, error) {
+	question := questionSection(query)
+	if question == nil {
+		return nil, dns.ErrShortRead
+	}
+	id, q, err := c.register(question)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id, q)
+
+	b := getPacketBuffer()
+	defer putPacketBuffer(b)
+	packet := append((*b)[:0], query...)
+	binary.BigEndian.PutUint16(packet, id)
+	if _, err := c.conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case r := <-q.ch:
+		reply := append([]byte(nil), (*r.buf)[:r.n]...)
+		putPacketBuffer(r.buf)
+		copy(reply, query[:2])
+		return reply, nil
+	case <-timer.C:
+		return nil, errors.Wrap(os.ErrDeadlineExceeded, "fail to receive reply")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// register picks a random ID unused by queries in flight, and returns it with the query of question in flight,
+// whose channel its reply is sent to.
+func (c *muxConn) register(question []byte) (uint16, *muxQuery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) > 0xffff/2 {
+		return 0, nil, errors.New("too many queries in flight on the upstream socket")
+	}
+	for {
+		id := uint16(rand.Intn(0x10000))
+		if _, ok := c.pending[id]; !ok {
+			q := &muxQuery{question: question, ch: make(chan muxReply, 1)}
+			c.pending[id] = q
+			return id, q, nil
+		}
+	}
+}
+
+// unregister frees id, and puts back the buffer of a reply sent to q which is not received.
+func (c *muxConn) unregister(id uint16, q *muxQuery) {
+	c.mu.Lock()
+	if c.pending[id] == q {
+		delete(c.pending, id)
+	}
+	if c.retired && len(c.pending) == 0 {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	select {
+	case r := <-q.ch:
+		putPacketBuffer(r.buf)
+	default:
+	}
+}
+
+// readLoop sends replies to queries waiting for them, until the socket is closed or fails.
+// Replies to no query in flight, such as late or spoofed ones, and those whose question is not that of the query of
+// their ID are dropped, and the query keeps waiting.
+func (c *muxConn) readLoop() {
+	for {
+		b := getPacketBuffer()
+		n, err := c.conn.Read(*b)
+		if err != nil {
+			putPacketBuffer(b)
+			// ICMP errors of earlier packets are reported by connected sockets, and such queries time out.
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			c.mu.Lock()
+			c.dead = true
+			c.mu.Unlock()
+			c.conn.Close()
+			return
+		}
+		if n < _headerSize {
+			putPacketBuffer(b)
+			continue
+		}
+		id := binary.BigEndian.Uint16(*b)
+		question := questionSection((*b)[:n])
+		c.mu.Lock()
+		q, ok := c.pending[id]
+		if ok && question != nil && bytes.EqualFold(question, q.question) {
+			delete(c.pending, id)
+		} else {
+			ok = false
+		}
+		c.mu.Unlock()
+		if !ok {
+			putPacketBuffer(b)
+			continue
+		}
+		q.ch <- muxReply{buf: b, n: n}
+	}
+}
+
+// questionSection returns the question of the packed message, which has one question with an uncompressed name,
+// or nil if it has not.
+func questionSection(packet []byte) []byte {
+	if len(packet) < _headerSize || binary.BigEndian.Uint16(packet[4:]) != 1 {
+		return nil
+	}
+	off := _headerSize
+	for {
+		if off >= len(packet) {
+			return nil
+		}
+		l := int(packet[off])
+		if l == 0 {
+			break
+		}
+		if l&0xc0 != 0 {
+			return nil
+		}
+		off += 1 + l
+	}
+	// the root label, type and class.
+	if off += 5; off > len(packet) {
+		return nil
+	}
+	return packet[_headerSize:off]
+}
+
+// retire closes the socket once queries in flight on it are done. New queries are not sent on it.
+func (c *muxConn) retire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retired = true
+	if len(c.pending) == 0 {
+		c.conn.Close()
+	}
+}
+
+func (c *muxConn) isDead() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dead
+}
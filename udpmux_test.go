@@ -0,0 +1,218 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startEchoUpstream answers A queries with 1.2.3.4 unless silent, recording source addresses of queries in sources.
+func startEchoUpstream(t *testing.T, silent bool, mu *sync.Mutex, sources map[string]bool) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		sources[w.RemoteAddr().String()] = true
+		mu.Unlock()
+		if silent {
+			return
+		}
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+		reply.Answer = append(reply.Answer, rr)
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestUpstreamSockets(t *testing.T) {
+	var mu sync.Mutex
+	sources := make(map[string]bool)
+	addr := startEchoUpstream(t, false, &mu, sources)
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTimeout(time.Second), WithUpstreamSockets(2), WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.upstreams.Close()
+
+	// concurrent queries with the same ID get their own replies.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			req.Id = 1
+			reply, _, err := s.exchange(context.Background(), s.UDPCli, req, addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if reply.Id != 1 || reply.Question[0].Name != name || len(reply.Answer) != 1 {
+				t.Errorf("query of %s is answered with %v", name, reply)
+			}
+		}(string(rune('a'+i)) + ".example.com.")
+	}
+	wg.Wait()
+	mu.Lock()
+	if len(sources) != 2 {
+		t.Errorf("queries are sent from %d sockets, want 2", len(sources))
+	}
+	mu.Unlock()
+
+	silent := startEchoUpstream(t, true, &mu, sources)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := s.exchange(context.Background(), s.UDPCli, req, silent); !isTimeout(err) {
+		t.Errorf("exchange with a silent upstream fails with %v, want a timeout", err)
+	}
+
+	s.upstreams.Close()
+	if _, _, err := s.exchange(context.Background(), s.UDPCli, req, addr); err == nil {
+		t.Error("exchange after Close should fail")
+	}
+}
+
+func TestUpstreamSocketsQuestion(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a spoofed reply of the ID of the query, but of another question, comes first.
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		spoofed := new(dns.Msg)
+		spoofed.SetQuestion("evil.example.com.", dns.TypeA)
+		spoofed.Id, spoofed.Response = req.Id, true
+		rr, _ := dns.NewRR("evil.example.com. 60 IN A 6.6.6.6")
+		spoofed.Answer = append(spoofed.Answer, rr)
+		w.WriteMsg(spoofed)
+
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		rr, _ = dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+		reply.Answer = append(reply.Answer, rr)
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	u := newUpstreamConns(1, 0)
+	defer u.Close()
+	req := new(dns.Msg)
+	req.SetQuestion("WWW.example.com.", dns.TypeA)
+	query, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := u.Exchange(context.Background(), nil, pc.LocalAddr().String(), query, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := answerIPs(reply); len(ips) != 1 || ips[0].String() != "1.2.3.4" {
+		t.Errorf("reply = %v, want the one of the question", reply)
+	}
+
+	if q := questionSection(query); len(q) != len("\x03WWW\x07example\x03com\x00")+4 {
+		t.Errorf("question section = %q", q)
+	}
+	if questionSection(query[:len(query)-1]) != nil {
+		t.Error("question section of a short message should be nil")
+	}
+}
+
+func TestUpstreamRotation(t *testing.T) {
+	var mu sync.Mutex
+	sources := make(map[string]bool)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		sources[w.RemoteAddr().String()] = true
+		mu.Unlock()
+		if req.Question[0].Name == "slow.example.com." {
+			time.Sleep(200 * time.Millisecond)
+		}
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+		reply.Answer = append(reply.Answer, rr)
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	addr := pc.LocalAddr().String()
+
+	u := newUpstreamConns(1, 50*time.Millisecond)
+	defer u.Close()
+	exchange := func(name string) error {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		query, err := req.Pack()
+		if err != nil {
+			return err
+		}
+		_, err = u.Exchange(context.Background(), nil, addr, query, time.Now().Add(time.Second))
+		return err
+	}
+	if err := exchange("a.example.com."); err != nil {
+		t.Fatal(err)
+	}
+	old := u.conns[addr][0]
+	slow := make(chan error, 1)
+	go func() { slow <- exchange("slow.example.com.") }()
+
+	// the socket is replaced once it's old, while the query in flight on it still gets its reply.
+	time.Sleep(100 * time.Millisecond)
+	if err := exchange("b.example.com."); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-slow; err != nil {
+		t.Errorf("query in flight on the rotated socket fails with %v", err)
+	}
+	mu.Lock()
+	if len(sources) != 2 {
+		t.Errorf("queries are sent from %d sockets, want 2", len(sources))
+	}
+	mu.Unlock()
+	if u.conns[addr][0] == old {
+		t.Error("the old socket is not replaced")
+	}
+	if _, err := old.conn.Write([]byte{0}); err == nil {
+		t.Error("the old socket should be closed once no query is in flight")
+	}
+}
+
+func TestUpstreamSocketsMutation(t *testing.T) {
+	var mu sync.Mutex
+	sources := make(map[string]bool)
+	addr := startEchoUpstream(t, false, &mu, sources)
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTimeout(time.Second), WithUpstreamSockets(2),
+		WithMutation(true), WithTrustedResolvers("udp@"+addr), WithSkipStartupTest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.upstreams.Close()
+
+	// queries with compressed questions are sent over sockets of their own.
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	reply, _, err := s.LookupMutated(context.Background(), req, s.options().TrustedServers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := answerIPs(reply); len(ips) != 1 || ips[0].String() != "1.2.3.4" {
+		t.Errorf("reply of the mutated query = %v", reply)
+	}
+}
@@ -0,0 +1,51 @@
+package gochinadns
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Validate builds options from opts like NewServer, without testing resolvers or starting to serve,
+// and returns every problem found: bad options, bad lines of lists and config files, bad resolver schemas,
+// and listening addresses which cannot be bound. It returns nil if opts are good to serve with.
+func Validate(opts ...ServerOption) []error {
+	o := newServerOptions()
+	o.checking = true
+	o.apply(opts)
+
+	for _, l := range []struct {
+		name, addr string
+		udp        bool
+	}{
+		{"listen", o.Listen, true},
+		{"metrics-listen", o.MetricsListen, false},
+		{"admin-listen", o.AdminListen, false},
+		{"debug-listen", o.DebugListen, false},
+	} {
+		if l.addr == "" {
+			continue
+		}
+		if err := checkBindable(l.addr, l.udp); err != nil {
+			o.problems = append(o.problems, errors.Wrap(err, l.name))
+		}
+	}
+	return o.problems
+}
+
+// checkBindable binds addr on TCP, and UDP as well if udp is set, and releases it at once.
+func checkBindable(addr string, udp bool) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	l.Close()
+	if udp {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		pc.Close()
+	}
+	return nil
+}
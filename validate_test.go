@@ -0,0 +1,47 @@
+package gochinadns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chinadns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	list := filepath.Join(dir, "china.list")
+	if err := ioutil.WriteFile(list, []byte("1.0.1.0/24\nbad\n1.0.2.0/23\nworse\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	problems := Validate(
+		WithCHNList(list),
+		WithResolvers("udp@1.1.1.1:53", "xyz@2.2.2.2:53"),
+		WithListenAddr("127.0.0.1:0"),
+		WithAdminListen(l.Addr().String()),
+	)
+	want := []string{list + ":2:", list + ":4:", "xyz", "admin-listen"}
+	if len(problems) != len(want) {
+		t.Fatalf("Validate() = %v, want %d problems", problems, len(want))
+	}
+	for i, err := range problems {
+		if !strings.Contains(err.Error(), want[i]) {
+			t.Errorf("Problem %d = %v, want containing %q", i, err, want[i])
+		}
+	}
+
+	if problems := Validate(WithCHNList(list), WithListenAddr("127.0.0.1:0")); len(problems) != 2 {
+		t.Errorf("Validate() = %v, want 2 problems", problems)
+	}
+}
@@ -1,14 +1,74 @@
 package gochinadns
 
-import "fmt"
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
 
 const (
 	name = "GoChinaDNS"
 )
 
-var version = "v1.0"
+// Build information, set by ldflags such as
+// -X github.com/cherrot/gochinadns.version=v1.1 -X github.com/cherrot/gochinadns.commit=abc1234 -X github.com/cherrot/gochinadns.buildDate=2021-01-01T00:00:00Z.
+// Unset ones are filled from build information embedded by the Go toolchain, if any.
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+// _defaultVersion is the version of builds without any version information.
+const _defaultVersion = "v1.0"
+
+// BuildInfo identifies the build of the server.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// GetBuildInfo returns the build information of the server.
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, Date: buildDate, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		fillBuildInfo(&info, bi)
+	}
+	if info.Version == "" {
+		info.Version = _defaultVersion
+	}
+	return info
+}
+
+// fillBuildInfo fills fields of info which are not set by ldflags from bi: the module version of go install pkg@version,
+// and the VCS revision and commit time of builds in a git checkout, see fillVCSInfo.
+func fillBuildInfo(info *BuildInfo, bi *debug.BuildInfo) {
+	if info.Version == "" {
+		for _, m := range append([]*debug.Module{&bi.Main}, bi.Deps...) {
+			if m.Path == "github.com/cherrot/gochinadns" && m.Version != "" && m.Version != "(devel)" {
+				info.Version = m.Version
+			}
+		}
+	}
+	fillVCSInfo(info, bi)
+}
 
 // GetVersion returns server version.
 func GetVersion() string {
-	return fmt.Sprintf("%s %s", name, version)
+	return fmt.Sprintf("%s %s", name, GetBuildInfo().Version)
+}
+
+// String formats the build information in one line,
+// such as GoChinaDNS v1.1 (commit abc1234, built 2021-01-01T00:00:00Z, go1.15.6).
+func (b BuildInfo) String() string {
+	s := fmt.Sprintf("%s %s (", name, b.Version)
+	if b.Commit != "" {
+		s += "commit " + b.Commit + ", "
+	}
+	if b.Date != "" {
+		s += "built " + b.Date + ", "
+	}
+	return s + b.GoVersion + ")"
 }
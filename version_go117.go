@@ -0,0 +1,9 @@
+//go:build !go1.18
+// +build !go1.18
+
+package gochinadns
+
+import "runtime/debug"
+
+// fillVCSInfo does nothing, since builds of Go before 1.18 embed no VCS information.
+func fillVCSInfo(info *BuildInfo, bi *debug.BuildInfo) {}
@@ -0,0 +1,32 @@
+//go:build go1.18
+// +build go1.18
+
+package gochinadns
+
+import "runtime/debug"
+
+// fillVCSInfo fills the commit and the date of info which are not set by ldflags from the VCS revision and commit time
+// embedded in builds in a git checkout since Go 1.18.
+func fillVCSInfo(info *BuildInfo, bi *debug.BuildInfo) {
+	var revision, time string
+	modified := false
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.time":
+			time = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if info.Commit == "" && revision != "" {
+		info.Commit = revision
+		if modified {
+			info.Commit += "-dirty"
+		}
+	}
+	if info.Date == "" {
+		info.Date = time
+	}
+}
@@ -0,0 +1,32 @@
+//go:build go1.18
+// +build go1.18
+
+package gochinadns
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestFillBuildInfo(t *testing.T) {
+	bi := &debug.BuildInfo{
+		Main: debug.Module{Path: "github.com/cherrot/gochinadns", Version: "v1.2.0"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "abc1234"},
+			{Key: "vcs.time", Value: "2021-01-01T00:00:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+	info := BuildInfo{}
+	fillBuildInfo(&info, bi)
+	if want := (BuildInfo{Version: "v1.2.0", Commit: "abc1234-dirty", Date: "2021-01-01T00:00:00Z"}); info != want {
+		t.Errorf("fillBuildInfo() = %+v, want %+v", info, want)
+	}
+
+	// ldflags take precedence.
+	info = BuildInfo{Version: "v1.1", Commit: "def5678"}
+	fillBuildInfo(&info, bi)
+	if info.Version != "v1.1" || info.Commit != "def5678" || info.Date != "2021-01-01T00:00:00Z" {
+		t.Errorf("fillBuildInfo() = %+v, want ldflags kept", info)
+	}
+}
@@ -0,0 +1,32 @@
+package gochinadns
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestVersionQuery(t *testing.T) {
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithDelay(100*time.Millisecond), WithTestDomains())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("VERSION.BIND.", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	w := &explainWriter{}
+	result := s.serve(context.Background(), w, req, nil)
+	if result.path != pathLocal || result.reason != reasonVersion {
+		t.Errorf("version.bind is answered by path %s, reason %s", result.path, result.reason)
+	}
+	if len(w.reply.Answer) != 1 {
+		t.Fatalf("reply %v, want one TXT answer", w.reply)
+	}
+	txt := w.reply.Answer[0].(*dns.TXT)
+	if txt.Hdr.Class != dns.ClassCHAOS || !strings.HasPrefix(txt.Txt[0], GetVersion()) {
+		t.Errorf("answer %v, want %s", txt, GetVersion())
+	}
+}
@@ -0,0 +1,69 @@
+package gochinadns
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchFiles watches files of lists and config files, and reloads once changed files stay the same for the interval,
+// so that a file being written is not loaded.
+// Directories of the files are watched instead of the files, since lists are often replaced by renaming.
+func (s *Server) watchFiles(ctx context.Context, interval time.Duration) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		s.log.WithError(err).Error("Fail to watch files.")
+		return
+	}
+	defer watcher.Close()
+
+	files := s.watchDirs(watcher, nil)
+	timer := time.NewTimer(interval)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case err := <-watcher.Errors:
+			s.log.WithError(err).Warn("Fail to watch files.")
+		case event := <-watcher.Events:
+			if _, ok := files[filepath.Clean(event.Name)]; !ok || event.Op == fsnotify.Chmod {
+				continue
+			}
+			timer.Reset(interval)
+		case <-timer.C:
+			s.log.Info("Files changed. Reload.")
+			if err := s.Reload(); err != nil {
+				s.log.WithError(err).Error("Fail to reload changed files.")
+			}
+			// files may be added or removed by a changed config file.
+			files = s.watchDirs(watcher, files)
+		}
+	}
+}
+
+// watchDirs adds directories of the current files to the watcher, and returns the set of watched files.
+func (s *Server) watchDirs(watcher *fsnotify.Watcher, watched map[string]struct{}) map[string]struct{} {
+	files := make(map[string]struct{})
+	dirs := make(map[string]struct{})
+	for path := range watched {
+		dirs[filepath.Dir(path)] = struct{}{}
+	}
+	for _, path := range s.options().Files {
+		path = filepath.Clean(path)
+		files[path] = struct{}{}
+		dir := filepath.Dir(path)
+		if _, ok := dirs[dir]; ok {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			s.log.WithError(err).WithField("dir", dir).Warn("Fail to watch directory.")
+			continue
+		}
+		dirs[dir] = struct{}{}
+	}
+	return files
+}
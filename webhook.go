@@ -0,0 +1,115 @@
+package gochinadns
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// _webhookQueue is the max number of pending webhook events. Events are dropped when the queue is full.
+const _webhookQueue = 64
+
+// webhook posts JSON events to a URL asynchronously, so that DNS serving is never blocked by it.
+type webhook struct {
+	log    Logger
+	url    string
+	client *http.Client
+	queue  chan interface{}
+}
+
+func newWebhook(url string, log Logger) *webhook {
+	h := &webhook{
+		log:    log,
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+		queue:  make(chan interface{}, _webhookQueue),
+	}
+	go h.run()
+	return h
+}
+
+// Post queues an event to be posted. It does nothing if h is nil.
+func (h *webhook) Post(event interface{}) {
+	if h == nil {
+		return
+	}
+	select {
+	case h.queue <- event:
+	default:
+		h.log.WithField("webhook", h.url).Warn("Webhook queue is full. Drop event.")
+	}
+}
+
+func (h *webhook) run() {
+	for event := range h.queue {
+		if err := h.post(event); err != nil {
+			h.log.WithField("webhook", h.url).WithError(err).Error("Fail to post event.")
+		}
+	}
+}
+
+func (h *webhook) post(event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// upstreamWebhook posts changes of states of resolvers to a webhook, along with changes of whether every trusted
+// resolver is unreachable, so that monitoring notices the trusted path dies before users do.
+type upstreamWebhook struct {
+	s    *Server
+	hook *webhook
+
+	mu          sync.Mutex
+	unreachable bool //every trusted resolver is unreachable
+}
+
+func newUpstreamWebhook(s *Server, url string) *upstreamWebhook {
+	return &upstreamWebhook{s: s, hook: newWebhook(url, s.upstreamLog)}
+}
+
+// observe posts event, and a TrustedUnreachable or TrustedReachable event if the trusted path changes with it.
+func (h *upstreamWebhook) observe(event *UpstreamStateEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hook.Post(event)
+	if unreachable := h.s.trustedUnreachable(); unreachable != h.unreachable {
+		h.unreachable = unreachable
+		state := TrustedReachable
+		if unreachable {
+			h.s.upstreamLog.Error("Every trusted resolver is unreachable.")
+			state = TrustedUnreachable
+		} else {
+			h.s.upstreamLog.Info("A trusted resolver is reachable again.")
+		}
+		h.hook.Post(&UpstreamStateEvent{Time: event.Time, State: state})
+	}
+}
+
+// trustedUnreachable reports whether every trusted resolver is disabled, hijacked, its circuit is open,
+// or it's down over every protocol.
+func (s *Server) trustedUnreachable() bool {
+	o := s.options()
+	for _, server := range o.TrustedServers {
+		addr := server.GetAddr()
+		if !s.isDisabled(addr) && s.canary.reason(addr) == "" && !s.breaker.isOpen(addr) &&
+			len(s.health.downProtocols(addr)) < len(server.protocols) {
+			return false
+		}
+	}
+	return len(o.TrustedServers) > 0
+}
@@ -0,0 +1,122 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+func TestUpstreamWebhook(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []UpstreamStateEvent
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e UpstreamStateEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	addr1, addr2 := startTestUpstream(t, "1.2.3.4"), startTestUpstream(t, "1.2.3.4")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithSkipStartupTest(true),
+		WithTrustedResolvers("udp@"+addr1, "udp@"+addr2), WithCircuitBreaker(1, time.Minute),
+		WithUpstreamWebhook(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.breaker.observe(Resolver{addr: addr1}, errors.New("refused"))
+	if err := s.DisableResolver(addr2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableResolver(addr2); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []UpstreamStateEvent{
+		{Resolver: addr1, State: UpstreamCircuitOpen, Reason: "refused"},
+		{Resolver: addr2, State: UpstreamDisabled},
+		{State: TrustedUnreachable},
+		{Resolver: addr2, State: UpstreamEnabled},
+		{State: TrustedReachable},
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := len(events)
+		mu.Unlock()
+		if n >= len(want) || time.Now().After(deadline) {
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != len(want) {
+		t.Fatalf("posted events = %+v, want %+v", events, want)
+	}
+	for i, e := range events {
+		if e.Time.IsZero() || e.Resolver != want[i].Resolver || e.State != want[i].State || e.Reason != want[i].Reason {
+			t.Errorf("posted event %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+	if !s.Config().UpstreamHook {
+		t.Error("Config should report the upstream webhook")
+	}
+}
+
+func TestPollutionWebhook(t *testing.T) {
+	events := make(chan PollutionEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e PollutionEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		events <- e
+	}))
+	defer srv.Close()
+
+	var queries int32
+	trusted, untrusted := startSlowUpstream(t, &queries), startTestUpstream(t, "6.6.6.6")
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithCHNListSource(DataList([]byte("127.0.0.0/8\n"))),
+		WithIPBlacklistSource(DataList([]byte("6.6.6.0/24\n"))), WithTrustedResolvers("udp@"+trusted),
+		WithResolvers("udp@"+untrusted), WithTimeout(time.Second), WithSkipStartupTest(true),
+		WithPollutionWebhook(srv.URL), WithMetricsListen("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := new(explainWriter)
+	s.serve(s.ctx, w, req, nil)
+	if ips := answerIPs(w.reply); len(ips) != 1 || ips[0].String() != "1.2.3.4" {
+		t.Errorf("Answers = %v, want the trusted 1.2.3.4", ips)
+	}
+
+	select {
+	case e := <-events:
+		if e.Time.IsZero() || e.Domain != "example.com." || e.QType != "A" || len(e.IPs) != 1 || e.IPs[0] != "6.6.6.6" ||
+			e.Resolver != untrusted || e.Heuristic != heuristicIPBlacklist {
+			t.Errorf("Posted event = %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No pollution event is posted")
+	}
+	rec := httptest.NewRecorder()
+	s.metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if line := `chinadns_pollution_rejections_total{heuristic="ip-blacklist"} 1`; !strings.Contains(rec.Body.String(), line+"\n") {
+		t.Errorf("Metrics miss %s:\n%s", line, rec.Body)
+	}
+	if !s.Config().Webhook {
+		t.Error("Config should report the pollution webhook")
+	}
+}
@@ -0,0 +1,168 @@
+package gochinadns
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// _maxZoneCNAMEs is how many CNAMEs in a local zone are followed in a reply.
+const _maxZoneCNAMEs = 8
+
+// localZone is a zone of a zone file answered authoritatively, see WithZoneFile.
+type localZone struct {
+	origin string              //canonical name of the zone, which is the owner of its SOA
+	soa    *dns.SOA            //SOA of the zone, in the authority section of negative answers
+	names  map[string][]dns.RR //records by canonical owner name, with no records for empty non-terminals
+}
+
+// localZones are zones of zone files, of which the one of the longest origin containing a name answers it.
+type localZones []*localZone
+
+// match returns the zone of the longest origin containing name, or nil if there is none.
+func (zones localZones) match(name string) *localZone {
+	var zone *localZone
+	name = dns.CanonicalName(name)
+	for _, z := range zones {
+		if dns.IsSubDomain(z.origin, name) && (zone == nil || len(z.origin) > len(zone.origin)) {
+			zone = z
+		}
+	}
+	return zone
+}
+
+// WithZoneFile answers queries of the zone in the zone file of RFC 1035 at path authoritatively, before they are
+// resolved by upstreams, so that a small zone, such as of hosts at home, needs no authoritative server of its own.
+// The file has one SOA record, whose owner is the origin of the zone, and names out of the zone are invalid.
+// Relative names are relative to $ORIGIN of the file.
+//
+// Records of the name and type of a query answer it, following CNAMEs in the zone, and wildcard records answer names
+// which don't exist below their closest encloser. Otherwise it's answered NOERROR without answers if the name exists,
+// or NXDOMAIN if it doesn't, with the SOA in the authority section. Delegations of subzones are not followed.
+// The file is watched like lists.
+func WithZoneFile(path string) ServerOption {
+	return func(o *serverOptions) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "fail to open zone file")
+		}
+		defer f.Close()
+		o.Files = uniqueAppendString(o.Files, path)
+		zone := &localZone{names: make(map[string][]dns.RR)}
+		zp := dns.NewZoneParser(f, "", path)
+		var rrs []dns.RR
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if zone.soa != nil {
+					return errors.Errorf("%s: more than one SOA record", path)
+				}
+				zone.soa, zone.origin = soa, dns.CanonicalName(soa.Hdr.Name)
+			}
+			rrs = append(rrs, rr)
+		}
+		if err := zp.Err(); err != nil {
+			return errors.Wrap(err, "fail to parse zone file")
+		}
+		if zone.soa == nil {
+			return errors.Errorf("%s: no SOA record", path)
+		}
+		for _, z := range o.LocalZones {
+			if z.origin == zone.origin {
+				return errors.Errorf("%s: zone %s is loaded already", path, zone.origin)
+			}
+		}
+		for _, rr := range rrs {
+			name := dns.CanonicalName(rr.Header().Name)
+			if !dns.IsSubDomain(zone.origin, name) {
+				return errors.Errorf("%s: %s is out of zone %s", path, rr.Header().Name, zone.origin)
+			}
+			zone.names[name] = append(zone.names[name], rr)
+			// parents of the name exist as empty non-terminals.
+			for name != zone.origin {
+				name = name[strings.IndexByte(name, '.')+1:]
+				if _, ok := zone.names[name]; !ok {
+					zone.names[name] = nil
+				}
+			}
+		}
+		o.LocalZones = append(o.LocalZones, zone)
+		return nil
+	}
+}
+
+// lookup returns records of name, of the wildcard of its closest encloser if name doesn't exist, and whether either
+// of them exists.
+func (z *localZone) lookup(name string) ([]dns.RR, bool) {
+	if rrs, ok := z.names[name]; ok {
+		return rrs, true
+	}
+	for encloser := name; encloser != z.origin; {
+		encloser = encloser[strings.IndexByte(encloser, '.')+1:]
+		if _, ok := z.names[encloser]; ok {
+			rrs, ok := z.names["*."+encloser]
+			return rrs, ok
+		}
+	}
+	return nil, false
+}
+
+// reply returns the authoritative answer to req, whose name is in the zone.
+func (z *localZone) reply(req *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Authoritative = true
+	q := req.Question[0]
+	owner := q.Name
+	for i := 0; i <= _maxZoneCNAMEs; i++ {
+		rrs, ok := z.lookup(dns.CanonicalName(owner))
+		if !ok {
+			// names of CNAMEs which don't exist are NXDOMAIN as well, see RFC 6604.
+			reply.Rcode = dns.RcodeNameError
+			z.negative(reply)
+			return reply
+		}
+		var cname dns.RR
+		found := false
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; {
+			case t == q.Qtype || q.Qtype == dns.TypeANY:
+				reply.Answer = append(reply.Answer, renamedRR(rr, owner))
+				found = true
+			case t == dns.TypeCNAME:
+				cname = rr
+			}
+		}
+		if found || cname == nil {
+			if !found {
+				z.negative(reply)
+			}
+			return reply
+		}
+		reply.Answer = append(reply.Answer, renamedRR(cname, owner))
+		owner = cname.(*dns.CNAME).Target
+		if !dns.IsSubDomain(z.origin, dns.CanonicalName(owner)) {
+			// the target out of the zone is left to the client.
+			return reply
+		}
+	}
+	return reply
+}
+
+// negative adds the SOA of the zone to the authority section of a negative answer, with the negative TTL of RFC 2308.
+func (z *localZone) negative(reply *dns.Msg) {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	reply.Ns = append(reply.Ns, soa)
+}
+
+// renamedRR returns a copy of rr owned by name, such as the name of a query in the case it's sent,
+// or the one a wildcard record answers.
+func renamedRR(rr dns.RR, name string) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = name
+	return rr
+}
@@ -0,0 +1,106 @@
+package gochinadns
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := startTestUpstream(t, "1.2.3.4")
+	path := filepath.Join(dir, "home.lan.zone")
+	content := `$ORIGIN home.lan.
+$TTL 3600
+@        IN SOA  ns.home.lan. admin.home.lan. 1 3600 600 86400 300
+@        IN NS   ns
+ns       IN A    192.168.1.1
+nas      IN A    192.168.1.2
+         IN AAAA fd00::2
+www      IN CNAME nas
+ext      IN CNAME www.example.com.
+a.b.deep IN A    192.168.1.3
+*.dev    IN A    192.168.1.4
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(WithListenAddr("127.0.0.1:0"), WithTrustedResolvers("udp@"+upstream),
+		WithSkipStartupTest(true), WithZoneFile(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers []string //owner names and data of answers
+		soa     bool
+	}{
+		{"NAS.home.lan.", dns.TypeA, dns.RcodeSuccess, []string{"NAS.home.lan. 192.168.1.2"}, false},
+		{"nas.home.lan.", dns.TypeAAAA, dns.RcodeSuccess, []string{"nas.home.lan. fd00::2"}, false},
+		{"nas.home.lan.", dns.TypeTXT, dns.RcodeSuccess, nil, true},
+		{"www.home.lan.", dns.TypeA, dns.RcodeSuccess, []string{"www.home.lan. nas.home.lan.", "nas.home.lan. 192.168.1.2"}, false},
+		{"ext.home.lan.", dns.TypeA, dns.RcodeSuccess, []string{"ext.home.lan. www.example.com."}, false},
+		{"deep.home.lan.", dns.TypeA, dns.RcodeSuccess, nil, true},
+		{"missing.home.lan.", dns.TypeA, dns.RcodeNameError, nil, true},
+		{"x.dev.home.lan.", dns.TypeA, dns.RcodeSuccess, []string{"x.dev.home.lan. 192.168.1.4"}, false},
+		{"home.lan.", dns.TypeNS, dns.RcodeSuccess, []string{"home.lan. ns.home.lan."}, false},
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.com. 1.2.3.4"}, false},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, tt.qtype)
+		w := new(explainWriter)
+		s.Serve(w, req)
+		if w.reply == nil {
+			t.Fatalf("No reply to %s", tt.name)
+		}
+		if w.reply.Rcode != tt.rcode {
+			t.Errorf("Rcode of %s %s = %s, want %s", tt.name, dns.TypeToString[tt.qtype], dns.RcodeToString[w.reply.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		var answers []string
+		for _, rr := range w.reply.Answer {
+			answers = append(answers, rr.Header().Name+" "+dns.Field(rr, 1))
+		}
+		if len(answers) != len(tt.answers) {
+			t.Errorf("Answers of %s %s = %v, want %v", tt.name, dns.TypeToString[tt.qtype], answers, tt.answers)
+		} else {
+			for i := range answers {
+				if answers[i] != tt.answers[i] {
+					t.Errorf("Answers of %s %s = %v, want %v", tt.name, dns.TypeToString[tt.qtype], answers, tt.answers)
+					break
+				}
+			}
+		}
+		local := tt.name != "www.example.com."
+		if w.reply.Authoritative != local {
+			t.Errorf("Authoritative of %s = %v, want %v", tt.name, w.reply.Authoritative, local)
+		}
+		if soa := len(w.reply.Ns) == 1 && w.reply.Ns[0].Header().Ttl == 300; soa != tt.soa {
+			t.Errorf("Authority of %s %s = %v, want SOA %v", tt.name, dns.TypeToString[tt.qtype], w.reply.Ns, tt.soa)
+		}
+	}
+	if zones := s.Config().Zones; len(zones) != 1 || zones[0] != "home.lan." {
+		t.Errorf("Config().Zones = %v, want home.lan.", zones)
+	}
+
+	for _, content := range []string{
+		"$ORIGIN home.lan.\nnas IN A 192.168.1.2\n",
+		"$ORIGIN home.lan.\n@ IN SOA ns admin 1 3600 600 86400 300\nnas.example.com. IN A 192.168.1.2\n",
+		"$ORIGIN home.lan.\n@ IN SOA ns admin 1 3600 600 86400 300\nnas IN A 192.168.1\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := WithZoneFile(path)(new(serverOptions)); err == nil {
+			t.Errorf("Zone file should fail:\n%s", content)
+		}
+	}
+}